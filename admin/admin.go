@@ -0,0 +1,421 @@
+/*
+Package admin provides an HTTP API exposing and changing the runtime state of the middlewares of a proxy: the servers
+of the load balancers and their weights, the state of the circuit breakers, the token buckets of the rate limiters,
+the connections of the connection limiters and the retries of the buffers.
+
+The API answers JSON:
+
+	GET    /balancers                   the servers of the balancers and their weights
+	PUT    /balancers/{name}            adds or updates a server, e.g. {"url": "http://10.0.0.1:8080", "weight": 2}
+	DELETE /balancers/{name}?url={url}  removes a server
+	GET    /breakers                    the states of the circuit breakers
+	GET    /breakers/{name}             the states and the window stats of a circuit breaker, or of each key of a
+	                                    keyed circuit breaker
+	POST   /breakers/{name}/trip        trips a circuit breaker
+	POST   /breakers/{name}/reset       sets a circuit breaker back to standby
+	GET    /limiters                    the number of sources of the rate limiters
+	GET    /limiters/{name}?source={s}  the token buckets of a source
+	GET    /connlimits                  the connections of the connection limiters, per source
+	GET    /buffers                     the request counters of the buffers
+
+It must be protected, e.g. served on an internal listener or behind an authentication middleware, as it lets the
+callers change the routing of the traffic.
+
+Examples of an admin API:
+
+	a, err := admin.New(
+		admin.Balancer("backends", lb),
+		admin.Breaker("backends", cb),
+		admin.Limiter("clients", limiter))
+
+	mux.Handle("/admin/", http.StripPrefix("/admin", a))
+*/
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/buffer"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/connlimit"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/utils"
+)
+
+// LoadBalancer is a load balancer managed by the API, e.g. a roundrobin.RoundRobin or a roundrobin.Rebalancer.
+// The weights of the servers are exposed when it implements ServerWeight(u *url.URL) (int, bool).
+type LoadBalancer interface {
+	Servers() []*url.URL
+	UpsertServer(u *url.URL, options ...roundrobin.ServerOption) error
+	RemoveServer(u *url.URL) error
+}
+
+type weighted interface {
+	ServerWeight(u *url.URL) (int, bool)
+}
+
+// Server is a server of a load balancer
+type Server struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// ConnLimit is the usage of a connection limiter, GlobalMax is the limit of all the sources if any
+type ConnLimit struct {
+	Max         int64            `json:"max"`
+	GlobalMax   int64            `json:"globalMax,omitempty"`
+	Total       int64            `json:"total"`
+	Connections map[string]int64 `json:"connections"`
+}
+
+// Admin is the handler of the admin API
+type Admin struct {
+	balancers  map[string]LoadBalancer
+	breakers   map[string]*cbreaker.CircuitBreaker
+	keyed      map[string]*cbreaker.Keyed
+	limiters   map[string]*ratelimit.TokenLimiter
+	connlimits map[string]*connlimit.ConnLimiter
+	buffers    map[string]*buffer.Buffer
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Admin
+type Option func(a *Admin) error
+
+// New creates a new admin API, the middlewares are registered with the options
+func New(opts ...Option) (*Admin, error) {
+	a := &Admin{
+		balancers:  make(map[string]LoadBalancer),
+		breakers:   make(map[string]*cbreaker.CircuitBreaker),
+		keyed:      make(map[string]*cbreaker.Keyed),
+		limiters:   make(map[string]*ratelimit.TokenLimiter),
+		connlimits: make(map[string]*connlimit.ConnLimiter),
+		buffers:    make(map[string]*buffer.Buffer),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func checkName(kind, name string, isNil, registered bool) error {
+	if name == "" {
+		return fmt.Errorf("%s name can not be empty", kind)
+	}
+	if isNil {
+		return fmt.Errorf("%s %s can not be nil", kind, name)
+	}
+	if registered {
+		return fmt.Errorf("%s %s already exists", kind, name)
+	}
+	return nil
+}
+
+// Balancer registers a load balancer
+func Balancer(name string, lb LoadBalancer) Option {
+	return func(a *Admin) error {
+		_, ok := a.balancers[name]
+		if err := checkName("balancer", name, lb == nil, ok); err != nil {
+			return err
+		}
+		a.balancers[name] = lb
+		return nil
+	}
+}
+
+// Breaker registers a circuit breaker
+func Breaker(name string, cb *cbreaker.CircuitBreaker) Option {
+	return func(a *Admin) error {
+		_, ok := a.breakers[name]
+		_, keyed := a.keyed[name]
+		if err := checkName("breaker", name, cb == nil, ok || keyed); err != nil {
+			return err
+		}
+		a.breakers[name] = cb
+		return nil
+	}
+}
+
+// KeyedBreaker registers a keyed circuit breaker, the circuit breakers of its keys are listed by
+// GET /breakers/{name}
+func KeyedBreaker(name string, k *cbreaker.Keyed) Option {
+	return func(a *Admin) error {
+		_, ok := a.breakers[name]
+		_, keyed := a.keyed[name]
+		if err := checkName("breaker", name, k == nil, ok || keyed); err != nil {
+			return err
+		}
+		a.keyed[name] = k
+		return nil
+	}
+}
+
+// Limiter registers a rate limiter
+func Limiter(name string, tl *ratelimit.TokenLimiter) Option {
+	return func(a *Admin) error {
+		_, ok := a.limiters[name]
+		if err := checkName("limiter", name, tl == nil, ok); err != nil {
+			return err
+		}
+		a.limiters[name] = tl
+		return nil
+	}
+}
+
+// ConnLimiter registers a connection limiter
+func ConnLimiter(name string, cl *connlimit.ConnLimiter) Option {
+	return func(a *Admin) error {
+		_, ok := a.connlimits[name]
+		if err := checkName("connection limiter", name, cl == nil, ok); err != nil {
+			return err
+		}
+		a.connlimits[name] = cl
+		return nil
+	}
+}
+
+// Buffer registers a buffer
+func Buffer(name string, b *buffer.Buffer) Option {
+	return func(a *Admin) error {
+		_, ok := a.buffers[name]
+		if err := checkName("buffer", name, b == nil, ok); err != nil {
+			return err
+		}
+		a.buffers[name] = b
+		return nil
+	}
+}
+
+// Logger defines the logger the admin API will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(a *Admin) error {
+		a.log = l
+		return nil
+	}
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if a.log.Level >= log.DebugLevel {
+		logEntry := a.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/admin: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/admin: completed ServeHttp on request")
+	}
+
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch segments[0] {
+	case "balancers":
+		a.serveBalancers(w, req, segments[1:])
+	case "breakers":
+		a.serveBreakers(w, req, segments[1:])
+	case "limiters":
+		a.serveLimiters(w, req, segments[1:])
+	case "connlimits":
+		if !allow(w, req, len(segments) == 1, http.MethodGet) {
+			return
+		}
+		usage := make(map[string]ConnLimit, len(a.connlimits))
+		for name, cl := range a.connlimits {
+			connections := cl.Connections()
+			var total int64
+			for _, n := range connections {
+				total += n
+			}
+			usage[name] = ConnLimit{Max: cl.MaxConnections(), GlobalMax: cl.MaxTotalConnections(), Total: total, Connections: connections}
+		}
+		reply(w, usage)
+	case "buffers":
+		if !allow(w, req, len(segments) == 1, http.MethodGet) {
+			return
+		}
+		stats := make(map[string]buffer.Stats, len(a.buffers))
+		for name, b := range a.buffers {
+			stats[name] = b.Stats()
+		}
+		reply(w, stats)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (a *Admin) serveBalancers(w http.ResponseWriter, req *http.Request, segments []string) {
+	if len(segments) == 0 {
+		if !allow(w, req, true, http.MethodGet) {
+			return
+		}
+		balancers := make(map[string][]Server, len(a.balancers))
+		for name, lb := range a.balancers {
+			balancers[name] = servers(lb)
+		}
+		reply(w, balancers)
+		return
+	}
+	lb, ok := a.balancers[segments[0]]
+	if !allow(w, req, ok && len(segments) == 1, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var s Server
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid server: %v", err), http.StatusBadRequest)
+			return
+		}
+		u, err := parseURL(s.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var options []roundrobin.ServerOption
+		if s.Weight != 0 {
+			options = append(options, roundrobin.Weight(s.Weight))
+		}
+		if err := lb.UpsertServer(u, options...); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.log.Infof("vulcand/oxy/admin: balancer %s: upserted server %s", segments[0], u)
+	case http.MethodDelete:
+		u, err := parseURL(req.URL.Query().Get("url"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := lb.RemoveServer(u); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		a.log.Infof("vulcand/oxy/admin: balancer %s: removed server %s", segments[0], u)
+	}
+	reply(w, servers(lb))
+}
+
+func (a *Admin) serveBreakers(w http.ResponseWriter, req *http.Request, segments []string) {
+	if len(segments) == 0 {
+		if !allow(w, req, true, http.MethodGet) {
+			return
+		}
+		states := make(map[string]string, len(a.breakers))
+		for name, cb := range a.breakers {
+			states[name] = cb.State()
+		}
+		reply(w, states)
+		return
+	}
+	if len(segments) == 1 {
+		if k, ok := a.keyed[segments[0]]; ok {
+			if allow(w, req, true, http.MethodGet) {
+				reply(w, k.Breakers())
+			}
+			return
+		}
+		cb, ok := a.breakers[segments[0]]
+		if allow(w, req, ok, http.MethodGet) {
+			reply(w, []cbreaker.BreakerStats{cb.Stats()})
+		}
+		return
+	}
+	cb, ok := a.breakers[segments[0]]
+	if !allow(w, req, ok && len(segments) == 2 && (segments[1] == "trip" || segments[1] == "reset"), http.MethodPost) {
+		return
+	}
+	if segments[1] == "trip" {
+		cb.Trip()
+	} else {
+		cb.Reset()
+	}
+	a.log.Infof("vulcand/oxy/admin: breaker %s: %s", segments[0], segments[1])
+	reply(w, map[string]string{segments[0]: cb.State()})
+}
+
+func (a *Admin) serveLimiters(w http.ResponseWriter, req *http.Request, segments []string) {
+	if len(segments) == 0 {
+		if !allow(w, req, true, http.MethodGet) {
+			return
+		}
+		sources := make(map[string]int, len(a.limiters))
+		for name, tl := range a.limiters {
+			sources[name] = tl.Sources()
+		}
+		reply(w, sources)
+		return
+	}
+	tl, ok := a.limiters[segments[0]]
+	if !allow(w, req, ok && len(segments) == 1, http.MethodGet) {
+		return
+	}
+	source := req.URL.Query().Get("source")
+	if source == "" {
+		http.Error(w, "source is required", http.StatusBadRequest)
+		return
+	}
+	buckets, ok := tl.Buckets(source)
+	if !ok {
+		http.Error(w, fmt.Sprintf("source %s not found", source), http.StatusNotFound)
+		return
+	}
+	reply(w, buckets)
+}
+
+// allow replies 404 when the resource is not found and 405 when the method is not allowed
+func allow(w http.ResponseWriter, req *http.Request, found bool, methods ...string) bool {
+	if !found {
+		http.NotFound(w, req)
+		return false
+	}
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+func servers(lb LoadBalancer) []Server {
+	urls := lb.Servers()
+	servers := make([]Server, len(urls))
+	for i, u := range urls {
+		servers[i].URL = u.String()
+		if wlb, ok := lb.(weighted); ok {
+			servers[i].Weight, _ = wlb.ServerWeight(u)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].URL < servers[j].URL })
+	return servers
+}
+
+func parseURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, errors.New("server url is required")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server url %q", s)
+	}
+	return u, nil
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,213 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/buffer"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/connlimit"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func call(t *testing.T, a *Admin, method, path, body string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if v != nil && rec.Code == http.StatusOK {
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(v))
+	}
+	return rec.Code
+}
+
+func TestBalancers(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	lb, err := roundrobin.New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:8080")))
+
+	a, err := New(Balancer("backends", lb))
+	require.NoError(t, err)
+
+	var balancers map[string][]Server
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/balancers", "", &balancers))
+	assert.Equal(t, map[string][]Server{"backends": {{URL: "http://localhost:8080", Weight: 1}}}, balancers)
+
+	var servers []Server
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodPut, "/balancers/backends", `{"url": "http://localhost:8081", "weight": 3}`, &servers))
+	assert.Equal(t, []Server{{URL: "http://localhost:8080", Weight: 1}, {URL: "http://localhost:8081", Weight: 3}}, servers)
+
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodDelete, "/balancers/backends?url=http://localhost:8080", "", &servers))
+	assert.Equal(t, []Server{{URL: "http://localhost:8081", Weight: 3}}, servers)
+
+	assert.Equal(t, http.StatusNotFound, call(t, a, http.MethodDelete, "/balancers/backends?url=http://localhost:8080", "", nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, a, http.MethodPut, "/balancers/backends", `{"url": "localhost"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, a, http.MethodPut, "/balancers/backends", `{`, nil))
+	assert.Equal(t, http.StatusNotFound, call(t, a, http.MethodGet, "/balancers/unknown", "", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, call(t, a, http.MethodPost, "/balancers/backends", "", nil))
+}
+
+func TestBreakers(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	cb, err := cbreaker.New(handler, "NetworkErrorRatio() > 0.5", cbreaker.FallbackDuration(time.Minute))
+	require.NoError(t, err)
+
+	a, err := New(Breaker("backends", cb))
+	require.NoError(t, err)
+
+	var states map[string]string
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/breakers", "", &states))
+	assert.Equal(t, map[string]string{"backends": "standby"}, states)
+
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodPost, "/breakers/backends/trip", "", &states))
+	assert.Equal(t, map[string]string{"backends": "tripped"}, states)
+	assert.True(t, cb.Tripped())
+
+	rec := httptest.NewRecorder()
+	cb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodPost, "/breakers/backends/reset", "", &states))
+	assert.Equal(t, map[string]string{"backends": "standby"}, states)
+
+	rec = httptest.NewRecorder()
+	cb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, call(t, a, http.MethodGet, "/breakers/backends/trip", "", nil))
+	assert.Equal(t, http.StatusNotFound, call(t, a, http.MethodPost, "/breakers/backends/open", "", nil))
+}
+
+func TestBreakerStats(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	cb, err := cbreaker.New(handler, "NetworkErrorRatio() > 0.5")
+	require.NoError(t, err)
+
+	extract, err := utils.NewExtractor("request.host")
+	require.NoError(t, err)
+	k, err := cbreaker.NewKeyed(handler, "NetworkErrorRatio() > 0.5", extract)
+	require.NoError(t, err)
+	for _, host := range []string{"b", "a"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		k.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	a, err := New(Breaker("backends", cb), KeyedBreaker("hosts", k))
+	require.NoError(t, err)
+
+	var stats []cbreaker.BreakerStats
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/breakers/backends", "", &stats))
+	require.Len(t, stats, 1)
+	assert.Equal(t, "standby", stats[0].State)
+
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/breakers/hosts", "", &stats))
+	require.Len(t, stats, 2)
+	assert.Equal(t, "a", stats[0].Key)
+	assert.Equal(t, int64(1), stats[0].Requests)
+	assert.Equal(t, "b", stats[1].Key)
+
+	assert.Equal(t, http.StatusNotFound, call(t, a, http.MethodGet, "/breakers/unknown", "", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, call(t, a, http.MethodPost, "/breakers/hosts", "", nil))
+
+	_, err = New(Breaker("backends", cb), KeyedBreaker("backends", k))
+	require.Error(t, err)
+}
+
+func TestLimiters(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	rates := ratelimit.NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 3))
+	clock := testutils.GetClock()
+	extractor, err := utils.NewExtractor("client.ip")
+	require.NoError(t, err)
+	tl, err := ratelimit.New(handler, extractor, rates, ratelimit.Clock(clock))
+	require.NoError(t, err)
+
+	a, err := New(Limiter("clients", tl))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	tl.ServeHTTP(httptest.NewRecorder(), req)
+
+	var sources map[string]int
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/limiters", "", &sources))
+	assert.Equal(t, map[string]int{"clients": 1}, sources)
+
+	var buckets []ratelimit.BucketState
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/limiters/clients?source=192.0.2.1", "", &buckets))
+	assert.Equal(t, []ratelimit.BucketState{{Period: time.Second, Average: 1, Burst: 3, Available: 2}}, buckets)
+
+	assert.Equal(t, http.StatusNotFound, call(t, a, http.MethodGet, "/limiters/clients?source=192.0.2.2", "", nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, a, http.MethodGet, "/limiters/clients", "", nil))
+}
+
+func TestConnLimitsAndBuffers(t *testing.T) {
+	var cl *connlimit.ConnLimiter
+	var a *Admin
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var usage map[string]ConnLimit
+		assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/connlimits", "", &usage))
+		assert.Equal(t, map[string]ConnLimit{"clients": {Max: 2, Total: 1, Connections: map[string]int64{"192.0.2.1": 1}}}, usage)
+		w.WriteHeader(http.StatusOK)
+	})
+	extractor, err := utils.NewExtractor("client.ip")
+	require.NoError(t, err)
+	cl, err = connlimit.New(handler, extractor, 2)
+	require.NoError(t, err)
+	b, err := buffer.New(cl, buffer.MaxRequestBodyBytes(4))
+	require.NoError(t, err)
+
+	a, err = New(ConnLimiter("clients", cl), Buffer("uploads", b))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hi"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	b.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large"))
+	b.ServeHTTP(httptest.NewRecorder(), req)
+
+	var usage map[string]ConnLimit
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/connlimits", "", &usage))
+	assert.Equal(t, map[string]ConnLimit{"clients": {Max: 2, Total: 0, Connections: map[string]int64{}}}, usage)
+
+	var stats map[string]buffer.Stats
+	assert.Equal(t, http.StatusOK, call(t, a, http.MethodGet, "/buffers", "", &stats))
+	assert.Equal(t, map[string]buffer.Stats{"uploads": {Requests: 1, Rejected: 1}}, stats)
+}
+
+func TestNew(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	lb, err := roundrobin.New(fwd)
+	require.NoError(t, err)
+
+	_, err = New(Balancer("", lb))
+	assert.Error(t, err)
+	_, err = New(Balancer("backends", nil))
+	assert.Error(t, err)
+	_, err = New(Balancer("backends", lb), Balancer("backends", lb))
+	assert.Error(t, err)
+
+	a, err := New()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, call(t, a, http.MethodGet, "/unknown", "", nil))
+}
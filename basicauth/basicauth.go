@@ -0,0 +1,160 @@
+/*
+Package basicauth provides a middleware enforcing the Basic authentication of the requests.
+
+The credentials are checked by a pluggable Verifier: htpasswd files, maps of password hashes or callbacks.
+Unauthenticated requests are challenged with a 401 response and the WWW-Authenticate header. The identity of the
+authenticated user is stored in the request context, see utils.IdentityFromContext, it is used by the
+request.identity extractors of the rate and connection limiters.
+
+Examples of a basic auth middleware:
+
+	verifier, err := basicauth.Htpasswd("/etc/oxy/.htpasswd")
+
+	ba, err := basicauth.New(handler, verifier, basicauth.Realm("admin"), basicauth.UserHeader("X-Forwarded-User"))
+
+	// the authenticated requests are limited per user
+	extractor, err := utils.NewExtractor("request.identity")
+	limiter, err := ratelimit.New(handler, extractor, rates)
+	ba, err := basicauth.New(limiter, verifier)
+*/
+package basicauth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultRealm is the realm of the challenges
+const DefaultRealm = "Restricted"
+
+// BasicAuth is a middleware authenticating the requests with their Basic credentials
+type BasicAuth struct {
+	next                http.Handler
+	verifier            Verifier
+	realm               string
+	removeHeader        bool
+	userHeader          string
+	unauthorizedHandler http.Handler
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for BasicAuth
+type Option func(ba *BasicAuth) error
+
+// New creates a new BasicAuth middleware checking the credentials with the verifier
+func New(next http.Handler, verifier Verifier, opts ...Option) (*BasicAuth, error) {
+	if verifier == nil {
+		return nil, fmt.Errorf("verifier can not be nil")
+	}
+	ba := &BasicAuth{
+		next:                next,
+		verifier:            verifier,
+		realm:               DefaultRealm,
+		unauthorizedHandler: http.HandlerFunc(unauthorized),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(ba); err != nil {
+			return nil, err
+		}
+	}
+	return ba, nil
+}
+
+// Realm sets the realm of the challenges, it defaults to DefaultRealm
+func Realm(realm string) Option {
+	return func(ba *BasicAuth) error {
+		if strings.ContainsAny(realm, "\"\\\r\n") {
+			return fmt.Errorf("invalid realm %q", realm)
+		}
+		ba.realm = realm
+		return nil
+	}
+}
+
+// RemoveHeader removes the Authorization header from the authenticated requests, so that the credentials are
+// not forwarded to the upstreams
+func RemoveHeader(remove bool) Option {
+	return func(ba *BasicAuth) error {
+		ba.removeHeader = remove
+		return nil
+	}
+}
+
+// UserHeader sets the name of the header telling the upstreams the authenticated user, e.g. X-Forwarded-User.
+// The header sent by the client is replaced.
+func UserHeader(name string) Option {
+	return func(ba *BasicAuth) error {
+		ba.userHeader = name
+		return nil
+	}
+}
+
+// UnauthorizedHandler sets the handler replying to the unauthenticated requests, once the challenge header is set.
+// It defaults to a 401 Unauthorized response.
+func UnauthorizedHandler(h http.Handler) Option {
+	return func(ba *BasicAuth) error {
+		if h == nil {
+			return fmt.Errorf("unauthorized handler can not be nil")
+		}
+		ba.unauthorizedHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the basic auth middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(ba *BasicAuth) error {
+		ba.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by basic auth handler.
+func (ba *BasicAuth) Wrap(next http.Handler) error {
+	ba.next = next
+	return nil
+}
+
+func (ba *BasicAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if ba.log.Level >= log.DebugLevel {
+		logEntry := ba.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/basicauth: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/basicauth: completed ServeHttp on request")
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok || !ba.verifier.Verify(user, password) {
+		if ok {
+			ba.log.Debugf("vulcand/oxy/basicauth: invalid credentials for user %q", user)
+		}
+		w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(ba.realm)+`, charset="UTF-8"`)
+		ba.unauthorizedHandler.ServeHTTP(w, req)
+		return
+	}
+
+	outReq := req.WithContext(utils.WithIdentity(req.Context(), &utils.Identity{Scheme: utils.AuthSchemeBasic, Name: user}))
+	if ba.removeHeader || ba.userHeader != "" {
+		outReq.Header = utils.CloneHeaders(req.Header)
+		if ba.removeHeader {
+			outReq.Header.Del("Authorization")
+		}
+		if ba.userHeader != "" {
+			outReq.Header.Set(ba.userHeader, user)
+		}
+	}
+	ba.next.ServeHTTP(w, outReq)
+}
+
+func unauthorized(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
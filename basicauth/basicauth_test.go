@@ -0,0 +1,126 @@
+package basicauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	verifier := VerifierFunc(func(user, password string) bool {
+		return user == "alice" && password == "secret"
+	})
+
+	testCases := []struct {
+		desc         string
+		user         string
+		password     string
+		noAuth       bool
+		expectedCode int
+	}{
+		{desc: "valid", user: "alice", password: "secret", expectedCode: http.StatusOK},
+		{desc: "invalid password", user: "alice", password: "wrong", expectedCode: http.StatusUnauthorized},
+		{desc: "unknown user", user: "bob", password: "secret", expectedCode: http.StatusUnauthorized},
+		{desc: "no credentials", noAuth: true, expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var identity *utils.Identity
+			var header http.Header
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				identity, _ = utils.IdentityFromContext(req.Context())
+				header = req.Header
+			})
+			ba, err := New(next, verifier, Realm("admin"), RemoveHeader(true), UserHeader("X-Forwarded-User"))
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-User", "mallory")
+			if !test.noAuth {
+				req.SetBasicAuth(test.user, test.password)
+			}
+			rec := httptest.NewRecorder()
+			ba.ServeHTTP(rec, req)
+			assert.Equal(t, test.expectedCode, rec.Code)
+
+			if test.expectedCode != http.StatusOK {
+				assert.Equal(t, `Basic realm="admin", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+				assert.Nil(t, header)
+				return
+			}
+			assert.Empty(t, rec.Header().Get("WWW-Authenticate"))
+			require.NotNil(t, identity)
+			assert.Equal(t, "basic:alice", identity.String())
+			assert.Empty(t, header.Get("Authorization"))
+			assert.Equal(t, "alice", header.Get("X-Forwarded-User"))
+			// the request of the client is left untouched
+			assert.NotEmpty(t, req.Header.Get("Authorization"))
+		})
+	}
+}
+
+func TestBasicAuthUnauthorizedHandler(t *testing.T) {
+	unauthorized := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("custom"))
+	})
+	ba, err := New(http.NotFoundHandler(), VerifierFunc(func(string, string) bool { return false }), UnauthorizedHandler(unauthorized))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	ba.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "custom", rec.Body.String())
+	assert.Equal(t, `Basic realm="Restricted", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestBasicAuthInvalidOptions(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), nil)
+	assert.Error(t, err)
+
+	verifier := VerifierFunc(func(string, string) bool { return true })
+	_, err = New(http.NotFoundHandler(), verifier, Realm(`"`))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), verifier, UnauthorizedHandler(nil))
+	assert.Error(t, err)
+}
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	file := strings.Join([]string{
+		"# users",
+		"bcrypt:" + string(bcryptHash),
+		"apr1:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/",
+		"",
+		"sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	}, "\n")
+	verifier, err := ParseHtpasswd(strings.NewReader(file))
+	require.NoError(t, err)
+
+	for _, user := range []string{"bcrypt", "apr1", "sha"} {
+		assert.True(t, verifier.Verify(user, "password"), user)
+		assert.False(t, verifier.Verify(user, "wrong"), user)
+	}
+	assert.False(t, verifier.Verify("unknown", "password"))
+}
+
+func TestUsersInvalidHash(t *testing.T) {
+	for _, h := range []string{"password", "$apr1$salt", "{SHA}abc", "$2y$invalid"} {
+		_, err := Users(map[string]string{"user": h})
+		assert.Error(t, err, h)
+	}
+
+	_, err := ParseHtpasswd(strings.NewReader("no separator"))
+	assert.Error(t, err)
+}
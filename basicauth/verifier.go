@@ -0,0 +1,207 @@
+package basicauth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Verifier checks the credentials of the users
+type Verifier interface {
+	Verify(user, password string) bool
+}
+
+// VerifierFunc is an adapter to use a function as a Verifier, e.g. to check the credentials against a database
+type VerifierFunc func(user, password string) bool
+
+// Verify calls f(user, password)
+func (f VerifierFunc) Verify(user, password string) bool {
+	return f(user, password)
+}
+
+// hashVerifier checks the passwords against their hashes
+type hashVerifier map[string]hash
+
+// Users returns a Verifier checking the passwords against the hashes of the users.
+// Supported hashes are bcrypt ($2y$, as created by htpasswd -B), MD5 ($apr1$, htpasswd -m) and SHA1 ({SHA}, htpasswd -s).
+func Users(users map[string]string) (Verifier, error) {
+	v := make(hashVerifier, len(users))
+	for user, h := range users {
+		parsed, err := parseHash(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid password hash of %q: %v", user, err)
+		}
+		v[user] = parsed
+	}
+	return v, nil
+}
+
+// Htpasswd returns a Verifier checking the passwords against the hashes of an htpasswd file, see Users for the
+// supported hashes. The file is read once.
+func Htpasswd(path string) (Verifier, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd returns a Verifier checking the passwords against the hashes of the user:hash lines,
+// empty lines and lines starting with # are ignored
+func ParseHtpasswd(r io.Reader) (Verifier, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid htpasswd line %d", line)
+		}
+		users[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return Users(users)
+}
+
+func (v hashVerifier) Verify(user, password string) bool {
+	h, ok := v[user]
+	if !ok {
+		return false
+	}
+	return h.matches(password)
+}
+
+type hash interface {
+	matches(password string) bool
+}
+
+func parseHash(h string) (hash, error) {
+	switch {
+	case strings.HasPrefix(h, "$2a$"), strings.HasPrefix(h, "$2b$"), strings.HasPrefix(h, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(h)); err != nil {
+			return nil, err
+		}
+		return bcryptHash(h), nil
+	case strings.HasPrefix(h, apr1Magic):
+		parts := strings.Split(h, "$")
+		if len(parts) != 4 || len(parts[2]) == 0 || len(parts[2]) > 8 {
+			return nil, fmt.Errorf("malformed apr1 hash")
+		}
+		return apr1Hash{salt: parts[2], hash: h}, nil
+	case strings.HasPrefix(h, shaPrefix):
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(h, shaPrefix))
+		if err != nil || len(sum) != sha1.Size {
+			return nil, fmt.Errorf("malformed SHA1 hash")
+		}
+		return shaHash(sum), nil
+	}
+	return nil, fmt.Errorf("unsupported hash format")
+}
+
+type bcryptHash string
+
+func (h bcryptHash) matches(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(h), []byte(password)) == nil
+}
+
+const shaPrefix = "{SHA}"
+
+type shaHash []byte
+
+func (h shaHash) matches(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return subtle.ConstantTimeCompare(h, sum[:]) == 1
+}
+
+const apr1Magic = "$apr1$"
+
+type apr1Hash struct {
+	salt string
+	hash string
+}
+
+func (h apr1Hash) matches(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(h.hash), []byte(apr1(password, h.salt))) == 1
+}
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes the Apache variant of the MD5 crypt hash
+func apr1(password, salt string) string {
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic + salt))
+	for i := len(pw); i > 0; i -= md5.Size {
+		n := i
+		if n > md5.Size {
+			n = md5.Size
+		}
+		ctx.Write(altSum[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	out := []byte(apr1Magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return string(out)
+}
@@ -0,0 +1,417 @@
+/*
+Package bodyrewrite provides a middleware replacing text in the response bodies, e.g. the absolute URLs of a backend
+pointing to its internal host name.
+
+The replacements are literal strings or regular expressions, applied in order on the responses having one of the
+configured content types. The bodies are rewritten while they are streamed: only the last bytes, that may be the
+beginning of a match continuing in the next write, are held back. The matches of a regular expression are therefore
+limited in length, and the expressions should not rely on the ^ and $ anchors.
+
+The rewritten responses lose their Content-Length, their ETag becomes weak. The gzip and deflate responses are
+decoded, rewritten and encoded again, the responses encoded with another content coding are passed through.
+
+Examples of a body rewriting:
+
+	r, err := bodyrewrite.New(handler,
+		bodyrewrite.Literal("http://backend.internal:8080/", "https://www.example.com/"),
+		bodyrewrite.Regexp(`data-env="[a-z]+"`, `data-env="production"`, 32))
+*/
+package bodyrewrite
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultContentTypes are the content types rewritten unless configured otherwise
+var DefaultContentTypes = []string{
+	"text/html",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+}
+
+// replacement holds a compiled replacement, hold is the number of bytes held back between the writes
+type replacement struct {
+	re      *regexp.Regexp
+	repl    []byte
+	literal bool
+	hold    int
+}
+
+// Rewriter is a middleware rewriting the response bodies
+type Rewriter struct {
+	next         http.Handler
+	replacements []replacement
+	contentTypes []string
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Rewriter
+type Option func(r *Rewriter) error
+
+// New creates a new Rewriter middleware, at least one replacement is required
+func New(next http.Handler, opts ...Option) (*Rewriter, error) {
+	r := &Rewriter{
+		next:         next,
+		contentTypes: DefaultContentTypes,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.replacements) == 0 {
+		return nil, fmt.Errorf("at least one replacement is required")
+	}
+	return r, nil
+}
+
+// Literal replaces all the occurrences of old by new
+func Literal(old, new string) Option {
+	return func(r *Rewriter) error {
+		if old == "" {
+			return fmt.Errorf("the replaced string can not be empty")
+		}
+		r.replacements = append(r.replacements, replacement{
+			re:      regexp.MustCompile(regexp.QuoteMeta(old)),
+			repl:    []byte(new),
+			literal: true,
+			hold:    len(old) - 1,
+		})
+		return nil
+	}
+}
+
+// Regexp replaces the matches of the regular expression by repl, in which $1 or ${name} are replaced by the
+// submatches as in regexp.Expand. The matches longer than maxLength bytes may be missed at the boundaries of the writes.
+func Regexp(expr, repl string, maxLength int) Option {
+	return func(r *Rewriter) error {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		if re.MatchString("") {
+			return fmt.Errorf("regular expression %q should not match an empty string", expr)
+		}
+		if maxLength <= 0 {
+			return fmt.Errorf("max match length should be > 0, got %d", maxLength)
+		}
+		r.replacements = append(r.replacements, replacement{re: re, repl: []byte(repl), hold: maxLength - 1})
+		return nil
+	}
+}
+
+// ContentTypes sets the content types to rewrite, "type/*" matches all the subtypes of a type
+func ContentTypes(types ...string) Option {
+	return func(r *Rewriter) error {
+		r.contentTypes = types
+		return nil
+	}
+}
+
+// Logger defines the logger the body rewriter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(r *Rewriter) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by body rewriter handler.
+func (r *Rewriter) Wrap(next http.Handler) error {
+	r.next = next
+	return nil
+}
+
+func (r *Rewriter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/bodyrewrite: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/bodyrewrite: completed ServeHttp on request")
+	}
+
+	rw := &rewriteWriter{w: w, rewriter: r, head: req.Method == http.MethodHead}
+	defer func() {
+		if err := rw.close(); err != nil {
+			r.log.Errorf("vulcand/oxy/bodyrewrite: failed to complete response, err: %v", err)
+		}
+	}()
+	r.next.ServeHTTP(rw, req)
+}
+
+func (r *Rewriter) isRewrittenType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range r.contentTypes {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// stage applies a replacement on the stream, holding back the bytes that may be the beginning of a match
+type stage struct {
+	replacement
+	buf  []byte
+	next io.Writer
+}
+
+func (s *stage) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	if err := s.process(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// process writes the rewritten buffer to the next writer, but the bytes held back if the stream is not over
+func (s *stage) process(final bool) error {
+	safe := len(s.buf)
+	if !final {
+		safe -= s.hold
+	}
+	if safe <= 0 {
+		return nil
+	}
+
+	var out []byte
+	pos := 0
+	for _, m := range s.re.FindAllSubmatchIndex(s.buf, -1) {
+		if m[0] >= safe {
+			// the match may continue in the next write
+			break
+		}
+		out = append(out, s.buf[pos:m[0]]...)
+		if s.literal {
+			out = append(out, s.repl...)
+		} else {
+			out = s.re.Expand(out, s.repl, s.buf, m)
+		}
+		pos = m[1]
+	}
+	if pos < safe {
+		out = append(out, s.buf[pos:safe]...)
+		pos = safe
+	}
+	s.buf = s.buf[:copy(s.buf, s.buf[pos:])]
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := s.next.Write(out)
+	return err
+}
+
+// encoder is the compressor of a gzip or deflate response
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// rewriteWriter rewrites the body of the responses having a rewritten content type
+type rewriteWriter struct {
+	w        http.ResponseWriter
+	rewriter *Rewriter
+	head     bool
+
+	wroteHeader bool
+	hijacked    bool
+	stages      []*stage
+
+	// the compressed responses are decoded by a goroutine reading the body from the pipe,
+	// mutex guards the encoder and the response writer it writes to
+	mutex   sync.Mutex
+	encoder encoder
+	pipe    *io.PipeWriter
+	decoded chan error
+}
+
+func (rw *rewriteWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *rewriteWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	if rw.eligible(code) {
+		rw.start()
+	}
+	rw.w.WriteHeader(code)
+}
+
+func (rw *rewriteWriter) eligible(code int) bool {
+	if rw.head || code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		return false
+	}
+	h := rw.w.Header()
+	if h.Get("Content-Range") != "" {
+		return false
+	}
+	switch strings.ToLower(h.Get("Content-Encoding")) {
+	case "", "identity", "gzip", "deflate":
+	default:
+		return false
+	}
+	return rw.rewriter.isRewrittenType(h.Get("Content-Type"))
+}
+
+// start sets up the stages of the replacements
+func (rw *rewriteWriter) start() {
+	h := rw.w.Header()
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the rewritten representation is not byte for byte identical to the original one
+		h.Set("ETag", "W/"+etag)
+	}
+
+	var newReader func(r io.Reader) (io.Reader, error)
+	switch strings.ToLower(h.Get("Content-Encoding")) {
+	case "gzip":
+		rw.encoder = gzip.NewWriter(rw.w)
+		newReader = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "deflate":
+		// the level is valid, flate.NewWriter can not fail
+		rw.encoder, _ = flate.NewWriter(rw.w, flate.DefaultCompression)
+		newReader = func(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil }
+	}
+
+	var out io.Writer = &lockedWriter{rw: rw}
+	rw.stages = make([]*stage, len(rw.rewriter.replacements))
+	for i := len(rw.stages) - 1; i >= 0; i-- {
+		rw.stages[i] = &stage{replacement: rw.rewriter.replacements[i], next: out}
+		out = rw.stages[i]
+	}
+	if newReader != nil {
+		rw.decode(newReader)
+	}
+}
+
+// decode starts the goroutine decoding the body written to the pipe
+func (rw *rewriteWriter) decode(newReader func(r io.Reader) (io.Reader, error)) {
+	pr, pw := io.Pipe()
+	rw.pipe = pw
+	rw.decoded = make(chan error, 1)
+	go func() {
+		r, err := newReader(pr)
+		if err == nil {
+			_, err = io.Copy(rw.stages[0], r)
+		}
+		// the handler writes fail once the body can not be decoded
+		pr.CloseWithError(err)
+		rw.decoded <- err
+	}()
+}
+
+func (rw *rewriteWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		if rw.w.Header().Get("Content-Type") == "" {
+			rw.w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case rw.stages == nil:
+		return rw.w.Write(p)
+	case rw.pipe != nil:
+		return rw.pipe.Write(p)
+	default:
+		return rw.stages[0].Write(p)
+	}
+}
+
+// Flush sends the rewritten data to the client, but the bytes that may be the beginning of a match
+func (rw *rewriteWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	if rw.encoder != nil {
+		if err := rw.encoder.Flush(); err != nil {
+			rw.rewriter.log.Errorf("vulcand/oxy/bodyrewrite: failed to flush encoder, err: %v", err)
+			return
+		}
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, the response is not rewritten by then.
+func (rw *rewriteWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := rw.w.(http.Hijacker); ok {
+		rw.hijacked = true
+		rw.wroteHeader = true
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this bodyrewrite middleware does not implement http.Hijacker(type: %T)", rw.w)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (rw *rewriteWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// close writes the bytes held back by the stages once the handler returned
+func (rw *rewriteWriter) close() error {
+	if rw.hijacked || rw.stages == nil {
+		return nil
+	}
+	if rw.pipe != nil {
+		rw.pipe.Close()
+		if err := <-rw.decoded; err != nil {
+			return err
+		}
+	}
+	for _, s := range rw.stages {
+		if err := s.process(true); err != nil {
+			return err
+		}
+	}
+	if rw.encoder != nil {
+		return rw.encoder.Close()
+	}
+	return nil
+}
+
+// lockedWriter is the last stage, writing to the encoder or to the response writer
+type lockedWriter struct {
+	rw *rewriteWriter
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.rw.mutex.Lock()
+	defer l.rw.mutex.Unlock()
+	if l.rw.encoder != nil {
+		return l.rw.encoder.Write(p)
+	}
+	return l.rw.w.Write(p)
+}
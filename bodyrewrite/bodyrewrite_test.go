@@ -0,0 +1,181 @@
+package bodyrewrite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunked writes the body in chunks of size bytes, flushing each one
+func chunked(contentType, body string, size int) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", "1")
+		w.Header().Set("ETag", `"v1"`)
+		for len(body) > 0 {
+			n := size
+			if n > len(body) {
+				n = len(body)
+			}
+			w.Write([]byte(body[:n]))
+			w.(http.Flusher).Flush()
+			body = body[n:]
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	body := `<a href="http://backend:8080/a">a</a> <a href="http://backend:8080/b">b</a> <p data-id="42">`
+	testCases := []struct {
+		desc     string
+		opts     []Option
+		expected string
+	}{
+		{
+			desc:     "literal",
+			opts:     []Option{Literal("http://backend:8080/", "https://example.com/")},
+			expected: `<a href="https://example.com/a">a</a> <a href="https://example.com/b">b</a> <p data-id="42">`,
+		},
+		{
+			desc:     "regexp with submatches",
+			opts:     []Option{Regexp(`data-id="(\d+)"`, `data-ref="id-$1"`, 32)},
+			expected: `<a href="http://backend:8080/a">a</a> <a href="http://backend:8080/b">b</a> <p data-ref="id-42">`,
+		},
+		{
+			desc: "replacements in order",
+			opts: []Option{
+				Literal("http://backend:8080/", "https://example.com/"),
+				Literal("https://example.com/b", "https://cdn.example.com/b"),
+			},
+			expected: `<a href="https://example.com/a">a</a> <a href="https://cdn.example.com/b">b</a> <p data-id="42">`,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			// every chunk size splits the matches at another place
+			for size := 1; size <= len(body); size++ {
+				r, err := New(chunked("text/html; charset=utf-8", body, size), test.opts...)
+				require.NoError(t, err)
+
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+				require.Equal(t, test.expected, rec.Body.String(), "chunk size %d", size)
+				assert.Empty(t, rec.Header().Get("Content-Length"))
+				assert.Equal(t, `W/"v1"`, rec.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestRewritePassThrough(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{
+			desc:    "other content type",
+			method:  http.MethodGet,
+			handler: chunked("image/png", "http://backend/", 4),
+		},
+		{
+			desc:   "partial content",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("http://backend/"))
+			},
+		},
+		{
+			desc:   "other content coding",
+			method: http.MethodGet,
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", "br")
+				w.Write([]byte("http://backend/"))
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			r, err := New(test.handler, Literal("http://backend/", "https://example.com/"))
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(test.method, "/", nil))
+			assert.Equal(t, "http://backend/", rec.Body.String())
+		})
+	}
+}
+
+func TestRewriteGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(strings.Repeat("see http://backend/ ", 1000)))
+	gz.Close()
+
+	r, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		b := compressed.Bytes()
+		for len(b) > 0 {
+			n := 100
+			if n > len(b) {
+				n = len(b)
+			}
+			w.Write(b[:n])
+			b = b[n:]
+		}
+	}), Literal("http://backend/", "https://example.com/"), ContentTypes("text/*"))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+
+	gr, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	decoded, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("see https://example.com/ ", 1000), string(decoded))
+}
+
+func TestRewriteInvalidGzip(t *testing.T) {
+	r, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte("this is not a gzip body"))
+		// the body could not be decoded
+		_, err := w.Write([]byte("this is not a gzip body"))
+		assert.Error(t, err)
+	}), Literal("a", "b"))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, opts := range [][]Option{
+		nil,
+		{Literal("", "a")},
+		{Regexp("(", "a", 10)},
+		{Regexp("a*", "b", 10)},
+		{Regexp("a+", "b", 0)},
+	} {
+		_, err := New(http.NotFoundHandler(), opts...)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,220 @@
+package buffer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/multibuf"
+)
+
+const (
+	// DefaultBudgetMaxQueue is the default number of requests a buffer queues for the budget
+	DefaultBudgetMaxQueue = 100
+	// DefaultBudgetQueueTimeout is the default time a request waits in the queue for the budget
+	DefaultBudgetQueueTimeout = 10 * time.Second
+)
+
+// BudgetPolicy is what the buffer does with a request when the memory budget is spent
+type BudgetPolicy int
+
+const (
+	// BudgetStream passes the request to the next handler as is, without buffering: the request is streamed and
+	// can not be retried, the reads of its body fail once it is over MaxRequestBodyBytes
+	BudgetStream BudgetPolicy = iota
+	// BudgetQueue holds the request until enough of the budget is released, the request is rejected when the queue
+	// is full or when it waits more than the queue timeout, see BudgetQueueLimits
+	BudgetQueue
+)
+
+// BudgetError is passed to the error handler when a request is rejected by the queue of the budget, it replies 503
+type BudgetError struct {
+	TimedOut bool
+}
+
+func (e *BudgetError) Error() string {
+	if e.TimedOut {
+		return "timed out waiting for the memory budget"
+	}
+	return "memory budget queue is full"
+}
+
+// StatusCode returns 503 Service Unavailable
+func (e *BudgetError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// MemoryBudget bounds the memory buffered by all the requests in flight, shared by one or more buffers, e.g. the
+// buffers of all the routes of a proxy: the per request limits can not prevent a burst of large requests from
+// exhausting the memory.
+//
+// A request reserves the memory it may buffer before it is buffered: its body size up to the memory limit of the
+// request bodies, plus the memory limit of the response bodies. The bodies buffered to disk are not counted.
+type MemoryBudget struct {
+	mutex    sync.Mutex
+	capacity int64
+	used     int64
+	// released is closed and replaced each time memory is released, to wake up the queued requests
+	released chan struct{}
+}
+
+// NewMemoryBudget creates a memory budget of capacity bytes
+func NewMemoryBudget(capacity int64) (*MemoryBudget, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("memory budget should be > 0, got %d", capacity)
+	}
+	return &MemoryBudget{capacity: capacity, released: make(chan struct{})}, nil
+}
+
+// Used returns the memory reserved by the requests in flight
+func (m *MemoryBudget) Used() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.used
+}
+
+// Capacity returns the capacity of the budget
+func (m *MemoryBudget) Capacity() int64 {
+	return m.capacity
+}
+
+// tryReserve reserves n bytes if they are available, it returns the channel closed on the next release otherwise.
+// A request reserving more than the capacity is let through once no other request holds memory.
+func (m *MemoryBudget) tryReserve(n int64) (bool, <-chan struct{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.used+n <= m.capacity || m.used == 0 {
+		m.used += n
+		return true, nil
+	}
+	return false, m.released
+}
+
+func (m *MemoryBudget) release(n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.used -= n
+	close(m.released)
+	m.released = make(chan struct{})
+}
+
+// Budget sets the memory budget the buffer reserves the memory of the requests from, and the policy of the requests
+// once it is spent
+func Budget(budget *MemoryBudget, policy BudgetPolicy) optSetter {
+	return func(b *Buffer) error {
+		if budget == nil {
+			return fmt.Errorf("memory budget can not be nil")
+		}
+		if policy != BudgetStream && policy != BudgetQueue {
+			return fmt.Errorf("unknown budget policy: %d", policy)
+		}
+		b.budget = budget
+		b.budgetPolicy = policy
+		return nil
+	}
+}
+
+// BudgetQueueLimits sets the number of requests the buffer queues for the budget with BudgetQueue, and the maximum
+// time they wait, they default to DefaultBudgetMaxQueue and DefaultBudgetQueueTimeout
+func BudgetQueueLimits(maxQueue int, timeout time.Duration) optSetter {
+	return func(b *Buffer) error {
+		if maxQueue < 0 {
+			return fmt.Errorf("budget max queue should be >= 0, got %d", maxQueue)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("budget queue timeout should be > 0, got %v", timeout)
+		}
+		b.budgetMaxQueue = int32(maxQueue)
+		b.budgetQueueTimeout = timeout
+		return nil
+	}
+}
+
+// reservation returns the memory a request may buffer
+func (b *Buffer) reservation(req *http.Request) int64 {
+	n := b.memRequestBodyBytes
+	if req.ContentLength >= 0 && req.ContentLength < n {
+		n = req.ContentLength
+	}
+	return n + b.memResponseBodyBytes
+}
+
+// reserve reserves the memory of the request, it returns false when the request was served without buffering
+func (b *Buffer) reserve(w http.ResponseWriter, req *http.Request, n int64) bool {
+	ok, released := b.budget.tryReserve(n)
+	if ok {
+		return true
+	}
+	atomic.AddInt64(&b.stats.OverBudget, 1)
+
+	if b.budgetPolicy == BudgetStream {
+		b.log.Debugf("vulcand/oxy/buffer: memory budget spent, streaming Request(%v %v)", req.Method, req.URL)
+		if b.maxRequestBodyBytes > 0 && req.Body != nil {
+			req.Body = &streamedBody{ReadCloser: req.Body, remaining: b.maxRequestBodyBytes, buffer: b}
+		}
+		b.next.ServeHTTP(w, req)
+		return false
+	}
+
+	if atomic.AddInt32(&b.budgetQueued, 1) > b.budgetMaxQueue {
+		atomic.AddInt32(&b.budgetQueued, -1)
+		b.log.Debugf("vulcand/oxy/buffer: memory budget queue is full, rejecting Request(%v %v)", req.Method, req.URL)
+		b.errHandler.ServeHTTP(w, req, &BudgetError{})
+		return false
+	}
+	defer atomic.AddInt32(&b.budgetQueued, -1)
+
+	timer := time.NewTimer(b.budgetQueueTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-released:
+		case <-timer.C:
+			b.log.Debugf("vulcand/oxy/buffer: timed out waiting for the memory budget, rejecting Request(%v %v)", req.Method, req.URL)
+			b.errHandler.ServeHTTP(w, req, &BudgetError{TimedOut: true})
+			return false
+		case <-req.Context().Done():
+			b.errHandler.ServeHTTP(w, req, req.Context().Err())
+			return false
+		}
+		if ok, released = b.budget.tryReserve(n); ok {
+			return true
+		}
+	}
+}
+
+// streamedBody fails the reads of a streamed request body past MaxRequestBodyBytes, like the buffered bodies
+type streamedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+	buffer    *Buffer
+}
+
+func (s *streamedBody) Read(p []byte) (int, error) {
+	if s.exceeded {
+		return 0, s.tooLarge()
+	}
+	// read one more byte than allowed to detect the bodies exceeding the limit
+	if int64(len(p)) > s.remaining+1 {
+		p = p[:s.remaining+1]
+	}
+	n, err := s.ReadCloser.Read(p)
+	if int64(n) > s.remaining {
+		s.exceeded = true
+		s.buffer.recordRejected()
+		return int(s.remaining), s.tooLarge()
+	}
+	s.remaining -= int64(n)
+	return n, err
+}
+
+func (s *streamedBody) tooLarge() error {
+	return &bodyTooLargeError{err: &multibuf.MaxSizeReachedError{MaxSize: s.buffer.maxRequestBodyBytes}}
+}
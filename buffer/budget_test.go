@@ -0,0 +1,189 @@
+package buffer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		policy         BudgetPolicy
+		expectedLength int64
+	}{
+		{desc: "stream", policy: BudgetStream, expectedLength: -1},
+		{desc: "queue", policy: BudgetQueue, expectedLength: 5},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			entered := make(chan struct{})
+			unblock := make(chan struct{})
+			var served int32
+			lengths := make(chan int64, 1)
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&served, 1)
+				if req.URL.Path == "/block" {
+					close(entered)
+					<-unblock
+				} else {
+					lengths <- req.ContentLength
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("hello"))
+			})
+
+			budget, err := NewMemoryBudget(20)
+			require.NoError(t, err)
+
+			st, err := New(handler, MemRequestBodyBytes(10), MemResponseBodyBytes(10), Budget(budget, test.policy))
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(st)
+			defer srv.Close()
+
+			blocked := make(chan error, 1)
+			go func() {
+				_, err := http.Post(srv.URL+"/block", "text/plain", strings.NewReader("hello"))
+				blocked <- err
+			}()
+			<-entered
+			assert.Equal(t, int64(15), budget.Used())
+
+			// the chunked request reserves 10 bytes for its body and 10 for its response
+			done := make(chan error, 1)
+			go func() {
+				re, err := http.Post(srv.URL, "text/plain", ioutil.NopCloser(io.MultiReader(strings.NewReader("hello"))))
+				if err == nil {
+					re.Body.Close()
+				}
+				done <- err
+			}()
+
+			if test.policy == BudgetQueue {
+				time.Sleep(50 * time.Millisecond)
+				assert.Equal(t, int32(1), atomic.LoadInt32(&served))
+				close(unblock)
+			}
+			require.NoError(t, <-done)
+			assert.Equal(t, test.expectedLength, <-lengths)
+			if test.policy == BudgetStream {
+				close(unblock)
+			}
+			require.NoError(t, <-blocked)
+
+			assert.Equal(t, int64(0), budget.Used())
+			assert.Equal(t, int64(1), st.Stats().OverBudget)
+		})
+	}
+}
+
+func TestMemoryBudgetQueueLimits(t *testing.T) {
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			close(entered)
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	budget, err := NewMemoryBudget(10)
+	require.NoError(t, err)
+
+	st, err := New(handler, MemRequestBodyBytes(10), MemResponseBodyBytes(10),
+		Budget(budget, BudgetQueue), BudgetQueueLimits(1, 100*time.Millisecond))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(st)
+	defer srv.Close()
+
+	go http.Get(srv.URL + "/block")
+	<-entered
+	defer close(unblock)
+
+	// the first request over the budget waits in the queue until the timeout, the second one finds it full
+	timedOut := make(chan int, 1)
+	go func() {
+		re, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		re.Body.Close()
+		timedOut <- re.StatusCode
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt32(&st.budgetQueued) == 1 })
+
+	re, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	re.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	assert.Equal(t, http.StatusServiceUnavailable, <-timedOut)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&st.budgetQueued))
+}
+
+func TestMemoryBudgetStreamLimit(t *testing.T) {
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	errs := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			close(entered)
+			<-unblock
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, err := ioutil.ReadAll(req.Body)
+		errs <- err
+	})
+
+	budget, err := NewMemoryBudget(20)
+	require.NoError(t, err)
+
+	st, err := New(handler, MemRequestBodyBytes(10), MemResponseBodyBytes(10), MaxRequestBodyBytes(10),
+		Budget(budget, BudgetStream))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(st)
+	defer srv.Close()
+
+	go http.Get(srv.URL + "/block")
+	<-entered
+	defer close(unblock)
+
+	// the streamed chunked body is over the limit
+	re, err := http.Post(srv.URL, "text/plain", ioutil.NopCloser(strings.NewReader(strings.Repeat("hello", 4))))
+	require.NoError(t, err)
+	re.Body.Close()
+
+	assert.True(t, utils.IsError(<-errs, utils.ErrBodyTooLarge))
+	assert.EqualValues(t, 1, st.Stats().Rejected)
+}
+
+func TestMemoryBudgetInvalid(t *testing.T) {
+	_, err := NewMemoryBudget(0)
+	require.Error(t, err)
+
+	budget, err := NewMemoryBudget(10)
+	require.NoError(t, err)
+	_, err = New(http.NotFoundHandler(), Budget(nil, BudgetStream))
+	require.Error(t, err)
+	_, err = New(http.NotFoundHandler(), Budget(budget, BudgetPolicy(42)))
+	require.Error(t, err)
+	_, err = New(http.NotFoundHandler(), BudgetQueueLimits(-1, time.Second))
+	require.Error(t, err)
+	_, err = New(http.NotFoundHandler(), BudgetQueueLimits(1, 0))
+	require.Error(t, err)
+}
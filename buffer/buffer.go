@@ -43,9 +43,12 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"sync/atomic"
+	"time"
 
 	"github.com/mailgun/multibuf"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -60,9 +63,28 @@ const (
 
 var errHandler utils.ErrorHandler = &SizeErrHandler{}
 
+// Stats are the counters of the requests handled by the buffer
+type Stats struct {
+	// Requests is the number of requests buffered
+	Requests int64 `json:"requests"`
+	// Retried is the number of requests retried at least once
+	Retried int64 `json:"retried"`
+	// Retries is the number of retry attempts
+	Retries int64 `json:"retries"`
+	// Rejected is the number of requests rejected as their body is over the limit
+	Rejected int64 `json:"rejected"`
+	// OverBudget is the number of requests streamed or queued as the memory budget was spent
+	OverBudget int64 `json:"overBudget"`
+	// Coalesced is the number of requests served with the response of an identical in-flight request
+	Coalesced int64 `json:"coalesced"`
+}
+
 // Buffer is responsible for buffering requests and responses
 // It buffers large requests and responses to disk,
 type Buffer struct {
+	// stats is first to be 64-bit aligned for the atomic operations
+	stats Stats
+
 	maxRequestBodyBytes int64
 	memRequestBodyBytes int64
 
@@ -73,6 +95,20 @@ type Buffer struct {
 
 	next       http.Handler
 	errHandler utils.ErrorHandler
+	metrics    *bufferMetrics
+	events     events.Emitter
+	skip       func(req *http.Request) bool
+
+	budget             *MemoryBudget
+	budgetPolicy       BudgetPolicy
+	budgetMaxQueue     int32
+	budgetQueueTimeout time.Duration
+	// budgetQueued is the number of requests waiting for the budget
+	budgetQueued int32
+
+	flights *flightGroup
+	// checksums verifies the checksums of the request bodies, see ValidateChecksums
+	checksums bool
 
 	log *log.Logger
 }
@@ -88,7 +124,10 @@ func New(next http.Handler, setters ...optSetter) (*Buffer, error) {
 		maxResponseBodyBytes: DefaultMaxBodyBytes,
 		memResponseBodyBytes: DefaultMemBodyBytes,
 
-		log: log.StandardLogger(),
+		budgetMaxQueue:     DefaultBudgetMaxQueue,
+		budgetQueueTimeout: DefaultBudgetQueueTimeout,
+
+		log: utils.InheritedLogger(),
 	}
 	for _, s := range setters {
 		if err := s(strm); err != nil {
@@ -98,6 +137,9 @@ func New(next http.Handler, setters ...optSetter) (*Buffer, error) {
 	if strm.errHandler == nil {
 		strm.errHandler = errHandler
 	}
+	if strm.flights != nil {
+		strm.errHandler = &flightErrHandler{ErrorHandler: strm.errHandler}
+	}
 
 	return strm, nil
 }
@@ -148,6 +190,15 @@ func Retry(predicate string) optSetter {
 	}
 }
 
+// SkipFunc sets a predicate of the requests passed to the next handler without being buffered,
+// e.g. the streaming uploads
+func SkipFunc(skip func(req *http.Request) bool) optSetter {
+	return func(b *Buffer) error {
+		b.skip = skip
+		return nil
+	}
+}
+
 // ErrorHandler sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) optSetter {
 	return func(b *Buffer) error {
@@ -215,18 +266,60 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/buffer: completed ServeHttp on request")
 	}
 
+	if b.skip != nil && b.skip(req) {
+		b.next.ServeHTTP(w, req)
+		return
+	}
+
+	if b.flights != nil && b.flights.coalescable(req) {
+		b.serveCoalesced(w, req)
+		return
+	}
+
+	b.serveBuffered(w, req)
+}
+
+// serveBuffered buffers the request and the response
+func (b *Buffer) serveBuffered(w http.ResponseWriter, req *http.Request) {
 	if err := b.checkLimit(req); err != nil {
+		b.recordRejected()
 		b.log.Errorf("vulcand/oxy/buffer: request body over limit, err: %v", err)
 		b.errHandler.ServeHTTP(w, req, err)
 		return
 	}
 
+	if b.budget != nil {
+		reserved := b.reservation(req)
+		if !b.reserve(w, req, reserved) {
+			return
+		}
+		defer b.budget.release(reserved)
+	}
+
 	// Read the body while keeping limits in mind. This reader controls the maximum bytes
 	// to read into memory and disk. This reader returns an error if the total request size exceeds the
 	// predefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
 	// and the reader would be unbounded bufio in the http.Server
-	body, err := multibuf.New(req.Body, multibuf.MaxBytes(b.maxRequestBodyBytes), multibuf.MemBytes(b.memRequestBodyBytes))
+	var input io.Reader = req.Body
+	var checksums *bodyChecksums
+	if b.checksums {
+		var err error
+		if checksums, err = newBodyChecksums(req.Header); err != nil {
+			b.log.Debugf("vulcand/oxy/buffer: rejecting request with malformed checksums, err: %v", err)
+			b.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		if checksums != nil && req.Body != nil {
+			input = checksums.reader(req.Body)
+		}
+	}
+
+	body, err := multibuf.New(input, multibuf.MaxBytes(b.maxRequestBodyBytes), multibuf.MemBytes(b.memRequestBodyBytes))
 	if err != nil || body == nil {
+		if e, ok := err.(*multibuf.MaxSizeReachedError); ok {
+			b.recordRejected()
+			err = &bodyTooLargeError{err: e}
+		}
 		b.log.Errorf("vulcand/oxy/buffer: error when reading request body, err: %v", err)
 		b.errHandler.ServeHTTP(w, req, err)
 		return
@@ -244,6 +337,14 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
+	if checksums != nil {
+		if err := checksums.verify(); err != nil {
+			b.log.Debugf("vulcand/oxy/buffer: rejecting request, err: %v", err)
+			b.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+	}
+
 	// We need to set ContentLength based on known request size. The incoming request may have been
 	// set without content length or using chunked TransferEncoding
 	totalSize, err := body.Size()
@@ -258,6 +359,7 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	outreq := b.copyRequest(req, body, totalSize)
+	atomic.AddInt64(&b.stats.Requests, 1)
 
 	attempt := 1
 	for {
@@ -287,6 +389,9 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		var reader multibuf.MultiReader
 		if bw.expectBody(outreq) {
 			rdr, err := writer.Reader()
+			if e, ok := err.(*multibuf.MaxSizeReachedError); ok {
+				err = &bodyTooLargeError{err: e}
+			}
 			if err != nil {
 				b.log.Errorf("vulcand/oxy/buffer: failed to read response, err: %v", err)
 				b.errHandler.ServeHTTP(w, req, err)
@@ -307,6 +412,16 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 
 		attempt++
+		if attempt == 2 {
+			atomic.AddInt64(&b.stats.Retried, 1)
+		}
+		atomic.AddInt64(&b.stats.Retries, 1)
+		if b.metrics != nil {
+			b.metrics.retries.Inc()
+		}
+		if b.events != nil {
+			b.events.Emit(events.RetryPerformed{Request: req, Attempt: attempt, Code: bw.code})
+		}
 		if body != nil {
 			if _, err := body.Seek(0, 0); err != nil {
 				b.log.Errorf("vulcand/oxy/buffer: failed to rewind response body, err: %v", err)
@@ -320,11 +435,29 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Stats returns the counters of the requests handled by the buffer
+func (b *Buffer) Stats() Stats {
+	return Stats{
+		Requests:   atomic.LoadInt64(&b.stats.Requests),
+		Retried:    atomic.LoadInt64(&b.stats.Retried),
+		Retries:    atomic.LoadInt64(&b.stats.Retries),
+		Rejected:   atomic.LoadInt64(&b.stats.Rejected),
+		OverBudget: atomic.LoadInt64(&b.stats.OverBudget),
+		Coalesced:  atomic.LoadInt64(&b.stats.Coalesced),
+	}
+}
+
+func (b *Buffer) recordRejected() {
+	atomic.AddInt64(&b.stats.Rejected, 1)
+	if b.metrics != nil {
+		b.metrics.rejected.Inc()
+	}
+}
+
 func (b *Buffer) copyRequest(req *http.Request, body io.ReadCloser, bodySize int64) *http.Request {
 	o := *req
 	o.URL = utils.CopyURL(req.URL)
-	o.Header = make(http.Header)
-	utils.CopyHeaders(o.Header, req.Header)
+	o.Header = utils.CloneHeaders(req.Header)
 	o.ContentLength = bodySize
 	// remove TransferEncoding that could have been previously set because we have transformed the request from chunked encoding
 	o.TransferEncoding = []string{}
@@ -342,7 +475,7 @@ func (b *Buffer) checkLimit(req *http.Request) error {
 		return nil
 	}
 	if req.ContentLength > b.maxRequestBodyBytes {
-		return &multibuf.MaxSizeReachedError{MaxSize: b.maxRequestBodyBytes}
+		return &bodyTooLargeError{err: &multibuf.MaxSizeReachedError{MaxSize: b.maxRequestBodyBytes}}
 	}
 	return nil
 }
@@ -420,11 +553,30 @@ func (b *bufferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return nil, nil, fmt.Errorf("the response writer wrapped in this proxy does not implement http.Hijacker. Its type is: %v", reflect.TypeOf(b.responseWriter))
 }
 
+// bodyTooLargeError is a request or a response body over the limit, it matches utils.ErrBodyTooLarge
+type bodyTooLargeError struct {
+	err *multibuf.MaxSizeReachedError
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return e.err.Error()
+}
+
+// Is matches utils.ErrBodyTooLarge
+func (e *bodyTooLargeError) Is(target error) bool {
+	return target == utils.ErrBodyTooLarge
+}
+
+// Unwrap returns the *multibuf.MaxSizeReachedError
+func (e *bodyTooLargeError) Unwrap() error {
+	return e.err
+}
+
 // SizeErrHandler Size error handler
 type SizeErrHandler struct{}
 
 func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
-	if _, ok := err.(*multibuf.MaxSizeReachedError); ok {
+	if utils.IsError(err, utils.ErrBodyTooLarge) {
 		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
 		return
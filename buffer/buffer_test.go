@@ -9,11 +9,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/metrics"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
 )
@@ -266,6 +269,31 @@ func TestCustomErrorHandler(t *testing.T) {
 	assert.Equal(t, http.StatusTeapot, re.StatusCode)
 }
 
+func TestBodyTooLargeError(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var handled []error
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handled = append(handled, err)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	st, err := New(handler, MaxRequestBodyBytes(4), ErrorHandler(errHandler))
+	require.NoError(t, err)
+
+	// the first request announces its length, the second is read up to the limit
+	st.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large")))
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large"))
+	req.ContentLength = -1
+	st.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Len(t, handled, 2)
+	for _, err := range handled {
+		assert.True(t, utils.IsError(err, utils.ErrBodyTooLarge))
+	}
+}
+
 func TestNotModified(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusNotModified)
@@ -392,3 +420,87 @@ func TestNotNilBody(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 	assert.Equal(t, "hello", string(body))
 }
+
+func TestMetrics(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+	registry := metrics.NewRegistry()
+
+	st, err := New(handler, Retry(`ResponseCode() == 502 && Attempts() <= 2`), MaxRequestBodyBytes(4), Metrics(registry))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	re, _, err = testutils.Get(proxy.URL, testutils.Body("this request is too long"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, "oxy_buffer_retries_total 1\n")
+	assert.Contains(t, gathered, "oxy_buffer_rejected_total 1\n")
+}
+
+func TestEvents(t *testing.T) {
+	attempts := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+	bus := events.NewBus()
+	var received []events.RetryPerformed
+	bus.Subscribe(func(m events.Message) {
+		received = append(received, m.Event.(events.RetryPerformed))
+	})
+
+	st, err := New(handler, Retry(`ResponseCode() == 502 && Attempts() <= 2`), Events(bus))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	require.Len(t, received, 2)
+	assert.Equal(t, 2, received[0].Attempt)
+	assert.Equal(t, http.StatusBadGateway, received[0].Code)
+	assert.Equal(t, 3, received[1].Attempt)
+	assert.Equal(t, Stats{Requests: 1, Retried: 1, Retries: 2}, st.Stats())
+}
+
+func TestSkipFunc(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	st, err := New(handler, MaxRequestBodyBytes(4),
+		SkipFunc(func(req *http.Request) bool { return req.URL.Path == "/upload" }))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("this request is too long")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("this request is too long")))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, Stats{Requests: 0, Rejected: 1}, st.Stats())
+}
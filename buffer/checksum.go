@@ -0,0 +1,160 @@
+package buffer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// Checksum headers of the request bodies
+const (
+	ContentMD5    = "Content-Md5"
+	Digest        = "Digest"
+	ContentDigest = "Content-Digest"
+)
+
+// ValidateChecksums verifies the checksums of the request bodies announced in the Content-MD5 (RFC 1864), Digest
+// (RFC 3230) and Content-Digest (RFC 9530) headers against the buffered bodies: a request whose body does not match,
+// or whose checksum headers are malformed, is rejected with a 400 before reaching the next handler, e.g. a corrupted
+// upload. The MD5, SHA-1, SHA-256 and SHA-512 checksums are verified, the other algorithms are ignored.
+func ValidateChecksums() optSetter {
+	return func(b *Buffer) error {
+		b.checksums = true
+		return nil
+	}
+}
+
+// checksumMismatchError is a request body not matching its checksum, it matches utils.ErrMalformedRequest
+type checksumMismatchError struct {
+	header    string
+	algorithm string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("request body does not match its %s checksum of header %s", e.algorithm, e.header)
+}
+
+// Is matches utils.ErrMalformedRequest
+func (e *checksumMismatchError) Is(target error) bool {
+	return target == utils.ErrMalformedRequest
+}
+
+type checksum struct {
+	header    string
+	algorithm string
+	expected  []byte
+}
+
+// bodyChecksums computes the checksums of a request body announced in its headers
+type bodyChecksums struct {
+	checksums []checksum
+	hashes    map[string]hash.Hash
+}
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// newBodyChecksums parses the checksum headers of the request, it returns nil if there are no checksums to verify
+func newBodyChecksums(h http.Header) (*bodyChecksums, error) {
+	c := &bodyChecksums{hashes: make(map[string]hash.Hash)}
+
+	if value := h.Get(ContentMD5); value != "" {
+		if err := c.add(ContentMD5, "md5", value); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range h[Digest] {
+		for _, digest := range strings.Split(value, ",") {
+			algorithm, encoded, ok := cutDigest(digest)
+			if !ok {
+				return nil, &utils.MalformedError{What: "header " + Digest, Reason: fmt.Sprintf("invalid digest %q", digest)}
+			}
+			if err := c.add(Digest, algorithm, encoded); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, value := range h[ContentDigest] {
+		for _, digest := range strings.Split(value, ",") {
+			algorithm, encoded, ok := cutDigest(digest)
+			// the digests are structured field byte sequences, :base64:, with optional parameters
+			if i := strings.IndexByte(encoded, ';'); i >= 0 {
+				encoded = encoded[:i]
+			}
+			if !ok || len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+				return nil, &utils.MalformedError{What: "header " + ContentDigest, Reason: fmt.Sprintf("invalid digest %q", digest)}
+			}
+			if err := c.add(ContentDigest, algorithm, encoded[1:len(encoded)-1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(c.checksums) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// cutDigest splits an "algorithm=value" digest, the algorithm is lower cased
+func cutDigest(digest string) (string, string, bool) {
+	digest = strings.TrimSpace(digest)
+	i := strings.IndexByte(digest, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+	return strings.ToLower(digest[:i]), strings.TrimSpace(digest[i+1:]), true
+}
+
+func (c *bodyChecksums) add(header, algorithm, encoded string) error {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil
+	}
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return &utils.MalformedError{What: "header " + header, Reason: fmt.Sprintf("invalid %s checksum: %v", algorithm, err)}
+	}
+	if _, ok := c.hashes[algorithm]; !ok {
+		c.hashes[algorithm] = newHash()
+	}
+	c.checksums = append(c.checksums, checksum{header: header, algorithm: algorithm, expected: expected})
+	return nil
+}
+
+// reader returns a reader of the body computing its checksums
+func (c *bodyChecksums) reader(body io.Reader) io.Reader {
+	writers := make([]io.Writer, 0, len(c.hashes))
+	for _, h := range c.hashes {
+		writers = append(writers, h)
+	}
+	return io.TeeReader(body, io.MultiWriter(writers...))
+}
+
+// verify compares the checksums of the body read to the expected ones
+func (c *bodyChecksums) verify() error {
+	sums := make(map[string][]byte, len(c.hashes))
+	for algorithm, h := range c.hashes {
+		sums[algorithm] = h.Sum(nil)
+	}
+	for _, checksum := range c.checksums {
+		if !bytes.Equal(sums[checksum.algorithm], checksum.expected) {
+			return &checksumMismatchError{header: checksum.header, algorithm: checksum.algorithm}
+		}
+	}
+	return nil
+}
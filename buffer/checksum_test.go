@@ -0,0 +1,72 @@
+package buffer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateChecksums(t *testing.T) {
+	body := "upload content"
+	md5Sum := md5.Sum([]byte(body))
+	sha256Sum := sha256.Sum256([]byte(body))
+	validMD5 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	validSHA256 := base64.StdEncoding.EncodeToString(sha256Sum[:])
+	otherSum := sha256.Sum256([]byte("other content"))
+	invalidSHA256 := base64.StdEncoding.EncodeToString(otherSum[:])
+
+	testCases := []struct {
+		desc     string
+		header   http.Header
+		expected int
+	}{
+		{desc: "no checksum", header: http.Header{}, expected: http.StatusOK},
+		{desc: "Content-MD5", header: http.Header{"Content-Md5": {validMD5}}, expected: http.StatusOK},
+		{desc: "Digest", header: http.Header{Digest: {"SHA-256=" + validSHA256 + ", MD5=" + validMD5}}, expected: http.StatusOK},
+		{desc: "Content-Digest", header: http.Header{ContentDigest: {"sha-256=:" + validSHA256 + ":"}}, expected: http.StatusOK},
+		{desc: "unknown algorithm", header: http.Header{Digest: {"UNIXsum=42"}}, expected: http.StatusOK},
+		{desc: "Content-MD5 mismatch", header: http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(make([]byte, 16))}}, expected: http.StatusBadRequest},
+		{desc: "Digest mismatch", header: http.Header{Digest: {"MD5=" + validMD5 + ",SHA-256=" + invalidSHA256}}, expected: http.StatusBadRequest},
+		{desc: "Content-Digest mismatch", header: http.Header{ContentDigest: {"sha-256=:" + invalidSHA256 + ":"}}, expected: http.StatusBadRequest},
+		{desc: "malformed Digest", header: http.Header{Digest: {"SHA-256"}}, expected: http.StatusBadRequest},
+		{desc: "malformed Content-Digest", header: http.Header{ContentDigest: {"sha-256=" + validSHA256}}, expected: http.StatusBadRequest},
+		{desc: "invalid base64", header: http.Header{"Content-Md5": {"not base64!"}}, expected: http.StatusBadRequest},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var served string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, err := ioutil.ReadAll(req.Body)
+				require.NoError(t, err)
+				served = string(b)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("stored"))
+			})
+
+			b, err := New(handler, ValidateChecksums())
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPut, "/upload", strings.NewReader(body))
+			req.Header = test.header
+			rec := httptest.NewRecorder()
+			b.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expected, rec.Code)
+			if test.expected == http.StatusOK {
+				assert.Equal(t, body, served)
+			} else {
+				assert.Empty(t, served)
+			}
+		})
+	}
+}
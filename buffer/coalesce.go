@@ -0,0 +1,255 @@
+package buffer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// privateHeaders are the request headers that make the response specific to the client, the requests carrying
+// them are not coalesced unless they are part of the key
+var privateHeaders = []string{"Authorization", "Cookie", "Range"}
+
+// Coalesce serves the identical idempotent requests that arrive while one is in flight with the response of the
+// first one, so that a burst of requests for the same resource sends a single request upstream. The requests are
+// identical when they have the same method, host, URL and values of the given headers, e.g. Accept-Encoding.
+//
+// Only the GET and HEAD requests without a body are coalesced, and not the upgrade requests nor the ones carrying
+// an Authorization, a Cookie or a Range header unless the header is part of the key. The response is shared if it
+// has no Set-Cookie header and fits in the memory limit of the responses, see MemResponseBodyBytes, otherwise the
+// waiting requests are sent upstream each. If the first request is canceled by its client, or answered by the error
+// handler of the buffer, its response is not shared: one of the waiting requests is sent upstream in its place and
+// the other ones wait for its response.
+func Coalesce(headers ...string) optSetter {
+	return func(b *Buffer) error {
+		g := &flightGroup{flights: make(map[string]*flight)}
+		for _, h := range headers {
+			if err := utils.ValidateHeaderName(h); err != nil {
+				return fmt.Errorf("invalid coalescing header: %v", err)
+			}
+			g.headers = append(g.headers, http.CanonicalHeaderKey(h))
+		}
+		b.flights = g
+		return nil
+	}
+}
+
+// flightGroup tracks the in-flight requests by key
+type flightGroup struct {
+	headers []string
+
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a request in flight, done is closed once the response is recorded
+type flight struct {
+	done chan struct{}
+	// waiters is the number of requests waiting for the response, with the mutex of the group held
+	waiters int
+
+	// aborted is true if the request was canceled or failed, a waiting request is sent upstream in its place
+	aborted bool
+	// shared is true if the recorded response can be served to the waiting requests
+	shared bool
+	code   int
+	header http.Header
+	body   []byte
+}
+
+func (g *flightGroup) coalescable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.ContentLength > 0 || len(req.TransferEncoding) > 0 || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	for _, h := range privateHeaders {
+		if req.Header.Get(h) != "" && !g.inKey(h) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *flightGroup) inKey(header string) bool {
+	for _, h := range g.headers {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *flightGroup) key(req *http.Request) string {
+	var k bytes.Buffer
+	k.WriteString(req.Method)
+	k.WriteByte(' ')
+	k.WriteString(req.Host)
+	k.WriteByte(' ')
+	k.WriteString(req.URL.RequestURI())
+	for _, h := range g.headers {
+		k.WriteByte('\n')
+		k.WriteString(h)
+		k.WriteByte(':')
+		k.WriteString(strings.Join(req.Header[h], ","))
+	}
+	return k.String()
+}
+
+// join returns the flight of the key and true if the request is the first one, the one to send upstream
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// leave removes a request canceled while waiting for the response of the flight
+func (g *flightGroup) leave(f *flight) {
+	g.mutex.Lock()
+	f.waiters--
+	g.mutex.Unlock()
+}
+
+// land releases the requests waiting for the flight and returns their number
+func (g *flightGroup) land(key string, f *flight) int {
+	g.mutex.Lock()
+	delete(g.flights, key)
+	waiters := f.waiters
+	g.mutex.Unlock()
+	close(f.done)
+	return waiters
+}
+
+// serveCoalesced sends the request upstream if no identical request is in flight, otherwise it waits for the
+// response of the in-flight one
+func (b *Buffer) serveCoalesced(w http.ResponseWriter, req *http.Request) {
+	key := b.flights.key(req)
+	f, first := b.flights.join(key)
+	for {
+		if first {
+			b.lead(w, req, key, f)
+			return
+		}
+
+		select {
+		case <-f.done:
+		case <-req.Context().Done():
+			b.flights.leave(f)
+			b.log.Debugf("vulcand/oxy/buffer: request canceled while waiting for a coalesced response: %v", req.Context().Err())
+			return
+		}
+		if !f.aborted {
+			break
+		}
+		// the first of the waiting requests takes over the aborted one
+		f, first = b.flights.join(key)
+	}
+
+	if !f.shared {
+		b.serveBuffered(w, req)
+		return
+	}
+	atomic.AddInt64(&b.stats.Coalesced, 1)
+	utils.CopyHeaders(w.Header(), f.header)
+	w.WriteHeader(f.code)
+	if len(f.body) > 0 {
+		w.Write(f.body)
+	}
+}
+
+// lead sends the request upstream and records the response for the identical requests
+func (b *Buffer) lead(w http.ResponseWriter, req *http.Request, key string, f *flight) {
+	rec := &flightRecorder{ResponseWriter: w, limit: b.memResponseBodyBytes, shared: true}
+	// the waiting requests are released even if the handler panics
+	defer func() {
+		switch {
+		case rec.failed || req.Context().Err() != nil:
+			f.aborted = true
+		case rec.shared && rec.code != 0 && rec.header.Get("Set-Cookie") == "":
+			f.shared, f.code, f.header, f.body = true, rec.code, rec.header, rec.body.Bytes()
+		}
+		if waiters := b.flights.land(key, f); f.aborted && waiters > 0 {
+			b.log.Debugf("vulcand/oxy/buffer: coalesced request aborted, %d waiting requests are sent upstream in turn", waiters)
+		}
+	}()
+
+	b.serveBuffered(rec, req)
+}
+
+// flightRecorder writes the response and records a copy of it
+type flightRecorder struct {
+	http.ResponseWriter
+	limit int64
+
+	// failed is true if the response is written by the error handler of the buffer
+	failed bool
+	shared bool
+	code   int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *flightRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+		r.header = utils.CloneHeaders(r.ResponseWriter.Header())
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *flightRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.shared {
+		if r.limit >= 0 && int64(r.body.Len()+len(p)) > r.limit {
+			r.shared = false
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Hijack hijacks the connection, the response is not shared then
+func (r *flightRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.shared = false
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", r.ResponseWriter)
+}
+
+func (r *flightRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flightErrHandler marks the responses recorded for the coalesced requests as failed
+type flightErrHandler struct {
+	utils.ErrorHandler
+}
+
+func (h *flightErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if rec, ok := w.(*flightRecorder); ok {
+		rec.failed = true
+	}
+	h.ErrorHandler.ServeHTTP(w, req, err)
+}
@@ -0,0 +1,271 @@
+package buffer
+
+import (
+	gocontext "context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// coalescedServer returns a server blocking the requests until release is closed, it counts the requests received
+func coalescedServer(hits *int64, release chan struct{}, setCookie bool) *httptest.Server {
+	return testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(hits, 1)
+		<-release
+		if setCookie {
+			w.Header().Set("Set-Cookie", "session=1")
+		}
+		w.Header().Set("X-Encoding", req.Header.Get("Accept-Encoding"))
+		w.Write([]byte("hello"))
+	})
+}
+
+func TestCoalesceIdenticalRequests(t *testing.T) {
+	var hits int64
+	release := make(chan struct{})
+	srv := coalescedServer(&hits, release, false)
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, Coalesce("Accept-Encoding"))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	const n = 5
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	bodies := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			re, body, err := testutils.Get(proxy.URL, testutils.Header("Accept-Encoding", "identity"))
+			require.NoError(t, err)
+			codes[i], bodies[i] = re.StatusCode, string(body)
+			assert.Equal(t, "identity", re.Header.Get("X-Encoding"))
+		}(i)
+	}
+
+	// the first request is in flight, the other ones wait for its response
+	waitFor(t, func() bool { return atomic.LoadInt64(&hits) == 1 && waiting(st) == n-1 })
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, atomic.LoadInt64(&hits))
+	for i := 0; i < n; i++ {
+		assert.Equal(t, http.StatusOK, codes[i])
+		assert.Equal(t, "hello", bodies[i])
+	}
+	stats := st.Stats()
+	assert.EqualValues(t, 1, stats.Requests)
+	assert.EqualValues(t, n-1, stats.Coalesced)
+}
+
+func TestCoalesceDifferentHeaders(t *testing.T) {
+	var hits int64
+	release := make(chan struct{})
+	srv := coalescedServer(&hits, release, false)
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, Coalesce("Accept-Encoding"))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	var wg sync.WaitGroup
+	for _, encoding := range []string{"gzip", "identity"} {
+		wg.Add(1)
+		go func(encoding string) {
+			defer wg.Done()
+			re, _, err := testutils.Get(proxy.URL, testutils.Header("Accept-Encoding", encoding))
+			require.NoError(t, err)
+			assert.Equal(t, encoding, re.Header.Get("X-Encoding"))
+		}(encoding)
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt64(&hits) == 2 })
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 0, st.Stats().Coalesced)
+}
+
+func TestCoalesceNotShared(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		setCookie bool
+		memBytes  int64
+	}{
+		{desc: "set-cookie", setCookie: true, memBytes: DefaultMemBodyBytes},
+		{desc: "over the memory limit", memBytes: 2},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var hits int64
+			release := make(chan struct{})
+			srv := coalescedServer(&hits, release, test.setCookie)
+			defer srv.Close()
+
+			fwd, err := forward.New()
+			require.NoError(t, err)
+			rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				fwd.ServeHTTP(w, req)
+			})
+
+			st, err := New(rdr, Coalesce(), MemResponseBodyBytes(test.memBytes))
+			require.NoError(t, err)
+			proxy := httptest.NewServer(st)
+			defer proxy.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					re, body, err := testutils.Get(proxy.URL)
+					require.NoError(t, err)
+					assert.Equal(t, http.StatusOK, re.StatusCode)
+					assert.Equal(t, "hello", string(body))
+				}()
+			}
+
+			waitFor(t, func() bool { return atomic.LoadInt64(&hits) == 1 && waiting(st) == 1 })
+			close(release)
+			wg.Wait()
+
+			// the waiting request was sent upstream once the response of the first one was not shared
+			assert.EqualValues(t, 2, atomic.LoadInt64(&hits))
+			assert.EqualValues(t, 0, st.Stats().Coalesced)
+		})
+	}
+}
+
+func TestCoalesceCanceledRequest(t *testing.T) {
+	var hits int64
+	release := make(chan struct{})
+	srv := coalescedServer(&hits, release, false)
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, Coalesce())
+	require.NoError(t, err)
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	canceled := make(chan struct{})
+	go func() {
+		defer close(canceled)
+		req, errReq := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		require.NoError(t, errReq)
+		_, errGet := http.DefaultClient.Do(req.WithContext(ctx))
+		assert.Error(t, errGet)
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt64(&hits) == 1 })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		re, body, errGet := testutils.Get(proxy.URL)
+		require.NoError(t, errGet)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	}()
+	waitFor(t, func() bool { return waiting(st) == 1 })
+
+	// the waiting request is sent upstream in place of the canceled one
+	cancel()
+	<-canceled
+	waitFor(t, func() bool { return atomic.LoadInt64(&hits) == 2 })
+	close(release)
+	<-done
+
+	assert.EqualValues(t, 0, st.Stats().Coalesced)
+}
+
+func TestCoalescePrivateRequests(t *testing.T) {
+	g := &flightGroup{headers: []string{"Cookie"}}
+
+	testCases := []struct {
+		desc       string
+		method     string
+		header     http.Header
+		coalescing bool
+	}{
+		{desc: "get", method: http.MethodGet, coalescing: true},
+		{desc: "head", method: http.MethodHead, coalescing: true},
+		{desc: "post", method: http.MethodPost},
+		{desc: "authorization", method: http.MethodGet, header: http.Header{"Authorization": {"Bearer t"}}},
+		{desc: "range", method: http.MethodGet, header: http.Header{"Range": {"bytes=0-1"}}},
+		{desc: "upgrade", method: http.MethodGet, header: http.Header{"Upgrade": {"websocket"}}},
+		{desc: "cookie in the key", method: http.MethodGet, header: http.Header{"Cookie": {"a=b"}}, coalescing: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost/", nil)
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+			assert.Equal(t, test.coalescing, g.coalescable(req))
+		})
+	}
+}
+
+func TestCoalesceInvalidHeader(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), Coalesce("bad header"))
+	require.Error(t, err)
+}
+
+// waiting returns the number of requests waiting for an in-flight one
+func waiting(b *Buffer) int {
+	b.flights.mutex.Lock()
+	defer b.flights.mutex.Unlock()
+	n := 0
+	for _, f := range b.flights.flights {
+		n += f.waiters
+	}
+	return n
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met")
+}
@@ -0,0 +1,13 @@
+package buffer
+
+import (
+	"github.com/vulcand/oxy/events"
+)
+
+// Events sets the emitter the buffer publishes the retries to, as events.RetryPerformed
+func Events(e events.Emitter) optSetter {
+	return func(b *Buffer) error {
+		b.events = e
+		return nil
+	}
+}
@@ -0,0 +1,30 @@
+package buffer
+
+import (
+	"github.com/vulcand/oxy/metrics"
+)
+
+// bufferMetrics are the metrics of the buffer registered by the Metrics option
+type bufferMetrics struct {
+	rejected *metrics.Counter
+	retries  *metrics.Counter
+}
+
+// Metrics registers the metrics of the buffer into the registry:
+//
+//	oxy_buffer_rejected_total counts the requests rejected as their body is over the limit
+//	oxy_buffer_retries_total counts the requests retried by the retry predicate
+func Metrics(r *metrics.Registry) optSetter {
+	return func(b *Buffer) error {
+		rejected, err := r.Counter("oxy_buffer_rejected_total", "Requests rejected as their body is over the limit.")
+		if err != nil {
+			return err
+		}
+		retries, err := r.Counter("oxy_buffer_retries_total", "Requests retried by the buffer.")
+		if err != nil {
+			return err
+		}
+		b.metrics = &bufferMetrics{rejected: rejected.With(), retries: retries.With()}
+		return nil
+	}
+}
@@ -87,3 +87,46 @@ func newBufferMiddleware(t *testing.T, p string) (*roundrobin.RoundRobin, *Buffe
 
 	return lb, st
 }
+
+func TestRetryOnFlakyBackend(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		failures         int
+		expectedCode     int
+		expectedRequests int
+	}{
+		{
+			desc:             "succeeds on last attempt",
+			failures:         2,
+			expectedCode:     http.StatusOK,
+			expectedRequests: 3,
+		},
+		{
+			desc:             "exceeds attempts",
+			failures:         3,
+			expectedCode:     http.StatusBadGateway,
+			expectedRequests: 3,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			srv, err := testutils.NewChaosBackend(testutils.FailFirst(test.failures, testutils.ResetFault()))
+			require.NoError(t, err)
+			defer srv.Close()
+
+			lb, rt := newBufferMiddleware(t, `IsNetworkError() && Attempts() <= 2`)
+
+			proxy := httptest.NewServer(rt)
+			defer proxy.Close()
+
+			require.NoError(t, lb.UpsertServer(testutils.ParseURI(srv.URL)))
+
+			re, _, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+			assert.Equal(t, test.expectedRequests, srv.Requests())
+		})
+	}
+}
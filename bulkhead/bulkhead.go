@@ -0,0 +1,310 @@
+/*
+Package bulkhead provides a middleware isolating the concurrency of the requests into pools.
+
+The requests are partitioned by a key, e.g. the route or the tenant, into pools serving a bounded number of requests
+at a time. The requests exceeding the concurrency of their pool wait in a bounded queue, and are rejected with
+a 503 response when the queue is full or when they waited too long. A slow endpoint exhausts its own pool only,
+the other pools keep serving.
+
+Examples of a bulkhead:
+
+	// 20 concurrent requests per host, the reports host gets 2 with a queue of 10
+	extract, _ := utils.NewExtractor("request.host")
+	b, err := bulkhead.New(handler, extract,
+		bulkhead.Default(20, 0),
+		bulkhead.Pool("reports.example.com", 2, 10),
+		bulkhead.QueueTimeout(5*time.Second))
+*/
+package bulkhead
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Defaults of the pools created for the keys without configuration
+const (
+	DefaultMaxConcurrency = 100
+	DefaultMaxQueue       = 0
+)
+
+// FullError is returned when the pool of a request is full, or when the request waited more than the queue timeout
+type FullError struct {
+	Key      string
+	TimedOut bool
+}
+
+func (e *FullError) Error() string {
+	if e.TimedOut {
+		return fmt.Sprintf("timed out waiting in the queue of pool %q", e.Key)
+	}
+	return fmt.Sprintf("pool %q is full", e.Key)
+}
+
+type poolConfig struct {
+	maxConcurrency int
+	maxQueue       int
+}
+
+// pool bounds the concurrency of the requests of a key
+type pool struct {
+	key        string
+	slots      chan struct{}
+	maxQueue   int
+	configured bool
+
+	// guarded by the bulkhead mutex
+	waiting int
+	users   int
+}
+
+// Stats are the usage of a pool
+type Stats struct {
+	Active  int
+	Waiting int
+}
+
+// Bulkhead is a middleware bounding the concurrency of the requests per key
+type Bulkhead struct {
+	next         http.Handler
+	extract      utils.SourceExtractor
+	defaults     poolConfig
+	configs      map[string]poolConfig
+	queueTimeout time.Duration
+
+	mutex sync.Mutex
+	pools map[string]*pool
+
+	errHandler utils.ErrorHandler
+	log        *log.Logger
+}
+
+// Option is a functional option setter for Bulkhead
+type Option func(b *Bulkhead) error
+
+// New creates a new Bulkhead middleware, partitioning the requests by the token of the extractor
+func New(next http.Handler, extract utils.SourceExtractor, opts ...Option) (*Bulkhead, error) {
+	if extract == nil {
+		return nil, errors.New("extract function can not be nil")
+	}
+	b := &Bulkhead{
+		next:       next,
+		extract:    extract,
+		defaults:   poolConfig{maxConcurrency: DefaultMaxConcurrency, maxQueue: DefaultMaxQueue},
+		configs:    make(map[string]poolConfig),
+		pools:      make(map[string]*pool),
+		errHandler: &FullErrHandler{},
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func newPoolConfig(maxConcurrency, maxQueue int) (poolConfig, error) {
+	if maxConcurrency <= 0 {
+		return poolConfig{}, fmt.Errorf("max concurrency should be > 0, got %d", maxConcurrency)
+	}
+	if maxQueue < 0 {
+		return poolConfig{}, fmt.Errorf("max queue should be >= 0, got %d", maxQueue)
+	}
+	return poolConfig{maxConcurrency: maxConcurrency, maxQueue: maxQueue}, nil
+}
+
+// Default sets the concurrency and the queue size of the pools of the keys without configuration
+func Default(maxConcurrency, maxQueue int) Option {
+	return func(b *Bulkhead) error {
+		c, err := newPoolConfig(maxConcurrency, maxQueue)
+		if err != nil {
+			return err
+		}
+		b.defaults = c
+		return nil
+	}
+}
+
+// Pool sets the concurrency and the queue size of the pool of a key
+func Pool(key string, maxConcurrency, maxQueue int) Option {
+	return func(b *Bulkhead) error {
+		c, err := newPoolConfig(maxConcurrency, maxQueue)
+		if err != nil {
+			return err
+		}
+		b.configs[key] = c
+		return nil
+	}
+}
+
+// QueueTimeout sets the maximum time a request waits in the queue of its pool, by default it waits until
+// the client goes away
+func QueueTimeout(d time.Duration) Option {
+	return func(b *Bulkhead) error {
+		if d < 0 {
+			return fmt.Errorf("queue timeout should be >= 0, got %v", d)
+		}
+		b.queueTimeout = d
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler replying to the rejected requests, it defaults to FullErrHandler
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(b *Bulkhead) error {
+		if h == nil {
+			return errors.New("error handler can not be nil")
+		}
+		b.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the bulkhead will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(b *Bulkhead) error {
+		b.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by bulkhead handler.
+func (b *Bulkhead) Wrap(next http.Handler) error {
+	b.next = next
+	return nil
+}
+
+// Stats returns the usage of the pool of a key
+func (b *Bulkhead) Stats(key string) Stats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	p, ok := b.pools[key]
+	if !ok {
+		return Stats{}
+	}
+	return Stats{Active: len(p.slots), Waiting: p.waiting}
+}
+
+func (b *Bulkhead) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if b.log.Level >= log.DebugLevel {
+		logEntry := b.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/bulkhead: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/bulkhead: completed ServeHttp on request")
+	}
+
+	key, _, err := b.extract.Extract(req)
+	if err != nil {
+		b.log.Errorf("vulcand/oxy/bulkhead: failed to extract the key of the request: %v", err)
+		b.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	p, err := b.acquire(req, key)
+	if err != nil {
+		if utils.Sampled(b.log, log.DebugLevel, "vulcand/oxy/bulkhead: rejecting request of pool %q: %v") {
+			b.log.Debugf("vulcand/oxy/bulkhead: rejecting request of pool %q: %v", key, err)
+		}
+		b.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer b.release(p)
+
+	b.next.ServeHTTP(w, req)
+}
+
+// acquire takes a slot of the pool of the key, waiting in the queue if the pool is busy
+func (b *Bulkhead) acquire(req *http.Request, key string) (*pool, error) {
+	b.mutex.Lock()
+	p := b.pool(key)
+	select {
+	case p.slots <- struct{}{}:
+		p.users++
+		b.mutex.Unlock()
+		return p, nil
+	default:
+	}
+	if p.waiting >= p.maxQueue {
+		b.evict(p)
+		b.mutex.Unlock()
+		return nil, &FullError{Key: key}
+	}
+	p.waiting++
+	p.users++
+	b.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if b.queueTimeout > 0 {
+		timer := time.NewTimer(b.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case p.slots <- struct{}{}:
+	case <-timeout:
+		err = &FullError{Key: key, TimedOut: true}
+	case <-req.Context().Done():
+		err = req.Context().Err()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	p.waiting--
+	if err != nil {
+		p.users--
+		b.evict(p)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (b *Bulkhead) release(p *pool) {
+	<-p.slots
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	p.users--
+	b.evict(p)
+}
+
+// pool returns the pool of the key, creating it if needed. It is called with the mutex held.
+func (b *Bulkhead) pool(key string) *pool {
+	if p, ok := b.pools[key]; ok {
+		return p
+	}
+	c, configured := b.configs[key]
+	if !configured {
+		c = b.defaults
+	}
+	p := &pool{key: key, slots: make(chan struct{}, c.maxConcurrency), maxQueue: c.maxQueue, configured: configured}
+	b.pools[key] = p
+	return p
+}
+
+// evict removes the unused pools of the keys without configuration, otherwise they would grow forever.
+// It is called with the mutex held.
+func (b *Bulkhead) evict(p *pool) {
+	if p.users == 0 && !p.configured {
+		delete(b.pools, p.key)
+	}
+}
+
+// FullErrHandler replies 503 to the requests rejected by a full pool
+type FullErrHandler struct{}
+
+func (e *FullErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if _, ok := err.(*FullError); ok {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
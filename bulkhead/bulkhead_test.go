@@ -0,0 +1,133 @@
+package bulkhead
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+)
+
+func byHeader(req *http.Request) (string, int64, error) {
+	return req.Header.Get("X-Pool"), 1, nil
+}
+
+func newRequest(pool string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Pool", pool)
+	return req
+}
+
+// blocking serves the requests until they are released, and signals when they are served
+type blocking struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlocking() *blocking {
+	return &blocking{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (h *blocking) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.started <- struct{}{}
+	<-h.release
+}
+
+func serveAsync(b *Bulkhead, req *http.Request) (*httptest.ResponseRecorder, *sync.WaitGroup) {
+	rec := httptest.NewRecorder()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.ServeHTTP(rec, req)
+	}()
+	return rec, wg
+}
+
+func TestBulkheadIsolation(t *testing.T) {
+	h := newBlocking()
+	b, err := New(h, utils.ExtractorFunc(byHeader), Default(2, 0), Pool("slow", 1, 0))
+	require.NoError(t, err)
+
+	_, wg := serveAsync(b, newRequest("slow"))
+	<-h.started
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, newRequest("slow"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// the other pools are not affected
+	var others []*sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		_, owg := serveAsync(b, newRequest("fast"))
+		others = append(others, owg)
+		<-h.started
+	}
+	assert.Equal(t, Stats{Active: 2}, b.Stats("fast"))
+	assert.Equal(t, Stats{Active: 1}, b.Stats("slow"))
+
+	close(h.release)
+	wg.Wait()
+	for _, owg := range others {
+		owg.Wait()
+	}
+	assert.Equal(t, Stats{}, b.Stats("fast"))
+	b.mutex.Lock()
+	assert.Len(t, b.pools, 1, "the configured pool is kept, the others are evicted")
+	b.mutex.Unlock()
+}
+
+func TestBulkheadQueue(t *testing.T) {
+	h := newBlocking()
+	b, err := New(h, utils.ExtractorFunc(byHeader), Pool("queued", 1, 1))
+	require.NoError(t, err)
+
+	_, wg := serveAsync(b, newRequest("queued"))
+	<-h.started
+	queued, qwg := serveAsync(b, newRequest("queued"))
+	for b.Stats("queued").Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, newRequest("queued"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "the queue is full")
+
+	h.release <- struct{}{}
+	wg.Wait()
+	<-h.started
+	h.release <- struct{}{}
+	qwg.Wait()
+	assert.Equal(t, http.StatusOK, queued.Code)
+}
+
+func TestBulkheadQueueTimeout(t *testing.T) {
+	h := newBlocking()
+	b, err := New(h, utils.ExtractorFunc(byHeader), Default(1, 1), QueueTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+
+	_, wg := serveAsync(b, newRequest("a"))
+	<-h.started
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, newRequest("a"))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, Stats{Active: 1}, b.Stats("a"))
+
+	close(h.release)
+	wg.Wait()
+}
+
+func TestBulkheadInvalidOptions(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), nil)
+	assert.Error(t, err)
+
+	for _, opt := range []Option{Default(0, 0), Pool("a", 1, -1), QueueTimeout(-time.Second), ErrorHandler(nil)} {
+		_, err := New(http.NotFoundHandler(), utils.ExtractorFunc(byHeader), opt)
+		assert.Error(t, err)
+	}
+}
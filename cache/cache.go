@@ -0,0 +1,603 @@
+/*
+Package cache implements a shared HTTP cache following RFC 7234 semantics.
+
+Responses to GET requests are stored in a pluggable Store and served while they are fresh.
+Stale responses carrying validators (ETag, Last-Modified) are revalidated with a conditional request,
+unsafe requests (POST, PUT, DELETE...) invalidate the stored responses of their URL.
+
+Examples of a caching middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Header().Set("Cache-Control", "max-age=60")
+	  w.Write([]byte("hello"))
+	})
+
+	// responses are kept in memory, up to 64MB
+	c, err := cache.New(handler)
+
+	// responses are kept on disk
+	store, err := cache.NewDiskStore("/var/cache/oxy")
+	c, err := cache.New(handler, cache.WithStore(store))
+*/
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	// DefaultMemoryStoreBytes is the size of the memory store used unless configured otherwise
+	DefaultMemoryStoreBytes = 64 * 1024 * 1024
+	// DefaultMaxEntryBytes responses bigger than 10MB are not stored
+	DefaultMaxEntryBytes = 10 * 1024 * 1024
+	// DefaultStatusHeader is the response header telling how the cache handled the request
+	DefaultStatusHeader = "X-Cache"
+)
+
+// Values of the status header
+const (
+	StatusHit         = "HIT"
+	StatusMiss        = "MISS"
+	StatusRevalidated = "REVALIDATED"
+	StatusBypass      = "BYPASS"
+)
+
+// Cache is a middleware serving responses from a store
+type Cache struct {
+	next          http.Handler
+	store         Store
+	clock         utils.Clock
+	key           func(req *http.Request) string
+	defaultTTL    time.Duration
+	maxEntryBytes int64
+	statusHeader  string
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Cache
+type Option func(c *Cache) error
+
+// New creates a new Cache middleware
+func New(next http.Handler, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		next:          next,
+		clock:         utils.InheritedClock(),
+		key:           DefaultKey,
+		maxEntryBytes: DefaultMaxEntryBytes,
+		statusHeader:  DefaultStatusHeader,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.store == nil {
+		c.store = NewMemoryStore(DefaultMemoryStoreBytes)
+	}
+	return c, nil
+}
+
+// WithStore sets the store of the responses
+func WithStore(s Store) Option {
+	return func(c *Cache) error {
+		c.store = s
+		return nil
+	}
+}
+
+// Clock sets the clock used to compute the age of the responses
+func Clock(clock utils.Clock) Option {
+	return func(c *Cache) error {
+		c.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the cache will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(c *Cache) error {
+		c.log = l
+		return nil
+	}
+}
+
+// DefaultTTL sets the freshness lifetime of the responses without explicit expiration time nor Last-Modified header.
+// It defaults to 0: those responses are stored only if they can be revalidated.
+func DefaultTTL(ttl time.Duration) Option {
+	return func(c *Cache) error {
+		if ttl < 0 {
+			return fmt.Errorf("ttl should be >= 0, got %v", ttl)
+		}
+		c.defaultTTL = ttl
+		return nil
+	}
+}
+
+// MaxEntryBytes sets the size of the biggest response body to store, bigger responses are passed through
+func MaxEntryBytes(m int64) Option {
+	return func(c *Cache) error {
+		if m < 0 {
+			return fmt.Errorf("max bytes should be >= 0, got %d", m)
+		}
+		c.maxEntryBytes = m
+		return nil
+	}
+}
+
+// Key sets the function computing the key of the requests, it defaults to DefaultKey.
+// The requests with unsafe methods invalidate the keys of GET requests to the same URLs, with the same headers.
+func Key(key func(req *http.Request) string) Option {
+	return func(c *Cache) error {
+		c.key = key
+		return nil
+	}
+}
+
+// StatusHeader sets the name of the response header telling how the cache handled the request, an empty name disables it
+func StatusHeader(name string) Option {
+	return func(c *Cache) error {
+		c.statusHeader = name
+		return nil
+	}
+}
+
+// DefaultKey builds the key of a request from its host and URI, HEAD requests share the key of GET requests
+func DefaultKey(req *http.Request) string {
+	return keyFor(req.Host, req.URL.RequestURI())
+}
+
+func keyFor(host, uri string) string {
+	return http.MethodGet + " " + host + uri
+}
+
+// Wrap sets the next handler to be called by the cache handler.
+func (c *Cache) Wrap(next http.Handler) error {
+	c.next = next
+	return nil
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/cache: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/cache: completed ServeHttp on request")
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		c.serveUnsafe(w, req)
+		return
+	}
+	if req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" {
+		c.setStatus(w.Header(), StatusBypass)
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	key := c.key(req)
+	reqCC := parseCacheControl(req.Header)
+	if len(reqCC) == 0 && req.Header.Get("Pragma") == "no-cache" {
+		reqCC["no-cache"] = ""
+	}
+
+	entry, variantKey := c.lookup(key, req)
+	if entry != nil {
+		age := entry.age(c.clock.UtcNow())
+		if !reqCC.has("no-cache") && c.isFresh(reqCC, entry, age) {
+			c.serveEntry(w, req, entry, age, StatusHit)
+			return
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		c.setStatus(w.Header(), StatusMiss)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	if entry != nil && !hasValidators(entry.Header) {
+		entry = nil
+	}
+	c.fetch(w, req, key, variantKey, entry)
+}
+
+// lookup returns the entry for the request along with its variant key, the latter is empty if the entry does not vary
+func (c *Cache) lookup(key string, req *http.Request) (*Entry, string) {
+	entry, err := c.store.Get(key)
+	if err != nil {
+		c.log.Errorf("vulcand/oxy/cache: failed to get entry %q, err: %v", key, err)
+		return nil, ""
+	}
+	if entry == nil || !entry.isVaryMarker() {
+		return entry, ""
+	}
+
+	variantKey := variantKeyFor(key, varyNames(entry.Header), req.Header)
+	variant, err := c.store.Get(variantKey)
+	if err != nil {
+		c.log.Errorf("vulcand/oxy/cache: failed to get entry %q, err: %v", variantKey, err)
+		return nil, variantKey
+	}
+	if variant == nil || !variant.matches(req) {
+		return nil, variantKey
+	}
+	return variant, variantKey
+}
+
+// fetch forwards the request to the next handler, revalidating the entry if there is one. The conditions of the
+// client are not forwarded, they are evaluated against the response so that it can be stored
+func (c *Cache) fetch(w http.ResponseWriter, req *http.Request, key, variantKey string, entry *Entry) {
+	outReq := conditionalRequest(req, entry)
+
+	requestTime := c.clock.UtcNow()
+	cw := &captureWriter{
+		w:        w,
+		header:   make(http.Header),
+		maxBytes: c.maxEntryBytes,
+		record:   req.Method == http.MethodGet,
+		passThrough: func(code int) bool {
+			return entry == nil || code != http.StatusNotModified
+		},
+		onPassThrough: func(h http.Header) {
+			c.setStatus(h, StatusMiss)
+		},
+		notModified: func(code int, h http.Header) bool {
+			return code == http.StatusOK && notModified(req, h)
+		},
+	}
+	c.next.ServeHTTP(cw, outReq)
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	responseTime := c.clock.UtcNow()
+
+	if !cw.passing {
+		// the stored response is still valid, refresh its headers, see RFC 7234 section 4.3.4
+		updated := *entry
+		updated.Header = utils.CloneHeaders(entry.Header)
+		for k, vv := range cw.header {
+			if k == "Content-Length" {
+				continue
+			}
+			updated.Header[k] = vv
+		}
+		updated.RequestTime = requestTime
+		updated.ResponseTime = responseTime
+		c.set(c.entryKey(key, variantKey, &updated, req), &updated)
+		c.serveEntry(w, req, &updated, updated.age(responseTime), StatusRevalidated)
+		return
+	}
+
+	if !cw.record {
+		return
+	}
+	if cw.overflow || cw.code == http.StatusPartialContent || !isStorable(req, cw.code, cw.header) ||
+		freshnessLifetime(cw.header, c.defaultTTL) <= 0 && !hasValidators(cw.header) {
+		if entry != nil {
+			// the stored response has been replaced by one that cannot be stored
+			c.invalidate(c.entryKey(key, variantKey, entry, req))
+		}
+		return
+	}
+
+	e := &Entry{
+		StatusCode:   cw.code,
+		Header:       utils.CloneHeaders(cw.header),
+		Body:         cw.body.Bytes(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	names := varyNames(cw.header)
+	if len(names) == 0 {
+		c.set(key, e)
+		return
+	}
+	e.VaryHeaders = make(http.Header, len(names))
+	for _, name := range names {
+		if vv := req.Header[name]; len(vv) > 0 {
+			e.VaryHeaders[name] = vv
+		}
+	}
+	c.set(key, &Entry{Header: http.Header{"Vary": cw.header["Vary"]}})
+	c.set(variantKeyFor(key, names, req.Header), e)
+}
+
+func (c *Cache) entryKey(key, variantKey string, e *Entry, req *http.Request) string {
+	if len(varyNames(e.Header)) == 0 {
+		return key
+	}
+	if variantKey == "" {
+		variantKey = variantKeyFor(key, varyNames(e.Header), req.Header)
+	}
+	return variantKey
+}
+
+func (c *Cache) set(key string, e *Entry) {
+	if err := c.store.Set(key, e); err != nil {
+		c.log.Errorf("vulcand/oxy/cache: failed to store entry %q, err: %v", key, err)
+	}
+}
+
+// serveUnsafe forwards requests with unsafe methods, invalidating the stored responses of the URL on success, see RFC 7234 section 4.4
+func (c *Cache) serveUnsafe(w http.ResponseWriter, req *http.Request) {
+	pw := utils.NewProxyWriterWithLogger(w, c.log)
+	c.next.ServeHTTP(pw, req)
+
+	code := pw.StatusCode()
+	if code < 200 || code >= 400 {
+		return
+	}
+	c.invalidate(c.keyOf(req, req.URL))
+	for _, h := range []string{"Location", "Content-Location"} {
+		value := pw.Header().Get(h)
+		if value == "" {
+			continue
+		}
+		u, err := req.URL.Parse(value)
+		if err != nil || (u.Host != "" && u.Host != req.Host) {
+			// invalidating other hosts would allow denial of service attacks
+			continue
+		}
+		c.invalidate(c.keyOf(req, u))
+	}
+}
+
+// keyOf returns the key of a GET request to the URL, with the headers of the request
+func (c *Cache) keyOf(req *http.Request, u *url.URL) string {
+	get := new(http.Request)
+	*get = *req
+	get.Method = http.MethodGet
+	get.URL = u
+	get.RequestURI = u.RequestURI()
+	return c.key(get)
+}
+
+func (c *Cache) invalidate(key string) {
+	if err := c.store.Delete(key); err != nil {
+		c.log.Errorf("vulcand/oxy/cache: failed to delete entry %q, err: %v", key, err)
+	}
+}
+
+// isFresh tells whether the entry can be served without revalidation, taking the request directives into account
+func (c *Cache) isFresh(reqCC cacheControl, e *Entry, age time.Duration) bool {
+	respCC := parseCacheControl(e.Header)
+	if respCC.has("no-cache") {
+		return false
+	}
+	lifetime := freshnessLifetime(e.Header, c.defaultTTL)
+
+	if maxAge, ok := reqCC.duration("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.duration("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+
+	// the entry is stale, some clients accept that
+	if respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage") || !reqCC.has("max-stale") {
+		return false
+	}
+	maxStale, ok := reqCC.duration("max-stale")
+	return !ok || age-lifetime <= maxStale
+}
+
+func (c *Cache) serveEntry(w http.ResponseWriter, req *http.Request, e *Entry, age time.Duration, status string) {
+	h := w.Header()
+	utils.CopyHeaders(h, e.Header)
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	c.setStatus(h, status)
+
+	if e.StatusCode == http.StatusOK && notModified(req, e.Header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if e.StatusCode != http.StatusNoContent {
+		h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	}
+	w.WriteHeader(e.StatusCode)
+	if req.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+func (c *Cache) setStatus(h http.Header, status string) {
+	if c.statusHeader != "" {
+		h.Set(c.statusHeader, status)
+	}
+}
+
+// age computes the current age of the entry, see RFC 7234 section 4.2.3
+func (e *Entry) age(now time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date := parseDate(e.Header, "Date"); !date.IsZero() && e.ResponseTime.After(date) {
+		apparentAge = e.ResponseTime.Sub(date)
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedAge := responseDelay
+	if seconds, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		correctedAge += time.Duration(seconds) * time.Second
+	}
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+// isVaryMarker tells whether the entry only records the Vary header of the response, the actual responses being stored per variant
+func (e *Entry) isVaryMarker() bool {
+	return e.StatusCode == 0
+}
+
+func (e *Entry) matches(req *http.Request) bool {
+	for _, name := range varyNames(e.Header) {
+		if strings.Join(e.VaryHeaders[name], ",") != strings.Join(req.Header[name], ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func variantKeyFor(key string, names []string, h http.Header) string {
+	var b bytes.Buffer
+	b.WriteString(key)
+	for _, name := range names {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(url.QueryEscape(strings.Join(h[name], ",")))
+	}
+	return b.String()
+}
+
+func hasValidators(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// conditionalRequest returns a copy of the request validating the entry, or of an unconditional request if there is
+// no entry. The conditions of the client are removed as they are evaluated against the response once the upstream
+// answered
+func conditionalRequest(req *http.Request, e *Entry) *http.Request {
+	if req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" && e == nil {
+		return req
+	}
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.Header = utils.CloneHeaders(req.Header)
+	outReq.Header.Del("If-None-Match")
+	outReq.Header.Del("If-Modified-Since")
+	if e == nil {
+		return outReq
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		outReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		outReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return outReq
+}
+
+// notModified evaluates the conditions of the request against the headers of a stored response, see RFC 7232 section 6
+func notModified(req *http.Request, h http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims := parseDate(req.Header, "If-Modified-Since")
+	lastModified := parseDate(h, "Last-Modified")
+	return !ims.IsZero() && !lastModified.IsZero() && !lastModified.After(ims)
+}
+
+// captureWriter records the response of the next handler while passing it to the client,
+// unless passThrough decides to hold it back once the status code is known.
+// The client gets a 304 without the body if notModified matches the response to its conditions
+type captureWriter struct {
+	w             http.ResponseWriter
+	header        http.Header
+	passThrough   func(code int) bool
+	onPassThrough func(h http.Header)
+	notModified   func(code int, h http.Header) bool
+
+	code        int
+	wroteHeader bool
+	passing     bool
+	// discard is true if the body is not passed to the client
+	discard bool
+
+	record   bool
+	body     bytes.Buffer
+	maxBytes int64
+	overflow bool
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.code = code
+	cw.passing = cw.passThrough(code)
+	if !cw.passing {
+		return
+	}
+	utils.CopyHeaders(cw.w.Header(), cw.header)
+	cw.onPassThrough(cw.w.Header())
+	if cw.notModified != nil && cw.notModified(code, cw.header) {
+		cw.discard = true
+		cw.w.Header().Del("Content-Length")
+		cw.w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	cw.w.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.record && !cw.overflow {
+		if int64(cw.body.Len()+len(p)) > cw.maxBytes {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	if !cw.passing || cw.discard {
+		return len(p), nil
+	}
+	return cw.w.Write(p)
+}
+
+func (cw *captureWriter) Flush() {
+	if !cw.passing || cw.discard {
+		return
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,420 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestHitAndExpiry(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "hello %d", n)
+	})
+
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello 1", string(body))
+	assert.Equal(t, StatusMiss, re.Header.Get(DefaultStatusHeader))
+
+	clock.Advance(30 * time.Second)
+	re, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "hello 1", string(body))
+	assert.Equal(t, StatusHit, re.Header.Get(DefaultStatusHeader))
+	assert.Equal(t, "30", re.Header.Get("Age"))
+
+	clock.Advance(31 * time.Second)
+	re, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "hello 2", string(body))
+	assert.Equal(t, StatusMiss, re.Header.Get(DefaultStatusHeader))
+}
+
+func TestRequestDirectives(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+
+	testCases := []struct {
+		desc           string
+		cacheControl   string
+		elapsed        time.Duration
+		expectedStatus string
+	}{
+		{desc: "fresh", elapsed: 10 * time.Second, expectedStatus: StatusHit},
+		{desc: "no-cache", cacheControl: "no-cache", elapsed: 10 * time.Second, expectedStatus: StatusMiss},
+		{desc: "max-age exceeded", cacheControl: "max-age=5", elapsed: 10 * time.Second, expectedStatus: StatusMiss},
+		{desc: "max-age", cacheControl: "max-age=20", elapsed: 10 * time.Second, expectedStatus: StatusHit},
+		{desc: "min-fresh", cacheControl: "min-fresh=55", elapsed: 10 * time.Second, expectedStatus: StatusMiss},
+		{desc: "stale", elapsed: 70 * time.Second, expectedStatus: StatusMiss},
+		{desc: "max-stale", cacheControl: "max-stale=20", elapsed: 70 * time.Second, expectedStatus: StatusHit},
+		{desc: "max-stale exceeded", cacheControl: "max-stale=5", elapsed: 70 * time.Second, expectedStatus: StatusMiss},
+		{desc: "unbounded max-stale", cacheControl: "max-stale", elapsed: time.Hour, expectedStatus: StatusHit},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			clock := testutils.GetClock()
+			c, err := New(handler, Clock(clock))
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(c)
+			defer srv.Close()
+
+			_, _, err = testutils.Get(srv.URL)
+			require.NoError(t, err)
+
+			clock.Advance(test.elapsed)
+			var opts []testutils.ReqOption
+			if test.cacheControl != "" {
+				opts = append(opts, testutils.Header("Cache-Control", test.cacheControl))
+			}
+			re, _, err := testutils.Get(srv.URL, opts...)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedStatus, re.Header.Get(DefaultStatusHeader))
+		})
+	}
+}
+
+func TestNotStored(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		header  http.Header
+		code    int
+		request http.Header
+	}{
+		{desc: "no-store", header: http.Header{"Cache-Control": {"max-age=60, no-store"}}},
+		{desc: "private", header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{desc: "vary all", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+		{desc: "vary list with all", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept, *"}}},
+		{desc: "vary lines with all", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept", "*"}}},
+		{desc: "set-cookie", header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}},
+		{desc: "no freshness", header: http.Header{}},
+		{desc: "not cacheable status", header: http.Header{}, code: http.StatusInternalServerError},
+		{desc: "request no-store", header: http.Header{"Cache-Control": {"max-age=60"}}, request: http.Header{"Cache-Control": {"no-store"}}},
+		{desc: "authorization", header: http.Header{"Cache-Control": {"max-age=60"}}, request: http.Header{"Authorization": {"Bearer abc"}}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var calls int32
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				for k, v := range test.header {
+					w.Header()[k] = v
+				}
+				if test.code != 0 {
+					w.WriteHeader(test.code)
+				}
+				w.Write([]byte("hello"))
+			})
+
+			store := NewMemoryStore(1024)
+			c, err := New(handler, WithStore(store))
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(c)
+			defer srv.Close()
+
+			for i := 0; i < 2; i++ {
+				_, body, err := testutils.Get(srv.URL, testutils.Headers(test.request))
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(body))
+			}
+			assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+			assert.Equal(t, 0, store.Len())
+		})
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	var calls, notModified int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.Header().Set("X-Revalidated", "yes")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	clock.Advance(20 * time.Second)
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, StatusRevalidated, re.Header.Get(DefaultStatusHeader))
+	assert.Equal(t, "yes", re.Header.Get("X-Revalidated"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&notModified))
+
+	// the revalidated entry is fresh again
+	clock.Advance(5 * time.Second)
+	re, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, StatusHit, re.Header.Get(DefaultStatusHeader))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestClientConditionalRequest(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `W/"v1"`)
+		w.Header().Set("Last-Modified", "Sun, 04 Mar 2012 05:00:00 GMT")
+		w.Write([]byte("hello"))
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		header       string
+		value        string
+		expectedCode int
+	}{
+		{desc: "matching etag", header: "If-None-Match", value: `"v0", "v1"`, expectedCode: http.StatusNotModified},
+		{desc: "other etag", header: "If-None-Match", value: `"v2"`, expectedCode: http.StatusOK},
+		{desc: "not modified since", header: "If-Modified-Since", value: "Sun, 04 Mar 2012 06:00:00 GMT", expectedCode: http.StatusNotModified},
+		{desc: "modified since", header: "If-Modified-Since", value: "Sun, 04 Mar 2012 04:00:00 GMT", expectedCode: http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			re, _, err := testutils.Get(srv.URL, testutils.Header(test.header, test.value))
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+			assert.Equal(t, StatusHit, re.Header.Get(DefaultStatusHeader))
+		})
+	}
+}
+
+func TestClientConditionalRequestOnMiss(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	// the conditions are evaluated by the cache, the upstream sends the full response to store
+	re, body, err := testutils.Get(srv.URL, testutils.Header("If-None-Match", `"v1"`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, re.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, StatusMiss, re.Header.Get(DefaultStatusHeader))
+
+	re, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, StatusHit, re.Header.Get(DefaultStatusHeader))
+}
+
+func TestVary(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello " + req.Header.Get("Accept-Language")))
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		for _, lang := range []string{"en", "fr"} {
+			_, body, err := testutils.Get(srv.URL, testutils.Header("Accept-Language", lang))
+			require.NoError(t, err)
+			assert.Equal(t, "hello "+lang, string(body))
+		}
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestInvalidation(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opts []Option
+	}{
+		{desc: "default key"},
+		{desc: "custom key", opts: []Option{Key(func(req *http.Request) string {
+			return req.Header.Get("X-Tenant") + " " + DefaultKey(req)
+		})}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var calls int32
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodPost {
+					w.Header().Set("Location", "/other")
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				n := atomic.AddInt32(&calls, 1)
+				w.Header().Set("Cache-Control", "max-age=60")
+				fmt.Fprintf(w, "hello %d", n)
+			})
+
+			c, err := New(handler, append(test.opts, Clock(testutils.GetClock()))...)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(c)
+			defer srv.Close()
+
+			tenant := testutils.Header("X-Tenant", "acme")
+			for _, path := range []string{"/", "/other"} {
+				_, body, err := testutils.Get(srv.URL+path, tenant)
+				require.NoError(t, err)
+				_, cached, err := testutils.Get(srv.URL+path, tenant)
+				require.NoError(t, err)
+				assert.Equal(t, string(body), string(cached))
+			}
+			assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+			re, _, err := testutils.Post(srv.URL, tenant)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, re.StatusCode)
+
+			for _, path := range []string{"/", "/other"} {
+				re, _, err := testutils.Get(srv.URL+path, tenant)
+				require.NoError(t, err)
+				assert.Equal(t, StatusMiss, re.Header.Get(DefaultStatusHeader), path)
+			}
+			assert.EqualValues(t, 4, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestOnlyIfCached(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Cache-Control", "only-if-cached"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	re, body, err := testutils.Get(srv.URL, testutils.Header("Cache-Control", "only-if-cached"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestHead(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+
+	c, err := New(handler, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	re, body, err := testutils.MakeRequest(srv.URL, testutils.Method(http.MethodHead))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Empty(t, body)
+	assert.EqualValues(t, 5, re.ContentLength)
+	assert.Equal(t, StatusHit, re.Header.Get(DefaultStatusHeader))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestMaxEntryBytes(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello world"))
+	})
+
+	c, err := New(handler, MaxEntryBytes(5))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		_, body, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(body))
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+	_, err = New(handler, MaxEntryBytes(-1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the parsed directives of a Cache-Control header
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range h[http.CanonicalHeaderKey("Cache-Control")] {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, arg = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// duration returns the value of a delta-seconds directive, ok is false when the directive is missing or invalid
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheableByDefault lists the status codes that can be cached without explicit freshness information, see RFC 7231 section 6.1
+var cacheableByDefault = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+	http.StatusPermanentRedirect:    true,
+}
+
+// isStorable tells whether a shared cache is allowed to store the response to the request, see RFC 7234 section 3
+func isStorable(req *http.Request, code int, header http.Header) bool {
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(header)
+
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	// a 304 answers the conditions of a client, it has no body to serve to the other ones
+	if code == http.StatusNotModified {
+		return false
+	}
+	for _, name := range varyNames(header) {
+		if name == "*" {
+			return false
+		}
+	}
+	// responses setting cookies are personal, storing them would leak the cookie to other clients
+	if len(header["Set-Cookie"]) > 0 {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	if cacheableByDefault[code] {
+		return true
+	}
+	// other status codes need explicit freshness information
+	return respCC.has("public") || respCC.has("s-maxage") || respCC.has("max-age") || header.Get("Expires") != ""
+}
+
+// freshnessLifetime computes how long the response stays fresh, see RFC 7234 section 4.2.1
+func freshnessLifetime(header http.Header, defaultTTL time.Duration) time.Duration {
+	cc := parseCacheControl(header)
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+
+	date := parseDate(header, "Date")
+	if expires := header.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil || date.IsZero() || exp.Before(date) {
+			// invalid dates represent a time in the past
+			return 0
+		}
+		return exp.Sub(date)
+	}
+
+	if lastModified := parseDate(header, "Last-Modified"); !lastModified.IsZero() && !date.IsZero() && date.After(lastModified) {
+		// heuristic freshness, 10% of the time since the last modification, see RFC 7234 section 4.2.2
+		return date.Sub(lastModified) / 10
+	}
+	return defaultTTL
+}
+
+func parseDate(header http.Header, name string) time.Time {
+	value := header.Get(name)
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(http.Header{"Cache-Control": {`Public, max-age=60`, `no-cache="Set-Cookie"`}})
+
+	assert.True(t, cc.has("public"))
+	assert.Equal(t, "Set-Cookie", cc["no-cache"])
+
+	d, ok := cc.duration("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+
+	_, ok = cc.duration("s-maxage")
+	assert.False(t, ok)
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{
+			desc:     "s-maxage wins over max-age",
+			header:   http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}},
+			expected: 10 * time.Second,
+		},
+		{
+			desc:     "max-age wins over expires",
+			header:   http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"Sun, 04 Mar 2012 06:00:00 GMT"}},
+			expected: time.Minute,
+		},
+		{
+			desc:     "expires",
+			header:   http.Header{"Date": {"Sun, 04 Mar 2012 05:00:00 GMT"}, "Expires": {"Sun, 04 Mar 2012 06:00:00 GMT"}},
+			expected: time.Hour,
+		},
+		{
+			desc:     "invalid expires",
+			header:   http.Header{"Date": {"Sun, 04 Mar 2012 05:00:00 GMT"}, "Expires": {"0"}},
+			expected: 0,
+		},
+		{
+			desc:     "heuristic",
+			header:   http.Header{"Date": {"Sun, 04 Mar 2012 05:00:00 GMT"}, "Last-Modified": {"Sun, 04 Mar 2012 04:00:00 GMT"}},
+			expected: 6 * time.Minute,
+		},
+		{
+			desc:     "default",
+			header:   http.Header{},
+			expected: 42 * time.Second,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.expected, freshnessLifetime(test.header, 42*time.Second))
+		})
+	}
+}
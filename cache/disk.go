@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DiskStore is a Store keeping every entry in its own file of a directory.
+// Entries are never evicted, the directory is expected to be cleaned up by its owner.
+type DiskStore struct {
+	dir string
+}
+
+// NewDiskStore creates a new DiskStore writing its files in dir, the directory is created if needed
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %v", dir, err)
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+// Get returns the entry stored for the key, nil if there is none
+func (s *DiskStore) Get(key string) (*Entry, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	e := &Entry{}
+	if err := gob.NewDecoder(f).Decode(e); err != nil {
+		return nil, fmt.Errorf("failed to decode cache entry %s: %v", f.Name(), err)
+	}
+	return e, nil
+}
+
+// Set stores the entry for the key. The entry is written to a temporary file first,
+// so concurrent readers never see a partially written entry.
+func (s *DiskStore) Set(key string, e *Entry) error {
+	f, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(e); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(key))
+}
+
+// Delete removes the entry stored for the key
+func (s *DiskStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a response stored in the cache
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// RequestTime and ResponseTime are the times at which the request was sent and the response received,
+	// they are used to compute the age of the entry
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// VaryHeaders holds the request headers selected by the Vary response header, an entry only
+	// serves requests having the same values for these headers
+	VaryHeaders http.Header
+}
+
+// size approximates the memory used by the entry
+func (e *Entry) size() int64 {
+	size := int64(len(e.Body))
+	for _, h := range []http.Header{e.Header, e.VaryHeaders} {
+		for k, vv := range h {
+			size += int64(len(k))
+			for _, v := range vv {
+				size += int64(len(v))
+			}
+		}
+	}
+	return size
+}
+
+// Store persists the cache entries. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the entry stored for the key, nil if there is none
+	Get(key string) (*Entry, error)
+	// Set stores the entry for the key, replacing any existing one
+	Set(key string, e *Entry) error
+	// Delete removes the entry stored for the key, deleting a missing key is not an error
+	Delete(key string) error
+}
+
+// MemoryStore is an in memory Store bounded in size, the least recently used entries are evicted first
+type MemoryStore struct {
+	mutex    *sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// NewMemoryStore creates a new MemoryStore holding up to maxBytes of responses
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		mutex:    &sync.Mutex{},
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// Get returns the entry stored for the key, nil if there is none
+func (s *MemoryStore) Get(key string) (*Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, nil
+}
+
+// Set stores the entry for the key, entries larger than the store are ignored
+func (s *MemoryStore) Set(key string, e *Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(key)
+	item := &memoryItem{key: key, entry: e, size: e.size() + int64(len(key))}
+	if item.size > s.maxBytes {
+		return nil
+	}
+	s.entries[key] = s.lru.PushFront(item)
+	s.size += item.size
+
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+// Delete removes the entry stored for the key
+func (s *MemoryStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remove(key)
+	return nil
+}
+
+// Len returns the number of entries in the store
+func (s *MemoryStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lru.Len()
+}
+
+// Size returns the approximate size of the entries in bytes
+func (s *MemoryStore) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
+
+func (s *MemoryStore) remove(key string) {
+	el, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.entries, key)
+	s.size -= el.Value.(*memoryItem).size
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreEviction(t *testing.T) {
+	s := NewMemoryStore(30)
+
+	require.NoError(t, s.Set("a", &Entry{Body: []byte("0123456789")}))
+	require.NoError(t, s.Set("b", &Entry{Body: []byte("0123456789")}))
+	assert.Equal(t, 2, s.Len())
+	assert.EqualValues(t, 22, s.Size())
+
+	// a is now the most recently used
+	e, err := s.Get("a")
+	require.NoError(t, err)
+	require.NotNil(t, e)
+
+	require.NoError(t, s.Set("c", &Entry{Body: []byte("0123456789")}))
+	assert.Equal(t, 2, s.Len())
+
+	e, err = s.Get("b")
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	// too big to be stored at all
+	require.NoError(t, s.Set("d", &Entry{Body: make([]byte, 100)}))
+	e, err = s.Get("d")
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	require.NoError(t, s.Delete("a"))
+	require.NoError(t, s.Delete("missing"))
+	assert.Equal(t, 1, s.Len())
+	assert.EqualValues(t, 11, s.Size())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStore(dir)
+	require.NoError(t, err)
+
+	e, err := s.Get("GET localhost/")
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	entry := &Entry{
+		StatusCode:   http.StatusOK,
+		Header:       http.Header{"Etag": {`"v1"`}},
+		Body:         []byte("hello"),
+		RequestTime:  time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+		ResponseTime: time.Date(2012, 3, 4, 5, 6, 8, 0, time.UTC),
+	}
+	require.NoError(t, s.Set("GET localhost/", entry))
+
+	e, err = s.Get("GET localhost/")
+	require.NoError(t, err)
+	assert.Equal(t, entry, e)
+
+	require.NoError(t, s.Delete("GET localhost/"))
+	require.NoError(t, s.Delete("GET localhost/"))
+	e, err = s.Get("GET localhost/")
+	require.NoError(t, err)
+	assert.Nil(t, e)
+}
@@ -23,6 +23,11 @@
 // * OnTripped action is called on transition (Standby -> Tripped)
 // * OnStandby action is called on transition (Recovering -> Standby)
 //
+// A circuit breaker guarding a single server can eject it from its load balancer while tripped, see Eject.
+//
+// A circuit breaker can also enter a "Degraded" state, distinct from the tripped state, when a latency condition
+// matches but not its condition, see Degrade.
+//
 package cbreaker
 
 import (
@@ -31,8 +36,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/oxy/utils"
 )
@@ -41,6 +46,11 @@ import (
 type CircuitBreaker struct {
 	m       *sync.RWMutex
 	metrics *memmetrics.RTMetrics
+	// exported are the metrics registered by the Metrics option
+	exported *breakerMetrics
+	events   events.Emitter
+	skip     func(req *http.Request) bool
+	scope    func(req *http.Request) bool
 
 	condition hpredicate
 
@@ -49,9 +59,13 @@ type CircuitBreaker struct {
 
 	onTripped SideEffect
 	onStandby SideEffect
+	ejector   *ejector
+	degrade   *degrade
 
 	state cbState
 	until time.Time
+	// lastTransition is the time of the last change of state
+	lastTransition time.Time
 
 	rc *ratioController
 
@@ -61,7 +75,7 @@ type CircuitBreaker struct {
 	fallback http.Handler
 	next     http.Handler
 
-	clock timetools.TimeProvider
+	clock utils.Clock
 
 	log *log.Logger
 }
@@ -72,12 +86,12 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 		m:    &sync.RWMutex{},
 		next: next,
 		// Default values. Might be overwritten by options below.
-		clock:            &timetools.RealTime{},
+		clock:            utils.InheritedClock(),
 		checkPeriod:      defaultCheckPeriod,
 		fallbackDuration: defaultFallbackDuration,
 		recoveryDuration: defaultRecoveryDuration,
 		fallback:         defaultFallback,
-		log:              log.StandardLogger(),
+		log:              utils.InheritedLogger(),
 	}
 
 	for _, s := range options {
@@ -92,7 +106,7 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 	}
 	cb.condition = condition
 
-	mt, err := memmetrics.NewRTMetrics()
+	mt, err := memmetrics.NewRTMetrics(memmetrics.RTClock(cb.clock))
 	if err != nil {
 		return nil, err
 	}
@@ -117,10 +131,23 @@ func (c *CircuitBreaker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		logEntry.Debug("vulcand/oxy/circuitbreaker: begin ServeHttp on request")
 		defer logEntry.Debug("vulcand/oxy/circuitbreaker: completed ServeHttp on request")
 	}
+	if !c.inScope(req) {
+		c.next.ServeHTTP(w, req)
+		return
+	}
 	if c.activateFallback(w, req) {
+		if c.exported != nil {
+			c.exported.fallbacks.Inc()
+		}
 		c.fallback.ServeHTTP(w, req)
 		return
 	}
+	if c.activateDegraded() {
+		c.degrade.handler.ServeHTTP(w, req)
+		// the degraded state is left once the latency of the passed requests is back to normal
+		c.checkAndSet()
+		return
+	}
 	c.serve(w, req)
 }
 
@@ -132,7 +159,7 @@ func (c *CircuitBreaker) Wrap(next http.Handler) {
 // updateState updates internal state and returns true if fallback should be used and false otherwise
 func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Request) bool {
 	// Quick check with read locks optimized for normal operation use-case
-	if c.isStandby() {
+	if c.isStandbyOrDegraded() {
 		return false
 	}
 	// Circuit breaker is in tripped or recovering state
@@ -142,7 +169,7 @@ func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Reque
 	c.log.Warnf("%v is in error state", c)
 
 	switch c.state {
-	case stateStandby:
+	case stateStandby, stateDegraded:
 		// someone else has set it to standby just now
 		return false
 	case stateTripped:
@@ -169,7 +196,8 @@ func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Reque
 
 func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
 	start := c.clock.UtcNow()
-	p := utils.NewProxyWriterWithLogger(w, c.log)
+	p := utils.AcquireProxyWriter(w, c.log)
+	defer utils.ReleaseProxyWriter(p)
 
 	c.next.ServeHTTP(p, req)
 
@@ -181,10 +209,44 @@ func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
 	c.checkAndSet()
 }
 
-func (c *CircuitBreaker) isStandby() bool {
+func (c *CircuitBreaker) isStandbyOrDegraded() bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.state == stateStandby || c.state == stateDegraded
+}
+
+// Tripped returns true while the circuit breaker serves all the requests with the fallback
+func (c *CircuitBreaker) Tripped() bool {
 	c.m.RLock()
 	defer c.m.RUnlock()
-	return c.state == stateStandby
+	return c.state == stateTripped
+}
+
+// State returns the state of the circuit breaker: standby, tripped, recovering or degraded
+func (c *CircuitBreaker) State() string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.state.String()
+}
+
+// Trip trips the circuit breaker manually, the fallback serves all the requests for the fallback duration,
+// then the circuit breaker recovers as if its condition had matched
+func (c *CircuitBreaker) Trip() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.setState(stateTripped, c.clock.UtcNow().Add(c.fallbackDuration))
+	c.metrics.Reset()
+}
+
+// Reset sets the circuit breaker back to the standby state, with fresh metrics
+func (c *CircuitBreaker) Reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.state == stateStandby {
+		return
+	}
+	c.setState(stateStandby, time.Time{})
+	c.metrics.Reset()
 }
 
 // String returns log-friendly representation of the circuit breaker state
@@ -211,12 +273,30 @@ func (c *CircuitBreaker) exec(s SideEffect) {
 
 func (c *CircuitBreaker) setState(new cbState, until time.Time) {
 	c.log.Debugf("%v setting state to %v, until %v", c, new, until)
+	former := c.state
 	c.state = new
 	c.until = until
+	c.lastTransition = c.clock.UtcNow()
+	if c.exported != nil {
+		c.exported.transitions.With(new.String()).Inc()
+	}
+	if c.events != nil {
+		c.events.Emit(events.BreakerStateChanged{From: former.String(), To: new.String(), Until: until})
+	}
 	switch new {
 	case stateTripped:
+		if c.ejector != nil {
+			c.ejector.eject(c, until.Sub(c.clock.UtcNow()))
+		}
 		c.exec(c.onTripped)
 	case stateStandby:
+		if former == stateDegraded {
+			// the server was not ejected, and the side effects are for the recoveries
+			return
+		}
+		if c.ejector != nil {
+			c.ejector.restore(c, 0)
+		}
 		c.exec(c.onStandby)
 	}
 }
@@ -248,6 +328,7 @@ func (c *CircuitBreaker) checkAndSet() {
 	}
 
 	if !c.condition(c) {
+		c.checkDegraded()
 		return
 	}
 
@@ -266,13 +347,41 @@ type CircuitBreakerOption func(*CircuitBreaker) error
 
 // Clock allows you to fake che CircuitBreaker's view of the current time.
 // Intended for unit tests.
-func Clock(clock timetools.TimeProvider) CircuitBreakerOption {
+func Clock(clock utils.Clock) CircuitBreakerOption {
 	return func(c *CircuitBreaker) error {
 		c.clock = clock
 		return nil
 	}
 }
 
+// SkipFunc sets a predicate of the requests passed to the next handler whatever the state of the CircuitBreaker,
+// e.g. the health checks. Their responses are not recorded in the metrics of the condition.
+func SkipFunc(skip func(req *http.Request) bool) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.skip = skip
+		return nil
+	}
+}
+
+// ScopeFunc sets a predicate of the requests guarded by the CircuitBreaker, e.g. the POST requests to /orders: the
+// other requests are passed to the next handler whatever the state of the CircuitBreaker, and their responses are not
+// recorded in the metrics of the condition, so that the noise traffic neither masks nor triggers the trips. The
+// requests matching SkipFunc are passed through even when they are in the scope.
+func ScopeFunc(scope func(req *http.Request) bool) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.scope = scope
+		return nil
+	}
+}
+
+// inScope returns true if the request is guarded by the CircuitBreaker, see ScopeFunc and SkipFunc
+func (c *CircuitBreaker) inScope(req *http.Request) bool {
+	if c.skip != nil && c.skip(req) {
+		return false
+	}
+	return c.scope == nil || c.scope(req)
+}
+
 // FallbackDuration is how long the CircuitBreaker will remain in the Tripped
 // state before trying to recover.
 func FallbackDuration(d time.Duration) CircuitBreakerOption {
@@ -338,6 +447,8 @@ func (s cbState) String() string {
 		return "tripped"
 	case stateRecovering:
 		return "recovering"
+	case stateDegraded:
+		return "degraded"
 	}
 	return "undefined"
 }
@@ -349,6 +460,8 @@ const (
 	stateTripped
 	// CircuitBreaker passes some requests to go through, rejecting others
 	stateRecovering
+	// CircuitBreaker passes some requests to go through, serving the others with the degraded handler
+	stateDegraded
 )
 
 const (
@@ -361,7 +474,7 @@ var defaultFallback = &fallback{}
 
 type fallback struct{}
 
+// ServeHTTP passes utils.ErrCircuitOpen to the default error handler, answering 503 Service Unavailable
 func (f *fallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(http.StatusServiceUnavailable)
-	w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+	utils.DefaultHandler.ServeHTTP(w, req, utils.ErrCircuitOpen)
 }
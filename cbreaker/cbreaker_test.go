@@ -6,12 +6,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/metrics"
 	"github.com/vulcand/oxy/testutils"
 )
 
@@ -52,27 +55,27 @@ func TestFullCycle(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 
 	cb.metrics = statsNetErrors(0.6)
-	clock.CurrentTime = clock.CurrentTime.Add(defaultCheckPeriod + time.Millisecond)
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, cbState(stateTripped), cb.state)
 
 	// Some time has passed, but we are still in trapped state.
-	clock.CurrentTime = clock.CurrentTime.Add(9 * time.Second)
+	clock.Advance(9 * time.Second)
 	re, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
 	assert.Equal(t, cbState(stateTripped), cb.state)
 
 	// We should be in recovering state by now
-	clock.CurrentTime = clock.CurrentTime.Add(time.Second*1 + time.Millisecond)
+	clock.Advance(time.Second*1 + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
 	assert.Equal(t, cbState(stateRecovering), cb.state)
 
 	// 5 seconds after we should be allowing some requests to pass
-	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	clock.Advance(5 * time.Second)
 	allowed := 0
 	for i := 0; i < 100; i++ {
 		re, _, err = testutils.Get(srv.URL)
@@ -83,7 +86,7 @@ func TestFullCycle(t *testing.T) {
 	assert.NotEqual(t, 0, allowed)
 
 	// After some time, all is good and we should be in stand by mode again
-	clock.CurrentTime = clock.CurrentTime.Add(5*time.Second + time.Millisecond)
+	clock.Advance(5*time.Second + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
 	assert.Equal(t, cbState(stateStandby), cb.state)
 	require.NoError(t, err)
@@ -172,14 +175,14 @@ func TestTriggerDuringRecovery(t *testing.T) {
 	assert.Equal(t, cbState(stateTripped), cb.state)
 
 	// We should be in recovering state by now
-	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
+	clock.Advance(10*time.Second + time.Millisecond)
 	re, _, err := testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
 	assert.Equal(t, cbState(stateRecovering), cb.state)
 
 	// We have matched error condition during recovery state and are going back to tripped state
-	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	clock.Advance(5 * time.Second)
 	cb.metrics = statsNetErrors(0.6)
 	allowed := 0
 	for i := 0; i < 100; i++ {
@@ -259,14 +262,14 @@ func TestSideEffects(t *testing.T) {
 	}
 
 	// Transition to recovering state
-	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
+	clock.Advance(10*time.Second + time.Millisecond)
 	cb.metrics = statsOK()
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, cbState(stateRecovering), cb.state)
 
 	// Going back to standby
-	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
+	clock.Advance(10*time.Second + time.Millisecond)
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, cbState(stateStandby), cb.state)
@@ -330,3 +333,150 @@ type statusCode struct {
 	Code  int
 	Count int64
 }
+
+func TestMetrics(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	clock := testutils.GetClock()
+	registry := metrics.NewRegistry()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Metrics(registry.With("backend", "api")))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Contains(t, string(registry.Gather()), `oxy_cbreaker_state{backend="api"} 0`)
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, `oxy_cbreaker_state{backend="api"} 1`)
+	assert.Contains(t, gathered, `oxy_cbreaker_transitions_total{backend="api",state="tripped"} 1`)
+	assert.Contains(t, gathered, `oxy_cbreaker_fallbacks_total{backend="api"} 1`)
+}
+
+func TestEvents(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	clock := testutils.GetClock()
+	bus := events.NewBus()
+	var received []events.Event
+	bus.Subscribe(func(m events.Message) {
+		assert.Equal(t, "api", m.Source)
+		received = append(received, m.Event)
+	})
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Events(bus.Source("api")))
+	require.NoError(t, err)
+
+	cb.Trip()
+	assert.True(t, cb.Tripped())
+	assert.Equal(t, "tripped", cb.State())
+	cb.Reset()
+	assert.Equal(t, "standby", cb.State())
+	cb.Reset()
+
+	assert.Equal(t, []events.Event{
+		events.BreakerStateChanged{From: "standby", To: "tripped", Until: clock.UtcNow().Add(defaultFallbackDuration)},
+		events.BreakerStateChanged{From: "tripped", To: "standby"},
+	}, received)
+}
+
+func TestSkipFunc(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	cb, err := New(handler, triggerNetRatio, Clock(testutils.GetClock()),
+		SkipFunc(func(req *http.Request) bool { return req.Header.Get("X-Debug") != "" }))
+	require.NoError(t, err)
+	cb.Trip()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	cb.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	req.Header.Set("X-Debug", "1")
+	rec = httptest.NewRecorder()
+	cb.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestScopeFunc(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	isOrder := func(req *http.Request) bool {
+		return req.Method == http.MethodPost && strings.HasPrefix(req.URL.Path, "/orders")
+	}
+	cb, err := New(handler, "ResponseCodeRatio(500, 600, 0, 600) > 0.5", Clock(testutils.GetClock()),
+		ScopeFunc(isOrder),
+		SkipFunc(func(req *http.Request) bool { return req.Header.Get("X-Debug") != "" }))
+	require.NoError(t, err)
+
+	// the failing requests out of the scope are not recorded
+	for i := 0; i < 10; i++ {
+		cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	}
+	assert.EqualValues(t, 0, cb.metrics.TotalCount())
+	assert.False(t, cb.Tripped())
+
+	cb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/orders", nil))
+	require.True(t, cb.Tripped())
+
+	testCases := []struct {
+		desc     string
+		method   string
+		path     string
+		header   string
+		expected int
+	}{
+		{desc: "in scope", method: http.MethodPost, path: "/orders/1", expected: http.StatusServiceUnavailable},
+		{desc: "out of scope", method: http.MethodGet, path: "/orders/1", expected: http.StatusInternalServerError},
+		{desc: "skipped in scope", method: http.MethodPost, path: "/orders/1", header: "1", expected: http.StatusInternalServerError},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if test.header != "" {
+				req.Header.Set("X-Debug", test.header)
+			}
+			rec := httptest.NewRecorder()
+			cb.ServeHTTP(rec, req)
+			assert.Equal(t, test.expected, rec.Code)
+		})
+	}
+}
+
+func BenchmarkCircuitBreaker(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	cb, err := New(handler, triggerNetRatio)
+	require.NoError(b, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := testutils.NewDiscardWriter()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		cb.ServeHTTP(w, req)
+	}
+}
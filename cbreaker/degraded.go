@@ -0,0 +1,88 @@
+package cbreaker
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// degrade is the degraded mode of a circuit breaker
+type degrade struct {
+	condition hpredicate
+	handler   http.Handler
+	ratio     float64
+
+	// passed and served count the requests passed to the next handler and served by the handler since the circuit
+	// breaker is degraded
+	passed, served int
+}
+
+// Degrade defines a degraded mode, distinct from the tripped state: while the expression matches, e.g. a latency
+// condition like "LatencyAtQuantileMS(50.0) > 200", and the condition of the circuit breaker does not, the requests
+// are served by the handler, e.g. simplified or cached responses, but for the ratio of the requests still passed to
+// the next handler, so that the latency keeps being measured.
+//
+// The circuit breaker leaves the degraded state once the expression no longer matches, and trips as usual if its
+// condition matches. The side effects and the ejection of the server are for the tripped state only.
+func Degrade(expression string, handler http.Handler, ratio float64) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if handler == nil {
+			return fmt.Errorf("degraded handler can not be nil")
+		}
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("degraded ratio should be in [0, 1], got %v", ratio)
+		}
+		condition, err := parseExpression(expression)
+		if err != nil {
+			return err
+		}
+		c.degrade = &degrade{condition: condition, handler: handler, ratio: ratio}
+		return nil
+	}
+}
+
+// activateDegraded returns true if the request should be served by the degraded handler
+func (c *CircuitBreaker) activateDegraded() bool {
+	if c.degrade == nil {
+		return false
+	}
+	c.m.RLock()
+	degraded := c.state == stateDegraded
+	c.m.RUnlock()
+	if !degraded {
+		return false
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.state != stateDegraded {
+		return false
+	}
+	d := c.degrade
+	// pass the request if it keeps the ratio of the passed requests under the target
+	if float64(d.passed+1) <= d.ratio*float64(d.passed+d.served+1) {
+		d.passed++
+		return false
+	}
+	d.served++
+	return true
+}
+
+// checkDegraded enters or leaves the degraded state, it is called with the lock held once the condition of the
+// circuit breaker did not match
+func (c *CircuitBreaker) checkDegraded() {
+	if c.degrade == nil {
+		return
+	}
+	switch c.state {
+	case stateStandby:
+		if c.degrade.condition(c) {
+			c.degrade.passed, c.degrade.served = 0, 0
+			c.setState(stateDegraded, c.clock.UtcNow())
+		}
+	case stateDegraded:
+		if !c.degrade.condition(c) {
+			c.setState(stateStandby, c.clock.UtcNow())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestDegraded(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	degraded := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("cached"))
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock),
+		Degrade("LatencyAtQuantileMS(50.0) > 50", degraded, 0.25),
+		OnStandby(&failingEffect{t: t}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	_, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	cb.metrics = statsSlow(10, 100*time.Millisecond)
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "degraded", cb.State())
+
+	// a quarter of the requests still reach the backend
+	served := map[string]int{}
+	for i := 0; i < 8; i++ {
+		re, body, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		served[string(body)]++
+	}
+	assert.Equal(t, map[string]int{"hello": 2, "cached": 6}, served)
+
+	// the latency is back to normal
+	cb.metrics = statsOK()
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "standby", cb.State())
+
+	_, body, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestDegradedTrips(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Degrade("LatencyAtQuantileMS(50.0) > 50", handler, 0.5))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	cb.metrics = statsSlow(10, 100*time.Millisecond)
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "degraded", cb.State())
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	for cb.State() == "degraded" {
+		_, _, err = testutils.Get(srv.URL)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "tripped", cb.State())
+}
+
+func TestDegradeInvalid(t *testing.T) {
+	handler := http.NotFoundHandler()
+
+	_, err := New(handler, triggerNetRatio, Degrade("LatencyAtQuantileMS(50.0) > 50", nil, 0.1))
+	assert.Error(t, err)
+	_, err = New(handler, triggerNetRatio, Degrade("LatencyAtQuantileMS(50.0) > 50", handler, 1.5))
+	assert.Error(t, err)
+	_, err = New(handler, triggerNetRatio, Degrade("Unknown()", handler, 0.1))
+	assert.Error(t, err)
+}
+
+func statsSlow(count int, latency time.Duration) *memmetrics.RTMetrics {
+	m, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < count; i++ {
+		m.Record(http.StatusOK, latency)
+	}
+	return m
+}
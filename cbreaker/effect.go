@@ -49,7 +49,7 @@ func NewWebhookSideEffectsWithLogger(w Webhook, l *log.Logger) (*WebhookSideEffe
 
 // NewWebhookSideEffect creates a new WebhookSideEffect
 func NewWebhookSideEffect(w Webhook) (*WebhookSideEffect, error) {
-	return NewWebhookSideEffectsWithLogger(w, log.StandardLogger())
+	return NewWebhookSideEffectsWithLogger(w, utils.InheritedLogger())
 }
 
 func (w *WebhookSideEffect) getBody() io.Reader {
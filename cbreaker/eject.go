@@ -0,0 +1,105 @@
+package cbreaker
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// Balancer is the load balancer a circuit breaker ejects its server from, e.g. a roundrobin.RoundRobin or a
+// roundrobin.Rebalancer
+type Balancer interface {
+	UpsertServer(u *url.URL, options ...roundrobin.ServerOption) error
+	RemoveServer(u *url.URL) error
+}
+
+type weighted interface {
+	ServerWeight(u *url.URL) (int, bool)
+}
+
+// Eject coordinates a circuit breaker guarding a single server with the load balancer: while the circuit breaker is
+// tripped, the server is removed from the load balancer when weight is 0, or set to the weight otherwise. The server
+// is put back with its weight once the fallback duration is over, the circuit breaker needs the requests to recover,
+// and it is ejected again if the circuit breaker trips again.
+//
+// Examples of a circuit breaker per server:
+//
+//	cb, err := cbreaker.New(fwd, "NetworkErrorRatio() > 0.5", cbreaker.Eject(lb, u, 0))
+func Eject(lb Balancer, u *url.URL, weight int) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if lb == nil || u == nil {
+			return fmt.Errorf("balancer and server URL can not be nil")
+		}
+		if weight < 0 {
+			return fmt.Errorf("eject weight should be >= 0, got %d", weight)
+		}
+		c.ejector = &ejector{lb: lb, url: u, weight: weight}
+		return nil
+	}
+}
+
+// ejector ejects a server from a load balancer
+type ejector struct {
+	lb     Balancer
+	url    *url.URL
+	weight int
+
+	mutex      sync.Mutex
+	ejected    bool
+	origWeight int
+	// generation discards the restores of the former ejections
+	generation int
+}
+
+// eject ejects the server and restores it after the fallback duration
+func (e *ejector) eject(c *CircuitBreaker, d time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.ejected {
+		e.origWeight = 0
+		if wlb, ok := e.lb.(weighted); ok {
+			e.origWeight, _ = wlb.ServerWeight(e.url)
+		}
+		var err error
+		if e.weight == 0 {
+			err = e.lb.RemoveServer(e.url)
+		} else {
+			err = e.lb.UpsertServer(e.url, roundrobin.Weight(e.weight))
+		}
+		if err != nil {
+			c.log.Errorf("%v failed to eject server %v: %v", c, e.url, err)
+			return
+		}
+		e.ejected = true
+	}
+
+	e.generation++
+	generation := e.generation
+	go func() {
+		<-c.clock.After(d)
+		e.restore(c, generation)
+	}()
+}
+
+// restore puts the server back, generation is 0 to restore the server whatever the ejection
+func (e *ejector) restore(c *CircuitBreaker, generation int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.ejected || (generation != 0 && generation != e.generation) {
+		return
+	}
+	var options []roundrobin.ServerOption
+	if e.origWeight > 0 {
+		options = append(options, roundrobin.Weight(e.origWeight))
+	}
+	if err := e.lb.UpsertServer(e.url, options...); err != nil {
+		c.log.Errorf("%v failed to restore server %v: %v", c, e.url, err)
+		return
+	}
+	e.ejected = false
+}
@@ -0,0 +1,90 @@
+package cbreaker
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestEject(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	a, b := testutils.ParseURI("http://localhost:8081"), testutils.ParseURI("http://localhost:8082")
+
+	testCases := []struct {
+		desc     string
+		weight   int
+		expected map[string]int
+	}{
+		{desc: "remove", weight: 0, expected: map[string]int{b.String(): 1}},
+		{desc: "deweight", weight: 1, expected: map[string]int{a.String(): 1, b.String(): 1}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			lb, err := roundrobin.New(fwd)
+			require.NoError(t, err)
+			require.NoError(t, lb.UpsertServer(a, roundrobin.Weight(3)))
+			require.NoError(t, lb.UpsertServer(b))
+
+			clock := testutils.GetClock()
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+			cb, err := New(handler, triggerNetRatio, Clock(clock), FallbackDuration(time.Minute), Eject(lb, a, test.weight))
+			require.NoError(t, err)
+
+			cb.Trip()
+			assert.Equal(t, test.expected, weights(lb))
+
+			// the server is back once the fallback duration is over
+			waitWaiters(t, clock.Waiters, 1)
+			clock.Advance(time.Minute)
+			waitServerWeight(t, lb, 3)
+
+			cb.Trip()
+			assert.Equal(t, test.expected, weights(lb))
+			cb.Reset()
+			assert.Equal(t, map[string]int{a.String(): 3, b.String(): 1}, weights(lb))
+		})
+	}
+}
+
+func TestEjectInvalid(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	_, err := New(handler, triggerNetRatio, Eject(nil, testutils.ParseURI("http://localhost:8081"), 0))
+	assert.Error(t, err)
+}
+
+func weights(lb *roundrobin.RoundRobin) map[string]int {
+	weights := make(map[string]int)
+	for _, u := range lb.Servers() {
+		weights[u.String()], _ = lb.ServerWeight(u)
+	}
+	return weights
+}
+
+func waitWaiters(t *testing.T, waiters func() int, n int) {
+	deadline := time.Now().Add(time.Second)
+	for waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d waiters", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitServerWeight(t *testing.T, lb *roundrobin.RoundRobin, weight int) {
+	deadline := time.Now().Add(time.Second)
+	for weights(lb)["http://localhost:8081"] != weight {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the weight %d", weight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,13 @@
+package cbreaker
+
+import (
+	"github.com/vulcand/oxy/events"
+)
+
+// Events sets the emitter the circuit breaker publishes its transitions to, as events.BreakerStateChanged
+func Events(e events.Emitter) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.events = e
+		return nil
+	}
+}
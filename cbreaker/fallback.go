@@ -34,7 +34,7 @@ func NewResponseFallbackWithLogger(r Response, l *log.Logger) (*ResponseFallback
 
 // NewResponseFallback creates a new ResponseFallback
 func NewResponseFallback(r Response) (*ResponseFallback, error) {
-	return NewResponseFallbackWithLogger(r, log.StandardLogger())
+	return NewResponseFallbackWithLogger(r, utils.InheritedLogger())
 }
 
 func (f *ResponseFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -81,7 +81,7 @@ func NewRedirectFallbackWithLogger(r Redirect, l *log.Logger) (*RedirectFallback
 
 // NewRedirectFallback creates a new RedirectFallback
 func NewRedirectFallback(r Redirect) (*RedirectFallback, error) {
-	return NewRedirectFallbackWithLogger(r, log.StandardLogger())
+	return NewRedirectFallbackWithLogger(r, utils.InheritedLogger())
 }
 
 func (f *RedirectFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
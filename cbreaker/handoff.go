@@ -0,0 +1,67 @@
+package cbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const breakerStateVersion = 1
+
+type breakerState struct {
+	Version int       `json:"version"`
+	State   string    `json:"state"`
+	Until   time.Time `json:"until,omitempty"`
+}
+
+// SaveState saves the state of the circuit breaker, see utils.StateHandoff. The metrics of the condition are not saved.
+func (c *CircuitBreaker) SaveState() ([]byte, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	state := breakerState{Version: breakerStateVersion, State: c.state.String()}
+	if c.state != stateStandby {
+		state.Until = c.until
+	}
+	return json.Marshal(state)
+}
+
+// RestoreState restores the state saved by SaveState: a tripped circuit breaker stays tripped until the end of its
+// fallback duration, and a recovering one starts its recovery over. The side effects are not executed again, the
+// server is ejected again though when the circuit breaker ejects it, see Eject.
+func (c *CircuitBreaker) RestoreState(data []byte) error {
+	var state breakerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version != breakerStateVersion {
+		return fmt.Errorf("unsupported circuit breaker state version: %d", state.Version)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	switch state.State {
+	case cbState(stateStandby).String(), cbState(stateDegraded).String():
+		// the degraded mode is entered again once the latency condition matches the fresh metrics
+		return nil
+	case cbState(stateTripped).String():
+		if c.clock.UtcNow().Before(state.Until) {
+			c.state = stateTripped
+			c.until = state.Until
+			if c.ejector != nil {
+				c.ejector.eject(c, state.Until.Sub(c.clock.UtcNow()))
+			}
+			return nil
+		}
+		// the fallback duration went by during the handoff
+		c.state = stateRecovering
+	case cbState(stateRecovering).String():
+		c.state = stateRecovering
+	default:
+		return fmt.Errorf("unknown circuit breaker state: %q", state.State)
+	}
+	c.until = c.clock.UtcNow().Add(c.recoveryDuration)
+	c.rc = newRatioController(c.clock, c.recoveryDuration, c.log)
+	return nil
+}
@@ -0,0 +1,71 @@
+package cbreaker
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+var _ utils.StateHandoff = (*CircuitBreaker)(nil)
+
+func TestCircuitBreakerStateHandoff(t *testing.T) {
+	clock := testutils.GetClock()
+
+	cb, err := New(http.NotFoundHandler(), triggerNetRatio, Clock(clock))
+	require.NoError(t, err)
+
+	// the side effects are not executed again by the replacement
+	newBreaker := func() *CircuitBreaker {
+		cb, err := New(http.NotFoundHandler(), triggerNetRatio, Clock(clock), OnTripped(&failingEffect{t: t}))
+		require.NoError(t, err)
+		return cb
+	}
+
+	data, err := cb.SaveState()
+	require.NoError(t, err)
+
+	restarted := newBreaker()
+	require.NoError(t, restarted.RestoreState(data))
+	assert.Equal(t, "standby", restarted.State())
+
+	cb.Trip()
+	data, err = cb.SaveState()
+	require.NoError(t, err)
+
+	// the tripped replacement recovers at the end of the fallback duration
+	clock.Advance(5 * time.Second)
+	restarted = newBreaker()
+	require.NoError(t, restarted.RestoreState(data))
+	assert.Equal(t, "tripped", restarted.State())
+	assert.Equal(t, cb.until, restarted.until)
+
+	// the fallback duration is over once the state is restored
+	clock.Advance(10 * time.Second)
+	restarted = newBreaker()
+	require.NoError(t, restarted.RestoreState(data))
+	assert.Equal(t, "recovering", restarted.State())
+	assert.Equal(t, clock.UtcNow().Add(defaultRecoveryDuration), restarted.until)
+}
+
+func TestCircuitBreakerRestoreStateInvalid(t *testing.T) {
+	cb, err := New(http.NotFoundHandler(), triggerNetRatio)
+	require.NoError(t, err)
+
+	assert.Error(t, cb.RestoreState([]byte(`{"version":42}`)))
+	assert.Error(t, cb.RestoreState([]byte(`{"version":1,"state":"unknown"}`)))
+	assert.Equal(t, "standby", cb.State())
+}
+
+type failingEffect struct {
+	t *testing.T
+}
+
+func (e *failingEffect) Exec() error {
+	e.t.Errorf("unexpected side effect")
+	return nil
+}
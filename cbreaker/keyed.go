@@ -0,0 +1,284 @@
+package cbreaker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultIdleTimeout is the default time after which the idle circuit breakers of a Keyed are evicted
+const DefaultIdleTimeout = 10 * time.Minute
+
+// DefaultMaxKeys is the default number of circuit breakers of a Keyed
+const DefaultMaxKeys = 10000
+
+// BreakerStats are the state and the window stats of a circuit breaker
+type BreakerStats struct {
+	// Key is the key of the circuit breaker of a Keyed, empty for a standalone circuit breaker
+	Key   string `json:"key,omitempty"`
+	State string `json:"state"`
+	// Until is the end of the tripped or recovering state
+	Until time.Time `json:"until"`
+	// LastTransition is the time of the last change of state, zero if the state never changed
+	LastTransition time.Time `json:"lastTransition"`
+	// Requests is the number of requests of the window of the metrics
+	Requests int64 `json:"requests"`
+	// NetworkErrorRatio and ServerErrorRatio are the ratios of the network errors and of the 5xx responses
+	NetworkErrorRatio float64 `json:"networkErrorRatio"`
+	ServerErrorRatio  float64 `json:"serverErrorRatio"`
+	// P99 is the 99th percentile of the latency
+	P99 time.Duration `json:"p99"`
+}
+
+// Stats returns the state and the window stats of the circuit breaker
+func (c *CircuitBreaker) Stats() BreakerStats {
+	c.m.RLock()
+	s := BreakerStats{State: c.state.String(), LastTransition: c.lastTransition}
+	if c.state == stateTripped || c.state == stateRecovering {
+		s.Until = c.until
+	}
+	c.m.RUnlock()
+
+	s.Requests = c.metrics.TotalCount()
+	s.NetworkErrorRatio = c.metrics.NetworkErrorRatio()
+	s.ServerErrorRatio = c.metrics.ResponseCodeRatio(500, 600, 0, 600)
+	if latencies, err := c.metrics.LatencyAtQuantiles(99); err == nil {
+		s.P99 = latencies[0]
+	}
+	return s
+}
+
+// KeyedOption represents an option you can pass to NewKeyed
+type KeyedOption func(*Keyed) error
+
+// IdleTimeout sets the time after which a circuit breaker of a Keyed that served no request is evicted, if it is
+// in the standby state, see Keyed.EvictIdle. It defaults to DefaultIdleTimeout.
+func IdleTimeout(d time.Duration) KeyedOption {
+	return func(k *Keyed) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout should be > 0, got %v", d)
+		}
+		k.idleTimeout = d
+		return nil
+	}
+}
+
+// MaxKeys sets the number of circuit breakers of a Keyed, it defaults to DefaultMaxKeys. Once it is reached, e.g.
+// with the keys extracted from a header set by the clients, the requests of the new keys share a single circuit
+// breaker until the idle breakers are evicted.
+func MaxKeys(n int) KeyedOption {
+	return func(k *Keyed) error {
+		if n <= 0 {
+			return fmt.Errorf("max keys should be > 0, got %d", n)
+		}
+		k.maxKeys = n
+		return nil
+	}
+}
+
+// KeyedClock sets the clock of the evictions, the circuit breakers get their clock from the Clock option
+func KeyedClock(clock utils.Clock) KeyedOption {
+	return func(k *Keyed) error {
+		k.clock = clock
+		return nil
+	}
+}
+
+// KeyedErrorHandler sets the error handler of the requests whose key can not be extracted
+func KeyedErrorHandler(h utils.ErrorHandler) KeyedOption {
+	return func(k *Keyed) error {
+		k.errHandler = h
+		return nil
+	}
+}
+
+// BreakerOptions sets the options of the circuit breakers of a Keyed. The options are applied to each circuit
+// breaker, the options registering into a single registry like Metrics fail for the second key.
+func BreakerOptions(options ...CircuitBreakerOption) KeyedOption {
+	return func(k *Keyed) error {
+		k.options = options
+		return nil
+	}
+}
+
+// KeyedScopeFunc sets a predicate of the requests guarded by the circuit breakers of a Keyed, like ScopeFunc: the
+// other requests are passed to the next handler without creating a circuit breaker for their key
+func KeyedScopeFunc(scope func(req *http.Request) bool) KeyedOption {
+	return func(k *Keyed) error {
+		k.scope = scope
+		return nil
+	}
+}
+
+// Keyed is a http.Handler running a circuit breaker per key extracted from the requests, e.g. a breaker per
+// upstream server with utils.NewExtractor("request.host"), so that a failing backend trips its own breaker only.
+// The circuit breakers are created on the first request of a key, and evicted once idle.
+type Keyed struct {
+	next        http.Handler
+	expression  string
+	extract     utils.SourceExtractor
+	options     []CircuitBreakerOption
+	idleTimeout time.Duration
+	maxKeys     int
+	errHandler  utils.ErrorHandler
+	clock       utils.Clock
+	scope       func(req *http.Request) bool
+
+	mutex     sync.Mutex
+	breakers  map[string]*keyedBreaker
+	nextEvict time.Time
+	// overflow is the circuit breaker shared by the new keys once the max keys is reached
+	overflow *CircuitBreaker
+}
+
+type keyedBreaker struct {
+	cb       *CircuitBreaker
+	lastUsed time.Time
+}
+
+// NewKeyed creates a circuit breaker per key extracted from the requests, each tripping on the expression
+func NewKeyed(next http.Handler, expression string, extract utils.SourceExtractor, options ...KeyedOption) (*Keyed, error) {
+	if extract == nil {
+		return nil, fmt.Errorf("key extractor can not be nil")
+	}
+	// fail early on an invalid expression rather than on the first request
+	if _, err := parseExpression(expression); err != nil {
+		return nil, err
+	}
+
+	k := &Keyed{
+		next:        next,
+		expression:  expression,
+		extract:     extract,
+		idleTimeout: DefaultIdleTimeout,
+		maxKeys:     DefaultMaxKeys,
+		errHandler:  utils.InheritedErrorHandler(utils.DefaultHandler),
+		clock:       utils.InheritedClock(),
+		breakers:    make(map[string]*keyedBreaker),
+	}
+	for _, o := range options {
+		if err := o(k); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *Keyed) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if k.scope != nil && !k.scope(req) {
+		k.next.ServeHTTP(w, req)
+		return
+	}
+	key, _, err := k.extract.Extract(req)
+	if err != nil {
+		k.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	cb, err := k.breaker(key)
+	if err != nil {
+		k.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	cb.ServeHTTP(w, req)
+}
+
+// breaker returns the circuit breaker of the key, created if needed
+func (k *Keyed) breaker(key string) (*CircuitBreaker, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	now := k.clock.UtcNow()
+	if now.After(k.nextEvict) {
+		k.evictIdle(now)
+		k.nextEvict = now.Add(k.idleTimeout)
+	}
+
+	b, ok := k.breakers[key]
+	if !ok {
+		if len(k.breakers) >= k.maxKeys {
+			return k.overflowBreaker()
+		}
+		cb, err := New(k.next, k.expression, k.options...)
+		if err != nil {
+			return nil, err
+		}
+		b = &keyedBreaker{cb: cb}
+		k.breakers[key] = b
+	}
+	b.lastUsed = now
+	return b.cb, nil
+}
+
+// overflowBreaker returns the circuit breaker shared by the new keys, created if needed
+func (k *Keyed) overflowBreaker() (*CircuitBreaker, error) {
+	if k.overflow == nil {
+		cb, err := New(k.next, k.expression, k.options...)
+		if err != nil {
+			return nil, err
+		}
+		k.overflow = cb
+	}
+	return k.overflow, nil
+}
+
+// Breaker returns the circuit breaker of the key, if any
+func (k *Keyed) Breaker(key string) (*CircuitBreaker, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	b, ok := k.breakers[key]
+	if !ok {
+		return nil, false
+	}
+	return b.cb, true
+}
+
+// Breakers returns the stats of the circuit breakers, sorted by key, without the one shared once the max keys is
+// reached
+func (k *Keyed) Breakers() []BreakerStats {
+	k.mutex.Lock()
+	breakers := make(map[string]*CircuitBreaker, len(k.breakers))
+	for key, b := range k.breakers {
+		breakers[key] = b.cb
+	}
+	k.mutex.Unlock()
+
+	stats := make([]BreakerStats, 0, len(breakers))
+	for key, cb := range breakers {
+		s := cb.Stats()
+		s.Key = key
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+	return stats
+}
+
+// EvictIdle evicts the circuit breakers in the standby state that served no request for the idle timeout, it
+// returns the number of evicted breakers. The idle breakers are evicted as the requests are served as well.
+func (k *Keyed) EvictIdle() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.evictIdle(k.clock.UtcNow())
+}
+
+func (k *Keyed) evictIdle(now time.Time) int {
+	evicted := 0
+	for key, b := range k.breakers {
+		if now.Sub(b.lastUsed) < k.idleTimeout {
+			continue
+		}
+		// a tripped breaker keeps its state until it recovers, whether the key gets requests or not
+		b.cb.m.RLock()
+		standby := b.cb.state == stateStandby
+		b.cb.m.RUnlock()
+		if !standby {
+			continue
+		}
+		delete(k.breakers, key)
+		evicted++
+	}
+	return evicted
+}
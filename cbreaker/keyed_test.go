@@ -0,0 +1,172 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func hostExtractor(t *testing.T) utils.SourceExtractor {
+	extract, err := utils.NewExtractor("request.host")
+	require.NoError(t, err)
+	return extract
+}
+
+func TestKeyed(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	k, err := NewKeyed(handler, triggerNetRatio, hostExtractor(t),
+		KeyedClock(clock), IdleTimeout(time.Minute), BreakerOptions(Clock(clock)))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(k)
+	defer srv.Close()
+
+	for _, host := range []string{"a", "b"} {
+		re, _, err := testutils.Get(srv.URL, testutils.Host(host))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	a, ok := k.Breaker("a")
+	require.True(t, ok)
+	a.metrics = statsNetErrors(0.6)
+	clock.Advance(defaultCheckPeriod + time.Millisecond)
+	re, _, err := testutils.Get(srv.URL, testutils.Host("a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the breaker of b is not tripped
+	re, _, err = testutils.Get(srv.URL, testutils.Host("a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	re, _, err = testutils.Get(srv.URL, testutils.Host("b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	stats := k.Breakers()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "a", stats[0].Key)
+	assert.Equal(t, "tripped", stats[0].State)
+	assert.Equal(t, clock.UtcNow(), stats[0].LastTransition)
+	assert.Equal(t, clock.UtcNow().Add(defaultFallbackDuration), stats[0].Until)
+	assert.Equal(t, "b", stats[1].Key)
+	assert.Equal(t, "standby", stats[1].State)
+	assert.True(t, stats[1].LastTransition.IsZero())
+	assert.Equal(t, int64(2), stats[1].Requests)
+
+	// the tripped breaker of a is kept
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, k.EvictIdle())
+	_, ok = k.Breaker("b")
+	assert.False(t, ok)
+	_, ok = k.Breaker("a")
+	assert.True(t, ok)
+}
+
+func TestKeyedEvictsOnServe(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	k, err := NewKeyed(handler, triggerNetRatio, hostExtractor(t),
+		KeyedClock(clock), IdleTimeout(time.Minute))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(k)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL, testutils.Host("a"))
+	require.NoError(t, err)
+
+	clock.Advance(time.Minute + time.Second)
+	_, _, err = testutils.Get(srv.URL, testutils.Host("b"))
+	require.NoError(t, err)
+
+	stats := k.Breakers()
+	require.Len(t, stats, 1)
+	assert.Equal(t, "b", stats[0].Key)
+}
+
+func TestKeyedMaxKeys(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	k, err := NewKeyed(handler, triggerNetRatio, hostExtractor(t),
+		KeyedClock(clock), IdleTimeout(time.Minute), MaxKeys(2))
+	require.NoError(t, err)
+
+	serve := func(host string) {
+		rec := httptest.NewRecorder()
+		k.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	for _, host := range []string{"a", "b", "c", "d"} {
+		serve(host)
+	}
+	// the new keys share a breaker once the max keys is reached
+	_, ok := k.Breaker("c")
+	assert.False(t, ok)
+	c, err := k.breaker("c")
+	require.NoError(t, err)
+	d, err := k.breaker("d")
+	require.NoError(t, err)
+	assert.True(t, c == d)
+	assert.Len(t, k.Breakers(), 2)
+
+	// the new keys get their own breaker once the idle ones are evicted
+	clock.Advance(time.Minute + time.Second)
+	serve("c")
+	_, ok = k.Breaker("c")
+	assert.True(t, ok)
+}
+
+func TestKeyedScopeFunc(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	k, err := NewKeyed(handler, triggerNetRatio, hostExtractor(t),
+		KeyedScopeFunc(func(req *http.Request) bool { return req.Method == http.MethodPost }))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	k.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://a/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, ok := k.Breaker("a")
+	assert.False(t, ok)
+
+	k.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://a/", nil))
+	_, ok = k.Breaker("a")
+	assert.True(t, ok)
+}
+
+func TestNewKeyedInvalid(t *testing.T) {
+	_, err := NewKeyed(nil, triggerNetRatio, nil)
+	require.Error(t, err)
+
+	_, err = NewKeyed(nil, "bad expression", hostExtractor(t))
+	require.Error(t, err)
+
+	_, err = NewKeyed(nil, triggerNetRatio, hostExtractor(t), IdleTimeout(0))
+	require.Error(t, err)
+
+	_, err = NewKeyed(nil, triggerNetRatio, hostExtractor(t), MaxKeys(0))
+	require.Error(t, err)
+}
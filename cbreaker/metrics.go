@@ -0,0 +1,39 @@
+package cbreaker
+
+import (
+	"github.com/vulcand/oxy/metrics"
+)
+
+// breakerMetrics are the metrics of the circuit breaker registered by the Metrics option
+type breakerMetrics struct {
+	transitions *metrics.CounterVec
+	fallbacks   *metrics.Counter
+}
+
+// Metrics registers the metrics of the circuit breaker into the registry:
+//
+//	oxy_cbreaker_state is the state of the circuit breaker: 0 standby, 1 tripped, 2 recovering, 3 degraded
+//	oxy_cbreaker_transitions_total{state} counts the transitions to each state
+//	oxy_cbreaker_fallbacks_total counts the requests served by the fallback
+func Metrics(r *metrics.Registry) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		transitions, err := r.Counter("oxy_cbreaker_transitions_total", "Transitions of the circuit breaker to each state.", "state")
+		if err != nil {
+			return err
+		}
+		fallbacks, err := r.Counter("oxy_cbreaker_fallbacks_total", "Requests served by the fallback of the circuit breaker.")
+		if err != nil {
+			return err
+		}
+		err = r.GaugeFunc("oxy_cbreaker_state", "State of the circuit breaker: 0 standby, 1 tripped, 2 recovering, 3 degraded.", func() float64 {
+			c.m.RLock()
+			defer c.m.RUnlock()
+			return float64(c.state)
+		})
+		if err != nil {
+			return err
+		}
+		c.exported = &breakerMetrics{transitions: transitions, fallbacks: fallbacks.With()}
+		return nil
+	}
+}
@@ -47,12 +47,12 @@ type toFloat64 func(c *CircuitBreaker) float64
 
 func latencyAtQuantile(quantile float64) toInt {
 	return func(c *CircuitBreaker) int {
-		h, err := c.metrics.LatencyHistogram()
+		latencies, err := c.metrics.LatencyAtQuantiles(quantile)
 		if err != nil {
 			c.log.Errorf("Failed to get latency histogram, for %v error: %v", c, err)
 			return 0
 		}
-		return int(h.LatencyAtQuantile(quantile) / time.Millisecond)
+		return int(latencies[0] / time.Millisecond)
 	}
 }
 
@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
 )
 
 // ratioController allows passing portions traffic back to the endpoints,
@@ -16,14 +16,14 @@ import (
 type ratioController struct {
 	duration time.Duration
 	start    time.Time
-	tm       timetools.TimeProvider
+	tm       utils.Clock
 	allowed  int
 	denied   int
 
 	log *log.Logger
 }
 
-func newRatioController(tm timetools.TimeProvider, rampUp time.Duration, log *log.Logger) *ratioController {
+func newRatioController(tm utils.Clock, rampUp time.Duration, log *log.Logger) *ratioController {
 	return &ratioController{
 		duration: rampUp,
 		tm:       tm,
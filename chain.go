@@ -0,0 +1,402 @@
+/*
+Package oxy provides a builder composing the oxy middlewares into a chain.
+
+The links of the chain are created by constructors, from the back to the front, each one around the next link.
+The constructors get the settings shared by the chain, the logger, the clock and the metrics, to pass them to the
+options of their middleware. The combinations of middlewares that do not work together are rejected, e.g. stream
+and buffer.
+
+A link is swapped under traffic: the requests in flight complete with the former handler, then it is closed if it
+implements io.Closer.
+
+Examples of a chain:
+
+	fwd, err := forward.New()
+	lb, err := roundrobin.New(fwd)
+
+	chain, err := oxy.NewChain(lb,
+		oxy.Use("trace", func(next http.Handler, s oxy.Settings) (http.Handler, error) {
+			return trace.New(next, os.Stdout, trace.Logger(s.Logger))
+		}),
+		// the health checks are not rate limited
+		oxy.Use("ratelimit", oxy.Skip(isHealthCheck, func(next http.Handler, s oxy.Settings) (http.Handler, error) {
+			return ratelimit.New(next, extractor, rates, ratelimit.Clock(s.Clock), ratelimit.Logger(s.Logger))
+		})),
+		oxy.Use("cbreaker", func(next http.Handler, s oxy.Settings) (http.Handler, error) {
+			return cbreaker.New(next, "NetworkErrorRatio() > 0.5", cbreaker.Clock(s.Clock), cbreaker.Logger(s.Logger))
+		}),
+		oxy.Use("buffer", func(next http.Handler, s oxy.Settings) (http.Handler, error) {
+			return buffer.New(next, buffer.Logger(s.Logger))
+		}),
+		oxy.Logger(logger),
+	)
+
+	// later, a stricter circuit breaker
+	err = chain.Swap("cbreaker", func(next http.Handler, s oxy.Settings) (http.Handler, error) {
+		return cbreaker.New(next, "NetworkErrorRatio() > 0.2", cbreaker.Clock(s.Clock), cbreaker.Logger(s.Logger))
+	})
+*/
+package oxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/buffer"
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/stream"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Settings are shared by the links of a chain
+type Settings struct {
+	// Logger is the logger of the middlewares, it defaults to logrus.StandardLogger()
+	Logger *log.Logger
+	// Clock is the clock of the middlewares, it defaults to utils.DefaultClock
+	Clock utils.Clock
+	// Metrics are the round trip metrics the middlewares record or read, nil if not configured
+	Metrics *memmetrics.RTMetrics
+}
+
+// Constructor creates the handler of a link calling the next link, with the settings of the chain
+type Constructor func(next http.Handler, s Settings) (http.Handler, error)
+
+// entry is a handler of a link, counting its requests in flight so that it is closed once drained when swapped
+type entry struct {
+	inflight int64
+	retired  int32
+
+	handler http.Handler
+	drained chan struct{}
+	once    sync.Once
+}
+
+func newEntry(h http.Handler) *entry {
+	return &entry{handler: h, drained: make(chan struct{})}
+}
+
+// acquire counts a request in flight, it fails once the entry is retired
+func (e *entry) acquire() bool {
+	atomic.AddInt64(&e.inflight, 1)
+	if atomic.LoadInt32(&e.retired) == 1 {
+		e.release()
+		return false
+	}
+	return true
+}
+
+func (e *entry) release() {
+	if atomic.AddInt64(&e.inflight, -1) == 0 && atomic.LoadInt32(&e.retired) == 1 {
+		e.once.Do(func() { close(e.drained) })
+	}
+}
+
+// retire stops the entry from taking new requests, drained is closed once the requests in flight are completed
+func (e *entry) retire() {
+	atomic.StoreInt32(&e.retired, 1)
+	if atomic.LoadInt64(&e.inflight) == 0 {
+		e.once.Do(func() { close(e.drained) })
+	}
+}
+
+// link is the handler of a link, called by the previous link, it holds the current entry of the link
+type link struct {
+	name        string
+	constructor Constructor
+	current     atomic.Value
+}
+
+func (l *link) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for {
+		e := l.current.Load().(*entry)
+		if e.acquire() {
+			defer e.release()
+			e.handler.ServeHTTP(w, req)
+			return
+		}
+		if l.current.Load() == e {
+			// the chain is closed
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// the link has just been swapped
+	}
+}
+
+func (l *link) handler() http.Handler {
+	return l.current.Load().(*entry).handler
+}
+
+// Chain is a chain of middlewares
+type Chain struct {
+	final    http.Handler
+	links    []*link
+	settings Settings
+
+	// mutex serializes the swaps
+	mutex sync.Mutex
+}
+
+// ChainOption is a functional option setter for Chain
+type ChainOption func(c *Chain) error
+
+// NewChain creates a chain of the links added with Use, in that order, the last link calls the final handler
+func NewChain(final http.Handler, opts ...ChainOption) (*Chain, error) {
+	if final == nil {
+		return nil, errors.New("final handler can not be nil")
+	}
+	c := &Chain{
+		final: final,
+		settings: Settings{
+			Logger: utils.InheritedLogger(),
+			Clock:  utils.InheritedClock(),
+		},
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	handlers := make([]http.Handler, len(c.links))
+	for i := len(c.links) - 1; i >= 0; i-- {
+		h, err := c.links[i].constructor(c.next(i), c.settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the %s link: %v", c.links[i].name, err)
+		}
+		if h == nil {
+			return nil, fmt.Errorf("failed to create the %s link: nil handler", c.links[i].name)
+		}
+		handlers[i] = h
+	}
+	if err := validate(handlers); err != nil {
+		return nil, err
+	}
+	for i, h := range handlers {
+		c.links[i].current.Store(newEntry(h))
+	}
+	return c, nil
+}
+
+// Use appends a link to the chain, the names of the links are unique
+func Use(name string, constructor Constructor) ChainOption {
+	return func(c *Chain) error {
+		if name == "" {
+			return errors.New("link name can not be empty")
+		}
+		if constructor == nil {
+			return fmt.Errorf("link %s: constructor can not be nil", name)
+		}
+		if c.link(name) != nil {
+			return fmt.Errorf("link %s already exists", name)
+		}
+		c.links = append(c.links, &link{name: name, constructor: constructor})
+		return nil
+	}
+}
+
+// Skip wraps a constructor so that the requests matching the predicate bypass the middleware of the link,
+// e.g. the health checks bypass a rate limiter, they are passed straight to the next link
+func Skip(predicate func(req *http.Request) bool, constructor Constructor) Constructor {
+	if predicate == nil || constructor == nil {
+		return constructor
+	}
+	return func(next http.Handler, s Settings) (http.Handler, error) {
+		h, err := constructor(next, s)
+		if err != nil || h == nil {
+			return h, err
+		}
+		return &skipper{predicate: predicate, handler: h, next: next}, nil
+	}
+}
+
+// skipper passes the requests matching the predicate to the next link, the other ones to the middleware
+type skipper struct {
+	predicate func(req *http.Request) bool
+	handler   http.Handler
+	next      http.Handler
+}
+
+func (s *skipper) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.predicate(req) {
+		s.next.ServeHTTP(w, req)
+		return
+	}
+	s.handler.ServeHTTP(w, req)
+}
+
+// Close closes the middleware if it implements io.Closer
+func (s *skipper) Close() error {
+	return closeHandler(s.handler)
+}
+
+// Logger defines the logger shared by the links of the chain.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) ChainOption {
+	return func(c *Chain) error {
+		c.settings.Logger = l
+		return nil
+	}
+}
+
+// Clock sets the clock shared by the links of the chain, it defaults to utils.DefaultClock
+func Clock(clock utils.Clock) ChainOption {
+	return func(c *Chain) error {
+		c.settings.Clock = clock
+		return nil
+	}
+}
+
+// Metrics sets the round trip metrics shared by the links of the chain
+func Metrics(m *memmetrics.RTMetrics) ChainOption {
+	return func(c *Chain) error {
+		c.settings.Metrics = m
+		return nil
+	}
+}
+
+func (c *Chain) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(c.links) == 0 {
+		c.final.ServeHTTP(w, req)
+		return
+	}
+	c.links[0].ServeHTTP(w, req)
+}
+
+// Names returns the names of the links, from the front to the back of the chain
+func (c *Chain) Names() []string {
+	names := make([]string, len(c.links))
+	for i, l := range c.links {
+		names[i] = l.name
+	}
+	return names
+}
+
+// Handler returns the current handler of a link, the middleware itself for the links created with Skip
+func (c *Chain) Handler(name string) (http.Handler, bool) {
+	l := c.link(name)
+	if l == nil {
+		return nil, false
+	}
+	h := l.handler()
+	if s, ok := h.(*skipper); ok {
+		return s.handler, true
+	}
+	return h, true
+}
+
+// Swap replaces the handler of a link by the one created by the constructor. The new requests are handled by the new
+// handler right away, the former one is closed once its requests in flight are completed, if it implements io.Closer.
+func (c *Chain) Swap(name string, constructor Constructor) error {
+	if constructor == nil {
+		return fmt.Errorf("link %s: constructor can not be nil", name)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	index := -1
+	for i, l := range c.links {
+		if l.name == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("link %s not found", name)
+	}
+	h, err := constructor(c.next(index), c.settings)
+	if err != nil {
+		return fmt.Errorf("failed to create the %s link: %v", name, err)
+	}
+	if h == nil {
+		return fmt.Errorf("failed to create the %s link: nil handler", name)
+	}
+	handlers := make([]http.Handler, len(c.links))
+	for i, l := range c.links {
+		handlers[i] = l.handler()
+	}
+	handlers[index] = h
+	if err := validate(handlers); err != nil {
+		return err
+	}
+
+	l := c.links[index]
+	former := l.current.Load().(*entry)
+	l.current.Store(newEntry(h))
+	l.constructor = constructor
+	former.retire()
+	go func() {
+		<-former.drained
+		if err := closeHandler(former.handler); err != nil {
+			c.settings.Logger.Errorf("vulcand/oxy: failed to close the former %s link: %v", name, err)
+		}
+	}()
+	return nil
+}
+
+// Close waits for the requests in flight to complete and closes the handlers of the links implementing io.Closer,
+// from the front to the back of the chain. The chain answers the new requests with 503 afterwards.
+func (c *Chain) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var firstErr error
+	for _, l := range c.links {
+		e := l.current.Load().(*entry)
+		e.retire()
+		<-e.drained
+		if err := closeHandler(e.handler); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close the %s link: %v", l.name, err)
+		}
+	}
+	return firstErr
+}
+
+func (c *Chain) link(name string) *link {
+	for _, l := range c.links {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// next returns the handler called by the link at index
+func (c *Chain) next(index int) http.Handler {
+	if index == len(c.links)-1 {
+		return c.final
+	}
+	return c.links[index+1]
+}
+
+func closeHandler(h http.Handler) error {
+	if closer, ok := h.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// validate rejects the combinations of middlewares that do not work together
+func validate(handlers []http.Handler) error {
+	var streams, buffers int
+	for _, h := range handlers {
+		if s, ok := h.(*skipper); ok {
+			h = s.handler
+		}
+		switch h.(type) {
+		case *stream.Stream:
+			streams++
+		case *buffer.Buffer:
+			buffers++
+		}
+	}
+	if streams > 0 && buffers > 0 {
+		return errors.New("stream and buffer can not be combined in a chain, the buffering defeats the streaming")
+	}
+	return nil
+}
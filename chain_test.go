@@ -0,0 +1,259 @@
+package oxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/buffer"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/stream"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+// tag is a link appending its tag to the X-Chain header
+type tag struct {
+	next   http.Handler
+	tag    string
+	closed int32
+}
+
+func (t *tag) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.Header.Add("X-Chain", t.tag)
+	t.next.ServeHTTP(w, req)
+}
+
+func (t *tag) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	return nil
+}
+
+func tagged(name string, links map[string]*tag) Constructor {
+	return func(next http.Handler, s Settings) (http.Handler, error) {
+		t := &tag{next: next, tag: name}
+		if links != nil {
+			links[name] = t
+		}
+		return t, nil
+	}
+}
+
+func final(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(req.Header.Get("X-Chain") + "|" + req.Header["X-Chain"][len(req.Header["X-Chain"])-1]))
+}
+
+func serve(h http.Handler) string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Body.String()
+}
+
+func TestChain(t *testing.T) {
+	c, err := NewChain(http.HandlerFunc(final),
+		Use("a", tagged("a", nil)),
+		Use("b", tagged("b", nil)),
+		Use("c", tagged("c", nil)))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a", "b", "c"}, c.Names())
+	assert.Equal(t, "a|c", serve(c), "the links are called in order")
+
+	h, ok := c.Handler("b")
+	require.True(t, ok)
+	assert.Equal(t, "b", h.(*tag).tag)
+	_, ok = c.Handler("d")
+	assert.False(t, ok)
+}
+
+func TestChainSettings(t *testing.T) {
+	clock := testutils.GetClock()
+	var got Settings
+	_, err := NewChain(http.HandlerFunc(final), Clock(clock),
+		Use("a", func(next http.Handler, s Settings) (http.Handler, error) {
+			got = s
+			return next, nil
+		}))
+	require.NoError(t, err)
+	assert.Equal(t, clock, got.Clock)
+	assert.NotNil(t, got.Logger)
+}
+
+func TestChainIncompatible(t *testing.T) {
+	_, err := NewChain(http.HandlerFunc(final),
+		Use("stream", func(next http.Handler, s Settings) (http.Handler, error) {
+			return stream.New(next)
+		}),
+		Use("buffer", func(next http.Handler, s Settings) (http.Handler, error) {
+			return buffer.New(next)
+		}))
+	assert.Error(t, err)
+
+	c, err := NewChain(http.HandlerFunc(final),
+		Use("stream", func(next http.Handler, s Settings) (http.Handler, error) {
+			return stream.New(next)
+		}),
+		Use("b", tagged("b", nil)))
+	require.NoError(t, err)
+	err = c.Swap("b", func(next http.Handler, s Settings) (http.Handler, error) {
+		return buffer.New(next)
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "b|b", serve(c), "the link is not swapped")
+}
+
+func TestChainSwap(t *testing.T) {
+	links := map[string]*tag{}
+	c, err := NewChain(http.HandlerFunc(final), Use("a", tagged("a", links)), Use("b", tagged("b", links)))
+	require.NoError(t, err)
+
+	require.NoError(t, c.Swap("a", tagged("a2", links)))
+	assert.Equal(t, "a2|b", serve(c))
+	waitFor(t, func() bool { return atomic.LoadInt32(&links["a"].closed) == 1 })
+
+	require.NoError(t, c.Swap("b", tagged("b2", links)))
+	assert.Equal(t, "a2|b2", serve(c), "the previous link calls the new one")
+
+	assert.Error(t, c.Swap("d", tagged("d", nil)))
+	assert.Error(t, c.Swap("a", nil))
+}
+
+func TestChainSwapInFlight(t *testing.T) {
+	links := map[string]*tag{}
+	started, unblock := make(chan struct{}), make(chan struct{})
+	c, err := NewChain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Chain") == "a" {
+			close(started)
+			<-unblock
+		}
+		final(w, req)
+	}), Use("a", tagged("a", links)))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var body string
+	go func() {
+		defer wg.Done()
+		body = serve(c)
+	}()
+	<-started
+
+	require.NoError(t, c.Swap("a", tagged("a2", links)))
+	assert.Equal(t, "a2|a2", serve(c))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&links["a"].closed), "the former link is still serving")
+
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, "a|a", body)
+	waitFor(t, func() bool { return atomic.LoadInt32(&links["a"].closed) == 1 })
+}
+
+func TestChainClose(t *testing.T) {
+	links := map[string]*tag{}
+	c, err := NewChain(http.HandlerFunc(final), Use("a", tagged("a", links)))
+	require.NoError(t, err)
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&links["a"].closed))
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestChainSkip(t *testing.T) {
+	links := map[string]*tag{}
+	internal := func(req *http.Request) bool { return req.URL.Path == "/internal" }
+	all := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(strings.Join(req.Header["X-Chain"], ",")))
+	})
+	c, err := NewChain(all,
+		Use("a", tagged("a", links)),
+		Use("b", Skip(internal, tagged("b", links))),
+		Use("c", tagged("c", links)))
+	require.NoError(t, err)
+
+	assert.Equal(t, "a,b,c", serve(c))
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/internal", nil))
+	assert.Equal(t, "a,c", rec.Body.String())
+
+	h, ok := c.Handler("b")
+	require.True(t, ok)
+	assert.Equal(t, links["b"], h, "the middleware is returned")
+
+	require.NoError(t, c.Swap("b", tagged("b2", links)))
+	waitFor(t, func() bool { return atomic.LoadInt32(&links["b"].closed) == 1 })
+
+	_, err = NewChain(http.HandlerFunc(final),
+		Use("stream", func(next http.Handler, s Settings) (http.Handler, error) {
+			return stream.New(next)
+		}),
+		Use("buffer", Skip(internal, func(next http.Handler, s Settings) (http.Handler, error) {
+			return buffer.New(next)
+		})))
+	assert.Error(t, err, "the skipped middlewares are validated")
+}
+
+func TestChainInvalid(t *testing.T) {
+	for _, opts := range [][]ChainOption{
+		{Use("", tagged("a", nil))},
+		{Use("a", nil)},
+		{Use("a", tagged("a", nil)), Use("a", tagged("a", nil))},
+		{Use("a", func(next http.Handler, s Settings) (http.Handler, error) { return nil, nil })},
+		{Use("a", func(next http.Handler, s Settings) (http.Handler, error) { return nil, utils.ErrNoCredentials })},
+	} {
+		_, err := NewChain(http.HandlerFunc(final), opts...)
+		assert.Error(t, err)
+	}
+	_, err := NewChain(nil)
+	assert.Error(t, err)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkForwardRoundRobinRateLimit measures the proxy stack alone, the upstream replies without a round trip
+func BenchmarkForwardRoundRobinRateLimit(b *testing.B) {
+	fwd, err := forward.New(forward.RoundTripper(testutils.StaticTransport{}))
+	require.NoError(b, err)
+	lb, err := roundrobin.New(fwd)
+	require.NoError(b, err)
+	require.NoError(b, lb.UpsertServer(testutils.ParseURI("http://localhost:8080")))
+	require.NoError(b, lb.UpsertServer(testutils.ParseURI("http://localhost:8081")))
+
+	rates := ratelimit.NewRateSet()
+	require.NoError(b, rates.Add(time.Second, 1000000, 1<<30))
+	extractor, err := utils.NewExtractor("client.ip")
+	require.NoError(b, err)
+	tl, err := ratelimit.New(lb, extractor, rates)
+	require.NoError(b, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api?q=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := testutils.NewDiscardWriter()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		tl.ServeHTTP(w, req)
+	}
+}
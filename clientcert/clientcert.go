@@ -0,0 +1,266 @@
+/*
+Package clientcert provides a middleware enforcing a policy on the TLS client certificates.
+
+The certificate presented by the client must chain to one of the allowed CAs, or have been verified by the TLS server
+when no CA is configured. Its subject and subject alternative names can be restricted to allowlists, and its
+revocation is checked against CRLs and OCSP responders. Requests failing the policy are rejected with a 403 response.
+
+Examples of a client certificate policy:
+
+	// clients of the internal CA, from the payments team
+	cc, err := clientcert.New(handler, clientcert.CAs(pool), clientcert.OrganizationalUnits("payments"))
+
+	// SPIFFE workloads of a namespace, with OCSP revocation checks
+	cc, err := clientcert.New(handler, clientcert.SANs("spiffe://cluster.local/ns/billing/*"), clientcert.OCSP())
+*/
+package clientcert
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// ClientCert is a middleware rejecting the requests whose client certificate does not match the policy
+type ClientCert struct {
+	next        http.Handler
+	roots       *x509.CertPool
+	commonNames map[string]bool
+	ous         map[string]bool
+	sans        []string
+	crls        []*crl
+	ocsp        *ocspChecker
+	clock       utils.Clock
+
+	rejectHandler http.Handler
+	log           *log.Logger
+}
+
+// Option is a functional option setter for ClientCert
+type Option func(cc *ClientCert) error
+
+// New creates a new ClientCert middleware
+func New(next http.Handler, opts ...Option) (*ClientCert, error) {
+	cc := &ClientCert{
+		next:          next,
+		clock:         utils.InheritedClock(),
+		rejectHandler: http.HandlerFunc(forbidden),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(cc); err != nil {
+			return nil, err
+		}
+	}
+	if cc.ocsp != nil {
+		if err := cc.ocsp.init(cc.clock); err != nil {
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+// CAs sets the certificate authorities the client certificates must chain to.
+// By default, the chains verified by the TLS server are used.
+func CAs(pool *x509.CertPool) Option {
+	return func(cc *ClientCert) error {
+		if pool == nil {
+			return errors.New("CA pool can not be nil")
+		}
+		cc.roots = pool
+		return nil
+	}
+}
+
+// CommonNames restricts the subject common names of the client certificates
+func CommonNames(names ...string) Option {
+	return func(cc *ClientCert) error {
+		cc.commonNames = addAll(cc.commonNames, names)
+		return nil
+	}
+}
+
+// OrganizationalUnits requires the subject of the client certificates to have one of the organizational units
+func OrganizationalUnits(ous ...string) Option {
+	return func(cc *ClientCert) error {
+		cc.ous = addAll(cc.ous, ous)
+		return nil
+	}
+}
+
+// SANs requires one of the subject alternative names of the client certificates, DNS names, email addresses,
+// IP addresses or URIs, to match one of the patterns. The patterns use the path.Match syntax,
+// e.g. "*.billing.svc" or "spiffe://cluster.local/ns/billing/*".
+func SANs(patterns ...string) Option {
+	return func(cc *ClientCert) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid SAN pattern %q: %v", p, err)
+			}
+		}
+		cc.sans = append(cc.sans, patterns...)
+		return nil
+	}
+}
+
+// RejectHandler sets the handler serving the rejected requests, it defaults to a 403 Forbidden response
+func RejectHandler(h http.Handler) Option {
+	return func(cc *ClientCert) error {
+		if h == nil {
+			return errors.New("reject handler can not be nil")
+		}
+		cc.rejectHandler = h
+		return nil
+	}
+}
+
+// Clock sets the clock checking the validity of the certificates and of the revocation data,
+// it defaults to utils.DefaultClock
+func Clock(clock utils.Clock) Option {
+	return func(cc *ClientCert) error {
+		cc.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the client certificate middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(cc *ClientCert) error {
+		cc.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by client certificate handler.
+func (cc *ClientCert) Wrap(next http.Handler) error {
+	cc.next = next
+	return nil
+}
+
+func (cc *ClientCert) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if cc.log.Level >= log.DebugLevel {
+		logEntry := cc.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/clientcert: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/clientcert: completed ServeHttp on request")
+	}
+
+	if err := cc.check(req); err != nil {
+		if utils.Sampled(cc.log, log.DebugLevel, "vulcand/oxy/clientcert: rejecting %v, err: %v") {
+			cc.log.Debugf("vulcand/oxy/clientcert: rejecting %v, err: %v", req.RemoteAddr, err)
+		}
+		cc.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+	cc.next.ServeHTTP(w, req)
+}
+
+// check returns the reason the client certificate of the request does not match the policy
+func (cc *ClientCert) check(req *http.Request) error {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+	leaf := req.TLS.PeerCertificates[0]
+
+	chain, err := cc.verify(req)
+	if err != nil {
+		return err
+	}
+	if cc.commonNames != nil && !cc.commonNames[leaf.Subject.CommonName] {
+		return fmt.Errorf("common name %q is not allowed", leaf.Subject.CommonName)
+	}
+	if cc.ous != nil && !anyOf(cc.ous, leaf.Subject.OrganizationalUnit) {
+		return fmt.Errorf("organizational units %v are not allowed", leaf.Subject.OrganizationalUnit)
+	}
+	if cc.sans != nil && !cc.matchSAN(leaf) {
+		return errors.New("no subject alternative name is allowed")
+	}
+
+	issuer := leaf
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+	for _, c := range cc.crls {
+		if err := c.check(leaf, issuer); err != nil {
+			return err
+		}
+	}
+	if cc.ocsp != nil {
+		return cc.ocsp.check(req.Context(), leaf, issuer)
+	}
+	return nil
+}
+
+// verify returns the chain of the client certificate, verified against the CAs if any,
+// or as verified by the TLS server
+func (cc *ClientCert) verify(req *http.Request) ([]*x509.Certificate, error) {
+	if cc.roots == nil {
+		if len(req.TLS.VerifiedChains) == 0 {
+			return nil, errors.New("client certificate is not verified by the TLS server")
+		}
+		return req.TLS.VerifiedChains[0], nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, err := req.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         cc.roots,
+		Intermediates: intermediates,
+		CurrentTime:   cc.clock.UtcNow(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+func (cc *ClientCert) matchSAN(cert *x509.Certificate) bool {
+	names := append([]string(nil), cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	names = append(names, uriSANs(cert)...)
+
+	for _, pattern := range cc.sans {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addAll(set map[string]bool, values []string) map[string]bool {
+	if set == nil {
+		set = make(map[string]bool, len(values))
+	}
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func anyOf(set map[string]bool, values []string) bool {
+	for _, v := range values {
+		if set[v] {
+			return true
+		}
+	}
+	return false
+}
+
+func forbidden(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
@@ -0,0 +1,218 @@
+package clientcert
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+	"golang.org/x/crypto/ocsp"
+)
+
+func newRequest(certs ...tls.Certificate) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req.TLS = &tls.ConnectionState{}
+	for _, c := range certs {
+		for _, der := range c.Certificate {
+			parsed, _ := x509.ParseCertificate(der)
+			req.TLS.PeerCertificates = append(req.TLS.PeerCertificates, parsed)
+		}
+	}
+	return req
+}
+
+func serve(t *testing.T, cc *ClientCert, req *http.Request) int {
+	rec := httptest.NewRecorder()
+	cc.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestClientCertPolicy(t *testing.T) {
+	ca, err := testutils.NewCA()
+	require.NoError(t, err)
+	otherCA, err := testutils.NewCA()
+	require.NoError(t, err)
+
+	payments, err := ca.Issue(testutils.CommonName("api"), testutils.OrganizationalUnit("payments"), testutils.SAN("api.payments.svc"))
+	require.NoError(t, err)
+	billing, err := ca.Issue(testutils.CommonName("api"), testutils.OrganizationalUnit("billing"), testutils.SAN("api.billing.svc"))
+	require.NoError(t, err)
+	serverOnly, err := ca.Issue(testutils.ExtKeyUsage(x509.ExtKeyUsageServerAuth))
+	require.NoError(t, err)
+	expired, err := ca.Issue(testutils.Validity(time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour)))
+	require.NoError(t, err)
+	other, err := otherCA.Issue()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		opts         []Option
+		req          *http.Request
+		expectedCode int
+	}{
+		{desc: "trusted CA", opts: []Option{CAs(ca.CertPool())}, req: newRequest(payments), expectedCode: http.StatusOK},
+		{desc: "other CA", opts: []Option{CAs(ca.CertPool())}, req: newRequest(other), expectedCode: http.StatusForbidden},
+		{desc: "no certificate", opts: []Option{CAs(ca.CertPool())}, req: newRequest(), expectedCode: http.StatusForbidden},
+		{desc: "plain HTTP", opts: []Option{CAs(ca.CertPool())}, req: httptest.NewRequest(http.MethodGet, "/", nil), expectedCode: http.StatusForbidden},
+		{desc: "not for client auth", opts: []Option{CAs(ca.CertPool())}, req: newRequest(serverOnly), expectedCode: http.StatusForbidden},
+		{desc: "expired", opts: []Option{CAs(ca.CertPool())}, req: newRequest(expired), expectedCode: http.StatusForbidden},
+		{desc: "not verified by the server", req: newRequest(payments), expectedCode: http.StatusForbidden},
+		{desc: "allowed OU", opts: []Option{CAs(ca.CertPool()), OrganizationalUnits("payments")}, req: newRequest(payments), expectedCode: http.StatusOK},
+		{desc: "other OU", opts: []Option{CAs(ca.CertPool()), OrganizationalUnits("payments")}, req: newRequest(billing), expectedCode: http.StatusForbidden},
+		{desc: "allowed CN", opts: []Option{CAs(ca.CertPool()), CommonNames("api", "web")}, req: newRequest(billing), expectedCode: http.StatusOK},
+		{desc: "other CN", opts: []Option{CAs(ca.CertPool()), CommonNames("web")}, req: newRequest(billing), expectedCode: http.StatusForbidden},
+		{desc: "allowed SAN", opts: []Option{CAs(ca.CertPool()), SANs("*.billing.svc")}, req: newRequest(billing), expectedCode: http.StatusOK},
+		{desc: "other SAN", opts: []Option{CAs(ca.CertPool()), SANs("*.billing.svc")}, req: newRequest(payments), expectedCode: http.StatusForbidden},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			cc, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), test.opts...)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, serve(t, cc, test.req))
+		})
+	}
+}
+
+func TestClientCertVerifiedByServer(t *testing.T) {
+	ca, err := testutils.NewCA()
+	require.NoError(t, err)
+	cert, err := ca.Issue(testutils.OrganizationalUnit("payments"))
+	require.NoError(t, err)
+
+	cc, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}), OrganizationalUnits("payments"))
+	require.NoError(t, err)
+	srv, err := ca.NewTLSServer(cc, tls.VerifyClientCertIfGiven)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.ClientTLSConfig(cert)}}
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", string(body))
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: ca.ClientTLSConfig()}}
+	resp, err = client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestClientCertCRL(t *testing.T) {
+	ca, err := testutils.NewCA()
+	require.NoError(t, err)
+	otherCA, err := testutils.NewCA()
+	require.NoError(t, err)
+	revoked, err := ca.Issue()
+	require.NoError(t, err)
+	valid, err := ca.Issue()
+	require.NoError(t, err)
+
+	list := []pkix.RevokedCertificate{{SerialNumber: revoked.Leaf.SerialNumber, RevocationTime: time.Now()}}
+	crl, err := ca.Certificate.CreateCRL(rand.Reader, ca.Key, list, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	// the same serial, revoked by another CA
+	otherCRL, err := otherCA.Certificate.CreateCRL(rand.Reader, otherCA.Key, []pkix.RevokedCertificate{{SerialNumber: valid.Leaf.SerialNumber, RevocationTime: time.Now()}}, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	cc, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), CAs(ca.CertPool()), CRL(crl), CRL(otherCRL))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, serve(t, cc, newRequest(revoked)))
+	assert.Equal(t, http.StatusOK, serve(t, cc, newRequest(valid)))
+
+	_, err = New(http.NotFoundHandler(), CRL([]byte("not a CRL")))
+	assert.Error(t, err)
+}
+
+func TestClientCertOCSP(t *testing.T) {
+	ca, err := testutils.NewCA()
+	require.NoError(t, err)
+	revoked, err := ca.Issue()
+	require.NoError(t, err)
+	valid, err := ca.Issue()
+	require.NoError(t, err)
+
+	clock := utils.NewFakeClock(time.Now())
+	var queries, failing int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		ocspReq, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: ocspReq.SerialNumber,
+			ThisUpdate:   clock.UtcNow(),
+			NextUpdate:   clock.UtcNow().Add(time.Hour),
+		}
+		if ocspReq.SerialNumber.Cmp(revoked.Leaf.SerialNumber) == 0 {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = clock.UtcNow()
+		}
+		resp, err := ocsp.CreateResponse(ca.Certificate, ca.Certificate, template, ca.Key)
+		require.NoError(t, err)
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	cc, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		CAs(ca.CertPool()), OCSPResponder(responder.URL), Clock(clock))
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusForbidden, serve(t, cc, newRequest(revoked)))
+	assert.Equal(t, http.StatusOK, serve(t, cc, newRequest(valid)))
+	assert.Equal(t, http.StatusOK, serve(t, cc, newRequest(valid)))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&queries), "the responses are cached")
+
+	// the responder fails once the responses expired, soft fail accepts the certificates
+	atomic.StoreInt32(&failing, 1)
+	clock.Advance(2 * time.Hour)
+	assert.Equal(t, http.StatusOK, serve(t, cc, newRequest(valid)))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&queries))
+
+	hardFail, err := New(http.NotFoundHandler(), CAs(ca.CertPool()), OCSPResponder(responder.URL), OCSPHardFail(true), Clock(clock))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, serve(t, hardFail, newRequest(valid)))
+}
+
+func TestClientCertRejectHandler(t *testing.T) {
+	cc, err := New(http.NotFoundHandler(), RejectHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("client certificate required"))
+	})))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	cc.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "client certificate required", rec.Body.String())
+}
+
+func TestClientCertInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{CAs(nil), SANs("[a-"), RejectHandler(nil), OCSPClient(nil)} {
+		_, err := New(http.NotFoundHandler(), opt)
+		assert.Error(t, err)
+	}
+}
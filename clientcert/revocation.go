@@ -0,0 +1,267 @@
+package clientcert
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/ttlmap"
+	"github.com/vulcand/oxy/utils"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Defaults of the OCSP checks
+const (
+	DefaultOCSPTimeout   = 5 * time.Second
+	DefaultOCSPCacheSize = 10000
+	// DefaultOCSPCacheTTL is the time the responses without next update are cached
+	DefaultOCSPCacheTTL = time.Hour
+	maxOCSPBytes        = 1 << 20
+)
+
+// crl is a certificate revocation list of an issuer
+type crl struct {
+	list    *pkix.CertificateList
+	revoked map[string]bool
+
+	mutex sync.Mutex
+	// signedBy remembers the issuers the signature of the list was checked with
+	signedBy map[string]bool
+}
+
+func parseCRLs(data []byte) ([]*crl, error) {
+	var ders [][]byte
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	var crls []*crl
+	for _, der := range ders {
+		list, err := x509.ParseDERCRL(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CRL: %v", err)
+		}
+		c := &crl{list: list, revoked: make(map[string]bool), signedBy: make(map[string]bool)}
+		for _, r := range list.TBSCertList.RevokedCertificates {
+			c.revoked[r.SerialNumber.String()] = true
+		}
+		crls = append(crls, c)
+	}
+	return crls, nil
+}
+
+// check returns an error if the CRL is signed by the issuer of the certificate, and revokes it
+func (c *crl) check(cert, issuer *x509.Certificate) error {
+	if !c.isSignedBy(issuer) {
+		return nil
+	}
+	if c.revoked[cert.SerialNumber.String()] {
+		return fmt.Errorf("certificate %s is revoked", cert.SerialNumber)
+	}
+	return nil
+}
+
+// isSignedBy checks, once per issuer, whether the CRL is signed by the issuer
+func (c *crl) isSignedBy(issuer *x509.Certificate) bool {
+	key := string(issuer.Raw)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	signed, checked := c.signedBy[key]
+	if !checked {
+		signed = issuer.CheckCRLSignature(c.list) == nil
+		c.signedBy[key] = signed
+	}
+	return signed
+}
+
+// CRL adds certificate revocation lists, PEM or DER encoded. The lists apply to the certificates issued by their signer.
+func CRL(data []byte) Option {
+	return func(cc *ClientCert) error {
+		crls, err := parseCRLs(data)
+		if err != nil {
+			return err
+		}
+		cc.crls = append(cc.crls, crls...)
+		return nil
+	}
+}
+
+// CRLFile adds the certificate revocation lists of the file, see CRL. The file is read once.
+func CRLFile(path string) Option {
+	return func(cc *ClientCert) error {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return CRL(data)(cc)
+	}
+}
+
+// ocspChecker checks the revocation of the certificates with the OCSP responders of their issuer
+type ocspChecker struct {
+	client    *http.Client
+	responder string
+	hardFail  bool
+	clock     utils.Clock
+
+	mutex sync.Mutex
+	cache *ttlmap.TtlMap
+}
+
+func (cc *ClientCert) ocspChecker() *ocspChecker {
+	if cc.ocsp == nil {
+		cc.ocsp = &ocspChecker{client: &http.Client{Timeout: DefaultOCSPTimeout}}
+	}
+	return cc.ocsp
+}
+
+// OCSP checks the revocation of the client certificates with the OCSP responders listed in the certificates.
+// The responses are cached until their next update. The certificates are accepted when the responders are
+// unavailable, see OCSPHardFail.
+func OCSP() Option {
+	return func(cc *ClientCert) error {
+		cc.ocspChecker()
+		return nil
+	}
+}
+
+// OCSPResponder checks the revocation of the client certificates with the OCSP responder, instead of the responders
+// listed in the certificates
+func OCSPResponder(url string) Option {
+	return func(cc *ClientCert) error {
+		cc.ocspChecker().responder = url
+		return nil
+	}
+}
+
+// OCSPHardFail rejects the client certificates whose revocation status can not be determined
+func OCSPHardFail(hardFail bool) Option {
+	return func(cc *ClientCert) error {
+		cc.ocspChecker().hardFail = hardFail
+		return nil
+	}
+}
+
+// OCSPClient sets the HTTP client querying the OCSP responders
+func OCSPClient(c *http.Client) Option {
+	return func(cc *ClientCert) error {
+		if c == nil {
+			return errors.New("client can not be nil")
+		}
+		cc.ocspChecker().client = c
+		return nil
+	}
+}
+
+func (o *ocspChecker) check(ctx context.Context, cert, issuer *x509.Certificate) error {
+	key := fingerprint(issuer) + "/" + cert.SerialNumber.String()
+
+	o.mutex.Lock()
+	status, cached := o.cache.Get(key)
+	o.mutex.Unlock()
+	if !cached {
+		resp, err := o.query(ctx, cert, issuer)
+		if err != nil {
+			if o.hardFail {
+				return fmt.Errorf("OCSP check failed: %v", err)
+			}
+			return nil
+		}
+		status = resp.Status
+		ttl := DefaultOCSPCacheTTL
+		if !resp.NextUpdate.IsZero() {
+			ttl = resp.NextUpdate.Sub(o.clock.UtcNow())
+		}
+		if seconds := int(ttl / time.Second); seconds > 0 {
+			o.mutex.Lock()
+			o.cache.Set(key, resp.Status, seconds)
+			o.mutex.Unlock()
+		}
+	}
+
+	switch status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("certificate %s is revoked", cert.SerialNumber)
+	}
+	if o.hardFail {
+		return fmt.Errorf("certificate %s has an unknown OCSP status", cert.SerialNumber)
+	}
+	return nil
+}
+
+func (o *ocspChecker) init(clock utils.Clock) error {
+	cache, err := ttlmap.NewMapWithProvider(DefaultOCSPCacheSize, clock)
+	if err != nil {
+		return err
+	}
+	o.clock, o.cache = clock, cache
+	return nil
+}
+
+func (o *ocspChecker) query(ctx context.Context, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	responder := o.responder
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, errors.New("certificate has no OCSP responder")
+		}
+		responder = cert.OCSPServer[0]
+	}
+	body, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, responder, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder replied %d", resp.StatusCode)
+	}
+	der, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPBytes))
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !parsed.NextUpdate.IsZero() && parsed.NextUpdate.Before(o.clock.UtcNow()) {
+		return nil, errors.New("OCSP response is outdated")
+	}
+	return parsed, nil
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,15 @@
+//go:build go1.10
+// +build go1.10
+
+package clientcert
+
+import "crypto/x509"
+
+// uriSANs returns the URI subject alternative names of the certificate, e.g. SPIFFE IDs
+func uriSANs(cert *x509.Certificate) []string {
+	uris := make([]string, 0, len(cert.URIs))
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	return uris
+}
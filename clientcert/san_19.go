@@ -0,0 +1,11 @@
+//go:build !go1.10
+// +build !go1.10
+
+package clientcert
+
+import "crypto/x509"
+
+// uriSANs returns nothing, the URI subject alternative names are parsed since go1.10
+func uriSANs(cert *x509.Certificate) []string {
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build go1.22
+// +build go1.22
+
+package brotli
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	br "github.com/andybalholm/brotli"
+	"github.com/vulcand/oxy/compress"
+)
+
+// Qualities of the compression, from the fastest to the smallest output
+const (
+	BestSpeed       = br.BestSpeed
+	BestCompression = br.BestCompression
+	// DefaultQuality is a good tradeoff for dynamic content, the highest qualities are too slow to compress on the fly
+	DefaultQuality = 4
+)
+
+// NewEncoder creates a brotli compress.Encoder with the quality, from BestSpeed to BestCompression.
+// The compressors are pooled as allocating them is expensive.
+func NewEncoder(quality int) (compress.Encoder, error) {
+	if quality < BestSpeed || quality > BestCompression {
+		return nil, fmt.Errorf("brotli quality should be between %d and %d, got %d", BestSpeed, BestCompression, quality)
+	}
+	return &encoder{
+		pool: &sync.Pool{New: func() interface{} {
+			return br.NewWriterLevel(nil, quality)
+		}},
+	}, nil
+}
+
+type encoder struct {
+	pool *sync.Pool
+}
+
+func (e *encoder) Encoding() string {
+	return "br"
+}
+
+func (e *encoder) NewWriter(w io.Writer) (compress.Compressor, error) {
+	bw := e.pool.Get().(*br.Writer)
+	bw.Reset(w)
+	return &pooledWriter{Writer: bw, pool: e.pool}, nil
+}
+
+type pooledWriter struct {
+	*br.Writer
+	pool *sync.Pool
+}
+
+func (w *pooledWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
@@ -0,0 +1,123 @@
+//go:build go1.22
+// +build go1.22
+
+package brotli
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	br "github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/compress"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+var bigBody = strings.Repeat("hello oxy ", 200)
+
+func TestEncoder(t *testing.T) {
+	enc, err := NewEncoder(DefaultQuality)
+	require.NoError(t, err)
+	gz, err := compress.NewGzipEncoder(gzip.BestSpeed)
+	require.NoError(t, err)
+
+	c, err := compress.New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(bigBody))
+	}), compress.Encoders(enc, gz))
+	require.NoError(t, err)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	// the pooled compressors are reused by the following requests
+	for i := 0; i < 3; i++ {
+		re, body := get(t, srv.URL, "gzip, br")
+		assert.Equal(t, "br", re.Header.Get("Content-Encoding"))
+		out, err := ioutil.ReadAll(br.NewReader(bytes.NewReader(body)))
+		require.NoError(t, err)
+		assert.Equal(t, bigBody, string(out))
+	}
+
+	re, _ := get(t, srv.URL, "gzip")
+	assert.Equal(t, "gzip", re.Header.Get("Content-Encoding"))
+}
+
+func TestEncoderStreaming(t *testing.T) {
+	enc, err := NewEncoder(BestSpeed)
+	require.NoError(t, err)
+
+	next := make(chan struct{})
+	c, err := compress.New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: second\n"))
+	}), compress.Encoders(enc))
+	require.NoError(t, err)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "br")
+	re, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	require.NoError(t, err)
+	defer re.Body.Close()
+
+	reader := bufio.NewReader(br.NewReader(re.Body))
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line, "the flushed data is decoded before the response completes")
+	close(next)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: second\n", line)
+}
+
+func TestEncoderInvalidQuality(t *testing.T) {
+	_, err := NewEncoder(BestCompression + 1)
+	assert.Error(t, err)
+}
+
+func get(t *testing.T, url, acceptEncoding string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	// the transport must not decompress the response by itself
+	re, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	require.NoError(t, err)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	return re, body
+}
+
+func TestDecoder(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		bw := br.NewWriter(w)
+		bw.Write([]byte(bigBody))
+		bw.Close()
+	}))
+	defer upstream.Close()
+
+	fwd, err := forward.New(forward.Decompress(forward.GzipDecoder(), NewDecoder()))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(upstream.URL)
+		fwd.ServeHTTP(w, req)
+	}))
+	defer proxy.Close()
+
+	re, body := get(t, proxy.URL, "gzip")
+	assert.Empty(t, re.Header.Get("Content-Encoding"))
+	assert.Equal(t, bigBody, string(body))
+}
@@ -0,0 +1,19 @@
+//go:build go1.22
+// +build go1.22
+
+package brotli
+
+import (
+	"io"
+	"io/ioutil"
+
+	br "github.com/andybalholm/brotli"
+	"github.com/vulcand/oxy/forward"
+)
+
+// NewDecoder creates a brotli forward.Decoder, for the forward.Decompress option
+func NewDecoder() forward.Decoder {
+	return forward.DecoderFunc("br", func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(br.NewReader(r)), nil
+	})
+}
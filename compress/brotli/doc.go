@@ -0,0 +1,18 @@
+/*
+Package brotli provides a brotli ("br") encoder for the compress middleware, and a decoder for the Decompress option
+of the forwarder, based on github.com/andybalholm/brotli.
+
+The encoder and the decoder require go1.22, the package is empty when built with older versions.
+
+Examples of a brotli encoder:
+
+	// brotli preferred, gzip for the other clients
+	br, err := brotli.NewEncoder(brotli.DefaultQuality)
+	gz, err := compress.NewGzipEncoder(gzip.DefaultCompression)
+	c, err := compress.New(handler, compress.Encoders(br, gz))
+
+Examples of a forwarder decoding the brotli responses along with gzip and deflate:
+
+	fwd, err := forward.New(forward.Decompress(forward.GzipDecoder(), forward.DeflateDecoder(), brotli.NewDecoder()))
+*/
+package brotli
@@ -0,0 +1,374 @@
+/*
+Package compress provides a middleware compressing responses according to the Accept-Encoding header of the request.
+
+Responses are compressed when they are big enough and have a compressible content type,
+responses already encoded by the upstream are passed through untouched. Flushes of streaming
+responses are propagated through the compressor.
+
+Examples of a compression middleware:
+
+	// gzip only, responses of at least 1KB
+	c, err := compress.New(handler)
+
+	// brotli preferred when the client accepts it, see the compress/brotli and compress/zstd packages
+	br, err := brotli.NewEncoder(brotli.DefaultQuality)
+	gz, err := compress.NewGzipEncoder(gzip.DefaultCompression)
+	c, err := compress.New(handler, compress.Encoders(br, gz), compress.MinSize(512))
+
+	// any other content coding, wrapping its library
+	lz := compress.EncoderFunc("x-lz4", func(w io.Writer) (compress.Compressor, error) {
+		return lz4.NewWriter(w), nil
+	})
+*/
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultMinSize responses smaller than 1KB are not worth compressing
+const DefaultMinSize = 1024
+
+// DefaultContentTypes are the content types compressed unless configured otherwise
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// Compress is a middleware compressing responses
+type Compress struct {
+	next         http.Handler
+	encoders     []Encoder
+	minSize      int
+	contentTypes []string
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Compress
+type Option func(c *Compress) error
+
+// New creates a new Compress middleware
+func New(next http.Handler, opts ...Option) (*Compress, error) {
+	c := &Compress{
+		next:         next,
+		minSize:      DefaultMinSize,
+		contentTypes: DefaultContentTypes,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.encoders == nil {
+		gz, err := NewGzipEncoder(gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		c.encoders = []Encoder{gz}
+	}
+	return c, nil
+}
+
+// Encoders sets the available encoders, from the most to the least preferred
+func Encoders(encoders ...Encoder) Option {
+	return func(c *Compress) error {
+		if len(encoders) == 0 {
+			return fmt.Errorf("at least one encoder is required")
+		}
+		if err := validateEncoders(encoders); err != nil {
+			return err
+		}
+		c.encoders = encoders
+		return nil
+	}
+}
+
+// MinSize sets the size under which responses are not compressed
+func MinSize(size int) Option {
+	return func(c *Compress) error {
+		if size < 0 {
+			return fmt.Errorf("min size should be >= 0, got %d", size)
+		}
+		c.minSize = size
+		return nil
+	}
+}
+
+// ContentTypes sets the content types to compress, "type/*" matches all the subtypes of a type
+func ContentTypes(types ...string) Option {
+	return func(c *Compress) error {
+		c.contentTypes = types
+		return nil
+	}
+}
+
+// Logger defines the logger the compress middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(c *Compress) error {
+		c.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by compress handler.
+func (c *Compress) Wrap(next http.Handler) error {
+	c.next = next
+	return nil
+}
+
+func (c *Compress) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/compress: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/compress: completed ServeHttp on request")
+	}
+
+	encoder := negotiate(req.Header.Get("Accept-Encoding"), c.encoders)
+	if req.Method == http.MethodHead || req.Header.Get("Range") != "" {
+		encoder = nil
+	}
+
+	cw := &compressWriter{w: w, compress: c, encoder: encoder}
+	defer func() {
+		if err := cw.close(); err != nil {
+			c.log.Errorf("vulcand/oxy/compress: failed to complete response, err: %v", err)
+		}
+	}()
+	c.next.ServeHTTP(cw, req)
+}
+
+func (c *Compress) isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.contentTypes {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+type writerState int
+
+const (
+	// stateUndecided the response is buffered until enough is known to decide whether to compress it
+	stateUndecided writerState = iota
+	stateIdentity
+	stateCompressing
+)
+
+// compressWriter holds the response back until it knows whether it is worth compressing
+type compressWriter struct {
+	w        http.ResponseWriter
+	compress *Compress
+	encoder  Encoder
+
+	state       writerState
+	code        int
+	wroteHeader bool
+	buf         []byte
+	compressor  Compressor
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.w.Header()
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	// the interim responses, e.g. 103 Early Hints, are passed before the final one
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		cw.w.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+	cw.code = code
+
+	if !cw.eligible() {
+		cw.startIdentity()
+		return
+	}
+	h := cw.w.Header()
+	if !varies(h) {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if cw.encoder == nil {
+		cw.startIdentity()
+		return
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		if length < cw.compress.minSize {
+			cw.startIdentity()
+			return
+		}
+		cw.startCompressing()
+	}
+}
+
+func varies(h http.Header) bool {
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eligible tells whether the response could be compressed for some client
+func (cw *compressWriter) eligible() bool {
+	if cw.code < http.StatusOK || cw.code == http.StatusNoContent || cw.code == http.StatusNotModified || cw.code == http.StatusPartialContent {
+		return false
+	}
+	h := cw.w.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	return cw.compress.isCompressibleType(h.Get("Content-Type"))
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.w.Header().Get("Content-Type") == "" {
+			cw.w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch cw.state {
+	case stateIdentity:
+		return cw.w.Write(p)
+	case stateCompressing:
+		return cw.compressor.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.compress.minSize {
+		if err := cw.startCompressing(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.state == stateUndecided {
+		// the handler streams its response, its total size will only be known at the end
+		if err := cw.startCompressing(); err != nil {
+			return
+		}
+	}
+	if cw.state == stateCompressing {
+		if err := cw.compressor.Flush(); err != nil {
+			cw.compress.log.Errorf("vulcand/oxy/compress: failed to flush compressor, err: %v", err)
+			return
+		}
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, the response is not compressed by then.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := cw.w.(http.Hijacker); ok {
+		cw.state = stateIdentity
+		cw.wroteHeader = true
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this compress middleware does not implement http.Hijacker(type: %T)", cw.w)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (cw *compressWriter) CloseNotify() <-chan bool {
+	if cn, ok := cw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+func (cw *compressWriter) startIdentity() error {
+	cw.state = stateIdentity
+	cw.w.WriteHeader(cw.code)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err := cw.w.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+func (cw *compressWriter) startCompressing() error {
+	h := cw.w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoder.Encoding())
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the compressed representation is not byte for byte identical to the original one
+		h.Set("ETag", "W/"+etag)
+	}
+
+	compressor, err := cw.encoder.NewWriter(cw.w)
+	if err != nil {
+		h.Del("Content-Encoding")
+		cw.compress.log.Errorf("vulcand/oxy/compress: failed to create %s compressor, err: %v", cw.encoder.Encoding(), err)
+		return cw.startIdentity()
+	}
+	cw.state = stateCompressing
+	cw.compressor = compressor
+	cw.w.WriteHeader(cw.code)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err = compressor.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// close completes the response once the handler returned
+func (cw *compressWriter) close() error {
+	if !cw.wroteHeader {
+		// the handler did not write anything, let the server answer with an empty 200
+		return nil
+	}
+	switch cw.state {
+	case stateUndecided:
+		// the response is too small to be compressed
+		return cw.startIdentity()
+	case stateCompressing:
+		return cw.compressor.Close()
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+var bigBody = strings.Repeat("hello oxy ", 200)
+
+func TestCompress(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		acceptEncoding   string
+		contentType      string
+		contentEncoding  string
+		contentLength    bool
+		body             string
+		expectedEncoding string
+		expectedVary     bool
+	}{
+		{
+			desc:             "gzip",
+			acceptEncoding:   "gzip, deflate",
+			contentType:      "text/plain; charset=utf-8",
+			body:             bigBody,
+			expectedEncoding: "gzip",
+			expectedVary:     true,
+		},
+		{
+			desc:             "gzip with content length",
+			acceptEncoding:   "gzip",
+			contentType:      "application/json",
+			contentLength:    true,
+			body:             bigBody,
+			expectedEncoding: "gzip",
+			expectedVary:     true,
+		},
+		{
+			desc:         "client does not accept encoding",
+			contentType:  "text/plain",
+			body:         bigBody,
+			expectedVary: true,
+		},
+		{
+			desc:           "gzip refused by the client",
+			acceptEncoding: "gzip;q=0, br",
+			contentType:    "text/plain",
+			body:           bigBody,
+			expectedVary:   true,
+		},
+		{
+			desc:           "too small",
+			acceptEncoding: "gzip",
+			contentType:    "text/plain",
+			body:           "hello",
+			expectedVary:   true,
+		},
+		{
+			desc:           "too small with content length",
+			acceptEncoding: "gzip",
+			contentType:    "text/plain",
+			contentLength:  true,
+			body:           "hello",
+			expectedVary:   true,
+		},
+		{
+			desc:           "not compressible content type",
+			acceptEncoding: "gzip",
+			contentType:    "image/png",
+			body:           bigBody,
+		},
+		{
+			desc:             "already encoded",
+			acceptEncoding:   "gzip",
+			contentType:      "text/plain",
+			contentEncoding:  "br",
+			body:             bigBody,
+			expectedEncoding: "br",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				if test.contentEncoding != "" {
+					w.Header().Set("Content-Encoding", test.contentEncoding)
+				}
+				if test.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(test.body)))
+				}
+				w.Write([]byte(test.body))
+			})
+			c, err := New(handler)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(c)
+			defer srv.Close()
+
+			re, body := get(t, srv.URL, test.acceptEncoding)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, test.expectedEncoding, re.Header.Get("Content-Encoding"))
+			assert.Equal(t, test.expectedVary, re.Header.Get("Vary") == "Accept-Encoding")
+			if test.expectedEncoding == "gzip" {
+				body = gunzip(t, body)
+			}
+			assert.Equal(t, test.body, string(body))
+		})
+	}
+}
+
+func TestCompressPreference(t *testing.T) {
+	gz, err := NewGzipEncoder(gzip.BestSpeed)
+	require.NoError(t, err)
+	deflate, err := NewDeflateEncoder(flate.BestSpeed)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{acceptEncoding: "gzip, deflate", expected: "deflate"},
+		{acceptEncoding: "gzip;q=1, deflate;q=0.5", expected: "gzip"},
+		{acceptEncoding: "*", expected: "deflate"},
+		{acceptEncoding: "*, deflate;q=0", expected: "gzip"},
+		{acceptEncoding: "identity", expected: ""},
+		{acceptEncoding: "br", expected: ""},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.acceptEncoding, func(t *testing.T) {
+			e := negotiate(test.acceptEncoding, []Encoder{deflate, gz})
+			if test.expected == "" {
+				assert.Nil(t, e)
+				return
+			}
+			require.NotNil(t, e)
+			assert.Equal(t, test.expected, e.Encoding())
+		})
+	}
+}
+
+func TestCompressCustomEncoder(t *testing.T) {
+	gz, err := NewGzipEncoder(gzip.BestSpeed)
+	require.NoError(t, err)
+	// stands for a brotli or zstd library
+	custom := EncoderFunc("x-custom", func(w io.Writer) (Compressor, error) {
+		return gzip.NewWriter(w), nil
+	})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(bigBody))
+	})
+	c, err := New(handler, Encoders(custom, gz), MinSize(10))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	re, body := get(t, srv.URL, "gzip, x-custom")
+	assert.Equal(t, "x-custom", re.Header.Get("Content-Encoding"))
+	assert.Equal(t, `W/"v1"`, re.Header.Get("ETag"))
+	assert.Equal(t, bigBody, string(gunzip(t, body)))
+
+	_, err = New(handler, Encoders(custom, custom))
+	assert.Error(t, err)
+}
+
+func TestCompressStreaming(t *testing.T) {
+	next := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("data: " + strconv.Itoa(i) + "\n\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	})
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	re, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	require.NoError(t, err)
+	defer re.Body.Close()
+	assert.Equal(t, "gzip", re.Header.Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(re.Body)
+	require.NoError(t, err)
+	reader := bufio.NewReader(gz)
+	for i := 0; i < 3; i++ {
+		line := readLine(t, reader)
+		assert.Equal(t, "data: "+strconv.Itoa(i), line)
+		readLine(t, reader)
+		next <- struct{}{}
+	}
+}
+
+func TestCompressNoBody(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	re, body := get(t, srv.URL, "gzip")
+	assert.Equal(t, http.StatusNoContent, re.StatusCode)
+	assert.Empty(t, re.Header.Get("Content-Encoding"))
+	assert.Empty(t, body)
+
+	re, _, err = testutils.MakeRequest(srv.URL, testutils.Method(http.MethodHead), testutils.Header("Accept-Encoding", "gzip"))
+	require.NoError(t, err)
+	assert.Empty(t, re.Header.Get("Content-Encoding"))
+}
+
+// interimRecorder records the status codes of the interim responses
+type interimRecorder struct {
+	*httptest.ResponseRecorder
+	interim []int
+}
+
+func (r *interimRecorder) WriteHeader(code int) {
+	if code < http.StatusOK {
+		r.interim = append(r.interim, code)
+		return
+	}
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func TestCompressInterimResponse(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(103)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(bigBody))
+	})
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := &interimRecorder{ResponseRecorder: httptest.NewRecorder()}
+	c.ServeHTTP(rec, req)
+
+	assert.Equal(t, []int{103}, rec.interim)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, bigBody, string(gunzip(t, rec.Body.Bytes())))
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := r.ReadString('\n')
+		lines <- strings.TrimSuffix(line, "\n")
+	}()
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for the flushed data")
+		return ""
+	}
+}
+
+func get(t *testing.T, url, acceptEncoding string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	// the transport must not decompress the response by itself
+	re, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	require.NoError(t, err)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	return re, body
+}
+
+func gunzip(t *testing.T, body []byte) []byte {
+	gz, err := gzip.NewReader(strings.NewReader(string(body)))
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	return out
+}
@@ -0,0 +1,183 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compressor is a streaming compressor, Flush pushes the pending compressed data to the underlying writer
+type Compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Encoder creates the compressors of a content coding.
+// gzip and deflate are provided by this package, brotli ("br") and zstd ("zstd") by the compress/brotli and
+// compress/zstd packages, other codings can be plugged in by wrapping their respective libraries.
+type Encoder interface {
+	// Encoding returns the content coding, as found in the Accept-Encoding and Content-Encoding headers
+	Encoding() string
+	// NewWriter returns a compressor writing to w
+	NewWriter(w io.Writer) (Compressor, error)
+}
+
+// EncoderFunc adapts a function returning a compressor to the Encoder interface
+func EncoderFunc(encoding string, newWriter func(w io.Writer) (Compressor, error)) Encoder {
+	return &funcEncoder{encoding: encoding, newWriter: newWriter}
+}
+
+type funcEncoder struct {
+	encoding  string
+	newWriter func(w io.Writer) (Compressor, error)
+}
+
+func (e *funcEncoder) Encoding() string {
+	return e.encoding
+}
+
+func (e *funcEncoder) NewWriter(w io.Writer) (Compressor, error) {
+	return e.newWriter(w)
+}
+
+// NewGzipEncoder creates a gzip Encoder with the compression level, see compress/gzip for the available levels.
+// The compressors are pooled as allocating them is expensive.
+func NewGzipEncoder(level int) (Encoder, error) {
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, err
+	}
+	return &gzipEncoder{
+		pool: &sync.Pool{New: func() interface{} {
+			w, _ := gzip.NewWriterLevel(nil, level)
+			return w
+		}},
+	}, nil
+}
+
+type gzipEncoder struct {
+	pool *sync.Pool
+}
+
+func (e *gzipEncoder) Encoding() string {
+	return "gzip"
+}
+
+func (e *gzipEncoder) NewWriter(w io.Writer) (Compressor, error) {
+	gz := e.pool.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return &pooledGzipWriter{Writer: gz, pool: e.pool}, nil
+}
+
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// NewDeflateEncoder creates a deflate Encoder with the compression level, see compress/flate for the available levels
+func NewDeflateEncoder(level int) (Encoder, error) {
+	if _, err := flate.NewWriter(nil, level); err != nil {
+		return nil, err
+	}
+	return EncoderFunc("deflate", func(w io.Writer) (Compressor, error) {
+		return flate.NewWriter(w, level)
+	}), nil
+}
+
+// acceptedEncoding is a content coding of the Accept-Encoding header along with its quality value
+type acceptedEncoding struct {
+	name    string
+	quality float64
+}
+
+func parseAcceptEncoding(header string) []acceptedEncoding {
+	var accepted []acceptedEncoding
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, quality := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					continue
+				}
+				quality = q
+			}
+		}
+		accepted = append(accepted, acceptedEncoding{name: strings.ToLower(name), quality: quality})
+	}
+	return accepted
+}
+
+// negotiate picks the encoder preferred by the client, ties are broken by the order of the encoders.
+// It returns nil if the client does not accept any of the encoders.
+func negotiate(header string, encoders []Encoder) Encoder {
+	if header == "" {
+		return nil
+	}
+	accepted := parseAcceptEncoding(header)
+
+	type candidate struct {
+		encoder Encoder
+		quality float64
+		rank    int
+	}
+	var candidates []candidate
+	for rank, e := range encoders {
+		quality, wildcard, found := 0.0, -1.0, false
+		for _, a := range accepted {
+			switch a.name {
+			case e.Encoding():
+				quality, found = a.quality, true
+			case "*":
+				wildcard = a.quality
+			}
+		}
+		if !found && wildcard >= 0 {
+			quality, found = wildcard, true
+		}
+		if found && quality > 0 {
+			candidates = append(candidates, candidate{encoder: e, quality: quality, rank: rank})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].quality != candidates[j].quality {
+			return candidates[i].quality > candidates[j].quality
+		}
+		return candidates[i].rank < candidates[j].rank
+	})
+	return candidates[0].encoder
+}
+
+func validateEncoders(encoders []Encoder) error {
+	seen := map[string]bool{}
+	for _, e := range encoders {
+		name := strings.ToLower(e.Encoding())
+		if name == "" || name == "identity" || name == "*" {
+			return fmt.Errorf("invalid content coding %q", e.Encoding())
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicated content coding %q", e.Encoding())
+		}
+		seen[name] = true
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+/*
+Package zstd provides a zstd ("zstd") encoder for the compress middleware, based on github.com/klauspost/compress.
+
+The encoder requires go1.22, the package is empty when built with older versions.
+
+Examples of a zstd encoder:
+
+	// zstd preferred, gzip for the other clients
+	zs, err := zstd.NewEncoder(zstd.DefaultLevel)
+	gz, err := compress.NewGzipEncoder(gzip.DefaultCompression)
+	c, err := compress.New(handler, compress.Encoders(zs, gz))
+*/
+package zstd
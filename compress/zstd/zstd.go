@@ -0,0 +1,70 @@
+//go:build go1.22
+// +build go1.22
+
+package zstd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	kzstd "github.com/klauspost/compress/zstd"
+	"github.com/vulcand/oxy/compress"
+)
+
+// Levels of the compression, as used by the zstd command line
+const (
+	BestSpeed       = 1
+	BestCompression = 22
+	DefaultLevel    = 3
+)
+
+// MaxWindowSize is the window of the compressors, browsers do not decode the frames using larger windows, see RFC 8878
+const MaxWindowSize = 8 << 20
+
+// NewEncoder creates a zstd compress.Encoder with the level, from BestSpeed to BestCompression.
+// The compressors are pooled as allocating them is expensive.
+func NewEncoder(level int) (compress.Encoder, error) {
+	if level < BestSpeed || level > BestCompression {
+		return nil, fmt.Errorf("zstd level should be between %d and %d, got %d", BestSpeed, BestCompression, level)
+	}
+	opts := []kzstd.EOption{
+		kzstd.WithEncoderLevel(kzstd.EncoderLevelFromZstd(level)),
+		kzstd.WithEncoderConcurrency(1),
+		kzstd.WithWindowSize(MaxWindowSize),
+	}
+	if _, err := kzstd.NewWriter(nil, opts...); err != nil {
+		return nil, err
+	}
+	return &encoder{
+		pool: &sync.Pool{New: func() interface{} {
+			w, _ := kzstd.NewWriter(nil, opts...)
+			return w
+		}},
+	}, nil
+}
+
+type encoder struct {
+	pool *sync.Pool
+}
+
+func (e *encoder) Encoding() string {
+	return "zstd"
+}
+
+func (e *encoder) NewWriter(w io.Writer) (compress.Compressor, error) {
+	zw := e.pool.Get().(*kzstd.Encoder)
+	zw.Reset(w)
+	return &pooledWriter{Encoder: zw, pool: e.pool}, nil
+}
+
+type pooledWriter struct {
+	*kzstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *pooledWriter) Close() error {
+	err := w.Encoder.Close()
+	w.pool.Put(w.Encoder)
+	return err
+}
@@ -0,0 +1,105 @@
+//go:build go1.22
+// +build go1.22
+
+package zstd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kzstd "github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/compress"
+)
+
+var bigBody = strings.Repeat("hello oxy ", 200)
+
+func TestEncoder(t *testing.T) {
+	enc, err := NewEncoder(DefaultLevel)
+	require.NoError(t, err)
+	gz, err := compress.NewGzipEncoder(gzip.BestSpeed)
+	require.NoError(t, err)
+
+	c, err := compress.New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(bigBody))
+	}), compress.Encoders(enc, gz))
+	require.NoError(t, err)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	// the pooled compressors are reused by the following requests
+	for i := 0; i < 3; i++ {
+		re, body := get(t, srv.URL, "gzip, zstd")
+		assert.Equal(t, "zstd", re.Header.Get("Content-Encoding"))
+		dec, err := kzstd.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		out, err := ioutil.ReadAll(dec)
+		dec.Close()
+		require.NoError(t, err)
+		assert.Equal(t, bigBody, string(out))
+	}
+
+	re, _ := get(t, srv.URL, "gzip")
+	assert.Equal(t, "gzip", re.Header.Get("Content-Encoding"))
+}
+
+func TestEncoderStreaming(t *testing.T) {
+	enc, err := NewEncoder(BestSpeed)
+	require.NoError(t, err)
+
+	next := make(chan struct{})
+	c, err := compress.New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: second\n"))
+	}), compress.Encoders(enc))
+	require.NoError(t, err)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "zstd")
+	re, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	require.NoError(t, err)
+	defer re.Body.Close()
+
+	dec, err := kzstd.NewReader(re.Body)
+	require.NoError(t, err)
+	defer dec.Close()
+	reader := bufio.NewReader(dec)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line, "the flushed data is decoded before the response completes")
+	close(next)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: second\n", line)
+}
+
+func TestEncoderInvalidLevel(t *testing.T) {
+	_, err := NewEncoder(BestCompression + 1)
+	assert.Error(t, err)
+}
+
+func get(t *testing.T, url, acceptEncoding string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	// the transport must not decompress the response by itself
+	re, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	require.NoError(t, err)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	return re, body
+}
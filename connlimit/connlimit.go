@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/metrics"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -18,7 +20,17 @@ type ConnLimiter struct {
 	connections      map[string]int64
 	maxConnections   int64
 	totalConnections int64
-	next             http.Handler
+	// maxTotalConnections is the global limit, 0 for none, see GlobalMaxConnections
+	maxTotalConnections int64
+	next                http.Handler
+	rejected            *metrics.Counter
+	reaped              *metrics.Counter
+
+	// idleTimeout aborts the idle requests tracked, see IdleTimeout
+	idleTimeout time.Duration
+	clock       utils.Clock
+	tracked     map[*trackedConn]struct{}
+	reaping     bool
 
 	errHandler utils.ErrorHandler
 	log        *log.Logger
@@ -35,7 +47,7 @@ func New(next http.Handler, extract utils.SourceExtractor, maxConnections int64,
 		maxConnections: maxConnections,
 		connections:    make(map[string]int64),
 		next:           next,
-		log:            log.StandardLogger(),
+		log:            utils.InheritedLogger(),
 	}
 
 	for _, o := range options {
@@ -43,6 +55,12 @@ func New(next http.Handler, extract utils.SourceExtractor, maxConnections int64,
 			return nil, err
 		}
 	}
+	if cl.clock == nil {
+		cl.clock = utils.InheritedClock()
+	}
+	if cl.idleTimeout > 0 {
+		cl.tracked = make(map[*trackedConn]struct{})
+	}
 	if cl.errHandler == nil {
 		cl.errHandler = &ConnErrHandler{
 			log: cl.log,
@@ -74,11 +92,21 @@ func (cl *ConnLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := cl.acquire(token, amount); err != nil {
-		cl.log.Debugf("limiting request source %s: %v", token, err)
+		if cl.rejected != nil {
+			cl.rejected.Inc()
+		}
+		if utils.Sampled(cl.log, log.DebugLevel, "limiting request source %s: %v") {
+			cl.log.Debugf("limiting request source %s: %v", token, err)
+		}
 		cl.errHandler.ServeHTTP(w, r, err)
 		return
 	}
 
+	if cl.idleTimeout > 0 {
+		cl.serveTracked(w, r, token, amount)
+		return
+	}
+
 	defer cl.release(token, amount)
 
 	cl.next.ServeHTTP(w, r)
@@ -92,6 +120,9 @@ func (cl *ConnLimiter) acquire(token string, amount int64) error {
 	if connections >= cl.maxConnections {
 		return &MaxConnError{max: cl.maxConnections}
 	}
+	if cl.maxTotalConnections > 0 && cl.totalConnections >= cl.maxTotalConnections {
+		return &MaxConnError{max: cl.maxTotalConnections, global: true}
+	}
 
 	cl.connections[token] += amount
 	cl.totalConnections += amount
@@ -101,7 +132,10 @@ func (cl *ConnLimiter) acquire(token string, amount int64) error {
 func (cl *ConnLimiter) release(token string, amount int64) {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
+	cl.releaseLocked(token, amount)
+}
 
+func (cl *ConnLimiter) releaseLocked(token string, amount int64) {
 	cl.connections[token] -= amount
 	cl.totalConnections -= amount
 
@@ -111,15 +145,53 @@ func (cl *ConnLimiter) release(token string, amount int64) {
 	}
 }
 
+// MaxConnections returns the maximum number of simultaneous connections of a source
+func (cl *ConnLimiter) MaxConnections() int64 {
+	return cl.maxConnections
+}
+
+// MaxTotalConnections returns the maximum number of simultaneous connections of all the sources, 0 for no limit
+func (cl *ConnLimiter) MaxTotalConnections() int64 {
+	return cl.maxTotalConnections
+}
+
+// TotalConnections returns the number of connections being served
+func (cl *ConnLimiter) TotalConnections() int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.totalConnections
+}
+
+// Connections returns the number of connections being served per source
+func (cl *ConnLimiter) Connections() map[string]int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	connections := make(map[string]int64, len(cl.connections))
+	for token, n := range cl.connections {
+		connections[token] = n
+	}
+	return connections
+}
+
 // MaxConnError maximum connections reached error
 type MaxConnError struct {
-	max int64
+	max    int64
+	global bool
 }
 
 func (m *MaxConnError) Error() string {
+	if m.global {
+		return fmt.Sprintf("max total connections reached: %d", m.max)
+	}
 	return fmt.Sprintf("max connections reached: %d", m.max)
 }
 
+// Global returns true when the global limit was reached rather than the limit of the source
+func (m *MaxConnError) Global() bool {
+	return m.global
+}
+
 // ConnErrHandler connection limiter error handler
 type ConnErrHandler struct {
 	log *log.Logger
@@ -132,7 +204,13 @@ func (e *ConnErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err
 		defer logEntry.Debug("vulcand/oxy/connlimit: completed ServeHttp on request")
 	}
 
-	if _, ok := err.(*MaxConnError); ok {
+	if merr, ok := err.(*MaxConnError); ok {
+		if merr.global {
+			// the proxy is overloaded, the client is not to blame
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
 		w.WriteHeader(429)
 		w.Write([]byte(err.Error()))
 		return
@@ -150,3 +228,16 @@ func ErrorHandler(h utils.ErrorHandler) ConnLimitOption {
 		return nil
 	}
 }
+
+// GlobalMaxConnections sets the maximum number of simultaneous connections of all the sources, on top of the
+// maximum of each source, counted in the same pass. A request over the limit of its source is rejected with a 429,
+// a request over the global limit with a 503, see MaxConnError.Global.
+func GlobalMaxConnections(max int64) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		if max <= 0 {
+			return fmt.Errorf("global max connections should be > 0, got %d", max)
+		}
+		cl.maxTotalConnections = max
+		return nil
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/metrics"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
 )
@@ -109,3 +110,92 @@ func faultyExtractor(_ *http.Request) (string, int64, error) {
 
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
+
+func TestMetrics(t *testing.T) {
+	proceed, wait := make(chan bool), make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Wait") != "" {
+			proceed <- true
+			<-wait
+		}
+		w.Write([]byte("hello"))
+	})
+	registry := metrics.NewRegistry()
+
+	cl, err := New(handler, headerLimit, 1, Metrics(registry))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	finish := make(chan bool)
+	go func() {
+		testutils.Get(srv.URL, testutils.Header("Limit", "a"), testutils.Header("Wait", "yes"))
+		finish <- true
+	}()
+	<-proceed
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, "oxy_connlimit_connections 1\n")
+	assert.Contains(t, gathered, "oxy_connlimit_sources 1\n")
+	assert.Contains(t, gathered, "oxy_connlimit_rejected_total 1\n")
+
+	close(wait)
+	<-finish
+	assert.Contains(t, string(registry.Gather()), "oxy_connlimit_connections 0\n")
+}
+
+func TestGlobalMaxConnections(t *testing.T) {
+	proceed, wait := make(chan bool), make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Wait") != "" {
+			proceed <- true
+			<-wait
+		}
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 1, GlobalMaxConnections(2))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), cl.MaxTotalConnections())
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	finish := make(chan bool)
+	for _, source := range []string{"a", "b"} {
+		source := source
+		go func() {
+			testutils.Get(srv.URL, testutils.Header("Limit", source), testutils.Header("Wait", "yes"))
+			finish <- true
+		}()
+		<-proceed
+	}
+	assert.Equal(t, int64(2), cl.TotalConnections())
+
+	// the limit of the source is checked first
+	re, body, err := testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "max connections reached: 1", string(body))
+
+	re, body, err = testutils.Get(srv.URL, testutils.Header("Limit", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "max total connections reached: 2", string(body))
+
+	close(wait)
+	<-finish
+	<-finish
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Limit", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	_, err = New(handler, headerLimit, 1, GlobalMaxConnections(0))
+	require.Error(t, err)
+}
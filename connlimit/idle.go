@@ -0,0 +1,208 @@
+package connlimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// IdleTimeout aborts the requests that read nothing from their body and write nothing to their response for the
+// timeout, and releases their slots, so that the leaked or abandoned requests do not hold the limits forever. The
+// limiter counts the requests being served, not the connections: a keep-alive connection waiting for its next
+// request holds no slot and is closed by the IdleTimeout of the http.Server. A request waiting for a slow upstream
+// server is idle as well, the timeout should be longer than the expected response times. The idle requests are
+// checked every half timeout, they are aborted between one and one and a half timeout after their last activity.
+//
+// The context of an aborted request is canceled and the next reads of its body fail, a read in progress returns once
+// the client sends more data or the connection is closed. Once the next handler returns, the connection is closed
+// with http.ErrAbortHandler. The hijacked connections, e.g. the websockets, are not aborted.
+func IdleTimeout(d time.Duration) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout should be > 0, got %v", d)
+		}
+		cl.idleTimeout = d
+		return nil
+	}
+}
+
+// Clock sets the clock of the idle timeout
+func Clock(clock utils.Clock) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		cl.clock = clock
+		return nil
+	}
+}
+
+// trackedConn is a request counted by the limiter with an idle timeout
+type trackedConn struct {
+	// lastActivity is the UnixNano time of the last read or write, first for the 64-bit alignment of the atomics
+	lastActivity int64
+	hijacked     int32
+
+	token  string
+	amount int64
+	cancel context.CancelFunc
+	// reaped is set, with the mutex of the limiter held, once the request is aborted for being idle
+	reaped bool
+}
+
+func (c *trackedConn) touch(clock utils.Clock) {
+	atomic.StoreInt64(&c.lastActivity, clock.UtcNow().UnixNano())
+}
+
+// idleSince returns true if the request had no activity since t
+func (c *trackedConn) idleSince(t time.Time) bool {
+	return atomic.LoadInt32(&c.hijacked) == 0 && atomic.LoadInt64(&c.lastActivity) <= t.UnixNano()
+}
+
+// serveTracked serves a request whose slot is acquired, the slot is released once the request is served or idle
+func (cl *ConnLimiter) serveTracked(w http.ResponseWriter, r *http.Request, token string, amount int64) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	c := &trackedConn{token: token, amount: amount, cancel: cancel}
+	c.touch(cl.clock)
+
+	r = r.WithContext(ctx)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &trackedBody{ReadCloser: r.Body, ctx: ctx, conn: c, clock: cl.clock}
+	}
+
+	cl.mutex.Lock()
+	cl.tracked[c] = struct{}{}
+	if !cl.reaping {
+		cl.reaping = true
+		go cl.reapIdle()
+	}
+	cl.mutex.Unlock()
+
+	cl.next.ServeHTTP(&trackedWriter{ResponseWriter: w, conn: c, clock: cl.clock}, r)
+
+	cl.mutex.Lock()
+	reaped := c.reaped
+	if !reaped {
+		delete(cl.tracked, c)
+		cl.releaseLocked(token, amount)
+	}
+	cl.mutex.Unlock()
+
+	// the server recovers http.ErrAbortHandler and closes the connection
+	if reaped && r.Context().Value(http.ServerContextKey) != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// reapIdle aborts the idle requests every half idle timeout, it returns once no request is tracked
+func (cl *ConnLimiter) reapIdle() {
+	for {
+		<-cl.clock.After(cl.idleTimeout / 2)
+
+		reaped, done := cl.reapIdleLocked()
+		// the requests are canceled without the mutex held, their bodies are owned by the server and not closed: a
+		// close blocks until the read in progress returns
+		for _, c := range reaped {
+			c.cancel()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// reapIdleLocked releases the slots of the idle requests and returns them, true once no request is tracked
+func (cl *ConnLimiter) reapIdleLocked() ([]*trackedConn, bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if len(cl.tracked) == 0 {
+		cl.reaping = false
+		return nil, true
+	}
+	var reaped []*trackedConn
+	deadline := cl.clock.UtcNow().Add(-cl.idleTimeout)
+	for c := range cl.tracked {
+		if !c.idleSince(deadline) {
+			continue
+		}
+		cl.log.Debugf("vulcand/oxy/connlimit: aborting the idle request of source %s", c.token)
+		c.reaped = true
+		delete(cl.tracked, c)
+		cl.releaseLocked(c.token, c.amount)
+		if cl.reaped != nil {
+			cl.reaped.Inc()
+		}
+		reaped = append(reaped, c)
+	}
+	return reaped, false
+}
+
+// trackedBody records the reads of the request body as activity, its reads fail once the request is aborted
+type trackedBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	conn  *trackedConn
+	clock utils.Clock
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.conn.touch(b.clock)
+	}
+	return n, err
+}
+
+// trackedWriter records the writes of the response as activity
+type trackedWriter struct {
+	http.ResponseWriter
+	conn  *trackedConn
+	clock utils.Clock
+}
+
+func (w *trackedWriter) WriteHeader(code int) {
+	w.conn.touch(w.clock)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *trackedWriter) Write(buf []byte) (int, error) {
+	w.conn.touch(w.clock)
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *trackedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.conn.touch(w.clock)
+		f.Flush()
+	}
+}
+
+func (w *trackedWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack hijacks the connection, its request is no longer aborted when idle
+func (w *trackedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", w.ResponseWriter)
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		atomic.StoreInt32(&w.conn.hijacked, 1)
+	}
+	return conn, rw, err
+}
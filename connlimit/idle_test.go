@@ -0,0 +1,175 @@
+package connlimit
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/metrics"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestIdleTimeoutClosesIdleConnections(t *testing.T) {
+	canceled := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// waits for an upstream server that never answers
+		<-req.Context().Done()
+		close(canceled)
+	})
+
+	clock := testutils.GetClock()
+	registry := metrics.NewRegistry()
+	cl, err := New(handler, headerLimit, 1, IdleTimeout(10*time.Second), Clock(clock), Metrics(registry))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	done := make(chan error)
+	go func() {
+		_, _, errGet := testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+		done <- errGet
+	}()
+	waitForWaiters(t, clock, 1)
+	assert.EqualValues(t, 1, cl.TotalConnections())
+
+	// 5 seconds of inactivity
+	clock.Advance(5 * time.Second)
+	waitForWaiters(t, clock, 1)
+	assert.EqualValues(t, 1, cl.TotalConnections())
+
+	// 10 seconds of inactivity
+	clock.Advance(5 * time.Second)
+	<-canceled
+	assert.Error(t, <-done)
+	assert.EqualValues(t, 0, cl.TotalConnections())
+	assert.Empty(t, cl.Connections())
+	assert.Contains(t, string(registry.Gather()), "oxy_connlimit_idle_closed_total 1\n")
+}
+
+func TestIdleTimeoutKeepsActiveConnections(t *testing.T) {
+	step, stepped, finish := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for {
+			select {
+			case <-step:
+				w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+				stepped <- struct{}{}
+			case <-finish:
+				return
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+
+	clock := testutils.GetClock()
+	cl, err := New(handler, headerLimit, 1, IdleTimeout(10*time.Second), Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	done := make(chan *http.Response)
+	go func() {
+		re, _, errGet := testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+		assert.NoError(t, errGet)
+		done <- re
+	}()
+
+	for i := 0; i < 4; i++ {
+		waitForWaiters(t, clock, 1)
+		clock.Advance(5 * time.Second)
+		step <- struct{}{}
+		<-stepped
+	}
+	waitForWaiters(t, clock, 1)
+	assert.EqualValues(t, 1, cl.TotalConnections())
+
+	close(finish)
+	re := <-done
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.EqualValues(t, 0, cl.TotalConnections())
+}
+
+func TestIdleTimeoutStalledUpload(t *testing.T) {
+	read, returned := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer close(returned)
+		buf := make([]byte, 5)
+		io.ReadFull(req.Body, buf)
+		close(read)
+		// blocks until the client sends more data
+		ioutil.ReadAll(req.Body)
+	})
+
+	clock := testutils.GetClock()
+	cl, err := New(handler, headerLimit, 1, IdleTimeout(10*time.Second), Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	// a chunked upload stalled after its first chunk
+	body, upload := io.Pipe()
+	done := make(chan error)
+	go func() {
+		req, errReq := http.NewRequest(http.MethodPost, srv.URL, body)
+		require.NoError(t, errReq)
+		req.Header.Set("Limit", "a")
+		re, errPost := http.DefaultClient.Do(req)
+		if errPost == nil {
+			re.Body.Close()
+		}
+		done <- errPost
+	}()
+	upload.Write([]byte("chunk"))
+	<-read
+
+	waitForWaiters(t, clock, 1)
+	clock.Advance(5 * time.Second)
+	waitForWaiters(t, clock, 1)
+	clock.Advance(5 * time.Second)
+
+	total := make(chan int64)
+	go func() {
+		deadline := time.Now().Add(time.Second)
+		for cl.TotalConnections() != 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		total <- cl.TotalConnections()
+	}()
+	select {
+	case n := <-total:
+		assert.EqualValues(t, 0, n)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the limiter is blocked by the stalled upload")
+	}
+
+	upload.CloseWithError(io.ErrUnexpectedEOF)
+	<-returned
+	assert.Error(t, <-done)
+}
+
+func TestIdleTimeoutInvalid(t *testing.T) {
+	_, err := New(nil, headerLimit, 1, IdleTimeout(0))
+	assert.Error(t, err)
+}
+
+// waitForWaiters waits for n goroutines to wait on the clock
+func waitForWaiters(t *testing.T, clock *utils.FakeClock, n int) {
+	deadline := time.Now().Add(time.Second)
+	for clock.Waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are waiting on the clock, expected %d", clock.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,43 @@
+package connlimit
+
+import (
+	"github.com/vulcand/oxy/metrics"
+)
+
+// Metrics registers the metrics of the connection limiter into the registry:
+//
+//	oxy_connlimit_connections is the number of connections being served
+//	oxy_connlimit_sources is the number of sources having connections
+//	oxy_connlimit_rejected_total counts the connections rejected as their source reached the limit
+//	oxy_connlimit_idle_closed_total counts the requests aborted by the idle timeout
+func Metrics(r *metrics.Registry) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		rejected, err := r.Counter("oxy_connlimit_rejected_total", "Connections rejected by the connection limiter.")
+		if err != nil {
+			return err
+		}
+		err = r.GaugeFunc("oxy_connlimit_connections", "Connections being served by the connection limiter.", func() float64 {
+			cl.mutex.Lock()
+			defer cl.mutex.Unlock()
+			return float64(cl.totalConnections)
+		})
+		if err != nil {
+			return err
+		}
+		err = r.GaugeFunc("oxy_connlimit_sources", "Sources having connections in the connection limiter.", func() float64 {
+			cl.mutex.Lock()
+			defer cl.mutex.Unlock()
+			return float64(len(cl.connections))
+		})
+		if err != nil {
+			return err
+		}
+		idleClosed, err := r.Counter("oxy_connlimit_idle_closed_total", "Requests aborted by the idle timeout of the connection limiter.")
+		if err != nil {
+			return err
+		}
+		cl.rejected = rejected.With()
+		cl.reaped = idleClosed.With()
+		return nil
+	}
+}
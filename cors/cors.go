@@ -0,0 +1,339 @@
+/*
+Package cors provides a middleware implementing Cross-Origin Resource Sharing, letting browsers call the proxied APIs
+from other origins.
+
+Preflight requests are answered by the middleware, unless configured to pass them through. Requests from origins
+that are not allowed are passed to the next handler without CORS headers, browsers enforce the policy.
+
+Examples of a CORS middleware:
+
+	// any origin, simple methods
+	c, err := cors.New(handler, cors.AllowedOrigins("*"))
+
+	// the subdomains of example.com, with cookies
+	c, err := cors.New(handler,
+		cors.AllowedOrigins("https://*.example.com"),
+		cors.AllowedMethods(http.MethodGet, http.MethodPost, http.MethodDelete),
+		cors.AllowedHeaders("Content-Type", "X-Csrf-Token"),
+		cors.AllowCredentials(true),
+		cors.MaxAge(10*time.Minute),
+	)
+*/
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// CORS headers
+const (
+	Origin                        = "Origin"
+	AccessControlRequestMethod    = "Access-Control-Request-Method"
+	AccessControlRequestHeaders   = "Access-Control-Request-Headers"
+	AccessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	AccessControlAllowMethods     = "Access-Control-Allow-Methods"
+	AccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	AccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	AccessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	AccessControlMaxAge           = "Access-Control-Max-Age"
+)
+
+// DefaultMethods are the methods allowed unless configured otherwise, the CORS-safelisted methods
+var DefaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORS is a Cross-Origin Resource Sharing middleware
+type CORS struct {
+	next                 http.Handler
+	allowAllOrigins      bool
+	origins              map[string]bool
+	originPatterns       []*regexp.Regexp
+	methods              map[string]bool
+	methodsValue         string
+	allowAllHeaders      bool
+	headers              map[string]bool
+	headersValue         string
+	exposedHeaders       string
+	allowCredentials     bool
+	maxAge               time.Duration
+	passthroughPreflight bool
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for CORS
+type Option func(c *CORS) error
+
+// New creates a new CORS middleware. No origin is allowed by default.
+func New(next http.Handler, opts ...Option) (*CORS, error) {
+	c := &CORS{
+		next:    next,
+		origins: map[string]bool{},
+		headers: map[string]bool{},
+
+		log: utils.InheritedLogger(),
+	}
+	if err := AllowedMethods(DefaultMethods...)(c); err != nil {
+		return nil, err
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// AllowedOrigins adds allowed origins, e.g. "https://example.com". "*" allows any origin, a "*" within an origin
+// matches the subdomains, e.g. "https://*.example.com".
+func AllowedOrigins(origins ...string) Option {
+	return func(c *CORS) error {
+		for _, origin := range origins {
+			origin = strings.ToLower(origin)
+			switch {
+			case origin == "*":
+				c.allowAllOrigins = true
+			case strings.Contains(origin, "*"):
+				parts := strings.Split(origin, "*")
+				for i := range parts {
+					parts[i] = regexp.QuoteMeta(parts[i])
+				}
+				c.originPatterns = append(c.originPatterns, regexp.MustCompile("^"+strings.Join(parts, "[a-z0-9.-]+")+"$"))
+			default:
+				c.origins[origin] = true
+			}
+		}
+		return nil
+	}
+}
+
+// AllowedOriginPatterns adds regular expressions matching the allowed origins
+func AllowedOriginPatterns(patterns ...string) Option {
+	return func(c *CORS) error {
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("invalid origin pattern %q: %v", p, err)
+			}
+			c.originPatterns = append(c.originPatterns, re)
+		}
+		return nil
+	}
+}
+
+// AllowedMethods sets the methods allowed for the cross-origin requests, it defaults to GET, HEAD and POST
+func AllowedMethods(methods ...string) Option {
+	return func(c *CORS) error {
+		c.methods = make(map[string]bool, len(methods))
+		values := make([]string, len(methods))
+		for i, m := range methods {
+			values[i] = strings.ToUpper(m)
+			c.methods[values[i]] = true
+		}
+		c.methodsValue = strings.Join(values, ", ")
+		return nil
+	}
+}
+
+// AllowedHeaders adds the request headers allowed for the cross-origin requests, "*" allows any header
+func AllowedHeaders(headers ...string) Option {
+	return func(c *CORS) error {
+		for _, h := range headers {
+			if h == "*" {
+				c.allowAllHeaders = true
+				continue
+			}
+			c.headers[strings.ToLower(h)] = true
+			if c.headersValue != "" {
+				c.headersValue += ", "
+			}
+			c.headersValue += http.CanonicalHeaderKey(h)
+		}
+		return nil
+	}
+}
+
+// ExposedHeaders sets the response headers the browsers let the scripts read
+func ExposedHeaders(headers ...string) Option {
+	return func(c *CORS) error {
+		values := make([]string, len(headers))
+		for i, h := range headers {
+			values[i] = http.CanonicalHeaderKey(h)
+		}
+		c.exposedHeaders = strings.Join(values, ", ")
+		return nil
+	}
+}
+
+// AllowCredentials lets the cross-origin requests carry cookies and authorization headers.
+// The allowed origin is then always echoed, as browsers reject "*" for such requests.
+func AllowCredentials(allow bool) Option {
+	return func(c *CORS) error {
+		c.allowCredentials = allow
+		return nil
+	}
+}
+
+// MaxAge sets how long the browsers can cache the result of a preflight request
+func MaxAge(d time.Duration) Option {
+	return func(c *CORS) error {
+		if d < 0 {
+			return fmt.Errorf("max age should be >= 0, got %v", d)
+		}
+		c.maxAge = d
+		return nil
+	}
+}
+
+// PassthroughPreflight passes the preflight requests to the next handler once the CORS headers are set,
+// instead of answering them with a 204
+func PassthroughPreflight(passthrough bool) Option {
+	return func(c *CORS) error {
+		c.passthroughPreflight = passthrough
+		return nil
+	}
+}
+
+// Logger defines the logger the CORS middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(c *CORS) error {
+		c.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by CORS handler.
+func (c *CORS) Wrap(next http.Handler) error {
+	c.next = next
+	return nil
+}
+
+func (c *CORS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/cors: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/cors: completed ServeHttp on request")
+	}
+
+	if req.Method == http.MethodOptions && req.Header.Get(AccessControlRequestMethod) != "" {
+		c.preflight(w, req)
+		return
+	}
+
+	origin := req.Header.Get(Origin)
+	if origin == "" {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	h := w.Header()
+	h.Add("Vary", Origin)
+	if c.isOriginAllowed(origin) && c.methods[req.Method] {
+		c.setAllowOrigin(h, origin)
+		if c.exposedHeaders != "" {
+			h.Set(AccessControlExposeHeaders, c.exposedHeaders)
+		}
+	} else {
+		c.log.Debugf("vulcand/oxy/cors: cross-origin request from %s not allowed", origin)
+	}
+	c.next.ServeHTTP(w, req)
+}
+
+func (c *CORS) preflight(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Add("Vary", Origin)
+	h.Add("Vary", AccessControlRequestMethod)
+	h.Add("Vary", AccessControlRequestHeaders)
+
+	origin := req.Header.Get(Origin)
+	method := strings.ToUpper(req.Header.Get(AccessControlRequestMethod))
+	requested := parseHeaderList(req.Header.Get(AccessControlRequestHeaders))
+
+	switch {
+	case !c.isOriginAllowed(origin):
+		c.log.Debugf("vulcand/oxy/cors: preflight from %s not allowed", origin)
+	case !c.methods[method]:
+		c.log.Debugf("vulcand/oxy/cors: preflight method %s from %s not allowed", method, origin)
+	case !c.areHeadersAllowed(requested):
+		c.log.Debugf("vulcand/oxy/cors: preflight headers %v from %s not allowed", requested, origin)
+	default:
+		c.setAllowOrigin(h, origin)
+		h.Set(AccessControlAllowMethods, c.methodsValue)
+		if len(requested) > 0 {
+			if c.allowAllHeaders {
+				h.Set(AccessControlAllowHeaders, strings.Join(requested, ", "))
+			} else {
+				h.Set(AccessControlAllowHeaders, c.headersValue)
+			}
+		}
+		if c.maxAge > 0 {
+			h.Set(AccessControlMaxAge, strconv.Itoa(int(c.maxAge/time.Second)))
+		}
+		if c.passthroughPreflight {
+			c.next.ServeHTTP(w, req)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CORS) setAllowOrigin(h http.Header, origin string) {
+	if c.allowAllOrigins && !c.allowCredentials {
+		h.Set(AccessControlAllowOrigin, "*")
+	} else {
+		h.Set(AccessControlAllowOrigin, origin)
+	}
+	if c.allowCredentials {
+		h.Set(AccessControlAllowCredentials, "true")
+	}
+}
+
+func (c *CORS) isOriginAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if c.allowAllOrigins {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+	for _, re := range c.originPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) areHeadersAllowed(headers []string) bool {
+	if c.allowAllHeaders {
+		return true
+	}
+	for _, h := range headers {
+		if !c.headers[strings.ToLower(h)] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseHeaderList(value string) []string {
+	var headers []string
+	for _, h := range strings.Split(value, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	return headers
+}
@@ -0,0 +1,245 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORSActualRequest(t *testing.T) {
+	testCases := []struct {
+		desc                string
+		opts                []Option
+		origin              string
+		method              string
+		expectedAllowOrigin string
+		expectedCredentials string
+		expectedExposed     string
+	}{
+		{
+			desc:   "no origin",
+			opts:   []Option{AllowedOrigins("*")},
+			method: http.MethodGet,
+		},
+		{
+			desc:                "any origin",
+			opts:                []Option{AllowedOrigins("*")},
+			origin:              "https://example.com",
+			method:              http.MethodGet,
+			expectedAllowOrigin: "*",
+		},
+		{
+			desc:                "any origin with credentials",
+			opts:                []Option{AllowedOrigins("*"), AllowCredentials(true)},
+			origin:              "https://example.com",
+			method:              http.MethodGet,
+			expectedAllowOrigin: "https://example.com",
+			expectedCredentials: "true",
+		},
+		{
+			desc:                "listed origin",
+			opts:                []Option{AllowedOrigins("https://example.com"), ExposedHeaders("x-total-count", "X-Request-Id")},
+			origin:              "https://Example.com",
+			method:              http.MethodPost,
+			expectedAllowOrigin: "https://Example.com",
+			expectedExposed:     "X-Total-Count, X-Request-Id",
+		},
+		{
+			desc:   "origin not listed",
+			opts:   []Option{AllowedOrigins("https://example.com")},
+			origin: "https://evil.com",
+			method: http.MethodGet,
+		},
+		{
+			desc:                "wildcard subdomain",
+			opts:                []Option{AllowedOrigins("https://*.example.com")},
+			origin:              "https://api.eu.example.com",
+			method:              http.MethodGet,
+			expectedAllowOrigin: "https://api.eu.example.com",
+		},
+		{
+			desc:   "wildcard does not match another domain",
+			opts:   []Option{AllowedOrigins("https://*.example.com")},
+			origin: "https://example.com.evil.com",
+			method: http.MethodGet,
+		},
+		{
+			desc:                "regular expression",
+			opts:                []Option{AllowedOriginPatterns(`^http://localhost:\d+$`)},
+			origin:              "http://localhost:3000",
+			method:              http.MethodGet,
+			expectedAllowOrigin: "http://localhost:3000",
+		},
+		{
+			desc:   "method not allowed",
+			opts:   []Option{AllowedOrigins("*")},
+			origin: "https://example.com",
+			method: http.MethodDelete,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var called bool
+			c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				called = true
+			}), test.opts...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(test.method, "/", nil)
+			if test.origin != "" {
+				req.Header.Set(Origin, test.origin)
+			}
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			assert.True(t, called)
+			assert.Equal(t, test.expectedAllowOrigin, rw.Header().Get(AccessControlAllowOrigin))
+			assert.Equal(t, test.expectedCredentials, rw.Header().Get(AccessControlAllowCredentials))
+			assert.Equal(t, test.expectedExposed, rw.Header().Get(AccessControlExposeHeaders))
+			if test.origin != "" {
+				assert.Equal(t, "Origin", rw.Header().Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	opts := []Option{
+		AllowedOrigins("https://example.com"),
+		AllowedMethods(http.MethodGet, http.MethodPut),
+		AllowedHeaders("Content-Type", "x-csrf-token"),
+		MaxAge(10 * time.Minute),
+	}
+
+	testCases := []struct {
+		desc            string
+		opts            []Option
+		origin          string
+		method          string
+		headers         string
+		expectedAllowed bool
+		expectedHeaders string
+	}{
+		{
+			desc:            "allowed",
+			opts:            opts,
+			origin:          "https://example.com",
+			method:          http.MethodPut,
+			headers:         "content-type, X-CSRF-Token",
+			expectedAllowed: true,
+			expectedHeaders: "Content-Type, X-Csrf-Token",
+		},
+		{
+			desc:   "origin not allowed",
+			opts:   opts,
+			origin: "https://evil.com",
+			method: http.MethodPut,
+		},
+		{
+			desc:   "method not allowed",
+			opts:   opts,
+			origin: "https://example.com",
+			method: http.MethodDelete,
+		},
+		{
+			desc:    "header not allowed",
+			opts:    opts,
+			origin:  "https://example.com",
+			method:  http.MethodPut,
+			headers: "X-Other",
+		},
+		{
+			desc:            "any header",
+			opts:            []Option{AllowedOrigins("*"), AllowedHeaders("*")},
+			origin:          "https://example.com",
+			method:          http.MethodGet,
+			headers:         "x-other, x-another",
+			expectedAllowed: true,
+			expectedHeaders: "X-Other, X-Another",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var called bool
+			c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				called = true
+			}), test.opts...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodOptions, "/", nil)
+			req.Header.Set(Origin, test.origin)
+			req.Header.Set(AccessControlRequestMethod, test.method)
+			if test.headers != "" {
+				req.Header.Set(AccessControlRequestHeaders, test.headers)
+			}
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			assert.False(t, called)
+			assert.Equal(t, http.StatusNoContent, rw.Code)
+			assert.Equal(t, []string{Origin, AccessControlRequestMethod, AccessControlRequestHeaders}, rw.Header()["Vary"])
+			if !test.expectedAllowed {
+				assert.Empty(t, rw.Header().Get(AccessControlAllowOrigin))
+				assert.Empty(t, rw.Header().Get(AccessControlAllowMethods))
+				return
+			}
+			assert.NotEmpty(t, rw.Header().Get(AccessControlAllowOrigin))
+			assert.NotEmpty(t, rw.Header().Get(AccessControlAllowMethods))
+			assert.Equal(t, test.expectedHeaders, rw.Header().Get(AccessControlAllowHeaders))
+		})
+	}
+}
+
+func TestCORSPreflightHeaders(t *testing.T) {
+	c, err := New(http.NotFoundHandler(),
+		AllowedOrigins("https://example.com"),
+		AllowedMethods("get", "put"),
+		AllowCredentials(true),
+		MaxAge(10*time.Minute),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set(Origin, "https://example.com")
+	req.Header.Set(AccessControlRequestMethod, http.MethodPut)
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	assert.Equal(t, "https://example.com", rw.Header().Get(AccessControlAllowOrigin))
+	assert.Equal(t, "GET, PUT", rw.Header().Get(AccessControlAllowMethods))
+	assert.Equal(t, "true", rw.Header().Get(AccessControlAllowCredentials))
+	assert.Equal(t, "600", rw.Header().Get(AccessControlMaxAge))
+	assert.Empty(t, rw.Header().Get(AccessControlAllowHeaders))
+}
+
+func TestCORSPassthroughPreflight(t *testing.T) {
+	c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), AllowedOrigins("*"), PassthroughPreflight(true))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set(Origin, "https://example.com")
+	req.Header.Set(AccessControlRequestMethod, http.MethodGet)
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "*", rw.Header().Get(AccessControlAllowOrigin))
+}
+
+func TestCORSInvalidOptions(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), AllowedOriginPatterns("("))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), MaxAge(-time.Second))
+	assert.Error(t, err)
+}
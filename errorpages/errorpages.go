@@ -0,0 +1,382 @@
+/*
+Package errorpages provides a middleware replacing the body of the error responses by custom pages.
+
+The pages are either fetched from an error backend or rendered from a local html/template. The status code of the
+response is kept unless it is overridden.
+
+Examples of an error pages middleware:
+
+	// the 5xx responses are replaced by the page of the error backend, e.g. http://errors.local/503.html
+	ep, err := errorpages.New(handler, errorpages.Backend("500-599", "http://errors.local/{status}.html"))
+
+	// the 404 and 410 responses are replaced by a local page, and sent as 404
+	ep, err := errorpages.New(handler,
+		errorpages.Template("404,410", "<h1>{{.StatusCode}} {{.StatusText}}</h1><p>{{.Path}} was not found</p>"),
+		errorpages.StatusCode("410", http.StatusNotFound),
+	)
+*/
+package errorpages
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/requestid"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultTimeout is the timeout of the default client fetching the pages from the error backends
+const DefaultTimeout = 10 * time.Second
+
+// statusPlaceholder is replaced by the status code in the URLs of the error backends
+const statusPlaceholder = "{status}"
+
+// contentHeaders describe the body of the upstream response and are removed when the body is replaced
+var contentHeaders = []string{
+	"Content-Length",
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Range",
+	"Content-Disposition",
+	"Etag",
+	"Last-Modified",
+}
+
+// PageData is the data the templates are rendered with
+type PageData struct {
+	StatusCode int
+	StatusText string
+	Method     string
+	Host       string
+	Path       string
+	RequestID  string
+}
+
+type statusRange struct {
+	low, high int
+}
+
+type statusRanges []statusRange
+
+// parseStatusRanges parses comma separated status codes and ranges, e.g. "404,500-599"
+func parseStatusRanges(s string) (statusRanges, error) {
+	var ranges statusRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid status range %q", part)
+			}
+		}
+		if low < 100 || high > 599 || low > high {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+		ranges = append(ranges, statusRange{low: low, high: high})
+	}
+	return ranges, nil
+}
+
+func (r statusRanges) contains(code int) bool {
+	for _, sr := range r {
+		if code >= sr.low && code <= sr.high {
+			return true
+		}
+	}
+	return false
+}
+
+type page struct {
+	status   statusRanges
+	url      string
+	template *template.Template
+}
+
+type override struct {
+	status statusRanges
+	code   int
+}
+
+// ErrorPages is a middleware replacing error responses by custom pages
+type ErrorPages struct {
+	next      http.Handler
+	pages     []page
+	overrides []override
+	client    *http.Client
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for ErrorPages
+type Option func(ep *ErrorPages) error
+
+// New creates a new ErrorPages middleware
+func New(next http.Handler, opts ...Option) (*ErrorPages, error) {
+	ep := &ErrorPages{
+		next:   next,
+		client: &http.Client{Timeout: DefaultTimeout},
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(ep); err != nil {
+			return nil, err
+		}
+	}
+	return ep, nil
+}
+
+// Backend replaces the body of the responses with a status in the ranges, e.g. "404,500-599", by the page fetched
+// from the error backend. {status} in the URL is replaced by the status code.
+// The first page matching the status is used.
+func Backend(status, pageURL string) Option {
+	return func(ep *ErrorPages) error {
+		ranges, err := parseStatusRanges(status)
+		if err != nil {
+			return err
+		}
+		u, err := url.Parse(strings.Replace(pageURL, statusPlaceholder, "500", -1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid error backend URL %q", pageURL)
+		}
+		ep.pages = append(ep.pages, page{status: ranges, url: pageURL})
+		return nil
+	}
+}
+
+// Template replaces the body of the responses with a status in the ranges, e.g. "404,500-599", by the html/template
+// rendered with PageData. The first page matching the status is used.
+func Template(status, text string) Option {
+	return func(ep *ErrorPages) error {
+		ranges, err := parseStatusRanges(status)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New("errorpage").Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid error page template: %v", err)
+		}
+		ep.pages = append(ep.pages, page{status: ranges, template: tmpl})
+		return nil
+	}
+}
+
+// StatusCode overrides the status code of the replaced responses with a status in the ranges
+func StatusCode(status string, code int) Option {
+	return func(ep *ErrorPages) error {
+		ranges, err := parseStatusRanges(status)
+		if err != nil {
+			return err
+		}
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+		ep.overrides = append(ep.overrides, override{status: ranges, code: code})
+		return nil
+	}
+}
+
+// Client sets the HTTP client fetching the pages from the error backends
+func Client(c *http.Client) Option {
+	return func(ep *ErrorPages) error {
+		if c == nil {
+			return fmt.Errorf("client can not be nil")
+		}
+		ep.client = c
+		return nil
+	}
+}
+
+// Logger defines the logger the error pages middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(ep *ErrorPages) error {
+		ep.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by error pages handler.
+func (ep *ErrorPages) Wrap(next http.Handler) error {
+	ep.next = next
+	return nil
+}
+
+func (ep *ErrorPages) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if ep.log.Level >= log.DebugLevel {
+		logEntry := ep.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/errorpages: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/errorpages: completed ServeHttp on request")
+	}
+
+	pw := &pageWriter{ResponseWriter: w, errorPages: ep}
+	ep.next.ServeHTTP(pw, req)
+	if pw.page != nil {
+		ep.servePage(w, req, pw.page, pw.code)
+	}
+}
+
+// pageFor returns the page replacing the responses with the status code
+func (ep *ErrorPages) pageFor(code int) *page {
+	for i := range ep.pages {
+		if ep.pages[i].status.contains(code) {
+			return &ep.pages[i]
+		}
+	}
+	return nil
+}
+
+func (ep *ErrorPages) statusCode(code int) int {
+	for _, o := range ep.overrides {
+		if o.status.contains(code) {
+			return o.code
+		}
+	}
+	return code
+}
+
+// servePage writes the page replacing the body of the upstream response
+func (ep *ErrorPages) servePage(w http.ResponseWriter, req *http.Request, p *page, code int) {
+	body, contentType, err := ep.render(req, p, code)
+	if err != nil {
+		ep.log.Errorf("vulcand/oxy/errorpages: failed to get the error page for %d, err: %v", code, err)
+		body, contentType = []byte(http.StatusText(code)), "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(ep.statusCode(code))
+	if req.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func (ep *ErrorPages) render(req *http.Request, p *page, code int) ([]byte, string, error) {
+	if p.template == nil {
+		return ep.fetch(req, p, code)
+	}
+	data := PageData{
+		StatusCode: code,
+		StatusText: http.StatusText(code),
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+	}
+	data.RequestID, _ = requestid.FromContext(req.Context())
+
+	var buf bytes.Buffer
+	if err := p.template.Execute(&buf, data); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "text/html; charset=utf-8", nil
+}
+
+// fetch gets the page from the error backend
+func (ep *ErrorPages) fetch(req *http.Request, p *page, code int) ([]byte, string, error) {
+	pageReq, err := http.NewRequest(http.MethodGet, strings.Replace(p.url, statusPlaceholder, strconv.Itoa(code), -1), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	pageReq = pageReq.WithContext(req.Context())
+	for _, h := range []string{"Accept", "Accept-Language"} {
+		if v := req.Header.Get(h); v != "" {
+			pageReq.Header.Set(h, v)
+		}
+	}
+	if id, ok := requestid.FromContext(req.Context()); ok {
+		pageReq.Header.Set(requestid.DefaultHeader, id)
+	}
+
+	resp, err := ep.client.Do(pageReq)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error backend replied %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return body, contentType, nil
+}
+
+// pageWriter discards the upstream responses replaced by a page
+type pageWriter struct {
+	http.ResponseWriter
+	errorPages  *ErrorPages
+	wroteHeader bool
+	page        *page
+	code        int
+}
+
+func (pw *pageWriter) WriteHeader(code int) {
+	if pw.wroteHeader {
+		return
+	}
+	pw.wroteHeader = true
+	if p := pw.errorPages.pageFor(code); p != nil {
+		pw.page, pw.code = p, code
+		utils.RemoveHeaders(pw.Header(), contentHeaders...)
+		return
+	}
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *pageWriter) Write(p []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if pw.page != nil {
+		return len(p), nil
+	}
+	return pw.ResponseWriter.Write(p)
+}
+
+func (pw *pageWriter) Flush() {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if pw.page != nil {
+		return
+	}
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection
+func (pw *pageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := pw.ResponseWriter.(http.Hijacker); ok {
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this error pages middleware does not implement http.Hijacker(type: %T)", pw.ResponseWriter)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (pw *pageWriter) CloseNotify() <-chan bool {
+	if cn, ok := pw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
@@ -0,0 +1,123 @@
+package errorpages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/requestid"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestErrorPagesTemplate(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		status       int
+		expectedCode int
+		expectedBody string
+	}{
+		{desc: "replaced", status: http.StatusNotFound, expectedCode: http.StatusNotFound, expectedBody: "<h1>404 Not Found</h1><p>/a&lt;b&gt;</p>"},
+		{desc: "overridden status", status: http.StatusGone, expectedCode: http.StatusNotFound, expectedBody: "<h1>410 Gone</h1><p>/a&lt;b&gt;</p>"},
+		{desc: "not matching", status: http.StatusInternalServerError, expectedCode: http.StatusInternalServerError, expectedBody: "upstream"},
+		{desc: "success", status: http.StatusOK, expectedCode: http.StatusOK, expectedBody: "upstream"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("X-Upstream", "yes")
+				w.WriteHeader(test.status)
+				w.Write([]byte("upstream"))
+			})
+			ep, err := New(next,
+				Template("404,410", "<h1>{{.StatusCode}} {{.StatusText}}</h1><p>{{.Path}}</p>"),
+				StatusCode("410", http.StatusNotFound),
+			)
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			ep.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a%3Cb%3E", nil))
+			assert.Equal(t, test.expectedCode, rec.Code)
+			assert.Equal(t, test.expectedBody, rec.Body.String())
+			assert.Equal(t, "yes", rec.Header().Get("X-Upstream"))
+		})
+	}
+}
+
+func TestErrorPagesBackend(t *testing.T) {
+	errorBackend := testutils.NewRecorder(testutils.ScriptedResponse{
+		Header: http.Header{"Content-Type": {"text/html"}},
+		Body:   "<h1>oops</h1>",
+	})
+	defer errorBackend.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("error"))
+	})
+	rid, err := requestid.New(nil, requestid.IDGenerator(func() (string, error) { return "id-1", nil }))
+	require.NoError(t, err)
+	ep, err := New(next, Backend("500-599", errorBackend.URL+"/{status}.html"))
+	require.NoError(t, err)
+	require.NoError(t, rid.Wrap(ep))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "fr")
+	rec := httptest.NewRecorder()
+	rid.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "<h1>oops</h1>", rec.Body.String())
+	assert.Equal(t, "text/html", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "13", rec.Header().Get("Content-Length"))
+
+	errorBackend.AssertCount(t, 1)
+	last := errorBackend.Last()
+	assert.Equal(t, "/503.html", last.RequestURI)
+	last.AssertHeader(t, "Accept-Language", "fr")
+	last.AssertHeader(t, requestid.DefaultHeader, "id-1")
+}
+
+func TestErrorPagesBackendFailure(t *testing.T) {
+	errorBackend := testutils.NewRecorder(testutils.ScriptedResponse{StatusCode: http.StatusNotFound})
+	defer errorBackend.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream"))
+	})
+	ep, err := New(next, Backend("502", errorBackend.URL))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	ep.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, http.StatusText(http.StatusBadGateway), rec.Body.String())
+}
+
+func TestErrorPagesInvalidOptions(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opt  Option
+	}{
+		{desc: "range", opt: Template("599-500", "")},
+		{desc: "status", opt: Template("abc", "")},
+		{desc: "template", opt: Template("404", "{{")},
+		{desc: "backend URL", opt: Backend("404", "errors.local/404")},
+		{desc: "status code", opt: StatusCode("404", 1000)},
+		{desc: "client", opt: Client(nil)},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(http.NotFoundHandler(), test.opt)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Package events provides a bus the middlewares publish their lifecycle events to: server down, circuit breaker
+tripped, request rate limited, retry performed, request failed... so that a single subscriber drives the alerting
+and the audit logs.
+
+The middlewares publish to an Emitter set with their Events option. The events are typed, a subscriber switches on
+their concrete type to read their fields. The subscribers are called synchronously, in the goroutine publishing the
+event, possibly while the middleware holds a lock: they must be fast and must not call back into the middlewares,
+e.g. they push the events to a channel.
+
+Examples of an event bus:
+
+	bus := events.NewBus()
+	bus.Subscribe(func(m events.Message) {
+		switch e := m.Event.(type) {
+		case events.BreakerStateChanged:
+			alert("%s: circuit breaker %s", m.Source, e.To)
+		case events.RequestFailed:
+			audit.Printf("%s: %s %s failed: %v", m.Source, e.Request.Method, e.Request.URL, e.Err)
+		}
+	}, events.BreakerTripped, events.RequestFailure)
+
+	cb, err := cbreaker.New(lb, "NetworkErrorRatio() > 0.5", cbreaker.Events(bus.Source("backends")))
+	fwd, err := forward.New(forward.Events(bus.Source("forwarder")))
+*/
+package events
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// Type is the type of an event
+type Type string
+
+// Types of the events published by the middlewares
+const (
+	ServerDown        Type = "server.down"
+	ServerUp          Type = "server.up"
+	BreakerTripped    Type = "breaker.tripped"
+	BreakerRecovering Type = "breaker.recovering"
+	BreakerStandby    Type = "breaker.standby"
+	RateLimit         Type = "ratelimit.limited"
+	Retry             Type = "retry.performed"
+	RequestFailure    Type = "request.failed"
+	AffinityLost      Type = "affinity.lost"
+)
+
+// Event is an event published by a middleware
+type Event interface {
+	Type() Type
+}
+
+// ServerStateChanged is published when a load balancer detects that a server is failing, or is healthy again
+type ServerStateChanged struct {
+	URL *url.URL
+	// Down is true when the server is failing
+	Down bool
+}
+
+// Type returns ServerDown or ServerUp
+func (e ServerStateChanged) Type() Type {
+	if e.Down {
+		return ServerDown
+	}
+	return ServerUp
+}
+
+// BreakerStateChanged is published on the transitions of a circuit breaker
+type BreakerStateChanged struct {
+	// From and To are the states of the transition: standby, tripped or recovering
+	From, To string
+	// Until is the end of the tripped or recovering state
+	Until time.Time
+}
+
+// Type returns BreakerTripped, BreakerRecovering or BreakerStandby
+func (e BreakerStateChanged) Type() Type {
+	switch e.To {
+	case "tripped":
+		return BreakerTripped
+	case "recovering":
+		return BreakerRecovering
+	}
+	return BreakerStandby
+}
+
+// RateLimited is published when a request is rejected by a rate limiter
+type RateLimited struct {
+	Request *http.Request
+	// Source is the source of the request, e.g. the client IP
+	Source string
+	Err    error
+}
+
+// Type returns RateLimit
+func (e RateLimited) Type() Type {
+	return RateLimit
+}
+
+// RetryPerformed is published when a request is retried
+type RetryPerformed struct {
+	Request *http.Request
+	// Attempt is the number of the attempt about to be made, starting at 2
+	Attempt int
+	// Code is the response status code of the previous attempt
+	Code int
+}
+
+// Type returns Retry
+func (e RetryPerformed) Type() Type {
+	return Retry
+}
+
+// RequestFailed is published when a request can not be forwarded, e.g. on a network error
+type RequestFailed struct {
+	Request *http.Request
+	Err     error
+}
+
+// Type returns RequestFailure
+func (e RequestFailed) Type() Type {
+	return RequestFailure
+}
+
+// AffinityBroken is published when the sticky session cookie of a request points to a server no longer in the
+// load balancer, e.g. during a deploy
+type AffinityBroken struct {
+	Request *http.Request
+	// URL is the server of the cookie
+	URL *url.URL
+}
+
+// Type returns AffinityLost
+func (e AffinityBroken) Type() Type {
+	return AffinityLost
+}
+
+// Emitter publishes the events of the middlewares
+type Emitter interface {
+	Emit(e Event)
+}
+
+// Message is an event delivered to the subscribers
+type Message struct {
+	// Source is the name of the emitter, see Bus.Source
+	Source string
+	Time   time.Time
+	Event  Event
+}
+
+// Subscriber handles the events of a bus
+type Subscriber func(m Message)
+
+type subscription struct {
+	subscriber Subscriber
+	types      map[Type]bool
+}
+
+// Bus delivers the events published by the middlewares to its subscribers
+type Bus struct {
+	clock utils.Clock
+
+	mutex         sync.RWMutex
+	subscriptions map[int]*subscription
+	nextID        int
+}
+
+// BusOption is a functional option setter for Bus
+type BusOption func(b *Bus)
+
+// Clock sets the clock timestamping the messages, it defaults to utils.DefaultClock
+func Clock(clock utils.Clock) BusOption {
+	return func(b *Bus) {
+		b.clock = clock
+	}
+}
+
+// NewBus creates a new event bus
+func NewBus(opts ...BusOption) *Bus {
+	b := &Bus{
+		clock:         utils.InheritedClock(),
+		subscriptions: make(map[int]*subscription),
+	}
+	for _, o := range opts {
+		o(b)
+	}
+	return b
+}
+
+// Subscribe registers a subscriber to the events of the types, or to all the events when no type is given.
+// It returns a function canceling the subscription.
+func (b *Bus) Subscribe(s Subscriber, types ...Type) func() {
+	sub := &subscription{subscriber: s}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subscriptions[id] = sub
+
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscriptions, id)
+	}
+}
+
+// Emit publishes an event without source
+func (b *Bus) Emit(e Event) {
+	b.publish("", e)
+}
+
+// Source returns an emitter publishing the events of a middleware with its name
+func (b *Bus) Source(name string) Emitter {
+	return &source{bus: b, name: name}
+}
+
+func (b *Bus) publish(name string, e Event) {
+	t := e.Type()
+	var subscribers []Subscriber
+	b.mutex.RLock()
+	for _, sub := range b.subscriptions {
+		if sub.types == nil || sub.types[t] {
+			subscribers = append(subscribers, sub.subscriber)
+		}
+	}
+	b.mutex.RUnlock()
+	if len(subscribers) == 0 {
+		return
+	}
+
+	// the subscribers are called without the lock, they may subscribe or cancel their subscription
+	m := Message{Source: name, Time: b.clock.UtcNow(), Event: e}
+	for _, s := range subscribers {
+		s(m)
+	}
+}
+
+type source struct {
+	bus  *Bus
+	name string
+}
+
+func (s *source) Emit(e Event) {
+	s.bus.publish(s.name, e)
+}
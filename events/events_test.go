@@ -0,0 +1,76 @@
+package events
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestBus(t *testing.T) {
+	clock := testutils.GetClock()
+	bus := NewBus(Clock(clock))
+
+	var all, breakers []Message
+	bus.Subscribe(func(m Message) { all = append(all, m) })
+	cancel := bus.Subscribe(func(m Message) { breakers = append(breakers, m) }, BreakerTripped, BreakerStandby)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	failure := RequestFailed{Request: req, Err: errors.New("connection refused")}
+	tripped := BreakerStateChanged{From: "standby", To: "tripped", Until: clock.UtcNow().Add(10 * time.Second)}
+
+	bus.Source("forwarder").Emit(failure)
+	bus.Source("api").Emit(tripped)
+	cancel()
+	bus.Emit(BreakerStateChanged{From: "recovering", To: "standby"})
+
+	assert.Equal(t, []Message{
+		{Source: "forwarder", Time: clock.UtcNow(), Event: failure},
+		{Source: "api", Time: clock.UtcNow(), Event: tripped},
+		{Time: clock.UtcNow(), Event: BreakerStateChanged{From: "recovering", To: "standby"}},
+	}, all)
+	assert.Equal(t, []Message{{Source: "api", Time: clock.UtcNow(), Event: tripped}}, breakers)
+}
+
+func TestTypes(t *testing.T) {
+	testCases := []struct {
+		event    Event
+		expected Type
+	}{
+		{event: ServerStateChanged{Down: true}, expected: ServerDown},
+		{event: ServerStateChanged{}, expected: ServerUp},
+		{event: BreakerStateChanged{To: "tripped"}, expected: BreakerTripped},
+		{event: BreakerStateChanged{To: "recovering"}, expected: BreakerRecovering},
+		{event: BreakerStateChanged{To: "standby"}, expected: BreakerStandby},
+		{event: RateLimited{}, expected: RateLimit},
+		{event: RetryPerformed{}, expected: Retry},
+		{event: RequestFailed{}, expected: RequestFailure},
+		{event: AffinityBroken{}, expected: AffinityLost},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(string(test.expected), func(t *testing.T) {
+			assert.Equal(t, test.expected, test.event.Type())
+		})
+	}
+}
+
+func TestSubscribeFromSubscriber(t *testing.T) {
+	bus := NewBus()
+
+	var received int
+	var cancel func()
+	cancel = bus.Subscribe(func(m Message) {
+		received++
+		cancel()
+		bus.Subscribe(func(m Message) { received += 10 })
+	})
+
+	bus.Emit(RetryPerformed{Attempt: 2})
+	bus.Emit(RetryPerformed{Attempt: 3})
+	assert.Equal(t, 11, received)
+}
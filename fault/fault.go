@@ -0,0 +1,282 @@
+/*
+Package fault provides a middleware injecting faults in the requests, to validate the resilience of the systems
+behind and in front of the proxy.
+
+Latency, aborted connections and error responses are injected in a percentage of the matching requests,
+or in the requests asking for them with the trigger header. The latency is injected first, then the connection is
+aborted, or the error response is sent, instead of calling the next handler.
+
+Examples of a fault injection:
+
+	// 10% of the requests are delayed by 200ms, 1% get a 503 response
+	f, err := fault.New(handler, fault.Delay(200*time.Millisecond, 10), fault.Status(http.StatusServiceUnavailable, 1))
+
+	// the faults are requested by the clients, e.g. X-Fault: delay=1s, status=500
+	f, err := fault.New(handler, fault.TriggerHeader("X-Fault"))
+*/
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Fault is a middleware injecting faults in the requests
+type Fault struct {
+	next          http.Handler
+	match         func(req *http.Request) bool
+	delay         time.Duration
+	delayPercent  float64
+	abortPercent  float64
+	status        int
+	statusPercent float64
+	triggerHeader string
+
+	mutex  sync.Mutex
+	random func() float64
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Fault
+type Option func(f *Fault) error
+
+// New creates a new Fault middleware, no fault is injected by default
+func New(next http.Handler, opts ...Option) (*Fault, error) {
+	f := &Fault{
+		next:   next,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())).Float64,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(f); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func validatePercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("percentage should be between 0 and 100, got %v", percent)
+	}
+	return nil
+}
+
+// Delay delays the percentage of the matching requests by d
+func Delay(d time.Duration, percent float64) Option {
+	return func(f *Fault) error {
+		if d <= 0 {
+			return fmt.Errorf("delay should be > 0, got %v", d)
+		}
+		if err := validatePercent(percent); err != nil {
+			return err
+		}
+		f.delay, f.delayPercent = d, percent
+		return nil
+	}
+}
+
+// Abort closes the client connection of the percentage of the matching requests, without response
+func Abort(percent float64) Option {
+	return func(f *Fault) error {
+		if err := validatePercent(percent); err != nil {
+			return err
+		}
+		f.abortPercent = percent
+		return nil
+	}
+}
+
+// Status replies with the status code to the percentage of the matching requests
+func Status(code int, percent float64) Option {
+	return func(f *Fault) error {
+		if code < 100 || code > 999 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+		if err := validatePercent(percent); err != nil {
+			return err
+		}
+		f.status, f.statusPercent = code, percent
+		return nil
+	}
+}
+
+// Match restricts the percentage based faults to the requests matching the predicate, all the requests match by default
+func Match(match func(req *http.Request) bool) Option {
+	return func(f *Fault) error {
+		if match == nil {
+			return errors.New("predicate can not be nil")
+		}
+		f.match = match
+		return nil
+	}
+}
+
+// TriggerHeader injects the faults listed in the header of the requests, e.g. "delay=200ms, abort" or "status=503".
+// The header is removed before the request is passed to the next handler. Only enable it when the clients are trusted.
+func TriggerHeader(name string) Option {
+	return func(f *Fault) error {
+		if name == "" {
+			return errors.New("trigger header can not be empty")
+		}
+		f.triggerHeader = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// Random sets the source of the random numbers in [0, 1) drawing the requests to inject faults in
+func Random(random func() float64) Option {
+	return func(f *Fault) error {
+		if random == nil {
+			return errors.New("random source can not be nil")
+		}
+		f.random = random
+		return nil
+	}
+}
+
+// Logger defines the logger the fault injection will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(f *Fault) error {
+		f.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by fault injection handler.
+func (f *Fault) Wrap(next http.Handler) error {
+	f.next = next
+	return nil
+}
+
+// faults are the faults injected in a request
+type faults struct {
+	delay  time.Duration
+	abort  bool
+	status int
+}
+
+func (f *Fault) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.log.Level >= log.DebugLevel {
+		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/fault: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/fault: completed ServeHttp on request")
+	}
+
+	inject, err := f.faultsOf(req)
+	if err != nil {
+		f.log.Debugf("vulcand/oxy/fault: ignoring the faults requested by %v: %v", req.RemoteAddr, err)
+	}
+	if f.triggerHeader != "" {
+		req.Header.Del(f.triggerHeader)
+	}
+
+	if inject.delay > 0 {
+		f.log.Debugf("vulcand/oxy/fault: delaying %v by %v", req.RemoteAddr, inject.delay)
+		timer := time.NewTimer(inject.delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+	if inject.abort {
+		f.log.Debugf("vulcand/oxy/fault: aborting the connection of %v", req.RemoteAddr)
+		abort(w)
+		return
+	}
+	if inject.status != 0 {
+		f.log.Debugf("vulcand/oxy/fault: replying %d to %v", inject.status, req.RemoteAddr)
+		http.Error(w, http.StatusText(inject.status), inject.status)
+		return
+	}
+	f.next.ServeHTTP(w, req)
+}
+
+// faultsOf draws the faults of the request, the faults of the trigger header take precedence
+func (f *Fault) faultsOf(req *http.Request) (faults, error) {
+	if f.triggerHeader != "" {
+		if header := req.Header.Get(f.triggerHeader); header != "" {
+			return parseFaults(header)
+		}
+	}
+	var inject faults
+	if f.match != nil && !f.match(req) {
+		return inject, nil
+	}
+	if f.draw(f.delayPercent) {
+		inject.delay = f.delay
+	}
+	if f.draw(f.abortPercent) {
+		inject.abort = true
+	} else if f.draw(f.statusPercent) {
+		inject.status = f.status
+	}
+	return inject, nil
+}
+
+func (f *Fault) draw(percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.random()*100 < percent
+}
+
+func parseFaults(header string) (faults, error) {
+	var inject faults
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "delay":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return faults{}, fmt.Errorf("invalid delay %q", value)
+			}
+			inject.delay = d
+		case "abort":
+			inject.abort = true
+		case "status":
+			code, err := strconv.Atoi(value)
+			if err != nil || code < 100 || code > 999 {
+				return faults{}, fmt.Errorf("invalid status %q", value)
+			}
+			inject.status = code
+		case "":
+		default:
+			return faults{}, fmt.Errorf("unknown fault %q", name)
+		}
+	}
+	return inject, nil
+}
+
+// abort closes the client connection without response
+func abort(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	// the connection can not be hijacked, e.g. HTTP/2, the server resets the stream
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,100 @@
+package fault
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// sequence returns the values in turn, as random numbers
+func sequence(values ...float64) func() float64 {
+	i := 0
+	return func() float64 {
+		v := values[i%len(values)]
+		i++
+		return v
+	}
+}
+
+func TestFaultPercentage(t *testing.T) {
+	var served int
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served++
+	})
+	// the status is drawn once per request, 2 requests out of 4 are below 50%
+	f, err := New(next, Status(http.StatusServiceUnavailable, 50), Random(sequence(0.1, 0.7, 0.4, 0.9)))
+	require.NoError(t, err)
+
+	var codes []int
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes = append(codes, rec.Code)
+	}
+	assert.Equal(t, []int{503, 200, 503, 200}, codes)
+	assert.Equal(t, 2, served)
+}
+
+func TestFaultMatch(t *testing.T) {
+	f, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		Status(http.StatusInternalServerError, 100),
+		Match(func(req *http.Request) bool { return req.URL.Path == "/orders" }))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/orders", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	rec = httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestFaultTriggerHeader(t *testing.T) {
+	var header string
+	f, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header.Get("X-Fault")
+	}), TriggerHeader("X-Fault"))
+	require.NoError(t, err)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	start := time.Now()
+	re, _, err := testutils.Get(srv.URL, testutils.Header("X-Fault", "delay=50ms, status=502"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	_, _, err = testutils.Get(srv.URL, testutils.Header("X-Fault", "abort"))
+	assert.Error(t, err, "the connection is closed without response")
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("X-Fault", "explode"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode, "invalid faults are ignored")
+	assert.Empty(t, header, "the trigger header is not forwarded")
+}
+
+func TestFaultDelayCanceled(t *testing.T) {
+	f, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("the request should not be served")
+	}), Delay(time.Hour, 100))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Millisecond)
+	defer cancel()
+	f.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+}
+
+func TestFaultInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{Delay(0, 10), Delay(time.Second, 101), Abort(-1), Status(42, 10), Match(nil), TriggerHeader(""), Random(nil)} {
+		_, err := New(http.NotFoundHandler(), opt)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,166 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnStats are the stats of the upstream connection used by a request, they tell the requests waiting for a
+// connection of the pool from the slow upstream servers
+type ConnStats struct {
+	// Reused is true when the connection was taken from the idle connections of the transport
+	Reused bool
+	// IdleTime is the time the reused connection was idle
+	IdleTime time.Duration
+	// GetConn is the time to get the connection: the wait for a connection of the pool, or the DNS lookup,
+	// the connect and the TLS handshake of a new connection
+	GetConn time.Duration
+	// DNS, Connect and TLSHandshake are the times to open a new connection, they are zero for a reused connection
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// FirstByte is the time from the request written to the first byte of the response
+	FirstByte time.Duration
+	// RemoteAddr is the address of the upstream server
+	RemoteAddr net.Addr
+}
+
+// ConnStatsHook defines a hook called with the stats of the upstream connection of each request, once the response
+// headers are received or the round trip failed
+func ConnStatsHook(hook func(req *http.Request, stats ConnStats)) optSetter {
+	return func(f *Forwarder) error {
+		if hook == nil {
+			return fmt.Errorf("connection stats hook can not be nil")
+		}
+		f.httpForwarder.connStatsHook = hook
+		return nil
+	}
+}
+
+// ConnClosedHook defines a hook called when an upstream connection is closed, with its lifetime.
+//
+// The dialer of the *http.Transport round tripper is wrapped, a transport like http.DefaultTransport
+// is created when no round tripper is set.
+func ConnClosedHook(hook func(remoteAddr net.Addr, lifetime time.Duration)) optSetter {
+	return func(f *Forwarder) error {
+		if hook == nil {
+			return fmt.Errorf("connection closed hook can not be nil")
+		}
+		f.httpForwarder.connClosedHook = hook
+		return nil
+	}
+}
+
+// configureConnClosedHook wraps the dialer of the transport of the forwarder
+func (f *httpForwarder) configureConnClosedHook() error {
+	var t *http.Transport
+	switch rt := f.roundTripper.(type) {
+	case nil:
+		t = newProxyTransport(http.ProxyFromEnvironment)
+		f.roundTripper = t
+	case *http.Transport:
+		t = rt
+	default:
+		return fmt.Errorf("connection closed hook requires an *http.Transport round tripper, got %T", f.roundTripper)
+	}
+
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	hook := f.connClosedHook
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &hookedConn{Conn: conn, opened: time.Now(), hook: hook}, nil
+	}
+	return nil
+}
+
+type hookedConn struct {
+	net.Conn
+	opened time.Time
+	hook   func(remoteAddr net.Addr, lifetime time.Duration)
+	once   sync.Once
+}
+
+func (c *hookedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.hook(c.RemoteAddr(), time.Since(c.opened))
+	})
+	return err
+}
+
+// connStatsRoundTripper traces the connections of the round trips
+type connStatsRoundTripper struct {
+	http.RoundTripper
+	hook func(req *http.Request, stats ConnStats)
+}
+
+func (rt *connStatsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := &connTrace{}
+	res, err := rt.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace())))
+	rt.hook(req, t.get())
+	return res, err
+}
+
+// connTrace collects the stats of a round trip, the dial of a new connection may go on
+// in the background after the round trip got another connection
+type connTrace struct {
+	mutex                                            sync.Mutex
+	stats                                            ConnStats
+	getConn, dnsStart, connectStart, tlsStart, wrote time.Time
+}
+
+func (t *connTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { t.with(func() { t.getConn = time.Now() }) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.with(func() {
+				t.stats.GetConn = time.Since(t.getConn)
+				t.stats.Reused = info.Reused
+				t.stats.IdleTime = info.IdleTime
+				if info.Conn != nil {
+					t.stats.RemoteAddr = info.Conn.RemoteAddr()
+				}
+			})
+		},
+		DNSStart:          func(httptrace.DNSStartInfo) { t.with(func() { t.dnsStart = time.Now() }) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.with(func() { t.stats.DNS = time.Since(t.dnsStart) }) },
+		ConnectStart:      func(string, string) { t.with(func() { t.connectStart = time.Now() }) },
+		ConnectDone:       func(string, string, error) { t.with(func() { t.stats.Connect = time.Since(t.connectStart) }) },
+		TLSHandshakeStart: func() { t.with(func() { t.tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.with(func() { t.stats.TLSHandshake = time.Since(t.tlsStart) })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.with(func() { t.wrote = time.Now() }) },
+		GotFirstResponseByte: func() {
+			t.with(func() {
+				if !t.wrote.IsZero() {
+					t.stats.FirstByte = time.Since(t.wrote)
+				}
+			})
+		},
+	}
+}
+
+func (t *connTrace) with(f func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f()
+}
+
+func (t *connTrace) get() ConnStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stats
+}
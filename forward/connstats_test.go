@@ -0,0 +1,72 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestConnStatsHook(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var mutex sync.Mutex
+	var stats []ConnStats
+	var closed []net.Addr
+	transport := &http.Transport{}
+	f, err := New(
+		RoundTripper(transport),
+		ConnStatsHook(func(req *http.Request, s ConnStats) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			stats = append(stats, s)
+		}),
+		ConnClosedHook(func(remoteAddr net.Addr, lifetime time.Duration) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			closed = append(closed, remoteAddr)
+		}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	}
+	transport.CloseIdleConnections()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, stats, 2)
+	assert.False(t, stats[0].Reused)
+	assert.True(t, stats[1].Reused)
+	assert.Equal(t, time.Duration(0), stats[1].Connect)
+	assert.Equal(t, srv.Listener.Addr().String(), stats[0].RemoteAddr.String())
+	assert.Equal(t, []net.Addr{stats[0].RemoteAddr}, closed)
+}
+
+func TestConnClosedHookTransport(t *testing.T) {
+	_, err := New(
+		RoundTripper(testutils.StaticTransport{}),
+		ConnClosedHook(func(net.Addr, time.Duration) {}))
+	assert.Error(t, err)
+
+	f, err := New(ConnClosedHook(func(net.Addr, time.Duration) {}))
+	require.NoError(t, err)
+	assert.NotEqual(t, http.DefaultTransport, f.httpForwarder.revproxy.Transport.(ErrorHandlingRoundTripper).RoundTripper)
+}
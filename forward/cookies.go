@@ -0,0 +1,131 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CookieDomainRewrite rewrites the Domain attribute of the cookies set by the upstream servers from the internal
+// domain to the public one, e.g. from "backend.internal" to "example.com". The domains are case insensitive and match
+// with or without the leading dot. An empty to removes the attribute, the cookie is then scoped to the host of the
+// proxy. The rules are applied in order, the first matching one rewrites the cookie.
+func CookieDomainRewrite(from, to string) optSetter {
+	return func(f *Forwarder) error {
+		from = strings.TrimPrefix(from, ".")
+		if from == "" {
+			return fmt.Errorf("cookie domain to rewrite should not be empty")
+		}
+		r := f.httpForwarder.cookieRewrites()
+		r.domains = append(r.domains, cookieRewrite{from: strings.ToLower(from), to: to})
+		return nil
+	}
+}
+
+// CookiePathRewrite rewrites the prefix of the Path attribute of the cookies set by the upstream servers, e.g. from
+// "/api" to "/" for an upstream served under /. A prefix matches whole path segments, "/api" matches "/api" and
+// "/api/v1" but not "/apis". The rules are applied in order, the first matching one rewrites the cookie.
+func CookiePathRewrite(from, to string) optSetter {
+	return func(f *Forwarder) error {
+		if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+			return fmt.Errorf("cookie paths should start with /, got %q and %q", from, to)
+		}
+		r := f.httpForwarder.cookieRewrites()
+		r.paths = append(r.paths, cookieRewrite{from: from, to: to})
+		return nil
+	}
+}
+
+// cookieRewrites returns the cookie rewriter, created on the first option setting it
+func (f *httpForwarder) cookieRewrites() *cookieRewriter {
+	if f.cookies == nil {
+		f.cookies = &cookieRewriter{}
+	}
+	return f.cookies
+}
+
+type cookieRewrite struct {
+	from string
+	to   string
+}
+
+// cookieRewriter rewrites the Domain and Path attributes of the Set-Cookie headers, the other attributes are kept
+// as they are, including the ones unknown to net/http
+type cookieRewriter struct {
+	domains []cookieRewrite
+	paths   []cookieRewrite
+}
+
+func (r *cookieRewriter) apply(h http.Header) {
+	cookies := h[SetCookie]
+	for i, c := range cookies {
+		cookies[i] = r.rewrite(c)
+	}
+}
+
+// rewrite rewrites a Set-Cookie value, the name and value of the cookie come before the first ";"
+func (r *cookieRewriter) rewrite(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	changed := false
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		eq := strings.IndexByte(attr, '=')
+		if eq < 0 {
+			kept = append(kept, part)
+			continue
+		}
+		name, value := attr[:eq], strings.TrimSpace(attr[eq+1:])
+
+		switch {
+		case strings.EqualFold(name, "Domain"):
+			to, ok := r.rewriteDomain(value)
+			if !ok {
+				break
+			}
+			changed = true
+			if to != "" {
+				kept = append(kept, " "+name+"="+to)
+			}
+			continue
+		case strings.EqualFold(name, "Path"):
+			to, ok := r.rewritePath(value)
+			if !ok {
+				break
+			}
+			changed = true
+			kept = append(kept, " "+name+"="+to)
+			continue
+		}
+		kept = append(kept, part)
+	}
+	if !changed {
+		return cookie
+	}
+	return strings.Join(kept, ";")
+}
+
+func (r *cookieRewriter) rewriteDomain(domain string) (string, bool) {
+	d := strings.ToLower(strings.TrimPrefix(domain, "."))
+	for _, rw := range r.domains {
+		if d == rw.from {
+			return rw.to, true
+		}
+	}
+	return "", false
+}
+
+func (r *cookieRewriter) rewritePath(path string) (string, bool) {
+	for _, rw := range r.paths {
+		from := strings.TrimSuffix(rw.from, "/")
+		if path != rw.from && path != from && !strings.HasPrefix(path, from+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(path, from)
+		if strings.HasSuffix(rw.to, "/") || rest == "/" {
+			rest = strings.TrimPrefix(rest, "/")
+		}
+		return rw.to + rest, true
+	}
+	return "", false
+}
@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestCookieRewrite(t *testing.T) {
+	r := &cookieRewriter{
+		domains: []cookieRewrite{
+			{from: "backend.internal", to: "example.com"},
+			{from: "local.internal", to: ""},
+		},
+		paths: []cookieRewrite{
+			{from: "/api", to: "/"},
+			{from: "/", to: "/app"},
+		},
+	}
+
+	testCases := []struct {
+		cookie   string
+		expected string
+	}{
+		{cookie: "a=1", expected: "a=1"},
+		{cookie: "a=1; Domain=other.com; Secure", expected: "a=1; Domain=other.com; Secure"},
+		{cookie: "a=1; Domain=.Backend.Internal; HttpOnly", expected: "a=1; Domain=example.com; HttpOnly"},
+		{cookie: "a=1; domain=local.internal; path=/api/v1", expected: "a=1; path=/v1"},
+		{cookie: "a=1; Path=/api; Partitioned", expected: "a=1; Path=/; Partitioned"},
+		{cookie: "a=1; Path=/apis", expected: "a=1; Path=/app/apis"},
+		{cookie: "a=1; Path=/", expected: "a=1; Path=/app"},
+		{cookie: "a=b=c; Max-Age=10; Path=/x", expected: "a=b=c; Max-Age=10; Path=/app/x"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.cookie, func(t *testing.T) {
+			assert.Equal(t, test.expected, r.rewrite(test.cookie))
+		})
+	}
+}
+
+func TestCookieRewriteForwarded(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add(SetCookie, "session=1; Domain=backend.internal; Path=/internal/app; HttpOnly")
+		w.Header().Add(SetCookie, "theme=dark; Path=/")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(
+		CookieDomainRewrite(".backend.internal", "example.com"),
+		CookiePathRewrite("/internal/app", "/"),
+	)
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"session=1; Domain=example.com; Path=/; HttpOnly", "theme=dark; Path=/"}, re.Header[SetCookie])
+}
+
+func TestCookieRewriteInvalid(t *testing.T) {
+	_, err := New(CookieDomainRewrite("", "example.com"))
+	assert.Error(t, err)
+
+	_, err = New(CookiePathRewrite("api", "/"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,188 @@
+package forward
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Decoder decodes a content coding of the upstream responses.
+// gzip and deflate are provided, brotli ("br") by the compress/brotli package, other codings can be plugged in
+// by wrapping their respective libraries.
+type Decoder interface {
+	// Encoding returns the content coding, as found in the Content-Encoding header
+	Encoding() string
+	// NewReader returns a reader decoding r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// DecoderFunc adapts a function returning a decoding reader to the Decoder interface
+func DecoderFunc(encoding string, newReader func(r io.Reader) (io.ReadCloser, error)) Decoder {
+	return &funcDecoder{encoding: encoding, newReader: newReader}
+}
+
+type funcDecoder struct {
+	encoding  string
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+func (d *funcDecoder) Encoding() string {
+	return d.encoding
+}
+
+func (d *funcDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return d.newReader(r)
+}
+
+// GzipDecoder decodes gzip responses
+func GzipDecoder() Decoder {
+	return DecoderFunc("gzip", func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	})
+}
+
+// DeflateDecoder decodes deflate responses
+func DeflateDecoder() Decoder {
+	return DecoderFunc("deflate", func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	})
+}
+
+// Decompress makes the forwarder decode the upstream responses using a content coding the client does not accept.
+// Content-Encoding and Content-Length are removed from the decoded responses. The decoders default to gzip and
+// deflate: the responses with a coding without decoder, e.g. brotli unless the decoder of the compress/brotli package
+// is given, are passed as is, and the Accept-Encoding header of the requests is forwarded unchanged.
+func Decompress(decoders ...Decoder) optSetter {
+	return func(f *Forwarder) error {
+		if len(decoders) == 0 {
+			decoders = []Decoder{GzipDecoder(), DeflateDecoder()}
+		}
+		f.httpForwarder.decoders = make(map[string]Decoder, len(decoders))
+		for _, d := range decoders {
+			f.httpForwarder.decoders[strings.ToLower(d.Encoding())] = d
+		}
+		return nil
+	}
+}
+
+// ForceDecompress makes the forwarder decode the upstream responses even when the client accepts their content coding,
+// so that the ResponseModifier sees the plain body. It requires the Decompress option.
+func ForceDecompress(force bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.forceDecompress = force
+		return nil
+	}
+}
+
+// decompress replaces the body of the response by its decoded content when needed
+func (f *httpForwarder) decompress(resp *http.Response) error {
+	if len(f.decoders) == 0 || resp.Body == nil {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return nil
+	}
+
+	var codings []string
+	for _, value := range resp.Header[ContentEncoding] {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	if len(codings) == 0 {
+		return nil
+	}
+
+	var acceptEncoding string
+	if resp.Request != nil {
+		acceptEncoding = resp.Request.Header.Get(AcceptEncoding)
+	}
+	if !f.forceDecompress && acceptsAll(acceptEncoding, codings) {
+		return nil
+	}
+	for _, coding := range codings {
+		if _, ok := f.decoders[coding]; !ok {
+			// the response cannot be fully decoded, pass it as is
+			return nil
+		}
+	}
+
+	// codings are listed in the order they were applied
+	closers := []io.Closer{resp.Body}
+	var body io.Reader = resp.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		r, err := f.decoders[codings[i]].NewReader(body)
+		if err != nil {
+			closeAll(closers)
+			return err
+		}
+		closers = append(closers, r)
+		body = r
+	}
+
+	resp.Body = &decodedBody{Reader: body, closers: closers}
+	resp.Header.Del(ContentEncoding)
+	resp.Header.Del(ContentLength)
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the decoded representation is not byte for byte identical to the encoded one
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// acceptsAll tells whether the Accept-Encoding header accepts all the codings
+func acceptsAll(acceptEncoding string, codings []string) bool {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, quality := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(part[i+1:]), "q="), 64); err == nil {
+				quality = q
+			}
+		}
+		qualities[strings.ToLower(name)] = quality
+	}
+	for _, coding := range codings {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if !ok || q <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	return closeAll(b.closers)
+}
+
+func closeAll(closers []io.Closer) error {
+	var err error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if errClose := closers[i].Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
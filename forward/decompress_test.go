@@ -0,0 +1,198 @@
+package forward
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestDecompress(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		acceptEncoding   string
+		contentEncoding  string
+		force            bool
+		expectedEncoding string
+		expectedDecoded  bool
+	}{
+		{
+			desc:            "client does not accept gzip",
+			acceptEncoding:  "identity",
+			contentEncoding: "gzip",
+			expectedDecoded: true,
+		},
+		{
+			desc:            "client refuses gzip",
+			acceptEncoding:  "gzip;q=0, deflate",
+			contentEncoding: "gzip",
+			expectedDecoded: true,
+		},
+		{
+			desc:             "client accepts gzip",
+			acceptEncoding:   "gzip",
+			contentEncoding:  "gzip",
+			expectedEncoding: "gzip",
+		},
+		{
+			desc:             "client accepts all codings",
+			acceptEncoding:   "*",
+			contentEncoding:  "deflate",
+			expectedEncoding: "deflate",
+		},
+		{
+			desc:            "forced",
+			acceptEncoding:  "gzip",
+			contentEncoding: "gzip",
+			force:           true,
+			expectedDecoded: true,
+		},
+		{
+			desc:            "several codings",
+			acceptEncoding:  "gzip",
+			contentEncoding: "deflate, gzip",
+			expectedDecoded: true,
+		},
+		{
+			desc:             "unknown coding",
+			acceptEncoding:   "identity",
+			contentEncoding:  "br",
+			expectedEncoding: "br",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			encoded := encode(t, "hello", test.contentEncoding)
+			srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set(ContentEncoding, test.contentEncoding)
+				w.Header().Set(ContentLength, strconv.Itoa(len(encoded)))
+				w.Header().Set("ETag", `"v1"`)
+				w.Write(encoded)
+			})
+			defer srv.Close()
+
+			f, err := New(Decompress(), ForceDecompress(test.force))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, body, err := testutils.Get(proxy.URL, testutils.Header(AcceptEncoding, test.acceptEncoding))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, test.expectedEncoding, re.Header.Get(ContentEncoding))
+
+			if test.expectedDecoded {
+				assert.Equal(t, "hello", string(body))
+				assert.Equal(t, `W/"v1"`, re.Header.Get("ETag"))
+				assert.Empty(t, re.Header.Get(ContentLength))
+			} else {
+				assert.Equal(t, encoded, body)
+				assert.Equal(t, `"v1"`, re.Header.Get("ETag"))
+				assert.Equal(t, strconv.Itoa(len(encoded)), re.Header.Get(ContentLength))
+			}
+		})
+	}
+}
+
+func TestDecompressResponseModifier(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentEncoding, "x-custom")
+		w.Write(encode(t, "hello", "gzip"))
+	})
+	defer srv.Close()
+
+	// stands for a brotli library
+	custom := DecoderFunc("x-custom", func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	})
+
+	var seen string
+	f, err := New(
+		Decompress(custom),
+		ForceDecompress(true),
+		ResponseModifier(func(resp *http.Response) error {
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			seen = string(body)
+			resp.Body = ioutil.NopCloser(strings.NewReader(strings.ToUpper(seen)))
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header(AcceptEncoding, "x-custom"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Empty(t, re.Header.Get(ContentEncoding))
+	assert.Equal(t, "hello", seen)
+	assert.Equal(t, "HELLO", string(body))
+}
+
+func TestDecompressInvalidBody(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentEncoding, "gzip")
+		w.Write([]byte("not gzip"))
+	})
+	defer srv.Close()
+
+	f, err := New(Decompress())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Header(AcceptEncoding, "identity"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+}
+
+// encode applies the codings in the order they are listed
+func encode(t *testing.T, data, contentEncoding string) []byte {
+	out := []byte(data)
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch strings.TrimSpace(coding) {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+			require.NoError(t, err)
+			w = fw
+		default:
+			// unknown codings are left as is
+			continue
+		}
+		_, err := w.Write(out)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		out = buf.Bytes()
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// DirectCopy copies the bodies of the responses with a known length to the client with io.Copy once the reverse
+// proxy wrote the headers, instead of the read and write loop of net/http/httputil.ReverseProxy, when the
+// ResponseWriter implements io.ReaderFrom. The net/http ResponseWriter hands the body to the connection, that
+// sends it with sendfile(2) or splice(2) when the body is a file or a connection, e.g. from a custom round tripper,
+// and with a single copy otherwise.
+//
+// The responses without a Content-Length, with trailers, and the ones decompressed by the forwarder are copied by
+// the reverse proxy. The wrappers of oxy forward io.ReaderFrom, see utils.ProxyWriter.
+func DirectCopy() optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.directCopy = true
+		return nil
+	}
+}
+
+type detachedBodyKey struct{}
+
+// detachedBody is the body of a response taken from the reverse proxy, to be copied by the forwarder
+type detachedBody struct {
+	body io.ReadCloser
+}
+
+// detachable returns the request passed to the reverse proxy and the holder of the body of the response if it can
+// be copied directly to the writer, nil otherwise
+func (f *httpForwarder) detachable(w http.ResponseWriter, req *http.Request) (*http.Request, *detachedBody) {
+	if !f.directCopy || req.Method == http.MethodHead {
+		return req, nil
+	}
+	if _, ok := w.(io.ReaderFrom); !ok {
+		return req, nil
+	}
+	d := &detachedBody{}
+	return req.WithContext(context.WithValue(req.Context(), detachedBodyKey{}, d)), d
+}
+
+// detachBody takes the body of the response from the reverse proxy, that writes the headers only, it is the last
+// response modifier
+func detachBody(resp *http.Response) {
+	if resp.Request == nil || resp.ContentLength <= 0 || len(resp.Trailer) > 0 || resp.Header.Get("Trailer") != "" {
+		return
+	}
+	d, ok := resp.Request.Context().Value(detachedBodyKey{}).(*detachedBody)
+	if !ok {
+		return
+	}
+	d.body = resp.Body
+	resp.Body = http.NoBody
+	// the net/http ResponseWriter only hands the body to the connection when it is not chunked
+	if resp.Header.Get("Content-Length") == "" {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+}
+
+// copyTo copies the detached body to the writer, it aborts the response like the reverse proxy on failure
+func (d *detachedBody) copyTo(w http.ResponseWriter, req *http.Request, log OxyLogger) {
+	if d == nil || d.body == nil {
+		return
+	}
+	defer d.body.Close()
+
+	_, err := io.Copy(w, d.body)
+	if err == nil || err == context.Canceled {
+		return
+	}
+	log.Warnf("vulcand/oxy/forward/http: failed to copy the response body: %v", err)
+	// the server recovers http.ErrAbortHandler and closes the connection, the client gets a truncated body
+	if req.Context().Value(http.ServerContextKey) != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,228 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// readFromCounter counts the calls to the io.ReaderFrom of the net/http ResponseWriter
+type readFromCounter struct {
+	http.ResponseWriter
+	calls int32
+}
+
+func (w *readFromCounter) ReadFrom(r io.Reader) (int64, error) {
+	atomic.AddInt32(&w.calls, 1)
+	return w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+}
+
+func (w *readFromCounter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func TestDirectCopy(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/chunked":
+			w.Write(body[:10])
+			w.(http.Flusher).Flush()
+			w.Write(body[10:])
+		case "/trailer":
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write(body)
+			w.Header().Set("X-Checksum", "42")
+		default:
+			w.Header().Set("Content-Length", "100000")
+			w.Write(body)
+		}
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc       string
+		path       string
+		directCopy bool
+		readFrom   int32
+	}{
+		{desc: "content length", path: "/", directCopy: true, readFrom: 1},
+		{desc: "chunked", path: "/chunked", directCopy: true},
+		{desc: "trailer", path: "/trailer", directCopy: true},
+		{desc: "disabled", path: "/"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var opts []optSetter
+			if test.directCopy {
+				opts = append(opts, DirectCopy())
+			}
+			f, err := New(opts...)
+			require.NoError(t, err)
+
+			var calls int32
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL + test.path)
+				rw := &readFromCounter{ResponseWriter: w}
+				f.ServeHTTP(rw, req)
+				atomic.StoreInt32(&calls, atomic.LoadInt32(&rw.calls))
+			})
+			defer proxy.Close()
+
+			re, err := http.Get(proxy.URL + test.path)
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(re.Body)
+			re.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, body, got)
+			assert.Equal(t, test.readFrom, atomic.LoadInt32(&calls))
+			if test.path == "/trailer" {
+				assert.Equal(t, "42", re.Trailer.Get("X-Checksum"))
+			}
+		})
+	}
+}
+
+func TestDirectCopyHead(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(DirectCopy())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.MakeRequest(proxy.URL, testutils.Method(http.MethodHead))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.EqualValues(t, 5, re.ContentLength)
+}
+
+// fileTransport serves the requests from a file, its response bodies are *os.File
+type fileTransport struct {
+	path string
+}
+
+func (t fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          file,
+		ContentLength: info.Size(),
+		Request:       req,
+	}, nil
+}
+
+func newDownloadFile(t testing.TB, size int) string {
+	file, err := ioutil.TempFile("", "oxy-download")
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Write(bytes.Repeat([]byte("x"), size))
+	require.NoError(t, err)
+	return file.Name()
+}
+
+func TestDirectCopyFileBody(t *testing.T) {
+	path := newDownloadFile(t, 1<<20)
+	defer os.Remove(path)
+
+	f, err := New(RoundTripper(fileTransport{path: path}), DirectCopy())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost/file")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, 1<<20, len(body))
+}
+
+const downloadSize = 16 << 20
+
+func BenchmarkDownload(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), downloadSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "", testutils.GetClock().UtcNow(), bytes.NewReader(body))
+	}))
+	defer srv.Close()
+
+	path := newDownloadFile(b, downloadSize)
+	defer os.Remove(path)
+
+	benchmarks := []struct {
+		desc      string
+		transport http.RoundTripper
+		target    string
+	}{
+		{desc: "upstream", transport: http.DefaultTransport, target: srv.URL},
+		{desc: "file", transport: fileTransport{path: path}, target: "http://localhost/file"},
+	}
+
+	for _, bench := range benchmarks {
+		for _, directCopy := range []bool{false, true} {
+			name := bench.desc + "/reverse-proxy"
+			opts := []optSetter{RoundTripper(bench.transport)}
+			if directCopy {
+				name = bench.desc + "/direct-copy"
+				opts = append(opts, DirectCopy())
+			}
+			target := bench.target
+			b.Run(name, func(b *testing.B) {
+				f, err := New(opts...)
+				require.NoError(b, err)
+
+				proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					req.URL = testutils.ParseURI(target)
+					f.ServeHTTP(w, req)
+				}))
+				defer proxy.Close()
+
+				b.SetBytes(downloadSize)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					re, err := http.Get(proxy.URL)
+					require.NoError(b, err)
+					io.Copy(ioutil.Discard, re.Body)
+					re.Body.Close()
+				}
+			})
+		}
+	}
+}
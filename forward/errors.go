@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// upstreamTimeoutError is a timeout of the upstream server, it matches utils.ErrUpstreamTimeout and is still a
+// net.Error for the error handlers asserting it
+type upstreamTimeoutError struct {
+	err net.Error
+}
+
+func (e *upstreamTimeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamTimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *upstreamTimeoutError) Temporary() bool {
+	return e.err.Temporary()
+}
+
+// Is matches utils.ErrUpstreamTimeout
+func (e *upstreamTimeoutError) Is(target error) bool {
+	return target == utils.ErrUpstreamTimeout
+}
+
+// Unwrap returns the net.Error
+func (e *upstreamTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// timeoutErrors wraps the timeouts passed to the error handler in an upstreamTimeoutError, but those matching
+// utils.ErrUpstreamTimeout already
+func timeoutErrors(h utils.ErrorHandler) utils.ErrorHandler {
+	return utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		if e, ok := err.(net.Error); ok && e.Timeout() && !utils.IsError(err, utils.ErrUpstreamTimeout) {
+			err = &upstreamTimeoutError{err: e}
+		}
+		h.ServeHTTP(w, req, err)
+	})
+}
@@ -0,0 +1,24 @@
+package forward
+
+import (
+	"net/http"
+
+	"github.com/vulcand/oxy/events"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Events sets the emitter the forwarder publishes the requests failing to be forwarded to, as events.RequestFailed
+func Events(e events.Emitter) optSetter {
+	return func(f *Forwarder) error {
+		f.events = e
+		return nil
+	}
+}
+
+// failureEmitter publishes the errors passed to the error handler
+func failureEmitter(e events.Emitter, h utils.ErrorHandler) utils.ErrorHandler {
+	return utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		e.Emit(events.RequestFailed{Request: req, Err: err})
+		h.ServeHTTP(w, req, err)
+	})
+}
@@ -0,0 +1,42 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/events"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestEvents(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	down := srv.URL
+	srv.Close()
+
+	bus := events.NewBus()
+	var received []events.Message
+	bus.Subscribe(func(m events.Message) {
+		received = append(received, m)
+	})
+
+	f, err := New(Events(bus.Source("forwarder")))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL = testutils.ParseURI(down)
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+
+	require.Len(t, received, 1)
+	assert.Equal(t, "forwarder", received[0].Source)
+	failure, ok := received[0].Event.(events.RequestFailed)
+	require.True(t, ok)
+	assert.Error(t, failure.Err)
+	assert.Equal(t, testutils.ParseURI(down).Host, failure.Request.URL.Host)
+}
@@ -0,0 +1,126 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// prunedPrefix starts the X-Forwarded-For entry counting the pruned entries, an obfuscated identifier as of
+// RFC 7239 that the parsers do not take for an IP address
+const prunedPrefix = "_pruned-"
+
+// ForwardedForMaxEntries caps the number of entries of the X-Forwarded-For header forwarded upstream, the client IP
+// appended by the forwarder included: the earliest entries are dropped and the last n kept.
+//
+// When countPruned is true, the dropped entries are replaced with a single entry "_pruned-<count>" ahead of the
+// kept entries, and its count is carried over when a next proxy prunes the header again.
+func ForwardedForMaxEntries(n int, countPruned bool) optSetter {
+	return func(f *Forwarder) error {
+		if n < 1 {
+			return fmt.Errorf("max X-Forwarded-For entries should be >= 1, got %d", n)
+		}
+		ff := f.httpForwarder.forwardedForConfig()
+		ff.maxEntries = n
+		ff.countPruned = countPruned
+		return nil
+	}
+}
+
+// AnonymizeForwardedFor anonymizes the IP addresses of the X-Forwarded-For and X-Real-Ip headers forwarded upstream,
+// see utils.AnonymizeIP: the last octet of the IPv4 addresses and the last 64 bits of the IPv6 addresses are zeroed.
+func AnonymizeForwardedFor() optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.forwardedForConfig().anonymize = true
+		return nil
+	}
+}
+
+// forwardedFor rewrites the X-Forwarded-For header once the client IP is appended
+type forwardedFor struct {
+	maxEntries  int
+	countPruned bool
+	anonymize   bool
+}
+
+func (f *httpForwarder) forwardedForConfig() *forwardedFor {
+	if f.forwardedFor == nil {
+		f.forwardedFor = &forwardedFor{}
+	}
+	return f.forwardedFor
+}
+
+func (ff *forwardedFor) apply(h http.Header) {
+	if ff.anonymize {
+		if realIP := h.Get(XRealIp); realIP != "" {
+			h.Set(XRealIp, anonymizeEntry(realIP))
+		}
+	}
+
+	values, ok := h[XForwardedFor]
+	if !ok {
+		return
+	}
+	var entries []string
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if ff.maxEntries > 0 && len(entries) > ff.maxEntries {
+		pruned := entries[:len(entries)-ff.maxEntries]
+		entries = entries[len(entries)-ff.maxEntries:]
+		if ff.countPruned {
+			count := 0
+			for _, entry := range pruned {
+				count += prunedCount(entry)
+			}
+			entries = append([]string{prunedPrefix + strconv.Itoa(count)}, entries...)
+		}
+	}
+
+	if ff.anonymize {
+		for i, entry := range entries {
+			entries[i] = anonymizeEntry(entry)
+		}
+	}
+	h.Set(XForwardedFor, strings.Join(entries, ", "))
+}
+
+// prunedCount returns the number of entries an entry stands for
+func prunedCount(entry string) int {
+	if strings.HasPrefix(entry, prunedPrefix) {
+		if n, err := strconv.Atoi(entry[len(prunedPrefix):]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// anonymizeEntry anonymizes an IP address, the other values are kept as is
+func anonymizeEntry(entry string) string {
+	ip := net.ParseIP(ipv6fix(entry))
+	if ip == nil {
+		return entry
+	}
+	return utils.AnonymizeIP(ip).String()
+}
+
+// forwardedForRoundTripper rewrites the X-Forwarded-For header of the requests, http.ReverseProxy appends the client
+// IP after the request rewriters
+type forwardedForRoundTripper struct {
+	http.RoundTripper
+	forwardedFor *forwardedFor
+}
+
+func (rt *forwardedForRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.forwardedFor.apply(req.Header)
+	return rt.RoundTripper.RoundTrip(req)
+}
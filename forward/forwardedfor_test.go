@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestForwardedForApply(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		forwardedFor forwardedFor
+		header       http.Header
+		expected     string
+		realIP       string
+	}{
+		{
+			desc:         "within max entries",
+			forwardedFor: forwardedFor{maxEntries: 3},
+			header:       http.Header{XForwardedFor: {"1.1.1.1, 2.2.2.2"}},
+			expected:     "1.1.1.1, 2.2.2.2",
+		},
+		{
+			desc:         "prune the earliest entries",
+			forwardedFor: forwardedFor{maxEntries: 2},
+			header:       http.Header{XForwardedFor: {"1.1.1.1, 2.2.2.2", "3.3.3.3"}},
+			expected:     "2.2.2.2, 3.3.3.3",
+		},
+		{
+			desc:         "count the pruned entries",
+			forwardedFor: forwardedFor{maxEntries: 1, countPruned: true},
+			header:       http.Header{XForwardedFor: {"1.1.1.1, 2.2.2.2, 3.3.3.3"}},
+			expected:     "_pruned-2, 3.3.3.3",
+		},
+		{
+			desc:         "carry over the pruned count",
+			forwardedFor: forwardedFor{maxEntries: 2, countPruned: true},
+			header:       http.Header{XForwardedFor: {"_pruned-5, 1.1.1.1, 2.2.2.2, 3.3.3.3"}},
+			expected:     "_pruned-6, 2.2.2.2, 3.3.3.3",
+		},
+		{
+			desc:         "anonymize",
+			forwardedFor: forwardedFor{anonymize: true},
+			header:       http.Header{XForwardedFor: {"1.2.3.4, unknown, 2001:db8::1"}, XRealIp: {"1.2.3.4"}},
+			expected:     "1.2.3.0, unknown, 2001:db8::",
+			realIP:       "1.2.3.0",
+		},
+		{
+			desc:         "prune and anonymize",
+			forwardedFor: forwardedFor{maxEntries: 1, countPruned: true, anonymize: true},
+			header:       http.Header{XForwardedFor: {"1.1.1.1, 2.2.2.2"}},
+			expected:     "_pruned-1, 2.2.2.0",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			test.forwardedFor.apply(test.header)
+			assert.Equal(t, []string{test.expected}, test.header[XForwardedFor])
+			assert.Equal(t, test.realIP, test.header.Get(XRealIp))
+		})
+	}
+}
+
+func TestForwardedForMaxEntries(t *testing.T) {
+	srv := testutils.NewRecorder()
+	defer srv.Close()
+
+	f, err := New(ForwardedForMaxEntries(2, true), AnonymizeForwardedFor())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Header(XForwardedFor, "1.1.1.1, 2.2.2.2, 3.3.3.3"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the client IP appended by the forwarder is kept
+	outReq := srv.Last()
+	outReq.AssertHeader(t, XForwardedFor, "_pruned-2, 3.3.3.0, 127.0.0.0")
+	outReq.AssertHeader(t, XRealIp, "127.0.0.0")
+}
+
+func TestForwardedForMaxEntriesInvalid(t *testing.T) {
+	_, err := New(ForwardedForMaxEntries(0, false))
+	require.Error(t, err)
+}
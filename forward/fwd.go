@@ -21,6 +21,8 @@ import (
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/events"
+	"github.com/vulcand/oxy/requestid"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -38,6 +40,18 @@ func (i *internalLogger) GetLevel() log.Level {
 	return i.Level
 }
 
+// logrusLogger returns the logrus logger behind an OxyLogger, for the helpers taking a *log.Logger, or the standard
+// logger for the other implementations
+func logrusLogger(l OxyLogger) *log.Logger {
+	switch logger := l.(type) {
+	case *internalLogger:
+		return logger.Logger
+	case *log.Logger:
+		return logger
+	}
+	return log.StandardLogger()
+}
+
 // ReqRewriter can alter request headers and body
 type ReqRewriter interface {
 	Rewrite(r *http.Request)
@@ -70,6 +84,15 @@ func Rewriter(r ReqRewriter) optSetter {
 	}
 }
 
+// Rewriters adds request rewriters applied in order after the rewriter set with Rewriter, or after the default
+// HeaderRewriter setting the X-Forwarded headers, see CompositeRewriter
+func Rewriters(rewriters ...ReqRewriter) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.rewriters = append(f.httpForwarder.rewriters, rewriters...)
+		return nil
+	}
+}
+
 // WebsocketTLSClientConfig define the websocker client TLS configuration
 func WebsocketTLSClientConfig(tcc *tls.Config) optSetter {
 	return func(f *Forwarder) error {
@@ -121,6 +144,15 @@ func Logger(l log.FieldLogger) optSetter {
 	}
 }
 
+// requestLogEntry creates the log entry of a request, tagged with its ID when set by the requestid middleware
+func requestLogEntry(l OxyLogger, req *http.Request) *log.Entry {
+	logEntry := l.WithField("Request", utils.DumpHttpRequest(req))
+	if id, ok := requestid.FromContext(req.Context()); ok {
+		logEntry = logEntry.WithField("RequestID", id)
+	}
+	return logEntry
+}
+
 // StateListener defines a state listener for the HTTP forwarder
 func StateListener(stateListener UrlForwardingStateListener) optSetter {
 	return func(f *Forwarder) error {
@@ -179,6 +211,9 @@ type Forwarder struct {
 	*handlerContext
 	stateListener UrlForwardingStateListener
 	stream        bool
+	strict        bool
+	metrics       *forwardMetrics
+	events        events.Emitter
 }
 
 // handlerContext defines a handler context for error reporting and logging
@@ -190,17 +225,38 @@ type handlerContext struct {
 // HTTP traffic
 type httpForwarder struct {
 	roundTripper   http.RoundTripper
+	proxy          ProxySelector
 	rewriter       ReqRewriter
+	rewriters      []ReqRewriter
 	passHost       bool
 	flushInterval  time.Duration
 	modifyResponse func(*http.Response) error
 
+	decoders        map[string]Decoder
+	forceDecompress bool
+
 	tlsClientConfig *tls.Config
 
 	log OxyLogger
 
 	bufferPool                    httputil.BufferPool
 	websocketConnectionClosedHook func(req *http.Request, conn net.Conn)
+	websocketMessageHook          func(req *http.Request, msg *WebsocketMessage) error
+	websocketMaxMessageSize       int64
+	connStatsHook                 func(req *http.Request, stats ConnStats)
+	connClosedHook                func(remoteAddr net.Addr, lifetime time.Duration)
+	headerLimits                  *headerLimits
+	forwardedFor                  *forwardedFor
+	protocols                     *protocolSelector
+	informational                 *InformationalPolicy
+	directCopy                    bool
+	respHeaders                   *responseHeaderFilter
+	cookies                       *cookieRewriter
+	misdirected                   *MisdirectedRequestPolicy
+	responseTimeout               time.Duration
+
+	// revproxy is created once the forwarder is configured and shared by the requests
+	revproxy *httputil.ReverseProxy
 }
 
 const defaultFlushInterval = time.Duration(100) * time.Millisecond
@@ -217,7 +273,7 @@ type UrlForwardingStateListener func(*url.URL, int)
 // New creates an instance of Forwarder based on the provided list of configuration options
 func New(setters ...optSetter) (*Forwarder, error) {
 	f := &Forwarder{
-		httpForwarder:  &httpForwarder{log: &internalLogger{Logger: log.StandardLogger()}},
+		httpForwarder:  &httpForwarder{log: &internalLogger{Logger: utils.InheritedLogger()}},
 		handlerContext: &handlerContext{},
 	}
 	for _, s := range setters {
@@ -239,18 +295,77 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		}
 		f.httpForwarder.rewriter = &HeaderRewriter{TrustForwardHeader: true, Hostname: h}
 	}
+	if len(f.httpForwarder.rewriters) > 0 {
+		f.httpForwarder.rewriter = append(CompositeRewriter{f.httpForwarder.rewriter}, f.httpForwarder.rewriters...)
+	}
+
+	if f.httpForwarder.proxy != nil {
+		if err := f.httpForwarder.configureProxy(); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.httpForwarder.connClosedHook != nil {
+		if err := f.httpForwarder.configureConnClosedHook(); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.httpForwarder.protocols != nil {
+		if err := f.httpForwarder.configureProtocolSelection(); err != nil {
+			return nil, err
+		}
+	}
 
 	if f.httpForwarder.roundTripper == nil {
 		f.httpForwarder.roundTripper = http.DefaultTransport
 	}
 
 	if f.errHandler == nil {
-		f.errHandler = utils.DefaultHandler
+		f.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
 	}
+	if f.events != nil {
+		f.errHandler = failureEmitter(f.events, f.errHandler)
+	}
+	f.errHandler = timeoutErrors(f.errHandler)
 
 	if f.tlsClientConfig == nil {
 		if ht, ok := f.httpForwarder.roundTripper.(*http.Transport); ok {
 			f.tlsClientConfig = ht.TLSClientConfig
+		} else if f.httpForwarder.protocols != nil {
+			f.tlsClientConfig = f.httpForwarder.protocols.transport.TLSClientConfig
+		}
+	}
+
+	if f.httpForwarder.misdirected != nil {
+		f.httpForwarder.roundTripper = f.httpForwarder.newMisdirectedRoundTripper(f.httpForwarder.roundTripper)
+	}
+
+	if f.httpForwarder.connStatsHook != nil {
+		f.httpForwarder.roundTripper = &connStatsRoundTripper{
+			RoundTripper: f.httpForwarder.roundTripper,
+			hook:         f.httpForwarder.connStatsHook,
+		}
+	}
+
+	if f.httpForwarder.headerLimits != nil {
+		f.httpForwarder.roundTripper = &headerLimitsRoundTripper{
+			RoundTripper: f.httpForwarder.roundTripper,
+			limits:       f.httpForwarder.headerLimits,
+		}
+	}
+
+	if f.httpForwarder.forwardedFor != nil {
+		f.httpForwarder.roundTripper = &forwardedForRoundTripper{
+			RoundTripper: f.httpForwarder.roundTripper,
+			forwardedFor: f.httpForwarder.forwardedFor,
+		}
+	}
+
+	if f.httpForwarder.responseTimeout > 0 {
+		f.httpForwarder.roundTripper = &responseTimeoutRoundTripper{
+			RoundTripper: f.httpForwarder.roundTripper,
+			timeout:      f.httpForwarder.responseTimeout,
 		}
 	}
 
@@ -261,6 +376,17 @@ func New(setters ...optSetter) (*Forwarder, error) {
 
 	f.postConfig()
 
+	f.httpForwarder.revproxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// req is the copy of the incoming request, modifyRequest copies its URL before changing it
+			f.httpForwarder.modifyRequest(req, req.URL)
+		},
+		Transport:      f.httpForwarder.roundTripper,
+		FlushInterval:  f.httpForwarder.flushInterval,
+		ModifyResponse: f.httpForwarder.responseModifier(),
+		BufferPool:     f.httpForwarder.bufferPool,
+	}
+
 	return f, nil
 }
 
@@ -268,15 +394,27 @@ func New(setters ...optSetter) (*Forwarder, error) {
 // request and delegates to the proper implementation
 func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if f.log.GetLevel() >= log.DebugLevel {
-		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry := requestLogEntry(f.log, req)
 		logEntry.Debug("vulcand/oxy/forward: begin ServeHttp on request")
 		defer logEntry.Debug("vulcand/oxy/forward: completed ServeHttp on request")
 	}
 
+	if f.strict && f.rejectMalformed(w, req) {
+		return
+	}
+
 	if f.stateListener != nil {
 		f.stateListener(req.URL, StateConnected)
 		defer f.stateListener(req.URL, StateDisconnected)
 	}
+	if f.metrics != nil {
+		f.serveWithMetrics(w, req)
+		return
+	}
+	f.serve(w, req)
+}
+
+func (f *Forwarder) serve(w http.ResponseWriter, req *http.Request) {
 	if IsWebsocketRequest(req) {
 		f.httpForwarder.serveWebSocket(w, req, f.handlerContext)
 	} else {
@@ -330,14 +468,28 @@ func (f *httpForwarder) modifyRequest(outReq *http.Request, target *url.URL) {
 // serveHTTP forwards websocket traffic
 func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
 	if f.log.GetLevel() >= log.DebugLevel {
-		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry := requestLogEntry(f.log, req)
 		logEntry.Debug("vulcand/oxy/forward/websocket: begin ServeHttp on request")
 		defer logEntry.Debug("vulcand/oxy/forward/websocket: completed ServeHttp on request")
 	}
 
 	outReq := f.copyWebSocketRequest(req)
+	if f.forwardedFor != nil {
+		f.forwardedFor.apply(outReq.Header)
+	}
+	if f.headerLimits != nil {
+		if err := f.headerLimits.apply(outReq.Header); err != nil {
+			ctx.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+	}
 
 	dialer := websocket.DefaultDialer
+	if f.proxy != nil {
+		proxyDialer := *dialer
+		proxyDialer.Proxy = f.proxy
+		dialer = &proxyDialer
+	}
 
 	if outReq.URL.Scheme == "wss" && f.tlsClientConfig != nil {
 		dialer.TLSClientConfig = f.tlsClientConfig.Clone()
@@ -386,6 +538,12 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 	}}
 
 	utils.RemoveHeaders(resp.Header, WebsocketUpgradeHeaders...)
+	if f.respHeaders != nil {
+		f.respHeaders.apply(resp.Header)
+	}
+	if f.cookies != nil {
+		f.cookies.apply(resp.Header)
+	}
 	utils.CopyHeaders(resp.Header, w.Header())
 
 	underlyingConn, err := upgrader.Upgrade(w, req, resp.Header)
@@ -401,9 +559,14 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		}
 	}()
 
+	if limit := f.websocketReadLimit(); limit > 0 {
+		underlyingConn.SetReadLimit(limit)
+		targetConn.SetReadLimit(limit)
+	}
+
 	errClient := make(chan error, 1)
 	errBackend := make(chan error, 1)
-	replicateWebsocketConn := func(dst, src *websocket.Conn, errc chan error) {
+	replicateWebsocketConn := func(dst, src *websocket.Conn, direction WebsocketDirection, errc chan error) {
 
 		forward := func(messageType int, reader io.Reader) error {
 			writer, err := dst.NextWriter(messageType)
@@ -427,9 +590,16 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 
 		for {
 			msgType, reader, err := src.NextReader()
+			var msg *WebsocketMessage
+			if err == nil && f.websocketMessageHook != nil {
+				msg, err = readWebsocketMessage(direction, msgType, reader)
+			}
 
 			if err != nil {
 				m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
+				if err == websocket.ErrReadLimit {
+					m = websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+				}
 				if e, ok := err.(*websocket.CloseError); ok {
 					if e.Code != websocket.CloseNoStatusReceived {
 						m = nil
@@ -448,6 +618,22 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 				}
 				break
 			}
+			if msg != nil {
+				err = f.websocketMessageHook(req, msg)
+				if err == ErrDropWebsocketMessage {
+					continue
+				}
+				if err != nil {
+					// the message is vetoed, both sides are closed
+					m := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+					deadline := time.Now().Add(time.Second)
+					src.WriteControl(websocket.CloseMessage, m, deadline)
+					dst.WriteControl(websocket.CloseMessage, m, deadline)
+					errc <- &websocket.CloseError{Code: websocket.ClosePolicyViolation, Text: err.Error()}
+					break
+				}
+				reader = bytes.NewReader(msg.Data)
+			}
 			err = forward(msgType, reader)
 			if err != nil {
 				errc <- err
@@ -456,8 +642,8 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		}
 	}
 
-	go replicateWebsocketConn(underlyingConn, targetConn, errClient)
-	go replicateWebsocketConn(targetConn, underlyingConn, errBackend)
+	go replicateWebsocketConn(underlyingConn, targetConn, WebsocketServerToClient, errClient)
+	go replicateWebsocketConn(targetConn, underlyingConn, WebsocketClientToServer, errBackend)
 
 	var message string
 	select {
@@ -500,7 +686,7 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 		outReq.Host = req.URL.Host
 	}
 
-	outReq.Header = make(http.Header)
+	outReq.Header = make(http.Header, len(req.Header)+1)
 	// gorilla websocket use this header to set the request.Host tested in checkSameOrigin
 	outReq.Header.Set("Host", outReq.Host)
 	utils.CopyHeaders(outReq.Header, req.Header)
@@ -512,32 +698,58 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 	return outReq
 }
 
+// responseModifier decodes, filters the headers and rewrites the cookies of the response, if needed, before calling
+// the ResponseModifier
+func (f *httpForwarder) responseModifier() func(*http.Response) error {
+	if len(f.decoders) == 0 && !f.directCopy && f.respHeaders == nil && f.cookies == nil {
+		return f.modifyResponse
+	}
+	return func(resp *http.Response) error {
+		if len(f.decoders) > 0 {
+			if err := f.decompress(resp); err != nil {
+				return err
+			}
+		}
+		if f.respHeaders != nil {
+			f.respHeaders.apply(resp.Header)
+		}
+		if f.cookies != nil {
+			f.cookies.apply(resp.Header)
+		}
+		if f.modifyResponse != nil {
+			if err := f.modifyResponse(resp); err != nil {
+				return err
+			}
+		}
+		if f.directCopy {
+			detachBody(resp)
+		}
+		return nil
+	}
+}
+
 // serveHTTP forwards HTTP traffic using the configured transport
 func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ctx *handlerContext) {
 	if f.log.GetLevel() >= log.DebugLevel {
-		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(inReq))
+		logEntry := requestLogEntry(f.log, inReq)
 		logEntry.Debug("vulcand/oxy/forward/http: begin ServeHttp on request")
 		defer logEntry.Debug("vulcand/oxy/forward/http: completed ServeHttp on request")
 	}
 
 	start := time.Now().UTC()
 
-	outReq := new(http.Request)
-	*outReq = *inReq // includes shallow copies of maps, but we handle this in Director
+	w, inReq = f.serveInformational(w, inReq)
 
-	revproxy := httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			f.modifyRequest(req, inReq.URL)
-		},
-		Transport:      f.roundTripper,
-		FlushInterval:  f.flushInterval,
-		ModifyResponse: f.modifyResponse,
-		BufferPool:     f.bufferPool,
-	}
+	var detached *detachedBody
+	inReq, detached = f.detachable(w, inReq)
+
+	// the reverse proxy works on its own copy of the request, modified by the Director
+	revproxy := f.revproxy
 
 	if f.log.GetLevel() >= log.DebugLevel {
 		pw := utils.NewProxyWriter(w)
-		revproxy.ServeHTTP(pw, outReq)
+		revproxy.ServeHTTP(pw, inReq)
+		detached.copyTo(pw, inReq, f.log)
 
 		if inReq.TLS != nil {
 			f.log.Debugf("vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v tls:version: %x, tls:resume:%t, tls:csuite:%x, tls:server:%v",
@@ -551,7 +763,8 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 				inReq.URL, pw.StatusCode(), pw.GetLength(), time.Now().UTC().Sub(start))
 		}
 	} else {
-		revproxy.ServeHTTP(w, outReq)
+		revproxy.ServeHTTP(w, inReq)
+		detached.copyTo(w, inReq, f.log)
 	}
 
 	for key := range w.Header() {
@@ -568,14 +781,22 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 // IsWebsocketRequest determines if the specified HTTP request is a
 // websocket handshake request
 func IsWebsocketRequest(req *http.Request) bool {
-	containsHeader := func(name, value string) bool {
-		items := strings.Split(req.Header.Get(name), ",")
-		for _, item := range items {
-			if value == strings.ToLower(strings.TrimSpace(item)) {
-				return true
-			}
+	return containsToken(req.Header.Get(Connection), "upgrade") && containsToken(req.Header.Get(Upgrade), "websocket")
+}
+
+// containsToken reports whether the comma separated list of a header value contains the token, case insensitively.
+// It does not allocate, it is called on every request.
+func containsToken(list, token string) bool {
+	for list != "" {
+		item := list
+		if i := strings.IndexByte(list, ','); i >= 0 {
+			item, list = list[:i], list[i+1:]
+		} else {
+			list = ""
+		}
+		if strings.EqualFold(strings.TrimSpace(item), token) {
+			return true
 		}
-		return false
 	}
-	return containsHeader(Connection, "upgrade") && containsHeader(Upgrade, "websocket")
+	return false
 }
@@ -2,11 +2,16 @@ package forward
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,15 +23,8 @@ import (
 
 // Makes sure hop-by-hop headers are removed
 func TestForwardHopHeaders(t *testing.T) {
-	called := false
-	var outHeaders http.Header
-	var outHost, expectedHost string
-	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		called = true
-		outHeaders = req.Header
-		outHost = req.Host
-		w.Write([]byte("hello"))
-	})
+	var expectedHost string
+	srv := testutils.NewRecorder()
 	defer srv.Close()
 
 	f, err := New()
@@ -48,10 +46,9 @@ func TestForwardHopHeaders(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "hello", string(body))
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, true, called)
-	assert.Equal(t, "", outHeaders.Get(Connection))
-	assert.Equal(t, "", outHeaders.Get(KeepAlive))
-	assert.Equal(t, expectedHost, outHost)
+	require.True(t, srv.AssertCount(t, 1))
+	srv.Last().AssertNoHeader(t, Connection, KeepAlive)
+	assert.Equal(t, expectedHost, srv.Last().Host)
 }
 
 func TestDefaultErrHandler(t *testing.T) {
@@ -156,11 +153,7 @@ func TestXForwardedHostHeader(t *testing.T) {
 
 // Makes sure hop-by-hop headers are removed
 func TestForwardedHeaders(t *testing.T) {
-	var outHeaders http.Header
-	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		outHeaders = req.Header
-		w.Write([]byte("hello"))
-	})
+	srv := testutils.NewRecorder()
 	defer srv.Close()
 
 	f, err := New(Rewriter(&HeaderRewriter{TrustForwardHeader: true, Hostname: "hello"}))
@@ -182,18 +175,15 @@ func TestForwardedHeaders(t *testing.T) {
 	re, _, err := testutils.Get(proxy.URL, testutils.Headers(headers))
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, "httpx", outHeaders.Get(XForwardedProto))
-	assert.Contains(t, outHeaders.Get(XForwardedFor), "192.168.1.1")
-	assert.Contains(t, "upstream-foobar", outHeaders.Get(XForwardedHost))
-	assert.Equal(t, "hello", outHeaders.Get(XForwardedServer))
+	outReq := srv.Last()
+	outReq.AssertHeader(t, XForwardedProto, "httpx")
+	assert.Contains(t, outReq.Header.Get(XForwardedFor), "192.168.1.1")
+	assert.Contains(t, "upstream-foobar", outReq.Header.Get(XForwardedHost))
+	outReq.AssertHeader(t, XForwardedServer, "hello")
 }
 
 func TestCustomRewriter(t *testing.T) {
-	var outHeaders http.Header
-	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		outHeaders = req.Header
-		w.Write([]byte("hello"))
-	})
+	srv := testutils.NewRecorder()
 	defer srv.Close()
 
 	f, err := New(Rewriter(&HeaderRewriter{TrustForwardHeader: false, Hostname: "hello"}))
@@ -213,8 +203,41 @@ func TestCustomRewriter(t *testing.T) {
 	re, _, err := testutils.Get(proxy.URL, testutils.Headers(headers))
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, "http", outHeaders.Get(XForwardedProto))
-	assert.NotContains(t, outHeaders.Get(XForwardedFor), "192.168.1.1")
+	outReq := srv.Last()
+	outReq.AssertHeader(t, XForwardedProto, "http")
+	assert.NotContains(t, outReq.Header.Get(XForwardedFor), "192.168.1.1")
+}
+
+func TestRewriters(t *testing.T) {
+	srv := testutils.NewRecorder()
+	defer srv.Close()
+
+	var order []string
+	f, err := New(Rewriters(
+		ReqRewriterFunc(func(req *http.Request) {
+			order = append(order, "tenant")
+			req.Header.Set("X-Tenant", "acme")
+		}),
+		ReqRewriterFunc(func(req *http.Request) {
+			order = append(order, "forwarded")
+			req.Header.Set("X-Forwarded-Tenant", req.Header.Get("X-Tenant")+"@"+req.Header.Get(XForwardedProto))
+		})))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the custom rewriters are applied after the default X-Forwarded headers
+	outReq := srv.Last()
+	outReq.AssertHeader(t, "X-Forwarded-Tenant", "acme@http")
+	assert.Equal(t, []string{"tenant", "forwarded"}, order)
 }
 
 func TestCustomTransportTimeout(t *testing.T) {
@@ -241,6 +264,148 @@ func TestCustomTransportTimeout(t *testing.T) {
 	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
 }
 
+func TestUpstreamTimeoutError(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var handled error
+	f, err := New(
+		RoundTripper(&http.Transport{ResponseHeaderTimeout: 5 * time.Millisecond}),
+		ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+			handled = err
+			utils.DefaultHandler.ServeHTTP(w, req, err)
+		})))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+	assert.True(t, utils.IsError(handled, utils.ErrUpstreamTimeout))
+	_, ok := handled.(net.Error)
+	assert.True(t, ok)
+}
+
+func TestForwardClientTLSCert(t *testing.T) {
+	ca, err := testutils.NewCA()
+	require.NoError(t, err)
+
+	var clientCN string
+	srv, err := ca.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientCN = req.TLS.PeerCertificates[0].Subject.CommonName
+		w.Write([]byte("hello"))
+	}), tls.RequireAndVerifyClientCert)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	clientCert, err := ca.Issue(testutils.CommonName("oxy client"), testutils.ExtKeyUsage(x509.ExtKeyUsageClientAuth))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		certs        []tls.Certificate
+		expectedCode int
+	}{
+		{
+			desc:         "with client certificate",
+			certs:        []tls.Certificate{clientCert},
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "without client certificate",
+			expectedCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(RoundTripper(&http.Transport{TLSClientConfig: ca.ClientTLSConfig(test.certs...)}))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, body, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+			if test.expectedCode == http.StatusOK {
+				assert.Equal(t, "hello", string(body))
+				assert.Equal(t, "oxy client", clientCN)
+			}
+		})
+	}
+}
+
+func TestForwardExpiredServerCert(t *testing.T) {
+	ca, err := testutils.NewCA()
+	require.NoError(t, err)
+
+	expired := testutils.Validity(time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+	srv, err := ca.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}), tls.NoClientCert, expired)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	f, err := New(RoundTripper(&http.Transport{TLSClientConfig: ca.ClientTLSConfig()}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestForwardServerSentEvents(t *testing.T) {
+	srv := testutils.NewSSEServer(10*time.Millisecond,
+		testutils.SSEEvent{ID: "1", Event: "greeting", Data: "hello"},
+		testutils.SSEEvent{ID: "2", Data: "multi\nline", Retry: 1000},
+	)
+	defer srv.Close()
+
+	f, err := New(Stream(true), StreamingFlushInterval(time.Millisecond))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, events, err := testutils.GetSSE(proxy.URL)
+	require.NoError(t, err)
+	defer re.Body.Close()
+	assert.Equal(t, "text/event-stream", re.Header.Get("Content-Type"))
+
+	event, err := events.Next()
+	require.NoError(t, err)
+	assert.Equal(t, &testutils.SSEEvent{ID: "1", Event: "greeting", Data: "hello"}, event)
+
+	event, err = events.Next()
+	require.NoError(t, err)
+	assert.Equal(t, &testutils.SSEEvent{ID: "2", Data: "multi\nline", Retry: 1000}, event)
+
+	_, err = events.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
 func TestCustomLogger(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("hello"))
@@ -262,11 +427,7 @@ func TestCustomLogger(t *testing.T) {
 }
 
 func TestRouteForwarding(t *testing.T) {
-	var outPath string
-	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		outPath = req.RequestURI
-		w.Write([]byte("hello"))
-	})
+	srv := testutils.NewRecorder()
 	defer srv.Close()
 
 	f, err := New()
@@ -302,16 +463,12 @@ func TestRouteForwarding(t *testing.T) {
 		re, err := http.DefaultClient.Do(request)
 		require.NoError(t, err)
 		assert.Equal(t, http.StatusOK, re.StatusCode)
-		assert.Equal(t, test.ExpectedPath, outPath)
+		assert.Equal(t, test.ExpectedPath, srv.Last().RequestURI)
 	}
 }
 
 func TestForwardedProto(t *testing.T) {
-	var proto string
-	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		proto = req.Header.Get(XForwardedProto)
-		w.Write([]byte("hello"))
-	})
+	srv := testutils.NewRecorder()
 	defer srv.Close()
 
 	f, err := New()
@@ -328,7 +485,7 @@ func TestForwardedProto(t *testing.T) {
 	re, _, err := testutils.Get(tproxy.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, "https", proto)
+	srv.Last().AssertHeader(t, XForwardedProto, "https")
 }
 
 func TestChunkedResponseConversion(t *testing.T) {
@@ -387,11 +544,7 @@ func TestContextWithValueInErrHandler(t *testing.T) {
 }
 
 func TestTeTrailer(t *testing.T) {
-	var teHeader string
-	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
-		teHeader = req.Header.Get(Te)
-		w.Write([]byte("hello"))
-	})
+	srv := testutils.NewRecorder()
 	defer srv.Close()
 
 	f, err := New()
@@ -408,7 +561,40 @@ func TestTeTrailer(t *testing.T) {
 	re, _, err := testutils.Get(tproxy.URL, testutils.Header("Te", "trailers"))
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
-	assert.Equal(t, "trailers", teHeader)
+	srv.Last().AssertHeader(t, Te, "trailers")
+}
+
+func TestForwardResponseTrailers(t *testing.T) {
+	srv := testutils.NewRecorder(testutils.ScriptedResponse{
+		StatusCode: http.StatusCreated,
+		Body:       "created",
+		Trailer:    http.Header{"X-Response-Trailer": {"bar"}},
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, err := http.Post(proxy.URL, "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	re.Body.Close()
+
+	assert.Equal(t, http.StatusCreated, re.StatusCode)
+	assert.Equal(t, "created", string(body))
+	assert.Equal(t, "bar", re.Trailer.Get("X-Response-Trailer"))
+
+	require.True(t, srv.AssertCount(t, 1))
+	outReq := srv.Last()
+	assert.Equal(t, http.MethodPost, outReq.Method)
+	outReq.AssertBody(t, "hello")
 }
 
 func TestUnannouncedTrailer(t *testing.T) {
@@ -432,3 +618,75 @@ func TestUnannouncedTrailer(t *testing.T) {
 
 	require.Equal(t, resp.Trailer.Get("X-Trailer"), "foo")
 }
+
+func TestForwardHTTP2Upstream(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Proto", req.Proto)
+		w.Header().Set("X-Te", req.Header.Get(Te))
+		w.Header().Set("X-Keep-Alive", req.Header.Get(KeepAlive))
+		w.Write([]byte("hello"))
+	})
+
+	h2Srv, err := testutils.NewHTTP2Server(handler)
+	require.NoError(t, err)
+	defer h2Srv.Close()
+
+	h2cSrv := testutils.NewH2CServer(handler)
+	defer h2cSrv.Close()
+
+	testCases := []struct {
+		desc         string
+		url          string
+		roundTripper http.RoundTripper
+	}{
+		{
+			desc:         "HTTP/2 over TLS",
+			url:          h2Srv.URL,
+			roundTripper: testutils.NewHTTP2Transport(),
+		},
+		{
+			desc:         "h2c",
+			url:          h2cSrv.URL,
+			roundTripper: testutils.NewH2CTransport(),
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(RoundTripper(test.roundTripper))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(test.url)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, body, err := testutils.Get(proxy.URL, testutils.Header(Te, "trailers"), testutils.Header(KeepAlive, "timeout=600"))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+			assert.Equal(t, "HTTP/2.0", re.Header.Get("X-Proto"))
+			// TE: trailers is the only hop-by-hop header value allowed over HTTP/2
+			assert.Equal(t, "trailers", re.Header.Get("X-Te"))
+			assert.Empty(t, re.Header.Get("X-Keep-Alive"))
+		})
+	}
+}
+
+func BenchmarkForwarder(b *testing.B) {
+	f, err := New(RoundTripper(testutils.StaticTransport{}))
+	require.NoError(b, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/api?q=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := testutils.NewDiscardWriter()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		f.ServeHTTP(w, req)
+	}
+}
@@ -206,6 +206,27 @@ func TestWebSocketEcho(t *testing.T) {
 	conn.Close()
 }
 
+func TestWebSocketEchoServer(t *testing.T) {
+	f, err := New()
+	require.NoError(t, err)
+
+	srv := testutils.NewWebSocketEchoServer()
+	defer srv.Close()
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	conn, resp, err := testutils.DialWebSocket(proxy.URL, "/ws", http.Header{"X-Test": {"foo"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "foo", resp.Header.Get("Echo-X-Test"))
+
+	messageType, data, err := testutils.WebSocketRoundTrip(conn, gorillawebsocket.BinaryMessage, []byte("hello"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, gorillawebsocket.BinaryMessage, messageType)
+	assert.Equal(t, "hello", string(data))
+}
+
 func TestWebSocketPassHost(t *testing.T) {
 	testCases := []struct {
 		desc     string
@@ -0,0 +1,129 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// HeaderLimitPolicy is what the forwarder does with a request whose headers are over the limits
+type HeaderLimitPolicy int
+
+const (
+	// RejectOversizedHeaders rejects the request, the error handler replies 431 Request Header Fields Too Large
+	RejectOversizedHeaders HeaderLimitPolicy = iota
+	// DropOversizedHeaders drops the headers over the per header limit, then the largest headers until the headers
+	// are within the total limit, and forwards the request
+	DropOversizedHeaders
+)
+
+// HeaderLimits sets the size limits of the headers forwarded upstream, once rewritten: maxTotal is the size of all
+// the headers, maxPerHeader the size of the values of a header, e.g. a long X-Forwarded-For chain. The size of a
+// header is the size of its lines on the wire, "Name: value\r\n". A limit of 0 is no limit.
+//
+// The Host header and the request line are not counted.
+func HeaderLimits(maxTotal, maxPerHeader int, policy HeaderLimitPolicy) optSetter {
+	return func(f *Forwarder) error {
+		if maxTotal < 0 || maxPerHeader < 0 {
+			return fmt.Errorf("header limits should be >= 0, got %d and %d", maxTotal, maxPerHeader)
+		}
+		if policy != RejectOversizedHeaders && policy != DropOversizedHeaders {
+			return fmt.Errorf("unknown header limit policy: %d", policy)
+		}
+		f.httpForwarder.headerLimits = &headerLimits{maxTotal: maxTotal, maxPerHeader: maxPerHeader, policy: policy}
+		return nil
+	}
+}
+
+type headerLimits struct {
+	maxTotal     int
+	maxPerHeader int
+	policy       HeaderLimitPolicy
+}
+
+// headerTooLargeError is a request rejected by the header limits, it matches utils.ErrHeaderTooLarge
+type headerTooLargeError struct {
+	// name is the header over the per header limit, empty when the headers are over the total limit
+	name  string
+	size  int
+	limit int
+}
+
+func (e *headerTooLargeError) Error() string {
+	if e.name != "" {
+		return fmt.Sprintf("header %s of %d bytes is over the limit of %d bytes", e.name, e.size, e.limit)
+	}
+	return fmt.Sprintf("headers of %d bytes are over the limit of %d bytes", e.size, e.limit)
+}
+
+// Is matches utils.ErrHeaderTooLarge
+func (e *headerTooLargeError) Is(target error) bool {
+	return target == utils.ErrHeaderTooLarge
+}
+
+// headerSize returns the size of the lines of a header on the wire
+func headerSize(name string, values []string) int {
+	size := 0
+	for _, v := range values {
+		size += len(name) + len(v) + len(": \r\n")
+	}
+	return size
+}
+
+// apply enforces the limits on the headers, it returns a headerTooLargeError when the request is rejected
+func (l *headerLimits) apply(h http.Header) error {
+	sizes := make(map[string]int, len(h))
+	total := 0
+	for name, values := range h {
+		size := headerSize(name, values)
+		if l.maxPerHeader > 0 && size > l.maxPerHeader {
+			if l.policy == RejectOversizedHeaders {
+				return &headerTooLargeError{name: name, size: size, limit: l.maxPerHeader}
+			}
+			delete(h, name)
+			continue
+		}
+		sizes[name] = size
+		total += size
+	}
+	if l.maxTotal == 0 || total <= l.maxTotal {
+		return nil
+	}
+	if l.policy == RejectOversizedHeaders {
+		return &headerTooLargeError{size: total, limit: l.maxTotal}
+	}
+
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if sizes[names[i]] != sizes[names[j]] {
+			return sizes[names[i]] > sizes[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if total <= l.maxTotal {
+			break
+		}
+		delete(h, name)
+		total -= sizes[name]
+	}
+	return nil
+}
+
+// headerLimitsRoundTripper enforces the header limits on the requests once rewritten
+type headerLimitsRoundTripper struct {
+	http.RoundTripper
+	limits *headerLimits
+}
+
+func (rt *headerLimitsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := rt.limits.apply(req.Header); err != nil {
+		return nil, err
+	}
+	return rt.RoundTripper.RoundTrip(req)
+}
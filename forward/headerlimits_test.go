@@ -0,0 +1,128 @@
+package forward
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestHeaderLimitsApply(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		limits   headerLimits
+		header   http.Header
+		expected []string
+		rejected bool
+	}{
+		{
+			desc:     "within limits",
+			limits:   headerLimits{maxTotal: 100, maxPerHeader: 50},
+			header:   http.Header{"A": {"1"}, "B": {"2"}},
+			expected: []string{"A", "B"},
+		},
+		{
+			desc:     "no limits",
+			limits:   headerLimits{},
+			header:   http.Header{"A": {strings.Repeat("a", 1000)}},
+			expected: []string{"A"},
+		},
+		{
+			desc:     "reject header over the per header limit",
+			limits:   headerLimits{maxPerHeader: 10},
+			header:   http.Header{"A": {"1"}, "B": {"too large value"}},
+			rejected: true,
+		},
+		{
+			desc:     "reject headers over the total limit",
+			limits:   headerLimits{maxTotal: 10},
+			header:   http.Header{"A": {"123"}, "B": {"456"}},
+			rejected: true,
+		},
+		{
+			desc:     "values of a header are summed",
+			limits:   headerLimits{maxPerHeader: 10, policy: DropOversizedHeaders},
+			header:   http.Header{"A": {"1", "2"}, "B": {"3"}},
+			expected: []string{"B"},
+		},
+		{
+			desc:     "drop the largest headers over the total limit",
+			limits:   headerLimits{maxTotal: 20, policy: DropOversizedHeaders},
+			header:   http.Header{"A": {"1"}, "B": {"123456"}, "C": {"12"}},
+			expected: []string{"A", "C"},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			err := test.limits.apply(test.header)
+			if test.rejected {
+				require.Error(t, err)
+				assert.True(t, utils.IsError(err, utils.ErrHeaderTooLarge))
+				return
+			}
+			require.NoError(t, err)
+
+			var names []string
+			for name := range test.header {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			assert.Equal(t, test.expected, names)
+		})
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	srv := testutils.NewRecorder()
+	defer srv.Close()
+
+	xff := strings.Repeat("10.0.0.1, ", 20) + "10.0.0.2"
+
+	testCases := []struct {
+		desc     string
+		policy   HeaderLimitPolicy
+		expected int
+	}{
+		{desc: "reject", policy: RejectOversizedHeaders, expected: http.StatusRequestHeaderFieldsTooLarge},
+		{desc: "drop", policy: DropOversizedHeaders, expected: http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(HeaderLimits(0, 128, test.policy))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, _, err := testutils.Get(proxy.URL, testutils.Header(XForwardedFor, xff))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, re.StatusCode)
+
+			if test.policy == DropOversizedHeaders {
+				outReq := srv.Last()
+				outReq.AssertNoHeader(t, XForwardedFor)
+				outReq.AssertHeader(t, XForwardedProto, "http")
+			}
+		})
+	}
+}
+
+func TestHeaderLimitsInvalid(t *testing.T) {
+	_, err := New(HeaderLimits(-1, 0, RejectOversizedHeaders))
+	require.Error(t, err)
+
+	_, err = New(HeaderLimits(0, 0, HeaderLimitPolicy(42)))
+	require.Error(t, err)
+}
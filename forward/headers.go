@@ -17,6 +17,9 @@ const (
 	TransferEncoding       = "Transfer-Encoding"
 	Upgrade                = "Upgrade"
 	ContentLength          = "Content-Length"
+	ContentEncoding        = "Content-Encoding"
+	AcceptEncoding         = "Accept-Encoding"
+	SetCookie              = "Set-Cookie"
 	SecWebsocketKey        = "Sec-Websocket-Key"
 	SecWebsocketVersion    = "Sec-Websocket-Version"
 	SecWebsocketExtensions = "Sec-Websocket-Extensions"
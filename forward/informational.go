@@ -0,0 +1,63 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// InformationalPolicy is what the forwarder does with the informational (1xx) responses of the upstream servers,
+// the interim responses like 103 Early Hints sent ahead of the final response
+type InformationalPolicy int
+
+const (
+	// ForwardInformational forwards the interim responses to the client, with their headers. The ResponseWriter
+	// has to support writing interim responses, the net/http server does as of Go 1.19.
+	ForwardInformational InformationalPolicy = iota
+	// SuppressInformational drops the interim responses, the client only gets the final response
+	SuppressInformational
+)
+
+// InformationalResponses sets the policy of the interim responses of the upstream servers, 101 Switching Protocols
+// excluded. By default they are handled by net/http/httputil.ReverseProxy, that forwards them as of Go 1.20 and
+// drops them before.
+func InformationalResponses(policy InformationalPolicy) optSetter {
+	return func(f *Forwarder) error {
+		if policy != ForwardInformational && policy != SuppressInformational {
+			return fmt.Errorf("unknown informational responses policy: %d", policy)
+		}
+		f.httpForwarder.informational = &policy
+		return nil
+	}
+}
+
+// informationalWriter drops the interim responses written by the reverse proxy when they are suppressed
+type informationalWriter struct {
+	*utils.ProxyWriter
+	suppress bool
+}
+
+func (w *informationalWriter) WriteHeader(code int) {
+	if isInformational(code) && w.suppress {
+		return
+	}
+	w.ProxyWriter.WriteHeader(code)
+}
+
+// serveInformational returns the writer and the request passed to the reverse proxy to apply the policy of the
+// interim responses
+func (f *httpForwarder) serveInformational(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request) {
+	if f.informational == nil {
+		return w, req
+	}
+	iw := &informationalWriter{ProxyWriter: utils.NewProxyWriter(w), suppress: *f.informational == SuppressInformational}
+	if iw.suppress {
+		return iw, req
+	}
+	return iw, traceInformational(iw, req)
+}
+
+func isInformational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
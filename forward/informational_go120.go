@@ -0,0 +1,13 @@
+//go:build go1.20
+// +build go1.20
+
+package forward
+
+import (
+	"net/http"
+)
+
+// traceInformational returns the request as is, the reverse proxy forwards the interim responses as of Go 1.20
+func traceInformational(w http.ResponseWriter, req *http.Request) *http.Request {
+	return req
+}
@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// statusEarlyHints is http.StatusEarlyHints, added in Go 1.13
+const statusEarlyHints = 103
+
+func TestInformationalResponses(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(statusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc     string
+		policy   InformationalPolicy
+		expected []int
+	}{
+		{desc: "forward", policy: ForwardInformational, expected: []int{statusEarlyHints}},
+		{desc: "suppress", policy: SuppressInformational},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(InformationalResponses(test.policy))
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			var codes []int
+			var links []string
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					codes = append(codes, code)
+					links = append(links, header.Get("Link"))
+					return nil
+				},
+			}
+			req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			require.NoError(t, err)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+			re, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(re.Body)
+			re.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+			assert.Equal(t, test.expected, codes)
+			if len(test.expected) > 0 {
+				assert.Equal(t, []string{"</style.css>; rel=preload; as=style"}, links)
+			}
+			// the headers of the interim response are not repeated in the final response
+			assert.Empty(t, re.Header.Get("Link"))
+		})
+	}
+}
+
+func TestInformationalResponsesInvalid(t *testing.T) {
+	_, err := New(InformationalResponses(InformationalPolicy(42)))
+	require.Error(t, err)
+}
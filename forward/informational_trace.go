@@ -0,0 +1,44 @@
+//go:build !go1.20
+// +build !go1.20
+
+package forward
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+// traceInformational forwards the interim responses reported by the transport to w, the reverse proxy drops them
+// before Go 1.20
+func traceInformational(w http.ResponseWriter, req *http.Request) *http.Request {
+	var mutex sync.Mutex
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if !isInformational(code) {
+				return nil
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			writeInformational(w, code, http.Header(header))
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// writeInformational writes an interim response, the headers are removed from the header map once written, the
+// ResponseWriter does not reset them for an interim response
+func writeInformational(w http.ResponseWriter, code int, header http.Header) {
+	h := w.Header()
+	for k, vv := range header {
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+	w.WriteHeader(code)
+	for k := range header {
+		h.Del(k)
+	}
+}
@@ -0,0 +1,55 @@
+package forward
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vulcand/oxy/metrics"
+	"github.com/vulcand/oxy/utils"
+)
+
+// forwardMetrics are the metrics of the forwarder registered by the Metrics option
+type forwardMetrics struct {
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	inflight *metrics.Gauge
+}
+
+// Metrics registers the metrics of the forwarder into the registry:
+//
+//	oxy_forward_requests_total{method,code} counts the forwarded requests by response status code
+//	oxy_forward_request_duration_seconds{method} is the histogram of the round trip durations
+//	oxy_forward_requests_in_flight is the number of requests being forwarded
+func Metrics(r *metrics.Registry) optSetter {
+	return func(f *Forwarder) error {
+		requests, err := r.Counter("oxy_forward_requests_total", "Requests forwarded to the upstream servers.", "method", "code")
+		if err != nil {
+			return err
+		}
+		duration, err := r.Histogram("oxy_forward_request_duration_seconds", "Round trip durations of the forwarded requests.", nil, "method")
+		if err != nil {
+			return err
+		}
+		inflight, err := r.Gauge("oxy_forward_requests_in_flight", "Requests being forwarded to the upstream servers.")
+		if err != nil {
+			return err
+		}
+		f.metrics = &forwardMetrics{requests: requests, duration: duration, inflight: inflight.With()}
+		return nil
+	}
+}
+
+// serveWithMetrics serves the request and records its metrics
+func (f *Forwarder) serveWithMetrics(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	f.metrics.inflight.Inc()
+	defer f.metrics.inflight.Dec()
+
+	pw := utils.AcquireProxyWriter(w, logrusLogger(f.log))
+	defer utils.ReleaseProxyWriter(pw)
+	f.serve(pw, req)
+
+	f.metrics.requests.With(req.Method, strconv.Itoa(pw.StatusCode())).Inc()
+	f.metrics.duration.With(req.Method).Observe(time.Since(start).Seconds())
+}
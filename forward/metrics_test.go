@@ -0,0 +1,53 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/metrics"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestMetrics(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	registry := metrics.NewRegistry()
+	f, err := New(Metrics(registry))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL + req.URL.Path)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		_, _, err = testutils.Get(proxy.URL + path)
+		require.NoError(t, err)
+	}
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, `oxy_forward_requests_total{method="GET",code="200"} 2`)
+	assert.Contains(t, gathered, `oxy_forward_requests_total{method="GET",code="404"} 1`)
+	assert.Contains(t, gathered, `oxy_forward_request_duration_seconds_count{method="GET"} 3`)
+	assert.Contains(t, gathered, "oxy_forward_requests_in_flight 0\n")
+}
+
+func TestMetricsLogger(t *testing.T) {
+	logger := log.New()
+	f, err := New(Logger(logger), Metrics(metrics.NewRegistry()))
+	require.NoError(t, err)
+
+	// the proxy writer of the metrics logs with the logger of the forwarder
+	assert.Equal(t, logger, logrusLogger(f.log))
+}
@@ -0,0 +1,134 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// statusMisdirectedRequest is the status code of the 421 Misdirected Request responses, as of RFC 7540
+const statusMisdirectedRequest = 421
+
+// MisdirectedRequestPolicy is what the forwarder does with the 421 Misdirected Request responses of the upstream
+// servers, e.g. an HTTP/2 server refusing a request for another host sent on a connection it coalesced
+type MisdirectedRequestPolicy int
+
+const (
+	// RetryMisdirectedRequests retries the request once on a new connection, which is not shared with any other host,
+	// and passes the response of the retry, the error handler is called if the retry is misdirected as well
+	RetryMisdirectedRequests MisdirectedRequestPolicy = iota
+	// FailMisdirectedRequests calls the error handler with an error matching utils.ErrMisdirectedRequest, the
+	// default error handler replies 502 Bad Gateway
+	FailMisdirectedRequests
+)
+
+// MisdirectedRequests handles the 421 Misdirected Request responses of the upstream servers, which are passed to the
+// clients by default.
+//
+// The retries are sent with a transport of their own, over HTTP/1.1 with the TLS config of the forwarder, and the
+// connection is closed once the response is read. The requests with a body are retried only if their GetBody is set,
+// the others fail with the error handler.
+func MisdirectedRequests(policy MisdirectedRequestPolicy) optSetter {
+	return func(f *Forwarder) error {
+		if policy != RetryMisdirectedRequests && policy != FailMisdirectedRequests {
+			return fmt.Errorf("unknown misdirected request policy: %d", policy)
+		}
+		f.httpForwarder.misdirected = &policy
+		return nil
+	}
+}
+
+// misdirectedError is a request answered with a 421 Misdirected Request, it matches utils.ErrMisdirectedRequest
+type misdirectedError struct {
+	url     string
+	retried bool
+}
+
+func (e *misdirectedError) Error() string {
+	if e.retried {
+		return fmt.Sprintf("misdirected request to %s, retried on a new connection", e.url)
+	}
+	return fmt.Sprintf("misdirected request to %s", e.url)
+}
+
+// Is matches utils.ErrMisdirectedRequest
+func (e *misdirectedError) Is(target error) bool {
+	return target == utils.ErrMisdirectedRequest
+}
+
+// misdirectedRoundTripper handles the 421 Misdirected Request responses
+type misdirectedRoundTripper struct {
+	http.RoundTripper
+	policy MisdirectedRequestPolicy
+	// retry sends the retries on new connections
+	retry http.RoundTripper
+	log   OxyLogger
+}
+
+// newMisdirectedRoundTripper returns the round tripper, the retry transport dials like the transport of the
+// forwarder if it is an http.Transport
+func (f *httpForwarder) newMisdirectedRoundTripper(rt http.RoundTripper) *misdirectedRoundTripper {
+	retry := &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}
+	if ht, ok := rt.(*http.Transport); ok {
+		retry.Proxy = ht.Proxy
+		retry.DialContext = ht.DialContext
+		retry.TLSHandshakeTimeout = ht.TLSHandshakeTimeout
+		retry.ResponseHeaderTimeout = ht.ResponseHeaderTimeout
+	}
+	if f.tlsClientConfig != nil {
+		retry.TLSClientConfig = f.tlsClientConfig.Clone()
+		retry.TLSClientConfig.NextProtos = nil
+	}
+	return &misdirectedRoundTripper{RoundTripper: rt, policy: *f.misdirected, retry: retry, log: f.log}
+}
+
+func (rt *misdirectedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.RoundTripper.RoundTrip(req)
+	if err != nil || res.StatusCode != statusMisdirectedRequest {
+		return res, err
+	}
+	discardResponse(res)
+
+	if rt.policy == FailMisdirectedRequests {
+		return nil, &misdirectedError{url: req.URL.String()}
+	}
+	retry, ok := rewindRequest(req)
+	if !ok {
+		rt.log.Debugf("vulcand/oxy/forward: misdirected request to %s can not be retried, its body is consumed", req.URL)
+		return nil, &misdirectedError{url: req.URL.String()}
+	}
+
+	rt.log.Debugf("vulcand/oxy/forward: retrying misdirected request to %s on a new connection", req.URL)
+	res, err = rt.retry.RoundTrip(retry)
+	if err != nil || res.StatusCode != statusMisdirectedRequest {
+		return res, err
+	}
+	discardResponse(res)
+	return nil, &misdirectedError{url: req.URL.String(), retried: true}
+}
+
+// rewindRequest returns a copy of the request with a new body, false if the body can not be read again
+func rewindRequest(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry := req.WithContext(req.Context())
+	retry.Body = body
+	return retry, true
+}
+
+// discardResponse reads the rest of the body of a response not passed to the client, up to a limit, and closes it
+func discardResponse(res *http.Response) {
+	io.CopyN(ioutil.Discard, res.Body, 64*1024)
+	res.Body.Close()
+}
@@ -0,0 +1,138 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+// misdirectingServer answers 421 Misdirected Request to the requests of the first connection, or of every connection
+type misdirectingServer struct {
+	*httptest.Server
+	always bool
+
+	mutex     sync.Mutex
+	firstConn string
+	requests  int
+}
+
+func newMisdirectingServer(always bool) *misdirectingServer {
+	s := &misdirectingServer{always: always}
+	s.Server = testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		s.mutex.Lock()
+		s.requests++
+		if s.firstConn == "" {
+			s.firstConn = req.RemoteAddr
+		}
+		misdirected := s.always || req.RemoteAddr == s.firstConn
+		s.mutex.Unlock()
+
+		if misdirected {
+			w.WriteHeader(statusMisdirectedRequest)
+			w.Write([]byte("misdirected"))
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	return s
+}
+
+func (s *misdirectingServer) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func newMisdirectedProxy(t *testing.T, upstream string, setters ...optSetter) *httptest.Server {
+	f, err := New(setters...)
+	require.NoError(t, err)
+
+	return testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(upstream)
+		f.ServeHTTP(w, req)
+	})
+}
+
+func TestMisdirectedRequestsRetry(t *testing.T) {
+	srv := newMisdirectingServer(false)
+	defer srv.Close()
+
+	proxy := newMisdirectedProxy(t, srv.URL, MisdirectedRequests(RetryMisdirectedRequests))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 2, srv.Requests())
+}
+
+func TestMisdirectedRequestsRetryMisdirected(t *testing.T) {
+	srv := newMisdirectingServer(true)
+	defer srv.Close()
+
+	var handled error
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handled = err
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+	})
+	proxy := newMisdirectedProxy(t, srv.URL, MisdirectedRequests(RetryMisdirectedRequests), ErrorHandler(errHandler))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 2, srv.Requests())
+	assert.True(t, utils.IsError(handled, utils.ErrMisdirectedRequest))
+}
+
+func TestMisdirectedRequestsRetryBody(t *testing.T) {
+	srv := newMisdirectingServer(false)
+	defer srv.Close()
+
+	proxy := newMisdirectedProxy(t, srv.URL, MisdirectedRequests(RetryMisdirectedRequests))
+	defer proxy.Close()
+
+	// the body of the incoming request can not be read again
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("data"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 1, srv.Requests())
+}
+
+func TestMisdirectedRequestsFail(t *testing.T) {
+	srv := newMisdirectingServer(false)
+	defer srv.Close()
+
+	proxy := newMisdirectedProxy(t, srv.URL, MisdirectedRequests(FailMisdirectedRequests))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 1, srv.Requests())
+}
+
+func TestMisdirectedRequestsPassed(t *testing.T) {
+	srv := newMisdirectingServer(false)
+	defer srv.Close()
+
+	proxy := newMisdirectedProxy(t, srv.URL)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, statusMisdirectedRequest, re.StatusCode)
+	assert.Equal(t, "misdirected", string(body))
+}
+
+func TestMisdirectedRequestsInvalid(t *testing.T) {
+	_, err := New(MisdirectedRequests(MisdirectedRequestPolicy(5)))
+	assert.Error(t, err)
+}
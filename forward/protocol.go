@@ -0,0 +1,231 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// Protocol is the protocol a forwarder speaks to an upstream server
+type Protocol string
+
+const (
+	// ProtocolUnknown is the protocol of an upstream server no response was received from yet
+	ProtocolUnknown Protocol = ""
+	// ProtocolHTTP1 is HTTP/1.1
+	ProtocolHTTP1 Protocol = "HTTP/1.1"
+	// ProtocolHTTP2 is HTTP/2, negotiated with ALPN over TLS or with prior knowledge over cleartext (h2c)
+	ProtocolHTTP2 Protocol = "HTTP/2"
+)
+
+// ProtocolStats are the stats of the protocol selected for an upstream host
+type ProtocolStats struct {
+	// Protocol is the protocol of the last response of the host
+	Protocol Protocol `json:"protocol"`
+	// Requests is the number of requests sent to the host
+	Requests int64 `json:"requests"`
+	// Fallbacks is the number of requests sent over HTTP/1.1 once the h2c attempt failed
+	Fallbacks int64 `json:"fallbacks"`
+}
+
+// ProtocolSelection selects the protocol of each upstream host, so that a fleet of HTTP/1.1 and HTTP/2 upstream
+// servers does not need a transport configured per route:
+//
+// - the https upstream servers are offered HTTP/2 with ALPN, and the transport falls back to HTTP/1.1 if the server
+// does not select it.
+//
+// - when h2c is true, the http upstream servers are sent the first request over HTTP/2 with prior knowledge, and
+// the host is switched to HTTP/1.1 for good if the attempt fails. The failed attempt is replayed over HTTP/1.1, so
+// the requests that are not idempotent, e.g. a POST the server may have processed, and the requests with a body that
+// can not be replayed go over HTTP/1.1 until the host is known to speak h2c. The h2c connections are dialed
+// directly, without the proxies of the transport.
+//
+// The decision is cached per host, see Forwarder.UpstreamProtocols. HTTP/2 is configured on a copy of the
+// *http.Transport round tripper, a transport like http.DefaultTransport is created when no round tripper is set.
+func ProtocolSelection(h2c bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.protocols = &protocolSelector{h2c: h2c, hosts: make(map[string]*hostProtocol)}
+		return nil
+	}
+}
+
+// UpstreamProtocols returns the stats of the protocols selected for the upstream hosts, nil if ProtocolSelection
+// is not set
+func (f *Forwarder) UpstreamProtocols() map[string]ProtocolStats {
+	if f.httpForwarder.protocols == nil {
+		return nil
+	}
+	return f.httpForwarder.protocols.stats()
+}
+
+// hostProtocol is the protocol selected for a host
+type hostProtocol struct {
+	mutex    sync.Mutex
+	protocol Protocol
+	// noH2C is true once the h2c attempt failed
+	noH2C bool
+
+	requests  int64
+	fallbacks int64
+}
+
+// protocolSelector selects the protocol of the requests, it is the innermost round tripper of the forwarder.
+// It implements http.RoundTripper.
+type protocolSelector struct {
+	h2c bool
+	// transport speaks HTTP/1.1, and HTTP/2 over TLS, h2cTransport speaks HTTP/2 over cleartext
+	transport    *http.Transport
+	h2cTransport *http2.Transport
+
+	mutex sync.Mutex
+	hosts map[string]*hostProtocol
+}
+
+// configureProtocolSelection configures HTTP/2 on the transport of the forwarder and wraps it
+func (f *httpForwarder) configureProtocolSelection() error {
+	var t *http.Transport
+	switch rt := f.roundTripper.(type) {
+	case nil:
+		t = newProxyTransport(http.ProxyFromEnvironment)
+	case *http.Transport:
+		t = cloneTransport(rt)
+	default:
+		return fmt.Errorf("protocol selection requires an *http.Transport round tripper, got %T", f.roundTripper)
+	}
+
+	if _, ok := t.TLSNextProto[http2.NextProtoTLS]; !ok {
+		if err := http2.ConfigureTransport(t); err != nil {
+			return err
+		}
+	}
+
+	p := f.protocols
+	p.transport = t
+	if p.h2c {
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		p.h2cTransport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		}
+	}
+	f.roundTripper = p
+	return nil
+}
+
+func (p *protocolSelector) host(req *http.Request) *hostProtocol {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h, ok := p.hosts[req.URL.Host]
+	if !ok {
+		h = &hostProtocol{}
+		p.hosts[req.URL.Host] = h
+	}
+	return h
+}
+
+// RoundTrip sends the request with the protocol selected for its host
+func (p *protocolSelector) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := p.host(req)
+	atomic.AddInt64(&h.requests, 1)
+
+	if p.h2cTransport == nil || req.URL.Scheme != "http" {
+		return p.roundTrip(h, p.transport, req)
+	}
+
+	h.mutex.Lock()
+	noH2C, protocol := h.noH2C, h.protocol
+	h.mutex.Unlock()
+
+	if noH2C || (protocol == ProtocolUnknown && !replayable(req)) {
+		return p.roundTrip(h, p.transport, req)
+	}
+	if protocol == ProtocolHTTP2 {
+		return p.roundTrip(h, p.h2cTransport, req)
+	}
+
+	// first attempt of the host
+	res, err := p.roundTrip(h, p.h2cTransport, req)
+	if err == nil || req.Context().Err() != nil {
+		return res, err
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(req.Context())
+		req.Body = body
+	}
+	atomic.AddInt64(&h.fallbacks, 1)
+	res, err = p.roundTrip(h, p.transport, req)
+	if err != nil {
+		// the host may be down rather than not speaking h2c, the next request attempts h2c again
+		return nil, err
+	}
+	h.mutex.Lock()
+	h.noH2C = true
+	h.mutex.Unlock()
+	return res, nil
+}
+
+func (p *protocolSelector) roundTrip(h *hostProtocol, rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := ProtocolHTTP1
+	if res.ProtoMajor == 2 {
+		protocol = ProtocolHTTP2
+	}
+	h.mutex.Lock()
+	h.protocol = protocol
+	h.mutex.Unlock()
+	return res, nil
+}
+
+func (p *protocolSelector) stats() map[string]ProtocolStats {
+	p.mutex.Lock()
+	hosts := make(map[string]*hostProtocol, len(p.hosts))
+	for host, h := range p.hosts {
+		hosts[host] = h
+	}
+	p.mutex.Unlock()
+
+	stats := make(map[string]ProtocolStats, len(hosts))
+	for host, h := range hosts {
+		h.mutex.Lock()
+		protocol := h.protocol
+		h.mutex.Unlock()
+		stats[host] = ProtocolStats{
+			Protocol:  protocol,
+			Requests:  atomic.LoadInt64(&h.requests),
+			Fallbacks: atomic.LoadInt64(&h.fallbacks),
+		}
+	}
+	return stats
+}
+
+// replayable returns true if the request can be sent again once an attempt failed: it is idempotent and its body,
+// if any, can be read again
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
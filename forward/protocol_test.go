@@ -0,0 +1,132 @@
+package forward
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestProtocolSelectionH2C(t *testing.T) {
+	protoHandler := func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}
+	h2cSrv := testutils.NewH2CServer(http.HandlerFunc(protoHandler))
+	defer h2cSrv.Close()
+	h1Srv := testutils.NewHandler(protoHandler)
+	defer h1Srv.Close()
+
+	f, err := New(ProtocolSelection(true))
+	require.NoError(t, err)
+
+	var target *url.URL
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = target
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		target = testutils.ParseURI(h2cSrv.URL)
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "HTTP/2.0", string(body))
+
+		target = testutils.ParseURI(h1Srv.URL)
+		re, body, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "HTTP/1.1", string(body))
+	}
+
+	stats := f.UpstreamProtocols()
+	assert.Equal(t, ProtocolStats{Protocol: ProtocolHTTP2, Requests: 2}, stats[testutils.ParseURI(h2cSrv.URL).Host])
+	// only the first request attempted h2c
+	assert.Equal(t, ProtocolStats{Protocol: ProtocolHTTP1, Requests: 2, Fallbacks: 1}, stats[testutils.ParseURI(h1Srv.URL).Host])
+}
+
+func TestProtocolSelectionBodyNotReplayable(t *testing.T) {
+	srv := testutils.NewH2CServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	defer srv.Close()
+
+	f, err := New(ProtocolSelection(true))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the host is unknown, the body of the incoming request can not be replayed
+	re, err := http.Post(proxy.URL, "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	re.Body.Close()
+	assert.Equal(t, ProtocolHTTP1, f.UpstreamProtocols()[testutils.ParseURI(srv.URL).Host].Protocol)
+
+	// the next request attempts h2c
+	_, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", string(body))
+}
+
+func TestProtocolSelectionALPN(t *testing.T) {
+	srv, err := testutils.NewHTTP2Server(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	transport := newProxyTransport(nil)
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	f, err := New(RoundTripper(transport), ProtocolSelection(false))
+	require.NoError(t, err)
+	assert.Nil(t, transport.TLSNextProto, "the transport of the caller is not changed")
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	_, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", string(body))
+	assert.Equal(t, ProtocolHTTP2, f.UpstreamProtocols()[testutils.ParseURI(srv.URL).Host].Protocol)
+}
+
+func TestReplayable(t *testing.T) {
+	newRequest := func(method string, body io.Reader) *http.Request {
+		req, err := http.NewRequest(method, "http://localhost", body)
+		require.NoError(t, err)
+		return req
+	}
+
+	assert.True(t, replayable(newRequest(http.MethodGet, nil)))
+	assert.True(t, replayable(newRequest(http.MethodPut, strings.NewReader("hello"))))
+	// the server may have processed the request
+	assert.False(t, replayable(newRequest(http.MethodPost, strings.NewReader("hello"))))
+	assert.False(t, replayable(newRequest(http.MethodPatch, nil)))
+
+	req := newRequest(http.MethodPut, strings.NewReader("hello"))
+	req.GetBody = nil
+	assert.False(t, replayable(req))
+}
+
+func TestProtocolSelectionInvalidRoundTripper(t *testing.T) {
+	_, err := New(RoundTripper(testutils.NewH2CTransport()), ProtocolSelection(true))
+	require.Error(t, err)
+
+	f, err := New()
+	require.NoError(t, err)
+	assert.Nil(t, f.UpstreamProtocols())
+}
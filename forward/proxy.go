@@ -0,0 +1,78 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProxySelector returns the URL of the proxy the request to the upstream server goes through,
+// a nil URL connects directly to the upstream server
+type ProxySelector func(req *http.Request) (*url.URL, error)
+
+// UpstreamProxy routes the connections to the upstream servers through the proxies returned by the selector,
+// e.g. in egress restricted environments. The proxy URL schemes are:
+//
+//	socks5://[user:password@]host:port, the connections are opened by the SOCKS5 proxy
+//	http://[user:password@]host:port, or https://, the connections to the https upstream servers are tunneled
+//	with a CONNECT request, the requests to the http upstream servers are sent to the proxy
+//
+// The selector is set as the Proxy of a copy of the *http.Transport round tripper, a transport like
+// http.DefaultTransport is created when no round tripper is set. The WebSocket connections go through the proxies as well.
+func UpstreamProxy(selector ProxySelector) optSetter {
+	return func(f *Forwarder) error {
+		if selector == nil {
+			return fmt.Errorf("proxy selector can not be nil")
+		}
+		f.httpForwarder.proxy = selector
+		return nil
+	}
+}
+
+// UpstreamProxyURL routes all the connections to the upstream servers through the proxy, see UpstreamProxy
+func UpstreamProxyURL(u *url.URL) optSetter {
+	return func(f *Forwarder) error {
+		if u == nil {
+			return fmt.Errorf("proxy URL can not be nil")
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q, expected http, https or socks5", u.Scheme)
+		}
+		return UpstreamProxy(http.ProxyURL(u))(f)
+	}
+}
+
+// configureProxy sets the proxy selector on the transport of the forwarder
+func (f *httpForwarder) configureProxy() error {
+	switch t := f.roundTripper.(type) {
+	case nil:
+		f.roundTripper = newProxyTransport(f.proxy)
+	case *http.Transport:
+		t = cloneTransport(t)
+		t.Proxy = f.proxy
+		f.roundTripper = t
+	default:
+		return fmt.Errorf("upstream proxy requires an *http.Transport round tripper, got %T", f.roundTripper)
+	}
+	return nil
+}
+
+// newProxyTransport creates a transport configured like http.DefaultTransport, going through the proxies
+func newProxyTransport(proxy ProxySelector) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
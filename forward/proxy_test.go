@@ -0,0 +1,248 @@
+package forward
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// proxyLog records the upstream connections opened by the test proxies
+type proxyLog struct {
+	mutex   sync.Mutex
+	targets []string
+}
+
+func (l *proxyLog) add(target string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.targets = append(l.targets, target)
+}
+
+func (l *proxyLog) get() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.targets...)
+}
+
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// newHTTPProxy creates an HTTP proxy tunneling the CONNECT requests and forwarding the others
+func newHTTPProxy(l *proxyLog) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			l.add("GET " + req.URL.String())
+			req.RequestURI = ""
+			re, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer re.Body.Close()
+			w.WriteHeader(re.StatusCode)
+			io.Copy(w, re.Body)
+			return
+		}
+		l.add("CONNECT " + req.Host)
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		splice(conn, upstream)
+	}))
+}
+
+// newSOCKS5Proxy creates a SOCKS5 proxy without authentication, only supporting the CONNECT command
+func newSOCKS5Proxy(t *testing.T, l *proxyLog) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// greeting: version, methods
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					conn.Close()
+					return
+				}
+				io.ReadFull(conn, make([]byte, greeting[1]))
+				conn.Write([]byte{5, 0})
+
+				// request: version, command, reserved, address type, address, port
+				header := make([]byte, 4)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					conn.Close()
+					return
+				}
+				var host string
+				switch header[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					n := make([]byte, 1)
+					io.ReadFull(conn, n)
+					name := make([]byte, n[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+				port := make([]byte, 2)
+				io.ReadFull(conn, port)
+				target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+				l.add("SOCKS5 " + target)
+
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				splice(conn, upstream)
+			}()
+		}
+	}()
+	return listener
+}
+
+func forwardTo(t *testing.T, f *Forwarder, target string) *httptest.Server {
+	return testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(target)
+		f.ServeHTTP(w, req)
+	})
+}
+
+func TestUpstreamProxyHTTP(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("secure hello"))
+	}))
+	defer tlsSrv.Close()
+
+	var l proxyLog
+	httpProxy := newHTTPProxy(&l)
+	defer httpProxy.Close()
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	f, err := New(RoundTripper(transport), UpstreamProxyURL(testutils.ParseURI(httpProxy.URL)))
+	require.NoError(t, err)
+	assert.Nil(t, transport.Proxy, "the transport of the caller is not changed")
+
+	proxy := forwardTo(t, f, srv.URL)
+	defer proxy.Close()
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	tlsProxy := forwardTo(t, f, tlsSrv.URL)
+	defer tlsProxy.Close()
+	re, body, err = testutils.Get(tlsProxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "secure hello", string(body))
+
+	assert.Equal(t, []string{"GET " + srv.URL + "/", "CONNECT " + testutils.ParseURI(tlsSrv.URL).Host}, l.get())
+}
+
+func TestUpstreamProxySOCKS5(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var l proxyLog
+	socks := newSOCKS5Proxy(t, &l)
+	defer socks.Close()
+
+	f, err := New(UpstreamProxyURL(&url.URL{Scheme: "socks5", Host: socks.Addr().String()}))
+	require.NoError(t, err)
+
+	proxy := forwardTo(t, f, srv.URL)
+	defer proxy.Close()
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, []string{"SOCKS5 " + testutils.ParseURI(srv.URL).Host}, l.get())
+}
+
+func TestUpstreamProxySelector(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var l proxyLog
+	httpProxy := newHTTPProxy(&l)
+	defer httpProxy.Close()
+
+	f, err := New(UpstreamProxy(func(req *http.Request) (*url.URL, error) {
+		if req.Header.Get("X-Egress") == "proxy" {
+			return testutils.ParseURI(httpProxy.URL), nil
+		}
+		return nil, nil
+	}))
+	require.NoError(t, err)
+	proxy := forwardTo(t, f, srv.URL)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Empty(t, l.get(), "direct connection")
+
+	re, _, err = testutils.Get(proxy.URL, testutils.Header("X-Egress", "proxy"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Len(t, l.get(), 1)
+}
+
+func TestUpstreamProxyInvalid(t *testing.T) {
+	_, err := New(UpstreamProxy(nil))
+	assert.Error(t, err)
+
+	_, err = New(UpstreamProxyURL(testutils.ParseURI("ftp://proxy:21")))
+	assert.Error(t, err)
+
+	_, err = New(RoundTripper(testutils.NewH2CTransport()), UpstreamProxyURL(testutils.ParseURI("http://proxy:3128")))
+	assert.Error(t, err, "the proxy requires an *http.Transport")
+}
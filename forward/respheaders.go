@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// ResponseHeadersDeny removes the upstream response headers matching the names before the response reaches the
+// client, e.g. Server, X-Powered-By or internal debugging headers. A name ending with "*" matches the headers
+// starting with the rest of the name, e.g. "X-Debug-*". The names are case insensitive.
+func ResponseHeadersDeny(names ...string) optSetter {
+	return func(f *Forwarder) error {
+		m, err := newHeaderMatcher(names)
+		if err != nil {
+			return err
+		}
+		f.httpForwarder.responseHeaders().deny = m
+		return nil
+	}
+}
+
+// ResponseHeadersAllow removes the upstream response headers not matching the names, with the same wildcards as
+// ResponseHeadersDeny. Content-Length and Content-Encoding are always kept: the client can not read the body
+// without them. The denied headers are removed from the allowed ones.
+func ResponseHeadersAllow(names ...string) optSetter {
+	return func(f *Forwarder) error {
+		m, err := newHeaderMatcher(append([]string{ContentLength, ContentEncoding}, names...))
+		if err != nil {
+			return err
+		}
+		f.httpForwarder.responseHeaders().allow = m
+		return nil
+	}
+}
+
+// responseHeaders returns the response header filter, created on the first option setting it
+func (f *httpForwarder) responseHeaders() *responseHeaderFilter {
+	if f.respHeaders == nil {
+		f.respHeaders = &responseHeaderFilter{}
+	}
+	return f.respHeaders
+}
+
+// responseHeaderFilter removes the response headers not allowed or denied, the trailers are not filtered
+type responseHeaderFilter struct {
+	allow *headerMatcher
+	deny  *headerMatcher
+}
+
+func (r *responseHeaderFilter) apply(h http.Header) {
+	for name := range h {
+		if (r.allow != nil && !r.allow.match(name)) || (r.deny != nil && r.deny.match(name)) {
+			delete(h, name)
+		}
+	}
+}
+
+// headerMatcher matches canonical header names by name or by prefix
+type headerMatcher struct {
+	names    map[string]bool
+	prefixes []string
+}
+
+func newHeaderMatcher(names []string) (*headerMatcher, error) {
+	m := &headerMatcher{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		if strings.HasSuffix(name, "*") {
+			prefix := strings.TrimSuffix(name, "*")
+			if prefix != "" {
+				if err := utils.ValidateHeaderName(prefix); err != nil {
+					return nil, err
+				}
+			}
+			// the prefixes are compared with the lower case names, whatever the case of the upstream headers
+			m.prefixes = append(m.prefixes, strings.ToLower(prefix))
+			continue
+		}
+		if err := utils.ValidateHeaderName(name); err != nil {
+			return nil, err
+		}
+		m.names[http.CanonicalHeaderKey(name)] = true
+	}
+	return m, nil
+}
+
+func (m *headerMatcher) match(name string) bool {
+	if m.names[http.CanonicalHeaderKey(name)] {
+		return true
+	}
+	if len(m.prefixes) == 0 {
+		return false
+	}
+	lower := strings.ToLower(name)
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestResponseHeadersFiltering(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "upstream/1.0")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("X-Debug-Node", "node-1")
+		w.Header().Set("X-Request-Id", "42")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc     string
+		options  []optSetter
+		expected []string
+		removed  []string
+	}{
+		{
+			desc:     "deny",
+			options:  []optSetter{ResponseHeadersDeny("server", "X-Powered-By", "x-debug-*")},
+			expected: []string{"X-Request-Id", "Content-Type"},
+			removed:  []string{"Server", "X-Powered-By", "X-Debug-Node"},
+		},
+		{
+			desc:     "allow",
+			options:  []optSetter{ResponseHeadersAllow("Content-Type", "X-*")},
+			expected: []string{"X-Powered-By", "X-Debug-Node", "X-Request-Id", "Content-Type", "Content-Length"},
+			removed:  []string{"Server"},
+		},
+		{
+			desc:     "allow and deny",
+			options:  []optSetter{ResponseHeadersAllow("X-*"), ResponseHeadersDeny("X-Debug-*")},
+			expected: []string{"X-Powered-By", "X-Request-Id", "Content-Length"},
+			removed:  []string{"Server", "X-Debug-Node"},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(test.options...)
+			require.NoError(t, err)
+
+			proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(srv.URL)
+				f.ServeHTTP(w, req)
+			})
+			defer proxy.Close()
+
+			re, body, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+
+			for _, name := range test.expected {
+				assert.NotEmpty(t, re.Header.Get(name), name)
+			}
+			for _, name := range test.removed {
+				assert.Empty(t, re.Header.Get(name), name)
+			}
+		})
+	}
+}
+
+func TestResponseHeadersInvalidName(t *testing.T) {
+	_, err := New(ResponseHeadersDeny("X Debug"))
+	assert.Error(t, err)
+
+	_, err = New(ResponseHeadersAllow("X:*"))
+	assert.Error(t, err)
+}
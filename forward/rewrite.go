@@ -14,9 +14,30 @@ type HeaderRewriter struct {
 	Hostname           string
 }
 
+// CompositeRewriter applies the rewriters in order, e.g. a HeaderRewriter then custom rewriters
+type CompositeRewriter []ReqRewriter
+
+// Rewrite rewrites the request with each rewriter
+func (c CompositeRewriter) Rewrite(req *http.Request) {
+	for _, rw := range c {
+		rw.Rewrite(req)
+	}
+}
+
+// ReqRewriterFunc is an adapter to use a function as a ReqRewriter
+type ReqRewriterFunc func(req *http.Request)
+
+// Rewrite calls f(req)
+func (f ReqRewriterFunc) Rewrite(req *http.Request) {
+	f(req)
+}
+
 // clean up IP in case if it is ipv6 address and it has {zone} information in it, like "[fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)]:64692"
 func ipv6fix(clientIP string) string {
-	return strings.Split(clientIP, "%")[0]
+	if i := strings.IndexByte(clientIP, '%'); i >= 0 {
+		return clientIP[:i]
+	}
+	return clientIP
 }
 
 // Rewrite rewrite request headers
@@ -25,59 +46,82 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 		utils.RemoveHeaders(req.Header, XHeaders...)
 	}
 
+	websocket := IsWebsocketRequest(req)
+	h := headerSetter{header: req.Header}
+
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 		clientIP = ipv6fix(clientIP)
 		// If not websocket, done in http.ReverseProxy
-		if IsWebsocketRequest(req) {
+		if websocket {
 			if prior, ok := req.Header[XForwardedFor]; ok {
-				req.Header.Set(XForwardedFor, strings.Join(prior, ", ")+", "+clientIP)
+				h.set(XForwardedFor, strings.Join(prior, ", ")+", "+clientIP)
 			} else {
-				req.Header.Set(XForwardedFor, clientIP)
+				h.set(XForwardedFor, clientIP)
 			}
 		}
 
 		if req.Header.Get(XRealIp) == "" {
-			req.Header.Set(XRealIp, clientIP)
+			h.set(XRealIp, clientIP)
 		}
 	}
 
 	xfProto := req.Header.Get(XForwardedProto)
 	if xfProto == "" {
 		if req.TLS != nil {
-			req.Header.Set(XForwardedProto, "https")
+			h.set(XForwardedProto, "https")
 		} else {
-			req.Header.Set(XForwardedProto, "http")
+			h.set(XForwardedProto, "http")
 		}
 	}
 
-	if IsWebsocketRequest(req) {
+	if websocket {
 		if req.Header.Get(XForwardedProto) == "https" {
-			req.Header.Set(XForwardedProto, "wss")
+			h.set(XForwardedProto, "wss")
 		} else {
-			req.Header.Set(XForwardedProto, "ws")
+			h.set(XForwardedProto, "ws")
 		}
 	}
 
 	if xfPort := req.Header.Get(XForwardedPort); xfPort == "" {
-		req.Header.Set(XForwardedPort, forwardedPort(req))
+		h.set(XForwardedPort, forwardedPort(req))
 	}
 
 	if xfHost := req.Header.Get(XForwardedHost); xfHost == "" && req.Host != "" {
-		req.Header.Set(XForwardedHost, req.Host)
+		h.set(XForwardedHost, req.Host)
 	}
 
 	if rw.Hostname != "" {
-		req.Header.Set(XForwardedServer, rw.Hostname)
+		h.set(XForwardedServer, rw.Hostname)
 	}
 }
 
+// headerSetter sets the forwarding headers, their values share a backing array to save an allocation per header
+type headerSetter struct {
+	header http.Header
+	values []string
+}
+
+// set sets the value of a header, the key must be canonical
+func (s *headerSetter) set(key, value string) {
+	if s.values == nil {
+		s.values = make([]string, 0, 6)
+	}
+	s.values = append(s.values, value)
+	n := len(s.values)
+	// the capacity is limited so that appending to a header value does not overwrite the next one
+	s.header[key] = s.values[n-1 : n : n]
+}
+
 func forwardedPort(req *http.Request) string {
 	if req == nil {
 		return ""
 	}
 
-	if _, port, err := net.SplitHostPort(req.Host); err == nil && port != "" {
-		return port
+	// a host without a colon has no port, skip the error SplitHostPort would allocate
+	if strings.IndexByte(req.Host, ':') >= 0 {
+		if _, port, err := net.SplitHostPort(req.Host); err == nil && port != "" {
+			return port
+		}
 	}
 
 	if req.Header.Get(XForwardedProto) == "https" || req.Header.Get(XForwardedProto) == "wss" {
@@ -1,6 +1,8 @@
 package forward
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -59,3 +61,16 @@ func TestIPv6Fix(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkHeaderRewriter(b *testing.B) {
+	rw := &HeaderRewriter{TrustForwardHeader: true, Hostname: "proxy"}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req.Header = make(http.Header, 8)
+		rw.Rewrite(req)
+	}
+}
@@ -0,0 +1,28 @@
+package forward
+
+import (
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// StrictParsing rejects the malformed requests with a 400 instead of forwarding them upstream, see
+// utils.ValidateRequest: a request URI with an invalid percent-encoding, a header with CR, LF or other control
+// characters, or an X-Forwarded-For entry that is not an IP address, so that the upstream servers can not parse the
+// request differently than the proxy did.
+func StrictParsing() optSetter {
+	return func(f *Forwarder) error {
+		f.strict = true
+		return nil
+	}
+}
+
+// rejectMalformed reports the error of a malformed request, it returns true if the request was rejected
+func (f *Forwarder) rejectMalformed(w http.ResponseWriter, req *http.Request) bool {
+	if err := utils.ValidateRequest(req); err != nil {
+		f.log.Debugf("vulcand/oxy/forward: rejecting Request(%v %v): %v", req.Method, req.URL, err)
+		f.errHandler.ServeHTTP(w, req, err)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestStrictParsing(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		desc     string
+		header   http.Header
+		expected int
+	}{
+		{desc: "valid", header: http.Header{XForwardedFor: {"10.0.0.1"}}, expected: http.StatusOK},
+		{desc: "CR LF in header value", header: http.Header{"X-Test": {"a\r\nX-Injected: 1"}}, expected: http.StatusBadRequest},
+		{desc: "invalid X-Forwarded-For", header: http.Header{XForwardedFor: {"10.0.0.1, evil"}}, expected: http.StatusBadRequest},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(StrictParsing())
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+			req.RequestURI = ""
+			req.Header = test.header
+
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, test.expected, w.Code)
+		})
+	}
+}
+
+func TestStrictParsingRequestURI(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(StrictParsing())
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	req.RequestURI = "/a%zz"
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
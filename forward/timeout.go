@@ -0,0 +1,101 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// ResponseTimeout bounds the total duration of the responses of the upstream servers, from the request to the end of
+// the body, where the ResponseHeaderTimeout of the transport bounds the wait for the headers only, e.g. to abort the
+// upstream servers dripping their bodies.
+//
+// An upstream server not sending its headers in time fails with an error matching utils.ErrUpstreamTimeout, the
+// default error handler replies 504 Gateway Timeout. Once the headers are passed to the client, the response is
+// aborted: the connection of the client is closed, or its HTTP/2 stream reset, and the timeout is logged. The
+// websocket connections are not bounded.
+func ResponseTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d <= 0 {
+			return fmt.Errorf("response timeout should be > 0, got %v", d)
+		}
+		f.httpForwarder.responseTimeout = d
+		return nil
+	}
+}
+
+// responseTimeoutError is a response not received within the response timeout, it matches utils.ErrUpstreamTimeout
+// and is a net.Error
+type responseTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *responseTimeoutError) Error() string {
+	return fmt.Sprintf("upstream response not received within %v", e.timeout)
+}
+
+func (e *responseTimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *responseTimeoutError) Temporary() bool {
+	return true
+}
+
+// Is matches utils.ErrUpstreamTimeout
+func (e *responseTimeoutError) Is(target error) bool {
+	return target == utils.ErrUpstreamTimeout
+}
+
+// responseTimeoutRoundTripper bounds the duration of the round trips and of the reads of the response bodies
+type responseTimeoutRoundTripper struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (rt *responseTimeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), rt.timeout)
+	res, err := rt.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if rt.expired(ctx, req) {
+			return nil, &responseTimeoutError{timeout: rt.timeout}
+		}
+		return nil, err
+	}
+	res.Body = &timeoutBody{ReadCloser: res.Body, rt: rt, req: req, ctx: ctx, cancel: cancel}
+	return res, nil
+}
+
+// expired returns true if the response timeout expired, and not the deadline of the request
+func (rt *responseTimeoutRoundTripper) expired(ctx context.Context, req *http.Request) bool {
+	return ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil
+}
+
+// timeoutBody is the body of a response bounded by the response timeout, its reads fail with a responseTimeoutError
+// once the timeout expires
+type timeoutBody struct {
+	io.ReadCloser
+	rt     *responseTimeoutRoundTripper
+	req    *http.Request
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.rt.expired(b.ctx, b.req) {
+		err = &responseTimeoutError{timeout: b.rt.timeout}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
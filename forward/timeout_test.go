@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestResponseTimeoutHeaders(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	})
+	defer srv.Close()
+
+	var handled error
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handled = err
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+	})
+	f, err := New(ResponseTimeout(50*time.Millisecond), ErrorHandler(errHandler))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+	assert.IsType(t, &responseTimeoutError{}, handled)
+	assert.True(t, utils.IsError(handled, utils.ErrUpstreamTimeout))
+}
+
+func TestResponseTimeoutBody(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	})
+	defer srv.Close()
+
+	f, err := New(ResponseTimeout(50*time.Millisecond), Stream(true))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	start := time.Now()
+	re, body, err := testutils.Get(proxy.URL)
+	// the response is aborted once the headers are sent
+	assert.True(t, time.Since(start) < time.Second)
+	if err == nil {
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	}
+}
+
+func TestResponseTimeoutWithinTimeout(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(ResponseTimeout(time.Second))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestResponseTimeoutInvalid(t *testing.T) {
+	_, err := New(ResponseTimeout(0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,12 @@
+//go:build go1.13
+// +build go1.13
+
+package forward
+
+import "net/http"
+
+// cloneTransport returns a copy of the transport, so that the options of the forwarder do not change a transport
+// shared with other clients, e.g. http.DefaultTransport
+func cloneTransport(t *http.Transport) *http.Transport {
+	return t.Clone()
+}
@@ -0,0 +1,40 @@
+//go:build !go1.13
+// +build !go1.13
+
+package forward
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// cloneTransport returns a copy of the transport, so that the options of the forwarder do not change a transport
+// shared with other clients, e.g. http.DefaultTransport. The fields added after go1.9 are not copied.
+func cloneTransport(t *http.Transport) *http.Transport {
+	c := &http.Transport{
+		Proxy:                  t.Proxy,
+		DialContext:            t.DialContext,
+		Dial:                   t.Dial,
+		DialTLS:                t.DialTLS,
+		TLSHandshakeTimeout:    t.TLSHandshakeTimeout,
+		DisableKeepAlives:      t.DisableKeepAlives,
+		DisableCompression:     t.DisableCompression,
+		MaxIdleConns:           t.MaxIdleConns,
+		MaxIdleConnsPerHost:    t.MaxIdleConnsPerHost,
+		IdleConnTimeout:        t.IdleConnTimeout,
+		ResponseHeaderTimeout:  t.ResponseHeaderTimeout,
+		ExpectContinueTimeout:  t.ExpectContinueTimeout,
+		ProxyConnectHeader:     t.ProxyConnectHeader,
+		MaxResponseHeaderBytes: t.MaxResponseHeaderBytes,
+	}
+	if t.TLSClientConfig != nil {
+		c.TLSClientConfig = t.TLSClientConfig.Clone()
+	}
+	if t.TLSNextProto != nil {
+		c.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper, len(t.TLSNextProto))
+		for k, v := range t.TLSNextProto {
+			c.TLSNextProto[k] = v
+		}
+	}
+	return c
+}
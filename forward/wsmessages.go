@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// DefaultWebsocketMaxMessageSize is the size limit of the websocket messages buffered for the message hook
+const DefaultWebsocketMaxMessageSize = 1 << 20
+
+// ErrDropWebsocketMessage is returned by a websocket message hook to drop the message and keep the connection open
+var ErrDropWebsocketMessage = errors.New("drop websocket message")
+
+// WebsocketDirection is the direction of a websocket message
+type WebsocketDirection int
+
+// Directions of the websocket messages
+const (
+	// WebsocketClientToServer is a message sent by the client to the upstream server
+	WebsocketClientToServer WebsocketDirection = iota
+	// WebsocketServerToClient is a message sent by the upstream server to the client
+	WebsocketServerToClient
+)
+
+func (d WebsocketDirection) String() string {
+	if d == WebsocketClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// WebsocketMessage is a text or binary websocket message proxied by the forwarder
+type WebsocketMessage struct {
+	Direction WebsocketDirection
+	// Type is websocket.TextMessage or websocket.BinaryMessage
+	Type int
+	// Data is the payload of the message, the hook may replace it to forward another payload
+	Data []byte
+}
+
+// WebsocketMessageHook defines a hook called with each text or binary message of the websocket connections, in
+// either direction, before it is forwarded. The control messages are forwarded as is.
+//
+// The hook returns nil to forward the message, ErrDropWebsocketMessage to drop it, or another error to close
+// both sides of the connection with a policy violation close frame. The hook is called in turn for the messages of
+// a direction, and concurrently for the two directions.
+//
+// The messages are buffered for the hook, the connections sending a message over the limit set with
+// WebsocketMaxMessageSize, DefaultWebsocketMaxMessageSize if not set, are closed.
+func WebsocketMessageHook(hook func(req *http.Request, msg *WebsocketMessage) error) optSetter {
+	return func(f *Forwarder) error {
+		if hook == nil {
+			return fmt.Errorf("websocket message hook can not be nil")
+		}
+		f.httpForwarder.websocketMessageHook = hook
+		return nil
+	}
+}
+
+// WebsocketMaxMessageSize sets the size limit of the websocket messages in bytes, in either direction: the side
+// sending a message over the limit is closed with a message too big close frame, and so is the other side.
+//
+// There is no limit by default, unless a websocket message hook is set.
+func WebsocketMaxMessageSize(size int64) optSetter {
+	return func(f *Forwarder) error {
+		if size <= 0 {
+			return fmt.Errorf("websocket max message size should be > 0, got %d", size)
+		}
+		f.httpForwarder.websocketMaxMessageSize = size
+		return nil
+	}
+}
+
+// websocketReadLimit returns the read limit of the websocket connections, 0 for no limit
+func (f *httpForwarder) websocketReadLimit() int64 {
+	if f.websocketMaxMessageSize == 0 && f.websocketMessageHook != nil {
+		return DefaultWebsocketMaxMessageSize
+	}
+	return f.websocketMaxMessageSize
+}
+
+// readWebsocketMessage buffers a message for the message hook
+func readWebsocketMessage(direction WebsocketDirection, msgType int, reader io.Reader) (*WebsocketMessage, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &WebsocketMessage{Direction: direction, Type: msgType, Data: data}, nil
+}
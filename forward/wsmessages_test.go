@@ -0,0 +1,161 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEchoWebsocketServer() *httptest.Server {
+	upgrader := gorillawebsocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			msgType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func dialWebsocketProxy(t *testing.T, f *Forwarder) (*gorillawebsocket.Conn, func()) {
+	srv := newEchoWebsocketServer()
+	proxy := createProxyWithForwarder(f, srv.URL)
+
+	conn, resp, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err, "Error during Dial with response: %+v", resp)
+	return conn, func() {
+		conn.Close()
+		proxy.Close()
+		srv.Close()
+	}
+}
+
+func TestWebsocketMessageHook(t *testing.T) {
+	var mutex sync.Mutex
+	var audit []string
+	f, err := New(WebsocketMessageHook(func(req *http.Request, msg *WebsocketMessage) error {
+		mutex.Lock()
+		audit = append(audit, msg.Direction.String()+" "+string(msg.Data))
+		mutex.Unlock()
+		if msg.Direction == WebsocketServerToClient {
+			msg.Data = bytes.ToUpper(msg.Data)
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+
+	conn, closeAll := dialWebsocketProxy(t, f)
+	defer closeAll()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("hello")))
+	msgType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, gorillawebsocket.TextMessage, msgType)
+	assert.Equal(t, "HELLO", string(data))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"client->server hello", "server->client hello"}, audit)
+}
+
+func TestWebsocketMessageHookDrop(t *testing.T) {
+	f, err := New(WebsocketMessageHook(func(req *http.Request, msg *WebsocketMessage) error {
+		if strings.HasPrefix(string(msg.Data), "secret") {
+			return ErrDropWebsocketMessage
+		}
+		return nil
+	}))
+	require.NoError(t, err)
+
+	conn, closeAll := dialWebsocketProxy(t, f)
+	defer closeAll()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("secret")))
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("public")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "public", string(data))
+}
+
+func TestWebsocketMessageHookVeto(t *testing.T) {
+	f, err := New(WebsocketMessageHook(func(req *http.Request, msg *WebsocketMessage) error {
+		return errors.New("forbidden")
+	}))
+	require.NoError(t, err)
+
+	conn, closeAll := dialWebsocketProxy(t, f)
+	defer closeAll()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.BinaryMessage, []byte("hello")))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*gorillawebsocket.CloseError)
+	require.True(t, ok, "unexpected error: %v", err)
+	assert.Equal(t, gorillawebsocket.ClosePolicyViolation, closeErr.Code)
+	assert.Equal(t, "forbidden", closeErr.Text)
+}
+
+func TestWebsocketMaxMessageSize(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opts []optSetter
+	}{
+		{
+			desc: "without hook",
+			opts: []optSetter{WebsocketMaxMessageSize(8)},
+		},
+		{
+			desc: "with hook",
+			opts: []optSetter{
+				WebsocketMaxMessageSize(8),
+				WebsocketMessageHook(func(req *http.Request, msg *WebsocketMessage) error { return nil }),
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(test.opts...)
+			require.NoError(t, err)
+
+			conn, closeAll := dialWebsocketProxy(t, f)
+			defer closeAll()
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("small")))
+			_, data, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, "small", string(data))
+
+			require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("way too large")))
+			_, _, err = conn.ReadMessage()
+			closeErr, ok := err.(*gorillawebsocket.CloseError)
+			require.True(t, ok, "unexpected error: %v", err)
+			assert.Equal(t, gorillawebsocket.CloseMessageTooBig, closeErr.Code)
+		})
+	}
+}
+
+func TestWebsocketMaxMessageSizeInvalid(t *testing.T) {
+	_, err := New(WebsocketMaxMessageSize(0))
+	require.Error(t, err)
+
+	_, err = New(WebsocketMessageHook(nil))
+	require.Error(t, err)
+}
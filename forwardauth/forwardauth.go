@@ -0,0 +1,253 @@
+/*
+Package forwardauth provides a middleware delegating the authorization of requests to an external service.
+
+For every request, the middleware sends a GET request to the authorization service carrying the headers of the original
+request along with its method, scheme, host and URI in the X-Forwarded-* headers. A 2xx response lets the request
+through, the configured headers of the auth response being copied onto the upstream request. Any other response,
+e.g. a 401 or a 302 to a login page, is returned to the client as is.
+
+Examples of a forward-auth middleware:
+
+	// all the request headers are sent to the auth service, X-User is passed to the upstream
+	fa, err := forwardauth.New(handler, "http://auth.local/verify", forwardauth.AuthResponseHeaders("X-User"))
+
+	// only the cookies are sent to the auth service
+	fa, err := forwardauth.New(handler, "http://auth.local/verify", forwardauth.AuthRequestHeaders("Cookie"))
+*/
+package forwardauth
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+)
+
+// X-Forwarded-* headers describing the original request to the auth service
+const (
+	XForwardedMethod = "X-Forwarded-Method"
+	XForwardedUri    = "X-Forwarded-Uri"
+)
+
+// DefaultTimeout is the timeout of the requests to the auth service
+const DefaultTimeout = 30 * time.Second
+
+// maxAuthBodyBytes limits the body of the auth responses read by the middleware
+const maxAuthBodyBytes = 1 << 20
+
+// ForwardAuth is a middleware authorizing requests with an external service
+type ForwardAuth struct {
+	next    http.Handler
+	address string
+	client  *http.Client
+
+	requestHeaders     []string
+	responseHeaders    []string
+	trustForwardHeader bool
+
+	errHandler utils.ErrorHandler
+	log        *log.Logger
+}
+
+// Option is a functional option setter for ForwardAuth
+type Option func(fa *ForwardAuth) error
+
+// New creates a new ForwardAuth middleware calling the auth service at address
+func New(next http.Handler, address string, opts ...Option) (*ForwardAuth, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("auth address should be an absolute http(s) URL, got %q", address)
+	}
+
+	fa := &ForwardAuth{
+		next:    next,
+		address: address,
+		log:     utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(fa); err != nil {
+			return nil, err
+		}
+	}
+	if fa.client == nil {
+		fa.client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if fa.errHandler == nil {
+		fa.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
+	}
+	return fa, nil
+}
+
+// Client sets the HTTP client used to call the auth service.
+// Redirects of the auth service are never followed, they are returned to the client.
+func Client(client *http.Client) Option {
+	return func(fa *ForwardAuth) error {
+		if client == nil {
+			return fmt.Errorf("client can not be nil")
+		}
+		fa.client = client
+		return nil
+	}
+}
+
+// AuthRequestHeaders restricts the headers of the original request sent to the auth service, all of them are sent by default
+func AuthRequestHeaders(headers ...string) Option {
+	return func(fa *ForwardAuth) error {
+		fa.requestHeaders = headers
+		return nil
+	}
+}
+
+// AuthResponseHeaders sets the headers of the auth response copied onto the upstream request.
+// These headers are removed from the original request, so that clients can not forge them.
+func AuthResponseHeaders(headers ...string) Option {
+	return func(fa *ForwardAuth) error {
+		fa.responseHeaders = headers
+		return nil
+	}
+}
+
+// TrustForwardHeader keeps the X-Forwarded-* headers of the original request instead of overwriting them
+func TrustForwardHeader(trust bool) Option {
+	return func(fa *ForwardAuth) error {
+		fa.trustForwardHeader = trust
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler called when the auth service can not be reached
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(fa *ForwardAuth) error {
+		fa.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the forward-auth middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(fa *ForwardAuth) error {
+		fa.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by forward-auth handler.
+func (fa *ForwardAuth) Wrap(next http.Handler) error {
+	fa.next = next
+	return nil
+}
+
+func (fa *ForwardAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if fa.log.Level >= log.DebugLevel {
+		logEntry := fa.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/forwardauth: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/forwardauth: completed ServeHttp on request")
+	}
+
+	authReq, err := fa.authRequest(req)
+	if err != nil {
+		fa.log.Errorf("vulcand/oxy/forwardauth: failed to create auth request, err: %v", err)
+		fa.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	client := *fa.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	authResp, err := client.Do(authReq)
+	if err != nil {
+		fa.log.Errorf("vulcand/oxy/forwardauth: auth service %s failed, err: %v", fa.address, err)
+		fa.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer authResp.Body.Close()
+
+	if authResp.StatusCode < http.StatusOK || authResp.StatusCode >= http.StatusMultipleChoices {
+		fa.log.Debugf("vulcand/oxy/forwardauth: request denied by the auth service with status %d", authResp.StatusCode)
+		fa.deny(w, authResp)
+		return
+	}
+
+	for _, name := range fa.responseHeaders {
+		req.Header.Del(name)
+		if values, ok := authResp.Header[http.CanonicalHeaderKey(name)]; ok {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	// the body of the approval is not used, drain it so that the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(authResp.Body, maxAuthBodyBytes))
+
+	fa.next.ServeHTTP(w, req)
+}
+
+// authRequest creates the request describing req to the auth service
+func (fa *ForwardAuth) authRequest(req *http.Request) (*http.Request, error) {
+	authReq, err := http.NewRequest(http.MethodGet, fa.address, nil)
+	if err != nil {
+		return nil, err
+	}
+	authReq = authReq.WithContext(req.Context())
+
+	if fa.requestHeaders == nil {
+		utils.CopyHeaders(authReq.Header, req.Header)
+		utils.RemoveHeaders(authReq.Header, forward.HopHeaders...)
+		utils.RemoveHeaders(authReq.Header, forward.ContentLength)
+	} else {
+		for _, name := range fa.requestHeaders {
+			if values, ok := req.Header[http.CanonicalHeaderKey(name)]; ok {
+				authReq.Header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+
+	fa.setForwardedHeader(authReq.Header, req.Header, XForwardedMethod, req.Method)
+	fa.setForwardedHeader(authReq.Header, req.Header, forward.XForwardedHost, req.Host)
+	fa.setForwardedHeader(authReq.Header, req.Header, XForwardedUri, req.URL.RequestURI())
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	fa.setForwardedHeader(authReq.Header, req.Header, forward.XForwardedProto, proto)
+
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		forwardedFor := clientIP
+		if prior := req.Header.Get(forward.XForwardedFor); fa.trustForwardHeader && prior != "" {
+			forwardedFor = prior + ", " + clientIP
+		}
+		authReq.Header.Set(forward.XForwardedFor, forwardedFor)
+	}
+	return authReq, nil
+}
+
+func (fa *ForwardAuth) setForwardedHeader(dst, src http.Header, name, value string) {
+	if fa.trustForwardHeader && src.Get(name) != "" {
+		dst.Set(name, src.Get(name))
+		return
+	}
+	dst.Set(name, value)
+}
+
+// deny returns the auth response to the client
+func (fa *ForwardAuth) deny(w http.ResponseWriter, authResp *http.Response) {
+	utils.CopyHeaders(w.Header(), authResp.Header)
+	utils.RemoveHeaders(w.Header(), forward.HopHeaders...)
+	utils.RemoveHeaders(w.Header(), forward.ContentLength)
+
+	w.WriteHeader(authResp.StatusCode)
+	if _, err := io.Copy(w, io.LimitReader(authResp.Body, maxAuthBodyBytes)); err != nil {
+		fa.log.Errorf("vulcand/oxy/forwardauth: failed to copy auth response body, err: %v", err)
+	}
+}
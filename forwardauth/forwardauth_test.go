@@ -0,0 +1,175 @@
+package forwardauth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestForwardAuthApproved(t *testing.T) {
+	authSrv := testutils.NewRecorder(testutils.ScriptedResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-User": {"alice"}, "X-Ignored": {"value"}},
+	})
+	defer authSrv.Close()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-User", req.Header.Get("X-User"))
+		w.Header().Set("X-Ignored", req.Header.Get("X-Ignored"))
+		w.Write([]byte("hello"))
+	})
+	fa, err := New(next, authSrv.URL+"/verify", AuthResponseHeaders("X-User"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(fa)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL+"/path?q=1",
+		testutils.Header("Cookie", "session=1"),
+		testutils.Header("X-User", "forged"),
+		testutils.Header("X-Forwarded-Uri", "/forged"),
+		testutils.Header("Connection", "close"),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "alice", re.Header.Get("X-User"))
+	assert.Empty(t, re.Header.Get("X-Ignored"))
+
+	authSrv.AssertCount(t, 1)
+	authReq := authSrv.Last()
+	assert.Equal(t, http.MethodGet, authReq.Method)
+	assert.Equal(t, "/verify", authReq.RequestURI)
+	authReq.AssertHeader(t, "Cookie", "session=1")
+	authReq.AssertHeader(t, XForwardedMethod, http.MethodGet)
+	authReq.AssertHeader(t, XForwardedUri, "/path?q=1")
+	authReq.AssertHeader(t, "X-Forwarded-Proto", "http")
+	authReq.AssertHeader(t, "X-Forwarded-Host", re.Request.URL.Host)
+	authReq.AssertHeader(t, "X-Forwarded-For", "127.0.0.1")
+}
+
+func TestForwardAuthDenied(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		response testutils.ScriptedResponse
+	}{
+		{
+			desc: "unauthorized",
+			response: testutils.ScriptedResponse{
+				StatusCode: http.StatusUnauthorized,
+				Header:     http.Header{"Www-Authenticate": {`Basic realm="oxy"`}},
+				Body:       "denied",
+			},
+		},
+		{
+			desc: "redirect to the login page",
+			response: testutils.ScriptedResponse{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": {"http://login.local/"}, "Set-Cookie": {"state=42"}},
+				Body:       "denied",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			authSrv := testutils.NewRecorder(test.response)
+			defer authSrv.Close()
+
+			var called bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				called = true
+			})
+			fa, err := New(next, authSrv.URL)
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(fa)
+			defer srv.Close()
+
+			// the redirects must be returned as is
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			require.NoError(t, err)
+			re, err := http.DefaultTransport.RoundTrip(req)
+			require.NoError(t, err)
+			defer re.Body.Close()
+			body, err := ioutil.ReadAll(re.Body)
+			require.NoError(t, err)
+
+			assert.False(t, called)
+			assert.Equal(t, test.response.StatusCode, re.StatusCode)
+			assert.Equal(t, "denied", string(body))
+			for name := range test.response.Header {
+				assert.Equal(t, test.response.Header.Get(name), re.Header.Get(name))
+			}
+		})
+	}
+}
+
+func TestForwardAuthRequestHeaders(t *testing.T) {
+	authSrv := testutils.NewRecorder()
+	defer authSrv.Close()
+
+	fa, err := New(http.NotFoundHandler(), authSrv.URL, AuthRequestHeaders("Cookie"), TrustForwardHeader(true))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(fa)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL,
+		testutils.Header("Cookie", "session=1"),
+		testutils.Header("Authorization", "Bearer token"),
+		testutils.Header("X-Forwarded-Proto", "https"),
+		testutils.Header("X-Forwarded-For", "10.0.0.1"),
+	)
+	require.NoError(t, err)
+
+	authReq := authSrv.Last()
+	authReq.AssertHeader(t, "Cookie", "session=1")
+	authReq.AssertNoHeader(t, "Authorization")
+	authReq.AssertHeader(t, "X-Forwarded-Proto", "https")
+	authReq.AssertHeader(t, "X-Forwarded-For", "10.0.0.1, 127.0.0.1")
+}
+
+func TestForwardAuthServiceDown(t *testing.T) {
+	authSrv := testutils.NewRecorder(testutils.ScriptedResponse{Delay: 100 * time.Millisecond})
+	defer authSrv.Close()
+
+	var called bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	})
+	fa, err := New(next, authSrv.URL, Client(&http.Client{Timeout: 10 * time.Millisecond}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(fa)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.False(t, called)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+
+	fa, err = New(next, "http://localhost:63450")
+	require.NoError(t, err)
+	srv.Config.Handler = fa
+
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.False(t, called)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+}
+
+func TestForwardAuthInvalidAddress(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), "/verify")
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), "http://auth.local", Client(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,246 @@
+/*
+Package geoip provides a middleware granting or denying access to requests based on the country of the client,
+and exposing the country to the next handlers for routing and logging.
+
+The country is looked up with a Reader, the interface of the MaxMind DB readers: a *maxminddb.Reader
+(github.com/oschwald/maxminddb-golang) opened on a GeoIP2 or GeoLite2 Country or City database can be used
+directly, other sources are plugged with LookupFunc.
+
+Deny countries win over allow countries. When allow countries are configured, clients outside of them,
+and clients whose country is unknown, are rejected.
+
+Examples of a GeoIP filter:
+
+	db, err := maxminddb.Open("GeoLite2-Country.mmdb")
+
+	// only the clients from France and Belgium
+	g, err := geoip.New(handler, db, geoip.AllowCountries("FR", "BE"))
+
+	// no filtering, the country is passed to the backends
+	g, err := geoip.New(handler, db, geoip.CountryHeader("X-Country-Code"))
+*/
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Reader looks up the record of an IP address in a MaxMind DB formatted database, and decodes it into result
+type Reader interface {
+	Lookup(ip net.IP, result interface{}) error
+}
+
+// Record is the part of the GeoIP2 records decoded by the middleware
+type Record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// LookupFunc adapts a function returning the ISO 3166-1 alpha-2 country code of an IP address into a Reader,
+// an empty code means the country is unknown
+type LookupFunc func(ip net.IP) (string, error)
+
+// Lookup calls f and decodes the country code into result, a *Record
+func (f LookupFunc) Lookup(ip net.IP, result interface{}) error {
+	record, ok := result.(*Record)
+	if !ok {
+		return errors.New("geoip: LookupFunc only decodes into a *geoip.Record")
+	}
+	code, err := f(ip)
+	if err != nil {
+		return err
+	}
+	record.Country.ISOCode = code
+	return nil
+}
+
+type contextKey struct{}
+
+// CountryFromContext returns the country code of the client stored in ctx, it is not set when the country is unknown
+func CountryFromContext(ctx context.Context) (string, bool) {
+	code, ok := ctx.Value(contextKey{}).(string)
+	return code, ok
+}
+
+// GeoIP is a middleware filtering the requests on the country of the client
+type GeoIP struct {
+	next           http.Handler
+	reader         Reader
+	allow          map[string]bool
+	deny           map[string]bool
+	trustedProxies *utils.IPSet
+	header         string
+
+	rejectHandler http.Handler
+	log           *log.Logger
+}
+
+// Option is a functional option setter for GeoIP
+type Option func(g *GeoIP) error
+
+// New creates a new GeoIP middleware looking up the countries with reader
+func New(next http.Handler, reader Reader, opts ...Option) (*GeoIP, error) {
+	if reader == nil {
+		return nil, errors.New("reader can not be nil")
+	}
+	g := &GeoIP{
+		next:   next,
+		reader: reader,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(g); err != nil {
+			return nil, err
+		}
+	}
+	if g.rejectHandler == nil {
+		g.rejectHandler = http.HandlerFunc(forbidden)
+	}
+	return g, nil
+}
+
+// AllowCountries adds ISO 3166-1 alpha-2 country codes allowed to access the next handler,
+// all the other clients are rejected
+func AllowCountries(codes ...string) Option {
+	return func(g *GeoIP) error {
+		return addCountries(&g.allow, codes)
+	}
+}
+
+// DenyCountries adds ISO 3166-1 alpha-2 country codes rejected
+func DenyCountries(codes ...string) Option {
+	return func(g *GeoIP) error {
+		return addCountries(&g.deny, codes)
+	}
+}
+
+// TrustedProxies adds the IP addresses or CIDR ranges of the proxies whose X-Forwarded-For hops are trusted
+func TrustedProxies(ranges ...string) Option {
+	return func(g *GeoIP) error {
+		if g.trustedProxies == nil {
+			s, err := utils.NewIPSet()
+			if err != nil {
+				return err
+			}
+			g.trustedProxies = s
+		}
+		for _, r := range ranges {
+			if err := g.trustedProxies.Add(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// CountryHeader sets the request header passing the country code to the next handler.
+// The header sent by the client is always removed, the country is unknown when the header is missing.
+func CountryHeader(name string) Option {
+	return func(g *GeoIP) error {
+		if name == "" {
+			return errors.New("country header can not be empty")
+		}
+		g.header = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// RejectHandler sets the handler serving the rejected requests, it defaults to a 403 Forbidden response
+func RejectHandler(h http.Handler) Option {
+	return func(g *GeoIP) error {
+		g.rejectHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the GeoIP filter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(g *GeoIP) error {
+		g.log = l
+		return nil
+	}
+}
+
+func addCountries(set *map[string]bool, codes []string) error {
+	if *set == nil {
+		*set = make(map[string]bool)
+	}
+	for _, code := range codes {
+		if len(code) != 2 {
+			return fmt.Errorf("invalid country code %q, expected an ISO 3166-1 alpha-2 code", code)
+		}
+		(*set)[strings.ToUpper(code)] = true
+	}
+	return nil
+}
+
+// Wrap sets the next handler to be called by GeoIP handler.
+func (g *GeoIP) Wrap(next http.Handler) error {
+	g.next = next
+	return nil
+}
+
+func (g *GeoIP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if g.log.Level >= log.DebugLevel {
+		logEntry := g.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/geoip: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/geoip: completed ServeHttp on request")
+	}
+
+	code := g.country(req)
+	if g.deny[code] || g.allow != nil && !g.allow[code] {
+		if utils.Sampled(g.log, log.DebugLevel, "vulcand/oxy/geoip: rejecting request from %v, country %q") {
+			g.log.Debugf("vulcand/oxy/geoip: rejecting request from %v, country %q", req.RemoteAddr, code)
+		}
+		g.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+
+	outReq := req
+	if code != "" {
+		outReq = req.WithContext(context.WithValue(req.Context(), contextKey{}, code))
+	}
+	if g.header != "" {
+		if outReq == req {
+			outReq = req.WithContext(req.Context())
+		}
+		outReq.Header = utils.CloneHeaders(req.Header)
+		outReq.Header.Del(g.header)
+		if code != "" {
+			outReq.Header.Set(g.header, code)
+		}
+	}
+	g.next.ServeHTTP(w, outReq)
+}
+
+// country returns the country code of the client, or an empty string when it is unknown
+func (g *GeoIP) country(req *http.Request) string {
+	ip := utils.ClientIP(req, g.trustedProxies)
+	if ip == nil {
+		g.log.Warnf("vulcand/oxy/geoip: failed to parse client IP: %v", req.RemoteAddr)
+		return ""
+	}
+	var record Record
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		g.log.Warnf("vulcand/oxy/geoip: failed to look up %v: %v", ip, err)
+		return ""
+	}
+	return strings.ToUpper(record.Country.ISOCode)
+}
+
+func forbidden(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(http.StatusText(http.StatusForbidden)))
+}
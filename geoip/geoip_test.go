@@ -0,0 +1,152 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var countries = LookupFunc(func(ip net.IP) (string, error) {
+	switch ip.String() {
+	case "192.0.2.1":
+		return "fr", nil
+	case "198.51.100.1":
+		return "US", nil
+	case "203.0.113.1":
+		return "", errors.New("database error")
+	}
+	return "", nil
+})
+
+func TestGeoIP(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		opts         []Option
+		remoteAddr   string
+		forwardedFor string
+		expected     int
+		country      string
+	}{
+		{
+			desc:       "no rules",
+			remoteAddr: "192.0.2.1:1234",
+			expected:   http.StatusOK,
+			country:    "FR",
+		},
+		{
+			desc:       "allowed",
+			opts:       []Option{AllowCountries("FR", "BE")},
+			remoteAddr: "192.0.2.1:1234",
+			expected:   http.StatusOK,
+			country:    "FR",
+		},
+		{
+			desc:       "not allowed",
+			opts:       []Option{AllowCountries("FR", "BE")},
+			remoteAddr: "198.51.100.1:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:       "unknown country not allowed",
+			opts:       []Option{AllowCountries("FR")},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:       "lookup error not allowed",
+			opts:       []Option{AllowCountries("FR")},
+			remoteAddr: "203.0.113.1:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:       "denied",
+			opts:       []Option{DenyCountries("us")},
+			remoteAddr: "198.51.100.1:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:       "unknown country not denied",
+			opts:       []Option{DenyCountries("US")},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   http.StatusOK,
+		},
+		{
+			desc:       "deny wins over allow",
+			opts:       []Option{AllowCountries("FR"), DenyCountries("FR")},
+			remoteAddr: "192.0.2.1:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:         "forwarded for a trusted proxy",
+			opts:         []Option{DenyCountries("US"), TrustedProxies("10.0.0.0/8")},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "198.51.100.1",
+			expected:     http.StatusForbidden,
+		},
+		{
+			desc:         "forwarded for an untrusted proxy",
+			opts:         []Option{DenyCountries("US")},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "198.51.100.1",
+			expected:     http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var country string
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				country, _ = CountryFromContext(req.Context())
+			})
+			g, err := New(next, countries, test.opts...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", test.forwardedFor)
+			}
+			rec := httptest.NewRecorder()
+			g.ServeHTTP(rec, req)
+			assert.Equal(t, test.expected, rec.Code)
+			assert.Equal(t, test.country, country)
+		})
+	}
+}
+
+func TestGeoIPCountryHeader(t *testing.T) {
+	var header []string
+	g, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header["X-Country-Code"]
+	}), countries, CountryHeader("X-Country-Code"))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Country-Code", "US")
+	g.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []string{"FR"}, header)
+	assert.Equal(t, "US", req.Header.Get("X-Country-Code"), "the incoming request is not modified")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Country-Code", "US")
+	g.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, header, "the spoofed header is removed")
+}
+
+func TestGeoIPInvalidOptions(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), nil)
+	assert.Error(t, err)
+
+	for _, opt := range []Option{AllowCountries("FRA"), DenyCountries(""), TrustedProxies("nope"), CountryHeader("")} {
+		_, err := New(http.NotFoundHandler(), countries, opt)
+		assert.Error(t, err)
+	}
+}
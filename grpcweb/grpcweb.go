@@ -0,0 +1,315 @@
+/*
+Package grpcweb provides a middleware translating the gRPC-Web requests of the browsers into native gRPC requests,
+so that the browser clients reach the gRPC servers through the proxy.
+
+The gRPC-Web and gRPC-Web-Text (base64 encoded) requests are converted to gRPC requests, the other requests are
+passed through. The gRPC responses are converted back: their trailers, e.g. grpc-status, are sent as a trailer frame
+at the end of the body, as the browsers can not read the HTTP trailers.
+
+The next handler has to send the gRPC requests over HTTP/2, e.g. a forwarder using a golang.org/x/net/http2
+transport. The browsers need CORS to call a gRPC-Web endpoint of another origin, the grpc-status and grpc-message
+headers should be exposed.
+
+Examples of a gRPC-Web translation:
+
+	fwd, err := forward.New(forward.RoundTripper(&http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}))
+	g, err := grpcweb.New(fwd)
+*/
+package grpcweb
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	contentTypeGRPC        = "application/grpc"
+	contentTypeGRPCWeb     = "application/grpc-web"
+	contentTypeGRPCWebText = "application/grpc-web-text"
+
+	// trailerFrame flags a gRPC-Web frame holding the trailers
+	trailerFrame byte = 0x80
+)
+
+// GRPCWeb is a middleware translating the gRPC-Web requests into gRPC requests
+type GRPCWeb struct {
+	next http.Handler
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for GRPCWeb
+type Option func(g *GRPCWeb) error
+
+// New creates a new GRPCWeb middleware
+func New(next http.Handler, opts ...Option) (*GRPCWeb, error) {
+	g := &GRPCWeb{
+		next: next,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(g); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Logger defines the logger the gRPC-Web translation will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(g *GRPCWeb) error {
+		g.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by gRPC-Web handler.
+func (g *GRPCWeb) Wrap(next http.Handler) error {
+	g.next = next
+	return nil
+}
+
+// IsGRPCWebRequest tells whether the request is a gRPC-Web or gRPC-Web-Text request
+func IsGRPCWebRequest(req *http.Request) bool {
+	return req.Method == http.MethodPost && strings.HasPrefix(req.Header.Get("Content-Type"), contentTypeGRPCWeb)
+}
+
+func (g *GRPCWeb) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if g.log.Level >= log.DebugLevel {
+		logEntry := g.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/grpcweb: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/grpcweb: completed ServeHttp on request")
+	}
+
+	if !IsGRPCWebRequest(req) {
+		g.next.ServeHTTP(w, req)
+		return
+	}
+
+	// e.g. application/grpc-web-text+proto, the suffix is the codec of the messages
+	contentType := req.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, contentTypeGRPCWebText)
+	codec := strings.TrimPrefix(strings.TrimPrefix(contentType, contentTypeGRPCWebText), contentTypeGRPCWeb)
+
+	outReq := req.WithContext(req.Context())
+	outReq.Header = utils.CloneHeaders(req.Header)
+	outReq.Header.Set("Content-Type", contentTypeGRPC+codec)
+	outReq.Header.Set("Te", "trailers")
+	outReq.Header.Del("X-Grpc-Web")
+	outReq.Header.Del("Content-Length")
+	outReq.ContentLength = -1
+	outReq.ProtoMajor, outReq.ProtoMinor, outReq.Proto = 2, 0, "HTTP/2.0"
+	if text {
+		outReq.Body = &textReader{r: req.Body, closer: req.Body}
+	}
+
+	responseType := contentTypeGRPCWeb
+	if text {
+		responseType = contentTypeGRPCWebText
+	}
+	gw := &responseWriter{w: w, contentType: responseType + codec, text: text}
+	g.next.ServeHTTP(gw, outReq)
+	if err := gw.finish(); err != nil {
+		g.log.Debugf("vulcand/oxy/grpcweb: failed to write the trailers, err: %v", err)
+	}
+}
+
+// textReader decodes a gRPC-Web-Text body: base64 chunks, each one possibly padded
+type textReader struct {
+	r       io.Reader
+	closer  io.Closer
+	buf     []byte
+	quantum []byte
+	decoded []byte
+	err     error
+}
+
+func (t *textReader) Read(p []byte) (int, error) {
+	if t.buf == nil {
+		t.buf = make([]byte, 4096)
+	}
+	for len(t.decoded) == 0 {
+		if t.err != nil {
+			if t.err == io.EOF && len(t.quantum) != 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, t.err
+		}
+		n, err := t.r.Read(t.buf)
+		t.err = err
+		for _, c := range t.buf[:n] {
+			if c == '\r' || c == '\n' || c == ' ' || c == '\t' {
+				continue
+			}
+			t.quantum = append(t.quantum, c)
+			if len(t.quantum) < 4 {
+				continue
+			}
+			// the quanta are decoded one by one, a padded quantum ends a chunk
+			var decoded [3]byte
+			m, err := base64.StdEncoding.Decode(decoded[:], t.quantum)
+			if err != nil {
+				t.err = fmt.Errorf("grpcweb: invalid base64 body: %v", err)
+				break
+			}
+			t.decoded = append(t.decoded, decoded[:m]...)
+			t.quantum = t.quantum[:0]
+		}
+	}
+	n := copy(p, t.decoded)
+	t.decoded = t.decoded[n:]
+	return n, nil
+}
+
+func (t *textReader) Close() error {
+	return t.closer.Close()
+}
+
+// responseWriter converts a gRPC response into a gRPC-Web response
+type responseWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	text        bool
+	wroteHeader bool
+	hijacked    bool
+	trailers    []string
+	headerSent  map[string]bool
+}
+
+func (gw *responseWriter) Header() http.Header {
+	return gw.w.Header()
+}
+
+func (gw *responseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	h := gw.w.Header()
+	for _, v := range h["Trailer"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				gw.trailers = append(gw.trailers, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	h.Del("Trailer")
+	h.Del("Content-Length")
+	// a trailers-only response holds the gRPC status in its headers
+	gw.headerSent = make(map[string]bool, len(h))
+	for k := range h {
+		gw.headerSent[k] = true
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), contentTypeGRPC) {
+		h.Set("Content-Type", gw.contentType)
+	}
+	gw.w.WriteHeader(code)
+}
+
+func (gw *responseWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if !gw.text {
+		return gw.w.Write(b)
+	}
+	if _, err := gw.w.Write([]byte(base64.StdEncoding.EncodeToString(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// finish writes the trailers of the gRPC response as a trailer frame
+func (gw *responseWriter) finish() error {
+	if gw.hijacked {
+		return nil
+	}
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	h := gw.w.Header()
+	trailers := make(http.Header)
+	for _, name := range gw.trailers {
+		if v, ok := h[name]; ok && !gw.headerSent[name] {
+			trailers[name] = v
+		}
+		h.Del(name)
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+			h.Del(k)
+		}
+	}
+	if len(trailers) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(trailers))
+	for name := range trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var block []byte
+	for _, name := range names {
+		for _, v := range trailers[name] {
+			block = append(block, strings.ToLower(name)+": "+v+"\r\n"...)
+		}
+	}
+	frame := make([]byte, 5, 5+len(block))
+	frame[0] = trailerFrame
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(block)))
+	frame = append(frame, block...)
+	if _, err := gw.Write(frame); err != nil {
+		return err
+	}
+	gw.Flush()
+	return nil
+}
+
+// Flush sends any buffered data to the client
+func (gw *responseWriter) Flush() {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if fl, ok := gw.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack hijacks the connection
+func (gw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := gw.w.(http.Hijacker); ok {
+		gw.hijacked = true
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this grpcweb middleware does not implement http.Hijacker(type: %T)", gw.w)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (gw *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := gw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
@@ -0,0 +1,139 @@
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// frame returns a gRPC data frame holding the message
+func frame(msg string) []byte {
+	f := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(f[1:], uint32(len(msg)))
+	return append(f, msg...)
+}
+
+// trailers returns a gRPC-Web trailer frame
+func trailers(block string) []byte {
+	f := frame(block)
+	f[0] = trailerFrame
+	return f
+}
+
+// newGRPCWeb returns a gRPC-Web server translating the requests toward a gRPC server over h2c
+func newGRPCWeb(t *testing.T, handler http.HandlerFunc) (*httptest.Server, func()) {
+	backend := testutils.NewH2CServer(handler)
+
+	fwd, err := forward.New(forward.RoundTripper(testutils.NewH2CTransport()))
+	require.NoError(t, err)
+	g, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	}))
+	require.NoError(t, err)
+	srv := httptest.NewServer(g)
+	return srv, func() {
+		srv.Close()
+		backend.Close()
+	}
+}
+
+// echo is a gRPC server echoing the message of the request
+func echo(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, 2, req.ProtoMajor)
+		assert.Equal(t, "application/grpc+proto", req.Header.Get("Content-Type"))
+		assert.Empty(t, req.Header.Get("X-Grpc-Web"))
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "OK")
+	}
+}
+
+func TestGRPCWeb(t *testing.T) {
+	srv, closeAll := newGRPCWeb(t, echo(t))
+	defer closeAll()
+
+	re, body, err := testutils.Post(srv.URL, testutils.Body(string(frame("hello"))),
+		testutils.Header("Content-Type", "application/grpc-web+proto"), testutils.Header("X-Grpc-Web", "1"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "application/grpc-web+proto", re.Header.Get("Content-Type"))
+	expected := append(frame("hello"), trailers("grpc-message: OK\r\ngrpc-status: 0\r\n")...)
+	assert.Equal(t, expected, body)
+	assert.Empty(t, re.Trailer)
+}
+
+func TestGRPCWebText(t *testing.T) {
+	srv, closeAll := newGRPCWeb(t, echo(t))
+	defer closeAll()
+
+	// the body is made of two padded base64 chunks
+	msg := frame("hello world")
+	reqBody := base64.StdEncoding.EncodeToString(msg[:7]) + base64.StdEncoding.EncodeToString(msg[7:])
+	re, body, err := testutils.Post(srv.URL, testutils.Body(reqBody),
+		testutils.Header("Content-Type", "application/grpc-web-text+proto"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "application/grpc-web-text+proto", re.Header.Get("Content-Type"))
+
+	decoded, err := ioutil.ReadAll(&textReader{r: bytes.NewReader(body), closer: ioutil.NopCloser(nil)})
+	require.NoError(t, err)
+	expected := append(frame("hello world"), trailers("grpc-message: OK\r\ngrpc-status: 0\r\n")...)
+	assert.Equal(t, expected, decoded)
+}
+
+func TestGRPCWebTrailersOnly(t *testing.T) {
+	srv, closeAll := newGRPCWeb(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "12")
+		w.Header().Set("Grpc-Message", "unimplemented")
+		w.WriteHeader(http.StatusOK)
+	})
+	defer closeAll()
+
+	re, body, err := testutils.Post(srv.URL, testutils.Body(string(frame(""))),
+		testutils.Header("Content-Type", "application/grpc-web"))
+	require.NoError(t, err)
+	assert.Equal(t, "application/grpc-web", re.Header.Get("Content-Type"))
+	assert.Equal(t, "12", re.Header.Get("Grpc-Status"))
+	assert.Empty(t, body)
+}
+
+func TestGRPCWebPassThrough(t *testing.T) {
+	g, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		w.Write([]byte("plain"))
+	}))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	assert.Equal(t, "plain", rec.Body.String())
+}
+
+func TestTextReaderInvalid(t *testing.T) {
+	_, err := ioutil.ReadAll(&textReader{r: strings.NewReader("a*b="), closer: ioutil.NopCloser(nil)})
+	assert.Error(t, err)
+
+	_, err = ioutil.ReadAll(&textReader{r: strings.NewReader("YWJj\nYQ"), closer: ioutil.NopCloser(nil)})
+	assert.Error(t, err, "truncated quantum")
+}
@@ -0,0 +1,340 @@
+/*
+Package headers provides a middleware adding, setting, removing and renaming request and response headers.
+
+Header values are text/template templates executed with a Request, so they can reference the attributes
+of the request. The operations are applied in the order they are declared.
+
+Examples of a headers middleware:
+
+	h, err := headers.New(handler,
+		headers.SetRequestHeader("X-Client-Ip", "{{.ClientIP}}"),
+		headers.RenameRequestHeader("X-Token", "Authorization"),
+		headers.RemoveResponseHeaders("Server", "X-Powered-By"),
+		headers.AddResponseHeader("X-Served-For", `{{.Host}}{{.Path}}`),
+	)
+*/
+package headers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/requestid"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Request is the data the header value templates are executed with
+type Request struct {
+	req *http.Request
+}
+
+// Method returns the method of the request
+func (r Request) Method() string {
+	return r.req.Method
+}
+
+// Host returns the host of the request
+func (r Request) Host() string {
+	return r.req.Host
+}
+
+// Path returns the path of the request
+func (r Request) Path() string {
+	return r.req.URL.Path
+}
+
+// RequestURI returns the path and the query of the request
+func (r Request) RequestURI() string {
+	return r.req.URL.RequestURI()
+}
+
+// Scheme returns the scheme of the request, http or https
+func (r Request) Scheme() string {
+	if r.req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RemoteAddr returns the network address of the client
+func (r Request) RemoteAddr() string {
+	return r.req.RemoteAddr
+}
+
+// ClientIP returns the IP address of the client
+func (r Request) ClientIP() string {
+	if ip := utils.ClientIP(r.req, nil); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Header returns the first value of a request header
+func (r Request) Header(name string) string {
+	return r.req.Header.Get(name)
+}
+
+// Query returns the first value of a query parameter
+func (r Request) Query(name string) string {
+	return r.req.URL.Query().Get(name)
+}
+
+// RequestID returns the ID set by the requestid middleware
+func (r Request) RequestID() string {
+	id, _ := requestid.FromContext(r.req.Context())
+	return id
+}
+
+var emptyRequest = Request{req: &http.Request{URL: &url.URL{}, Header: http.Header{}}}
+
+type operationKind int
+
+const (
+	opAdd operationKind = iota
+	opSet
+	opRemove
+	opRename
+)
+
+type operation struct {
+	kind  operationKind
+	name  string
+	to    string
+	value *template.Template
+}
+
+func (o operation) apply(h http.Header, data Request) error {
+	switch o.kind {
+	case opAdd, opSet:
+		buf := &bytes.Buffer{}
+		if err := o.value.Execute(buf, data); err != nil {
+			return err
+		}
+		if o.kind == opAdd {
+			h.Add(o.name, buf.String())
+		} else {
+			h.Set(o.name, buf.String())
+		}
+	case opRemove:
+		h.Del(o.name)
+	case opRename:
+		if values, ok := h[http.CanonicalHeaderKey(o.name)]; ok {
+			h.Del(o.name)
+			h[http.CanonicalHeaderKey(o.to)] = values
+		}
+	}
+	return nil
+}
+
+// Headers is a middleware manipulating request and response headers
+type Headers struct {
+	next     http.Handler
+	request  []operation
+	response []operation
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Headers
+type Option func(h *Headers) error
+
+// New creates a new Headers middleware
+func New(next http.Handler, opts ...Option) (*Headers, error) {
+	h := &Headers{
+		next: next,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// AddRequestHeader adds a value to a request header
+func AddRequestHeader(name, value string) Option {
+	return valueOption(opAdd, false, name, value)
+}
+
+// SetRequestHeader replaces the values of a request header
+func SetRequestHeader(name, value string) Option {
+	return valueOption(opSet, false, name, value)
+}
+
+// RemoveRequestHeaders removes request headers
+func RemoveRequestHeaders(names ...string) Option {
+	return removeOption(false, names)
+}
+
+// RenameRequestHeader renames a request header, keeping its values
+func RenameRequestHeader(from, to string) Option {
+	return renameOption(false, from, to)
+}
+
+// AddResponseHeader adds a value to a response header
+func AddResponseHeader(name, value string) Option {
+	return valueOption(opAdd, true, name, value)
+}
+
+// SetResponseHeader replaces the values of a response header
+func SetResponseHeader(name, value string) Option {
+	return valueOption(opSet, true, name, value)
+}
+
+// RemoveResponseHeaders removes response headers
+func RemoveResponseHeaders(names ...string) Option {
+	return removeOption(true, names)
+}
+
+// RenameResponseHeader renames a response header, keeping its values
+func RenameResponseHeader(from, to string) Option {
+	return renameOption(true, from, to)
+}
+
+// Logger defines the logger the headers middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(h *Headers) error {
+		h.log = l
+		return nil
+	}
+}
+
+func valueOption(kind operationKind, response bool, name, value string) Option {
+	return func(h *Headers) error {
+		if name == "" {
+			return fmt.Errorf("header name can not be empty")
+		}
+		tmpl, err := template.New(name).Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid value template for header %s: %v", name, err)
+		}
+		// fields and methods that do not exist are only reported by the execution of the template
+		if err := tmpl.Execute(ioutil.Discard, emptyRequest); err != nil {
+			return fmt.Errorf("invalid value template for header %s: %v", name, err)
+		}
+		h.add(response, operation{kind: kind, name: name, value: tmpl})
+		return nil
+	}
+}
+
+func removeOption(response bool, names []string) Option {
+	return func(h *Headers) error {
+		for _, name := range names {
+			h.add(response, operation{kind: opRemove, name: name})
+		}
+		return nil
+	}
+}
+
+func renameOption(response bool, from, to string) Option {
+	return func(h *Headers) error {
+		if from == "" || to == "" {
+			return fmt.Errorf("header names can not be empty")
+		}
+		h.add(response, operation{kind: opRename, name: from, to: to})
+		return nil
+	}
+}
+
+func (h *Headers) add(response bool, op operation) {
+	if response {
+		h.response = append(h.response, op)
+	} else {
+		h.request = append(h.request, op)
+	}
+}
+
+// Wrap sets the next handler to be called by headers handler.
+func (h *Headers) Wrap(next http.Handler) error {
+	h.next = next
+	return nil
+}
+
+func (h *Headers) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.log.Level >= log.DebugLevel {
+		logEntry := h.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/headers: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/headers: completed ServeHttp on request")
+	}
+
+	data := Request{req: req}
+	h.applyAll(h.request, req.Header, data)
+
+	if len(h.response) == 0 {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	hw := &headersWriter{w: w, headers: h, data: data}
+	h.next.ServeHTTP(hw, req)
+}
+
+func (h *Headers) applyAll(ops []operation, header http.Header, data Request) {
+	for _, op := range ops {
+		if err := op.apply(header, data); err != nil {
+			h.log.Errorf("vulcand/oxy/headers: failed to execute the value template of header %s, err: %v", op.name, err)
+		}
+	}
+}
+
+// headersWriter applies the response operations right before the headers are sent
+type headersWriter struct {
+	w           http.ResponseWriter
+	headers     *Headers
+	data        Request
+	wroteHeader bool
+}
+
+func (hw *headersWriter) Header() http.Header {
+	return hw.w.Header()
+}
+
+func (hw *headersWriter) WriteHeader(code int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		hw.headers.applyAll(hw.headers.response, hw.w.Header(), hw.data)
+	}
+	hw.w.WriteHeader(code)
+}
+
+func (hw *headersWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.w.Write(p)
+}
+
+func (hw *headersWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := hw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection
+func (hw *headersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := hw.w.(http.Hijacker); ok {
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this headers middleware does not implement http.Hijacker(type: %T)", hw.w)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (hw *headersWriter) CloseNotify() <-chan bool {
+	if cn, ok := hw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
@@ -0,0 +1,118 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/requestid"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRequestHeaders(t *testing.T) {
+	var upstream http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream = req.Header
+	})
+
+	h, err := New(handler,
+		AddRequestHeader("X-Added", "{{.Method}} {{.RequestURI}}"),
+		SetRequestHeader("X-Set", `{{.Header "X-Source"}}-{{.Query "q"}}`),
+		SetRequestHeader("X-Client", "{{.ClientIP}}"),
+		RemoveRequestHeaders("X-Removed", "X-Missing"),
+		RenameRequestHeader("X-Token", "Authorization"),
+	)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL+"/path?q=1",
+		testutils.Header("X-Added", "first"),
+		testutils.Header("X-Set", "replaced"),
+		testutils.Header("X-Source", "src"),
+		testutils.Header("X-Removed", "value"),
+		testutils.Header("X-Token", "Bearer abc"),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"first", "GET /path?q=1"}, upstream["X-Added"])
+	assert.Equal(t, []string{"src-1"}, upstream["X-Set"])
+	assert.Equal(t, "127.0.0.1", upstream.Get("X-Client"))
+	assert.Empty(t, upstream.Get("X-Removed"))
+	assert.Empty(t, upstream.Get("X-Token"))
+	assert.Equal(t, "Bearer abc", upstream.Get("Authorization"))
+}
+
+func TestResponseHeaders(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "upstream")
+		w.Header().Set("X-Internal", "42")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	h, err := New(handler,
+		RemoveResponseHeaders("Server"),
+		RenameResponseHeader("X-Internal", "X-Public"),
+		SetResponseHeader("X-Served-For", "{{.Host}}{{.Path}}"),
+		AddResponseHeader("X-Request-Id", "{{.RequestID}}"),
+	)
+	require.NoError(t, err)
+
+	rid, err := requestid.New(h, requestid.Header("X-Id"), requestid.IDGenerator(func() (string, error) {
+		return "id-1", nil
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL+"/path", testutils.Host("example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Empty(t, re.Header.Get("Server"))
+	assert.Empty(t, re.Header.Get("X-Internal"))
+	assert.Equal(t, "42", re.Header.Get("X-Public"))
+	assert.Equal(t, "example.com/path", re.Header.Get("X-Served-For"))
+	assert.Equal(t, "id-1", re.Header.Get("X-Request-Id"))
+}
+
+func TestResponseHeadersImplicitWriteHeader(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	h, err := New(handler, SetResponseHeader("X-Scheme", "{{.Scheme}}"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "http", re.Header.Get("X-Scheme"))
+}
+
+func TestInvalidOptions(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opt  Option
+	}{
+		{desc: "syntax error", opt: SetRequestHeader("X-Test", "{{.Host")},
+		{desc: "unknown attribute", opt: SetResponseHeader("X-Test", "{{.Unknown}}")},
+		{desc: "empty name", opt: AddRequestHeader("", "value")},
+		{desc: "empty rename", opt: RenameResponseHeader("X-Test", "")},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(http.NotFoundHandler(), test.opt)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Package health provides the liveness and readiness endpoints of the proxy itself, so that the orchestrators gate the
+traffic on the actual state of the proxy.
+
+The liveness endpoint replies 200 as long as the process serves HTTP. The readiness endpoint runs the checks of the
+registered components, e.g. the load balancer has servers, the circuit breaker is not tripped, the storage of the
+limiter is reachable, and replies 200 when all of them pass, 503 otherwise, with the state of each component.
+Shutdown marks the proxy as not ready, so that it is taken out of the rotation before it stops.
+
+Examples of health endpoints:
+
+	h, err := health.New(
+		health.Component("balancer", health.Servers(lb)),
+		health.Component("breaker", health.Breaker(cb)),
+		health.Component("storage", health.CheckerFunc(func(ctx context.Context) error {
+			return store.Ping(ctx)
+		})),
+		health.Timeout(2*time.Second))
+
+	mux.Handle("/healthz", h.Liveness())
+	mux.Handle("/readyz", h.Readiness())
+*/
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultTimeout is the time the checks of the components have to complete
+const DefaultTimeout = 5 * time.Second
+
+// ErrShutdown is the reason the proxy is not ready after Shutdown
+var ErrShutdown = errors.New("shutting down")
+
+// Checker checks the health of a component, it returns an error when the component is not ready
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc is an adapter to use a function as a Checker
+type CheckerFunc func(ctx context.Context) error
+
+// Check calls f(ctx)
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Servers checks that a load balancer, e.g. a roundrobin.RoundRobin or a roundrobin.Rebalancer, has servers
+func Servers(lb interface {
+	Servers() []*url.URL
+}) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if len(lb.Servers()) == 0 {
+			return errors.New("no servers")
+		}
+		return nil
+	})
+}
+
+// Breaker checks that a circuit breaker, e.g. a cbreaker.CircuitBreaker, is not tripped
+func Breaker(cb interface {
+	Tripped() bool
+}) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if cb.Tripped() {
+			return errors.New("circuit breaker tripped")
+		}
+		return nil
+	})
+}
+
+// Health exposes the liveness and readiness of the proxy
+type Health struct {
+	timeout  time.Duration
+	shutdown int32
+
+	mutex      sync.RWMutex
+	components map[string]Checker
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Health
+type Option func(h *Health) error
+
+// New creates new health endpoints
+func New(opts ...Option) (*Health, error) {
+	h := &Health{
+		timeout:    DefaultTimeout,
+		components: make(map[string]Checker),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Component registers a component checked by the readiness endpoint, see Register
+func Component(name string, c Checker) Option {
+	return func(h *Health) error {
+		return h.Register(name, c)
+	}
+}
+
+// Timeout sets the time the checks of the components have to complete, a check still running is failed.
+// It defaults to DefaultTimeout.
+func Timeout(d time.Duration) Option {
+	return func(h *Health) error {
+		if d <= 0 {
+			return fmt.Errorf("timeout should be > 0, got %v", d)
+		}
+		h.timeout = d
+		return nil
+	}
+}
+
+// Logger defines the logger the health endpoints will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(h *Health) error {
+		h.log = l
+		return nil
+	}
+}
+
+// Register adds a component checked by the readiness endpoint, or replaces it
+func (h *Health) Register(name string, c Checker) error {
+	if name == "" {
+		return errors.New("component name can not be empty")
+	}
+	if c == nil {
+		return fmt.Errorf("component %s: checker can not be nil", name)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.components[name] = c
+	return nil
+}
+
+// Deregister removes a component
+func (h *Health) Deregister(name string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.components[name]; !ok {
+		return fmt.Errorf("component %s not found", name)
+	}
+	delete(h.components, name)
+	return nil
+}
+
+// Shutdown marks the proxy as not ready, the readiness endpoint replies 503 from now on
+func (h *Health) Shutdown() {
+	atomic.StoreInt32(&h.shutdown, 1)
+}
+
+// Status is the readiness of the proxy exposed by the readiness endpoint
+type Status struct {
+	Ready bool `json:"ready"`
+	// Reason is set when the proxy is shutting down
+	Reason string `json:"reason,omitempty"`
+	// Components are the states of the components, "ok" or the error of their check
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// Check runs the checks of the components concurrently and returns the readiness of the proxy
+func (h *Health) Check(ctx context.Context) Status {
+	if atomic.LoadInt32(&h.shutdown) == 1 {
+		return Status{Reason: ErrShutdown.Error()}
+	}
+
+	h.mutex.RLock()
+	names := make([]string, 0, len(h.components))
+	checkers := make([]Checker, 0, len(h.components))
+	for name := range h.components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checkers = append(checkers, h.components[name])
+	}
+	h.mutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	errs := make([]error, len(checkers))
+	var wg sync.WaitGroup
+	for i, c := range checkers {
+		wg.Add(1)
+		go func(i int, c Checker) {
+			defer wg.Done()
+			errs[i] = run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	status := Status{Ready: true, Components: make(map[string]string, len(names))}
+	for i, name := range names {
+		if errs[i] != nil {
+			status.Ready = false
+			status.Components[name] = errs[i].Error()
+			h.log.Debugf("vulcand/oxy/health: component %s not ready: %v", name, errs[i])
+			continue
+		}
+		status.Components[name] = "ok"
+	}
+	return status
+}
+
+// run calls the checker, it gives up when the context is done before the check returns
+func run(ctx context.Context, c Checker) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Liveness returns the handler of the liveness endpoint, it replies 200 as long as the proxy serves requests
+func (h *Health) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// Readiness returns the handler of the readiness endpoint, it replies 200 when all the components are ready,
+// 503 otherwise, with the Status as JSON
+func (h *Health) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := h.Check(req.Context())
+		code := http.StatusOK
+		if !status.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		if req.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,111 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/testutils"
+)
+
+type breaker bool
+
+func (b breaker) Tripped() bool { return bool(b) }
+
+func readiness(t *testing.T, h *Health) (int, Status) {
+	rec := httptest.NewRecorder()
+	h.Readiness().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var status Status
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	return rec.Code, status
+}
+
+func TestReadiness(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	lb, err := roundrobin.New(fwd)
+	require.NoError(t, err)
+
+	h, err := New(
+		Component("balancer", Servers(lb)),
+		Component("breaker", Breaker(breaker(false))))
+	require.NoError(t, err)
+
+	code, status := readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, status.Ready)
+	assert.Equal(t, map[string]string{"balancer": "no servers", "breaker": "ok"}, status.Components)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:8080")))
+	code, status = readiness(t, h)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Ready)
+	assert.Equal(t, map[string]string{"balancer": "ok", "breaker": "ok"}, status.Components)
+
+	require.NoError(t, h.Register("breaker", Breaker(breaker(true))))
+	code, status = readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "circuit breaker tripped", status.Components["breaker"])
+
+	require.NoError(t, h.Deregister("breaker"))
+	assert.Error(t, h.Deregister("breaker"))
+	code, _ = readiness(t, h)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	h, err := New(
+		Component("storage", CheckerFunc(func(ctx context.Context) error {
+			<-block
+			return nil
+		})),
+		Component("cache", CheckerFunc(func(ctx context.Context) error {
+			return errors.New("connection refused")
+		})),
+		Timeout(50*time.Millisecond))
+	require.NoError(t, err)
+
+	code, status := readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, context.DeadlineExceeded.Error(), status.Components["storage"])
+	assert.Equal(t, "connection refused", status.Components["cache"])
+}
+
+func TestShutdown(t *testing.T) {
+	h, err := New()
+	require.NoError(t, err)
+
+	code, status := readiness(t, h)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Ready)
+
+	h.Shutdown()
+	code, status = readiness(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, Status{Reason: "shutting down"}, status)
+
+	rec := httptest.NewRecorder()
+	h.Liveness().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok\n", rec.Body.String())
+}
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := New(Component("", CheckerFunc(func(ctx context.Context) error { return nil })))
+	assert.Error(t, err)
+	_, err = New(Component("storage", nil))
+	assert.Error(t, err)
+	_, err = New(Timeout(0))
+	assert.Error(t, err)
+}
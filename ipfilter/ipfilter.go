@@ -0,0 +1,142 @@
+/*
+Package ipfilter provides a middleware granting or denying access to requests based on the IP address of the client.
+
+Deny ranges win over allow ranges. When allow ranges are configured, clients outside of them are rejected.
+Behind proxies, the client address is resolved from the X-Forwarded-For header, only the hops added by the
+trusted proxies are taken into account.
+
+Examples of an IP filter:
+
+	// private networks only
+	f, err := ipfilter.New(handler, ipfilter.Allow("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"))
+
+	// behind a load balancer, a range is banned
+	f, err := ipfilter.New(handler, ipfilter.Deny("203.0.113.0/24"), ipfilter.TrustedProxies("10.0.0.0/8"))
+*/
+package ipfilter
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// IPFilter is a middleware filtering the requests on the client IP address
+type IPFilter struct {
+	next           http.Handler
+	allow          *utils.IPSet
+	deny           *utils.IPSet
+	trustedProxies *utils.IPSet
+
+	rejectHandler http.Handler
+	log           *log.Logger
+}
+
+// Option is a functional option setter for IPFilter
+type Option func(f *IPFilter) error
+
+// New creates a new IPFilter middleware
+func New(next http.Handler, opts ...Option) (*IPFilter, error) {
+	f := &IPFilter{
+		next: next,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(f); err != nil {
+			return nil, err
+		}
+	}
+	if f.rejectHandler == nil {
+		f.rejectHandler = http.HandlerFunc(forbidden)
+	}
+	return f, nil
+}
+
+// Allow adds IP addresses or CIDR ranges allowed to access the next handler, all the other clients are rejected
+func Allow(ranges ...string) Option {
+	return func(f *IPFilter) error {
+		return addRanges(&f.allow, ranges)
+	}
+}
+
+// Deny adds IP addresses or CIDR ranges rejected
+func Deny(ranges ...string) Option {
+	return func(f *IPFilter) error {
+		return addRanges(&f.deny, ranges)
+	}
+}
+
+// TrustedProxies adds the IP addresses or CIDR ranges of the proxies whose X-Forwarded-For hops are trusted
+func TrustedProxies(ranges ...string) Option {
+	return func(f *IPFilter) error {
+		return addRanges(&f.trustedProxies, ranges)
+	}
+}
+
+// RejectHandler sets the handler serving the rejected requests, it defaults to a 403 Forbidden response
+func RejectHandler(h http.Handler) Option {
+	return func(f *IPFilter) error {
+		f.rejectHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the IP filter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(f *IPFilter) error {
+		f.log = l
+		return nil
+	}
+}
+
+func addRanges(set **utils.IPSet, ranges []string) error {
+	if *set == nil {
+		s, err := utils.NewIPSet()
+		if err != nil {
+			return err
+		}
+		*set = s
+	}
+	for _, r := range ranges {
+		if err := (*set).Add(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wrap sets the next handler to be called by IP filter handler.
+func (f *IPFilter) Wrap(next http.Handler) error {
+	f.next = next
+	return nil
+}
+
+func (f *IPFilter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.log.Level >= log.DebugLevel {
+		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/ipfilter: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/ipfilter: completed ServeHttp on request")
+	}
+
+	ip := utils.ClientIP(req, f.trustedProxies)
+	if ip == nil {
+		f.log.Warnf("vulcand/oxy/ipfilter: failed to parse client IP: %v", req.RemoteAddr)
+		f.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+	if f.deny != nil && f.deny.Contains(ip) || f.allow != nil && !f.allow.Contains(ip) {
+		f.log.Debugf("vulcand/oxy/ipfilter: rejecting request from %v", ip)
+		f.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+	f.next.ServeHTTP(w, req)
+}
+
+func forbidden(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(http.StatusText(http.StatusForbidden)))
+}
@@ -0,0 +1,120 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFilter(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		opts         []Option
+		remoteAddr   string
+		forwardedFor string
+		expected     int
+	}{
+		{
+			desc:       "no rules",
+			remoteAddr: "1.2.3.4:1234",
+			expected:   http.StatusOK,
+		},
+		{
+			desc:       "allowed",
+			opts:       []Option{Allow("10.0.0.0/8")},
+			remoteAddr: "10.1.2.3:1234",
+			expected:   http.StatusOK,
+		},
+		{
+			desc:       "not allowed",
+			opts:       []Option{Allow("10.0.0.0/8")},
+			remoteAddr: "1.2.3.4:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:       "denied",
+			opts:       []Option{Deny("1.2.3.0/24")},
+			remoteAddr: "1.2.3.4:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:       "deny wins over allow",
+			opts:       []Option{Allow("10.0.0.0/8"), Deny("10.1.0.0/16")},
+			remoteAddr: "10.1.2.3:1234",
+			expected:   http.StatusForbidden,
+		},
+		{
+			desc:       "ipv6",
+			opts:       []Option{Allow("2001:db8::/32")},
+			remoteAddr: "[2001:db8::1]:1234",
+			expected:   http.StatusOK,
+		},
+		{
+			desc:         "forwarded for an untrusted proxy",
+			opts:         []Option{Deny("1.2.3.4")},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "1.2.3.4",
+			expected:     http.StatusOK,
+		},
+		{
+			desc:         "forwarded for a trusted proxy",
+			opts:         []Option{Deny("1.2.3.4"), TrustedProxies("10.0.0.0/8")},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "1.2.3.4",
+			expected:     http.StatusForbidden,
+		},
+		{
+			desc:         "spoofed forwarded for",
+			opts:         []Option{Allow("5.6.7.8"), TrustedProxies("10.0.0.0/8")},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "5.6.7.8, 1.2.3.4",
+			expected:     http.StatusForbidden,
+		},
+		{
+			desc:       "invalid remote address",
+			remoteAddr: "invalid",
+			expected:   http.StatusForbidden,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			f, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), test.opts...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", test.forwardedFor)
+			}
+			rw := httptest.NewRecorder()
+			f.ServeHTTP(rw, req)
+			assert.Equal(t, test.expected, rw.Code)
+		})
+	}
+}
+
+func TestIPFilterRejectHandler(t *testing.T) {
+	reject := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	f, err := New(http.NotFoundHandler(), Deny("0.0.0.0/0"), RejectHandler(reject))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rw := httptest.NewRecorder()
+	f.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestIPFilterInvalidRange(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), Allow("10.0.0.0/33"))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), TrustedProxies("proxy"))
+	assert.Error(t, err)
+}
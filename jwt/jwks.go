@@ -0,0 +1,200 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// Default JWKS caching settings
+const (
+	DefaultJWKSRefresh    = time.Hour
+	DefaultJWKSMinRefresh = time.Minute
+	maxJWKSBytes          = 1 << 20
+)
+
+// key is a verification key, with the algorithm it is restricted to if any
+type key struct {
+	key interface{}
+	alg string
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// symmetric
+	K string `json:"k"`
+}
+
+func (j jwk) key() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", j.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(k) == 0 {
+			return nil, fmt.Errorf("invalid symmetric key")
+		}
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keySet caches the keys of a JWKS endpoint. The keys are refreshed once stale, or when a token refers to an unknown
+// key ID, at most once per minRefresh. The cached keys are kept when a refresh fails.
+type keySet struct {
+	url        string
+	client     *http.Client
+	refresh    time.Duration
+	minRefresh time.Duration
+	clock      utils.Clock
+
+	mutex       sync.Mutex
+	keys        map[string]key
+	fetched     time.Time
+	lastAttempt time.Time
+}
+
+func newKeySet(url string, client *http.Client, clock utils.Clock) *keySet {
+	return &keySet{
+		url:        url,
+		client:     client,
+		refresh:    DefaultJWKSRefresh,
+		minRefresh: DefaultJWKSMinRefresh,
+		clock:      clock,
+	}
+}
+
+// key returns the key with the ID, an empty ID matches the key set if it holds a single key
+func (ks *keySet) key(ctx context.Context, kid string) (key, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	now := ks.clock.UtcNow()
+	k, found := ks.lookup(kid)
+	stale := ks.keys == nil || now.Sub(ks.fetched) >= ks.refresh
+	if (stale || !found) && now.Sub(ks.lastAttempt) >= ks.minRefresh {
+		ks.lastAttempt = now
+		keys, err := ks.fetch(ctx)
+		if err != nil && ks.keys == nil {
+			return key{}, err
+		}
+		if err == nil {
+			ks.keys, ks.fetched = keys, now
+			k, found = ks.lookup(kid)
+		}
+	}
+	if !found {
+		return key{}, fmt.Errorf("unknown key %q", kid)
+	}
+	return k, nil
+}
+
+func (ks *keySet) lookup(kid string) (key, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+func (ks *keySet) fetch(ctx context.Context) (map[string]key, error) {
+	req, err := http.NewRequest(http.MethodGet, ks.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := ks.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint replied %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	keys := make(map[string]key, len(set.Keys))
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		k, err := j.key()
+		if err != nil {
+			// keys of unsupported types do not prevent the use of the other keys of the set
+			continue
+		}
+		keys[j.Kid] = key{key: k, alg: j.Alg}
+	}
+	return keys, nil
+}
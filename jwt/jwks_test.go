@@ -0,0 +1,125 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func rsaJWK(kid string, pub *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": encodeBigInt(pub.N), "e": encodeBigInt(big.NewInt(int64(pub.E)))}
+}
+
+func TestJWKS(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var fetches, failing int32
+	keys := []map[string]string{rsaJWK("1", &first.PublicKey)}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer jwks.Close()
+
+	clock := utils.NewFakeClock(now)
+	j, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), JWKS(jwks.URL), Clock(clock))
+	require.NoError(t, err)
+
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		j.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(sign(t, "RS256", "1", first, validClaims())))
+	assert.Equal(t, http.StatusOK, serve(sign(t, "RS256", "1", first, validClaims())))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fetches), "the keys are cached")
+
+	// a new key is published
+	keys = append(keys, map[string]string{
+		"kty": "EC", "kid": "2", "crv": "P-256", "x": encodeBigInt(second.X), "y": encodeBigInt(second.Y),
+	})
+	claims := validClaims()
+	claims["exp"] = now.Add(2 * DefaultJWKSRefresh).Unix()
+	token := sign(t, "ES256", "2", second, claims)
+	assert.Equal(t, http.StatusUnauthorized, serve(token), "refreshes are rate limited")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fetches))
+
+	clock.Advance(DefaultJWKSMinRefresh)
+	assert.Equal(t, http.StatusOK, serve(token), "unknown key IDs trigger a refresh")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&fetches))
+
+	// the endpoint fails, the cached keys are kept
+	atomic.StoreInt32(&failing, 1)
+	clock.Advance(DefaultJWKSRefresh)
+	assert.Equal(t, http.StatusOK, serve(token))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&fetches), "stale keys are refreshed")
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer jwks.Close()
+
+	j, err := New(http.NotFoundHandler(), JWKS(jwks.URL), Clock(utils.NewFakeClock(now)))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+sign(t, "HS256", "", []byte("secret"), validClaims()))
+	rec := httptest.NewRecorder()
+	j.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestJWKKeys(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		jwk   jwk
+		valid bool
+	}{
+		{desc: "symmetric", jwk: jwk{Kty: "oct", K: "c2VjcmV0"}, valid: true},
+		{desc: "empty symmetric", jwk: jwk{Kty: "oct"}},
+		{desc: "RSA without modulus", jwk: jwk{Kty: "RSA", E: "AQAB"}},
+		{desc: "unsupported curve", jwk: jwk{Kty: "EC", Crv: "P-224", X: "AQ", Y: "AQ"}},
+		{desc: "point not on curve", jwk: jwk{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}},
+		{desc: "unsupported type", jwk: jwk{Kty: "OKP"}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := test.jwk.key()
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
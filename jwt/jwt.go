@@ -0,0 +1,419 @@
+/*
+Package jwt provides a middleware validating the JSON Web Tokens of the requests.
+
+The tokens are read from the Authorization Bearer header, or from a cookie. Their signature is verified with HMAC
+secrets (HS256, HS384, HS512), RSA (RS256, RS384, RS512, PS256, PS384, PS512) or ECDSA (ES256, ES384, ES512) public
+keys, either configured or fetched from a JWKS endpoint. The expiration, not before, issuer and audience claims are
+checked. Requests with a missing or invalid token are rejected with a 401 response.
+
+The claims of the validated tokens are stored in the request context, and can be injected as upstream headers.
+
+Examples of a JWT middleware:
+
+	// tokens signed by the keys of the identity provider
+	j, err := jwt.New(handler,
+		jwt.JWKS("https://idp.example.com/.well-known/jwks.json"),
+		jwt.Issuer("https://idp.example.com/"),
+		jwt.Audience("api"),
+		jwt.ClaimHeader("sub", "X-User"),
+	)
+
+	// tokens signed with a shared secret
+	j, err := jwt.New(handler, jwt.HMACSecret([]byte(secret)))
+*/
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultTimeout is the timeout of the default client fetching the JWKS
+const DefaultTimeout = 10 * time.Second
+
+type contextKey struct{}
+
+// ClaimsFromContext returns the claims of the validated token stored in ctx
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(Claims)
+	return claims, ok
+}
+
+type claimHeader struct {
+	claim  string
+	header string
+}
+
+// JWT is a middleware validating the JSON Web Tokens of the requests
+type JWT struct {
+	next                http.Handler
+	keys                map[string]key
+	jwksURL             string
+	jwks                *keySet
+	client              *http.Client
+	algorithms          map[string]bool
+	issuers             []string
+	audiences           []string
+	requireExpiration   bool
+	leeway              time.Duration
+	cookie              string
+	claimHeaders        []claimHeader
+	unauthorizedHandler http.Handler
+	clock               utils.Clock
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for JWT
+type Option func(j *JWT) error
+
+// New creates a new JWT middleware, at least one key or a JWKS endpoint is required
+func New(next http.Handler, opts ...Option) (*JWT, error) {
+	j := &JWT{
+		next:                next,
+		keys:                make(map[string]key),
+		client:              &http.Client{Timeout: DefaultTimeout},
+		requireExpiration:   true,
+		unauthorizedHandler: http.HandlerFunc(unauthorized),
+		clock:               utils.InheritedClock(),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(j); err != nil {
+			return nil, err
+		}
+	}
+	if len(j.keys) == 0 && j.jwksURL == "" {
+		return nil, errors.New("at least one key or a JWKS endpoint is required")
+	}
+	if j.jwksURL != "" {
+		j.jwks = newKeySet(j.jwksURL, j.client, j.clock)
+	}
+	return j, nil
+}
+
+// HMACSecret adds the secret verifying the HS256, HS384 and HS512 tokens with the key ID, if any
+func HMACSecret(secret []byte, kid ...string) Option {
+	return func(j *JWT) error {
+		if len(secret) == 0 {
+			return errors.New("HMAC secret can not be empty")
+		}
+		return j.addKey(append([]byte(nil), secret...), kid)
+	}
+}
+
+// PublicKey adds the *rsa.PublicKey or *ecdsa.PublicKey verifying the tokens with the key ID, if any
+func PublicKey(pub crypto.PublicKey, kid ...string) Option {
+	return func(j *JWT) error {
+		if _, err := keyFamily(pub); err != nil {
+			return err
+		}
+		if _, ok := pub.([]byte); ok {
+			return errors.New("use HMACSecret for the HMAC secrets")
+		}
+		return j.addKey(pub, kid)
+	}
+}
+
+func (j *JWT) addKey(k interface{}, kid []string) error {
+	if len(kid) > 1 {
+		return errors.New("a single key ID is expected")
+	}
+	id := ""
+	if len(kid) == 1 {
+		id = kid[0]
+	}
+	if _, exists := j.keys[id]; exists {
+		return fmt.Errorf("duplicate key ID %q", id)
+	}
+	j.keys[id] = key{key: k}
+	return nil
+}
+
+// JWKS fetches the keys verifying the tokens from the JWKS endpoint. The keys are cached, and refreshed every hour
+// or when a token refers to an unknown key ID.
+func JWKS(rawURL string) Option {
+	return func(j *JWT) error {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid JWKS URL %q", rawURL)
+		}
+		j.jwksURL = rawURL
+		return nil
+	}
+}
+
+// Client sets the HTTP client fetching the JWKS
+func Client(c *http.Client) Option {
+	return func(j *JWT) error {
+		if c == nil {
+			return errors.New("client can not be nil")
+		}
+		j.client = c
+		return nil
+	}
+}
+
+// Algorithms restricts the accepted signature algorithms, e.g. "RS256". By default all the supported algorithms
+// are accepted, provided that the type of the key matches.
+func Algorithms(algs ...string) Option {
+	return func(j *JWT) error {
+		j.algorithms = make(map[string]bool, len(algs))
+		for _, alg := range algs {
+			if _, ok := algorithms[alg]; !ok {
+				return fmt.Errorf("unsupported algorithm %q", alg)
+			}
+			j.algorithms[alg] = true
+		}
+		return nil
+	}
+}
+
+// Issuer requires the iss claim to be one of the issuers
+func Issuer(issuers ...string) Option {
+	return func(j *JWT) error {
+		j.issuers = append(j.issuers, issuers...)
+		return nil
+	}
+}
+
+// Audience requires the aud claim to contain one of the audiences
+func Audience(audiences ...string) Option {
+	return func(j *JWT) error {
+		j.audiences = append(j.audiences, audiences...)
+		return nil
+	}
+}
+
+// RequireExpiration rejects the tokens without exp claim, it defaults to true
+func RequireExpiration(require bool) Option {
+	return func(j *JWT) error {
+		j.requireExpiration = require
+		return nil
+	}
+}
+
+// Leeway tolerates the clock skew between the issuer and oxy when checking the exp and nbf claims
+func Leeway(d time.Duration) Option {
+	return func(j *JWT) error {
+		if d < 0 {
+			return fmt.Errorf("leeway can not be negative")
+		}
+		j.leeway = d
+		return nil
+	}
+}
+
+// Cookie reads the token from the cookie when the request has no Authorization header
+func Cookie(name string) Option {
+	return func(j *JWT) error {
+		j.cookie = name
+		return nil
+	}
+}
+
+// ClaimHeader sets the claim of the validated tokens as the header of the upstream request, see Claims.String.
+// The header sent by the client is removed.
+func ClaimHeader(claim, header string) Option {
+	return func(j *JWT) error {
+		if claim == "" || header == "" {
+			return errors.New("claim and header can not be empty")
+		}
+		j.claimHeaders = append(j.claimHeaders, claimHeader{claim: claim, header: header})
+		return nil
+	}
+}
+
+// UnauthorizedHandler sets the handler replying to the requests with a missing or invalid token, once the challenge
+// header is set. It defaults to a 401 Unauthorized response.
+func UnauthorizedHandler(h http.Handler) Option {
+	return func(j *JWT) error {
+		if h == nil {
+			return errors.New("unauthorized handler can not be nil")
+		}
+		j.unauthorizedHandler = h
+		return nil
+	}
+}
+
+// Clock sets the clock checking the time claims and the JWKS cache, it defaults to utils.DefaultClock
+func Clock(clock utils.Clock) Option {
+	return func(j *JWT) error {
+		j.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the JWT middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(j *JWT) error {
+		j.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by JWT handler.
+func (j *JWT) Wrap(next http.Handler) error {
+	j.next = next
+	return nil
+}
+
+func (j *JWT) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if j.log.Level >= log.DebugLevel {
+		logEntry := j.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/jwt: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/jwt: completed ServeHttp on request")
+	}
+
+	raw, err := j.extractToken(req)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		j.unauthorizedHandler.ServeHTTP(w, req)
+		return
+	}
+	claims, err := j.validate(req.Context(), raw)
+	if err != nil {
+		j.log.Debugf("vulcand/oxy/jwt: invalid token, err: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		j.unauthorizedHandler.ServeHTTP(w, req)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), contextKey{}, claims)
+	if sub, ok := claims["sub"].(string); ok && sub != "" {
+		ctx = utils.WithIdentity(ctx, &utils.Identity{Scheme: utils.AuthSchemeBearer, Name: sub})
+	}
+	outReq := req.WithContext(ctx)
+	if len(j.claimHeaders) > 0 {
+		outReq.Header = utils.CloneHeaders(req.Header)
+		for _, ch := range j.claimHeaders {
+			outReq.Header.Del(ch.header)
+		}
+		for _, ch := range j.claimHeaders {
+			if v, ok := claims.String(ch.claim); ok {
+				outReq.Header.Add(ch.header, v)
+			}
+		}
+	}
+	j.next.ServeHTTP(w, outReq)
+}
+
+func (j *JWT) extractToken(req *http.Request) (string, error) {
+	if header := req.Header.Get("Authorization"); header != "" || j.cookie == "" {
+		return utils.ParseBearerHeader(header)
+	}
+	c, err := req.Cookie(j.cookie)
+	if err != nil || c.Value == "" {
+		return "", utils.ErrNoCredentials
+	}
+	return c.Value, nil
+}
+
+// validate verifies the signature and the claims of the token
+func (j *JWT) validate(ctx context.Context, raw string) (Claims, error) {
+	t, err := parseToken(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, ok := algorithms[t.header.Alg]
+	if !ok || (j.algorithms != nil && !j.algorithms[t.header.Alg]) {
+		return nil, fmt.Errorf("algorithm %q is not accepted", t.header.Alg)
+	}
+	k, err := j.key(ctx, t.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if k.alg != "" && k.alg != t.header.Alg {
+		return nil, fmt.Errorf("key %q is restricted to %s", t.header.Kid, k.alg)
+	}
+	if err := alg.verify(k.key, t.signingInput, t.signature); err != nil {
+		return nil, err
+	}
+
+	if err := j.validateClaims(t.claims); err != nil {
+		return nil, err
+	}
+	return t.claims, nil
+}
+
+// key returns the configured key with the ID, then the key of the JWKS, or the configured key without ID
+func (j *JWT) key(ctx context.Context, kid string) (key, error) {
+	if k, ok := j.keys[kid]; ok {
+		return k, nil
+	}
+	if j.jwks != nil {
+		return j.jwks.key(ctx, kid)
+	}
+	if k, ok := j.keys[""]; ok {
+		return k, nil
+	}
+	return key{}, fmt.Errorf("unknown key %q", kid)
+}
+
+func (j *JWT) validateClaims(claims Claims) error {
+	now := j.clock.UtcNow()
+
+	exp, ok, err := claims.time("exp")
+	if err != nil {
+		return err
+	}
+	if !ok && j.requireExpiration {
+		return errors.New("token has no expiration")
+	}
+	if ok && !now.Before(exp.Add(j.leeway)) {
+		return errors.New("token is expired")
+	}
+
+	nbf, ok, err := claims.time("nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(j.leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	if len(j.issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !contains(j.issuers, iss) {
+			return fmt.Errorf("issuer %q is not accepted", iss)
+		}
+	}
+	if len(j.audiences) > 0 {
+		accepted := false
+		for _, aud := range claims.audiences() {
+			if contains(j.audiences, aud) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return errors.New("audience is not accepted")
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func unauthorized(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
@@ -0,0 +1,280 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+)
+
+var now = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// sign creates a token in the compact serialization, signed with the private key or HMAC secret
+func sign(t *testing.T, alg, kid string, k interface{}, claims map[string]interface{}) string {
+	h := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		h["kid"] = kid
+	}
+	hb, err := json.Marshal(h)
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+	input := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+
+	a := algorithms[alg]
+	var sig []byte
+	switch priv := k.(type) {
+	case []byte:
+		mac := hmac.New(a.hash.New, priv)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		hash := a.hash.New()
+		hash.Write([]byte(input))
+		if a.family == "PS" {
+			sig, err = rsa.SignPSS(rand.Reader, priv, a.hash, hash.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, priv, a.hash, hash.Sum(nil))
+		}
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		hash := a.hash.New()
+		hash.Write([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, priv, hash.Sum(nil))
+		require.NoError(t, err)
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rb):size], rb)
+		copy(sig[2*size-len(sb):], sb)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "alice",
+		"iss": "https://idp.example.com/",
+		"aud": []string{"api", "web"},
+		"exp": now.Add(time.Hour).Unix(),
+		"nbf": now.Add(-time.Hour).Unix(),
+	}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	secret := []byte("secret")
+
+	testCases := []struct {
+		alg  string
+		priv interface{}
+		pub  crypto.PublicKey
+	}{
+		{alg: "HS256", priv: secret},
+		{alg: "HS512", priv: secret},
+		{alg: "RS256", priv: rsaKey, pub: &rsaKey.PublicKey},
+		{alg: "PS384", priv: rsaKey, pub: &rsaKey.PublicKey},
+		{alg: "ES256", priv: ecKey, pub: &ecKey.PublicKey},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.alg, func(t *testing.T) {
+			opt := HMACSecret(secret)
+			if test.pub != nil {
+				opt = PublicKey(test.pub)
+			}
+			j, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), opt, Clock(utils.NewFakeClock(now)))
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+sign(t, test.alg, "", test.priv, validClaims()))
+			rec := httptest.NewRecorder()
+			j.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+		})
+	}
+}
+
+func TestJWTAlgorithmConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pubJSON, err := json.Marshal(rsaKey.PublicKey)
+	require.NoError(t, err)
+
+	j, err := New(http.NotFoundHandler(), PublicKey(&rsaKey.PublicKey), Clock(utils.NewFakeClock(now)))
+	require.NoError(t, err)
+
+	for _, raw := range []string{
+		// the public key used as an HMAC secret
+		sign(t, "HS256", "", pubJSON, validClaims()),
+		// unsigned
+		"eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSJ9.",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+raw)
+		rec := httptest.NewRecorder()
+		j.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, `Bearer error="invalid_token"`, rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	secret := []byte("secret")
+
+	testCases := []struct {
+		desc         string
+		update       func(c map[string]interface{})
+		expectedCode int
+	}{
+		{desc: "valid", update: func(c map[string]interface{}) {}, expectedCode: http.StatusOK},
+		{desc: "expired", update: func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() }, expectedCode: http.StatusUnauthorized},
+		{desc: "expired within leeway", update: func(c map[string]interface{}) { c["exp"] = now.Add(-10 * time.Second).Unix() }, expectedCode: http.StatusOK},
+		{desc: "no expiration", update: func(c map[string]interface{}) { delete(c, "exp") }, expectedCode: http.StatusUnauthorized},
+		{desc: "not valid yet", update: func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() }, expectedCode: http.StatusUnauthorized},
+		{desc: "other issuer", update: func(c map[string]interface{}) { c["iss"] = "https://evil.com/" }, expectedCode: http.StatusUnauthorized},
+		{desc: "single audience", update: func(c map[string]interface{}) { c["aud"] = "api" }, expectedCode: http.StatusOK},
+		{desc: "other audience", update: func(c map[string]interface{}) { c["aud"] = "admin" }, expectedCode: http.StatusUnauthorized},
+		{desc: "invalid expiration", update: func(c map[string]interface{}) { c["exp"] = "tomorrow" }, expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			j, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+				HMACSecret(secret),
+				Issuer("https://idp.example.com/"),
+				Audience("api"),
+				Leeway(30*time.Second),
+				Clock(utils.NewFakeClock(now)),
+			)
+			require.NoError(t, err)
+
+			claims := validClaims()
+			test.update(claims)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+sign(t, "HS256", "", secret, claims))
+			rec := httptest.NewRecorder()
+			j.ServeHTTP(rec, req)
+			assert.Equal(t, test.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestJWTClaimHeaders(t *testing.T) {
+	secret := []byte("secret")
+	var header http.Header
+	var claims Claims
+	var identity *utils.Identity
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		claims, _ = ClaimsFromContext(req.Context())
+		identity, _ = utils.IdentityFromContext(req.Context())
+	})
+	j, err := New(next,
+		HMACSecret(secret),
+		ClaimHeader("sub", "X-User"),
+		ClaimHeader("aud", "X-Audience"),
+		ClaimHeader("missing", "X-Missing"),
+		Cookie("token"),
+		Clock(utils.NewFakeClock(now)),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: sign(t, "HS256", "", secret, validClaims())})
+	req.Header.Set("X-User", "mallory")
+	req.Header.Set("X-Missing", "spoofed")
+	rec := httptest.NewRecorder()
+	j.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "alice", header.Get("X-User"))
+	assert.Equal(t, "api,web", header.Get("X-Audience"))
+	assert.Empty(t, header.Get("X-Missing"))
+	assert.Equal(t, "alice", claims["sub"])
+	assert.Equal(t, "bearer:alice", identity.String())
+	assert.Equal(t, "mallory", req.Header.Get("X-User"))
+}
+
+func TestJWTMissingToken(t *testing.T) {
+	j, err := New(http.NotFoundHandler(), HMACSecret([]byte("secret")))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	j.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestJWTKeyIDs(t *testing.T) {
+	j, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		HMACSecret([]byte("first"), "1"),
+		HMACSecret([]byte("second"), "2"),
+		Algorithms("HS256"),
+		Clock(utils.NewFakeClock(now)),
+	)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		token        string
+		expectedCode int
+	}{
+		{desc: "first", token: sign(t, "HS256", "1", []byte("first"), validClaims()), expectedCode: http.StatusOK},
+		{desc: "second", token: sign(t, "HS256", "2", []byte("second"), validClaims()), expectedCode: http.StatusOK},
+		{desc: "wrong key", token: sign(t, "HS256", "1", []byte("second"), validClaims()), expectedCode: http.StatusUnauthorized},
+		{desc: "unknown key", token: sign(t, "HS256", "3", []byte("first"), validClaims()), expectedCode: http.StatusUnauthorized},
+		{desc: "algorithm not accepted", token: sign(t, "HS512", "1", []byte("first"), validClaims()), expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			rec := httptest.NewRecorder()
+			j.ServeHTTP(rec, req)
+			assert.Equal(t, test.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestJWTInvalidOptions(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opts []Option
+	}{
+		{desc: "no key"},
+		{desc: "empty secret", opts: []Option{HMACSecret(nil)}},
+		{desc: "unsupported key", opts: []Option{PublicKey("key")}},
+		{desc: "duplicate key ID", opts: []Option{HMACSecret([]byte("a")), HMACSecret([]byte("b"))}},
+		{desc: "JWKS URL", opts: []Option{JWKS("idp.example.com/jwks")}},
+		{desc: "algorithm", opts: []Option{HMACSecret([]byte("a")), Algorithms("none")}},
+		{desc: "leeway", opts: []Option{HMACSecret([]byte("a")), Leeway(-time.Second)}},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(http.NotFoundHandler(), test.opts...)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	// registers the hash functions of the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Claims are the claims of a validated token
+type Claims map[string]interface{}
+
+// String returns the claim as a string, numbers and booleans are formatted, arrays are joined with commas and
+// objects are JSON encoded
+func (c Claims) String(name string) (string, bool) {
+	v, ok := c[name]
+	if !ok || v == nil {
+		return "", false
+	}
+	return claimString(v), true
+}
+
+func claimString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return fmt.Sprint(value)
+	case []interface{}:
+		values := make([]string, len(value))
+		for i, e := range value {
+			values[i] = claimString(e)
+		}
+		return strings.Join(values, ",")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// time returns the NumericDate claim
+func (c Claims) time(name string) (time.Time, bool, error) {
+	v, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true, nil
+}
+
+// audiences returns the aud claim, either a string or an array of strings
+func (c Claims) audiences() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var values []string
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// token is a parsed, not yet verified, JWS in the compact serialization
+type token struct {
+	header       header
+	claims       Claims
+	signingInput string
+	signature    []byte
+}
+
+var errMalformed = errors.New("malformed token")
+
+func parseToken(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+	t := &token{signingInput: parts[0] + "." + parts[1]}
+
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformed
+	}
+	if err := json.Unmarshal(h, &t.header); err != nil {
+		return nil, errMalformed
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformed
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&t.claims); err != nil || t.claims == nil {
+		return nil, errMalformed
+	}
+
+	if t.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, errMalformed
+	}
+	return t, nil
+}
+
+// algorithm verifies the signatures of a JWS algorithm
+type algorithm struct {
+	hash crypto.Hash
+	// family is HS, RS, PS or ES
+	family string
+	curve  elliptic.Curve
+}
+
+var algorithms = map[string]algorithm{
+	"HS256": {hash: crypto.SHA256, family: "HS"},
+	"HS384": {hash: crypto.SHA384, family: "HS"},
+	"HS512": {hash: crypto.SHA512, family: "HS"},
+	"RS256": {hash: crypto.SHA256, family: "RS"},
+	"RS384": {hash: crypto.SHA384, family: "RS"},
+	"RS512": {hash: crypto.SHA512, family: "RS"},
+	"PS256": {hash: crypto.SHA256, family: "PS"},
+	"PS384": {hash: crypto.SHA384, family: "PS"},
+	"PS512": {hash: crypto.SHA512, family: "PS"},
+	"ES256": {hash: crypto.SHA256, family: "ES", curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, family: "ES", curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, family: "ES", curve: elliptic.P521()},
+}
+
+// verify checks the signature with the key, the type of the key must match the algorithm so that e.g. an RSA public
+// key is never used as an HMAC secret
+func (a algorithm) verify(key interface{}, signingInput string, signature []byte) error {
+	if a.family == "HS" {
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key is not an HMAC secret")
+		}
+		mac := hmac.New(a.hash.New, secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	h := a.hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch a.family {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA public key")
+		}
+		if a.family == "RS" {
+			return rsa.VerifyPKCS1v15(pub, a.hash, digest, signature)
+		}
+		return rsa.VerifyPSS(pub, a.hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != a.curve {
+			return errors.New("key is not an ECDSA public key of the algorithm curve")
+		}
+		size := (a.curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm family %s", a.family)
+}
+
+// keyFamily returns the algorithm family matching the type of the key
+func keyFamily(key interface{}) (string, error) {
+	switch k := key.(type) {
+	case []byte:
+		if len(k) == 0 {
+			return "", errors.New("empty HMAC secret")
+		}
+		return "HS", nil
+	case *rsa.PublicKey:
+		return "RS", nil
+	case *ecdsa.PublicKey:
+		return "ES", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
@@ -0,0 +1,344 @@
+/*
+Package loadshed provides a middleware shedding the low priority requests when the proxy is overloaded.
+
+The pressure is the highest ratio of the signals to their threshold: the requests in flight, the average latency
+of the requests and a CPU usage callback. The average latency decays with the time, it halves every second without
+new samples, so that it recovers while the requests are shed. Under a pressure below 1, all the requests are served. Above, the requests
+of the lowest priority are rejected first with a 503 response, and every 10% of overload sheds one more priority.
+Critical requests are never shed.
+
+Examples of a load shedder:
+
+	// health checks are critical, the batch API is low priority
+	s, err := loadshed.New(handler,
+		loadshed.MaxInFlight(500),
+		loadshed.MaxLatency(200*time.Millisecond),
+		loadshed.PathPriority("/health", loadshed.Critical),
+		loadshed.PathPriority("/api/batch/", loadshed.Low))
+*/
+package loadshed
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Priority is the importance of a request, the lowest priorities are shed first
+type Priority int
+
+// Priorities of the requests
+const (
+	Low Priority = iota
+	Normal
+	High
+	// Critical requests are never shed
+	Critical
+)
+
+// ErrShed is passed to the error handler for the shed requests
+var ErrShed = errors.New("request shed under load")
+
+// overloadStep is the overload shedding one more priority
+const overloadStep = 0.1
+
+// latencyWeight is the weight of the last request in the average latency
+const latencyWeight = 0.1
+
+// latencyHalfLife is the time after which the average latency is halved without new samples
+const latencyHalfLife = time.Second
+
+type rule struct {
+	match    func(req *http.Request) bool
+	priority Priority
+}
+
+// LoadShed is a middleware rejecting the low priority requests under pressure
+type LoadShed struct {
+	next            http.Handler
+	rules           []rule
+	priorityHeader  string
+	defaultPriority Priority
+	maxInFlight     int64
+	maxLatency      time.Duration
+	cpu             func() float64
+	maxCPU          float64
+	clock           utils.Clock
+
+	mutex    sync.Mutex
+	inFlight int64
+	// latency is the average latency at latencyAt, see averageLatency
+	latency    float64
+	latencyAt  time.Time
+	hasLatency bool
+
+	errHandler utils.ErrorHandler
+	log        *log.Logger
+}
+
+// Option is a functional option setter for LoadShed
+type Option func(s *LoadShed) error
+
+// New creates a new LoadShed middleware, at least one pressure signal must be configured
+func New(next http.Handler, opts ...Option) (*LoadShed, error) {
+	s := &LoadShed{
+		next:            next,
+		defaultPriority: Normal,
+		clock:           utils.InheritedClock(),
+		errHandler:      utils.ErrorHandlerFunc(serviceUnavailable),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.maxInFlight == 0 && s.maxLatency == 0 && s.cpu == nil {
+		return nil, errors.New("at least one of the in flight, latency or CPU signals is required")
+	}
+	return s, nil
+}
+
+// MaxInFlight sets the number of requests in flight at which the proxy is under pressure
+func MaxInFlight(n int64) Option {
+	return func(s *LoadShed) error {
+		if n <= 0 {
+			return fmt.Errorf("max in flight should be > 0, got %d", n)
+		}
+		s.maxInFlight = n
+		return nil
+	}
+}
+
+// MaxLatency sets the average latency of the requests at which the proxy is under pressure
+func MaxLatency(d time.Duration) Option {
+	return func(s *LoadShed) error {
+		if d <= 0 {
+			return fmt.Errorf("max latency should be > 0, got %v", d)
+		}
+		s.maxLatency = d
+		return nil
+	}
+}
+
+// CPU sets the callback returning the CPU usage, and the usage at which the proxy is under pressure.
+// The callback is called for every request, it should return a cached value.
+func CPU(usage func() float64, max float64) Option {
+	return func(s *LoadShed) error {
+		if usage == nil {
+			return errors.New("CPU callback can not be nil")
+		}
+		if max <= 0 {
+			return fmt.Errorf("max CPU should be > 0, got %v", max)
+		}
+		s.cpu, s.maxCPU = usage, max
+		return nil
+	}
+}
+
+// PriorityHeader reads the priority of the requests from a header, e.g. "X-Priority: 2".
+// It takes precedence over the rules, so the header should be set by trusted clients only.
+func PriorityHeader(name string) Option {
+	return func(s *LoadShed) error {
+		s.priorityHeader = name
+		return nil
+	}
+}
+
+// PathPriority sets the priority of the requests whose path starts with the prefix
+func PathPriority(prefix string, p Priority) Option {
+	return PredicatePriority(func(req *http.Request) bool {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}, p)
+}
+
+// PredicatePriority sets the priority of the requests matching the predicate, the first matching rule applies
+func PredicatePriority(match func(req *http.Request) bool, p Priority) Option {
+	return func(s *LoadShed) error {
+		if match == nil {
+			return errors.New("predicate can not be nil")
+		}
+		if err := p.validate(); err != nil {
+			return err
+		}
+		s.rules = append(s.rules, rule{match: match, priority: p})
+		return nil
+	}
+}
+
+// DefaultPriority sets the priority of the requests matching no rule, it defaults to Normal
+func DefaultPriority(p Priority) Option {
+	return func(s *LoadShed) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		s.defaultPriority = p
+		return nil
+	}
+}
+
+// Clock sets the clock measuring the latency of the requests
+func Clock(clock utils.Clock) Option {
+	return func(s *LoadShed) error {
+		s.clock = clock
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler replying to the shed requests, with ErrShed. It defaults to a 503 response.
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(s *LoadShed) error {
+		if h == nil {
+			return errors.New("error handler can not be nil")
+		}
+		s.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the load shedder will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(s *LoadShed) error {
+		s.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by load shedder handler.
+func (s *LoadShed) Wrap(next http.Handler) error {
+	s.next = next
+	return nil
+}
+
+func (s *LoadShed) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.log.Level >= log.DebugLevel {
+		logEntry := s.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/loadshed: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/loadshed: completed ServeHttp on request")
+	}
+
+	priority := s.priority(req)
+	if !s.admit(priority) {
+		if utils.Sampled(s.log, log.DebugLevel, "vulcand/oxy/loadshed: shedding request of priority %d from %v") {
+			s.log.Debugf("vulcand/oxy/loadshed: shedding request of priority %d from %v", priority, req.RemoteAddr)
+		}
+		s.errHandler.ServeHTTP(w, req, ErrShed)
+		return
+	}
+
+	start := s.clock.UtcNow()
+	defer s.done(start)
+	s.next.ServeHTTP(w, req)
+}
+
+// Pressure returns the current pressure, above 1 the proxy is overloaded
+func (s *LoadShed) Pressure() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pressure()
+}
+
+// pressure is called with the mutex held
+func (s *LoadShed) pressure() float64 {
+	var p float64
+	if s.maxInFlight > 0 {
+		p = maxFloat(p, float64(s.inFlight)/float64(s.maxInFlight))
+	}
+	if s.maxLatency > 0 {
+		p = maxFloat(p, s.averageLatency(s.clock.UtcNow())/float64(s.maxLatency))
+	}
+	if s.cpu != nil {
+		p = maxFloat(p, s.cpu()/s.maxCPU)
+	}
+	return p
+}
+
+// admit counts the request in flight if its priority is not shed under the current pressure
+func (s *LoadShed) admit(priority Priority) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if priority < Critical {
+		if p := s.pressure(); p >= 1 && priority < shedBelow(p) {
+			return false
+		}
+	}
+	s.inFlight++
+	return true
+}
+
+func (s *LoadShed) done(start time.Time) {
+	now := s.clock.UtcNow()
+	latency := float64(now.Sub(start))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inFlight--
+	if !s.hasLatency {
+		s.latency, s.hasLatency = latency, true
+	} else {
+		s.latency = latencyWeight*latency + (1-latencyWeight)*s.averageLatency(now)
+	}
+	s.latencyAt = now
+}
+
+// averageLatency returns the average latency decayed since its last sample, it is called with the mutex held
+func (s *LoadShed) averageLatency(now time.Time) float64 {
+	elapsed := now.Sub(s.latencyAt)
+	if elapsed <= 0 {
+		return s.latency
+	}
+	return s.latency * math.Exp2(-float64(elapsed)/float64(latencyHalfLife))
+}
+
+// shedBelow returns the priority below which the requests are shed under an overload pressure
+func shedBelow(pressure float64) Priority {
+	level := Priority(1 + int((pressure-1)/overloadStep))
+	if level > Critical {
+		return Critical
+	}
+	return level
+}
+
+func (s *LoadShed) priority(req *http.Request) Priority {
+	if s.priorityHeader != "" {
+		if v := req.Header.Get(s.priorityHeader); v != "" {
+			if p, err := strconv.Atoi(v); err == nil && Priority(p).validate() == nil {
+				return Priority(p)
+			}
+		}
+	}
+	for _, r := range s.rules {
+		if r.match(req) {
+			return r.priority
+		}
+	}
+	return s.defaultPriority
+}
+
+func (p Priority) validate() error {
+	if p < Low || p > Critical {
+		return fmt.Errorf("invalid priority %d", p)
+	}
+	return nil
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func serviceUnavailable(w http.ResponseWriter, req *http.Request, err error) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
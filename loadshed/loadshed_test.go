@@ -0,0 +1,156 @@
+package loadshed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestLoadShedPriorities(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		cpu      float64
+		expected map[Priority]int
+	}{
+		{
+			desc:     "no pressure",
+			cpu:      0.5,
+			expected: map[Priority]int{Low: http.StatusOK, Normal: http.StatusOK, High: http.StatusOK, Critical: http.StatusOK},
+		},
+		{
+			desc:     "overloaded",
+			cpu:      0.9,
+			expected: map[Priority]int{Low: http.StatusServiceUnavailable, Normal: http.StatusOK, High: http.StatusOK, Critical: http.StatusOK},
+		},
+		{
+			desc:     "overloaded by 15%",
+			cpu:      1.035,
+			expected: map[Priority]int{Low: http.StatusServiceUnavailable, Normal: http.StatusServiceUnavailable, High: http.StatusOK, Critical: http.StatusOK},
+		},
+		{
+			desc:     "heavily overloaded",
+			cpu:      1.8,
+			expected: map[Priority]int{Low: http.StatusServiceUnavailable, Normal: http.StatusServiceUnavailable, High: http.StatusServiceUnavailable, Critical: http.StatusOK},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			s, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+				CPU(func() float64 { return test.cpu }, 0.9), PriorityHeader("X-Priority"))
+			require.NoError(t, err)
+
+			for priority, code := range test.expected {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Priority", string('0'+rune(priority)))
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+				assert.Equal(t, code, rec.Code, "priority %d", priority)
+			}
+		})
+	}
+}
+
+func TestLoadShedInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" {
+			return
+		}
+		started <- struct{}{}
+		<-release
+	}), MaxInFlight(1), PathPriority("/health", Critical), PathPriority("/batch", Low))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	<-started
+	assert.Equal(t, 1.0, s.Pressure())
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/batch/jobs", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "critical requests are not shed")
+
+	close(release)
+	<-done
+	assert.Equal(t, 0.0, s.Pressure())
+}
+
+func TestLoadShedLatency(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	latency := time.Duration(0)
+	s, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Advance(latency)
+	}), MaxLatency(100*time.Millisecond), DefaultPriority(Low), Clock(clock))
+	require.NoError(t, err)
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+
+	latency = 0
+	assert.Equal(t, http.StatusOK, serve())
+	latency = 500 * time.Millisecond
+	assert.Equal(t, http.StatusOK, serve())
+	assert.InDelta(t, 0.5, s.Pressure(), 0.001, "a zero latency is a sample")
+	latency = 50 * time.Millisecond
+	assert.Equal(t, http.StatusOK, serve())
+	latency = time.Second
+	assert.Equal(t, http.StatusOK, serve())
+	// the average is halved by the second of the last request
+	assert.InDelta(t, 1.218, s.Pressure(), 0.001)
+	assert.Equal(t, http.StatusServiceUnavailable, serve())
+}
+
+func TestLoadShedLatencyRecovery(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Advance(500 * time.Millisecond)
+	}), MaxLatency(100*time.Millisecond), Clock(clock))
+	require.NoError(t, err)
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve())
+	assert.InDelta(t, 5.0, s.Pressure(), 0.001)
+	assert.Equal(t, http.StatusServiceUnavailable, serve())
+
+	// no request is admitted, the average latency decays with the time
+	clock.Advance(time.Second)
+	assert.InDelta(t, 2.5, s.Pressure(), 0.001)
+	assert.Equal(t, http.StatusServiceUnavailable, serve())
+
+	clock.Advance(time.Hour)
+	assert.InDelta(t, 0.0, s.Pressure(), 0.001)
+	assert.Equal(t, http.StatusOK, serve())
+}
+
+func TestLoadShedInvalidOptions(t *testing.T) {
+	_, err := New(http.NotFoundHandler())
+	assert.Error(t, err, "a signal is required")
+
+	for _, opt := range []Option{MaxInFlight(0), MaxLatency(-1), CPU(nil, 1), DefaultPriority(Critical + 1), PredicatePriority(nil, Low), ErrorHandler(nil)} {
+		_, err := New(http.NotFoundHandler(), MaxInFlight(1), opt)
+		assert.Error(t, err)
+	}
+}
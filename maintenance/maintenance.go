@@ -0,0 +1,266 @@
+/*
+Package maintenance provides a middleware serving a 503 maintenance page while the maintenance mode is on.
+
+The mode is switched at runtime, with the Enable and Disable methods or with the API handler. While it is on,
+the matching requests are replied with the page and a Retry-After header, except for the allowed clients:
+the admin IP addresses and the requests carrying the bypass header.
+
+Examples of a maintenance mode:
+
+	// the whole site, the office network keeps access
+	m, err := maintenance.New(handler,
+		maintenance.Page("text/html; charset=utf-8", page),
+		maintenance.RetryAfter(10*time.Minute),
+		maintenance.AllowIPs("192.0.2.0/24"))
+
+	// switched with PUT /admin/maintenance {"enabled": true}
+	mux.Handle("/admin/maintenance", m.API())
+*/
+package maintenance
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultRetryAfter is the time the clients are asked to wait before retrying
+const DefaultRetryAfter = 5 * time.Minute
+
+// Maintenance is a middleware replying 503 to the requests while the maintenance mode is on
+type Maintenance struct {
+	next           http.Handler
+	enabled        int32
+	match          func(req *http.Request) bool
+	contentType    string
+	page           []byte
+	retryAfter     time.Duration
+	allowed        *utils.IPSet
+	trustedProxies *utils.IPSet
+	bypassHeader   string
+	bypassValue    string
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Maintenance
+type Option func(m *Maintenance) error
+
+// New creates a new Maintenance middleware, the maintenance mode is off unless Enabled is set
+func New(next http.Handler, opts ...Option) (*Maintenance, error) {
+	m := &Maintenance{
+		next:        next,
+		contentType: "text/plain; charset=utf-8",
+		page:        []byte(http.StatusText(http.StatusServiceUnavailable)),
+		retryAfter:  DefaultRetryAfter,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Enabled sets the initial maintenance mode
+func Enabled(enabled bool) Option {
+	return func(m *Maintenance) error {
+		m.set(enabled)
+		return nil
+	}
+}
+
+// Page sets the body of the maintenance responses, and its content type
+func Page(contentType string, body []byte) Option {
+	return func(m *Maintenance) error {
+		if contentType == "" {
+			return errors.New("content type can not be empty")
+		}
+		m.contentType, m.page = contentType, body
+		return nil
+	}
+}
+
+// RetryAfter sets the Retry-After header of the maintenance responses, it defaults to DefaultRetryAfter.
+// A zero duration disables the header.
+func RetryAfter(d time.Duration) Option {
+	return func(m *Maintenance) error {
+		if d < 0 {
+			return fmt.Errorf("retry after should be >= 0, got %v", d)
+		}
+		m.retryAfter = d
+		return nil
+	}
+}
+
+// Match restricts the maintenance mode to the matching requests, e.g. the routes under maintenance
+func Match(match func(req *http.Request) bool) Option {
+	return func(m *Maintenance) error {
+		if match == nil {
+			return errors.New("predicate can not be nil")
+		}
+		m.match = match
+		return nil
+	}
+}
+
+// AllowIPs adds IP addresses or CIDR ranges of the clients served during the maintenance, e.g. the admins
+func AllowIPs(ranges ...string) Option {
+	return func(m *Maintenance) error {
+		return addRanges(&m.allowed, ranges)
+	}
+}
+
+// TrustedProxies adds the IP addresses or CIDR ranges of the proxies whose X-Forwarded-For hops are trusted
+// to resolve the client address
+func TrustedProxies(ranges ...string) Option {
+	return func(m *Maintenance) error {
+		return addRanges(&m.trustedProxies, ranges)
+	}
+}
+
+// BypassHeader serves the requests carrying the header with the value during the maintenance.
+// The header is removed before the request is passed to the next handler.
+func BypassHeader(name, value string) Option {
+	return func(m *Maintenance) error {
+		if name == "" || value == "" {
+			return errors.New("bypass header name and value can not be empty")
+		}
+		m.bypassHeader, m.bypassValue = http.CanonicalHeaderKey(name), value
+		return nil
+	}
+}
+
+// Logger defines the logger the maintenance will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(m *Maintenance) error {
+		m.log = l
+		return nil
+	}
+}
+
+func addRanges(set **utils.IPSet, ranges []string) error {
+	if *set == nil {
+		s, err := utils.NewIPSet()
+		if err != nil {
+			return err
+		}
+		*set = s
+	}
+	for _, r := range ranges {
+		if err := (*set).Add(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wrap sets the next handler to be called by maintenance handler.
+func (m *Maintenance) Wrap(next http.Handler) error {
+	m.next = next
+	return nil
+}
+
+// Enable turns the maintenance mode on
+func (m *Maintenance) Enable() {
+	m.set(true)
+	m.log.Infof("vulcand/oxy/maintenance: maintenance mode enabled")
+}
+
+// Disable turns the maintenance mode off
+func (m *Maintenance) Disable() {
+	m.set(false)
+	m.log.Infof("vulcand/oxy/maintenance: maintenance mode disabled")
+}
+
+// IsEnabled tells whether the maintenance mode is on
+func (m *Maintenance) IsEnabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+func (m *Maintenance) set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+func (m *Maintenance) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.log.Level >= log.DebugLevel {
+		logEntry := m.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/maintenance: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/maintenance: completed ServeHttp on request")
+	}
+
+	bypass := m.bypassHeader != "" &&
+		subtle.ConstantTimeCompare([]byte(req.Header.Get(m.bypassHeader)), []byte(m.bypassValue)) == 1
+	if m.bypassHeader != "" {
+		req.Header.Del(m.bypassHeader)
+	}
+
+	if !m.IsEnabled() || bypass || (m.match != nil && !m.match(req)) || m.isAllowed(req) {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+
+	if m.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(m.retryAfter/time.Second)))
+	}
+	w.Header().Set("Content-Type", m.contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(m.page)
+}
+
+func (m *Maintenance) isAllowed(req *http.Request) bool {
+	if m.allowed == nil {
+		return false
+	}
+	ip := utils.ClientIP(req, m.trustedProxies)
+	return ip != nil && m.allowed.Contains(ip)
+}
+
+// Status is the state of the maintenance mode exposed by the API
+type Status struct {
+	Enabled bool `json:"enabled"`
+}
+
+// API returns a handler exposing the maintenance mode: GET returns the Status, PUT sets it, e.g. {"enabled": true}.
+// It must be protected, e.g. by an authentication middleware, as it lets the callers take the site down.
+func (m *Maintenance) API() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var status Status
+			if err := json.NewDecoder(req.Body).Decode(&status); err != nil {
+				http.Error(w, fmt.Sprintf("invalid status: %v", err), http.StatusBadRequest)
+				return
+			}
+			if status.Enabled {
+				m.Enable()
+			} else {
+				m.Disable()
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Status{Enabled: m.IsEnabled()})
+	})
+}
@@ -0,0 +1,104 @@
+package maintenance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Empty(t, req.Header.Get("X-Bypass"))
+		w.Write([]byte("served"))
+	})
+	m, err := New(next,
+		Enabled(true),
+		Page("text/html", []byte("<h1>Back soon</h1>")),
+		RetryAfter(10*time.Minute),
+		AllowIPs("192.0.2.0/24"),
+		BypassHeader("X-Bypass", "s3cret"),
+		Match(func(req *http.Request) bool { return !strings.HasPrefix(req.URL.Path, "/status") }))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		remoteAddr   string
+		path         string
+		header       string
+		expectedCode int
+	}{
+		{desc: "under maintenance", remoteAddr: "203.0.113.1:1234", path: "/", expectedCode: http.StatusServiceUnavailable},
+		{desc: "route not matching", remoteAddr: "203.0.113.1:1234", path: "/status", expectedCode: http.StatusOK},
+		{desc: "admin IP", remoteAddr: "192.0.2.10:1234", path: "/", expectedCode: http.StatusOK},
+		{desc: "bypass header", remoteAddr: "203.0.113.1:1234", path: "/", header: "s3cret", expectedCode: http.StatusOK},
+		{desc: "wrong bypass header", remoteAddr: "203.0.113.1:1234", path: "/", header: "guess", expectedCode: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.header != "" {
+				req.Header.Set("X-Bypass", test.header)
+			}
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, req)
+			assert.Equal(t, test.expectedCode, rec.Code)
+			if test.expectedCode == http.StatusServiceUnavailable {
+				assert.Equal(t, "600", rec.Header().Get("Retry-After"))
+				assert.Equal(t, "text/html", rec.Header().Get("Content-Type"))
+				assert.Equal(t, "<h1>Back soon</h1>", rec.Body.String())
+			} else {
+				assert.Equal(t, "served", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestMaintenanceAPI(t *testing.T) {
+	m, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	require.NoError(t, err)
+	api := httptest.NewServer(m.API())
+	defer api.Close()
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, serve())
+
+	for _, enabled := range []bool{true, false} {
+		body := `{"enabled": false}`
+		expectedCode := http.StatusOK
+		if enabled {
+			body, expectedCode = `{"enabled": true}`, http.StatusServiceUnavailable
+		}
+		req, err := http.NewRequest(http.MethodPut, api.URL, strings.NewReader(body))
+		require.NoError(t, err)
+		re, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		re.Body.Close()
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, enabled, m.IsEnabled())
+		assert.Equal(t, expectedCode, serve())
+	}
+
+	re, err := http.Post(api.URL, "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	re.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, re.StatusCode)
+}
+
+func TestMaintenanceInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{Page("", nil), RetryAfter(-time.Second), Match(nil), AllowIPs("nope"), BypassHeader("X-Bypass", "")} {
+		_, err := New(http.NotFoundHandler(), opt)
+		assert.Error(t, err)
+	}
+}
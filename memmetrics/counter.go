@@ -4,13 +4,13 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/utils"
 )
 
 type rcOptSetter func(*RollingCounter) error
 
 // CounterClock defines a counter clock
-func CounterClock(c timetools.TimeProvider) rcOptSetter {
+func CounterClock(c utils.Clock) rcOptSetter {
 	return func(r *RollingCounter) error {
 		r.clock = c
 		return nil
@@ -19,7 +19,7 @@ func CounterClock(c timetools.TimeProvider) rcOptSetter {
 
 // RollingCounter Calculates in memory failure rate of an endpoint using rolling window of a predefined size
 type RollingCounter struct {
-	clock          timetools.TimeProvider
+	clock          utils.Clock
 	resolution     time.Duration
 	values         []int
 	countedBuckets int // how many samples in different buckets have we collected so far
@@ -52,7 +52,7 @@ func NewCounter(buckets int, resolution time.Duration, options ...rcOptSetter) (
 	}
 
 	if rc.clock == nil {
-		rc.clock = &timetools.RealTime{}
+		rc.clock = utils.InheritedClock()
 	}
 
 	return rc, nil
@@ -145,15 +145,26 @@ func (c *RollingCounter) getBucket(t time.Time) int {
 func (c *RollingCounter) cleanup() {
 	now := c.clock.UtcNow()
 	for i := 0; i < len(c.values); i++ {
-		now = now.Add(time.Duration(-1*i) * c.resolution)
-		if now.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
-			c.values[c.getBucket(now)] = 0
+		t := now.Add(time.Duration(-1*i) * c.resolution)
+		if t.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
+			c.values[c.getBucket(t)] = 0
 		} else {
 			break
 		}
 	}
 }
 
+// countBetween counts the values of the buckets from since to until excluded, both truncated to the resolution and
+// within the window
+func (c *RollingCounter) countBetween(since, until time.Time) int64 {
+	c.cleanup()
+	out := int64(0)
+	for t := since.Truncate(c.resolution); t.Before(until); t = t.Add(c.resolution) {
+		out += int64(c.values[c.getBucket(t)])
+	}
+	return out
+}
+
 func (c *RollingCounter) sum() int64 {
 	out := int64(0)
 	for _, v := range c.values {
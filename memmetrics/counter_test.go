@@ -4,15 +4,13 @@ import (
 	"testing"
 	"time"
 
-	"github.com/mailgun/timetools"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
 )
 
 func TestCloneExpired(t *testing.T) {
-	clockTest := &timetools.FreezedTime{
-		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
-	}
+	clockTest := utils.NewFakeClock(time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC))
 
 	cnt, err := NewCounter(3, time.Second, CounterClock(clockTest))
 	require.NoError(t, err)
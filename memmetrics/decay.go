@@ -0,0 +1,182 @@
+package memmetrics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+type decayOptSetter func(*decay) error
+
+// DecayClock sets the clock of a decaying counter or ratio
+func DecayClock(clock utils.Clock) decayOptSetter {
+	return func(d *decay) error {
+		d.clock = clock
+		return nil
+	}
+}
+
+// decay holds the settings shared by the decaying counters
+type decay struct {
+	halfLife time.Duration
+	clock    utils.Clock
+}
+
+func newDecay(halfLife time.Duration, options []decayOptSetter) (*decay, error) {
+	if halfLife <= 0 {
+		return nil, fmt.Errorf("half-life should be > 0, got %v", halfLife)
+	}
+	d := &decay{halfLife: halfLife}
+	for _, o := range options {
+		if err := o(d); err != nil {
+			return nil, err
+		}
+	}
+	if d.clock == nil {
+		d.clock = utils.InheritedClock()
+	}
+	return d, nil
+}
+
+// factor returns the decay of a value recorded elapsed ago
+func (d *decay) factor(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 1
+	}
+	return math.Exp2(-float64(elapsed) / float64(d.halfLife))
+}
+
+// DecayingCounter is a counter whose values decay exponentially with time: a value counts half as much once the
+// half-life passed, a quarter after two half-lives and so on, so that the recent history matters more than in the
+// rolling windows of RollingCounter, and the former history still smooths the spikes.
+type DecayingCounter struct {
+	*decay
+
+	mutex       sync.Mutex
+	value       float64
+	lastUpdated time.Time
+}
+
+// NewDecayingCounter creates a counter decaying with the half-life
+func NewDecayingCounter(halfLife time.Duration, options ...decayOptSetter) (*DecayingCounter, error) {
+	d, err := newDecay(halfLife, options)
+	if err != nil {
+		return nil, err
+	}
+	return &DecayingCounter{decay: d}, nil
+}
+
+// Inc adds v to the counter
+func (c *DecayingCounter) Inc(v float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	c.value += v
+}
+
+// Value returns the decayed value of the counter
+func (c *DecayingCounter) Value() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	return c.value
+}
+
+// Rate returns the decayed rate of the counter per second: the value of a counter incremented at a steady rate
+// converges to the rate times the mean lifetime of the values, halfLife / ln 2
+func (c *DecayingCounter) Rate() float64 {
+	return c.Value() * math.Ln2 / c.halfLife.Seconds()
+}
+
+// Reset resets the counter to zero
+func (c *DecayingCounter) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.value = 0
+	c.lastUpdated = time.Time{}
+}
+
+func (c *DecayingCounter) update() {
+	now := c.clock.UtcNow()
+	if !c.lastUpdated.IsZero() {
+		c.value *= c.factor(now.Sub(c.lastUpdated))
+	}
+	c.lastUpdated = now
+}
+
+// DecayingRatio calculates the ratio a/a+b of two decaying counters, the decaying counterpart of RatioCounter
+type DecayingRatio struct {
+	*decay
+
+	mutex sync.Mutex
+	a, b  float64
+	// start is the time of the first value, the ratio is ready once a half-life passed
+	start       time.Time
+	lastUpdated time.Time
+}
+
+// NewDecayingRatio creates a ratio decaying with the half-life
+func NewDecayingRatio(halfLife time.Duration, options ...decayOptSetter) (*DecayingRatio, error) {
+	d, err := newDecay(halfLife, options)
+	if err != nil {
+		return nil, err
+	}
+	return &DecayingRatio{decay: d}, nil
+}
+
+// IncA increments the a counter
+func (r *DecayingRatio) IncA(v int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.update()
+	r.a += float64(v)
+}
+
+// IncB increments the b counter
+func (r *DecayingRatio) IncB(v int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.update()
+	r.b += float64(v)
+}
+
+// Ratio returns a/a+b, 0 when no values were recorded
+func (r *DecayingRatio) Ratio() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.a+r.b == 0 {
+		return 0
+	}
+	// both counters decay alike, the ratio does not need them to be updated
+	return r.a / (r.a + r.b)
+}
+
+// IsReady returns true once the values of a half-life at least were recorded
+func (r *DecayingRatio) IsReady() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return !r.start.IsZero() && r.clock.UtcNow().Sub(r.start) >= r.halfLife
+}
+
+// Reset resets the counters
+func (r *DecayingRatio) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.a, r.b = 0, 0
+	r.start, r.lastUpdated = time.Time{}, time.Time{}
+}
+
+func (r *DecayingRatio) update() {
+	now := r.clock.UtcNow()
+	if r.start.IsZero() {
+		r.start = now
+	} else {
+		f := r.factor(now.Sub(r.lastUpdated))
+		r.a *= f
+		r.b *= f
+	}
+	r.lastUpdated = now
+}
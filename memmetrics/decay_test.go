@@ -0,0 +1,92 @@
+package memmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestNewDecayingInvalidHalfLife(t *testing.T) {
+	_, err := NewDecayingCounter(0)
+	require.Error(t, err)
+
+	_, err = NewDecayingRatio(-time.Second)
+	require.Error(t, err)
+}
+
+func TestDecayingCounterHalfLife(t *testing.T) {
+	clock := testutils.GetClock()
+
+	c, err := NewDecayingCounter(10*time.Second, DecayClock(clock))
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, c.Value())
+
+	c.Inc(8)
+	assert.Equal(t, 8.0, c.Value())
+
+	clock.Advance(10 * time.Second)
+	assert.InDelta(t, 4.0, c.Value(), 1e-9)
+
+	c.Inc(4)
+	clock.Advance(20 * time.Second)
+	assert.InDelta(t, 2.0, c.Value(), 1e-9)
+
+	c.Reset()
+	assert.Equal(t, 0.0, c.Value())
+}
+
+func TestDecayingCounterRate(t *testing.T) {
+	clock := testutils.GetClock()
+
+	c, err := NewDecayingCounter(5*time.Second, DecayClock(clock))
+	require.NoError(t, err)
+
+	// 10 per second for many half-lives
+	for i := 0; i < 1000; i++ {
+		c.Inc(1)
+		clock.Advance(100 * time.Millisecond)
+	}
+	assert.InDelta(t, 10.0, c.Rate(), 0.5)
+}
+
+func TestDecayingRatio(t *testing.T) {
+	clock := testutils.GetClock()
+
+	r, err := NewDecayingRatio(10*time.Second, DecayClock(clock))
+	require.NoError(t, err)
+	assert.False(t, r.IsReady())
+	assert.Equal(t, 0.0, r.Ratio())
+
+	r.IncA(1)
+	r.IncB(1)
+	assert.False(t, r.IsReady())
+	assert.Equal(t, 0.5, r.Ratio())
+
+	clock.Advance(10 * time.Second)
+	assert.True(t, r.IsReady())
+
+	// the former values count half as much as the recent ones
+	r.IncA(1)
+	assert.InDelta(t, 1.5/2.0, r.Ratio(), 1e-9)
+
+	r.Reset()
+	assert.False(t, r.IsReady())
+	assert.Equal(t, 0.0, r.Ratio())
+}
+
+func TestDecayingRatioRecovers(t *testing.T) {
+	clock := testutils.GetClock()
+
+	r, err := NewDecayingRatio(time.Second, DecayClock(clock))
+	require.NoError(t, err)
+
+	r.IncA(100)
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+		r.IncB(1)
+	}
+	assert.True(t, r.Ratio() < 0.1)
+}
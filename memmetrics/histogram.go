@@ -5,7 +5,7 @@ import (
 	"time"
 
 	"github.com/codahale/hdrhistogram"
-	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/utils"
 )
 
 // HDRHistogram is a tiny wrapper around github.com/codahale/hdrhistogram that provides convenience functions for measuring http latencies
@@ -82,7 +82,7 @@ func (h *HDRHistogram) Merge(other *HDRHistogram) error {
 type rhOptSetter func(r *RollingHDRHistogram) error
 
 // RollingClock sets a clock
-func RollingClock(clock timetools.TimeProvider) rhOptSetter {
+func RollingClock(clock utils.Clock) rhOptSetter {
 	return func(r *RollingHDRHistogram) error {
 		r.clock = clock
 		return nil
@@ -100,7 +100,7 @@ type RollingHDRHistogram struct {
 	high        int64
 	sigfigs     int
 	buckets     []*HDRHistogram
-	clock       timetools.TimeProvider
+	clock       utils.Clock
 }
 
 // NewRollingHDRHistogram created a new RollingHDRHistogram
@@ -120,7 +120,7 @@ func NewRollingHDRHistogram(low, high int64, sigfigs int, period time.Duration,
 	}
 
 	if rh.clock == nil {
-		rh.clock = &timetools.RealTime{}
+		rh.clock = utils.InheritedClock()
 	}
 
 	buckets := make([]*HDRHistogram, rh.bucketCount)
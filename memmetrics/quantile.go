@@ -0,0 +1,355 @@
+package memmetrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// QuantileTarget is a quantile tracked by a QuantileStream with its rank error, e.g. {Quantile: 0.99, Epsilon: 0.001}
+// tracks the 99th percentile with a rank error of 0.1%
+type QuantileTarget struct {
+	Quantile float64
+	Epsilon  float64
+}
+
+// DefaultQuantileTargets are the targets of the latency quantiles of RTMetrics: the 50th, 90th and 99th percentiles
+var DefaultQuantileTargets = []QuantileTarget{
+	{Quantile: 0.5, Epsilon: 0.05},
+	{Quantile: 0.9, Epsilon: 0.01},
+	{Quantile: 0.99, Epsilon: 0.001},
+}
+
+// quantileBufferSize is the number of values buffered before they are merged into the samples
+const quantileBufferSize = 256
+
+type quantileSample struct {
+	value float64
+	// width is the difference between the lowest ranks of the sample and of the previous one, delta is the
+	// difference between the highest and the lowest ranks of the sample
+	width float64
+	delta float64
+}
+
+// QuantileStream estimates the targeted quantiles of a stream of values with the CKMS algorithm (Cormode, Korn,
+// Muthukrishnan and Srivastava, "Effective Computation of Biased Quantiles over Data Streams"). It keeps a few
+// hundred samples whatever the number of values, where a HDRHistogram keeps thousands of counters, at the cost of
+// the accuracy of the quantiles that are not targeted.
+//
+// QuantileStream is not thread safe.
+type QuantileStream struct {
+	targets []QuantileTarget
+	samples []quantileSample
+	n       float64
+	buffer  []float64
+}
+
+// NewQuantileStream returns a stream estimating the targeted quantiles, DefaultQuantileTargets if none is given
+func NewQuantileStream(targets ...QuantileTarget) (*QuantileStream, error) {
+	if len(targets) == 0 {
+		targets = DefaultQuantileTargets
+	}
+	for _, t := range targets {
+		if t.Quantile <= 0 || t.Quantile >= 1 {
+			return nil, fmt.Errorf("quantile should be in ]0, 1[, got %v", t.Quantile)
+		}
+		if t.Epsilon <= 0 || t.Epsilon >= 1 {
+			return nil, fmt.Errorf("epsilon should be in ]0, 1[, got %v", t.Epsilon)
+		}
+	}
+	return &QuantileStream{
+		targets: append([]QuantileTarget(nil), targets...),
+		buffer:  make([]float64, 0, quantileBufferSize),
+	}, nil
+}
+
+// Insert adds a value to the stream
+func (s *QuantileStream) Insert(v float64) {
+	s.buffer = append(s.buffer, v)
+	if len(s.buffer) == cap(s.buffer) {
+		s.flush()
+	}
+}
+
+// Query returns the estimation of the quantile q, in [0, 1], 0 if the stream is empty
+func (s *QuantileStream) Query(q float64) float64 {
+	s.flush()
+	if len(s.samples) == 0 {
+		return 0
+	}
+
+	rank := math.Ceil(q * s.n)
+	rank += math.Ceil(s.invariant(rank) / 2)
+	prev := s.samples[0]
+	var r float64
+	for _, c := range s.samples[1:] {
+		r += prev.width
+		if r+c.width+c.delta > rank {
+			return prev.value
+		}
+		prev = c
+	}
+	return prev.value
+}
+
+// LatencyAtQuantile returns the latency at the quantile q, in percents like HDRHistogram.LatencyAtQuantile, of a
+// stream of latencies in microseconds
+func (s *QuantileStream) LatencyAtQuantile(q float64) time.Duration {
+	return time.Duration(s.Query(q/100)) * time.Microsecond
+}
+
+// Count returns the number of values inserted
+func (s *QuantileStream) Count() int64 {
+	return int64(s.n) + int64(len(s.buffer))
+}
+
+// Samples returns the number of samples kept by the stream
+func (s *QuantileStream) Samples() int {
+	s.flush()
+	return len(s.samples)
+}
+
+// Reset drops the values of the stream
+func (s *QuantileStream) Reset() {
+	s.samples = s.samples[:0]
+	s.buffer = s.buffer[:0]
+	s.n = 0
+}
+
+// Merge adds the samples of the other stream, the quantiles of the result are estimations of the quantiles of the
+// union of the streams with the targets of s, their rank errors add up
+func (s *QuantileStream) Merge(other *QuantileStream) {
+	if other == nil {
+		return
+	}
+	other.flush()
+	s.flush()
+	s.merge(other.samples)
+}
+
+// Export returns a copy of the stream
+func (s *QuantileStream) Export() *QuantileStream {
+	return &QuantileStream{
+		targets: s.targets,
+		samples: append([]quantileSample(nil), s.samples...),
+		n:       s.n,
+		buffer:  append(make([]float64, 0, quantileBufferSize), s.buffer...),
+	}
+}
+
+func (s *QuantileStream) flush() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	sort.Float64s(s.buffer)
+	samples := make([]quantileSample, len(s.buffer))
+	for i, v := range s.buffer {
+		samples[i] = quantileSample{value: v, width: 1}
+	}
+	s.buffer = s.buffer[:0]
+	s.merge(samples)
+}
+
+// merge inserts the sorted samples and compresses the result
+func (s *QuantileStream) merge(samples []quantileSample) {
+	var r float64
+	i := 0
+	for _, sample := range samples {
+		inserted := false
+		for ; i < len(s.samples); i++ {
+			c := s.samples[i]
+			if c.value > sample.value {
+				s.samples = append(s.samples, quantileSample{})
+				copy(s.samples[i+1:], s.samples[i:])
+				s.samples[i] = quantileSample{
+					value: sample.value,
+					width: sample.width,
+					delta: math.Max(sample.delta, math.Floor(s.invariant(r))-1),
+				}
+				i++
+				inserted = true
+				break
+			}
+			r += c.width
+		}
+		if !inserted {
+			s.samples = append(s.samples, quantileSample{value: sample.value, width: sample.width})
+			i++
+		}
+		s.n += sample.width
+		r += sample.width
+	}
+	s.compress()
+}
+
+// compress merges the samples whose error bounds fit in the invariant
+func (s *QuantileStream) compress() {
+	if len(s.samples) < 2 {
+		return
+	}
+	x := s.samples[len(s.samples)-1]
+	xi := len(s.samples) - 1
+	r := s.n - 1 - x.width
+
+	for i := len(s.samples) - 2; i >= 0; i-- {
+		c := s.samples[i]
+		if c.width+x.width+x.delta <= s.invariant(r) {
+			x.width += c.width
+			s.samples[xi] = x
+			copy(s.samples[i:], s.samples[i+1:])
+			s.samples = s.samples[:len(s.samples)-1]
+			xi--
+		} else {
+			x = c
+			xi = i
+		}
+		r -= c.width
+	}
+}
+
+// invariant returns the allowed error at the rank r, the lowest of the targets
+func (s *QuantileStream) invariant(r float64) float64 {
+	m := math.MaxFloat64
+	for _, t := range s.targets {
+		var f float64
+		if t.Quantile*s.n <= r {
+			f = (2 * t.Epsilon * r) / t.Quantile
+		} else {
+			f = (2 * t.Epsilon * (s.n - r)) / (1 - t.Quantile)
+		}
+		if f < m {
+			m = f
+		}
+	}
+	return m
+}
+
+type rqOptSetter func(r *RollingQuantiles) error
+
+// RollingQuantilesClock sets a clock
+func RollingQuantilesClock(clock utils.Clock) rqOptSetter {
+	return func(r *RollingQuantiles) error {
+		r.clock = clock
+		return nil
+	}
+}
+
+// RollingQuantiles holds multiple quantile streams and rotates every period, like RollingHDRHistogram, so that the
+// quantiles are the ones of the values of the last bucketCount periods.
+type RollingQuantiles struct {
+	idx      int
+	lastRoll time.Time
+	period   time.Duration
+	targets  []QuantileTarget
+	buckets  []*QuantileStream
+	clock    utils.Clock
+}
+
+// NewRollingQuantiles creates a new RollingQuantiles tracking the targets, DefaultQuantileTargets if none is given
+func NewRollingQuantiles(period time.Duration, bucketCount int, targets []QuantileTarget, options ...rqOptSetter) (*RollingQuantiles, error) {
+	if period <= 0 || bucketCount <= 0 {
+		return nil, fmt.Errorf("period and bucket count should be > 0, got %v and %d", period, bucketCount)
+	}
+	rq := &RollingQuantiles{period: period, targets: targets}
+	for _, o := range options {
+		if err := o(rq); err != nil {
+			return nil, err
+		}
+	}
+	if rq.clock == nil {
+		rq.clock = utils.InheritedClock()
+	}
+
+	rq.buckets = make([]*QuantileStream, bucketCount)
+	for i := range rq.buckets {
+		s, err := NewQuantileStream(targets...)
+		if err != nil {
+			return nil, err
+		}
+		rq.buckets[i] = s
+	}
+	rq.lastRoll = rq.clock.UtcNow()
+	return rq, nil
+}
+
+// Export returns a copy of the RollingQuantiles
+func (r *RollingQuantiles) Export() *RollingQuantiles {
+	export := &RollingQuantiles{
+		idx:      r.idx,
+		lastRoll: r.lastRoll,
+		period:   r.period,
+		targets:  r.targets,
+		clock:    r.clock,
+		buckets:  make([]*QuantileStream, len(r.buckets)),
+	}
+	for i, s := range r.buckets {
+		export.buckets[i] = s.Export()
+	}
+	return export
+}
+
+// Append merges the buckets of the other RollingQuantiles into the ones of r
+func (r *RollingQuantiles) Append(o *RollingQuantiles) error {
+	if len(r.buckets) != len(o.buckets) || r.period != o.period {
+		return fmt.Errorf("can't merge")
+	}
+	for i := range r.buckets {
+		r.buckets[i].Merge(o.buckets[i])
+	}
+	return nil
+}
+
+// Reset drops the values of the buckets
+func (r *RollingQuantiles) Reset() {
+	r.idx = 0
+	r.lastRoll = r.clock.UtcNow()
+	for _, b := range r.buckets {
+		b.Reset()
+	}
+}
+
+// RecordLatency records a latency, in microseconds like RollingHDRHistogram.RecordLatencies
+func (r *RollingQuantiles) RecordLatency(d time.Duration) {
+	r.getStream().Insert(float64(d / time.Microsecond))
+}
+
+// Merged returns the merge of the streams of the buckets
+func (r *RollingQuantiles) Merged() (*QuantileStream, error) {
+	m, err := NewQuantileStream(r.targets...)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range r.buckets {
+		m.Merge(s)
+	}
+	return m, nil
+}
+
+// Count returns the number of latencies recorded in the buckets
+func (r *RollingQuantiles) Count() int64 {
+	var n int64
+	for _, s := range r.buckets {
+		n += s.Count()
+	}
+	return n
+}
+
+func (r *RollingQuantiles) getStream() *QuantileStream {
+	now := r.clock.UtcNow()
+	if elapsed := now.Sub(r.lastRoll); elapsed >= r.period {
+		// a bucket is dropped per elapsed period, all of them past the window
+		rotations := int(elapsed / r.period)
+		if rotations > len(r.buckets) {
+			rotations = len(r.buckets)
+		}
+		for i := 0; i < rotations; i++ {
+			r.idx = (r.idx + 1) % len(r.buckets)
+			r.buckets[r.idx].Reset()
+		}
+		r.lastRoll = now
+	}
+	return r.buckets[r.idx]
+}
@@ -0,0 +1,155 @@
+package memmetrics
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestQuantileStreamInvalidTargets(t *testing.T) {
+	_, err := NewQuantileStream(QuantileTarget{Quantile: 1, Epsilon: 0.01})
+	require.Error(t, err)
+
+	_, err = NewQuantileStream(QuantileTarget{Quantile: 0.5, Epsilon: 0})
+	require.Error(t, err)
+}
+
+func TestQuantileStreamAccuracy(t *testing.T) {
+	s, err := NewQuantileStream()
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, s.Query(0.5))
+
+	r := rand.New(rand.NewSource(42))
+	values := make([]float64, 100000)
+	for i := range values {
+		values[i] = r.ExpFloat64() * 1000
+		s.Insert(values[i])
+	}
+	sort.Float64s(values)
+
+	assert.EqualValues(t, len(values), s.Count())
+	for _, target := range DefaultQuantileTargets {
+		got := s.Query(target.Quantile)
+		// the rank of the estimation is within the rank error of the target
+		rank := float64(sort.SearchFloat64s(values, got)) / float64(len(values))
+		assert.InDelta(t, target.Quantile, rank, target.Epsilon, "quantile %v", target.Quantile)
+	}
+	// a few hundred samples are kept for 100k values
+	assert.True(t, s.Samples() < 1000, "%d samples", s.Samples())
+}
+
+func TestQuantileStreamMerge(t *testing.T) {
+	a, err := NewQuantileStream()
+	require.NoError(t, err)
+	b, err := NewQuantileStream()
+	require.NoError(t, err)
+
+	for i := 1; i <= 1000; i++ {
+		a.Insert(float64(i))
+		b.Insert(float64(i + 1000))
+	}
+	a.Merge(b)
+
+	// the rank errors of the merged streams add up
+	assert.EqualValues(t, 2000, a.Count())
+	assert.InDelta(t, 1000, a.Query(0.5), 2000*2*0.05)
+	assert.InDelta(t, 1980, a.Query(0.99), 2000*2*0.001)
+}
+
+func TestQuantileStreamExportReturnsNewCopy(t *testing.T) {
+	s, err := NewQuantileStream()
+	require.NoError(t, err)
+	s.Insert(1)
+
+	export := s.Export()
+	export.Insert(2)
+	export.Query(0.5)
+
+	assert.EqualValues(t, 1, s.Count())
+	assert.EqualValues(t, 2, export.Count())
+}
+
+func TestRollingQuantilesRotation(t *testing.T) {
+	clock := testutils.GetClock()
+
+	r, err := NewRollingQuantiles(time.Second, 2, nil, RollingQuantilesClock(clock))
+	require.NoError(t, err)
+
+	r.RecordLatency(5 * time.Millisecond)
+	s, err := r.Merged()
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Millisecond, s.LatencyAtQuantile(99))
+
+	clock.Advance(time.Second)
+	r.RecordLatency(2 * time.Millisecond)
+	assert.EqualValues(t, 2, r.Count())
+
+	// the first bucket is out of the window
+	clock.Advance(time.Second)
+	r.RecordLatency(time.Millisecond)
+	s, err = r.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, s.Count())
+	assert.Equal(t, 2*time.Millisecond, s.LatencyAtQuantile(99))
+
+	// all the buckets are out of the window
+	clock.Advance(time.Minute)
+	r.RecordLatency(3 * time.Millisecond)
+	assert.EqualValues(t, 1, r.Count())
+
+	r.Reset()
+	assert.EqualValues(t, 0, r.Count())
+}
+
+func TestRTMetricsQuantiles(t *testing.T) {
+	m, err := NewRTMetrics(RTQuantiles(), RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		m.Record(200, time.Duration(i)*time.Millisecond)
+	}
+
+	latencies, err := m.LatencyAtQuantiles(50, 99)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(50*time.Millisecond), float64(latencies[0]), float64(5*time.Millisecond))
+	assert.InDelta(t, float64(99*time.Millisecond), float64(latencies[1]), float64(time.Millisecond))
+
+	_, err = m.LatencyHistogram()
+	assert.Error(t, err)
+
+	export := m.Export()
+	export.Reset()
+	latencies, err = m.LatencyAtQuantiles(99)
+	require.NoError(t, err)
+	assert.NotZero(t, latencies[0])
+
+	other, err := NewRTMetrics(RTQuantiles(), RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+	require.NoError(t, other.Append(m))
+	assert.EqualValues(t, 100, other.TotalCount())
+
+	hdr, err := NewRTMetrics()
+	require.NoError(t, err)
+	assert.Error(t, hdr.Append(m))
+
+	m.Reset()
+	latencies, err = m.LatencyAtQuantiles(99)
+	require.NoError(t, err)
+	assert.Zero(t, latencies[0])
+}
+
+func TestRTMetricsLatencyAtQuantilesHistogram(t *testing.T) {
+	m, err := NewRTMetrics(RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+	m.Record(200, 10*time.Millisecond)
+
+	latencies, err := m.LatencyAtQuantiles(50, 99)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(10*time.Millisecond), float64(latencies[0]), float64(100*time.Microsecond))
+	assert.InDelta(t, float64(10*time.Millisecond), float64(latencies[1]), float64(100*time.Microsecond))
+}
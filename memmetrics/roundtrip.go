@@ -6,7 +6,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/utils"
 )
 
 // RTMetrics provides aggregated performance metrics for HTTP requests processing
@@ -20,11 +20,15 @@ type RTMetrics struct {
 	statusCodes     map[int]*RollingCounter
 	statusCodesLock sync.RWMutex
 	histogram       *RollingHDRHistogram
+	quantiles       *RollingQuantiles
 	histogramLock   sync.RWMutex
 
 	newCounter NewCounterFn
 	newHist    NewRollingHistogramFn
-	clock      timetools.TimeProvider
+	clock      utils.Clock
+
+	// quantileTargets are the targets of the quantile streams tracking the latencies instead of the histogram
+	quantileTargets []QuantileTarget
 }
 
 type rrOptSetter func(r *RTMetrics) error
@@ -54,8 +58,25 @@ func RTHistogram(fn NewRollingHistogramFn) rrOptSetter {
 	}
 }
 
+// RTQuantiles tracks the latencies with rolling quantile streams estimating the targets, DefaultQuantileTargets if
+// none is given, instead of a rolling HDR histogram. The streams take a few kilobytes where the histograms take about
+// 160 kilobytes, which matters when tracking thousands of servers or routes, but only the targeted quantiles are
+// accurate and LatencyHistogram returns an error, see LatencyAtQuantiles.
+func RTQuantiles(targets ...QuantileTarget) rrOptSetter {
+	return func(r *RTMetrics) error {
+		if len(targets) == 0 {
+			targets = DefaultQuantileTargets
+		}
+		if _, err := NewQuantileStream(targets...); err != nil {
+			return err
+		}
+		r.quantileTargets = targets
+		return nil
+	}
+}
+
 // RTClock sets a clock
-func RTClock(clock timetools.TimeProvider) rrOptSetter {
+func RTClock(clock utils.Clock) rrOptSetter {
 	return func(r *RTMetrics) error {
 		r.clock = clock
 		return nil
@@ -75,7 +96,7 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 	}
 
 	if m.clock == nil {
-		m.clock = &timetools.RealTime{}
+		m.clock = utils.InheritedClock()
 	}
 
 	if m.newCounter == nil {
@@ -84,15 +105,24 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 		}
 	}
 
-	if m.newHist == nil {
-		m.newHist = func() (*RollingHDRHistogram, error) {
-			return NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, histPeriod, histBuckets, RollingClock(m.clock))
+	if m.quantileTargets != nil {
+		q, err := NewRollingQuantiles(histPeriod, histBuckets, m.quantileTargets, RollingQuantilesClock(m.clock))
+		if err != nil {
+			return nil, err
+		}
+		m.quantiles = q
+	} else {
+		if m.newHist == nil {
+			m.newHist = func() (*RollingHDRHistogram, error) {
+				return NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, histPeriod, histBuckets, RollingClock(m.clock))
+			}
 		}
-	}
 
-	h, err := m.newHist()
-	if err != nil {
-		return nil, err
+		h, err := m.newHist()
+		if err != nil {
+			return nil, err
+		}
+		m.histogram = h
 	}
 
 	netErrors, err := m.newCounter()
@@ -105,7 +135,6 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 		return nil, err
 	}
 
-	m.histogram = h
 	m.netErrors = netErrors
 	m.total = total
 	return m, nil
@@ -131,9 +160,13 @@ func (m *RTMetrics) Export() *RTMetrics {
 	if m.histogram != nil {
 		export.histogram = m.histogram.Export()
 	}
+	if m.quantiles != nil {
+		export.quantiles = m.quantiles.Export()
+	}
 	export.newCounter = m.newCounter
 	export.newHist = m.newHist
 	export.clock = m.clock
+	export.quantileTargets = m.quantileTargets
 
 	return export
 }
@@ -203,6 +236,12 @@ func (m *RTMetrics) Append(other *RTMetrics) error {
 		}
 	}
 
+	if m.quantiles != nil || copied.quantiles != nil {
+		if m.quantiles == nil || copied.quantiles == nil {
+			return errors.New("RTMetrics cannot append latency histograms and quantiles")
+		}
+		return m.quantiles.Append(copied.quantiles)
+	}
 	return m.histogram.Append(copied.histogram)
 }
 
@@ -243,16 +282,98 @@ func (m *RTMetrics) StatusCodesCounts() map[int]int64 {
 func (m *RTMetrics) LatencyHistogram() (*HDRHistogram, error) {
 	m.histogramLock.Lock()
 	defer m.histogramLock.Unlock()
+	if m.histogram == nil {
+		return nil, errNoHistogram
+	}
 	return m.histogram.Merged()
 }
 
-// Reset reset metrics
+// LatencyAtQuantiles returns the latencies observed at the quantiles, in percents, e.g. 99 for the 99th percentile,
+// from the histogram or from the quantile streams, see RTQuantiles
+func (m *RTMetrics) LatencyAtQuantiles(quantiles ...float64) ([]time.Duration, error) {
+	m.histogramLock.Lock()
+	defer m.histogramLock.Unlock()
+
+	var q interface {
+		LatencyAtQuantile(q float64) time.Duration
+	}
+	if m.quantiles != nil {
+		s, err := m.quantiles.Merged()
+		if err != nil {
+			return nil, err
+		}
+		q = s
+	} else {
+		h, err := m.histogram.Merged()
+		if err != nil {
+			return nil, err
+		}
+		q = h
+	}
+
+	latencies := make([]time.Duration, len(quantiles))
+	for i, quantile := range quantiles {
+		latencies[i] = q.LatencyAtQuantile(quantile)
+	}
+	return latencies, nil
+}
+
+// RTSnapshot are the counts of the requests recorded by RTMetrics over a period, see RTMetrics.SnapshotSince
+type RTSnapshot struct {
+	// Since and Until are the bounds of the period, Until excluded
+	Since time.Time
+	Until time.Time
+
+	TotalCount        int64
+	NetworkErrorCount int64
+	StatusCodesCounts map[int]int64
+}
+
+// SnapshotSince returns the counts of the requests recorded since t, at the resolution of the counters: the period
+// starts at the counter bucket of t, or at the start of the window if t is older, and ends at the start of the
+// current bucket, which is still counting. A poller computes the deltas of the requests by taking the next snapshot
+// since the Until of the previous one, no request is counted twice or missed as long as it polls more often than the
+// counter window size.
+func (m *RTMetrics) SnapshotSince(t time.Time) RTSnapshot {
+	resolution := m.total.Resolution()
+	until := m.clock.UtcNow().Truncate(resolution)
+	since := t.Truncate(resolution)
+	if start := until.Add(-time.Duration(m.total.Buckets()-1) * resolution); since.Before(start) {
+		since = start
+	}
+	if since.After(until) {
+		since = until
+	}
+
+	s := RTSnapshot{
+		Since:             since,
+		Until:             until,
+		TotalCount:        m.total.countBetween(since, until),
+		NetworkErrorCount: m.netErrors.countBetween(since, until),
+		StatusCodesCounts: make(map[int]int64),
+	}
+
+	m.statusCodesLock.RLock()
+	defer m.statusCodesLock.RUnlock()
+	for code, c := range m.statusCodes {
+		if count := c.countBetween(since, until); count != 0 {
+			s.StatusCodesCounts[code] = count
+		}
+	}
+	return s
+}
+
+// Reset resets the counters and the latencies, e.g. to reuse the metrics in the tests
 func (m *RTMetrics) Reset() {
 	m.statusCodesLock.Lock()
 	defer m.statusCodesLock.Unlock()
 	m.histogramLock.Lock()
 	defer m.histogramLock.Unlock()
-	m.histogram.Reset()
+	if m.quantiles != nil {
+		m.quantiles.Reset()
+	} else {
+		m.histogram.Reset()
+	}
 	m.total.Reset()
 	m.netErrors.Reset()
 	m.statusCodes = make(map[int]*RollingCounter)
@@ -261,6 +382,10 @@ func (m *RTMetrics) Reset() {
 func (m *RTMetrics) recordLatency(d time.Duration) error {
 	m.histogramLock.Lock()
 	defer m.histogramLock.Unlock()
+	if m.quantiles != nil {
+		m.quantiles.RecordLatency(d)
+		return nil
+	}
 	return m.histogram.RecordLatencies(d, 1)
 }
 
@@ -291,6 +416,8 @@ func (m *RTMetrics) recordStatusCode(statusCode int) error {
 	return nil
 }
 
+var errNoHistogram = errors.New("latencies are tracked with quantile streams, there is no histogram")
+
 const (
 	counterBuckets         = 10
 	counterResolution      = time.Second
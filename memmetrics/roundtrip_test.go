@@ -6,10 +6,10 @@ import (
 	"testing"
 	"time"
 
-	"github.com/mailgun/timetools"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
 )
 
 func TestDefaults(t *testing.T) {
@@ -92,7 +92,7 @@ func TestConcurrentRecords(t *testing.T) {
 
 func TestRTMetricExportReturnsNewCopy(t *testing.T) {
 	a := RTMetrics{
-		clock:           &timetools.RealTime{},
+		clock:           utils.DefaultClock,
 		statusCodes:     map[int]*RollingCounter{},
 		statusCodesLock: sync.RWMutex{},
 		histogram:       &RollingHDRHistogram{},
@@ -149,3 +149,52 @@ func TestRTMetricExportReturnsNewCopy(t *testing.T) {
 		}
 	}
 }
+
+func TestRTMetricsSnapshotSince(t *testing.T) {
+	clock := testutils.GetClock()
+	rr, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+
+	start := clock.UtcNow()
+	rr.Record(200, time.Second)
+	rr.Record(502, time.Second)
+	clock.Advance(time.Second)
+	rr.Record(200, time.Second)
+
+	// the current bucket is still counting
+	s := rr.SnapshotSince(start)
+	assert.Equal(t, start, s.Since)
+	assert.Equal(t, start.Add(time.Second), s.Until)
+	assert.EqualValues(t, 2, s.TotalCount)
+	assert.EqualValues(t, 1, s.NetworkErrorCount)
+	assert.Equal(t, map[int]int64{200: 1, 502: 1}, s.StatusCodesCounts)
+
+	clock.Advance(1500 * time.Millisecond)
+	rr.Record(500, time.Second)
+	clock.Advance(time.Second)
+
+	s = rr.SnapshotSince(s.Until)
+	assert.Equal(t, start.Add(time.Second), s.Since)
+	assert.Equal(t, start.Add(3*time.Second), s.Until)
+	assert.EqualValues(t, 2, s.TotalCount)
+	assert.EqualValues(t, 0, s.NetworkErrorCount)
+	assert.Equal(t, map[int]int64{200: 1, 500: 1}, s.StatusCodesCounts)
+
+	// nothing new since the last snapshot
+	s = rr.SnapshotSince(s.Until)
+	assert.Equal(t, s.Since, s.Until)
+	assert.EqualValues(t, 0, s.TotalCount)
+	assert.Empty(t, s.StatusCodesCounts)
+
+	// the periods older than the window are not counted
+	clock.Advance(8 * time.Second)
+	s = rr.SnapshotSince(start)
+	assert.Equal(t, start.Add(2*time.Second), s.Since)
+	assert.EqualValues(t, 1, s.TotalCount)
+	assert.Equal(t, map[int]int64{500: 1}, s.StatusCodesCounts)
+
+	rr.Reset()
+	s = rr.SnapshotSince(start)
+	assert.EqualValues(t, 0, s.TotalCount)
+	assert.Empty(t, s.StatusCodesCounts)
+}
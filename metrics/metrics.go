@@ -0,0 +1,432 @@
+/*
+Package metrics provides a metrics registry the oxy middlewares register into, and a handler serving the metrics in
+the Prometheus text format.
+
+The forward, roundrobin, cbreaker, ratelimit, connlimit and buffer middlewares register their metrics with their
+Metrics option. The registry returned by With adds a label to the metrics registered through it, so that the
+middlewares of several routes, e.g. one circuit breaker per backend, share the same metrics.
+
+Examples of a metrics registry:
+
+	registry := metrics.NewRegistry()
+
+	fwd, err := forward.New(forward.Metrics(registry))
+	lb, err := roundrobin.New(fwd, roundrobin.Metrics(registry.With("backend", "api")))
+	cb, err := cbreaker.New(lb, "NetworkErrorRatio() > 0.5", cbreaker.Metrics(registry.With("backend", "api")))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+	mux.Handle("/", cb)
+*/
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the buckets of the latency histograms, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+var labelRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+// Registry holds the metrics of the middlewares, it is safe for concurrent use
+type Registry struct {
+	families *families
+	labels   []label
+}
+
+type families struct {
+	mutex  sync.Mutex
+	byName map[string]*family
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: &families{byName: make(map[string]*family)}}
+}
+
+// With returns a registry adding the label to the metrics registered through it,
+// the metrics are shared with the parent registry
+func (r *Registry) With(name, value string) *Registry {
+	labels := make([]label, len(r.labels), len(r.labels)+1)
+	copy(labels, r.labels)
+	return &Registry{families: r.families, labels: append(labels, label{name: name, value: value})}
+}
+
+// Counter returns the counter with the name, registering it on the first call
+func (r *Registry) Counter(name, help string, labelNames ...string) (*CounterVec, error) {
+	f, err := r.family(name, help, counterType, nil, labelNames)
+	if err != nil {
+		return nil, err
+	}
+	return &CounterVec{vec{family: f, labels: r.labels}}, nil
+}
+
+// Gauge returns the gauge with the name, registering it on the first call
+func (r *Registry) Gauge(name, help string, labelNames ...string) (*GaugeVec, error) {
+	f, err := r.family(name, help, gaugeType, nil, labelNames)
+	if err != nil {
+		return nil, err
+	}
+	return &GaugeVec{vec{family: f, labels: r.labels}}, nil
+}
+
+// Histogram returns the histogram with the name and the buckets, registering it on the first call
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) (*HistogramVec, error) {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		return nil, fmt.Errorf("metric %s: buckets should be sorted", name)
+	}
+	f, err := r.family(name, help, histogramType, buckets, labelNames)
+	if err != nil {
+		return nil, err
+	}
+	return &HistogramVec{vec{family: f, labels: r.labels}}, nil
+}
+
+// GaugeFunc registers a gauge whose value is read when the metrics are served, e.g. the state of a circuit breaker.
+// A function registered again with the same labels replaces the former one.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) error {
+	if fn == nil {
+		return fmt.Errorf("metric %s: function can not be nil", name)
+	}
+	f, err := r.family(name, help, gaugeType, nil, nil)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.funcs[renderLabels(r.labels, nil, nil)] = fn
+	return nil
+}
+
+func (r *Registry) family(name, help string, typ metricType, buckets []float64, labelNames []string) (*family, error) {
+	if !nameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid metric name %q", name)
+	}
+	for _, l := range labelNames {
+		if !labelRegexp.MatchString(l) || l == "le" {
+			return nil, fmt.Errorf("metric %s: invalid label name %q", name, l)
+		}
+	}
+	for _, l := range r.labels {
+		if !labelRegexp.MatchString(l.name) || l.name == "le" {
+			return nil, fmt.Errorf("metric %s: invalid label name %q", name, l.name)
+		}
+	}
+
+	r.families.mutex.Lock()
+	defer r.families.mutex.Unlock()
+	if f, ok := r.families.byName[name]; ok {
+		if f.typ != typ || strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") {
+			return nil, fmt.Errorf("metric %s is already registered as a %s with the labels %v", name, f.typ, f.labelNames)
+		}
+		return f, nil
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+		funcs:      make(map[string]func() float64),
+	}
+	r.families.byName[name] = f
+	return f, nil
+}
+
+// Handler returns a handler serving the metrics in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(r.Gather())
+	})
+}
+
+// Gather returns the metrics in the Prometheus text format
+func (r *Registry) Gather() []byte {
+	r.families.mutex.Lock()
+	list := make([]*family, 0, len(r.families.byName))
+	for _, f := range r.families.byName {
+		list = append(list, f)
+	}
+	r.families.mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	var buf bytes.Buffer
+	for _, f := range list {
+		f.write(&buf)
+	}
+	return buf.Bytes()
+}
+
+// family is the set of the series of a metric
+type family struct {
+	name       string
+	help       string
+	typ        metricType
+	buckets    []float64
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*series
+	funcs  map[string]func() float64
+}
+
+type series struct {
+	// bits holds the float64 value, or the sum of an histogram
+	bits   uint64
+	count  uint64
+	counts []uint64
+}
+
+func (s *series) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&s.bits)
+		if atomic.CompareAndSwapUint64(&s.bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (s *series) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.bits))
+}
+
+func (f *family) get(constLabels []label, values []string) *series {
+	if len(values) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labelNames), len(values)))
+	}
+	key := renderLabels(constLabels, f.labelNames, values)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{}
+		if f.typ == histogramType {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.series) == 0 && len(f.funcs) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series)+len(f.funcs))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	for key := range f.funcs {
+		if _, ok := f.series[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if fn, ok := f.funcs[key]; ok {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, key, formatFloat(fn()))
+			continue
+		}
+		s := f.series[key]
+		if f.typ != histogramType {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, key, formatFloat(s.value()))
+			continue
+		}
+		var cumulated uint64
+		for i, bound := range f.buckets {
+			cumulated += atomic.LoadUint64(&s.counts[i])
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, withLe(key, formatFloat(bound)), cumulated)
+		}
+		count := atomic.LoadUint64(&s.count)
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, withLe(key, "+Inf"), count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, key, formatFloat(s.value()))
+		fmt.Fprintf(buf, "%s_count%s %d\n", f.name, key, count)
+	}
+}
+
+// renderLabels returns the labels in the text format, e.g. {code="200",method="GET"}
+func renderLabels(constLabels []label, names, values []string) string {
+	if len(constLabels) == 0 && len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(constLabels)+len(names))
+	for _, l := range constLabels {
+		parts = append(parts, l.name+`="`+escapeValue(l.value)+`"`)
+	}
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeValue(values[i])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func withLe(key, le string) string {
+	if key == "" {
+		return `{le="` + le + `"}`
+	}
+	return key[:len(key)-1] + `,le="` + le + `"}`
+}
+
+var valueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeValue(v string) string {
+	return valueReplacer.Replace(v)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(v string) string {
+	return helpReplacer.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type vec struct {
+	family *family
+	labels []label
+}
+
+// CounterVec is a counter partitioned by its labels
+type CounterVec struct {
+	vec
+}
+
+// With returns the counter of the label values, given in the order of the label names
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{series: v.family.get(v.labels, values)}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	series *series
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.series.add(1)
+}
+
+// Add adds v, that must be positive, to the counter
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.series.add(v)
+}
+
+// Value returns the value of the counter
+func (c *Counter) Value() float64 {
+	return c.series.value()
+}
+
+// GaugeVec is a gauge partitioned by its labels
+type GaugeVec struct {
+	vec
+}
+
+// With returns the gauge of the label values, given in the order of the label names
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{series: v.family.get(v.labels, values)}
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	series *series
+}
+
+// Set sets the value of the gauge
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.series.bits, math.Float64bits(v))
+}
+
+// Add adds v to the gauge, v may be negative
+func (g *Gauge) Add(v float64) {
+	g.series.add(v)
+}
+
+// Inc increments the gauge by 1
+func (g *Gauge) Inc() {
+	g.series.add(1)
+}
+
+// Dec decrements the gauge by 1
+func (g *Gauge) Dec() {
+	g.series.add(-1)
+}
+
+// Value returns the value of the gauge
+func (g *Gauge) Value() float64 {
+	return g.series.value()
+}
+
+// HistogramVec is an histogram partitioned by its labels
+type HistogramVec struct {
+	vec
+}
+
+// With returns the histogram of the label values, given in the order of the label names
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{series: v.family.get(v.labels, values), buckets: v.family.buckets}
+}
+
+// Histogram counts the observations in buckets
+type Histogram struct {
+	series  *series
+	buckets []float64
+}
+
+// Observe records an observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.series.counts[i], 1)
+	}
+	atomic.AddUint64(&h.series.count, 1)
+	h.series.add(v)
+}
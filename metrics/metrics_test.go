@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	requests, err := r.Counter("requests_total", "Requests.", "code")
+	require.NoError(t, err)
+	requests.With("200").Inc()
+	requests.With("200").Add(2)
+	requests.With("500").Inc()
+	requests.With("500").Add(-1)
+
+	inflight, err := r.Gauge("in_flight", "Requests in flight.")
+	require.NoError(t, err)
+	inflight.With().Inc()
+	inflight.With().Inc()
+	inflight.With().Dec()
+
+	duration, err := r.Histogram("duration_seconds", "Durations.", []float64{0.1, 1})
+	require.NoError(t, err)
+	duration.With().Observe(0.05)
+	duration.With().Observe(0.1)
+	duration.With().Observe(5)
+
+	require.NoError(t, r.GaugeFunc("up", "Up.\nmultiline \\ help", func() float64 { return 1 }))
+
+	expected := `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 2
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 5.15
+duration_seconds_count 3
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 1
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="500"} 1
+# HELP up Up.\nmultiline \\ help
+# TYPE up gauge
+up 1
+`
+	assert.Equal(t, expected, string(r.Gather()))
+}
+
+func TestRegistryWith(t *testing.T) {
+	r := NewRegistry()
+
+	for _, backend := range []string{"b", "a"} {
+		sub := r.With("backend", backend)
+		requests, err := sub.Counter("requests_total", "Requests.", "code")
+		require.NoError(t, err)
+		requests.With("200").Inc()
+
+		latency, err := sub.Histogram("latency_seconds", "Latency.", []float64{1})
+		require.NoError(t, err)
+		latency.With().Observe(0.5)
+
+		state := 2.0
+		require.NoError(t, sub.With("quote", `"`).GaugeFunc("state", "State.", func() float64 { return state }))
+	}
+
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{backend="a",le="1"} 1
+latency_seconds_bucket{backend="a",le="+Inf"} 1
+latency_seconds_sum{backend="a"} 0.5
+latency_seconds_count{backend="a"} 1
+latency_seconds_bucket{backend="b",le="1"} 1
+latency_seconds_bucket{backend="b",le="+Inf"} 1
+latency_seconds_sum{backend="b"} 0.5
+latency_seconds_count{backend="b"} 1
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{backend="a",code="200"} 1
+requests_total{backend="b",code="200"} 1
+# HELP state State.
+# TYPE state gauge
+state{backend="a",quote="\""} 2
+state{backend="b",quote="\""} 2
+`
+	assert.Equal(t, expected, string(r.Gather()))
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	c, err := r.Counter("requests_total", "Requests.")
+	require.NoError(t, err)
+	c.With().Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "requests_total 1\n")
+}
+
+func TestRegistryInvalid(t *testing.T) {
+	r := NewRegistry()
+	_, err := r.Counter("requests_total", "Requests.", "code")
+	require.NoError(t, err)
+
+	_, err = r.Gauge("requests_total", "Requests.", "code")
+	assert.Error(t, err, "other type")
+	_, err = r.Counter("requests_total", "Requests.", "method")
+	assert.Error(t, err, "other labels")
+	_, err = r.Counter("invalid-name", "Invalid.")
+	assert.Error(t, err)
+	_, err = r.Counter("invalid_label", "Invalid.", "le")
+	assert.Error(t, err)
+	_, err = r.With("in-valid", "a").Counter("valid", "Valid.")
+	assert.Error(t, err)
+	_, err = r.Histogram("unsorted", "Unsorted.", []float64{1, 0.1})
+	assert.Error(t, err)
+	assert.Error(t, r.GaugeFunc("nil", "Nil.", nil))
+
+	assert.Panics(t, func() {
+		c, _ := r.Counter("requests_total", "Requests.", "code")
+		c.With()
+	})
+}
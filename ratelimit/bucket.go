@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/utils"
 )
 
 // UndefinedDelay  default delay
@@ -35,7 +35,7 @@ type tokenBucket struct {
 	// nether be larger then capacity.
 	availableTokens int64
 	// Interface that gives current time (so tests can override)
-	clock timetools.TimeProvider
+	clock utils.Clock
 	// Tells when tokensAvailable was updated the last time.
 	lastRefresh time.Time
 	// The number of tokens consumed the last time.
@@ -43,7 +43,7 @@ type tokenBucket struct {
 }
 
 // newTokenBucket crates a `tokenBucket` instance for the specified `Rate`.
-func newTokenBucket(rate *rate, clock timetools.TimeProvider) *tokenBucket {
+func newTokenBucket(rate *rate, clock utils.Clock) *tokenBucket {
 	return &tokenBucket{
 		period:          rate.period,
 		timePerToken:    time.Duration(int64(rate.period) / rate.average),
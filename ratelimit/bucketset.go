@@ -6,18 +6,20 @@ import (
 	"strings"
 	"time"
 
-	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/utils"
 )
 
 // TokenBucketSet represents a set of TokenBucket covering different time periods.
 type TokenBucketSet struct {
 	buckets   map[time.Duration]*tokenBucket
 	maxPeriod time.Duration
-	clock     timetools.TimeProvider
+	clock     utils.Clock
+	// nextRelease is the turn of the next request with Pacing
+	nextRelease time.Time
 }
 
 // NewTokenBucketSet creates a `TokenBucketSet` from the specified `rates`.
-func NewTokenBucketSet(rates *RateSet, clock timetools.TimeProvider) *TokenBucketSet {
+func NewTokenBucketSet(rates *RateSet, clock utils.Clock) *TokenBucketSet {
 	tbs := new(TokenBucketSet)
 	tbs.clock = clock
 	// In the majority of cases we will have only one bucket.
@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// epochThreshold tells the reset times given as a Unix time from the ones given as a number of seconds
+const epochThreshold = 1000000000
+
+// DefaultMaxUpstreamDelay is the default maximum time the budget reported by an upstream server lasts
+const DefaultMaxUpstreamDelay = time.Hour
+
+// upstreamBudget is the budget of a source as last reported by the upstream server
+type upstreamBudget struct {
+	remaining int64
+	reset     time.Time
+}
+
+// CooperativeThrottling adjusts the budget of each source to the limits the upstream servers report in their
+// responses, on top of the local rates, so that the limiter converges to the limits the upstream servers actually
+// enforce and rejects the requests they would reject anyway:
+//
+// - a 429 or a 503 response with a Retry-After header, in seconds or as an HTTP date, rejects the requests of the
+// source until then.
+//
+// - the X-RateLimit-Remaining and X-RateLimit-Reset headers, or the RateLimit-Remaining and RateLimit-Reset ones,
+// cap the requests of the source to the remaining number until the reset, in seconds or as a Unix time. Without a
+// reset header the budget lasts for the shortest period of the default rates.
+//
+// - a 429 response without these headers rejects the requests of the source for the shortest period of the default
+// rates.
+//
+// The budgets last at most for the max upstream delay, see MaxUpstreamDelay, and at most as many sources as the
+// capacity of the limiter are tracked.
+func CooperativeThrottling() TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		tl.upstream = make(map[string]*upstreamBudget)
+		return nil
+	}
+}
+
+// MaxUpstreamDelay sets the maximum time the budget reported by an upstream server lasts, e.g. a Retry-After of a
+// day is cut to this delay. It defaults to DefaultMaxUpstreamDelay.
+func MaxUpstreamDelay(d time.Duration) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		if d <= 0 {
+			return fmt.Errorf("bad max upstream delay: %v", d)
+		}
+		tl.maxUpstreamDelay = d
+		return nil
+	}
+}
+
+// checkUpstream checks the budget reported by the upstream server for the source, it returns the budget to consume
+// the tokens from once the local rates allowed the request, nil if there is none. It is called with the lock held.
+func (tl *TokenLimiter) checkUpstream(source string, amount int64) (*upstreamBudget, error) {
+	b, ok := tl.upstream[source]
+	if !ok {
+		return nil, nil
+	}
+	now := tl.clock.UtcNow()
+	if !now.Before(b.reset) {
+		delete(tl.upstream, source)
+		return nil, nil
+	}
+	if b.remaining < amount {
+		return nil, &MaxRateError{delay: b.reset.Sub(now)}
+	}
+	return b, nil
+}
+
+// serveCooperative serves the request and records the budget reported in the response
+func (tl *TokenLimiter) serveCooperative(w http.ResponseWriter, req *http.Request, source string) {
+	pw := utils.AcquireProxyWriter(w, tl.log)
+	defer utils.ReleaseProxyWriter(pw)
+
+	tl.next.ServeHTTP(pw, req)
+
+	now := tl.clock.UtcNow()
+	b, ok := tl.parseUpstreamBudget(pw.StatusCode(), w.Header(), now)
+	if !ok {
+		return
+	}
+
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if _, exists := tl.upstream[source]; !exists && len(tl.upstream) >= tl.capacity {
+		tl.pruneUpstream(now)
+		if len(tl.upstream) >= tl.capacity {
+			tl.evictUpstream()
+		}
+	}
+	tl.upstream[source] = b
+}
+
+func (tl *TokenLimiter) parseUpstreamBudget(code int, h http.Header, now time.Time) (*upstreamBudget, bool) {
+	if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+		if d, ok := parseRetryAfter(h.Get("Retry-After"), now); ok {
+			return &upstreamBudget{reset: tl.upstreamReset(now, d)}, true
+		}
+	}
+
+	if remaining, ok := parseRemaining(h); ok {
+		d, ok := parseReset(h, now)
+		if !ok {
+			d = tl.shortestPeriod()
+		}
+		return &upstreamBudget{remaining: remaining, reset: tl.upstreamReset(now, d)}, true
+	}
+
+	if code == http.StatusTooManyRequests {
+		return &upstreamBudget{reset: tl.upstreamReset(now, tl.shortestPeriod())}, true
+	}
+	return nil, false
+}
+
+// upstreamReset returns the reset of a budget lasting d, at most the max upstream delay
+func (tl *TokenLimiter) upstreamReset(now time.Time, d time.Duration) time.Time {
+	if d > tl.maxUpstreamDelay {
+		d = tl.maxUpstreamDelay
+	}
+	return now.Add(d)
+}
+
+// pruneUpstream drops the budgets past their reset, it is called with the lock held
+func (tl *TokenLimiter) pruneUpstream(now time.Time) {
+	for source, b := range tl.upstream {
+		if !now.Before(b.reset) {
+			delete(tl.upstream, source)
+		}
+	}
+}
+
+// evictUpstream drops the budget with the earliest reset, it is called with the lock held
+func (tl *TokenLimiter) evictUpstream() {
+	var evicted string
+	var earliest time.Time
+	for source, b := range tl.upstream {
+		if earliest.IsZero() || b.reset.Before(earliest) {
+			evicted, earliest = source, b.reset
+		}
+	}
+	delete(tl.upstream, evicted)
+}
+
+func (tl *TokenLimiter) shortestPeriod() time.Duration {
+	var shortest time.Duration
+	for period := range tl.defaultRates.m {
+		if shortest == 0 || period < shortest {
+			shortest = period
+		}
+	}
+	return shortest
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, false
+}
+
+func parseRemaining(h http.Header) (int64, bool) {
+	for _, name := range []string{"X-Ratelimit-Remaining", "Ratelimit-Remaining"} {
+		if value := strings.TrimSpace(h.Get(name)); value != "" {
+			remaining, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || remaining < 0 {
+				return 0, false
+			}
+			return remaining, true
+		}
+	}
+	return 0, false
+}
+
+// parseReset parses a reset header, in seconds or as a Unix time
+func parseReset(h http.Header, now time.Time) (time.Duration, bool) {
+	for _, name := range []string{"X-Ratelimit-Reset", "Ratelimit-Reset"} {
+		value := strings.TrimSpace(h.Get(name))
+		if value == "" {
+			continue
+		}
+		reset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || reset < 0 {
+			return 0, false
+		}
+		if reset < epochThreshold {
+			return time.Duration(reset) * time.Second, true
+		}
+		if d := time.Unix(reset, 0).Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, false
+	}
+	return 0, false
+}
@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// upstreamHeaders is an upstream handler replying with the scripted headers and code
+type upstreamHeaders struct {
+	mutex  sync.Mutex
+	code   int
+	header http.Header
+}
+
+func (u *upstreamHeaders) set(code int, header http.Header) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.code, u.header = code, header
+}
+
+func (u *upstreamHeaders) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for k, vv := range u.header {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(u.code)
+}
+
+func TestCooperativeThrottlingRemaining(t *testing.T) {
+	upstream := &upstreamHeaders{code: http.StatusOK}
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 100, 100))
+
+	clock := testutils.GetClock()
+
+	l, err := New(upstream, headerLimit, rates, Clock(clock), CooperativeThrottling())
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	upstream.set(http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"2"}, "X-Ratelimit-Reset": {"10"}})
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the upstream server allows 2 more requests in the next 10 seconds
+	upstream.set(http.StatusOK, nil)
+	for i := 0; i < 2; i++ {
+		re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "10", re.Header.Get("Retry-After"))
+
+	// the other sources are not limited
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	clock.Advance(10 * time.Second)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+func TestCooperativeThrottlingRetryAfter(t *testing.T) {
+	clock := testutils.GetClock()
+
+	testCases := []struct {
+		desc     string
+		code     int
+		header   http.Header
+		blockFor time.Duration
+	}{
+		{
+			desc:     "retry after seconds",
+			code:     http.StatusTooManyRequests,
+			header:   http.Header{"Retry-After": {"30"}},
+			blockFor: 30 * time.Second,
+		},
+		{
+			desc:     "retry after date",
+			code:     http.StatusServiceUnavailable,
+			header:   http.Header{"Retry-After": {clock.UtcNow().Add(time.Minute).Format(http.TimeFormat)}},
+			blockFor: time.Minute,
+		},
+		{
+			desc:     "reset as a unix time",
+			code:     http.StatusOK,
+			header:   http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {strconv.FormatInt(clock.UtcNow().Add(20*time.Second).Unix(), 10)}},
+			blockFor: 20 * time.Second,
+		},
+		{
+			desc:     "retry after over the max delay",
+			code:     http.StatusTooManyRequests,
+			header:   http.Header{"Retry-After": {"86400"}},
+			blockFor: DefaultMaxUpstreamDelay,
+		},
+		{
+			desc:     "429 without headers",
+			code:     http.StatusTooManyRequests,
+			blockFor: time.Second,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			clock := testutils.GetClock()
+			upstream := &upstreamHeaders{}
+			upstream.set(test.code, test.header)
+
+			rates := NewRateSet()
+			require.NoError(t, rates.Add(time.Second, 100, 100))
+
+			l, err := New(upstream, headerLimit, rates, Clock(clock), CooperativeThrottling())
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(l)
+			defer srv.Close()
+
+			re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, test.code, re.StatusCode)
+
+			upstream.set(http.StatusOK, nil)
+			clock.Advance(test.blockFor - time.Millisecond)
+			re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+			clock.Advance(time.Millisecond)
+			re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+		})
+	}
+}
+
+func TestCooperativeThrottlingCapacity(t *testing.T) {
+	upstream := &upstreamHeaders{}
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 100, 100))
+
+	clock := testutils.GetClock()
+	l, err := New(upstream, headerLimit, rates, Clock(clock), Capacity(2), CooperativeThrottling(), MaxUpstreamDelay(time.Minute))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	for _, budget := range []struct{ source, retryAfter string }{{"a", "30"}, {"b", "10"}, {"c", "3600"}} {
+		upstream.set(http.StatusTooManyRequests, http.Header{"Retry-After": {budget.retryAfter}})
+		_, _, err = testutils.Get(srv.URL, testutils.Header("Source", budget.source))
+		require.NoError(t, err)
+	}
+
+	// the budget of b, the first to reset, made room for the one of c
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	assert.Len(t, l.upstream, 2)
+	assert.Contains(t, l.upstream, "a")
+	require.Contains(t, l.upstream, "c")
+	assert.Equal(t, clock.UtcNow().Add(time.Minute), l.upstream["c"].reset)
+}
+
+func TestMaxUpstreamDelayInvalid(t *testing.T) {
+	_, err := New(nil, headerLimit, NewRateSet(), MaxUpstreamDelay(0))
+	assert.Error(t, err)
+}
+
+func TestParseUpstreamBudgetIgnored(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+	l, err := New(nil, headerLimit, rates, CooperativeThrottling())
+	require.NoError(t, err)
+
+	now := time.Now()
+	for _, h := range []http.Header{
+		{},
+		{"X-Ratelimit-Remaining": {"many"}},
+		{"X-Ratelimit-Remaining": {"-1"}},
+		// a Retry-After of a 200 response is not a limit
+		{"Retry-After": {"10"}},
+	} {
+		_, ok := l.parseUpstreamBudget(http.StatusOK, h, now)
+		assert.False(t, ok, h)
+	}
+}
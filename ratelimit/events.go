@@ -0,0 +1,13 @@
+package ratelimit
+
+import (
+	"github.com/vulcand/oxy/events"
+)
+
+// Events sets the emitter the rate limiter publishes the rejected requests to, as events.RateLimited
+func Events(e events.Emitter) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		tl.events = e
+		return nil
+	}
+}
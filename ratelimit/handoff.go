@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const limiterStateVersion = 1
+
+type limiterState struct {
+	Version int                       `json:"version"`
+	Sources map[string][]bucketRecord `json:"sources"`
+}
+
+type bucketRecord struct {
+	BucketState
+	LastRefresh time.Time `json:"lastRefresh"`
+}
+
+// SaveState saves the token buckets of the sources, see utils.StateHandoff
+func (tl *TokenLimiter) SaveState() ([]byte, error) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	tl.pruneSources()
+	state := limiterState{Version: limiterStateVersion, Sources: make(map[string][]bucketRecord, len(tl.sources))}
+	for source := range tl.sources {
+		bucketSetI, exists := tl.bucketSets.Get(source)
+		if !exists {
+			continue
+		}
+		bucketSet := bucketSetI.(*TokenBucketSet)
+		records := make([]bucketRecord, 0, len(bucketSet.buckets))
+		for _, bucket := range bucketSet.buckets {
+			bucket.updateAvailableTokens()
+			records = append(records, bucketRecord{
+				BucketState: BucketState{
+					Period:    bucket.period,
+					Average:   int64(bucket.period / bucket.timePerToken),
+					Burst:     bucket.burst,
+					Available: bucket.availableTokens,
+				},
+				LastRefresh: bucket.lastRefresh,
+			})
+		}
+		state.Sources[source] = records
+	}
+	return json.Marshal(state)
+}
+
+// RestoreState restores the token buckets saved by SaveState, the tokens refilled while the state was handed off
+// included. The buckets are updated to the rates of the requests as usual.
+func (tl *TokenLimiter) RestoreState(data []byte) error {
+	var state limiterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version != limiterStateVersion {
+		return fmt.Errorf("unsupported token limiter state version: %d", state.Version)
+	}
+
+	bucketSets := make(map[string]*TokenBucketSet, len(state.Sources))
+	for source, records := range state.Sources {
+		rates := NewRateSet()
+		for _, r := range records {
+			if err := rates.Add(r.Period, r.Average, r.Burst); err != nil {
+				return fmt.Errorf("invalid bucket of %v: %v", source, err)
+			}
+		}
+		bucketSet := NewTokenBucketSet(rates, tl.clock)
+		for _, r := range records {
+			bucket := bucketSet.buckets[r.Period]
+			bucket.availableTokens = r.Available
+			bucket.lastRefresh = r.LastRefresh
+			bucket.updateAvailableTokens()
+		}
+		bucketSets[source] = bucketSet
+	}
+
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	for source, bucketSet := range bucketSets {
+		tl.setBucketSet(source, bucketSet)
+	}
+	return nil
+}
+
+// setBucketSet sets the buckets of a source
+func (tl *TokenLimiter) setBucketSet(source string, bucketSet *TokenBucketSet) {
+	// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
+	// the counters for this ip will expire after 10 seconds of inactivity
+	tl.bucketSets.Set(source, bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
+	if len(tl.sources) >= 2*tl.capacity {
+		tl.pruneSources()
+	}
+	tl.sources[source] = struct{}{}
+}
+
+// pruneSources forgets the sources whose buckets expired or were evicted
+func (tl *TokenLimiter) pruneSources() {
+	for source := range tl.sources {
+		if _, exists := tl.bucketSets.Get(source); !exists {
+			delete(tl.sources, source)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+var _ utils.StateHandoff = (*TokenLimiter)(nil)
+
+func TestTokenLimiterStateHandoff(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 2))
+
+	clock := testutils.GetClock()
+
+	l, err := New(handler, headerLimit, rates, Clock(clock))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	for i := 0; i < 2; i++ {
+		re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	srv.Close()
+
+	data, err := l.SaveState()
+	require.NoError(t, err)
+
+	// the replacing limiter keeps limiting the source
+	restarted, err := New(handler, headerLimit, rates, Clock(clock))
+	require.NoError(t, err)
+	require.NoError(t, restarted.RestoreState(data))
+
+	buckets, ok := restarted.Buckets("a")
+	require.True(t, ok)
+	assert.Equal(t, []BucketState{{Period: time.Second, Average: 1, Burst: 2, Available: 0}}, buckets)
+
+	srv = httptest.NewServer(restarted)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// the tokens refill as they would have
+	clock.Sleep(time.Second)
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
+func TestTokenLimiterRestoreStateInvalid(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	l, err := New(http.NotFoundHandler(), headerLimit, rates)
+	require.NoError(t, err)
+
+	assert.Error(t, l.RestoreState([]byte(`{"version":42}`)))
+	assert.Error(t, l.RestoreState([]byte(`{"version":1,"sources":{"a":[{"period":0,"average":1,"burst":1}]}}`)))
+	assert.Error(t, l.RestoreState([]byte(`invalid`)))
+	assert.Equal(t, 0, l.Sources())
+}
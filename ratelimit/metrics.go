@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"github.com/vulcand/oxy/metrics"
+)
+
+// limiterMetrics are the metrics of the rate limiter registered by the Metrics option
+type limiterMetrics struct {
+	allowed *metrics.Counter
+	limited *metrics.Counter
+}
+
+// Metrics registers the metrics of the rate limiter into the registry:
+//
+//	oxy_ratelimit_requests_total{result} counts the requests by result, allowed or limited
+//	oxy_ratelimit_sources is the number of sources having token buckets
+func Metrics(r *metrics.Registry) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		requests, err := r.Counter("oxy_ratelimit_requests_total", "Requests checked by the rate limiter, by result.", "result")
+		if err != nil {
+			return err
+		}
+		err = r.GaugeFunc("oxy_ratelimit_sources", "Sources having token buckets in the rate limiter.", func() float64 {
+			tl.mutex.Lock()
+			defer tl.mutex.Unlock()
+			if tl.bucketSets == nil {
+				return 0
+			}
+			return float64(tl.bucketSets.Len())
+		})
+		if err != nil {
+			return err
+		}
+		tl.metrics = &limiterMetrics{allowed: requests.With("allowed"), limited: requests.With("limited")}
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Pacing spaces out the requests of a source at the rate of its bucket of the shortest period, e.g. a request every
+// 10ms for 100 requests per second, instead of letting a full bucket through at once, for the backends sensitive to
+// micro bursts even when the average rates are respected. The buckets of the longer periods, e.g. 1000 requests per
+// hour along with the 100 per second, reject the requests over their rates as usual. A request arriving before its turn waits for it up to maxWait, a
+// request whose turn is further away is rejected like a request over the rates. A maxWait of 0 rejects the requests
+// arriving early.
+//
+// The waiting requests hold their tokens, and are released with the clock of the limiter.
+func Pacing(maxWait time.Duration) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		if maxWait < 0 {
+			return fmt.Errorf("pacing max wait should be >= 0, got %v", maxWait)
+		}
+		tl.pacing = true
+		tl.maxPacingWait = maxWait
+		return nil
+	}
+}
+
+// turn returns the release time of a request of the bucket set, with the delay of the request if it is rejected
+func (tl *TokenLimiter) turn(bucketSet *TokenBucketSet) (time.Time, error) {
+	now := tl.clock.UtcNow()
+	release := bucketSet.nextRelease
+	if release.Before(now) {
+		release = now
+	}
+	if wait := release.Sub(now); wait > tl.maxPacingWait {
+		return release, &MaxRateError{delay: wait - tl.maxPacingWait}
+	}
+	return release, nil
+}
+
+// awaitTurn waits for the release time of the request, it returns false if the request is canceled in the meantime
+func (tl *TokenLimiter) awaitTurn(req *http.Request, wait time.Duration) bool {
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-tl.clock.After(wait):
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// paceInterval returns the interval between the requests consuming tokens, at the rate of the bucket of the shortest
+// period
+func (tbs *TokenBucketSet) paceInterval(tokens int64) time.Duration {
+	var shortest *tokenBucket
+	for _, bucket := range tbs.buckets {
+		if shortest == nil || bucket.period < shortest.period {
+			shortest = bucket
+		}
+	}
+	if shortest == nil {
+		return 0
+	}
+	return shortest.timePerToken * time.Duration(tokens)
+}
@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestPacingRejectsEarlyRequests(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 10, 10))
+
+	clock := testutils.GetClock()
+	l, err := New(handler, headerLimit, rates, Clock(clock), Pacing(0))
+	require.NoError(t, err)
+
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Source", "a")
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the bucket is full, but the requests are spaced by 100ms
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+
+	clock.Advance(50 * time.Millisecond)
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+
+	clock.Advance(50 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve())
+
+	// the tokens were only consumed by the allowed requests
+	states, ok := l.Buckets("a")
+	require.True(t, ok)
+	assert.EqualValues(t, 9, states[0].Available)
+}
+
+func TestPacingDelaysEarlyRequests(t *testing.T) {
+	served := make(chan struct{}, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served <- struct{}{}
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 10, 10))
+
+	clock := testutils.GetClock()
+	l, err := New(handler, headerLimit, rates, Clock(clock), Pacing(150*time.Millisecond))
+	require.NoError(t, err)
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Source", "a")
+		return req
+	}
+
+	l.ServeHTTP(httptest.NewRecorder(), newRequest())
+	<-served
+
+	// the second request waits for its turn, 100ms later
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, newRequest())
+		done <- rec.Code
+	}()
+	waitForWaiters(t, clock, 1)
+
+	// the third request turn is 200ms later, over the max wait
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, newRequest())
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	clock.Advance(100 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, <-done)
+	<-served
+
+	// a canceled request is not served
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		l.ServeHTTP(httptest.NewRecorder(), newRequest().WithContext(ctx))
+		close(done)
+	}()
+	waitForWaiters(t, clock, 1)
+	cancel()
+	<-done
+	assert.Empty(t, served)
+}
+
+func TestPacingMultipleRates(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 100, 100))
+	require.NoError(t, rates.Add(time.Hour, 3, 3))
+
+	clock := testutils.GetClock()
+	l, err := New(handler, headerLimit, rates, Clock(clock), Pacing(0))
+	require.NoError(t, err)
+
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Source", "a")
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the requests are spaced at the rate of the second, 10ms
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+	clock.Advance(10 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve())
+	clock.Advance(10 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve())
+
+	// the rate of the hour rejects the requests once its bucket is empty
+	clock.Advance(10 * time.Millisecond)
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+}
+
+func TestPacingInvalidMaxWait(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 10, 10))
+
+	_, err := New(http.NotFoundHandler(), headerLimit, rates, Pacing(-time.Second))
+	assert.Error(t, err)
+}
+
+// waitForWaiters waits for n goroutines to wait on the clock
+func waitForWaiters(t *testing.T, clock *utils.FakeClock, n int) {
+	deadline := time.Now().Add(time.Second)
+	for clock.Waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are waiting on the clock, expected %d", clock.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	// DefaultRateCacheCapacity is the default number of keys cached by a CachedRateExtractor
+	DefaultRateCacheCapacity = 65536
+	// DefaultRateLookupConcurrency is the default number of lookups a CachedRateExtractor runs at once
+	DefaultRateLookupConcurrency = 16
+)
+
+// RateLookup looks up the rates of a key, e.g. the rates of the plan of an API key in a database
+type RateLookup func(key string) (*RateSet, error)
+
+// CachedRateExtractor is a RateExtractor looking up the rates of the requests by key, e.g. by API key, in the
+// background: the requests never wait for a lookup.
+//
+// The rates of a key are cached for the TTL. Until the first lookup of a key completes, or when it fails, the
+// requests get the fallback rates, the default rates of the token limiter if not set. Once the TTL is over, the
+// requests get the cached rates while they are looked up again. When as many lookups as the lookup concurrency are
+// running, the lookup of a key is deferred to one of its next requests.
+type CachedRateExtractor struct {
+	key         utils.SourceExtractor
+	lookup      RateLookup
+	ttl         time.Duration
+	fallback    *RateSet
+	capacity    int
+	concurrency int
+	clock       utils.Clock
+
+	// lookups holds a token per running lookup
+	lookups chan struct{}
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// lru orders the entries from the most to the least recently extracted
+	lru *list.List
+
+	log *log.Logger
+}
+
+type rateEntry struct {
+	key string
+	// rates is nil when the lookup failed
+	rates   *RateSet
+	expires time.Time
+	// pending is true while the rates are looked up
+	pending bool
+}
+
+// CachedRateOption is a functional option setter for CachedRateExtractor
+type CachedRateOption func(e *CachedRateExtractor) error
+
+// RateFallback sets the rates of the keys while their rates are unknown, e.g. the rates of the free plan
+func RateFallback(rates *RateSet) CachedRateOption {
+	return func(e *CachedRateExtractor) error {
+		e.fallback = rates
+		return nil
+	}
+}
+
+// RateCacheCapacity sets the number of keys cached, the least recently used keys are evicted once it is reached.
+// It defaults to DefaultRateCacheCapacity.
+func RateCacheCapacity(capacity int) CachedRateOption {
+	return func(e *CachedRateExtractor) error {
+		if capacity <= 0 {
+			return fmt.Errorf("bad capacity: %v", capacity)
+		}
+		e.capacity = capacity
+		return nil
+	}
+}
+
+// RateLookupConcurrency sets the number of lookups running at once, it defaults to DefaultRateLookupConcurrency
+func RateLookupConcurrency(n int) CachedRateOption {
+	return func(e *CachedRateExtractor) error {
+		if n <= 0 {
+			return fmt.Errorf("bad lookup concurrency: %v", n)
+		}
+		e.concurrency = n
+		return nil
+	}
+}
+
+// RateCacheClock sets the clock
+func RateCacheClock(clock utils.Clock) CachedRateOption {
+	return func(e *CachedRateExtractor) error {
+		e.clock = clock
+		return nil
+	}
+}
+
+// RateCacheLogger defines the logger the cached rate extractor will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func RateCacheLogger(l *log.Logger) CachedRateOption {
+	return func(e *CachedRateExtractor) error {
+		e.log = l
+		return nil
+	}
+}
+
+// NewCachedRateExtractor creates a RateExtractor looking up the rates of the key extracted from the requests, cached
+// for the TTL
+func NewCachedRateExtractor(key utils.SourceExtractor, lookup RateLookup, ttl time.Duration, opts ...CachedRateOption) (*CachedRateExtractor, error) {
+	if key == nil {
+		return nil, fmt.Errorf("provide key extractor")
+	}
+	if lookup == nil {
+		return nil, fmt.Errorf("provide rate lookup")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid ttl: %v", ttl)
+	}
+	e := &CachedRateExtractor{
+		key:         key,
+		lookup:      lookup,
+		ttl:         ttl,
+		capacity:    DefaultRateCacheCapacity,
+		concurrency: DefaultRateLookupConcurrency,
+		clock:       utils.InheritedClock(),
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		log:         utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(e); err != nil {
+			return nil, err
+		}
+	}
+	e.lookups = make(chan struct{}, e.concurrency)
+	if e.fallback == nil {
+		// the token limiter applies its default rates to an empty rate set
+		e.fallback = NewRateSet()
+	}
+	return e, nil
+}
+
+// Extract returns the cached rates of the key of the request, or the fallback rates, and looks them up in the
+// background when they are unknown or expired
+func (e *CachedRateExtractor) Extract(req *http.Request) (*RateSet, error) {
+	key, _, err := e.key.Extract(req)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var entry *rateEntry
+	if el, ok := e.entries[key]; ok {
+		e.lru.MoveToFront(el)
+		entry = el.Value.(*rateEntry)
+	} else {
+		e.evict()
+		entry = &rateEntry{key: key}
+		e.entries[key] = e.lru.PushFront(entry)
+	}
+	if !entry.pending && !e.clock.UtcNow().Before(entry.expires) {
+		select {
+		case e.lookups <- struct{}{}:
+			entry.pending = true
+			go e.refresh(entry)
+		default:
+			// as many lookups as the concurrency are running
+		}
+	}
+	if entry.rates == nil {
+		return e.fallback, nil
+	}
+	return entry.rates, nil
+}
+
+func (e *CachedRateExtractor) refresh(entry *rateEntry) {
+	defer func() { <-e.lookups }()
+	rates, err := e.lookup(entry.key)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	entry.pending = false
+	entry.expires = e.clock.UtcNow().Add(e.ttl)
+	if err != nil {
+		// the failed lookups are retried after the ttl as well, the formerly looked up rates are kept meanwhile
+		e.log.Errorf("vulcand/oxy/ratelimit: failed to look up the rates of %v: %v", entry.key, err)
+		return
+	}
+	entry.rates = rates
+}
+
+// evict removes the least recently used key when the cache is full
+func (e *CachedRateExtractor) evict() {
+	for len(e.entries) >= e.capacity {
+		el := e.lru.Back()
+		e.lru.Remove(el)
+		delete(e.entries, el.Value.(*rateEntry).key)
+	}
+}
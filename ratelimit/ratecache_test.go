@@ -0,0 +1,199 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// plans are the rates of the API keys, looked up by the tests
+type plans struct {
+	mutex   sync.Mutex
+	rates   map[string]*RateSet
+	lookups int
+}
+
+func (p *plans) lookup(key string) (*RateSet, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.lookups++
+	rates, ok := p.rates[key]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+	return rates, nil
+}
+
+func (p *plans) set(key string, rates *RateSet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.rates[key] = rates
+}
+
+func newRates(t *testing.T, average int64) *RateSet {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, average, average))
+	return rates
+}
+
+// extractUntil extracts the rates of the key until they are the expected rates
+func extractUntil(t *testing.T, e *CachedRateExtractor, key string, expected *RateSet) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Source", key)
+	deadline := time.Now().Add(time.Second)
+	for {
+		rates, err := e.Extract(req)
+		require.NoError(t, err)
+		if rates == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rates of %s: got %v, expected %v", key, rates, expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachedRateExtractor(t *testing.T) {
+	gold, silver, free := newRates(t, 100), newRates(t, 10), newRates(t, 1)
+	p := &plans{rates: map[string]*RateSet{"a": gold}}
+	clock := testutils.GetClock()
+
+	e, err := NewCachedRateExtractor(headerLimit, p.lookup, time.Minute, RateFallback(free), RateCacheClock(clock))
+	require.NoError(t, err)
+
+	// the fallback rates apply until the rates are looked up
+	extractUntil(t, e, "a", free)
+	extractUntil(t, e, "a", gold)
+	extractUntil(t, e, "b", free)
+
+	// the rates are cached for the ttl, then looked up again
+	p.set("a", silver)
+	clock.Advance(30 * time.Second)
+	extractUntil(t, e, "a", gold)
+	clock.Advance(31 * time.Second)
+	extractUntil(t, e, "a", gold)
+	extractUntil(t, e, "a", silver)
+
+	// the cached rates are kept when the lookup fails
+	p.mutex.Lock()
+	delete(p.rates, "a")
+	p.mutex.Unlock()
+	clock.Advance(2 * time.Minute)
+	extractUntil(t, e, "a", silver)
+	waitFor(t, func() bool {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		return !e.entries["a"].Value.(*rateEntry).pending
+	})
+	extractUntil(t, e, "a", silver)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	assert.Equal(t, 4, p.lookups)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachedRateExtractorLimiter(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defaultRates := newRates(t, 1)
+	clock := testutils.GetClock()
+	p := &plans{rates: map[string]*RateSet{"a": newRates(t, 3)}}
+
+	e, err := NewCachedRateExtractor(headerLimit, p.lookup, time.Minute, RateCacheClock(clock))
+	require.NoError(t, err)
+	l, err := New(handler, headerLimit, defaultRates, Clock(clock), ExtractRates(e))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Source", "a")
+
+	// the first request gets the default rates of the limiter
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	l.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestCachedRateExtractorCapacity(t *testing.T) {
+	p := &plans{rates: map[string]*RateSet{}}
+	e, err := NewCachedRateExtractor(headerLimit, p.lookup, time.Minute, RateCacheCapacity(2))
+	require.NoError(t, err)
+
+	// a is extracted again before c, b is the least recently used key
+	for _, key := range []string{"a", "b", "a", "c"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Source", key)
+		_, err := e.Extract(req)
+		require.NoError(t, err)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	assert.Len(t, e.entries, 2)
+	assert.Contains(t, e.entries, "a")
+	assert.Contains(t, e.entries, "c")
+	assert.Equal(t, 2, e.lru.Len())
+}
+
+func TestCachedRateExtractorConcurrency(t *testing.T) {
+	gold, free := newRates(t, 100), newRates(t, 1)
+	p := &plans{rates: map[string]*RateSet{"a": gold, "b": gold}}
+	release := make(chan struct{})
+	lookup := func(key string) (*RateSet, error) {
+		<-release
+		return p.lookup(key)
+	}
+
+	e, err := NewCachedRateExtractor(headerLimit, lookup, time.Minute, RateFallback(free), RateLookupConcurrency(1))
+	require.NoError(t, err)
+
+	// the lookup of b waits for the lookup of a to complete
+	extractUntil(t, e, "a", free)
+	extractUntil(t, e, "b", free)
+	e.mutex.Lock()
+	assert.False(t, e.entries["b"].Value.(*rateEntry).pending)
+	e.mutex.Unlock()
+
+	close(release)
+	extractUntil(t, e, "a", gold)
+	extractUntil(t, e, "b", gold)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	assert.Equal(t, 2, p.lookups)
+}
+
+func TestCachedRateExtractorInvalidParams(t *testing.T) {
+	p := &plans{}
+	_, err := NewCachedRateExtractor(nil, p.lookup, time.Minute)
+	assert.Error(t, err)
+	_, err = NewCachedRateExtractor(headerLimit, nil, time.Minute)
+	assert.Error(t, err)
+	_, err = NewCachedRateExtractor(headerLimit, p.lookup, time.Minute, RateLookupConcurrency(0))
+	assert.Error(t, err)
+	_, err = NewCachedRateExtractor(headerLimit, p.lookup, 0)
+	assert.Error(t, err)
+	_, err = NewCachedRateExtractor(headerLimit, p.lookup, time.Minute, RateCacheCapacity(0))
+	assert.Error(t, err)
+}
@@ -4,12 +4,13 @@ package ratelimit
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/mailgun/timetools"
 	"github.com/mailgun/ttlmap"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -66,12 +67,24 @@ type TokenLimiter struct {
 	defaultRates *RateSet
 	extract      utils.SourceExtractor
 	extractRates RateExtractor
-	clock        timetools.TimeProvider
+	clock        utils.Clock
 	mutex        sync.Mutex
 	bucketSets   *ttlmap.TtlMap
-	errHandler   utils.ErrorHandler
-	capacity     int
-	next         http.Handler
+	// sources are the keys of bucketSets, for the state handoff
+	sources map[string]struct{}
+	// upstream are the budgets reported by the upstream servers, see CooperativeThrottling
+	upstream   map[string]*upstreamBudget
+	errHandler utils.ErrorHandler
+	capacity   int
+	next       http.Handler
+	metrics    *limiterMetrics
+	events     events.Emitter
+	skip       func(req *http.Request) bool
+	// pacing spaces out the requests of a source, see Pacing
+	pacing        bool
+	maxPacingWait time.Duration
+	// maxUpstreamDelay caps the budgets reported by the upstream servers, see MaxUpstreamDelay
+	maxUpstreamDelay time.Duration
 
 	log *log.Logger
 }
@@ -89,7 +102,7 @@ func New(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet
 		defaultRates: defaultRates,
 		extract:      extract,
 
-		log: log.StandardLogger(),
+		log: utils.InheritedLogger(),
 	}
 
 	for _, o := range opts {
@@ -103,6 +116,7 @@ func New(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet
 		return nil, err
 	}
 	tl.bucketSets = bucketSets
+	tl.sources = make(map[string]struct{})
 	return tl, nil
 }
 
@@ -122,25 +136,58 @@ func (tl *TokenLimiter) Wrap(next http.Handler) {
 }
 
 func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if tl.skip != nil && tl.skip(req) {
+		tl.next.ServeHTTP(w, req)
+		return
+	}
+
 	source, amount, err := tl.extract.Extract(req)
 	if err != nil {
 		tl.errHandler.ServeHTTP(w, req, err)
 		return
 	}
 
-	if err := tl.consumeRates(req, source, amount); err != nil {
-		tl.log.Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
+	wait, err := tl.consumeRates(req, source, amount)
+	if err != nil {
+		if tl.metrics != nil {
+			tl.metrics.limited.Inc()
+		}
+		if tl.events != nil {
+			tl.events.Emit(events.RateLimited{Request: req, Source: source, Err: err})
+		}
+		if utils.Sampled(tl.log, log.WarnLevel, "limiting request %v %v, limit: %v") {
+			tl.log.Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
+		}
 		tl.errHandler.ServeHTTP(w, req, err)
 		return
 	}
+	if !tl.awaitTurn(req, wait) {
+		return
+	}
+	if tl.metrics != nil {
+		tl.metrics.allowed.Inc()
+	}
 
+	if tl.upstream != nil {
+		tl.serveCooperative(w, req, source)
+		return
+	}
 	tl.next.ServeHTTP(w, req)
 }
 
-func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) error {
+// consumeRates consumes the tokens of the request, it returns how long the request waits for its turn with Pacing
+func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) (time.Duration, error) {
 	tl.mutex.Lock()
 	defer tl.mutex.Unlock()
 
+	var budget *upstreamBudget
+	if tl.upstream != nil {
+		var err error
+		if budget, err = tl.checkUpstream(source, amount); err != nil {
+			return 0, err
+		}
+	}
+
 	effectiveRates := tl.resolveRates(req)
 	bucketSetI, exists := tl.bucketSets.Get(source)
 	var bucketSet *TokenBucketSet
@@ -150,18 +197,72 @@ func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount in
 		bucketSet.Update(effectiveRates)
 	} else {
 		bucketSet = NewTokenBucketSet(effectiveRates, tl.clock)
-		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
-		// the counters for this ip will expire after 10 seconds of inactivity
-		tl.bucketSets.Set(source, bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
+		tl.setBucketSet(source, bucketSet)
+	}
+
+	var release time.Time
+	if tl.pacing {
+		var err error
+		if release, err = tl.turn(bucketSet); err != nil {
+			return 0, err
+		}
 	}
 	delay, err := bucketSet.Consume(amount)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if delay > 0 {
-		return &MaxRateError{delay: delay}
+		return 0, &MaxRateError{delay: delay}
 	}
-	return nil
+	if budget != nil {
+		budget.remaining -= amount
+	}
+	if tl.pacing {
+		bucketSet.nextRelease = release.Add(bucketSet.paceInterval(amount))
+		return release.Sub(tl.clock.UtcNow()), nil
+	}
+	return 0, nil
+}
+
+// BucketState is the state of a token bucket of a source
+type BucketState struct {
+	Period  time.Duration `json:"period"`
+	Average int64         `json:"average"`
+	Burst   int64         `json:"burst"`
+	// Available is the number of tokens the source can consume right now
+	Available int64 `json:"available"`
+}
+
+// Buckets returns the state of the token buckets of a source, sorted by period,
+// false if the source has no buckets, e.g. its buckets expired
+func (tl *TokenLimiter) Buckets(source string) ([]BucketState, bool) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	bucketSetI, exists := tl.bucketSets.Get(source)
+	if !exists {
+		return nil, false
+	}
+	bucketSet := bucketSetI.(*TokenBucketSet)
+	states := make([]BucketState, 0, len(bucketSet.buckets))
+	for _, bucket := range bucketSet.buckets {
+		bucket.updateAvailableTokens()
+		states = append(states, BucketState{
+			Period:    bucket.period,
+			Average:   int64(bucket.period / bucket.timePerToken),
+			Burst:     bucket.burst,
+			Available: bucket.availableTokens,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Period < states[j].Period })
+	return states, true
+}
+
+// Sources returns the number of sources having token buckets
+func (tl *TokenLimiter) Sources() int {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	return tl.bucketSets.Len()
 }
 
 // effectiveRates retrieves rates to be applied to the request.
@@ -195,6 +296,11 @@ func (m *MaxRateError) Error() string {
 	return fmt.Sprintf("max rate reached: retry-in %v", m.delay)
 }
 
+// Is matches utils.ErrRateLimited
+func (m *MaxRateError) Is(target error) bool {
+	return target == utils.ErrRateLimited
+}
+
 // RateErrHandler error handler
 type RateErrHandler struct{}
 
@@ -228,8 +334,17 @@ func ExtractRates(e RateExtractor) TokenLimiterOption {
 	}
 }
 
+// SkipFunc sets a predicate of the requests passed to the next handler without being rate limited,
+// e.g. the health checks
+func SkipFunc(skip func(req *http.Request) bool) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.skip = skip
+		return nil
+	}
+}
+
 // Clock sets the clock
-func Clock(clock timetools.TimeProvider) TokenLimiterOption {
+func Clock(clock utils.Clock) TokenLimiterOption {
 	return func(cl *TokenLimiter) error {
 		cl.clock = clock
 		return nil
@@ -254,9 +369,12 @@ func setDefaults(tl *TokenLimiter) {
 		tl.capacity = DefaultCapacity
 	}
 	if tl.clock == nil {
-		tl.clock = &timetools.RealTime{}
+		tl.clock = utils.InheritedClock()
 	}
 	if tl.errHandler == nil {
 		tl.errHandler = defaultErrHandler
 	}
+	if tl.maxUpstreamDelay == 0 {
+		tl.maxUpstreamDelay = DefaultMaxUpstreamDelay
+	}
 }
@@ -9,6 +9,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/events"
+	"github.com/vulcand/oxy/metrics"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
 )
@@ -347,3 +349,108 @@ func faultyExtractor(_ *http.Request) (string, int64, error) {
 
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
+
+func TestMetrics(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+	registry := metrics.NewRegistry()
+
+	l, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()), Metrics(registry))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	for _, source := range []string{"a", "a", "b"} {
+		_, _, err = testutils.Get(srv.URL, testutils.Header("Source", source))
+		require.NoError(t, err)
+	}
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, `oxy_ratelimit_requests_total{result="allowed"} 2`)
+	assert.Contains(t, gathered, `oxy_ratelimit_requests_total{result="limited"} 1`)
+	assert.Contains(t, gathered, "oxy_ratelimit_sources 2\n")
+}
+
+func TestEvents(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+	bus := events.NewBus()
+	var received []events.RateLimited
+	bus.Subscribe(func(m events.Message) {
+		received = append(received, m.Event.(events.RateLimited))
+	}, events.RateLimit)
+
+	l, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()), Events(bus))
+	require.NoError(t, err)
+
+	for _, source := range []string{"a", "a", "b"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Source", source)
+		l.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	require.Len(t, received, 1)
+	assert.Equal(t, "a", received[0].Source)
+	assert.IsType(t, &MaxRateError{}, received[0].Err)
+	assert.True(t, utils.IsError(received[0].Err, utils.ErrRateLimited))
+}
+
+func TestSkipFunc(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	l, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()),
+		SkipFunc(func(req *http.Request) bool { return req.URL.Path == "/health" }))
+	require.NoError(t, err)
+
+	for _, path := range []string{"/", "/health", "/health"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Source", "a")
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Source", "a")
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func BenchmarkTokenLimiter(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	rates := NewRateSet()
+	require.NoError(b, rates.Add(time.Second, 1000000, 1<<30))
+	extractor, err := utils.NewExtractor("client.ip")
+	require.NoError(b, err)
+
+	tl, err := New(handler, extractor, rates)
+	require.NoError(b, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := testutils.NewDiscardWriter()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		tl.ServeHTTP(w, req)
+	}
+}
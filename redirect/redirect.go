@@ -0,0 +1,231 @@
+/*
+Package redirect provides a middleware redirecting the requests before they are forwarded.
+
+The scheme upgrade, the host canonicalization and the rules are evaluated in this order on the URL of the request,
+their results are combined so that the client is redirected at most once. Requests left untouched are passed
+to the next handler.
+
+Examples of a redirect middleware:
+
+	// http to https, www.example.com to example.com
+	r, err := redirect.New(handler, redirect.HTTPS(), redirect.CanonicalHost("example.com"), redirect.Permanent(true))
+
+	// regular expressions on the full URL
+	r, err := redirect.New(handler, redirect.Rule(`^https?://[^/]+/blog/(.*)`, "https://blog.example.com/$1"))
+*/
+package redirect
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+type rule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// Redirect is a middleware redirecting requests
+type Redirect struct {
+	next               http.Handler
+	https              bool
+	httpsPort          string
+	host               string
+	rules              []rule
+	permanent          bool
+	trustForwardHeader bool
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Redirect
+type Option func(r *Redirect) error
+
+// New creates a new Redirect middleware, redirects are temporary by default
+func New(next http.Handler, opts ...Option) (*Redirect, error) {
+	r := &Redirect{
+		next: next,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// HTTPS redirects the plain HTTP requests to HTTPS, on the default port
+func HTTPS() Option {
+	return func(r *Redirect) error {
+		r.https = true
+		return nil
+	}
+}
+
+// HTTPSPort redirects the plain HTTP requests to HTTPS on the given port
+func HTTPSPort(port int) Option {
+	return func(r *Redirect) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		r.https = true
+		r.httpsPort = fmt.Sprint(port)
+		if port == 443 {
+			r.httpsPort = ""
+		}
+		return nil
+	}
+}
+
+// CanonicalHost redirects the requests for other hosts to the given one, the port of the request is kept
+func CanonicalHost(host string) Option {
+	return func(r *Redirect) error {
+		if host == "" || strings.ContainsAny(host, "/:") {
+			return fmt.Errorf("invalid canonical host %q", host)
+		}
+		r.host = strings.ToLower(host)
+		return nil
+	}
+}
+
+// Rule adds a redirect rule matching the full URL of the request, e.g. https://example.com/path?query.
+// The replacement can reference the capture groups, e.g. $1 or ${name}.
+// The first matching rule is applied, after the scheme and host redirects.
+func Rule(pattern, replacement string) Option {
+	return func(r *Redirect) error {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redirect pattern %q: %v", pattern, err)
+		}
+		r.rules = append(r.rules, rule{re: re, replacement: replacement})
+		return nil
+	}
+}
+
+// Permanent makes the redirects permanent: 301, or 308 for the methods other than GET and HEAD.
+// Temporary redirects are 302, or 307 for the methods other than GET and HEAD.
+func Permanent(permanent bool) Option {
+	return func(r *Redirect) error {
+		r.permanent = permanent
+		return nil
+	}
+}
+
+// TrustForwardHeader uses the X-Forwarded-Proto and X-Forwarded-Host headers set by a proxy in front of oxy
+// to determine the URL of the request
+func TrustForwardHeader(trust bool) Option {
+	return func(r *Redirect) error {
+		r.trustForwardHeader = trust
+		return nil
+	}
+}
+
+// Logger defines the logger the redirect middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(r *Redirect) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by redirect handler.
+func (r *Redirect) Wrap(next http.Handler) error {
+	r.next = next
+	return nil
+}
+
+func (r *Redirect) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/redirect: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/redirect: completed ServeHttp on request")
+	}
+
+	location, ok := r.location(req)
+	if !ok {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+
+	code := http.StatusFound
+	switch {
+	case r.permanent && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		code = http.StatusMovedPermanently
+	case r.permanent:
+		code = http.StatusPermanentRedirect
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		code = http.StatusTemporaryRedirect
+	}
+	r.log.Debugf("vulcand/oxy/redirect: redirecting %s to %s with %d", req.URL, location, code)
+	http.Redirect(w, req, location, code)
+}
+
+// location returns the URL the request is redirected to, if any
+func (r *Redirect) location(req *http.Request) (string, bool) {
+	original := r.requestURL(req)
+	u := *original
+
+	if r.https && u.Scheme == "http" {
+		u.Scheme = "https"
+		u.Host = withPort(u.Hostname(), r.httpsPort)
+	}
+	if r.host != "" && !strings.EqualFold(u.Hostname(), r.host) {
+		u.Host = withPort(r.host, u.Port())
+	}
+
+	location := u.String()
+	for _, rl := range r.rules {
+		match := rl.re.FindStringSubmatchIndex(location)
+		if match == nil {
+			continue
+		}
+		location = string(rl.re.ExpandString(nil, rl.replacement, location, match))
+		break
+	}
+	return location, location != original.String()
+}
+
+// requestURL returns the absolute URL of the request as sent by the client
+func (r *Redirect) requestURL(req *http.Request) *url.URL {
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	if req.TLS != nil {
+		u.Scheme = "https"
+	}
+	if r.trustForwardHeader {
+		if proto := strings.ToLower(req.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			u.Scheme = proto
+		}
+		if host := req.Header.Get("X-Forwarded-Host"); host != "" {
+			u.Host = host
+		}
+	}
+	return u
+}
+
+func withPort(host, port string) string {
+	if port == "" {
+		if strings.Contains(host, ":") {
+			// IPv6 literal
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
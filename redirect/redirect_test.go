@@ -0,0 +1,165 @@
+package redirect
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirect(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		opts             []Option
+		method           string
+		url              string
+		tls              bool
+		headers          map[string]string
+		expectedCode     int
+		expectedLocation string
+	}{
+		{
+			desc:             "https upgrade",
+			opts:             []Option{HTTPS()},
+			url:              "http://example.com/path?q=1",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://example.com/path?q=1",
+		},
+		{
+			desc:         "already https",
+			opts:         []Option{HTTPS()},
+			url:          "https://example.com/path",
+			tls:          true,
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:             "https upgrade drops the http port",
+			opts:             []Option{HTTPS()},
+			url:              "http://example.com:8080/",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://example.com/",
+		},
+		{
+			desc:             "https upgrade on a port",
+			opts:             []Option{HTTPSPort(8443)},
+			url:              "http://example.com:8080/",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://example.com:8443/",
+		},
+		{
+			desc:         "forwarded https",
+			opts:         []Option{HTTPS(), TrustForwardHeader(true)},
+			url:          "http://example.com/",
+			headers:      map[string]string{"X-Forwarded-Proto": "https"},
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:             "untrusted forwarded https",
+			opts:             []Option{HTTPS()},
+			url:              "http://example.com/",
+			headers:          map[string]string{"X-Forwarded-Proto": "https"},
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://example.com/",
+		},
+		{
+			desc:             "canonical host",
+			opts:             []Option{CanonicalHost("example.com")},
+			url:              "http://www.example.com:8080/path",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "http://example.com:8080/path",
+		},
+		{
+			desc:         "canonical host case insensitive",
+			opts:         []Option{CanonicalHost("example.com")},
+			url:          "http://EXAMPLE.com/path",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:             "https and canonical host in a single redirect",
+			opts:             []Option{HTTPS(), CanonicalHost("example.com"), Permanent(true)},
+			url:              "http://www.example.com/path",
+			expectedCode:     http.StatusMovedPermanently,
+			expectedLocation: "https://example.com/path",
+		},
+		{
+			desc:             "rule",
+			opts:             []Option{Rule(`^https?://[^/]+/blog/(.*)`, "https://blog.example.com/$1")},
+			url:              "http://example.com/blog/post?id=1",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://blog.example.com/post?id=1",
+		},
+		{
+			desc:         "rule without match",
+			opts:         []Option{Rule(`^https?://[^/]+/blog/(.*)`, "https://blog.example.com/$1")},
+			url:          "http://example.com/news",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:             "rule applied after the https upgrade",
+			opts:             []Option{HTTPS(), Rule(`^https://example.com/old$`, "https://example.com/new")},
+			url:              "http://example.com/old",
+			expectedCode:     http.StatusFound,
+			expectedLocation: "https://example.com/new",
+		},
+		{
+			desc:             "temporary keeps the method",
+			opts:             []Option{HTTPS()},
+			method:           http.MethodPost,
+			url:              "http://example.com/",
+			expectedCode:     http.StatusTemporaryRedirect,
+			expectedLocation: "https://example.com/",
+		},
+		{
+			desc:             "permanent keeps the method",
+			opts:             []Option{HTTPS(), Permanent(true)},
+			method:           http.MethodPost,
+			url:              "http://example.com/",
+			expectedCode:     http.StatusPermanentRedirect,
+			expectedLocation: "https://example.com/",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			r, err := New(next, test.opts...)
+			require.NoError(t, err)
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, test.url, nil)
+			if !test.tls {
+				req.TLS = nil
+			} else if req.TLS == nil {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			assert.Equal(t, test.expectedCode, rec.Code)
+			assert.Equal(t, test.expectedLocation, rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestRedirectInvalidOptions(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), Rule(`(`, "/"))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), HTTPSPort(0))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), CanonicalHost("example.com:80"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,186 @@
+/*
+Package requestid provides a middleware identifying every request with a unique ID.
+
+The ID is stored in the request context, set on the upstream request and on the response headers, so that the logs of
+the middlewares, the upstreams and the clients can be correlated. Trace records and forward logs include it.
+
+Examples of a request ID middleware:
+
+	// random UUIDs in the X-Request-Id header
+	rid, err := requestid.New(handler)
+
+	// IDs set by a trusted load balancer in front of oxy are kept
+	rid, err := requestid.New(handler, requestid.Header("X-Amzn-Trace-Id"), requestid.TrustHeader(true))
+
+	// the ID is available to the next handlers
+	id, ok := requestid.FromContext(req.Context())
+*/
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultHeader is the header carrying the request ID
+const DefaultHeader = "X-Request-Id"
+
+// maxLength limits the size of the trusted incoming IDs
+const maxLength = 128
+
+// Generator generates unique request IDs, e.g. UUIDs or KSUIDs
+type Generator func() (string, error)
+
+// NewUUID generates a random (version 4) UUID
+func NewUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID stored in ctx
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok
+}
+
+// RequestID is a middleware tagging the requests with a unique ID
+type RequestID struct {
+	next        http.Handler
+	header      string
+	trustHeader bool
+	generate    Generator
+
+	errHandler utils.ErrorHandler
+	log        *log.Logger
+}
+
+// Option is a functional option setter for RequestID
+type Option func(r *RequestID) error
+
+// New creates a new RequestID middleware
+func New(next http.Handler, opts ...Option) (*RequestID, error) {
+	r := &RequestID{
+		next:     next,
+		header:   DefaultHeader,
+		generate: NewUUID,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.errHandler == nil {
+		r.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
+	}
+	return r, nil
+}
+
+// Header sets the header carrying the request ID, it defaults to X-Request-Id
+func Header(name string) Option {
+	return func(r *RequestID) error {
+		if name == "" {
+			return fmt.Errorf("header name can not be empty")
+		}
+		r.header = name
+		return nil
+	}
+}
+
+// TrustHeader keeps the ID of the incoming requests, to be used when oxy is behind a trusted proxy setting it.
+// Invalid incoming IDs are replaced.
+func TrustHeader(trust bool) Option {
+	return func(r *RequestID) error {
+		r.trustHeader = trust
+		return nil
+	}
+}
+
+// IDGenerator sets the generator of the request IDs, it defaults to NewUUID
+func IDGenerator(g Generator) Option {
+	return func(r *RequestID) error {
+		if g == nil {
+			return fmt.Errorf("generator can not be nil")
+		}
+		r.generate = g
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler called when no ID can be generated
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(r *RequestID) error {
+		r.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the request ID middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(r *RequestID) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by request ID handler.
+func (r *RequestID) Wrap(next http.Handler) error {
+	r.next = next
+	return nil
+}
+
+func (r *RequestID) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(r.header)
+	if !r.trustHeader || !isValid(id) {
+		var err error
+		id, err = r.generate()
+		if err != nil {
+			r.log.Errorf("vulcand/oxy/requestid: failed to generate request ID, err: %v", err)
+			r.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+	}
+
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req)).WithField("RequestID", id)
+		logEntry.Debug("vulcand/oxy/requestid: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/requestid: completed ServeHttp on request")
+	}
+
+	req.Header.Set(r.header, id)
+	w.Header().Set(r.header, id)
+	r.next.ServeHTTP(w, req.WithContext(NewContext(req.Context(), id)))
+}
+
+// isValid tells whether an incoming ID can be trusted to be copied in the logs and headers
+func isValid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
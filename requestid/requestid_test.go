@@ -0,0 +1,127 @@
+package requestid
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewUUID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id, err := NewUUID()
+		require.NoError(t, err)
+		assert.Regexp(t, uuidPattern, id)
+		assert.False(t, seen[id])
+		seen[id] = true
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		trustHeader bool
+		incoming    string
+		expected    string
+	}{
+		{
+			desc: "generated",
+		},
+		{
+			desc:     "incoming ID not trusted",
+			incoming: "id-1",
+		},
+		{
+			desc:        "incoming ID trusted",
+			trustHeader: true,
+			incoming:    "id-1",
+			expected:    "id-1",
+		},
+		{
+			desc:        "invalid incoming ID",
+			trustHeader: true,
+			incoming:    strings.Repeat("a", maxLength+1),
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var upstreamID, contextID string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				upstreamID = req.Header.Get(DefaultHeader)
+				contextID, _ = FromContext(req.Context())
+			})
+			rid, err := New(handler, TrustHeader(test.trustHeader))
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(rid)
+			defer srv.Close()
+
+			var opts []testutils.ReqOption
+			if test.incoming != "" {
+				opts = append(opts, testutils.Header(DefaultHeader, test.incoming))
+			}
+			re, _, err := testutils.Get(srv.URL, opts...)
+			require.NoError(t, err)
+
+			id := re.Header.Get(DefaultHeader)
+			if test.expected != "" {
+				assert.Equal(t, test.expected, id)
+			} else {
+				assert.Regexp(t, uuidPattern, id)
+			}
+			assert.Equal(t, id, upstreamID)
+			assert.Equal(t, id, contextID)
+		})
+	}
+}
+
+func TestRequestIDCustom(t *testing.T) {
+	var count int
+	generator := func() (string, error) {
+		count++
+		return fmt.Sprintf("req-%d", count), nil
+	}
+	rid, err := New(http.NotFoundHandler(), Header("X-Trace"), IDGenerator(generator))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	defer srv.Close()
+
+	for _, expected := range []string{"req-1", "req-2"} {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, expected, re.Header.Get("X-Trace"))
+	}
+}
+
+func TestRequestIDGeneratorError(t *testing.T) {
+	generator := func() (string, error) {
+		return "", fmt.Errorf("no entropy")
+	}
+	rid, err := New(http.NotFoundHandler(), IDGenerator(generator))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestFromContextMissing(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, ok := FromContext(req.Context())
+	assert.False(t, ok)
+}
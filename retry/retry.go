@@ -0,0 +1,381 @@
+/*
+Package retry provides a middleware retrying the failed attempts of a request.
+
+Unlike the buffer middleware, the responses are streamed to the client and only the request body is buffered,
+up to a limit: requests with bigger bodies are forwarded once. The buffered body is replayable through
+http.Request.GetBody.
+
+An attempt fails when the next handler answers with a network error (502 or 504, as written by the forwarder)
+or with one of the configured status codes. The response of a failed attempt is discarded, unless it is the last one.
+
+Examples of a retry middleware:
+
+	// up to 3 attempts of the idempotent requests on network errors
+	r, err := retry.New(handler)
+
+	// 5 attempts on 503 as well, with an exponential backoff
+	r, err := retry.New(handler, retry.Attempts(5), retry.StatusCodes(http.StatusServiceUnavailable),
+		retry.Backoff(retry.ExponentialBackoff(10*time.Millisecond, time.Second)))
+*/
+package retry
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	// DefaultAttempts is the maximum number of attempts of a request, the first one included
+	DefaultAttempts = 3
+	// DefaultMaxBufferBytes requests with bodies bigger than 1MB are not retried
+	DefaultMaxBufferBytes = 1024 * 1024
+)
+
+// DefaultMethods are the idempotent methods, the only ones retried unless configured otherwise
+var DefaultMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// BackoffFunc returns the duration to wait before the given attempt, attempts start at 2
+type BackoffFunc func(attempt int) time.Duration
+
+// ExponentialBackoff doubles the wait after each attempt, starting from initial and capped to max
+func ExponentialBackoff(initial, max time.Duration) BackoffFunc {
+	return func(attempt int) time.Duration {
+		d := initial
+		for i := 2; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			return max
+		}
+		return d
+	}
+}
+
+// Retry is a middleware retrying failed attempts
+type Retry struct {
+	next           http.Handler
+	attempts       int
+	statusCodes    map[int]bool
+	networkErrors  bool
+	methods        map[string]bool
+	maxBufferBytes int64
+	backoff        BackoffFunc
+	clock          utils.Clock
+
+	errHandler utils.ErrorHandler
+	log        *log.Logger
+}
+
+// Option is a functional option setter for Retry
+type Option func(r *Retry) error
+
+// New creates a new Retry middleware
+func New(next http.Handler, opts ...Option) (*Retry, error) {
+	r := &Retry{
+		next:           next,
+		attempts:       DefaultAttempts,
+		statusCodes:    map[int]bool{},
+		networkErrors:  true,
+		maxBufferBytes: DefaultMaxBufferBytes,
+		clock:          utils.InheritedClock(),
+
+		log: utils.InheritedLogger(),
+	}
+	if err := Methods(DefaultMethods...)(r); err != nil {
+		return nil, err
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.errHandler == nil {
+		r.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
+	}
+	return r, nil
+}
+
+// Attempts sets the maximum number of attempts of a request, the first one included
+func Attempts(n int) Option {
+	return func(r *Retry) error {
+		if n < 1 {
+			return fmt.Errorf("attempts should be >= 1, got %d", n)
+		}
+		r.attempts = n
+		return nil
+	}
+}
+
+// StatusCodes sets the response status codes, in addition to the network errors, that make an attempt fail
+func StatusCodes(codes ...int) Option {
+	return func(r *Retry) error {
+		r.statusCodes = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid status code %d", code)
+			}
+			r.statusCodes[code] = true
+		}
+		return nil
+	}
+}
+
+// NetworkErrors sets whether the network errors, 502 and 504 responses, make an attempt fail. It defaults to true.
+func NetworkErrors(retry bool) Option {
+	return func(r *Retry) error {
+		r.networkErrors = retry
+		return nil
+	}
+}
+
+// Methods sets the request methods that are retried, it defaults to the idempotent methods
+func Methods(methods ...string) Option {
+	return func(r *Retry) error {
+		r.methods = make(map[string]bool, len(methods))
+		for _, m := range methods {
+			r.methods[m] = true
+		}
+		return nil
+	}
+}
+
+// MaxBufferBytes sets the maximum size of the request bodies buffered in memory, bigger requests are not retried
+func MaxBufferBytes(m int64) Option {
+	return func(r *Retry) error {
+		if m < 0 {
+			return fmt.Errorf("max buffer bytes should be >= 0, got %d", m)
+		}
+		r.maxBufferBytes = m
+		return nil
+	}
+}
+
+// Backoff sets the wait between two attempts, there is no wait by default
+func Backoff(b BackoffFunc) Option {
+	return func(r *Retry) error {
+		r.backoff = b
+		return nil
+	}
+}
+
+// Clock sets the clock used to wait between the attempts
+func Clock(clock utils.Clock) Option {
+	return func(r *Retry) error {
+		r.clock = clock
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler called when the request body can not be read
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(r *Retry) error {
+		r.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the retry middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(r *Retry) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by retry handler.
+func (r *Retry) Wrap(next http.Handler) error {
+	r.next = next
+	return nil
+}
+
+func (r *Retry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/retry: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/retry: completed ServeHttp on request")
+	}
+
+	attempts := r.attempts
+	if !r.methods[req.Method] {
+		attempts = 1
+	}
+	if attempts == 1 {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+
+	body, replayable, err := r.readBody(req)
+	if err != nil {
+		r.log.Errorf("vulcand/oxy/retry: error when reading request body, err: %v", err)
+		r.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	if !replayable {
+		r.log.Debugf("vulcand/oxy/retry: request body over %d bytes, the request will not be retried", r.maxBufferBytes)
+		outReq := copyRequest(req)
+		outReq.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		r.next.ServeHTTP(w, outReq)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		aw := &attemptWriter{w: w, header: make(http.Header), retry: r, last: attempt == attempts}
+		r.next.ServeHTTP(aw, replayableRequest(req, body))
+		if !aw.failed {
+			return
+		}
+
+		next := attempt + 1
+		if r.backoff != nil {
+			if d := r.backoff(next); d > 0 {
+				select {
+				case <-r.clock.After(d):
+				case <-req.Context().Done():
+					r.log.Debugf("vulcand/oxy/retry: client gone while waiting for attempt %d of Request(%v %v)", next, req.Method, req.URL)
+					return
+				}
+			}
+		}
+		r.log.Debugf("vulcand/oxy/retry: retry Request(%v %v) attempt %v", req.Method, req.URL, next)
+	}
+}
+
+// failed tells whether the status code of a response makes the attempt fail
+func (r *Retry) failed(code int) bool {
+	if r.networkErrors && (code == http.StatusBadGateway || code == http.StatusGatewayTimeout) {
+		return true
+	}
+	return r.statusCodes[code]
+}
+
+// readBody reads up to maxBufferBytes of the request body, the body is replayable if it has been fully read
+func (r *Retry) readBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > r.maxBufferBytes {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, r.maxBufferBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	return body, int64(len(body)) <= r.maxBufferBytes, nil
+}
+
+func copyRequest(req *http.Request) *http.Request {
+	o := *req
+	o.URL = utils.CopyURL(req.URL)
+	o.Header = utils.CloneHeaders(req.Header)
+	return &o
+}
+
+// replayableRequest creates the request of an attempt, each one gets a fresh copy of the buffered body
+func replayableRequest(req *http.Request, body []byte) *http.Request {
+	o := copyRequest(req)
+	if body == nil {
+		o.Body = http.NoBody
+		o.GetBody = func() (io.ReadCloser, error) {
+			return http.NoBody, nil
+		}
+		return o
+	}
+	o.ContentLength = int64(len(body))
+	// the body has been fully read, it is no longer chunked
+	o.TransferEncoding = nil
+	o.Body = ioutil.NopCloser(bytes.NewReader(body))
+	o.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return o
+}
+
+// attemptWriter passes the response through, unless it is the one of a failed attempt that will be retried
+type attemptWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	retry  *Retry
+	last   bool
+
+	wroteHeader bool
+	failed      bool
+}
+
+func (aw *attemptWriter) Header() http.Header {
+	if aw.wroteHeader && !aw.failed {
+		return aw.w.Header()
+	}
+	return aw.header
+}
+
+func (aw *attemptWriter) WriteHeader(code int) {
+	if aw.wroteHeader {
+		return
+	}
+	aw.wroteHeader = true
+	if !aw.last && aw.retry.failed(code) {
+		aw.failed = true
+		return
+	}
+	utils.CopyHeaders(aw.w.Header(), aw.header)
+	aw.w.WriteHeader(code)
+}
+
+func (aw *attemptWriter) Write(p []byte) (int, error) {
+	if !aw.wroteHeader {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.failed {
+		// the response is discarded
+		return len(p), nil
+	}
+	return aw.w.Write(p)
+}
+
+func (aw *attemptWriter) Flush() {
+	if !aw.wroteHeader {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.failed {
+		return
+	}
+	if f, ok := aw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, the request is not retried then
+func (aw *attemptWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := aw.w.(http.Hijacker); ok {
+		aw.wroteHeader = true
+		aw.failed = false
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this retry middleware does not implement http.Hijacker(type: %T)", aw.w)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (aw *attemptWriter) CloseNotify() <-chan bool {
+	if cn, ok := aw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
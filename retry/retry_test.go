@@ -0,0 +1,237 @@
+package retry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRetryNetworkError(t *testing.T) {
+	backend := testutils.NewRecorder()
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	lb, err := roundrobin.New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:64321")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(backend.URL)))
+
+	r, err := New(lb)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	re, body, err := testutils.MakeRequest(proxy.URL, testutils.Method(http.MethodPut), testutils.Body("some request parameters"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	backend.AssertCount(t, 1)
+	backend.Last().AssertBody(t, "some request parameters")
+	assert.EqualValues(t, len("some request parameters"), backend.Last().ContentLength)
+}
+
+func TestRetryOnFlakyBackend(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		failures         int
+		opts             []Option
+		method           string
+		expectedCode     int
+		expectedRequests int
+	}{
+		{
+			desc:             "succeeds on last attempt",
+			failures:         2,
+			opts:             []Option{StatusCodes(http.StatusServiceUnavailable)},
+			expectedCode:     http.StatusOK,
+			expectedRequests: 3,
+		},
+		{
+			desc:             "exceeds attempts",
+			failures:         3,
+			opts:             []Option{StatusCodes(http.StatusServiceUnavailable)},
+			expectedCode:     http.StatusServiceUnavailable,
+			expectedRequests: 3,
+		},
+		{
+			desc:             "more attempts",
+			failures:         3,
+			opts:             []Option{StatusCodes(http.StatusServiceUnavailable), Attempts(4)},
+			expectedCode:     http.StatusOK,
+			expectedRequests: 4,
+		},
+		{
+			desc:             "status code not retried",
+			failures:         1,
+			expectedCode:     http.StatusServiceUnavailable,
+			expectedRequests: 1,
+		},
+		{
+			desc:             "method not retried",
+			failures:         1,
+			opts:             []Option{StatusCodes(http.StatusServiceUnavailable)},
+			method:           http.MethodPost,
+			expectedCode:     http.StatusServiceUnavailable,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			backend, err := testutils.NewChaosBackend(
+				testutils.FailFirst(test.failures, testutils.StatusFault(http.StatusServiceUnavailable)),
+				testutils.ResponseBody("hello"),
+			)
+			require.NoError(t, err)
+			defer backend.Close()
+
+			fwd, err := forward.New()
+			require.NoError(t, err)
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.URL = testutils.ParseURI(backend.URL)
+				fwd.ServeHTTP(w, req)
+			})
+
+			r, err := New(handler, test.opts...)
+			require.NoError(t, err)
+
+			proxy := httptest.NewServer(r)
+			defer proxy.Close()
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			re, body, err := testutils.MakeRequest(proxy.URL, testutils.Method(method))
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedCode, re.StatusCode)
+			if test.expectedCode == http.StatusOK {
+				assert.Equal(t, "hello", string(body))
+			}
+			assert.Equal(t, test.expectedRequests, backend.Requests())
+		})
+	}
+}
+
+func TestRetryDiscardsFailedAttempts(t *testing.T) {
+	var attempts int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("X-Failed", "true")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("failed"))
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Attempt", "2")
+		w.Write(body)
+	})
+
+	r, err := New(handler)
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("payload")))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "payload", rw.Body.String())
+	assert.Empty(t, rw.Header().Get("X-Failed"))
+	assert.Equal(t, "2", rw.Header().Get("X-Attempt"))
+}
+
+func TestRetryBodyOverLimit(t *testing.T) {
+	var attempts int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		body, _ := ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(body)
+	})
+
+	r, err := New(handler, MaxBufferBytes(4))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("payload"))
+	// unknown length, as for chunked requests
+	req.ContentLength = -1
+	r.ServeHTTP(rw, req)
+
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, "payload", rw.Body.String())
+}
+
+func TestRetryGetBody(t *testing.T) {
+	var replayed string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.NotNil(t, req.GetBody)
+		body, err := req.GetBody()
+		require.NoError(t, err)
+		data, _ := ioutil.ReadAll(body)
+		replayed = string(data)
+	})
+
+	r, err := New(handler)
+	require.NoError(t, err)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/", strings.NewReader("payload")))
+	assert.Equal(t, "payload", replayed)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	clock := testutils.GetClock()
+	start := clock.UtcNow()
+
+	var attempts []time.Time
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts = append(attempts, clock.UtcNow())
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})
+
+	r, err := New(handler, Clock(clock), Backoff(ExponentialBackoff(time.Second, time.Minute)))
+	require.NoError(t, err)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	rw := httptest.NewRecorder()
+	go func() {
+		defer wg.Done()
+		r.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(d)
+	}
+	wg.Wait()
+
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Equal(t, []time.Time{start, start.Add(time.Second), start.Add(3 * time.Second)}, attempts)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, backoff(2))
+	assert.Equal(t, 20*time.Millisecond, backoff(3))
+	assert.Equal(t, 40*time.Millisecond, backoff(4))
+	assert.Equal(t, 50*time.Millisecond, backoff(5))
+	assert.Equal(t, 50*time.Millisecond, backoff(10))
+}
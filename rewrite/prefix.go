@@ -0,0 +1,114 @@
+package rewrite
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// XForwardedPrefix is the header telling the upstreams the path prefix stripped by the proxies
+const XForwardedPrefix = "X-Forwarded-Prefix"
+
+type originalURIKey struct{}
+
+// OriginalURI returns the request URI, path and query, as received before the rewrites
+func OriginalURI(ctx context.Context) (string, bool) {
+	uri, ok := ctx.Value(originalURIKey{}).(string)
+	return uri, ok
+}
+
+type prefixOperation struct {
+	strip bool
+	// prefixes are unescaped, escaped holds the way they appear in an escaped path
+	prefixes []string
+	escaped  []string
+}
+
+func newPrefixOperation(strip bool, prefixes []string) (prefixOperation, error) {
+	op := prefixOperation{strip: strip}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return prefixOperation{}, fmt.Errorf("prefix should start with /, got %q", prefix)
+		}
+		if !strip {
+			prefix = strings.TrimSuffix(prefix, "/")
+		}
+		op.prefixes = append(op.prefixes, prefix)
+		op.escaped = append(op.escaped, (&url.URL{Path: prefix}).EscapedPath())
+	}
+	return op, nil
+}
+
+// apply strips or adds the prefix to the escaped path, it returns the stripped prefix
+func (p prefixOperation) apply(path string) (string, string) {
+	if !p.strip {
+		return p.escaped[0] + path, ""
+	}
+	for i, escaped := range p.escaped {
+		if !strings.HasPrefix(path, escaped) {
+			continue
+		}
+		rest := path[len(escaped):]
+		if rest != "" && rest[0] != '/' && !strings.HasSuffix(escaped, "/") {
+			// the prefix must end on a segment boundary, /api does not strip /apix
+			continue
+		}
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
+		}
+		return rest, strings.TrimSuffix(p.prefixes[i], "/")
+	}
+	return path, ""
+}
+
+// StripPrefix removes the first matching prefix from the request path, e.g. "/api" turns /api/users into /users.
+// The stripped prefix is appended to the X-Forwarded-Prefix header, see PrefixHeader.
+// Prefix operations are applied in order, after the rewrite rules.
+func StripPrefix(prefixes ...string) Option {
+	return func(rw *Rewrite) error {
+		if len(prefixes) == 0 {
+			return fmt.Errorf("at least one prefix is required")
+		}
+		op, err := newPrefixOperation(true, prefixes)
+		if err != nil {
+			return err
+		}
+		rw.prefixes = append(rw.prefixes, op)
+		return nil
+	}
+}
+
+// AddPrefix adds a prefix to the request path, e.g. "/v2" turns /users into /v2/users.
+// Prefix operations are applied in order, after the rewrite rules.
+func AddPrefix(prefix string) Option {
+	return func(rw *Rewrite) error {
+		op, err := newPrefixOperation(false, []string{prefix})
+		if err != nil {
+			return err
+		}
+		rw.prefixes = append(rw.prefixes, op)
+		return nil
+	}
+}
+
+// NewStripPrefix creates a handler removing the first matching prefix from the request path before calling next,
+// see StripPrefix. The options can set the PrefixHeader or the Logger.
+func NewStripPrefix(next http.Handler, prefixes []string, opts ...Option) (*Rewrite, error) {
+	return New(next, append([]Option{StripPrefix(prefixes...)}, opts...)...)
+}
+
+// NewAddPrefix creates a handler adding a prefix to the request path before calling next, see AddPrefix
+func NewAddPrefix(next http.Handler, prefix string, opts ...Option) (*Rewrite, error) {
+	return New(next, append([]Option{AddPrefix(prefix)}, opts...)...)
+}
+
+// PrefixHeader sets the header receiving the stripped prefixes, it defaults to X-Forwarded-Prefix.
+// An empty name disables the header.
+func PrefixHeader(name string) Option {
+	return func(rw *Rewrite) error {
+		rw.prefixHeader = name
+		return nil
+	}
+}
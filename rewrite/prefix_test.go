@@ -0,0 +1,166 @@
+package rewrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestPrefix(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		opts           []Option
+		uri            string
+		expected       string
+		expectedPrefix string
+	}{
+		{
+			desc:           "strip",
+			opts:           []Option{StripPrefix("/api")},
+			uri:            "/api/users?id=1",
+			expected:       "/users?id=1",
+			expectedPrefix: "/api",
+		},
+		{
+			desc:           "strip whole path",
+			opts:           []Option{StripPrefix("/api")},
+			uri:            "/api",
+			expected:       "/",
+			expectedPrefix: "/api",
+		},
+		{
+			desc:     "strip on segment boundary only",
+			opts:     []Option{StripPrefix("/api")},
+			uri:      "/apix/users",
+			expected: "/apix/users",
+		},
+		{
+			desc:           "strip with trailing slash",
+			opts:           []Option{StripPrefix("/api/")},
+			uri:            "/api/users",
+			expected:       "/users",
+			expectedPrefix: "/api",
+		},
+		{
+			desc:           "first matching prefix",
+			opts:           []Option{StripPrefix("/api/v1", "/api")},
+			uri:            "/api/v1/users",
+			expected:       "/users",
+			expectedPrefix: "/api/v1",
+		},
+		{
+			desc:           "encoded slash",
+			opts:           []Option{StripPrefix("/files")},
+			uri:            "/files/a%2Fb",
+			expected:       "/a%2Fb",
+			expectedPrefix: "/files",
+		},
+		{
+			desc:     "add",
+			opts:     []Option{AddPrefix("/v2/")},
+			uri:      "/users?id=1",
+			expected: "/v2/users?id=1",
+		},
+		{
+			desc:           "strip then add",
+			opts:           []Option{StripPrefix("/api"), AddPrefix("/v2")},
+			uri:            "/api/users",
+			expected:       "/v2/users",
+			expectedPrefix: "/api",
+		},
+		{
+			desc:           "after a rule",
+			opts:           []Option{Rule(`^/old/`, "/api/"), StripPrefix("/api")},
+			uri:            "/old/users",
+			expected:       "/users",
+			expectedPrefix: "/api",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			backend := testutils.NewRecorder()
+			defer backend.Close()
+
+			proxy := newProxy(t, backend.URL, test.opts...)
+			defer proxy.Close()
+
+			_, _, err := testutils.Get(proxy.URL + test.uri)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, backend.Last().RequestURI)
+			assert.Equal(t, test.expectedPrefix, backend.Last().Header.Get(XForwardedPrefix))
+		})
+	}
+}
+
+func TestPrefixOriginalURI(t *testing.T) {
+	var original string
+	var found bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		original, found = OriginalURI(req.Context())
+	})
+	rw, err := New(next, StripPrefix("/api"), PrefixHeader(""))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users?id=1", nil)
+	req.Header.Set(XForwardedPrefix, "/outer")
+	rw.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, found)
+	assert.Equal(t, "/api/users?id=1", original)
+	// the header is disabled, the one of the client is left untouched
+	assert.Equal(t, "/outer", req.Header.Get(XForwardedPrefix))
+
+	_, found = OriginalURI(httptest.NewRequest(http.MethodGet, "/", nil).Context())
+	assert.False(t, found)
+}
+
+func TestPrefixHeaderAppend(t *testing.T) {
+	var prefix string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prefix = req.Header.Get(XForwardedPrefix)
+	})
+	rw, err := New(next, StripPrefix("/api"))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set(XForwardedPrefix, "/outer")
+	rw.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "/outer/api", prefix)
+	assert.Equal(t, "/outer", req.Header.Get(XForwardedPrefix))
+}
+
+func TestPrefixHandlers(t *testing.T) {
+	var path, prefix string
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path, prefix = req.URL.Path, req.Header.Get(XForwardedPrefix)
+	})
+	add, err := NewAddPrefix(next, "/v2")
+	require.NoError(t, err)
+	strip, err := NewStripPrefix(add, []string{"/internal", "/api"})
+	require.NoError(t, err)
+
+	strip.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	assert.Equal(t, "/v2/users", path)
+	assert.Equal(t, "/api", prefix)
+
+	_, err = NewStripPrefix(next, nil)
+	assert.Error(t, err)
+	_, err = NewAddPrefix(next, "v2")
+	assert.Error(t, err)
+}
+
+func TestPrefixInvalid(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), StripPrefix("api"))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), StripPrefix())
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), AddPrefix(""))
+	assert.Error(t, err)
+}
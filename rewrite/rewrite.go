@@ -0,0 +1,290 @@
+/*
+Package rewrite provides a middleware rewriting the URL of the requests before they are forwarded.
+
+The regular expressions are matched against the escaped path, so that encoded characters such as %2F are preserved.
+The replacements can reference the capture groups, e.g. $1 or ${name}, and contain a query string that is prepended
+to the query of the request.
+
+Examples of a rewrite middleware:
+
+	// /api/v1/users?id=1 is forwarded as /users?id=1
+	rw, err := rewrite.New(handler, rewrite.Rule(`^/api/v1/(.*)`, "/$1"))
+
+	// /users/42 is forwarded as /user?id=42, the redirects of the upstream to /user are rewritten to /users
+	rw, err := rewrite.New(handler,
+		rewrite.Rule(`^/users/([0-9]+)$`, "/user?id=$1"),
+		rewrite.LocationRule(`^/user$`, "/users"),
+	)
+
+	// /api/users is forwarded as /v2/users with the X-Forwarded-Prefix: /api header
+	rw, err := rewrite.New(handler, rewrite.StripPrefix("/api"), rewrite.AddPrefix("/v2"))
+
+	// the same with the prefix handlers, composing them
+	add, err := rewrite.NewAddPrefix(handler, "/v2")
+	strip, err := rewrite.NewStripPrefix(add, []string{"/api"})
+*/
+package rewrite
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+type rule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func newRule(pattern, replacement string) (rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return rule{}, fmt.Errorf("invalid rewrite pattern %q: %v", pattern, err)
+	}
+	return rule{re: re, replacement: replacement}, nil
+}
+
+// apply returns the replacement if the rule matches the path
+func (r rule) apply(path string) (string, bool) {
+	match := r.re.FindStringSubmatchIndex(path)
+	if match == nil {
+		return "", false
+	}
+	var dst []byte
+	dst = r.re.ExpandString(dst, r.replacement, path, match)
+	return path[:match[0]] + string(dst) + path[match[1]:], true
+}
+
+// Rewrite is a middleware rewriting the request URLs with regular expressions
+type Rewrite struct {
+	next          http.Handler
+	rules         []rule
+	locationRules []rule
+	prefixes      []prefixOperation
+	prefixHeader  string
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Rewrite
+type Option func(rw *Rewrite) error
+
+// New creates a new Rewrite middleware
+func New(next http.Handler, opts ...Option) (*Rewrite, error) {
+	rw := &Rewrite{
+		next:         next,
+		prefixHeader: XForwardedPrefix,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(rw); err != nil {
+			return nil, err
+		}
+	}
+	return rw, nil
+}
+
+// Rule adds a rewrite rule of the request path, the first matching rule is applied before the prefix operations
+func Rule(pattern, replacement string) Option {
+	return func(rw *Rewrite) error {
+		r, err := newRule(pattern, replacement)
+		if err != nil {
+			return err
+		}
+		rw.rules = append(rw.rules, r)
+		return nil
+	}
+}
+
+// LocationRule adds a rewrite rule of the path of the Location response header, to undo the rewrite of the request
+// path in the redirects of the upstream. Only the locations on the host of the request are rewritten.
+func LocationRule(pattern, replacement string) Option {
+	return func(rw *Rewrite) error {
+		r, err := newRule(pattern, replacement)
+		if err != nil {
+			return err
+		}
+		rw.locationRules = append(rw.locationRules, r)
+		return nil
+	}
+}
+
+// Logger defines the logger the rewrite middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(rw *Rewrite) error {
+		rw.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by rewrite handler.
+func (rw *Rewrite) Wrap(next http.Handler) error {
+	rw.next = next
+	return nil
+}
+
+func (rw *Rewrite) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if rw.log.Level >= log.DebugLevel {
+		logEntry := rw.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/rewrite: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/rewrite: completed ServeHttp on request")
+	}
+
+	outReq := rw.rewriteRequest(req)
+	if len(rw.locationRules) == 0 {
+		rw.next.ServeHTTP(w, outReq)
+		return
+	}
+	rw.next.ServeHTTP(&locationWriter{ResponseWriter: w, rewrite: rw, req: req}, outReq)
+}
+
+// rewriteRequest applies the first matching rule, then the prefix operations
+func (rw *Rewrite) rewriteRequest(req *http.Request) *http.Request {
+	original := req.URL.EscapedPath()
+	path, query := original, ""
+	for _, r := range rw.rules {
+		replaced, ok := r.apply(path)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(replaced, "?"); i >= 0 {
+			replaced, query = replaced[:i], replaced[i+1:]
+		}
+		path = replaced
+		break
+	}
+
+	var stripped []string
+	for _, op := range rw.prefixes {
+		var prefix string
+		if path, prefix = op.apply(path); prefix != "" {
+			stripped = append(stripped, prefix)
+		}
+	}
+
+	if path == original && query == "" {
+		return req
+	}
+	outReq, err := withPath(req, path, query)
+	if err != nil {
+		rw.log.Errorf("vulcand/oxy/rewrite: invalid rewritten path %q, err: %v", path, err)
+		return req
+	}
+	if len(stripped) > 0 && rw.prefixHeader != "" {
+		outReq.Header = utils.CloneHeaders(req.Header)
+		outReq.Header.Set(rw.prefixHeader, req.Header.Get(rw.prefixHeader)+strings.Join(stripped, ""))
+	}
+	outReq = outReq.WithContext(context.WithValue(req.Context(), originalURIKey{}, req.URL.RequestURI()))
+	rw.log.Debugf("vulcand/oxy/rewrite: %s rewritten as %s", req.URL.RequestURI(), outReq.URL.RequestURI())
+	return outReq
+}
+
+// rewriteLocation applies the location rules to the path of a Location header
+func (rw *Rewrite) rewriteLocation(req *http.Request, location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host != "" && !strings.EqualFold(u.Host, req.Host) {
+		return location
+	}
+	for _, r := range rw.locationRules {
+		replaced, ok := r.apply(u.EscapedPath())
+		if !ok {
+			continue
+		}
+		path, err := url.PathUnescape(replaced)
+		if err != nil {
+			return location
+		}
+		u.Path, u.RawPath = path, replaced
+		return u.String()
+	}
+	return location
+}
+
+// withPath returns a copy of the request with the escaped path, the query is prepended to the query of the request
+func withPath(req *http.Request, escapedPath, query string) (*http.Request, error) {
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return nil, err
+	}
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.URL = utils.CopyURL(req.URL)
+	outReq.URL.Path = path
+	outReq.URL.RawPath = ""
+	if escapedPath != (&url.URL{Path: path}).EscapedPath() {
+		// keeps the encoded characters, e.g. %2F, the way the client sent them
+		outReq.URL.RawPath = escapedPath
+	}
+	if query != "" {
+		if outReq.URL.RawQuery != "" {
+			query += "&" + outReq.URL.RawQuery
+		}
+		outReq.URL.RawQuery = query
+	}
+	if req.RequestURI != "" {
+		// the forwarder prefers the request URI over the URL
+		outReq.RequestURI = outReq.URL.RequestURI()
+	}
+	return outReq, nil
+}
+
+// locationWriter rewrites the Location header of the response
+type locationWriter struct {
+	http.ResponseWriter
+	rewrite     *Rewrite
+	req         *http.Request
+	wroteHeader bool
+}
+
+func (lw *locationWriter) WriteHeader(code int) {
+	if !lw.wroteHeader {
+		lw.wroteHeader = true
+		if location := lw.Header().Get("Location"); location != "" {
+			lw.Header().Set("Location", lw.rewrite.rewriteLocation(lw.req, location))
+		}
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *locationWriter) Write(p []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	return lw.ResponseWriter.Write(p)
+}
+
+func (lw *locationWriter) Flush() {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection
+func (lw *locationWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := lw.ResponseWriter.(http.Hijacker); ok {
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this rewrite middleware does not implement http.Hijacker(type: %T)", lw.ResponseWriter)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (lw *locationWriter) CloseNotify() <-chan bool {
+	if cn, ok := lw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
@@ -0,0 +1,127 @@
+package rewrite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRewrite(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		opts     []Option
+		uri      string
+		expected string
+	}{
+		{
+			desc:     "strip version",
+			opts:     []Option{Rule(`^/api/v1/(.*)`, "/$1")},
+			uri:      "/api/v1/users?id=1",
+			expected: "/users?id=1",
+		},
+		{
+			desc:     "no match",
+			opts:     []Option{Rule(`^/api/v1/(.*)`, "/$1")},
+			uri:      "/api/v2/users",
+			expected: "/api/v2/users",
+		},
+		{
+			desc:     "named group to query",
+			opts:     []Option{Rule(`^/users/(?P<id>[0-9]+)$`, "/user?id=${id}")},
+			uri:      "/users/42?full=true",
+			expected: "/user?id=42&full=true",
+		},
+		{
+			desc:     "first matching rule",
+			opts:     []Option{Rule(`^/a`, "/first"), Rule(`^/a`, "/second")},
+			uri:      "/a",
+			expected: "/first",
+		},
+		{
+			desc:     "partial match",
+			opts:     []Option{Rule(`/old/`, "/new/")},
+			uri:      "/prefix/old/suffix",
+			expected: "/prefix/new/suffix",
+		},
+		{
+			desc:     "encoded slash",
+			opts:     []Option{Rule(`^/files/(.*)`, "/storage/$1")},
+			uri:      "/files/a%2Fb",
+			expected: "/storage/a%2Fb",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			backend := testutils.NewRecorder()
+			defer backend.Close()
+
+			proxy := newProxy(t, backend.URL, test.opts...)
+			defer proxy.Close()
+
+			re, _, err := testutils.Get(proxy.URL + test.uri)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, test.expected, backend.Last().RequestURI)
+		})
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		location string
+		expected string
+	}{
+		{desc: "relative", location: "/user?id=42", expected: "/users?id=42"},
+		{desc: "other path", location: "/login", expected: "/login"},
+		{desc: "other host", location: "http://other.com/user", expected: "http://other.com/user"},
+		{desc: "same host", location: "http://example.com/user", expected: "http://example.com/users"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Location", test.location)
+				w.WriteHeader(http.StatusFound)
+			})
+			rw, err := New(next, LocationRule(`^/user$`, "/users"))
+			require.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			rw.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/users", nil))
+			assert.Equal(t, http.StatusFound, rec.Code)
+			assert.Equal(t, test.expected, rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestRewriteInvalidPattern(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), Rule(`(`, "/"))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), LocationRule(`(`, "/"))
+	assert.Error(t, err)
+}
+
+// newProxy serves a forwarder to the backend behind the rewrite middleware
+func newProxy(t *testing.T, backendURL string, opts ...Option) *httptest.Server {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u := testutils.ParseURI(backendURL)
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		fwd.ServeHTTP(w, req)
+	})
+	rw, err := New(handler, opts...)
+	require.NoError(t, err)
+	return httptest.NewServer(rw)
+}
@@ -0,0 +1,43 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// noServerError is a request the load balancer has no server for, it matches utils.ErrNoServer
+type noServerError struct {
+	reason string
+}
+
+func (e *noServerError) Error() string {
+	return e.reason
+}
+
+// Is matches utils.ErrNoServer
+func (e *noServerError) Is(target error) bool {
+	return target == utils.ErrNoServer
+}
+
+// affinityBrokenError is a request whose sticky session server is gone, it matches utils.ErrAffinityBroken and its
+// status code is the sticky session fallback code
+type affinityBrokenError struct {
+	url  *url.URL
+	code int
+}
+
+func (e *affinityBrokenError) Error() string {
+	return fmt.Sprintf("server %s of the sticky session is gone", e.url)
+}
+
+// StatusCode is the sticky session fallback code replied by the default error handler
+func (e *affinityBrokenError) StatusCode() int {
+	return e.code
+}
+
+// Is matches utils.ErrAffinityBroken
+func (e *affinityBrokenError) Is(target error) bool {
+	return target == utils.ErrAffinityBroken
+}
@@ -0,0 +1,23 @@
+package roundrobin
+
+import (
+	"github.com/vulcand/oxy/events"
+)
+
+// Events sets the emitter the load balancer publishes the requests whose sticky cookie points to a server no longer in
+// the load balancer to, as events.AffinityBroken
+func Events(e events.Emitter) LBOption {
+	return func(r *RoundRobin) error {
+		r.events = e
+		return nil
+	}
+}
+
+// RebalancerEvents sets the emitter the rebalancer publishes to, as events.ServerStateChanged, when a server starts
+// failing compared to the other servers and when it recovers, and as events.AffinityBroken, see Events
+func RebalancerEvents(e events.Emitter) RebalancerOption {
+	return func(rb *Rebalancer) error {
+		rb.events = e
+		return nil
+	}
+}
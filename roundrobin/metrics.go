@@ -0,0 +1,37 @@
+package roundrobin
+
+import (
+	"github.com/vulcand/oxy/metrics"
+)
+
+// rrMetrics are the metrics of the load balancer registered by the Metrics option
+type rrMetrics struct {
+	requests *metrics.CounterVec
+	noServer *metrics.Counter
+}
+
+// Metrics registers the metrics of the load balancer into the registry:
+//
+//	oxy_roundrobin_requests_total{server} counts the requests sent to each server
+//	oxy_roundrobin_no_server_total counts the requests rejected as no server was available
+//	oxy_roundrobin_servers is the number of servers in the pool
+func Metrics(r *metrics.Registry) LBOption {
+	return func(rr *RoundRobin) error {
+		requests, err := r.Counter("oxy_roundrobin_requests_total", "Requests sent to the servers of the pool.", "server")
+		if err != nil {
+			return err
+		}
+		noServer, err := r.Counter("oxy_roundrobin_no_server_total", "Requests rejected as no server was available.")
+		if err != nil {
+			return err
+		}
+		err = r.GaugeFunc("oxy_roundrobin_servers", "Servers in the pool.", func() float64 {
+			return float64(len(rr.Servers()))
+		})
+		if err != nil {
+			return err
+		}
+		rr.metrics = &rrMetrics{requests: requests, noServer: noServer.With()}
+		return nil
+	}
+}
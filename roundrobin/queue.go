@@ -0,0 +1,88 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serverQueue holds the requests waiting for a server, see QueueWhenUnavailable
+type serverQueue struct {
+	maxWait  time.Duration
+	maxDepth int
+
+	// depth is the number of queued requests, changed is closed and replaced each time the servers change, both
+	// are guarded by the mutex of the load balancer
+	depth   int
+	changed chan struct{}
+}
+
+// QueueWhenUnavailable holds the requests for up to maxWait when no server is available, e.g. all the servers are
+// removed or drained with a 0 weight for a moment during a rolling deploy, instead of failing them right away: the
+// requests are sent as soon as a server is upserted. At most maxDepth requests are queued, the next ones fail as
+// usual.
+func QueueWhenUnavailable(maxWait time.Duration, maxDepth int) LBOption {
+	return func(r *RoundRobin) error {
+		if maxWait <= 0 {
+			return fmt.Errorf("max wait should be > 0, got %v", maxWait)
+		}
+		if maxDepth <= 0 {
+			return fmt.Errorf("max depth should be > 0, got %d", maxDepth)
+		}
+		r.queue = &serverQueue{maxWait: maxWait, maxDepth: maxDepth, changed: make(chan struct{})}
+		return nil
+	}
+}
+
+// notify wakes up the queued requests, it is called with the lock held once the servers changed
+func (q *serverQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// waitServer waits for a server once nextServer failed, it returns the error of nextServer if the queue is full or no
+// server became available in time
+func (r *RoundRobin) waitServer(req *http.Request) (*server, error) {
+	q := r.queue
+	r.mutex.Lock()
+	// the servers may have changed since nextServer failed, changed is read along with the servers so that no change
+	// is missed
+	srv, err := r.nextServerLocked(nil)
+	if err == nil {
+		r.mutex.Unlock()
+		return srv, nil
+	}
+	if q.depth >= q.maxDepth {
+		r.mutex.Unlock()
+		return nil, err
+	}
+	q.depth++
+	changed := q.changed
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		q.depth--
+		r.mutex.Unlock()
+	}()
+
+	timeout := r.clock.After(q.maxWait)
+	for {
+		select {
+		case <-changed:
+		case <-timeout:
+			// a last chance, in case the servers changed along with the timeout
+			return r.nextServer(nil)
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		r.mutex.Lock()
+		srv, err = r.nextServerLocked(nil)
+		changed = q.changed
+		r.mutex.Unlock()
+		if err == nil {
+			return srv, nil
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func queueDepth(lb *RoundRobin) int {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.queue.depth
+}
+
+func waitQueueDepth(t *testing.T, lb *RoundRobin, depth int) {
+	for i := 0; i < 100 && queueDepth(lb) != depth; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, depth, queueDepth(lb))
+}
+
+// waitClock waits for a queued request to wait on the clock
+func waitClock(t *testing.T, clock *utils.FakeClock) {
+	for i := 0; i < 100 && clock.Waiters() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotZero(t, clock.Waiters())
+}
+
+func TestQueueWhenUnavailable(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, QueueWhenUnavailable(5*time.Second, 1))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	type result struct {
+		code int
+		body string
+	}
+	done := make(chan result)
+	go func() {
+		re, body, err := testutils.Get(proxy.URL)
+		if err != nil {
+			done <- result{}
+			return
+		}
+		done <- result{code: re.StatusCode, body: string(body)}
+	}()
+	waitQueueDepth(t, lb, 1)
+
+	// the queue is full
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	select {
+	case res := <-done:
+		assert.Equal(t, result{code: http.StatusOK, body: "a"}, res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued request was not sent")
+	}
+	assert.Equal(t, 0, queueDepth(lb))
+}
+
+func TestQueueWhenUnavailableTimeout(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+	lb, err := New(fwd, QueueWhenUnavailable(5*time.Second, 10), RoundRobinClock(clock))
+	require.NoError(t, err)
+
+	u := testutils.ParseURI("http://localhost:1")
+	require.NoError(t, lb.UpsertServer(u))
+	require.NoError(t, lb.UpsertServer(u, Weight(0)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	done := make(chan int)
+	go func() {
+		re, _, errGet := testutils.Get(proxy.URL)
+		require.NoError(t, errGet)
+		done <- re.StatusCode
+	}()
+	waitQueueDepth(t, lb, 1)
+	waitClock(t, clock)
+
+	// a server drained with a 0 weight does not end the wait
+	require.NoError(t, lb.UpsertServer(u, Weight(0)))
+	clock.Advance(4 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("the queued request ended before the max wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	assert.Equal(t, http.StatusInternalServerError, <-done)
+	assert.Equal(t, 0, queueDepth(lb))
+}
+
+func TestQueueWhenUnavailableMissedChange(t *testing.T) {
+	clock := testutils.GetClock()
+	lb, err := New(nil, QueueWhenUnavailable(5*time.Second, 1), RoundRobinClock(clock))
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// a server upserted between the failure of nextServer and the wait
+	_, err = lb.nextServer(nil)
+	require.Error(t, err)
+	a := testutils.ParseURI("http://localhost:1")
+	require.NoError(t, lb.UpsertServer(a))
+
+	srv, err := lb.waitServer(req)
+	require.NoError(t, err)
+	assert.Equal(t, a, srv.url)
+
+	// a server upserted with the expiry of the wait
+	require.NoError(t, lb.RemoveServer(a))
+	found := make(chan *server)
+	go func() {
+		srv, errWait := lb.waitServer(req)
+		assert.NoError(t, errWait)
+		found <- srv
+	}()
+	waitClock(t, clock)
+	lb.mutex.Lock()
+	lb.servers = append(lb.servers, &server{url: a, weight: 1})
+	lb.mutex.Unlock()
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, a, (<-found).url)
+}
+
+func TestQueueWhenUnavailableInvalid(t *testing.T) {
+	_, err := New(nil, QueueWhenUnavailable(0, 1))
+	require.Error(t, err)
+
+	_, err = New(nil, QueueWhenUnavailable(time.Second, 0))
+	require.Error(t, err)
+}
@@ -7,8 +7,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/oxy/utils"
 )
@@ -32,9 +32,19 @@ type Rebalancer struct {
 	// mutex
 	mtx *sync.Mutex
 	// As usual, control time in tests
-	clock timetools.TimeProvider
+	clock utils.Clock
 	// Time that freezes state machine to accumulate stats after updating the weights
 	backoffDuration time.Duration
+	// Time that freezes state machine after reverting the weights towards the original weights
+	revertBackoffDuration time.Duration
+	// Maximum weight of a server, and the factors multiplying and dividing the weights of the servers
+	maxWeight    int
+	growFactor   int
+	shrinkFactor int
+	// baseWeights multiplies the weights set with UpsertServer instead of replacing them
+	baseWeights bool
+	// How far the rating of a server goes from the others before the server is marked as bad
+	splitThreshold float64
 	// Timer is set to give probing some time to take place
 	timer time.Time
 	// server records that remember original weights
@@ -51,14 +61,18 @@ type Rebalancer struct {
 
 	// sticky session object
 	stickySession *StickySession
+	// status code replied when the server of the sticky cookie is gone, 0 rebalances the request
+	stickyFallbackCode int
 
 	requestRewriteListener RequestRewriteListener
 
+	events events.Emitter
+
 	log *log.Logger
 }
 
 // RebalancerClock sets a clock
-func RebalancerClock(clock timetools.TimeProvider) RebalancerOption {
+func RebalancerClock(clock utils.Clock) RebalancerOption {
 	return func(r *Rebalancer) error {
 		r.clock = clock
 		return nil
@@ -73,6 +87,68 @@ func RebalancerBackoff(d time.Duration) RebalancerOption {
 	}
 }
 
+// RebalancerRevertBackoff sets the back off duration after the weights are reverted towards the original weights,
+// when the servers perform the same again. It defaults to the back off duration, see RebalancerBackoff.
+func RebalancerRevertBackoff(d time.Duration) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if d <= 0 {
+			return fmt.Errorf("revert backoff should be > 0, got %v", d)
+		}
+		r.revertBackoffDuration = d
+		return nil
+	}
+}
+
+// RebalancerMaxWeight sets the maximum weight the rebalancer gives to a server, it defaults to FSMMaxWeight
+func RebalancerMaxWeight(w int) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if w < 1 {
+			return fmt.Errorf("max weight should be >= 1, got %d", w)
+		}
+		r.maxWeight = w
+		return nil
+	}
+}
+
+// RebalancerWeightFactors sets the factors multiplying the weights of the good servers, and dividing them when the
+// servers perform the same again. They default to FSMGrowFactor, lower factors shift the traffic in smaller steps.
+func RebalancerWeightFactors(grow, shrink int) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if grow < 2 || shrink < 2 {
+			return fmt.Errorf("weight factors should be >= 2, got %d and %d", grow, shrink)
+		}
+		r.growFactor = grow
+		r.shrinkFactor = shrink
+		return nil
+	}
+}
+
+// RebalancerBaseWeights keeps the weights set with UpsertServer as the base weights of the servers: the rebalancer
+// multiplies them by its adjustments instead of replacing them, so that a server of weight 3 performing as well as
+// a server of weight 1 keeps three times its traffic, and the weights are back to the base weights once the servers
+// perform the same again. Upserting a known server without a Weight option keeps its base weight.
+//
+// The effective weight of a server, its base weight multiplied by the adjustment, is still capped by
+// RebalancerMaxWeight, and is returned by ServerWeight.
+func RebalancerBaseWeights() RebalancerOption {
+	return func(r *Rebalancer) error {
+		r.baseWeights = true
+		return nil
+	}
+}
+
+// RebalancerSplitThreshold sets how far the rating of a server goes from the median + median absolute deviation of
+// the ratings before the server is marked as bad. It defaults to 1.5, higher thresholds tolerate more errors.
+func RebalancerSplitThreshold(t float64) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if t <= 0 {
+			return fmt.Errorf("split threshold should be > 0, got %v", t)
+		}
+		r.splitThreshold = t
+		return nil
+	}
+}
+
 // RebalancerMeter sets a Meter builder function
 func RebalancerMeter(newMeter NewMeterFn) RebalancerOption {
 	return func(r *Rebalancer) error {
@@ -81,7 +157,31 @@ func RebalancerMeter(newMeter NewMeterFn) RebalancerOption {
 	}
 }
 
-// RebalancerErrorHandler is a functional argument that sets error handler of the server
+// RebalancerDecayingMeter rates the servers with the ratio of their 5xx responses, like the default meter, but
+// decayed with the halfLife instead of over a 10 seconds rolling window, so that the recent responses matter more and
+// the former ones still smooth the spikes. A meter is ready once it recorded the responses of a half-life.
+func RebalancerDecayingMeter(halfLife time.Duration) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if halfLife <= 0 {
+			return fmt.Errorf("half-life should be > 0, got %v", halfLife)
+		}
+		r.newMeter = func() (Meter, error) {
+			dr, err := memmetrics.NewDecayingRatio(halfLife, memmetrics.DecayClock(r.clock))
+			if err != nil {
+				return nil, err
+			}
+			return &codeMeter{
+				r:     dr,
+				codeS: http.StatusInternalServerError,
+				codeE: http.StatusGatewayTimeout + 1,
+			}, nil
+		}
+		return nil
+	}
+}
+
+// RebalancerErrorHandler is a functional argument that sets error handler of the server, see ErrorHandler for the
+// errors of the load balancer
 func RebalancerErrorHandler(h utils.ErrorHandler) RebalancerOption {
 	return func(r *Rebalancer) error {
 		r.errHandler = h
@@ -97,6 +197,18 @@ func RebalancerStickySession(stickySession *StickySession) RebalancerOption {
 	}
 }
 
+// RebalancerStickySessionFallback sets the status code replied to the requests whose sticky cookie points to a server
+// no longer in the load balancer, see StickySessionFallback
+func RebalancerStickySessionFallback(code int) RebalancerOption {
+	return func(r *Rebalancer) error {
+		if err := checkFallbackCode(code); err != nil {
+			return err
+		}
+		r.stickyFallbackCode = code
+		return nil
+	}
+}
+
 // RebalancerRequestRewriteListener is a functional argument that sets error handler of the server
 func RebalancerRequestRewriteListener(rrl RequestRewriteListener) RebalancerOption {
 	return func(r *Rebalancer) error {
@@ -112,7 +224,7 @@ func NewRebalancer(handler balancerHandler, opts ...RebalancerOption) (*Rebalanc
 		next:          handler,
 		stickySession: nil,
 
-		log: log.StandardLogger(),
+		log: utils.InheritedLogger(),
 	}
 	for _, o := range opts {
 		if err := o(rb); err != nil {
@@ -120,11 +232,24 @@ func NewRebalancer(handler balancerHandler, opts ...RebalancerOption) (*Rebalanc
 		}
 	}
 	if rb.clock == nil {
-		rb.clock = &timetools.RealTime{}
+		rb.clock = utils.InheritedClock()
 	}
 	if rb.backoffDuration == 0 {
 		rb.backoffDuration = 10 * time.Second
 	}
+	if rb.revertBackoffDuration == 0 {
+		rb.revertBackoffDuration = rb.backoffDuration
+	}
+	if rb.maxWeight == 0 {
+		rb.maxWeight = FSMMaxWeight
+	}
+	if rb.growFactor == 0 {
+		rb.growFactor = FSMGrowFactor
+		rb.shrinkFactor = FSMGrowFactor
+	}
+	if rb.splitThreshold == 0 {
+		rb.splitThreshold = splitThreshold
+	}
 	if rb.newMeter == nil {
 		rb.newMeter = func() (Meter, error) {
 			rc, err := memmetrics.NewRatioCounter(10, time.Second, memmetrics.RatioClock(rb.clock))
@@ -139,7 +264,7 @@ func NewRebalancer(handler balancerHandler, opts ...RebalancerOption) (*Rebalanc
 		}
 	}
 	if rb.errHandler == nil {
-		rb.errHandler = utils.DefaultHandler
+		rb.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
 	}
 	return rb, nil
 }
@@ -169,7 +294,8 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/roundrobin/rebalancer: completed ServeHttp on request")
 	}
 
-	pw := utils.NewProxyWriter(w)
+	pw := utils.AcquireProxyWriter(w, rb.log)
+	defer utils.ReleaseProxyWriter(pw)
 	start := rb.clock.UtcNow()
 
 	// make shallow copy of request before changing anything to avoid side effects
@@ -177,15 +303,17 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	stuck := false
 
 	if rb.stickySession != nil {
-		cookieUrl, present, err := rb.stickySession.GetBackend(&newReq, rb.Servers())
+		cookieUrl, alive, err := rb.stickySession.backend(&newReq, rb.Servers())
 
 		if err != nil {
 			log.Warnf("vulcand/oxy/roundrobin/rebalancer: error using server from cookie: %v", err)
 		}
 
-		if present {
+		if alive {
 			newReq.URL = cookieUrl
 			stuck = true
+		} else if cookieUrl != nil && affinityBroken(w, req, cookieUrl, rb.stickyFallbackCode, rb.events, rb.errHandler) {
+			return
 		}
 	}
 
@@ -196,9 +324,9 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if log.GetLevel() >= log.DebugLevel {
+		if rb.log.Level >= log.DebugLevel {
 			// log which backend URL we're sending this request to
-			log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": fwdURL}).Debugf("vulcand/oxy/roundrobin/rebalancer: Forwarding this request to URL")
+			rb.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": fwdURL}).Debugf("vulcand/oxy/roundrobin/rebalancer: Forwarding this request to URL")
 		}
 
 		if rb.stickySession != nil {
@@ -230,12 +358,24 @@ func (rb *Rebalancer) recordMetrics(u *url.URL, code int, latency time.Duration)
 func (rb *Rebalancer) reset() {
 	for _, s := range rb.servers {
 		s.curWeight = s.origWeight
+		s.multiplier = 1
 		rb.next.UpsertServer(s.url, Weight(s.origWeight))
 	}
 	rb.timer = rb.clock.UtcNow().Add(-1 * time.Second)
 	rb.ratings = make([]float64, len(rb.servers))
 }
 
+// ServerWeight returns the effective weight of the server, the weight set by the rebalancer
+func (rb *Rebalancer) ServerWeight(u *url.URL) (int, bool) {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	if srv, i := rb.findServer(u); i != -1 {
+		return srv.curWeight, true
+	}
+	return -1, false
+}
+
 // Wrap sets the next handler to be called by rebalancer handler.
 func (rb *Rebalancer) Wrap(next balancerHandler) error {
 	if rb.next != nil {
@@ -254,6 +394,16 @@ func (rb *Rebalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
 		return err
 	}
 	weight, _ := rb.next.ServerWeight(u)
+	if s, i := rb.findServer(u); i != -1 && rb.baseWeights {
+		// the weight of the next handler is the effective one, the base weight only changes with a Weight option
+		probe := &server{weight: s.origWeight}
+		for _, o := range options {
+			if err := o(probe); err != nil {
+				return err
+			}
+		}
+		weight = probe.weight
+	}
 	if err := rb.upsertServer(u, weight); err != nil {
 		rb.next.RemoveServer(u)
 		return err
@@ -286,6 +436,7 @@ func (rb *Rebalancer) removeServer(u *url.URL) error {
 func (rb *Rebalancer) upsertServer(u *url.URL, weight int) error {
 	if s, i := rb.findServer(u); i != -1 {
 		s.origWeight = weight
+		return nil
 	}
 	meter, err := rb.newMeter()
 	if err != nil {
@@ -295,6 +446,7 @@ func (rb *Rebalancer) upsertServer(u *url.URL, weight int) error {
 		url:        utils.CopyURL(u),
 		origWeight: weight,
 		curWeight:  weight,
+		multiplier: 1,
 		meter:      meter,
 	}
 	rb.servers = append(rb.servers, rbSrv)
@@ -332,11 +484,11 @@ func (rb *Rebalancer) adjustWeights() {
 	}
 	if rb.markServers() {
 		if rb.setMarkedWeights() {
-			rb.setTimer()
+			rb.setTimer(rb.backoffDuration)
 		}
 	} else { // No servers that are different by their quality, so converge weights
 		if rb.convergeWeights() {
-			rb.setTimer()
+			rb.setTimer(rb.revertBackoffDuration)
 		}
 	}
 }
@@ -352,13 +504,23 @@ func (rb *Rebalancer) setMarkedWeights() bool {
 	changed := false
 	// Increase weights on servers marked as good
 	for _, srv := range rb.servers {
-		if srv.good {
-			weight := increase(srv.curWeight)
-			if weight <= FSMMaxWeight {
-				rb.log.Debugf("increasing weight of %v from %v to %v", srv.url, srv.curWeight, weight)
-				srv.curWeight = weight
+		if !srv.good {
+			continue
+		}
+		if rb.baseWeights {
+			multiplier := srv.multiplier * rb.growFactor
+			if srv.origWeight*multiplier <= rb.maxWeight {
+				rb.log.Debugf("increasing weight of %v from %v to %v", srv.url, srv.curWeight, srv.origWeight*multiplier)
+				srv.multiplier = multiplier
 				changed = true
 			}
+			continue
+		}
+		weight := srv.curWeight * rb.growFactor
+		if weight <= rb.maxWeight {
+			rb.log.Debugf("increasing weight of %v from %v to %v", srv.url, srv.curWeight, weight)
+			srv.curWeight = weight
+			changed = true
 		}
 	}
 	if changed {
@@ -369,8 +531,8 @@ func (rb *Rebalancer) setMarkedWeights() bool {
 	return false
 }
 
-func (rb *Rebalancer) setTimer() {
-	rb.timer = rb.clock.UtcNow().Add(rb.backoffDuration)
+func (rb *Rebalancer) setTimer(d time.Duration) {
+	rb.timer = rb.clock.UtcNow().Add(d)
 }
 
 func (rb *Rebalancer) timerExpired() bool {
@@ -393,13 +555,19 @@ func (rb *Rebalancer) markServers() bool {
 	for i, srv := range rb.servers {
 		rb.ratings[i] = srv.meter.Rating()
 	}
-	g, b := memmetrics.SplitFloat64(splitThreshold, 0, rb.ratings)
+	g, b := memmetrics.SplitFloat64(rb.splitThreshold, 0, rb.ratings)
 	for i, srv := range rb.servers {
 		if g[rb.ratings[i]] {
 			srv.good = true
 		} else {
 			srv.good = false
 		}
+		if down := !srv.good; down != srv.down {
+			srv.down = down
+			if rb.events != nil {
+				rb.events.Emit(events.ServerStateChanged{URL: srv.url, Down: down})
+			}
+		}
 	}
 	if len(g) != 0 && len(b) != 0 {
 		rb.log.Debugf("bad: %v good: %v, ratings: %v", b, g, rb.ratings)
@@ -411,11 +579,20 @@ func (rb *Rebalancer) convergeWeights() bool {
 	// If we have previously changed servers try to restore weights to the original state
 	changed := false
 	for _, s := range rb.servers {
+		if rb.baseWeights {
+			if s.multiplier == 1 {
+				continue
+			}
+			changed = true
+			s.multiplier = decrease(1, s.multiplier, rb.shrinkFactor)
+			log.Debugf("decreasing weight of %v from %v to %v", s.url, s.curWeight, s.origWeight*s.multiplier)
+			continue
+		}
 		if s.origWeight == s.curWeight {
 			continue
 		}
 		changed = true
-		newWeight := decrease(s.origWeight, s.curWeight)
+		newWeight := decrease(s.origWeight, s.curWeight, rb.shrinkFactor)
 		log.Debugf("decreasing weight of %v from %v to %v", s.url, s.curWeight, newWeight)
 		s.curWeight = newWeight
 	}
@@ -430,31 +607,36 @@ func (rb *Rebalancer) convergeWeights() bool {
 func (rb *Rebalancer) weightsGcd() int {
 	divisor := -1
 	for _, w := range rb.servers {
+		weight := w.curWeight
+		if rb.baseWeights {
+			weight = w.multiplier
+		}
 		if divisor == -1 {
-			divisor = w.curWeight
+			divisor = weight
 		} else {
-			divisor = gcd(divisor, w.curWeight)
+			divisor = gcd(divisor, weight)
 		}
 	}
 	return divisor
 }
 
+// normalizeWeights divides the weights, or the multipliers of the base weights, by their greatest common divisor
 func (rb *Rebalancer) normalizeWeights() {
 	gcd := rb.weightsGcd()
-	if gcd <= 1 {
-		return
-	}
 	for _, s := range rb.servers {
-		s.curWeight = s.curWeight / gcd
+		if rb.baseWeights {
+			if gcd > 1 {
+				s.multiplier /= gcd
+			}
+			s.curWeight = s.origWeight * s.multiplier
+		} else if gcd > 1 {
+			s.curWeight = s.curWeight / gcd
+		}
 	}
 }
 
-func increase(weight int) int {
-	return weight * FSMGrowFactor
-}
-
-func decrease(target, current int) int {
-	adjusted := current / FSMGrowFactor
+func decrease(target, current, factor int) int {
+	adjusted := current / factor
 	if adjusted < target {
 		return target
 	}
@@ -466,7 +648,9 @@ type rbServer struct {
 	url        *url.URL
 	origWeight int // original weight supplied by user
 	curWeight  int // current weight
+	multiplier int // adjustment of the original weight, see RebalancerBaseWeights
 	good       bool
+	down       bool // failing compared to the other servers, as reported to the events emitter
 	meter      Meter
 }
 
@@ -477,8 +661,16 @@ const (
 	FSMGrowFactor = 4
 )
 
+// ratioCounter is the ratio of the codes of a codeMeter, a memmetrics.RatioCounter or a memmetrics.DecayingRatio
+type ratioCounter interface {
+	IncA(int)
+	IncB(int)
+	Ratio() float64
+	IsReady() bool
+}
+
 type codeMeter struct {
-	r     *memmetrics.RatioCounter
+	r     ratioCounter
 	codeS int
 	codeE int
 }
@@ -9,8 +9,10 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
 )
 
 func TestRebalancerNormalOperation(t *testing.T) {
@@ -119,7 +121,7 @@ func TestRebalancerRecovery(t *testing.T) {
 		require.NoError(t, err)
 		_, _, err = testutils.Get(proxy.URL)
 		require.NoError(t, err)
-		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+		clock.Advance(rb.backoffDuration + time.Second)
 	}
 
 	assert.Equal(t, 1, rb.servers[0].curWeight)
@@ -136,7 +138,7 @@ func TestRebalancerRecovery(t *testing.T) {
 		require.NoError(t, err)
 		_, _, err = testutils.Get(proxy.URL)
 		require.NoError(t, err)
-		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+		clock.Advance(rb.backoffDuration + time.Second)
 	}
 
 	assert.Equal(t, 1, rb.servers[0].curWeight)
@@ -186,7 +188,7 @@ func TestRebalancerCascading(t *testing.T) {
 		require.NoError(t, err)
 		_, _, err = testutils.Get(proxy.URL)
 		require.NoError(t, err)
-		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+		clock.Advance(rb.backoffDuration + time.Second)
 	}
 
 	// We have increased the load, and the situation became worse as the other servers started failing
@@ -204,7 +206,7 @@ func TestRebalancerCascading(t *testing.T) {
 		require.NoError(t, err)
 		_, _, err = testutils.Get(proxy.URL)
 		require.NoError(t, err)
-		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+		clock.Advance(rb.backoffDuration + time.Second)
 	}
 
 	// the algo reverted it back
@@ -254,7 +256,7 @@ func TestRebalancerAllBad(t *testing.T) {
 		require.NoError(t, err)
 		_, _, err = testutils.Get(proxy.URL)
 		require.NoError(t, err)
-		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+		clock.Advance(rb.backoffDuration + time.Second)
 	}
 
 	// load balancer does nothing
@@ -304,7 +306,7 @@ func TestRebalancerReset(t *testing.T) {
 		require.NoError(t, err)
 		_, _, err = testutils.Get(proxy.URL)
 		require.NoError(t, err)
-		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+		clock.Advance(rb.backoffDuration + time.Second)
 	}
 
 	// load balancer changed weights
@@ -350,7 +352,7 @@ func TestRebalancerRequestRewriteListenerLive(t *testing.T) {
 		_, _, err = testutils.Get(proxy.URL)
 		require.NoError(t, err)
 		if i%10 == 0 {
-			clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+			clock.Advance(rb.backoffDuration + time.Second)
 		}
 	}
 
@@ -429,6 +431,53 @@ func TestRebalancerStickySession(t *testing.T) {
 	assert.Equal(t, []string{"x", "x", "x"}, seq(t, proxy.URL, 3))
 }
 
+func TestRebalancerEvents(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+	clock := testutils.GetClock()
+	bus := events.NewBus()
+	var received []events.Event
+	bus.Subscribe(func(m events.Message) {
+		received = append(received, m.Event)
+	})
+
+	rb, err := NewRebalancer(lb, RebalancerMeter(newMeter), RebalancerClock(clock), RebalancerEvents(bus))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	serve := func() {
+		for i := 0; i < 2; i++ {
+			rb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+		clock.Advance(rb.backoffDuration + time.Second)
+	}
+
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+	serve()
+	serve()
+	assert.Equal(t, []events.Event{events.ServerStateChanged{URL: testutils.ParseURI(a.URL), Down: true}}, received)
+
+	rb.servers[0].meter.(*testMeter).rating = 0
+	serve()
+	assert.Equal(t, []events.Event{
+		events.ServerStateChanged{URL: testutils.ParseURI(a.URL), Down: true},
+		events.ServerStateChanged{URL: testutils.ParseURI(a.URL)},
+	}, received)
+}
+
 type testMeter struct {
 	rating   float64
 	notReady bool
@@ -444,3 +493,273 @@ func (tm *testMeter) Record(int, time.Duration) {
 func (tm *testMeter) IsReady() bool {
 	return !tm.notReady
 }
+
+func TestRebalancerStickySessionFallback(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	bus := events.NewBus()
+	var broken int
+	bus.Subscribe(func(m events.Message) { broken++ }, events.AffinityLost)
+
+	rb, err := NewRebalancer(lb,
+		RebalancerStickySession(NewStickySession("test")),
+		RebalancerStickySessionFallback(http.StatusGone),
+		RebalancerEvents(bus))
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.AddCookie(&http.Cookie{Name: "test", Value: "http://localhost:63450"})
+	rec := httptest.NewRecorder()
+	rb.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusGone, rec.Code)
+	assert.Equal(t, 1, broken)
+}
+
+func TestRebalancerWeightOptions(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+
+	clock := testutils.GetClock()
+
+	rb, err := NewRebalancer(lb,
+		RebalancerMeter(newMeter),
+		RebalancerClock(clock),
+		RebalancerBackoff(time.Second),
+		RebalancerRevertBackoff(time.Minute),
+		RebalancerMaxWeight(8),
+		RebalancerWeightFactors(2, 2))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	var weights []int
+	for i := 0; i < 4; i++ {
+		seq(t, proxy.URL, 1)
+		weights = append(weights, rb.servers[1].curWeight)
+		clock.Advance(2 * time.Second)
+	}
+	assert.Equal(t, []int{2, 4, 8, 8}, weights)
+
+	rb.servers[0].meter.(*testMeter).rating = 0
+
+	// the weights are reverted once per revert back off
+	weights = nil
+	for i := 0; i < 4; i++ {
+		seq(t, proxy.URL, 1)
+		weights = append(weights, rb.servers[1].curWeight)
+		clock.Advance(30 * time.Second)
+	}
+	assert.Equal(t, []int{4, 4, 4, 2}, weights)
+}
+
+func TestRebalancerBaseWeights(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+
+	clock := testutils.GetClock()
+
+	rb, err := NewRebalancer(lb,
+		RebalancerMeter(newMeter),
+		RebalancerClock(clock),
+		RebalancerBackoff(time.Second),
+		RebalancerMaxWeight(16),
+		RebalancerWeightFactors(2, 2),
+		RebalancerBaseWeights())
+	require.NoError(t, err)
+
+	urlA, urlB := testutils.ParseURI(a.URL), testutils.ParseURI(b.URL)
+	require.NoError(t, rb.UpsertServer(urlA, Weight(3)))
+	require.NoError(t, rb.UpsertServer(urlB, Weight(2)))
+
+	// b is failing, the weight of a is multiplied up to the max weight
+	rb.servers[1].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	var weights []int
+	for i := 0; i < 4; i++ {
+		seq(t, proxy.URL, 1)
+		weight, ok := rb.ServerWeight(urlA)
+		require.True(t, ok)
+		weights = append(weights, weight)
+		clock.Advance(2 * time.Second)
+	}
+	assert.Equal(t, []int{6, 12, 12, 12}, weights)
+	assert.Equal(t, 12, lb.servers[0].weight)
+	assert.Equal(t, 2, lb.servers[1].weight)
+
+	// the servers perform the same again, the weights converge to the base weights
+	rb.servers[1].meter.(*testMeter).rating = 0
+	for i := 0; i < 3; i++ {
+		seq(t, proxy.URL, 1)
+		clock.Advance(2 * time.Second)
+	}
+	assert.Equal(t, 3, lb.servers[0].weight)
+	assert.Equal(t, 2, lb.servers[1].weight)
+
+	// upserting without a weight keeps the base weight
+	require.NoError(t, rb.UpsertServer(urlA))
+	weight, _ := rb.ServerWeight(urlA)
+	assert.Equal(t, 3, weight)
+	assert.Len(t, rb.servers, 2)
+
+	states := rb.ServerStates()
+	assert.Equal(t, 3, states[0].BaseWeight)
+}
+
+func TestRebalancerInvalidOptions(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	for _, opt := range []RebalancerOption{
+		RebalancerRevertBackoff(0),
+		RebalancerMaxWeight(0),
+		RebalancerWeightFactors(1, 4),
+		RebalancerSplitThreshold(-1),
+	} {
+		_, err := NewRebalancer(lb, opt)
+		assert.Error(t, err)
+	}
+}
+
+func TestRebalancerRestoreServerStates(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	newRebalancer := func(clock *utils.FakeClock) (*RoundRobin, *Rebalancer) {
+		lb, err := New(fwd)
+		require.NoError(t, err)
+		rb, err := NewRebalancer(lb, RebalancerMeter(func() (Meter, error) { return &testMeter{}, nil }), RebalancerClock(clock))
+		require.NoError(t, err)
+		require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+		require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+		return lb, rb
+	}
+
+	clock := testutils.GetClock()
+	_, rb := newRebalancer(clock)
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	seq(t, proxy.URL, 1)
+	proxy.Close()
+
+	states := rb.ServerStates()
+	assert.Equal(t, []ServerState{{URL: a.URL, Weight: 1, Down: true}, {URL: b.URL, Weight: FSMGrowFactor}}, states)
+
+	// the restarted rebalancer keeps the weights until the servers are rated again
+	lb, restarted := newRebalancer(clock)
+	require.NoError(t, restarted.RestoreServerStates(append(states, ServerState{URL: "http://localhost:63450", Weight: 1})))
+	assert.Equal(t, states, restarted.ServerStates())
+	assert.Equal(t, FSMGrowFactor, lb.servers[1].weight)
+
+	assert.Error(t, restarted.RestoreServerStates([]ServerState{{URL: a.URL}}))
+}
+
+func TestRebalancerStateHandoff(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	newRebalancer := func() *Rebalancer {
+		lb, err := New(fwd)
+		require.NoError(t, err)
+		rb, err := NewRebalancer(lb, RebalancerMeter(func() (Meter, error) { return &testMeter{}, nil }), RebalancerClock(testutils.GetClock()))
+		require.NoError(t, err)
+		require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+		require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+		return rb
+	}
+
+	rb := newRebalancer()
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+	proxy := httptest.NewServer(rb)
+	seq(t, proxy.URL, 1)
+	proxy.Close()
+
+	var handoff utils.StateHandoff = rb
+	data, err := handoff.SaveState()
+	require.NoError(t, err)
+
+	restarted := newRebalancer()
+	require.NoError(t, restarted.RestoreState(data))
+	assert.Equal(t, rb.ServerStates(), restarted.ServerStates())
+
+	assert.Error(t, restarted.RestoreState([]byte(`{"version":42}`)))
+}
+
+func TestRebalancerDecayingMeter(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	_, err = NewRebalancer(lb, RebalancerDecayingMeter(0))
+	require.Error(t, err)
+
+	rb, err := NewRebalancer(lb, RebalancerDecayingMeter(time.Second), RebalancerClock(clock))
+	require.NoError(t, err)
+
+	meter, err := rb.newMeter()
+	require.NoError(t, err)
+	assert.False(t, meter.IsReady())
+
+	meter.Record(http.StatusBadGateway, time.Millisecond)
+	meter.Record(http.StatusOK, time.Millisecond)
+	assert.Equal(t, 0.5, meter.Rating())
+
+	// the errors of a second ago count half as much
+	clock.Advance(time.Second)
+	assert.True(t, meter.IsReady())
+	meter.Record(http.StatusOK, time.Millisecond)
+	assert.InDelta(t, 0.25, meter.Rating(), 1e-9)
+}
@@ -3,11 +3,14 @@ package roundrobin
 
 import (
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -22,7 +25,10 @@ func Weight(w int) ServerOption {
 	}
 }
 
-// ErrorHandler is a functional argument that sets error handler of the server
+// ErrorHandler is a functional argument that sets error handler of the server. It is called with an error matching
+// utils.ErrNoServer when no server is available, the default error handler replies 500, and with an error matching
+// utils.ErrAffinityBroken when the server of a sticky session is gone and a fallback code is set, the default error
+// handler replies the fallback code.
 func ErrorHandler(h utils.ErrorHandler) LBOption {
 	return func(s *RoundRobin) error {
 		s.errHandler = h
@@ -38,6 +44,27 @@ func EnableStickySession(stickySession *StickySession) LBOption {
 	}
 }
 
+// WeightedRandom picks the servers at random, in proportion to their weights, instead of stepping through them.
+// The proxies of a fleet sharing the same servers don't send their requests to the servers in the same order.
+func WeightedRandom() LBOption {
+	return func(s *RoundRobin) error {
+		s.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+		return nil
+	}
+}
+
+// StickySessionFallback sets the status code replied to the requests whose sticky cookie points to a server no longer
+// in the load balancer. By default, these requests are sent to the next server and the cookie is re-issued.
+func StickySessionFallback(code int) LBOption {
+	return func(s *RoundRobin) error {
+		if err := checkFallbackCode(code); err != nil {
+			return err
+		}
+		s.stickyFallbackCode = code
+		return nil
+	}
+}
+
 // RoundRobinRequestRewriteListener is a functional argument that sets error handler of the server
 func RoundRobinRequestRewriteListener(rrl RequestRewriteListener) LBOption {
 	return func(s *RoundRobin) error {
@@ -52,11 +79,18 @@ type RoundRobin struct {
 	next       http.Handler
 	errHandler utils.ErrorHandler
 	// Current index (starts from -1)
-	index                  int
-	servers                []*server
-	currentWeight          int
+	index         int
+	servers       []*server
+	currentWeight int
+	// random picks the servers when set, see WeightedRandom
+	random                 *rand.Rand
 	stickySession          *StickySession
+	stickyFallbackCode     int
 	requestRewriteListener RequestRewriteListener
+	metrics                *rrMetrics
+	events                 events.Emitter
+	queue                  *serverQueue
+	clock                  utils.Clock
 
 	log *log.Logger
 }
@@ -70,7 +104,7 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 		servers:       []*server{},
 		stickySession: nil,
 
-		log: log.StandardLogger(),
+		log: utils.InheritedLogger(),
 	}
 	for _, o := range opts {
 		if err := o(rr); err != nil {
@@ -78,7 +112,10 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 		}
 	}
 	if rr.errHandler == nil {
-		rr.errHandler = utils.DefaultHandler
+		rr.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
+	}
+	if rr.clock == nil {
+		rr.clock = utils.InheritedClock()
 	}
 	return rr, nil
 }
@@ -93,6 +130,15 @@ func RoundRobinLogger(l *log.Logger) LBOption {
 	}
 }
 
+// RoundRobinClock sets the clock of the round robin load balancer, it times the requests queued by
+// QueueWhenUnavailable
+func RoundRobinClock(clock utils.Clock) LBOption {
+	return func(r *RoundRobin) error {
+		r.clock = clock
+		return nil
+	}
+}
+
 // Next returns the next handler
 func (r *RoundRobin) Next() http.Handler {
 	return r.next
@@ -105,33 +151,44 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/roundrobin/rr: completed ServeHttp on request")
 	}
 
-	// make shallow copy of request before chaning anything to avoid side effects
-	newReq := *req
+	// make shallow copy of request before chaning anything to avoid side effects,
+	// it is allocated with the copy of the server URL
+	fr := &forwardedRequest{req: *req}
+	newReq := &fr.req
 	stuck := false
 	if r.stickySession != nil {
-		cookieURL, present, err := r.stickySession.GetBackend(&newReq, r.Servers())
+		cookieURL, alive, err := r.stickySession.backend(newReq, r.Servers())
 
 		if err != nil {
 			log.Warnf("vulcand/oxy/roundrobin/rr: error using server from cookie: %v", err)
 		}
 
-		if present {
+		if alive {
 			newReq.URL = cookieURL
 			stuck = true
+		} else if cookieURL != nil && affinityBroken(w, req, cookieURL, r.stickyFallbackCode, r.events, r.errHandler) {
+			return
 		}
 	}
 
 	if !stuck {
-		url, err := r.NextServer()
+		srv, err := r.nextServer(nil)
+		if err != nil && r.queue != nil {
+			srv, err = r.waitServer(req)
+		}
 		if err != nil {
+			if r.metrics != nil {
+				r.metrics.noServer.Inc()
+			}
 			r.errHandler.ServeHTTP(w, req, err)
 			return
 		}
 
+		fr.url = *srv.url
 		if r.stickySession != nil {
-			r.stickySession.StickBackend(url, &w)
+			r.stickySession.StickBackend(&fr.url, &w)
 		}
-		newReq.URL = url
+		newReq.URL = &fr.url
 	}
 
 	if r.log.Level >= log.DebugLevel {
@@ -141,27 +198,56 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// Emit event to a listener if one exists
 	if r.requestRewriteListener != nil {
-		r.requestRewriteListener(req, &newReq)
+		r.requestRewriteListener(req, newReq)
+	}
+
+	if r.metrics != nil {
+		r.metrics.requests.With(newReq.URL.String()).Inc()
 	}
 
-	r.next.ServeHTTP(w, &newReq)
+	r.next.ServeHTTP(w, newReq)
+}
+
+// forwardedRequest is the copy of a request forwarded to a server, with the copy of the server URL
+type forwardedRequest struct {
+	req http.Request
+	url url.URL
 }
 
 // NextServer gets the next server
 func (r *RoundRobin) NextServer() (*url.URL, error) {
-	srv, err := r.nextServer()
+	return r.NextServerExcluding()
+}
+
+// NextServerExcluding gets the next server that is not one of the excluded servers, e.g. the servers that already
+// failed to answer a retried request. The balancer is not changed, the excluded servers are still picked by the
+// other requests.
+func (r *RoundRobin) NextServerExcluding(exclude ...*url.URL) (*url.URL, error) {
+	srv, err := r.nextServer(exclude)
 	if err != nil {
 		return nil, err
 	}
 	return utils.CopyURL(srv.url), nil
 }
 
-func (r *RoundRobin) nextServer() (*server, error) {
+func (r *RoundRobin) nextServer(exclude []*url.URL) (*server, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	return r.nextServerLocked(exclude)
+}
 
+// nextServerLocked is called with the mutex held
+func (r *RoundRobin) nextServerLocked(exclude []*url.URL) (*server, error) {
 	if len(r.servers) == 0 {
-		return nil, fmt.Errorf("no servers in the pool")
+		return nil, &noServerError{reason: "no servers in the pool"}
+	}
+
+	if len(exclude) > 0 && !r.hasEligibleServer(exclude) {
+		return nil, &noServerError{reason: "all servers are excluded or have 0 weight"}
+	}
+
+	if r.random != nil {
+		return r.randomServer(exclude)
 	}
 
 	// The algo below may look messy, but is actually very simple
@@ -180,17 +266,63 @@ func (r *RoundRobin) nextServer() (*server, error) {
 			if r.currentWeight <= 0 {
 				r.currentWeight = max
 				if r.currentWeight == 0 {
-					return nil, fmt.Errorf("all servers have 0 weight")
+					return nil, &noServerError{reason: "all servers have 0 weight"}
 				}
 			}
 		}
 		srv := r.servers[r.index]
-		if srv.weight >= r.currentWeight {
+		if srv.weight >= r.currentWeight && !excluded(srv.url, exclude) {
 			return srv, nil
 		}
 	}
 }
 
+// hasEligibleServer returns true when a server with a weight is not excluded
+func (r *RoundRobin) hasEligibleServer(exclude []*url.URL) bool {
+	for _, srv := range r.servers {
+		if srv.weight > 0 && !excluded(srv.url, exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+func excluded(u *url.URL, exclude []*url.URL) bool {
+	for _, e := range exclude {
+		if sameURL(u, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomServer picks a server at random, each server having a chance proportional to its weight
+func (r *RoundRobin) randomServer(exclude []*url.URL) (*server, error) {
+	total := 0
+	for _, srv := range r.servers {
+		if !excluded(srv.url, exclude) {
+			total += srv.weight
+		}
+	}
+	if total == 0 {
+		return nil, &noServerError{reason: "all servers have 0 weight"}
+	}
+
+	n := r.random.Intn(total)
+	var last *server
+	for _, srv := range r.servers {
+		if excluded(srv.url, exclude) {
+			continue
+		}
+		if n < srv.weight {
+			return srv, nil
+		}
+		n -= srv.weight
+		last = srv
+	}
+	return last, nil
+}
+
 // RemoveServer remove a server
 func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	r.mutex.Lock()
@@ -270,6 +402,9 @@ func (r *RoundRobin) resetIterator() {
 
 func (r *RoundRobin) resetState() {
 	r.resetIterator()
+	if r.queue != nil {
+		r.queue.notify()
+	}
 }
 
 func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
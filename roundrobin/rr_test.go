@@ -1,6 +1,7 @@
 package roundrobin
 
 import (
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -8,6 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/metrics"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
 )
@@ -35,7 +37,9 @@ func TestRemoveBadServer(t *testing.T) {
 }
 
 func TestCustomErrHandler(t *testing.T) {
+	var handled error
 	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		handled = err
 		w.WriteHeader(http.StatusTeapot)
 		w.Write([]byte(http.StatusText(http.StatusTeapot)))
 	})
@@ -49,6 +53,28 @@ func TestCustomErrHandler(t *testing.T) {
 	proxy := httptest.NewServer(lb)
 	defer proxy.Close()
 
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, re.StatusCode)
+	assert.True(t, utils.IsError(handled, utils.ErrNoServer))
+}
+
+func TestInheritedErrHandler(t *testing.T) {
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	utils.SetDefaults(utils.Defaults{ErrorHandler: errHandler})
+	defer utils.SetDefaults(utils.Defaults{})
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
 	re, _, err := testutils.Get(proxy.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusTeapot, re.StatusCode)
@@ -228,6 +254,66 @@ func TestRequestRewriteListener(t *testing.T) {
 	assert.NotNil(t, lb.requestRewriteListener)
 }
 
+func TestWeightedRandom(t *testing.T) {
+	require.NoError(t, SetDefaultWeight(0))
+	defer SetDefaultWeight(1)
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, WeightedRandom())
+	require.NoError(t, err)
+	lb.random = rand.New(rand.NewSource(1))
+
+	_, err = lb.NextServer()
+	assert.Error(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a"), Weight(3)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b"), Weight(1)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://z"), Weight(0)))
+
+	picks := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		picks[u.Host]++
+	}
+	assert.InDelta(t, 3000, picks["a"], 150)
+	assert.InDelta(t, 1000, picks["b"], 150)
+	assert.Zero(t, picks["z"])
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a"), Weight(0)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b"), Weight(0)))
+	_, err = lb.NextServer()
+	assert.Error(t, err)
+}
+
+func TestNextServerExcluding(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	a, b, c := testutils.ParseURI("http://a"), testutils.ParseURI("http://b"), testutils.ParseURI("http://c")
+	for _, opts := range [][]LBOption{nil, {WeightedRandom()}} {
+		lb, err := New(fwd, opts...)
+		require.NoError(t, err)
+		require.NoError(t, lb.UpsertServer(a))
+		require.NoError(t, lb.UpsertServer(b, Weight(2)))
+		require.NoError(t, lb.UpsertServer(c))
+
+		for i := 0; i < 10; i++ {
+			u, err := lb.NextServerExcluding(testutils.ParseURI("http://b"), c)
+			require.NoError(t, err)
+			assert.Equal(t, a, u)
+		}
+
+		_, err = lb.NextServerExcluding(a, b, c)
+		assert.Error(t, err)
+
+		// the balancer is not changed
+		assert.Len(t, lb.Servers(), 3)
+	}
+}
+
 func seq(t *testing.T, url string, repeat int) []string {
 	var out []string
 	for i := 0; i < repeat; i++ {
@@ -237,3 +323,49 @@ func seq(t *testing.T, url string, repeat int) []string {
 	}
 	return out
 }
+
+func TestMetrics(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	registry := metrics.NewRegistry()
+	lb, err := New(fwd, Metrics(registry))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	_, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	_, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, "oxy_roundrobin_servers 1\n")
+	assert.Contains(t, gathered, "oxy_roundrobin_no_server_total 1\n")
+	assert.Contains(t, gathered, `oxy_roundrobin_requests_total{server="`+a.URL+`"} 1`)
+}
+
+func BenchmarkRoundRobin(b *testing.B) {
+	fwd, err := forward.New(forward.RoundTripper(testutils.StaticTransport{}))
+	require.NoError(b, err)
+
+	lb, err := New(fwd)
+	require.NoError(b, err)
+	require.NoError(b, lb.UpsertServer(testutils.ParseURI("http://localhost:8081")))
+	require.NoError(b, lb.UpsertServer(testutils.ParseURI("http://localhost:8082")))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+	w := testutils.NewDiscardWriter()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		lb.ServeHTTP(w, req)
+	}
+}
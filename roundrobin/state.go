@@ -0,0 +1,105 @@
+package roundrobin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// ServerState is the state of a server of a rebalancer, saved before a restart so that the restarted proxy does
+// not give their full weights back to the servers that were failing
+type ServerState struct {
+	URL string `json:"url"`
+	// Weight is the weight set by the rebalancer
+	Weight int `json:"weight"`
+	// BaseWeight is the weight set with UpsertServer, with RebalancerBaseWeights only
+	BaseWeight int `json:"base_weight,omitempty"`
+	// Down is true when the server was failing compared to the other servers
+	Down bool `json:"down,omitempty"`
+}
+
+// ServerStates returns the state of the servers, see RestoreServerStates
+func (rb *Rebalancer) ServerStates() []ServerState {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	states := make([]ServerState, len(rb.servers))
+	for i, srv := range rb.servers {
+		states[i] = ServerState{URL: srv.url.String(), Weight: srv.curWeight, Down: srv.down}
+		if rb.baseWeights {
+			states[i].BaseWeight = srv.origWeight
+		}
+	}
+	return states
+}
+
+// RestoreServerStates restores the weights of the servers saved by ServerStates, once the servers are upserted:
+// upserting or removing a server resets the weights. The states of the unknown servers are ignored.
+//
+// The restored weights are kept for the back off duration, then the rebalancer converges them towards the original
+// weights step by step as long as the servers perform the same.
+func (rb *Rebalancer) RestoreServerStates(states []ServerState) error {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	urls := make([]*url.URL, len(states))
+	for i, state := range states {
+		if state.Weight < 1 {
+			return fmt.Errorf("invalid weight %d for server %s", state.Weight, state.URL)
+		}
+		u, err := url.Parse(state.URL)
+		if err != nil {
+			return err
+		}
+		urls[i] = u
+	}
+
+	restored := false
+	for i, state := range states {
+		srv, index := rb.findServer(urls[i])
+		if index == -1 {
+			continue
+		}
+		srv.curWeight = state.Weight
+		if rb.baseWeights && srv.origWeight > 0 {
+			// the adjustment is restored on the current base weight, the one saved may have changed since
+			srv.multiplier = state.Weight / srv.origWeight
+			if srv.multiplier < 1 {
+				srv.multiplier = 1
+			}
+			srv.curWeight = srv.origWeight * srv.multiplier
+		}
+		srv.down = state.Down
+		srv.good = !state.Down
+		restored = true
+	}
+	if restored {
+		rb.applyWeights()
+		rb.setTimer(rb.backoffDuration)
+	}
+	return nil
+}
+
+const rebalancerStateVersion = 1
+
+type rebalancerState struct {
+	Version int           `json:"version"`
+	Servers []ServerState `json:"servers"`
+}
+
+// SaveState saves the state of the servers, see utils.StateHandoff and ServerStates
+func (rb *Rebalancer) SaveState() ([]byte, error) {
+	return json.Marshal(rebalancerState{Version: rebalancerStateVersion, Servers: rb.ServerStates()})
+}
+
+// RestoreState restores the state saved by SaveState, see RestoreServerStates
+func (rb *Rebalancer) RestoreState(data []byte) error {
+	var state rebalancerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version != rebalancerStateVersion {
+		return fmt.Errorf("unsupported rebalancer state version: %d", state.Version)
+	}
+	return rb.RestoreServerStates(state.Servers)
+}
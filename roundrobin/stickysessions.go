@@ -1,8 +1,12 @@
 package roundrobin
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
+
+	"github.com/vulcand/oxy/events"
+	"github.com/vulcand/oxy/utils"
 )
 
 // StickySession is a mixin for load balancers that implements layer 7 (http cookie) session affinity
@@ -30,6 +34,16 @@ func NewStickySessionWithOptions(cookieName string, options CookieOptions) *Stic
 
 // GetBackend returns the backend URL stored in the sticky cookie, iff the backend is still in the valid list of servers.
 func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
+	serverURL, alive, err := s.backend(req, servers)
+	if !alive {
+		return nil, false, err
+	}
+	return serverURL, true, nil
+}
+
+// backend returns the backend URL stored in the sticky cookie, nil without cookie, and whether the backend is still
+// in the valid list of servers
+func (s *StickySession) backend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
 	cookie, err := req.Cookie(s.cookieName)
 	switch err {
 	case nil:
@@ -43,11 +57,30 @@ func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.
 	if err != nil {
 		return nil, false, err
 	}
+	return serverURL, s.isBackendAlive(serverURL, servers), nil
+}
+
+// affinityBroken handles a request whose sticky cookie points to a server gone from the load balancer: it publishes
+// an events.AffinityBroken and, when the status code is not 0, calls the error handler with an affinityBrokenError
+// replying the code. It returns true when the request is replied, otherwise the request is rebalanced and the cookie
+// re-issued.
+func affinityBroken(w http.ResponseWriter, req *http.Request, u *url.URL, code int, e events.Emitter, h utils.ErrorHandler) bool {
+	if e != nil {
+		e.Emit(events.AffinityBroken{Request: req, URL: u})
+	}
+	if code == 0 {
+		return false
+	}
+	h.ServeHTTP(w, req, &affinityBrokenError{url: u, code: code})
+	return true
+}
 
-	if s.isBackendAlive(serverURL, servers) {
-		return serverURL, true, nil
+// checkFallbackCode validates the status code replied when the server of a sticky cookie is gone
+func checkFallbackCode(code int) error {
+	if code < 100 || code > 599 {
+		return fmt.Errorf("invalid sticky session fallback code: %d", code)
 	}
-	return nil, false, nil
+	return nil
 }
 
 // StickBackend creates and sets the cookie
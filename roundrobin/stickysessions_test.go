@@ -8,8 +8,10 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/events"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
 )
 
 func TestBasic(t *testing.T) {
@@ -290,3 +292,86 @@ func TestBadCookieVal(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
+
+func TestStickySessionFallback(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		opts         []LBOption
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			desc:         "rebalance",
+			expectedCode: http.StatusOK,
+			expectedBody: "a",
+		},
+		{
+			desc:         "status code",
+			opts:         []LBOption{StickySessionFallback(http.StatusServiceUnavailable)},
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: http.StatusText(http.StatusServiceUnavailable),
+		},
+		{
+			desc: "error handler",
+			opts: []LBOption{
+				StickySessionFallback(http.StatusServiceUnavailable),
+				ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+					if utils.IsError(err, utils.ErrAffinityBroken) {
+						w.WriteHeader(http.StatusTeapot)
+					}
+					w.Write([]byte(err.Error()))
+				})),
+			},
+			expectedCode: http.StatusTeapot,
+			expectedBody: "server http://localhost:63450 of the sticky session is gone",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			bus := events.NewBus()
+			var broken []events.AffinityBroken
+			bus.Subscribe(func(m events.Message) {
+				broken = append(broken, m.Event.(events.AffinityBroken))
+			}, events.AffinityLost)
+
+			lb, err := New(fwd, append(test.opts, EnableStickySession(NewStickySession("test")), Events(bus))...)
+			require.NoError(t, err)
+			require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.AddCookie(&http.Cookie{Name: "test", Value: "http://localhost:63450"})
+			rec := httptest.NewRecorder()
+			lb.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedCode, rec.Code)
+			assert.Equal(t, test.expectedBody, rec.Body.String())
+			require.Len(t, broken, 1)
+			assert.Equal(t, "http://localhost:63450", broken[0].URL.String())
+
+			// the request without cookie is not an affinity breakage
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+			assert.Len(t, broken, 1)
+		})
+	}
+}
+
+func TestStickySessionFallbackInvalidCode(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	_, err = New(fwd, StickySessionFallback(0))
+	assert.Error(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	_, err = NewRebalancer(lb, RebalancerStickySessionFallback(600))
+	assert.Error(t, err)
+}
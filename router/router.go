@@ -0,0 +1,265 @@
+/*
+Package router provides a request router dispatching the requests to oxy handler chains, e.g. a load balancer and
+its forwarder per backend, according to their host, path, method and headers.
+
+The routes are evaluated in the order they are added, the first route whose matchers all match the request handles
+it. The requests matching no route are passed to the next handler, e.g. http.NotFoundHandler().
+
+Examples of a router:
+
+	r, err := router.New(http.NotFoundHandler(),
+		router.Route("api", apiBalancer, router.Host("api.example.com"), router.PathPrefix("/v1/")),
+		router.Route("upload", uploadBuffer, router.PathPrefix("/upload"), router.Method(http.MethodPost, http.MethodPut)),
+		router.Route("canary", canaryBalancer, router.Header("X-Canary", "true")),
+		router.Route("www", wwwBalancer, router.Host("*.example.com")),
+	)
+*/
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Matcher matches the requests of a route, it is created by Host, PathPrefix, PathRegexp, Method, Header,
+// HeaderRegexp or MatcherFunc
+type Matcher struct {
+	match func(req *http.Request) bool
+	err   error
+}
+
+// MatcherFunc creates a Matcher from a predicate
+func MatcherFunc(f func(req *http.Request) bool) Matcher {
+	if f == nil {
+		return Matcher{err: errors.New("matcher predicate can not be nil")}
+	}
+	return Matcher{match: f}
+}
+
+// Host matches the requests to one of the hosts, the port of the Host header is ignored.
+// A leading "*." matches any host of the domain.
+func Host(hosts ...string) Matcher {
+	if len(hosts) == 0 {
+		return Matcher{err: errors.New("at least one host is required")}
+	}
+	patterns := make([]string, len(hosts))
+	for i, h := range hosts {
+		if h == "" || h == "*." {
+			return Matcher{err: fmt.Errorf("invalid host %q", h)}
+		}
+		patterns[i] = strings.ToLower(h)
+	}
+	return Matcher{match: func(req *http.Request) bool {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		for _, p := range patterns {
+			if p == host || strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// PathPrefix matches the requests whose path starts with the prefix on a segment boundary: /api matches /api and
+// /api/users but not /apix, a prefix ending with a slash matches all the paths below it
+func PathPrefix(prefix string) Matcher {
+	if !strings.HasPrefix(prefix, "/") {
+		return Matcher{err: fmt.Errorf("prefix should start with /, got %q", prefix)}
+	}
+	return Matcher{match: func(req *http.Request) bool {
+		path := req.URL.Path
+		if !strings.HasPrefix(path, prefix) {
+			return false
+		}
+		return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+	}}
+}
+
+// PathRegexp matches the requests whose whole path matches the regular expression
+func PathRegexp(expr string) Matcher {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return Matcher{err: err}
+	}
+	return Matcher{match: func(req *http.Request) bool {
+		return re.MatchString(req.URL.Path)
+	}}
+}
+
+// Method matches the requests using one of the methods
+func Method(methods ...string) Matcher {
+	if len(methods) == 0 {
+		return Matcher{err: errors.New("at least one method is required")}
+	}
+	allowed := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		allowed[strings.ToUpper(m)] = true
+	}
+	return Matcher{match: func(req *http.Request) bool {
+		return allowed[req.Method]
+	}}
+}
+
+// Header matches the requests having the header with the value, an empty value matches any value of the header
+func Header(name, value string) Matcher {
+	if name == "" {
+		return Matcher{err: errors.New("header name can not be empty")}
+	}
+	name = http.CanonicalHeaderKey(name)
+	return Matcher{match: func(req *http.Request) bool {
+		values, ok := req.Header[name]
+		if !ok || value == "" {
+			return ok
+		}
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// HeaderRegexp matches the requests having a value of the header matching the regular expression
+func HeaderRegexp(name, expr string) Matcher {
+	if name == "" {
+		return Matcher{err: errors.New("header name can not be empty")}
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return Matcher{err: err}
+	}
+	name = http.CanonicalHeaderKey(name)
+	return Matcher{match: func(req *http.Request) bool {
+		for _, v := range req.Header[name] {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+type route struct {
+	name     string
+	handler  http.Handler
+	matchers []Matcher
+}
+
+func (r *route) matches(req *http.Request) bool {
+	for _, m := range r.matchers {
+		if !m.match(req) {
+			return false
+		}
+	}
+	return true
+}
+
+type contextKey struct{}
+
+// RouteFromContext returns the name of the route handling the request stored in ctx
+func RouteFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(contextKey{}).(string)
+	return name, ok
+}
+
+// Router dispatches the requests to the handler of the first matching route
+type Router struct {
+	next   http.Handler
+	routes []route
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Router
+type Option func(r *Router) error
+
+// New creates a new Router, next handles the requests matching no route
+func New(next http.Handler, opts ...Option) (*Router, error) {
+	r := &Router{
+		next: next,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Route adds a route named name, passing the requests matched by all the matchers to the handler.
+// A route without matchers matches all the requests.
+func Route(name string, handler http.Handler, matchers ...Matcher) Option {
+	return func(r *Router) error {
+		if name == "" {
+			return errors.New("route name can not be empty")
+		}
+		if handler == nil {
+			return fmt.Errorf("route %s: handler can not be nil", name)
+		}
+		for _, rt := range r.routes {
+			if rt.name == name {
+				return fmt.Errorf("route %s already exists", name)
+			}
+		}
+		for _, m := range matchers {
+			if m.err != nil {
+				return fmt.Errorf("route %s: %v", name, m.err)
+			}
+			if m.match == nil {
+				return fmt.Errorf("route %s: invalid matcher", name)
+			}
+		}
+		r.routes = append(r.routes, route{name: name, handler: handler, matchers: matchers})
+		return nil
+	}
+}
+
+// Logger defines the logger the router will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(r *Router) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by router handler.
+func (r *Router) Wrap(next http.Handler) error {
+	r.next = next
+	return nil
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/router: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/router: completed ServeHttp on request")
+	}
+
+	for i := range r.routes {
+		rt := &r.routes[i]
+		if !rt.matches(req) {
+			continue
+		}
+		r.log.Debugf("vulcand/oxy/router: request routed to %s", rt.name)
+		rt.handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, rt.name)))
+		return
+	}
+	r.next.ServeHTTP(w, req)
+}
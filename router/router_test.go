@@ -0,0 +1,94 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route, _ := RouteFromContext(req.Context())
+		w.Write([]byte(name + ":" + route))
+	})
+}
+
+func TestRouter(t *testing.T) {
+	r, err := New(http.NotFoundHandler(),
+		Route("api", named("api"), Host("api.example.com"), PathPrefix("/v1")),
+		Route("upload", named("upload"), PathPrefix("/upload/"), Method(http.MethodPost, "put")),
+		Route("user", named("user"), PathRegexp(`/users/[0-9]+`)),
+		Route("canary", named("canary"), Header("X-Canary", "true")),
+		Route("beta", named("beta"), HeaderRegexp("Cookie", `(^|; )beta=1`)),
+		Route("debug", named("debug"), Header("X-Debug", "")),
+		Route("www", named("www"), Host("*.example.com")),
+		Route("custom", named("custom"), MatcherFunc(func(req *http.Request) bool { return req.URL.Query().Get("custom") != "" })),
+	)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		method   string
+		url      string
+		headers  map[string]string
+		expected string
+	}{
+		{desc: "host and prefix", url: "http://api.example.com:8080/v1/users", expected: "api:api"},
+		{desc: "host case", url: "http://API.example.com/v1", expected: "api:api"},
+		{desc: "prefix on segment boundary", url: "http://api.example.com/v10", expected: "www:www"},
+		{desc: "method", method: http.MethodPut, url: "http://localhost/upload/file", expected: "upload:upload"},
+		{desc: "other method", url: "http://localhost/upload/file", expected: "404 page not found\n"},
+		{desc: "regexp", url: "http://localhost/users/42", expected: "user:user"},
+		{desc: "whole path regexp", url: "http://localhost/users/42/posts", expected: "404 page not found\n"},
+		{desc: "header", url: "http://localhost/", headers: map[string]string{"X-Canary": "true"}, expected: "canary:canary"},
+		{desc: "header value", url: "http://localhost/", headers: map[string]string{"X-Canary": "false"}, expected: "404 page not found\n"},
+		{desc: "header regexp", url: "http://localhost/", headers: map[string]string{"Cookie": "a=b; beta=1"}, expected: "beta:beta"},
+		{desc: "header presence", url: "http://localhost/", headers: map[string]string{"X-Debug": "1"}, expected: "debug:debug"},
+		{desc: "wildcard host", url: "http://www.example.com/", expected: "www:www"},
+		{desc: "wildcard does not match the domain", url: "http://example.com/", expected: "404 page not found\n"},
+		{desc: "custom matcher", url: "http://localhost/?custom=1", expected: "custom:custom"},
+		{desc: "first route wins", url: "http://api.example.com/v1", headers: map[string]string{"X-Canary": "true"}, expected: "api:api"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, test.url, nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			assert.Equal(t, test.expected, rec.Body.String())
+		})
+	}
+}
+
+func TestRouterInvalid(t *testing.T) {
+	for _, opt := range []Option{
+		Route("", named("a")),
+		Route("a", nil),
+		Route("a", named("a"), Host()),
+		Route("a", named("a"), Host("*.")),
+		Route("a", named("a"), PathPrefix("api")),
+		Route("a", named("a"), PathRegexp("(")),
+		Route("a", named("a"), Method()),
+		Route("a", named("a"), Header("", "")),
+		Route("a", named("a"), HeaderRegexp("X", "(")),
+		Route("a", named("a"), MatcherFunc(nil)),
+		Route("a", named("a"), Matcher{}),
+	} {
+		_, err := New(http.NotFoundHandler(), opt)
+		assert.Error(t, err)
+	}
+
+	_, err := New(http.NotFoundHandler(), Route("a", named("a")), Route("a", named("b")))
+	assert.Error(t, err, "duplicated route")
+}
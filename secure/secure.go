@@ -0,0 +1,383 @@
+/*
+Package secure provides a middleware adding the standard security headers to the responses.
+
+By default, the responses get X-Content-Type-Options: nosniff, X-Frame-Options: SAMEORIGIN and
+Referrer-Policy: strict-origin-when-cross-origin. Strict-Transport-Security and Content-Security-Policy are enabled
+with their options, the CSP is built with NewCSP. The headers replace the ones sent by the next handler,
+an empty value removes a header.
+
+The routes needing other values, e.g. a page embedded in frames, are configured with Override.
+
+Examples of security headers:
+
+	s, err := secure.New(handler,
+		secure.HSTS(365*24*time.Hour, true, false),
+		secure.ContentSecurityPolicy(secure.NewCSP().
+			Directive("default-src", "'self'").
+			Directive("img-src", "'self'", "data:")),
+		secure.Override(func(req *http.Request) bool {
+			return strings.HasPrefix(req.URL.Path, "/embed/")
+		}, secure.FrameOptions("")),
+	)
+*/
+package secure
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Default values of the headers
+const (
+	DefaultFrameOptions   = "SAMEORIGIN"
+	DefaultReferrerPolicy = "strict-origin-when-cross-origin"
+)
+
+var referrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+// CSP builds a Content-Security-Policy
+type CSP struct {
+	directives []cspDirective
+	err        error
+}
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+// NewCSP creates an empty Content-Security-Policy
+func NewCSP() *CSP {
+	return &CSP{}
+}
+
+// Directive sets the sources of a directive, e.g. Directive("script-src", "'self'", "https://cdn.example.com"),
+// a directive without sources, e.g. upgrade-insecure-requests, takes no sources
+func (c *CSP) Directive(name string, sources ...string) *CSP {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || strings.ContainsAny(name, "; ,") {
+		c.err = fmt.Errorf("invalid CSP directive %q", name)
+		return c
+	}
+	for _, s := range sources {
+		if s == "" || strings.ContainsAny(s, "; ,") {
+			c.err = fmt.Errorf("invalid source %q of CSP directive %s", s, name)
+			return c
+		}
+	}
+	for i := range c.directives {
+		if c.directives[i].name == name {
+			c.directives[i].sources = sources
+			return c
+		}
+	}
+	c.directives = append(c.directives, cspDirective{name: name, sources: sources})
+	return c
+}
+
+// String returns the value of the Content-Security-Policy header
+func (c *CSP) String() string {
+	parts := make([]string, 0, len(c.directives))
+	for _, d := range c.directives {
+		parts = append(parts, strings.TrimSpace(d.name+" "+strings.Join(d.sources, " ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// policy holds the values of the headers, an empty value removes a header
+type policy struct {
+	hsts           string
+	nosniff        bool
+	frameOptions   string
+	referrerPolicy string
+	csp            string
+	cspReportOnly  string
+}
+
+type override struct {
+	match  func(req *http.Request) bool
+	policy policy
+}
+
+// Secure is a middleware adding the security headers to the responses
+type Secure struct {
+	next      http.Handler
+	policy    policy
+	overrides []override
+	// pending are the overrides, applied on the policy once all the options are set
+	pending    []pendingOverride
+	overriding bool
+
+	log *log.Logger
+}
+
+type pendingOverride struct {
+	match func(req *http.Request) bool
+	opts  []Option
+}
+
+// Option is a functional option setter for Secure
+type Option func(s *Secure) error
+
+// New creates a new Secure middleware
+func New(next http.Handler, opts ...Option) (*Secure, error) {
+	s := &Secure{
+		next: next,
+		policy: policy{
+			nosniff:        true,
+			frameOptions:   DefaultFrameOptions,
+			referrerPolicy: DefaultReferrerPolicy,
+		},
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range s.pending {
+		o := &Secure{policy: s.policy, overriding: true}
+		for _, opt := range p.opts {
+			if err := opt(o); err != nil {
+				return nil, err
+			}
+		}
+		s.overrides = append(s.overrides, override{match: p.match, policy: o.policy})
+	}
+	s.pending = nil
+	return s, nil
+}
+
+// HSTS sets the Strict-Transport-Security header of the HTTPS responses, a zero maxAge tells the browsers to forget
+// the host. The requests are HTTPS when received over TLS or forwarded with X-Forwarded-Proto: https.
+func HSTS(maxAge time.Duration, includeSubDomains, preload bool) Option {
+	return func(s *Secure) error {
+		if maxAge < 0 {
+			return fmt.Errorf("HSTS max age should be >= 0, got %v", maxAge)
+		}
+		value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+		if includeSubDomains {
+			value += "; includeSubDomains"
+		}
+		if preload {
+			value += "; preload"
+		}
+		s.policy.hsts = value
+		return nil
+	}
+}
+
+// DisableHSTS removes the Strict-Transport-Security header, e.g. in an Override
+func DisableHSTS() Option {
+	return func(s *Secure) error {
+		s.policy.hsts = ""
+		return nil
+	}
+}
+
+// ContentTypeNosniff sets X-Content-Type-Options: nosniff, it is enabled by default
+func ContentTypeNosniff(enabled bool) Option {
+	return func(s *Secure) error {
+		s.policy.nosniff = enabled
+		return nil
+	}
+}
+
+// FrameOptions sets the X-Frame-Options header, DENY or SAMEORIGIN, it defaults to DefaultFrameOptions
+func FrameOptions(value string) Option {
+	return func(s *Secure) error {
+		value = strings.ToUpper(value)
+		if value != "" && value != "DENY" && value != "SAMEORIGIN" {
+			return fmt.Errorf("invalid X-Frame-Options %q, expected DENY or SAMEORIGIN", value)
+		}
+		s.policy.frameOptions = value
+		return nil
+	}
+}
+
+// ReferrerPolicy sets the Referrer-Policy header, it defaults to DefaultReferrerPolicy
+func ReferrerPolicy(value string) Option {
+	return func(s *Secure) error {
+		if value != "" && !referrerPolicies[value] {
+			return fmt.Errorf("invalid Referrer-Policy %q", value)
+		}
+		s.policy.referrerPolicy = value
+		return nil
+	}
+}
+
+// ContentSecurityPolicy sets the Content-Security-Policy header, a nil CSP removes it
+func ContentSecurityPolicy(csp *CSP) Option {
+	return cspOption(csp, func(p *policy, v string) { p.csp = v })
+}
+
+// ContentSecurityPolicyReportOnly sets the Content-Security-Policy-Report-Only header, to evaluate a policy
+// before enforcing it. A nil CSP removes it.
+func ContentSecurityPolicyReportOnly(csp *CSP) Option {
+	return cspOption(csp, func(p *policy, v string) { p.cspReportOnly = v })
+}
+
+func cspOption(csp *CSP, set func(p *policy, v string)) Option {
+	return func(s *Secure) error {
+		if csp == nil {
+			set(&s.policy, "")
+			return nil
+		}
+		if csp.err != nil {
+			return csp.err
+		}
+		set(&s.policy, csp.String())
+		return nil
+	}
+}
+
+// Override applies the options on top of the other options to the requests matching the predicate.
+// The overrides are evaluated in the order they are added, the first matching one is used.
+func Override(match func(req *http.Request) bool, opts ...Option) Option {
+	return func(s *Secure) error {
+		if s.overriding {
+			return errors.New("overrides can not be nested")
+		}
+		if match == nil {
+			return errors.New("predicate can not be nil")
+		}
+		s.pending = append(s.pending, pendingOverride{match: match, opts: opts})
+		return nil
+	}
+}
+
+// Logger defines the logger the security headers middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(s *Secure) error {
+		s.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by security headers handler.
+func (s *Secure) Wrap(next http.Handler) error {
+	s.next = next
+	return nil
+}
+
+func (s *Secure) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.log.Level >= log.DebugLevel {
+		logEntry := s.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/secure: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/secure: completed ServeHttp on request")
+	}
+
+	p := &s.policy
+	for i := range s.overrides {
+		if s.overrides[i].match(req) {
+			p = &s.overrides[i].policy
+			break
+		}
+	}
+	https := req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+	sw := &secureWriter{w: w, policy: p, https: https}
+	s.next.ServeHTTP(sw, req)
+	// the headers are sent once the next handler returns when it did not write anything
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		p.apply(w.Header(), https)
+	}
+}
+
+func (p *policy) apply(h http.Header, https bool) {
+	set := func(name, value string) {
+		if value == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, value)
+		}
+	}
+	if https {
+		set("Strict-Transport-Security", p.hsts)
+	} else {
+		// the browsers ignore it over HTTP
+		h.Del("Strict-Transport-Security")
+	}
+	if p.nosniff {
+		set("X-Content-Type-Options", "nosniff")
+	} else {
+		h.Del("X-Content-Type-Options")
+	}
+	set("X-Frame-Options", p.frameOptions)
+	set("Referrer-Policy", p.referrerPolicy)
+	set("Content-Security-Policy", p.csp)
+	set("Content-Security-Policy-Report-Only", p.cspReportOnly)
+}
+
+// secureWriter adds the security headers right before the headers are sent
+type secureWriter struct {
+	w           http.ResponseWriter
+	policy      *policy
+	https       bool
+	wroteHeader bool
+}
+
+func (sw *secureWriter) Header() http.Header {
+	return sw.w.Header()
+}
+
+func (sw *secureWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		sw.policy.apply(sw.w.Header(), sw.https)
+	}
+	sw.w.WriteHeader(code)
+}
+
+func (sw *secureWriter) Write(p []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.w.Write(p)
+}
+
+func (sw *secureWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection
+func (sw *secureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hi, ok := sw.w.(http.Hijacker); ok {
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this secure middleware does not implement http.Hijacker(type: %T)", sw.w)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (sw *secureWriter) CloseNotify() <-chan bool {
+	if cn, ok := sw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
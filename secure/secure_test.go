@@ -0,0 +1,147 @@
+package secure
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecure(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		opts     []Option
+		path     string
+		https    bool
+		expected map[string]string
+	}{
+		{
+			desc: "defaults",
+			expected: map[string]string{
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "SAMEORIGIN",
+				"Referrer-Policy":           "strict-origin-when-cross-origin",
+				"Strict-Transport-Security": "",
+				"Content-Security-Policy":   "",
+			},
+		},
+		{
+			desc:     "HSTS over HTTPS",
+			opts:     []Option{HSTS(365*24*time.Hour, true, true)},
+			https:    true,
+			expected: map[string]string{"Strict-Transport-Security": "max-age=31536000; includeSubDomains; preload"},
+		},
+		{
+			desc:     "no HSTS over HTTP",
+			opts:     []Option{HSTS(time.Hour, false, false)},
+			expected: map[string]string{"Strict-Transport-Security": ""},
+		},
+		{
+			desc: "CSP",
+			opts: []Option{
+				ContentSecurityPolicy(NewCSP().
+					Directive("default-src", "'self'").
+					Directive("img-src", "'self'", "data:").
+					Directive("upgrade-insecure-requests").
+					Directive("default-src", "'none'")),
+				ContentSecurityPolicyReportOnly(NewCSP().Directive("script-src", "'self'")),
+			},
+			expected: map[string]string{
+				"Content-Security-Policy":             "default-src 'none'; img-src 'self' data:; upgrade-insecure-requests",
+				"Content-Security-Policy-Report-Only": "script-src 'self'",
+			},
+		},
+		{
+			desc: "disabled headers",
+			opts: []Option{ContentTypeNosniff(false), FrameOptions(""), ReferrerPolicy("")},
+			expected: map[string]string{
+				"X-Content-Type-Options": "",
+				"X-Frame-Options":        "",
+				"Referrer-Policy":        "",
+			},
+		},
+		{
+			desc: "override",
+			opts: []Option{
+				FrameOptions("DENY"),
+				Override(func(req *http.Request) bool { return strings.HasPrefix(req.URL.Path, "/embed/") },
+					FrameOptions(""), ReferrerPolicy("no-referrer")),
+			},
+			path: "/embed/video",
+			expected: map[string]string{
+				"X-Frame-Options":        "",
+				"Referrer-Policy":        "no-referrer",
+				"X-Content-Type-Options": "nosniff",
+			},
+		},
+		{
+			desc: "override not matching",
+			opts: []Option{
+				FrameOptions("DENY"),
+				Override(func(req *http.Request) bool { return strings.HasPrefix(req.URL.Path, "/embed/") }, FrameOptions("")),
+			},
+			path:     "/",
+			expected: map[string]string{"X-Frame-Options": "DENY"},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				// the values of the next handler are replaced
+				w.Header().Set("X-Frame-Options", "ALLOWALL")
+				w.Write([]byte("hello"))
+			})
+			s, err := New(next, test.opts...)
+			require.NoError(t, err)
+
+			path := test.path
+			if path == "" {
+				path = "/"
+			}
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if test.https {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			assert.Equal(t, "hello", rec.Body.String())
+			for name, value := range test.expected {
+				assert.Equal(t, value, rec.Header().Get(name), name)
+			}
+		})
+	}
+}
+
+func TestSecureForwardedProto(t *testing.T) {
+	s, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), HSTS(time.Hour, false, false))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, "max-age=3600", rec.Header().Get("Strict-Transport-Security"))
+}
+
+func TestSecureInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{
+		HSTS(-time.Second, false, false),
+		FrameOptions("ALLOW-FROM https://example.com"),
+		ReferrerPolicy("everywhere"),
+		ContentSecurityPolicy(NewCSP().Directive("default-src", "'self';")),
+		ContentSecurityPolicy(NewCSP().Directive("")),
+		Override(nil),
+		Override(func(req *http.Request) bool { return true }, Override(func(req *http.Request) bool { return true })),
+		Override(func(req *http.Request) bool { return true }, FrameOptions("nope")),
+	} {
+		_, err := New(http.NotFoundHandler(), opt)
+		assert.Error(t, err)
+	}
+}
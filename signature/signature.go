@@ -0,0 +1,371 @@
+/*
+Package signature provides middlewares authenticating the requests between services with HMAC signatures.
+
+The Verifier checks the signatures of the inbound requests, the Signer signs the outbound requests toward the
+upstreams. The Signature header lists the signed components of the request:
+
+	Signature: keyId="billing",algorithm="hmac-sha256",headers="(request-target) host date digest",nonce="...",signature="..."
+
+The signing string holds one "name: value" line per component, the request target being the lowercased method and the
+request URI, e.g. "(request-target): post /invoices?draft=1", the nonce being the last line if any. The Digest header
+holds the SHA-256 of the body. The Date header is checked against the clock of the verifier, and the nonces are
+remembered to reject the replays.
+
+Examples of signature middlewares:
+
+	// verifies the requests signed with the keys of the clients
+	v, err := signature.NewVerifier(handler, signature.StaticKeys(map[string][]byte{"billing": secret}))
+
+	// signs the requests forwarded to the upstreams
+	s, err := signature.NewSigner(fwd, "billing", secret)
+*/
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Header is the header carrying the signature
+const Header = "Signature"
+
+// Defaults of the signature middlewares
+const (
+	DefaultAlgorithm       = "hmac-sha256"
+	DefaultClockSkew       = 5 * time.Minute
+	DefaultMaxBodyBytes    = 1 << 20
+	DefaultReplayCacheSize = 65536
+)
+
+// Pseudo components of the signing string
+const (
+	RequestTarget = "(request-target)"
+	nonceName     = "(nonce)"
+)
+
+// DefaultComponents are the components signed by the Signer and required by the Verifier
+var DefaultComponents = []string{RequestTarget, "host", "date", "digest"}
+
+var hashes = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// Keys returns the secret of the key ID
+type Keys func(keyID string) ([]byte, bool)
+
+// StaticKeys returns the secrets of the map
+func StaticKeys(keys map[string][]byte) Keys {
+	copied := make(map[string][]byte, len(keys))
+	for id, secret := range keys {
+		copied[id] = append([]byte(nil), secret...)
+	}
+	return func(keyID string) ([]byte, bool) {
+		secret, ok := copied[keyID]
+		return secret, ok
+	}
+}
+
+// config holds the settings shared by the Verifier and the Signer
+type config struct {
+	components      []string
+	algorithm       string
+	clockSkew       time.Duration
+	nonce           bool
+	replayCacheSize int
+	maxBodyBytes    int64
+	clock           utils.Clock
+
+	unauthorizedHandler http.Handler
+	errHandler          utils.ErrorHandler
+	log                 *log.Logger
+}
+
+func newConfig() config {
+	return config{
+		components:          DefaultComponents,
+		algorithm:           DefaultAlgorithm,
+		clockSkew:           DefaultClockSkew,
+		nonce:               true,
+		replayCacheSize:     DefaultReplayCacheSize,
+		maxBodyBytes:        DefaultMaxBodyBytes,
+		clock:               utils.InheritedClock(),
+		unauthorizedHandler: http.HandlerFunc(unauthorized),
+		errHandler:          utils.InheritedErrorHandler(utils.DefaultHandler),
+		log:                 utils.InheritedLogger(),
+	}
+}
+
+// Option is a functional option setter for the Verifier and the Signer
+type Option func(c *config) error
+
+// Components sets the components signed by the Signer, or required to be signed by the Verifier.
+// It defaults to DefaultComponents.
+func Components(components ...string) Option {
+	return func(c *config) error {
+		if len(components) == 0 {
+			return errors.New("at least one component is required")
+		}
+		c.components = nil
+		for _, component := range components {
+			component = strings.ToLower(component)
+			if component == "" || component == nonceName {
+				return fmt.Errorf("invalid component %q", component)
+			}
+			c.components = append(c.components, component)
+		}
+		return nil
+	}
+}
+
+// Algorithm sets the algorithm of the Signer, hmac-sha256 or hmac-sha512. The Verifier accepts both.
+func Algorithm(algorithm string) Option {
+	return func(c *config) error {
+		if _, ok := hashes[algorithm]; !ok {
+			return fmt.Errorf("unsupported algorithm %q", algorithm)
+		}
+		c.algorithm = algorithm
+		return nil
+	}
+}
+
+// ClockSkew sets the tolerated difference between the Date header and the clock of the Verifier
+func ClockSkew(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("clock skew must be positive")
+		}
+		c.clockSkew = d
+		return nil
+	}
+}
+
+// Nonce makes the Signer add a random nonce to the signatures, and the Verifier require it. It defaults to true.
+func Nonce(nonce bool) Option {
+	return func(c *config) error {
+		c.nonce = nonce
+		return nil
+	}
+}
+
+// ReplayCacheSize sets the number of nonces remembered by the Verifier to reject the replays
+func ReplayCacheSize(size int) Option {
+	return func(c *config) error {
+		if size <= 0 {
+			return errors.New("replay cache size must be positive")
+		}
+		c.replayCacheSize = size
+		return nil
+	}
+}
+
+// MaxBodyBytes limits the size of the bodies buffered to compute their digest
+func MaxBodyBytes(m int64) Option {
+	return func(c *config) error {
+		if m <= 0 {
+			return errors.New("max body bytes must be positive")
+		}
+		c.maxBodyBytes = m
+		return nil
+	}
+}
+
+// Clock sets the clock of the Date headers and of the replay cache, it defaults to utils.DefaultClock
+func Clock(clock utils.Clock) Option {
+	return func(c *config) error {
+		c.clock = clock
+		return nil
+	}
+}
+
+// UnauthorizedHandler sets the handler replying to the requests rejected by the Verifier.
+// It defaults to a 401 Unauthorized response.
+func UnauthorizedHandler(h http.Handler) Option {
+	return func(c *config) error {
+		if h == nil {
+			return errors.New("unauthorized handler can not be nil")
+		}
+		c.unauthorizedHandler = h
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler replying when the Signer fails to sign a request
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(c *config) error {
+		c.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the signature middlewares will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(c *config) error {
+		c.log = l
+		return nil
+	}
+}
+
+// errBodyTooLarge is returned when the body is too large to compute its digest
+var errBodyTooLarge = errors.New("request body too large")
+
+// readBody buffers the body of the request, so that its digest can be computed and it can be forwarded
+func readBody(req *http.Request, max int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, errBodyTooLarge
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func requestTarget(req *http.Request) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	return strings.ToLower(req.Method) + " " + uri
+}
+
+// signingString returns the string signed for the components of the request
+func signingString(req *http.Request, components []string, nonce string) (string, error) {
+	lines := make([]string, 0, len(components)+1)
+	for _, component := range components {
+		var value string
+		switch component {
+		case RequestTarget:
+			value = requestTarget(req)
+		case "host":
+			value = req.Host
+		default:
+			values, ok := req.Header[http.CanonicalHeaderKey(component)]
+			if !ok {
+				return "", fmt.Errorf("missing signed header %q", component)
+			}
+			value = strings.Join(values, ", ")
+		}
+		lines = append(lines, component+": "+value)
+	}
+	if nonce != "" {
+		lines = append(lines, nonceName+": "+nonce)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func sign(algorithm string, secret []byte, s string) []byte {
+	mac := hmac.New(hashes[algorithm], secret)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// params are the parameters of the Signature header
+type params struct {
+	keyID      string
+	algorithm  string
+	components []string
+	nonce      string
+	signature  []byte
+}
+
+var paramRegexp = regexp.MustCompile(`^\s*([a-zA-Z]+)="([^"]*)"\s*$`)
+
+func parseParams(header string) (*params, error) {
+	p := &params{}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		m := paramRegexp.FindStringSubmatch(part)
+		if m == nil || seen[m[1]] {
+			return nil, errors.New("malformed signature header")
+		}
+		seen[m[1]] = true
+		switch m[1] {
+		case "keyId":
+			p.keyID = m[2]
+		case "algorithm":
+			p.algorithm = m[2]
+		case "headers":
+			p.components = strings.Fields(strings.ToLower(m[2]))
+		case "nonce":
+			p.nonce = m[2]
+		case "signature":
+			sig, err := base64.StdEncoding.DecodeString(m[2])
+			if err != nil {
+				return nil, errors.New("malformed signature")
+			}
+			p.signature = sig
+		}
+	}
+	if p.keyID == "" || p.signature == nil || len(p.components) == 0 {
+		return nil, errors.New("incomplete signature header")
+	}
+	if p.algorithm == "" {
+		p.algorithm = DefaultAlgorithm
+	}
+	return p, nil
+}
+
+func (p *params) String() string {
+	fields := []string{
+		fmt.Sprintf("keyId=%q", p.keyID),
+		fmt.Sprintf("algorithm=%q", p.algorithm),
+		fmt.Sprintf("headers=%q", strings.Join(p.components, " ")),
+	}
+	if p.nonce != "" {
+		fields = append(fields, fmt.Sprintf("nonce=%q", p.nonce))
+	}
+	fields = append(fields, fmt.Sprintf("signature=%q", base64.StdEncoding.EncodeToString(p.signature)))
+	return strings.Join(fields, ",")
+}
+
+// missing returns the required components that are not signed
+func missing(required, signed []string) []string {
+	set := make(map[string]bool, len(signed))
+	for _, c := range signed {
+		set[c] = true
+	}
+	var result []string
+	for _, c := range required {
+		if !set[c] {
+			result = append(result, c)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func unauthorized(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
@@ -0,0 +1,160 @@
+package signature
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+)
+
+var now = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// signed returns the request as signed by a Signer
+func signed(t *testing.T, req *http.Request, opts ...Option) *http.Request {
+	var out *http.Request
+	s, err := NewSigner(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		out = req
+	}), "billing", []byte("secret"), append([]Option{Clock(utils.NewFakeClock(now))}, opts...)...)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.NotNil(t, out, rec.Body.String())
+	return out
+}
+
+func newVerifier(t *testing.T, clock utils.Clock, opts ...Option) (*Verifier, *string) {
+	var body string
+	v, err := NewVerifier(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		body = string(b)
+	}), StaticKeys(map[string][]byte{"billing": []byte("secret")}), append([]Option{Clock(clock)}, opts...)...)
+	require.NoError(t, err)
+	return v, &body
+}
+
+func TestSignature(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		tamper       func(req *http.Request)
+		opts         []Option
+		expectedCode int
+	}{
+		{desc: "valid", tamper: func(req *http.Request) {}, expectedCode: http.StatusOK},
+		{desc: "other path", tamper: func(req *http.Request) { req.RequestURI = "/refunds" }, expectedCode: http.StatusUnauthorized},
+		{desc: "other method", tamper: func(req *http.Request) { req.Method = http.MethodPut }, expectedCode: http.StatusUnauthorized},
+		{desc: "other host", tamper: func(req *http.Request) { req.Host = "evil.com" }, expectedCode: http.StatusUnauthorized},
+		{desc: "other body", tamper: func(req *http.Request) { req.Body = ioutil.NopCloser(strings.NewReader("amount=1000")) }, expectedCode: http.StatusUnauthorized},
+		{desc: "other digest", tamper: func(req *http.Request) { req.Header.Set("Digest", digest([]byte("amount=1000"))) }, expectedCode: http.StatusUnauthorized},
+		{desc: "unsigned", tamper: func(req *http.Request) { req.Header.Del(Header) }, expectedCode: http.StatusUnauthorized},
+		{desc: "unknown key", tamper: func(req *http.Request) {
+			req.Header.Set(Header, strings.Replace(req.Header.Get(Header), `"billing"`, `"shipping"`, 1))
+		}, expectedCode: http.StatusUnauthorized},
+		{desc: "required component not signed", tamper: func(req *http.Request) {}, opts: []Option{Components(RequestTarget, "host", "date", "digest", "content-type")}, expectedCode: http.StatusUnauthorized},
+		{desc: "body too large", tamper: func(req *http.Request) {}, opts: []Option{MaxBodyBytes(4)}, expectedCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/invoices?draft=1", strings.NewReader("amount=10"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			out := signed(t, req)
+			assert.NotEmpty(t, out.Header.Get("Date"))
+			assert.Empty(t, req.Header.Get(Header), "the request of the client is left untouched")
+			test.tamper(out)
+
+			v, body := newVerifier(t, utils.NewFakeClock(now.Add(time.Minute)), test.opts...)
+			rec := httptest.NewRecorder()
+			v.ServeHTTP(rec, out)
+			assert.Equal(t, test.expectedCode, rec.Code)
+			if test.expectedCode == http.StatusOK {
+				assert.Equal(t, "amount=10", *body)
+			}
+		})
+	}
+}
+
+func TestSignatureReplay(t *testing.T) {
+	clock := utils.NewFakeClock(now)
+	v, _ := newVerifier(t, clock)
+	out := signed(t, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, out)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	v.ServeHTTP(rec, out)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "replays are rejected")
+
+	rec = httptest.NewRecorder()
+	v.ServeHTTP(rec, signed(t, httptest.NewRequest(http.MethodGet, "/", nil)))
+	assert.Equal(t, http.StatusOK, rec.Code, "every signature has its nonce")
+}
+
+func TestSignatureClockSkew(t *testing.T) {
+	out := signed(t, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	for _, d := range []time.Duration{-DefaultClockSkew - time.Second, DefaultClockSkew + time.Second} {
+		v, _ := newVerifier(t, utils.NewFakeClock(now.Add(d)))
+		rec := httptest.NewRecorder()
+		v.ServeHTTP(rec, out)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, d.String())
+	}
+}
+
+func TestSignatureWithoutNonce(t *testing.T) {
+	out := signed(t, httptest.NewRequest(http.MethodGet, "/", nil), Nonce(false), Algorithm("hmac-sha512"), Components(RequestTarget, "date"))
+	assert.NotContains(t, out.Header.Get(Header), "nonce=")
+	assert.Contains(t, out.Header.Get(Header), `algorithm="hmac-sha512",headers="(request-target) date"`)
+
+	v, _ := newVerifier(t, utils.NewFakeClock(now), Components(RequestTarget, "date"))
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, out)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "nonces are required by default")
+
+	v, _ = newVerifier(t, utils.NewFakeClock(now), Components(RequestTarget, "date"), Nonce(false))
+	rec = httptest.NewRecorder()
+	v.ServeHTTP(rec, out)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestParseParams(t *testing.T) {
+	p, err := parseParams(`keyId="k", algorithm="hmac-sha256",headers="(request-target) Host",nonce="n",signature="c2ln"`)
+	require.NoError(t, err)
+	assert.Equal(t, "k", p.keyID)
+	assert.Equal(t, []string{RequestTarget, "host"}, p.components)
+	assert.Equal(t, []byte("sig"), p.signature)
+
+	for _, header := range []string{
+		`keyId="k"`,
+		`keyId="k",headers="host",signature="not base64"`,
+		`keyId="k",keyId="other",headers="host",signature="c2ln"`,
+		`keyId=k,headers="host",signature="c2ln"`,
+	} {
+		_, err := parseParams(header)
+		assert.Error(t, err, header)
+	}
+}
+
+func TestSignatureInvalidOptions(t *testing.T) {
+	_, err := NewSigner(http.NotFoundHandler(), "", []byte("secret"))
+	assert.Error(t, err)
+
+	_, err = NewSigner(http.NotFoundHandler(), "k", []byte("secret"), Algorithm("hmac-md5"))
+	assert.Error(t, err)
+
+	_, err = NewVerifier(http.NotFoundHandler(), nil)
+	assert.Error(t, err)
+
+	_, err = NewVerifier(http.NotFoundHandler(), StaticKeys(nil), Components("(nonce)"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,93 @@
+package signature
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Signer is a middleware signing the requests before they are forwarded to the upstreams
+type Signer struct {
+	config
+	next   http.Handler
+	keyID  string
+	secret []byte
+}
+
+// NewSigner creates a new Signer signing the requests with the secret of the key ID
+func NewSigner(next http.Handler, keyID string, secret []byte, opts ...Option) (*Signer, error) {
+	if keyID == "" || len(secret) == 0 {
+		return nil, errors.New("key ID and secret can not be empty")
+	}
+	s := &Signer{config: newConfig(), next: next, keyID: keyID, secret: append([]byte(nil), secret...)}
+	for _, o := range opts {
+		if err := o(&s.config); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Wrap sets the next handler to be called by signer handler.
+func (s *Signer) Wrap(next http.Handler) error {
+	s.next = next
+	return nil
+}
+
+func (s *Signer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.log.Level >= log.DebugLevel {
+		logEntry := s.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/signature: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/signature: completed ServeHttp on request")
+	}
+
+	outReq, err := s.sign(req)
+	if err != nil {
+		if err == errBodyTooLarge {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.log.Errorf("vulcand/oxy/signature: failed to sign request, err: %v", err)
+		s.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	s.next.ServeHTTP(w, outReq)
+}
+
+// sign returns a copy of the request with the Signature header, and the Date and Digest headers when signed
+func (s *Signer) sign(req *http.Request) (*http.Request, error) {
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.Header = utils.CloneHeaders(req.Header)
+
+	if contains(s.components, "date") && outReq.Header.Get("Date") == "" {
+		outReq.Header.Set("Date", s.clock.UtcNow().Format(http.TimeFormat))
+	}
+	if contains(s.components, "digest") {
+		body, err := readBody(outReq, s.maxBodyBytes)
+		if err != nil {
+			return nil, err
+		}
+		outReq.Header.Set("Digest", digest(body))
+	}
+
+	p := &params{keyID: s.keyID, algorithm: s.algorithm, components: s.components}
+	if s.nonce {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		p.nonce = hex.EncodeToString(b[:])
+	}
+	str, err := signingString(outReq, s.components, p.nonce)
+	if err != nil {
+		return nil, err
+	}
+	p.signature = sign(s.algorithm, s.secret, str)
+	outReq.Header.Set(Header, p.String())
+	return outReq, nil
+}
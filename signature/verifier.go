@@ -0,0 +1,157 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/ttlmap"
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Verifier is a middleware rejecting the requests without a valid signature
+type Verifier struct {
+	config
+	next  http.Handler
+	keys  Keys
+	mutex sync.Mutex
+	seen  *ttlmap.TtlMap
+}
+
+// NewVerifier creates a new Verifier checking the signatures with the secrets of the keys
+func NewVerifier(next http.Handler, keys Keys, opts ...Option) (*Verifier, error) {
+	if keys == nil {
+		return nil, errors.New("keys can not be nil")
+	}
+	v := &Verifier{config: newConfig(), next: next, keys: keys}
+	for _, o := range opts {
+		if err := o(&v.config); err != nil {
+			return nil, err
+		}
+	}
+	seen, err := ttlmap.NewMapWithProvider(v.replayCacheSize, v.clock)
+	if err != nil {
+		return nil, err
+	}
+	v.seen = seen
+	return v, nil
+}
+
+// Wrap sets the next handler to be called by verifier handler.
+func (v *Verifier) Wrap(next http.Handler) error {
+	v.next = next
+	return nil
+}
+
+func (v *Verifier) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if v.log.Level >= log.DebugLevel {
+		logEntry := v.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/signature: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/signature: completed ServeHttp on request")
+	}
+
+	if err := v.verify(req); err != nil {
+		if err == errBodyTooLarge {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		v.log.Debugf("vulcand/oxy/signature: rejecting request, err: %v", err)
+		v.unauthorizedHandler.ServeHTTP(w, req)
+		return
+	}
+	v.next.ServeHTTP(w, req)
+}
+
+func (v *Verifier) verify(req *http.Request) error {
+	header := req.Header.Get(Header)
+	if header == "" {
+		return utils.ErrNoCredentials
+	}
+	p, err := parseParams(header)
+	if err != nil {
+		return err
+	}
+	if _, ok := hashes[p.algorithm]; !ok {
+		return fmt.Errorf("unsupported algorithm %q", p.algorithm)
+	}
+	if m := missing(v.components, p.components); len(m) > 0 {
+		return fmt.Errorf("components %v are not signed", m)
+	}
+	if v.nonce && p.nonce == "" {
+		return errors.New("missing nonce")
+	}
+	secret, ok := v.keys(p.keyID)
+	if !ok {
+		return fmt.Errorf("unknown key %q", p.keyID)
+	}
+
+	s, err := signingString(req, p.components, p.nonce)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sign(p.algorithm, secret, s), p.signature) {
+		return errors.New("invalid signature")
+	}
+
+	if err := v.checkDate(req, p.components); err != nil {
+		return err
+	}
+	if contains(p.components, "digest") {
+		body, err := readBody(req, v.maxBodyBytes)
+		if err != nil {
+			return err
+		}
+		if req.Header.Get("Digest") != digest(body) {
+			return errors.New("digest does not match the body")
+		}
+	}
+	if p.nonce != "" {
+		return v.checkReplay(p.keyID, p.nonce)
+	}
+	return nil
+}
+
+// checkDate rejects the signatures of the requests dated too far from now, when the date is signed
+func (v *Verifier) checkDate(req *http.Request, components []string) error {
+	if !contains(components, "date") {
+		return nil
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("invalid date: %v", err)
+	}
+	skew := v.clock.UtcNow().Sub(date)
+	if skew > v.clockSkew || skew < -v.clockSkew {
+		return fmt.Errorf("date is %v away from now", skew)
+	}
+	return nil
+}
+
+// checkReplay rejects the nonces already seen, they are remembered for twice the clock skew: the time the dates of the
+// requests are accepted
+func (v *Verifier) checkReplay(keyID, nonce string) error {
+	key := keyID + "/" + nonce
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if _, seen := v.seen.Get(key); seen {
+		return errors.New("replayed nonce")
+	}
+	ttl := int(2 * v.clockSkew / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	return v.seen.Set(key, true, ttl)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+/*
+Package sizelimit provides a middleware bounding the size of the request headers and bodies.
+
+Requests whose headers are too large are rejected with a 431 response, requests whose body is too large with
+a 413 response. The body size is checked against the Content-Length before the request is passed to the next handler,
+and counted while it is read for the chunked bodies, so that the memory used by buffer or forward is bounded.
+
+Examples of a size limit:
+
+	// at most 8KB of headers and 1MB of body
+	l, err := sizelimit.New(handler, sizelimit.MaxHeaderBytes(8<<10), sizelimit.MaxBodyBytes(1<<20))
+*/
+package sizelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+var (
+	// ErrHeaderTooLarge is passed to the error handler when the request headers exceed the limit
+	ErrHeaderTooLarge = errors.New("request header too large")
+	// ErrBodyTooLarge is passed to the error handler, and returned by the request body reads, when the request
+	// body exceeds the limit
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// SizeLimit is a middleware rejecting the requests exceeding the size limits
+type SizeLimit struct {
+	next           http.Handler
+	maxHeaderBytes int64
+	maxBodyBytes   int64
+	errHandler     utils.ErrorHandler
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for SizeLimit
+type Option func(l *SizeLimit) error
+
+// New creates a new SizeLimit middleware, the sizes are not limited by default
+func New(next http.Handler, opts ...Option) (*SizeLimit, error) {
+	l := &SizeLimit{
+		next:       next,
+		errHandler: &SizeErrHandler{},
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(l); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// MaxHeaderBytes sets the maximum size of the request line and headers, as sent on the wire
+func MaxHeaderBytes(n int64) Option {
+	return func(l *SizeLimit) error {
+		if n <= 0 {
+			return fmt.Errorf("max header bytes should be > 0, got %d", n)
+		}
+		l.maxHeaderBytes = n
+		return nil
+	}
+}
+
+// MaxBodyBytes sets the maximum size of the request body
+func MaxBodyBytes(n int64) Option {
+	return func(l *SizeLimit) error {
+		if n <= 0 {
+			return fmt.Errorf("max body bytes should be > 0, got %d", n)
+		}
+		l.maxBodyBytes = n
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler replying to the requests exceeding the limits, with ErrHeaderTooLarge or
+// ErrBodyTooLarge. It defaults to SizeErrHandler.
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(l *SizeLimit) error {
+		if h == nil {
+			return errors.New("error handler can not be nil")
+		}
+		l.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the size limit will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(logger *log.Logger) Option {
+	return func(l *SizeLimit) error {
+		l.log = logger
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by size limit handler.
+func (l *SizeLimit) Wrap(next http.Handler) error {
+	l.next = next
+	return nil
+}
+
+func (l *SizeLimit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if l.log.Level >= log.DebugLevel {
+		logEntry := l.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/sizelimit: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/sizelimit: completed ServeHttp on request")
+	}
+
+	if l.maxHeaderBytes > 0 && headerSize(req) > l.maxHeaderBytes {
+		if utils.Sampled(l.log, log.DebugLevel, "vulcand/oxy/sizelimit: rejecting %v, headers exceed %d bytes") {
+			l.log.Debugf("vulcand/oxy/sizelimit: rejecting %v, headers exceed %d bytes", req.RemoteAddr, l.maxHeaderBytes)
+		}
+		l.errHandler.ServeHTTP(w, req, ErrHeaderTooLarge)
+		return
+	}
+	if l.maxBodyBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		l.next.ServeHTTP(w, req)
+		return
+	}
+	if req.ContentLength > l.maxBodyBytes {
+		if utils.Sampled(l.log, log.DebugLevel, "vulcand/oxy/sizelimit: rejecting %v, content length %d exceeds %d bytes") {
+			l.log.Debugf("vulcand/oxy/sizelimit: rejecting %v, content length %d exceeds %d bytes", req.RemoteAddr, req.ContentLength, l.maxBodyBytes)
+		}
+		l.errHandler.ServeHTTP(w, req, ErrBodyTooLarge)
+		return
+	}
+
+	lw := &limitWriter{ResponseWriter: w}
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.Body = &limitBody{
+		ReadCloser: req.Body,
+		remaining:  l.maxBodyBytes,
+		onExceeded: func() {
+			if utils.Sampled(l.log, log.DebugLevel, "vulcand/oxy/sizelimit: rejecting %v, body exceeds %d bytes") {
+				l.log.Debugf("vulcand/oxy/sizelimit: rejecting %v, body exceeds %d bytes", req.RemoteAddr, l.maxBodyBytes)
+			}
+			lw.reject(func(w http.ResponseWriter) { l.errHandler.ServeHTTP(w, req, ErrBodyTooLarge) })
+		},
+	}
+	l.next.ServeHTTP(lw, outReq)
+}
+
+// headerSize returns the size of the request line and of the headers, as sent by HTTP/1.1 clients
+func headerSize(req *http.Request) int64 {
+	// METHOD URI PROTO\r\n
+	size := int64(len(req.Method) + 1 + len(req.RequestURI) + 1 + len(req.Proto) + 2)
+	if req.Host != "" && req.Header.Get("Host") == "" {
+		size += int64(len("Host: ") + len(req.Host) + 2)
+	}
+	for name, values := range req.Header {
+		for _, v := range values {
+			size += int64(len(name) + 2 + len(v) + 2)
+		}
+	}
+	return size + 2
+}
+
+// SizeErrHandler replies 431 to ErrHeaderTooLarge, 413 to ErrBodyTooLarge, and 500 to the other errors
+type SizeErrHandler struct{}
+
+func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case ErrHeaderTooLarge:
+		http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge), http.StatusRequestHeaderFieldsTooLarge)
+	case ErrBodyTooLarge:
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	default:
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+	}
+}
+
+// limitBody counts the bytes read from the request body, and fails the reads past the limit
+type limitBody struct {
+	io.ReadCloser
+	remaining  int64
+	exceeded   bool
+	onExceeded func()
+}
+
+func (b *limitBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, ErrBodyTooLarge
+	}
+	// read one more byte than allowed to detect the bodies exceeding the limit
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded = true
+		b.onExceeded()
+		return int(b.remaining), ErrBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitWriter replaces the response by the error handler reply when the body exceeds the limit before the response
+// is started, and discards what the next handler writes afterwards
+type limitWriter struct {
+	http.ResponseWriter
+
+	mutex    sync.Mutex
+	started  bool
+	rejected bool
+}
+
+func (lw *limitWriter) reject(reply func(w http.ResponseWriter)) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	if lw.started || lw.rejected {
+		return
+	}
+	lw.rejected = true
+	reply(lw.ResponseWriter)
+}
+
+// Header returns the headers of the response, the next handler can not change them once the request is rejected
+func (lw *limitWriter) Header() http.Header {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	if lw.rejected {
+		return http.Header{}
+	}
+	return lw.ResponseWriter.Header()
+}
+
+func (lw *limitWriter) WriteHeader(code int) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	if lw.rejected {
+		return
+	}
+	lw.started = true
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	if lw.rejected {
+		return len(p), nil
+	}
+	lw.started = true
+	return lw.ResponseWriter.Write(p)
+}
+
+// Flush sends any buffered data to the client
+func (lw *limitWriter) Flush() {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	if lw.rejected {
+		return
+	}
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		lw.started = true
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection
+func (lw *limitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	if lw.rejected {
+		return nil, nil, ErrBodyTooLarge
+	}
+	if hi, ok := lw.ResponseWriter.(http.Hijacker); ok {
+		lw.started = true
+		return hi.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer that was wrapped in this size limit middleware does not implement http.Hijacker(type: %T)", lw.ResponseWriter)
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (lw *limitWriter) CloseNotify() <-chan bool {
+	if cn, ok := lw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
@@ -0,0 +1,116 @@
+package sizelimit
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestSizeLimit(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	})
+
+	testCases := []struct {
+		desc         string
+		header       http.Header
+		body         io.Reader
+		chunked      bool
+		expectedCode int
+	}{
+		{desc: "within the limits", header: http.Header{"X-Small": {"value"}}, body: strings.NewReader("hello"), expectedCode: http.StatusOK},
+		{desc: "no body", expectedCode: http.StatusOK},
+		{desc: "headers too large", header: http.Header{"X-Large": {strings.Repeat("a", 1024)}}, expectedCode: http.StatusRequestHeaderFieldsTooLarge},
+		{desc: "content length too large", body: strings.NewReader(strings.Repeat("a", 101)), expectedCode: http.StatusRequestEntityTooLarge},
+		{desc: "chunked body at the limit", body: strings.NewReader(strings.Repeat("a", 100)), chunked: true, expectedCode: http.StatusOK},
+		{desc: "chunked body too large", body: strings.NewReader(strings.Repeat("a", 101)), chunked: true, expectedCode: http.StatusRequestEntityTooLarge},
+	}
+
+	l, err := New(echo, MaxHeaderBytes(512), MaxBodyBytes(100))
+	require.NoError(t, err)
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			body := test.body
+			if test.chunked {
+				// hide the length of the reader, so that the body is sent chunked
+				body = ioutil.NopCloser(body)
+			}
+			req, err := http.NewRequest(http.MethodPost, srv.URL, body)
+			require.NoError(t, err)
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, test.expectedCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestSizeLimitBeforeForward(t *testing.T) {
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Write([]byte("backend"))
+	})
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	l, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	}), MaxBodyBytes(1024))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(l)
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL, "text/plain", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 64<<10))))
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, http.StatusText(http.StatusRequestEntityTooLarge)+"\n", string(body))
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "backend", string(body))
+}
+
+func TestSizeLimitErrorHandler(t *testing.T) {
+	l, err := New(http.NotFoundHandler(), MaxBodyBytes(1), ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		assert.Equal(t, ErrBodyTooLarge, err)
+		w.WriteHeader(http.StatusBadRequest)
+	})))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSizeLimitInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{MaxHeaderBytes(0), MaxBodyBytes(-1), ErrorHandler(nil)} {
+		_, err := New(http.NotFoundHandler(), opt)
+		assert.Error(t, err)
+	}
+}
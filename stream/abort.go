@@ -0,0 +1,103 @@
+package stream
+
+import (
+	gocontext "context"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// AbortOnDisconnect cancels the context of the request passed to the next handler as soon as the client disconnects
+// mid-stream, i.e. once a write to the client fails or the server cancels the request, so that the forwarder
+// stops reading the upstream body right away instead of streaming it to a closed connection.
+//
+// onAbort, if not nil, is called once the next handler returned with the number of bytes of the response body
+// delivered to the client.
+func AbortOnDisconnect(onAbort func(req *http.Request, delivered int64)) optSetter {
+	return func(s *Stream) error {
+		s.abort = true
+		s.onAbort = onAbort
+		return nil
+	}
+}
+
+// abortWriter cancels the request once a write to the client fails
+type abortWriter struct {
+	*utils.ProxyWriter
+	cancel    gocontext.CancelFunc
+	delivered int64
+	failed    int32
+}
+
+func (w *abortWriter) Write(buf []byte) (int, error) {
+	n, err := w.ProxyWriter.Write(buf)
+	atomic.AddInt64(&w.delivered, int64(n))
+	if err != nil {
+		atomic.StoreInt32(&w.failed, 1)
+		w.cancel()
+	}
+	return n, err
+}
+
+// ReadFrom copies the body with the io.ReaderFrom of the client writer, the errors reading r are told from the
+// ones writing to the client so that an upstream failure is not taken for a disconnection
+func (w *abortWriter) ReadFrom(r io.Reader) (int64, error) {
+	src := &readErrRecorder{Reader: r}
+	n, err := w.ProxyWriter.ReadFrom(src)
+	atomic.AddInt64(&w.delivered, n)
+	if err != nil && err != src.err {
+		atomic.StoreInt32(&w.failed, 1)
+		w.cancel()
+	}
+	return n, err
+}
+
+// readErrRecorder records the last error of the reader
+type readErrRecorder struct {
+	io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (s *Stream) serveAbortable(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := gocontext.WithCancel(req.Context())
+	defer cancel()
+
+	pw := utils.AcquireProxyWriter(w, s.log)
+	defer utils.ReleaseProxyWriter(pw)
+	aw := &abortWriter{ProxyWriter: pw, cancel: cancel}
+
+	defer func() {
+		// the forwarder panics with http.ErrAbortHandler once it fails to write the response
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				s.aborted(req, aw)
+			}
+			panic(p)
+		}
+	}()
+
+	s.next.ServeHTTP(aw, req.WithContext(ctx))
+
+	// the server cancels the context of the request once the client is gone
+	if atomic.LoadInt32(&aw.failed) != 0 || req.Context().Err() != nil {
+		s.aborted(req, aw)
+	}
+}
+
+func (s *Stream) aborted(req *http.Request, aw *abortWriter) {
+	delivered := atomic.LoadInt64(&aw.delivered)
+	s.log.Debugf("vulcand/oxy/stream: client disconnected from Request(%v %v) after %d bytes", req.Method, req.URL, delivered)
+	if s.onAbort != nil {
+		s.onAbort(req, delivered)
+	}
+}
@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestAbortOnDisconnect(t *testing.T) {
+	upstreamDone := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		defer close(upstreamDone)
+		w.WriteHeader(http.StatusOK)
+		for {
+			if _, err := w.Write([]byte("chunk")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+	defer srv.Close()
+
+	fwd, err := forward.New(forward.Stream(true), forward.StreamingFlushInterval(time.Millisecond))
+	require.NoError(t, err)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	aborted := make(chan int64, 1)
+	st, err := New(rdr, AbortOnDisconnect(func(req *http.Request, delivered int64) {
+		aborted <- delivered
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = re.Body.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "chunk", string(buf))
+	re.Body.Close()
+
+	select {
+	case delivered := <-aborted:
+		assert.True(t, delivered >= 5, "delivered %d bytes", delivered)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the abort callback was not called")
+	}
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not canceled")
+	}
+}
+
+func TestAbortOnDisconnectCompleted(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	st, err := New(handler, AbortOnDisconnect(func(req *http.Request, delivered int64) {
+		t.Errorf("unexpected abort after %d bytes", delivered)
+	}))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+}
@@ -0,0 +1,255 @@
+package stream
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vulcand/oxy/metrics"
+	"github.com/vulcand/oxy/utils"
+)
+
+// OpenRangePolicy is what the streamer does with the open-ended byte ranges, e.g. "bytes=1000-", over the limit
+type OpenRangePolicy int
+
+const (
+	// TruncateOpenRanges rewrites the open-ended ranges of the requests into ranges of the limit, e.g. "bytes=1000-"
+	// into "bytes=1000-1999" for a limit of 1000 bytes, the clients read the rest with the next requests
+	TruncateOpenRanges OpenRangePolicy = iota
+	// RejectOpenRanges replies 416 Range Not Satisfiable, with the complete length in the Content-Range header, when
+	// the upstream server answers an open-ended range with a partial content over the limit
+	RejectOpenRanges
+)
+
+// OpenRangeLimit limits the size of the partial contents of the open-ended byte ranges, e.g. "bytes=1000-" asking
+// for the rest of a large media file, so that a client can not hold a large stream with a single request. The
+// suffix ranges, "bytes=-500", and the closed ranges are not limited.
+//
+// RejectOpenRanges only checks the single part responses, their Content-Range header gives their size.
+func OpenRangeLimit(size int64, policy OpenRangePolicy) optSetter {
+	return func(s *Stream) error {
+		if size <= 0 {
+			return fmt.Errorf("open range limit should be > 0, got %d", size)
+		}
+		if policy != TruncateOpenRanges && policy != RejectOpenRanges {
+			return fmt.Errorf("unknown open range policy: %d", policy)
+		}
+		s.openRanges = &openRangeLimit{size: size, policy: policy}
+		return nil
+	}
+}
+
+type openRangeLimit struct {
+	size   int64
+	policy OpenRangePolicy
+}
+
+// rangeMetrics are the metrics of the range requests registered by the Metrics option
+type rangeMetrics struct {
+	requests *metrics.CounterVec
+	bytes    *metrics.Counter
+	sizes    *metrics.Histogram
+}
+
+// rangeSizeBuckets are the buckets of the sizes of the partial contents, from 64KiB to 1GiB
+var rangeSizeBuckets = []float64{1 << 16, 1 << 20, 1 << 24, 1 << 28, 1 << 30}
+
+// Metrics registers the metrics of the range requests into the registry:
+//
+//	oxy_stream_range_requests_total counts the requests with a Range header by result: partial for a 206, full when
+//	the upstream server did not answer with a 206, truncated and rejected for the 206 truncated and rejected by
+//	OpenRangeLimit
+//	oxy_stream_range_bytes_total counts the bytes of the partial contents delivered to the clients
+//	oxy_stream_range_size_bytes is the histogram of the sizes of the partial contents, from their Content-Range
+func Metrics(r *metrics.Registry) optSetter {
+	return func(s *Stream) error {
+		requests, err := r.Counter("oxy_stream_range_requests_total", "Range requests streamed, by result.", "result")
+		if err != nil {
+			return err
+		}
+		bytes, err := r.Counter("oxy_stream_range_bytes_total", "Bytes of the partial contents delivered.")
+		if err != nil {
+			return err
+		}
+		sizes, err := r.Histogram("oxy_stream_range_size_bytes", "Sizes of the partial contents.", rangeSizeBuckets)
+		if err != nil {
+			return err
+		}
+		s.metrics = &rangeMetrics{requests: requests, bytes: bytes.With(), sizes: sizes.With()}
+		return nil
+	}
+}
+
+func (m *rangeMetrics) count(result string) {
+	if m != nil {
+		m.requests.With(result).Inc()
+	}
+}
+
+// serveRange serves a request with a Range header, limiting its open-ended ranges and recording its metrics
+func (s *Stream) serveRange(w http.ResponseWriter, req *http.Request) {
+	openEnded, truncated := false, false
+	if s.openRanges != nil {
+		ranges, ok := truncateOpenRanges(req.Header.Get("Range"), s.openRanges.size)
+		openEnded = ok
+		if ok && s.openRanges.policy == TruncateOpenRanges {
+			outReq := req.WithContext(req.Context())
+			outReq.Header = utils.CloneHeaders(req.Header)
+			outReq.Header.Set("Range", ranges)
+			req = outReq
+			// the limit is enforced, the response is not checked
+			openEnded = false
+			truncated = true
+		}
+	}
+
+	ctx, cancel := gocontext.WithCancel(req.Context())
+	defer cancel()
+
+	pw := utils.AcquireProxyWriter(w, s.log)
+	defer utils.ReleaseProxyWriter(pw)
+	rw := &rangeWriter{ProxyWriter: pw, stream: s, checkOpenRange: openEnded, truncated: truncated, cancel: cancel}
+
+	s.serveNext(rw, req.WithContext(ctx))
+
+	if rw.partial && s.metrics != nil {
+		s.metrics.bytes.Add(float64(pw.GetLength()))
+	}
+}
+
+// rangeWriter checks the partial contents of the range requests, its io.ReaderFrom keeps the one of the client
+// writer for the large media files
+type rangeWriter struct {
+	*utils.ProxyWriter
+	stream *Stream
+	// checkOpenRange rejects the partial contents over the limit, see RejectOpenRanges
+	checkOpenRange bool
+	// truncated is a request whose open-ended ranges were truncated, see TruncateOpenRanges
+	truncated bool
+	cancel    gocontext.CancelFunc
+
+	wroteHeader bool
+	partial     bool
+	rejected    bool
+}
+
+func (w *rangeWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	// the interim responses, e.g. 103 Early Hints, are passed before the final one
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		w.ProxyWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+
+	if code != http.StatusPartialContent {
+		w.stream.metrics.count("full")
+		w.ProxyWriter.WriteHeader(code)
+		return
+	}
+	first, last, complete, ok := parseContentRange(w.Header().Get("Content-Range"))
+	if ok && w.checkOpenRange && last-first+1 > w.stream.openRanges.size {
+		w.reject(complete)
+		return
+	}
+	w.partial = true
+	if w.truncated {
+		w.stream.metrics.count("truncated")
+	} else {
+		w.stream.metrics.count("partial")
+	}
+	if ok && w.stream.metrics != nil {
+		w.stream.metrics.sizes.Observe(float64(last - first + 1))
+	}
+	w.ProxyWriter.WriteHeader(code)
+}
+
+// reject replies 416 instead of the partial content and stops reading the upstream response
+func (w *rangeWriter) reject(complete string) {
+	w.rejected = true
+	w.cancel()
+	w.stream.metrics.count("rejected")
+	w.stream.log.Debugf("vulcand/oxy/stream: rejecting partial content over the open range limit of %d bytes", w.stream.openRanges.size)
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Type")
+	h.Set("Content-Range", "bytes */"+complete)
+	w.ProxyWriter.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+}
+
+func (w *rangeWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rejected {
+		return len(buf), nil
+	}
+	return w.ProxyWriter.Write(buf)
+}
+
+func (w *rangeWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rejected {
+		return io.Copy(ioutil.Discard, r)
+	}
+	return w.ProxyWriter.ReadFrom(r)
+}
+
+// truncateOpenRanges rewrites the open-ended ranges of a byte ranges header into ranges of size bytes, it returns
+// false if the header has no open-ended range
+func truncateOpenRanges(header string, size int64) (string, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return "", false
+	}
+	specs := strings.Split(header[len(prefix):], ",")
+	truncated := false
+	for i, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.HasSuffix(spec, "-") || spec == "-" {
+			continue
+		}
+		first, err := strconv.ParseInt(strings.TrimSuffix(spec, "-"), 10, 64)
+		if err != nil || first < 0 {
+			continue
+		}
+		specs[i] = fmt.Sprintf("%d-%d", first, first+size-1)
+		truncated = true
+	}
+	if !truncated {
+		return "", false
+	}
+	return prefix + strings.Join(specs, ","), true
+}
+
+// parseContentRange parses a "bytes first-last/complete" Content-Range header, complete may be "*"
+func parseContentRange(header string) (int64, int64, string, bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, "", false
+	}
+	r := header[len(prefix):]
+	slash := strings.IndexByte(r, '/')
+	dash := strings.IndexByte(r, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, "", false
+	}
+	first, err := strconv.ParseInt(r[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	last, err := strconv.ParseInt(r[dash+1:slash], 10, 64)
+	if err != nil || last < first {
+		return 0, 0, "", false
+	}
+	return first, last, r[slash+1:], true
+}
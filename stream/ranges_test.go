@@ -0,0 +1,199 @@
+package stream
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/metrics"
+	"github.com/vulcand/oxy/testutils"
+)
+
+var media = []byte(strings.Repeat("0123456789", 10))
+
+func mediaHandler(w http.ResponseWriter, req *http.Request) {
+	http.ServeContent(w, req, "media.mp4", time.Time{}, bytes.NewReader(media))
+}
+
+func TestOpenRangeLimitTruncate(t *testing.T) {
+	registry := metrics.NewRegistry()
+	st, err := New(http.HandlerFunc(mediaHandler), OpenRangeLimit(10, TruncateOpenRanges), Metrics(registry))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header("Range", "bytes=25-"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, re.StatusCode)
+	assert.Equal(t, "bytes 25-34/100", re.Header.Get("Content-Range"))
+	assert.Equal(t, string(media[25:35]), string(body))
+
+	// the closed ranges are not limited
+	re, body, err = testutils.Get(proxy.URL, testutils.Header("Range", "bytes=0-49"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, re.StatusCode)
+	assert.Equal(t, string(media[:50]), string(body))
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, `oxy_stream_range_requests_total{result="truncated"} 1`+"\n")
+	assert.Contains(t, gathered, `oxy_stream_range_requests_total{result="partial"} 1`+"\n")
+	assert.Contains(t, gathered, "oxy_stream_range_bytes_total 60\n")
+	assert.Contains(t, gathered, "oxy_stream_range_size_bytes_sum 60\n")
+}
+
+func TestOpenRangeLimitReject(t *testing.T) {
+	registry := metrics.NewRegistry()
+	st, err := New(http.HandlerFunc(mediaHandler), OpenRangeLimit(10, RejectOpenRanges), Metrics(registry))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header("Range", "bytes=25-"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, re.StatusCode)
+	assert.Equal(t, "bytes */100", re.Header.Get("Content-Range"))
+	assert.Empty(t, body)
+
+	// the open-ended ranges under the limit are served
+	re, body, err = testutils.Get(proxy.URL, testutils.Header("Range", "bytes=95-"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, re.StatusCode)
+	assert.Equal(t, string(media[95:]), string(body))
+
+	// the requests without a Range header are not counted
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, `oxy_stream_range_requests_total{result="rejected"} 1`+"\n")
+	assert.Contains(t, gathered, `oxy_stream_range_requests_total{result="partial"} 1`+"\n")
+	assert.NotContains(t, gathered, `result="full"`)
+	assert.Contains(t, gathered, "oxy_stream_range_bytes_total 5\n")
+}
+
+func TestRangeMetricsFull(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(media)
+	})
+
+	registry := metrics.NewRegistry()
+	st, err := New(handler, Metrics(registry))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header("Range", "bytes=25-"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, media, body)
+
+	gathered := string(registry.Gather())
+	assert.Contains(t, gathered, `oxy_stream_range_requests_total{result="full"} 1`+"\n")
+	assert.Contains(t, gathered, "oxy_stream_range_bytes_total 0\n")
+}
+
+// interimRecorder records the status codes of the interim responses
+type interimRecorder struct {
+	*httptest.ResponseRecorder
+	interim []int
+}
+
+func (r *interimRecorder) WriteHeader(code int) {
+	if code < http.StatusOK {
+		r.interim = append(r.interim, code)
+		return
+	}
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func TestOpenRangeLimitInterimResponse(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(103)
+		mediaHandler(w, req)
+	})
+
+	st, err := New(handler, OpenRangeLimit(10, TruncateOpenRanges))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("Range", "bytes=25-")
+	rec := &interimRecorder{ResponseRecorder: httptest.NewRecorder()}
+	st.ServeHTTP(rec, req)
+
+	assert.Equal(t, []int{103}, rec.interim)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "bytes 25-34/100", rec.Header().Get("Content-Range"))
+	assert.Equal(t, string(media[25:35]), rec.Body.String())
+}
+
+func TestTruncateOpenRanges(t *testing.T) {
+	testCases := []struct {
+		header    string
+		expected  string
+		truncated bool
+	}{
+		{header: "bytes=100-", expected: "bytes=100-109", truncated: true},
+		{header: "bytes=0-5, 100-", expected: "bytes=0-5,100-109", truncated: true},
+		{header: "bytes=0-5", truncated: false},
+		{header: "bytes=-500", truncated: false},
+		{header: "bytes=-", truncated: false},
+		{header: "bytes=a-", truncated: false},
+		{header: "items=100-", truncated: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.header, func(t *testing.T) {
+			ranges, truncated := truncateOpenRanges(test.header, 10)
+			assert.Equal(t, test.truncated, truncated)
+			assert.Equal(t, test.expected, ranges)
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	testCases := []struct {
+		header   string
+		first    int64
+		last     int64
+		complete string
+		ok       bool
+	}{
+		{header: "bytes 0-9/100", first: 0, last: 9, complete: "100", ok: true},
+		{header: "bytes 10-99/*", first: 10, last: 99, complete: "*", ok: true},
+		{header: "bytes */100"},
+		{header: "bytes 9-0/100"},
+		{header: "bytes 0-9"},
+		{header: "items 0-9/100"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.header, func(t *testing.T) {
+			first, last, complete, ok := parseContentRange(test.header)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.first, first)
+			assert.Equal(t, test.last, last)
+			assert.Equal(t, test.complete, complete)
+		})
+	}
+}
+
+func TestOpenRangeLimitInvalid(t *testing.T) {
+	_, err := New(nil, OpenRangeLimit(0, TruncateOpenRanges))
+	assert.Error(t, err)
+
+	_, err = New(nil, OpenRangeLimit(10, OpenRangePolicy(5)))
+	assert.Error(t, err)
+}
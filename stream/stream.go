@@ -28,6 +28,12 @@ Examples of a streaming middleware:
   // or validation of the data.
   stream.New(handler)
 
+  // Stream will stop reading the upstream response as soon as the client disconnects
+  stream.New(handler, stream.AbortOnDisconnect(nil))
+
+  // Stream will serve the open-ended ranges of large media files 16MB at a time
+  stream.New(handler, stream.OpenRangeLimit(16 * 1024 * 1024, stream.TruncateOpenRanges))
+
 */
 package stream
 
@@ -55,6 +61,12 @@ type Stream struct {
 	next       http.Handler
 	errHandler utils.ErrorHandler
 
+	abort   bool
+	onAbort func(req *http.Request, delivered int64)
+
+	openRanges *openRangeLimit
+	metrics    *rangeMetrics
+
 	log *log.Logger
 }
 
@@ -67,7 +79,7 @@ func New(next http.Handler, setters ...optSetter) (*Stream, error) {
 
 		maxResponseBodyBytes: DefaultMaxBodyBytes,
 
-		log: log.StandardLogger(),
+		log: utils.InheritedLogger(),
 	}
 	for _, s := range setters {
 		if err := s(strm); err != nil {
@@ -102,5 +114,17 @@ func (s *Stream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer logEntry.Debug("vulcand/oxy/stream: completed ServeHttp on request")
 	}
 
+	if (s.openRanges != nil || s.metrics != nil) && req.Header.Get("Range") != "" {
+		s.serveRange(w, req)
+		return
+	}
+	s.serveNext(w, req)
+}
+
+func (s *Stream) serveNext(w http.ResponseWriter, req *http.Request) {
+	if s.abort {
+		s.serveAbortable(w, req)
+		return
+	}
 	s.next.ServeHTTP(w, req)
 }
@@ -0,0 +1,56 @@
+package tcpproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyV2Signature starts the PROXY protocol version 2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader returns the PROXY protocol header of the version for a connection from src to dst,
+// see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+func proxyHeader(version int, src, dst net.Addr) []byte {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	var src4, dst4 net.IP
+	if known {
+		src4, dst4 = srcTCP.IP.To4(), dstTCP.IP.To4()
+	}
+	ipv4 := src4 != nil && dst4 != nil
+
+	if version == 1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src4, dst4, srcTCP.Port, dstTCP.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcTCP.IP.To16(), dstTCP.IP.To16(), srcTCP.Port, dstTCP.Port))
+		}
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	if !known {
+		// LOCAL command, the upstream server uses the addresses of the connection
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	if ipv4 {
+		header = append(header, 0x21, 0x11)
+		addrs = append(append(addrs, src4...), dst4...)
+	} else {
+		header = append(header, 0x21, 0x21)
+		addrs = append(append(addrs, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(srcTCP.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstTCP.Port))
+	addrs = append(addrs, ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+	return append(append(header, length...), addrs...)
+}
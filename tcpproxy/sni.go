@@ -0,0 +1,68 @@
+package tcpproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errHelloPeeked = errors.New("tcpproxy: ClientHello peeked")
+
+// peekServerName reads the server name of the TLS ClientHello sent on conn,
+// the returned connection replays the bytes read before the rest of the stream.
+// The server name is empty when the client sends no SNI, or does not speak TLS.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	var hello bool
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, hello = info.ServerName, true
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	if !hello {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return "", nil, errors.New("tcpproxy: timeout reading the ClientHello")
+		}
+		if peeked.Len() == 0 {
+			return "", nil, err
+		}
+	}
+	return serverName, &peekedConn{Conn: conn, r: io.MultiReader(&peeked, conn)}, nil
+}
+
+// peekedConn replays the peeked bytes
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection, when supported
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readOnlyConn is a net.Conn reading r, and discarding the writes, to run the start of a TLS handshake
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
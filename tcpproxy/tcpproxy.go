@@ -0,0 +1,521 @@
+/*
+Package tcpproxy implements a TCP proxy forwarding the connections to upstream servers, to front non-HTTP services.
+
+The proxy dials an upstream server for each accepted connection and copies the bytes both ways until both sides are
+done. TLS connections are either passed through, routed on the server name (SNI) of their ClientHello, or
+terminated by the proxy before being routed on the negotiated server name. The upstream servers can be sent the
+PROXY protocol header, to let them know of the client addresses.
+
+Examples of a TCP proxy:
+
+	// all the connections go to the database
+	p, err := tcpproxy.New(tcpproxy.Upstream("10.0.0.1:5432"), tcpproxy.MaxConnections(1000))
+	err = p.ListenAndServe(":5432")
+
+	// TLS passthrough, routed on the server name
+	p, err := tcpproxy.New(
+		tcpproxy.Route("api.example.com", "10.0.0.2:443"),
+		tcpproxy.Route("*.example.com", "10.0.0.3:443"),
+		tcpproxy.SendProxyProtocol(2))
+*/
+package tcpproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	// DefaultDialTimeout is the timeout of the connections to the upstream servers
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultHandshakeTimeout is the time the clients have to send their TLS ClientHello
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrTooManyConnections is reported when a connection is refused because of MaxConnections
+	ErrTooManyConnections = errors.New("tcpproxy: too many connections")
+	// ErrNoRoute is reported when no upstream server is configured for the server name of a connection
+	ErrNoRoute = errors.New("tcpproxy: no route")
+	// ErrProxyClosed is returned by Serve after the proxy is closed
+	ErrProxyClosed = errors.New("tcpproxy: proxy closed")
+)
+
+// Stats are the statistics of a proxied connection, reported when the connection is closed
+type Stats struct {
+	// Client is the address of the client
+	Client net.Addr
+	// ServerName is the server name requested by the client, when the connection is TLS
+	ServerName string
+	// Upstream is the address of the upstream server
+	Upstream string
+	// Received is the number of bytes received from the client
+	Received int64
+	// Sent is the number of bytes sent to the client
+	Sent int64
+	// Duration is the lifetime of the connection
+	Duration time.Duration
+	// Err is the error ending the connection, if any
+	Err error
+}
+
+type route struct {
+	serverName string
+	upstream   string
+}
+
+// Proxy forwards the TCP connections to upstream servers
+type Proxy struct {
+	upstream          string
+	routes            []route
+	tlsConfig         *tls.Config
+	proxyProtocol     int
+	maxConnections    int64
+	idleTimeout       time.Duration
+	dialTimeout       time.Duration
+	handshakeTimeout  time.Duration
+	dial              func(network, address string) (net.Conn, error)
+	errHandler        func(conn net.Conn, err error)
+	connectionClosedH func(stats Stats)
+
+	connections int64
+
+	mutex     sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Proxy
+type Option func(p *Proxy) error
+
+// New creates a new Proxy
+func New(opts ...Option) (*Proxy, error) {
+	p := &Proxy{
+		dialTimeout:      DefaultDialTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		listeners:        make(map[net.Listener]struct{}),
+		conns:            make(map[net.Conn]struct{}),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(p); err != nil {
+			return nil, err
+		}
+	}
+	if p.upstream == "" && len(p.routes) == 0 {
+		return nil, errors.New("no upstream server, use Upstream or Route")
+	}
+	if p.dial == nil {
+		p.dial = (&net.Dialer{Timeout: p.dialTimeout}).Dial
+	}
+	return p, nil
+}
+
+// Upstream sets the upstream server of the connections matching no route
+func Upstream(address string) Option {
+	return func(p *Proxy) error {
+		if address == "" {
+			return errors.New("upstream address can not be empty")
+		}
+		p.upstream = address
+		return nil
+	}
+}
+
+// Route forwards the TLS connections for the server name to the upstream server.
+// A leading "*." matches any server name of the domain, the routes are evaluated in the order they are added.
+// Without TLSTermination, the connections are routed on the ClientHello and passed through encrypted.
+func Route(serverName, address string) Option {
+	return func(p *Proxy) error {
+		if serverName == "" || address == "" {
+			return errors.New("route server name and upstream address can not be empty")
+		}
+		p.routes = append(p.routes, route{serverName: strings.ToLower(serverName), upstream: address})
+		return nil
+	}
+}
+
+// TLSTermination terminates the TLS connections with the config, the decrypted bytes are forwarded upstream
+func TLSTermination(config *tls.Config) Option {
+	return func(p *Proxy) error {
+		if config == nil {
+			return errors.New("TLS config can not be nil")
+		}
+		p.tlsConfig = config
+		return nil
+	}
+}
+
+// SendProxyProtocol sends the PROXY protocol header of the version, 1 or 2, to the upstream servers
+func SendProxyProtocol(version int) Option {
+	return func(p *Proxy) error {
+		if version != 1 && version != 2 {
+			return fmt.Errorf("unsupported PROXY protocol version %d", version)
+		}
+		p.proxyProtocol = version
+		return nil
+	}
+}
+
+// MaxConnections limits the number of concurrent connections, the exceeding connections are closed
+func MaxConnections(max int64) Option {
+	return func(p *Proxy) error {
+		if max <= 0 {
+			return fmt.Errorf("max connections should be > 0, got %d", max)
+		}
+		p.maxConnections = max
+		return nil
+	}
+}
+
+// IdleTimeout closes the connections on which no byte is transferred, either way, for d
+func IdleTimeout(d time.Duration) Option {
+	return func(p *Proxy) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout should be > 0, got %v", d)
+		}
+		p.idleTimeout = d
+		return nil
+	}
+}
+
+// DialTimeout sets the timeout of the connections to the upstream servers, it defaults to DefaultDialTimeout
+func DialTimeout(d time.Duration) Option {
+	return func(p *Proxy) error {
+		if d <= 0 {
+			return fmt.Errorf("dial timeout should be > 0, got %v", d)
+		}
+		p.dialTimeout = d
+		return nil
+	}
+}
+
+// HandshakeTimeout sets the time the clients have to send their ClientHello, or to complete the TLS handshake when
+// it is terminated. It defaults to DefaultHandshakeTimeout.
+func HandshakeTimeout(d time.Duration) Option {
+	return func(p *Proxy) error {
+		if d <= 0 {
+			return fmt.Errorf("handshake timeout should be > 0, got %v", d)
+		}
+		p.handshakeTimeout = d
+		return nil
+	}
+}
+
+// Dial sets the function connecting to the upstream servers, DialTimeout is ignored when it is set
+func Dial(dial func(network, address string) (net.Conn, error)) Option {
+	return func(p *Proxy) error {
+		if dial == nil {
+			return errors.New("dial function can not be nil")
+		}
+		p.dial = dial
+		return nil
+	}
+}
+
+// ErrorHandler sets the function called when a connection can not be proxied, before it is closed
+func ErrorHandler(h func(conn net.Conn, err error)) Option {
+	return func(p *Proxy) error {
+		p.errHandler = h
+		return nil
+	}
+}
+
+// ConnectionClosedHook sets the function called with the statistics of each proxied connection once closed
+func ConnectionClosedHook(hook func(stats Stats)) Option {
+	return func(p *Proxy) error {
+		p.connectionClosedH = hook
+		return nil
+	}
+}
+
+// Logger defines the logger the proxy will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(p *Proxy) error {
+		p.log = l
+		return nil
+	}
+}
+
+// ListenAndServe listens on the TCP address and proxies the accepted connections
+func (p *Proxy) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return p.Serve(l)
+}
+
+// Serve proxies the connections accepted on l until it fails or the proxy is closed, it closes l
+func (p *Proxy) Serve(l net.Listener) error {
+	if !p.trackListener(l, true) {
+		l.Close()
+		return ErrProxyClosed
+	}
+	defer func() {
+		p.trackListener(l, false)
+		l.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// backs off like net/http.Server
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				p.log.Warnf("vulcand/oxy/tcpproxy: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go p.ServeConn(conn)
+	}
+}
+
+// Close stops the listeners and closes the proxied connections
+func (p *Proxy) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	for c := range p.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
+
+func (p *Proxy) trackListener(l net.Listener, add bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !add {
+		delete(p.listeners, l)
+		return true
+	}
+	if p.closed {
+		return false
+	}
+	p.listeners[l] = struct{}{}
+	return true
+}
+
+func (p *Proxy) trackConn(c net.Conn, add bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !add {
+		delete(p.conns, c)
+		return true
+	}
+	if p.closed {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+// ServeConn proxies the client connection to its upstream server, it closes conn
+func (p *Proxy) ServeConn(conn net.Conn) {
+	start := time.Now()
+	if p.maxConnections > 0 {
+		defer atomic.AddInt64(&p.connections, -1)
+		if atomic.AddInt64(&p.connections, 1) > p.maxConnections {
+			p.fail(conn, ErrTooManyConnections)
+			return
+		}
+	}
+	if !p.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer p.trackConn(conn, false)
+
+	client, serverName, err := p.accept(conn)
+	if err != nil {
+		p.fail(conn, err)
+		return
+	}
+	address, err := p.route(serverName)
+	if err != nil {
+		p.fail(conn, err)
+		return
+	}
+
+	upstream, err := p.dial("tcp", address)
+	if err != nil {
+		p.fail(conn, fmt.Errorf("tcpproxy: failed to dial %v: %v", address, err))
+		return
+	}
+	if !p.trackConn(upstream, true) {
+		upstream.Close()
+		conn.Close()
+		return
+	}
+	defer p.trackConn(upstream, false)
+
+	if p.proxyProtocol != 0 {
+		if _, err := upstream.Write(proxyHeader(p.proxyProtocol, conn.RemoteAddr(), conn.LocalAddr())); err != nil {
+			upstream.Close()
+			p.fail(conn, fmt.Errorf("tcpproxy: failed to send the PROXY header to %v: %v", address, err))
+			return
+		}
+	}
+
+	received, sent, err := p.splice(client, upstream)
+	p.log.Debugf("vulcand/oxy/tcpproxy: closed %v -> %v, received %d, sent %d, err: %v", conn.RemoteAddr(), address, received, sent, err)
+	if p.connectionClosedH != nil {
+		p.connectionClosedH(Stats{
+			Client:     conn.RemoteAddr(),
+			ServerName: serverName,
+			Upstream:   address,
+			Received:   received,
+			Sent:       sent,
+			Duration:   time.Since(start),
+			Err:        err,
+		})
+	}
+}
+
+// accept terminates or peeks the TLS handshake of the connection when the server name is needed
+func (p *Proxy) accept(conn net.Conn) (net.Conn, string, error) {
+	if p.tlsConfig == nil && len(p.routes) == 0 {
+		return conn, "", nil
+	}
+	conn.SetReadDeadline(time.Now().Add(p.handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if p.tlsConfig != nil {
+		tlsConn := tls.Server(conn, p.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, "", fmt.Errorf("tcpproxy: TLS handshake failed: %v", err)
+		}
+		return tlsConn, tlsConn.ConnectionState().ServerName, nil
+	}
+	serverName, peeked, err := peekServerName(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	return peeked, serverName, nil
+}
+
+func (p *Proxy) route(serverName string) (string, error) {
+	serverName = strings.ToLower(serverName)
+	for _, r := range p.routes {
+		if r.serverName == serverName ||
+			strings.HasPrefix(r.serverName, "*.") && strings.HasSuffix(serverName, r.serverName[1:]) {
+			return r.upstream, nil
+		}
+	}
+	if p.upstream != "" {
+		return p.upstream, nil
+	}
+	return "", ErrNoRoute
+}
+
+func (p *Proxy) fail(conn net.Conn, err error) {
+	p.log.Debugf("vulcand/oxy/tcpproxy: closing %v: %v", conn.RemoteAddr(), err)
+	if p.errHandler != nil {
+		p.errHandler(conn, err)
+	}
+	conn.Close()
+}
+
+// splice copies the bytes both ways until both directions are done, and closes the connections
+func (p *Proxy) splice(client, upstream net.Conn) (received, sent int64, err error) {
+	defer client.Close()
+	defer upstream.Close()
+
+	errc := make(chan error, 2)
+	go func() {
+		var err error
+		received, err = p.copy(upstream, client)
+		errc <- err
+	}()
+	go func() {
+		var err error
+		sent, err = p.copy(client, upstream)
+		errc <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+			// a failed direction ends the connection, unblocking the other direction
+			client.Close()
+			upstream.Close()
+		}
+	}
+	return received, sent, err
+}
+
+// copy copies src to dst and half-closes dst when src is done
+func (p *Proxy) copy(dst, src net.Conn) (int64, error) {
+	var r io.Reader = src
+	if p.idleTimeout > 0 {
+		r = &idleReader{conn: src, peer: dst, timeout: p.idleTimeout}
+	}
+	n, err := io.Copy(dst, r)
+	if err == nil {
+		closeWrite(dst)
+	}
+	return n, err
+}
+
+// closeWrite signals the end of the stream to the peer, the connection is closed when it can not be half-closed
+func closeWrite(conn net.Conn) {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		c.CloseWrite()
+	default:
+		conn.Close()
+	}
+}
+
+// idleReader extends the deadlines of the connections at every read, the transfers both ways keep them alive
+type idleReader struct {
+	conn    net.Conn
+	peer    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	deadline := time.Now().Add(r.timeout)
+	r.conn.SetReadDeadline(deadline)
+	n, err := r.conn.Read(b)
+	if n > 0 {
+		r.peer.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return n, err
+}
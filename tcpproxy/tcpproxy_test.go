@@ -0,0 +1,308 @@
+package tcpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// echoServer greets the clients with its name, then echoes their lines
+func echoServer(t *testing.T, name string, config *tls.Config) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, name+"\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func startProxy(t *testing.T, opts ...Option) (*Proxy, string) {
+	p, err := New(opts...)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.Serve(l)
+	return p, l.Addr().String()
+}
+
+func greeting(t *testing.T, conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSpace(line)
+}
+
+// waitFor waits for the proxy goroutines to meet the condition
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	backend := echoServer(t, "backend", nil)
+	defer backend.Close()
+
+	var mutex sync.Mutex
+	var stats []Stats
+	p, addr := startProxy(t, Upstream(backend.Addr().String()), ConnectionClosedHook(func(s Stats) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		stats = append(stats, s)
+	}))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "backend\n", line)
+
+	_, err = io.WriteString(conn, "hello\n")
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(rest), "the half-close is propagated")
+	conn.Close()
+
+	waitFor(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(stats) == 1
+	})
+	assert.Equal(t, int64(6), stats[0].Received)
+	assert.Equal(t, int64(14), stats[0].Sent)
+	assert.Equal(t, backend.Addr().String(), stats[0].Upstream)
+	assert.NoError(t, stats[0].Err)
+}
+
+func TestProxySNI(t *testing.T) {
+	ca, err := testutils.NewCA()
+	require.NoError(t, err)
+	cert, err := ca.Issue(testutils.SAN("api.example.com", "www.example.com", "other.com"))
+	require.NoError(t, err)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	api := echoServer(t, "api", config)
+	defer api.Close()
+	www := echoServer(t, "www", config)
+	defer www.Close()
+
+	testCases := []struct {
+		desc        string
+		termination bool
+	}{
+		{desc: "passthrough"},
+		{desc: "termination", termination: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			opts := []Option{
+				Route("api.example.com", api.Addr().String()),
+				Route("*.example.com", www.Addr().String()),
+			}
+			upstreamConfig := &tls.Config{ServerName: "api.example.com", RootCAs: ca.CertPool()}
+			if test.termination {
+				opts = append(opts, TLSTermination(config))
+				// the proxy terminates the TLS connections, the upstream servers get the decrypted bytes
+				opts = append(opts, Dial(func(network, address string) (net.Conn, error) {
+					return tls.Dial(network, address, upstreamConfig)
+				}))
+			}
+			var mutex sync.Mutex
+			var errs []error
+			opts = append(opts, ErrorHandler(func(conn net.Conn, err error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				errs = append(errs, err)
+			}))
+			p, addr := startProxy(t, opts...)
+			defer p.Close()
+
+			for serverName, expected := range map[string]string{"api.example.com": "api", "www.example.com": "www"} {
+				conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, RootCAs: ca.CertPool()})
+				require.NoError(t, err)
+				assert.Equal(t, expected, greeting(t, conn), serverName)
+				conn.Close()
+			}
+
+			conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "other.com", RootCAs: ca.CertPool()})
+			if err == nil {
+				_, err = conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+			assert.Error(t, err, "no route")
+			waitFor(t, func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return len(errs) == 1 && errs[0] == ErrNoRoute
+			})
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	headers := make(chan []byte, 1)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			b, _ := ioutil.ReadAll(conn)
+			headers <- b
+			conn.Close()
+		}
+	}()
+
+	p, addr := startProxy(t, Upstream(backend.Addr().String()), SendProxyProtocol(1))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	local := conn.LocalAddr().(*net.TCPAddr)
+	conn.Close()
+
+	expected := "PROXY TCP4 127.0.0.1 " + strings.Split(addr, ":")[0] + " " +
+		strconv.Itoa(local.Port) + " " + strings.Split(addr, ":")[1] + "\r\n"
+	select {
+	case header := <-headers:
+		assert.Equal(t, expected, string(header))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no header received")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", string(proxyHeader(1, src, dst)))
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", string(proxyHeader(1, src6, dst6)))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeader(1, &net.UnixAddr{}, dst)))
+
+	v2 := proxyHeader(2, src, dst)
+	assert.Equal(t, proxyV2Signature, v2[:12])
+	assert.Equal(t, []byte{0x21, 0x11, 0x00, 12, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}, v2[12:])
+	assert.Len(t, proxyHeader(2, src6, dst6), 16+36)
+	assert.Equal(t, []byte{0x20, 0x00, 0x00, 0x00}, proxyHeader(2, &net.UnixAddr{}, dst)[12:])
+}
+
+func TestProxyMaxConnections(t *testing.T) {
+	backend := echoServer(t, "backend", nil)
+	defer backend.Close()
+	errs := make(chan error, 1)
+	p, addr := startProxy(t, Upstream(backend.Addr().String()), MaxConnections(1),
+		ErrorHandler(func(conn net.Conn, err error) { errs <- err }))
+	defer p.Close()
+
+	first, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer first.Close()
+	assert.Equal(t, "backend", greeting(t, first))
+
+	second, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, ErrTooManyConnections, <-errs)
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	backend := echoServer(t, "backend", nil)
+	defer backend.Close()
+	p, addr := startProxy(t, Upstream(backend.Addr().String()), IdleTimeout(50*time.Millisecond))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	_, err = r.ReadString('\n')
+	require.NoError(t, err)
+
+	// the transfers keep the connection alive
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(conn, "ping\n")
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "ping\n", line)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = r.ReadByte()
+	assert.Equal(t, io.EOF, err, "the idle connection is closed")
+}
+
+func TestProxyClose(t *testing.T) {
+	backend := echoServer(t, "backend", nil)
+	defer backend.Close()
+	p, err := New(Upstream(backend.Addr().String()))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "backend", greeting(t, conn))
+
+	require.NoError(t, p.Close())
+	assert.Equal(t, ErrProxyClosed, <-served)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "the proxied connections are closed")
+}
+
+func TestProxyInvalidOptions(t *testing.T) {
+	_, err := New()
+	assert.Error(t, err)
+
+	for _, opt := range []Option{Upstream(""), Route("", "a:1"), TLSTermination(nil), SendProxyProtocol(3),
+		MaxConnections(0), IdleTimeout(0), DialTimeout(-1), HandshakeTimeout(0), Dial(nil)} {
+		_, err := New(Upstream("127.0.0.1:1"), opt)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Package tenant provides a multi-tenant handler, dispatching each request to the middleware chain of its tenant:
+its own rate limits, circuit breaker settings, load balancer and backends.
+
+The tenant of a request is extracted from its Host, the server name of its TLS connection (SNI) or any other source,
+e.g. a header with utils.NewExtractor("request.header.X-Tenant"). The tenant keys are case insensitive. The tenants
+are added, replaced and removed at runtime, the requests in flight complete with the chain they started with.
+The requests of an unknown tenant are passed to the next handler.
+
+Examples of a multi-tenant gateway:
+
+	tenants, err := tenant.New(http.NotFoundHandler(), tenant.Host())
+
+	// the chain of a tenant, built from oxy primitives
+	fwd, err := forward.New()
+	lb, err := roundrobin.New(fwd)
+	lb.UpsertServer(backendURL)
+	limiter, err := ratelimit.New(lb, extractor, rates)
+	err = tenants.Upsert("acme.example.com", limiter)
+
+	// later, when the tenant leaves
+	err = tenants.Remove("acme.example.com")
+*/
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Host extracts the tenant from the Host header, without its port
+func Host() utils.SourceExtractor {
+	return utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		return stripPort(req.Host), 1, nil
+	})
+}
+
+// ServerName extracts the tenant from the server name sent by the client in the TLS handshake (SNI),
+// it falls back on the Host header when the request was not received over TLS or without a server name.
+func ServerName() utils.SourceExtractor {
+	return utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		if req.TLS != nil && req.TLS.ServerName != "" {
+			return req.TLS.ServerName, 1, nil
+		}
+		return stripPort(req.Host), 1, nil
+	})
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+type contextKey struct{}
+
+// FromContext returns the tenant of the request stored in ctx
+func FromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(contextKey{}).(string)
+	return key, ok
+}
+
+// Tenants dispatches the requests to the middleware chains of their tenants
+type Tenants struct {
+	next      http.Handler
+	extractor utils.SourceExtractor
+
+	mutex  sync.RWMutex
+	chains map[string]http.Handler
+
+	errHandler utils.ErrorHandler
+	log        *log.Logger
+}
+
+// Option is a functional option setter for Tenants
+type Option func(t *Tenants) error
+
+// New creates a new multi-tenant handler, the extractor returns the tenant of the requests
+func New(next http.Handler, extractor utils.SourceExtractor, opts ...Option) (*Tenants, error) {
+	if extractor == nil {
+		return nil, errors.New("tenant extractor can not be nil")
+	}
+	t := &Tenants{
+		next:      next,
+		extractor: extractor,
+		chains:    make(map[string]http.Handler),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(t); err != nil {
+			return nil, err
+		}
+	}
+	if t.errHandler == nil {
+		t.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
+	}
+	return t, nil
+}
+
+// Tenant adds the chain of a tenant, see Upsert
+func Tenant(key string, chain http.Handler) Option {
+	return func(t *Tenants) error {
+		return t.Upsert(key, chain)
+	}
+}
+
+// ErrorHandler sets the error handler called when the tenant can not be extracted from the request
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(t *Tenants) error {
+		t.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the multi-tenant handler will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(t *Tenants) error {
+		t.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by multi-tenant handler.
+func (t *Tenants) Wrap(next http.Handler) error {
+	t.next = next
+	return nil
+}
+
+// Upsert adds the chain of a tenant, or replaces it. The requests in flight complete with the former chain.
+func (t *Tenants) Upsert(key string, chain http.Handler) error {
+	if key == "" {
+		return errors.New("tenant key can not be empty")
+	}
+	if chain == nil {
+		return fmt.Errorf("tenant %s: chain can not be nil", key)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.chains[strings.ToLower(key)] = chain
+	return nil
+}
+
+// Remove removes a tenant, its requests are passed to the next handler from now on
+func (t *Tenants) Remove(key string) error {
+	key = strings.ToLower(key)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.chains[key]; !ok {
+		return fmt.Errorf("tenant %s not found", key)
+	}
+	delete(t.chains, key)
+	return nil
+}
+
+// Get returns the chain of a tenant
+func (t *Tenants) Get(key string) (http.Handler, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	chain, ok := t.chains[strings.ToLower(key)]
+	return chain, ok
+}
+
+// Keys returns the sorted keys of the tenants
+func (t *Tenants) Keys() []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	keys := make([]string, 0, len(t.chains))
+	for key := range t.chains {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (t *Tenants) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if t.log.Level >= log.DebugLevel {
+		logEntry := t.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/tenant: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/tenant: completed ServeHttp on request")
+	}
+
+	key, _, err := t.extractor.Extract(req)
+	if err != nil {
+		t.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	key = strings.ToLower(key)
+	chain, ok := t.Get(key)
+	if !ok {
+		t.log.Debugf("vulcand/oxy/tenant: unknown tenant %q", key)
+		t.next.ServeHTTP(w, req)
+		return
+	}
+	chain.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, key)))
+}
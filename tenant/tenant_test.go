@@ -0,0 +1,125 @@
+package tenant
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/utils"
+)
+
+func chain(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, _ := FromContext(req.Context())
+		w.Write([]byte(name + ":" + key))
+	})
+}
+
+func serve(h http.Handler, req *http.Request) string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Body.String()
+}
+
+func TestTenantsHost(t *testing.T) {
+	tenants, err := New(http.NotFoundHandler(), Host(),
+		Tenant("acme.example.com", chain("acme")),
+		Tenant("Globex.example.com", chain("globex")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acme.example.com", "globex.example.com"}, tenants.Keys())
+
+	assert.Equal(t, "acme:acme.example.com", serve(tenants, httptest.NewRequest(http.MethodGet, "http://acme.example.com:8080/", nil)))
+	assert.Equal(t, "globex:globex.example.com", serve(tenants, httptest.NewRequest(http.MethodGet, "http://GLOBEX.example.com/", nil)))
+	assert.Equal(t, "404 page not found\n", serve(tenants, httptest.NewRequest(http.MethodGet, "http://initech.example.com/", nil)))
+}
+
+func TestTenantsRuntime(t *testing.T) {
+	tenants, err := New(http.NotFoundHandler(), Host())
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "http://acme.example.com/", nil)
+
+	assert.Equal(t, "404 page not found\n", serve(tenants, req))
+
+	require.NoError(t, tenants.Upsert("acme.example.com", chain("v1")))
+	assert.Equal(t, "v1:acme.example.com", serve(tenants, req))
+
+	require.NoError(t, tenants.Upsert("acme.example.com", chain("v2")))
+	assert.Equal(t, "v2:acme.example.com", serve(tenants, req))
+
+	_, ok := tenants.Get("ACME.example.com")
+	assert.True(t, ok)
+
+	require.NoError(t, tenants.Remove("acme.example.com"))
+	assert.Equal(t, "404 page not found\n", serve(tenants, req))
+	assert.Error(t, tenants.Remove("acme.example.com"))
+
+	assert.Error(t, tenants.Upsert("", chain("a")))
+	assert.Error(t, tenants.Upsert("a", nil))
+}
+
+func TestTenantsServerName(t *testing.T) {
+	tenants, err := New(http.NotFoundHandler(), ServerName(), Tenant("acme.example.com", chain("acme")))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "https://10.0.0.1/", nil)
+	req.TLS = &tls.ConnectionState{ServerName: "acme.example.com"}
+	assert.Equal(t, "acme:acme.example.com", serve(tenants, req))
+
+	// without SNI, the Host header is used
+	req = httptest.NewRequest(http.MethodGet, "http://acme.example.com/", nil)
+	assert.Equal(t, "acme:acme.example.com", serve(tenants, req))
+}
+
+func TestTenantsHeader(t *testing.T) {
+	extractor, err := utils.NewExtractor("request.header.X-Tenant")
+	require.NoError(t, err)
+	tenants, err := New(http.NotFoundHandler(), extractor, Tenant("acme", chain("acme")))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	assert.Equal(t, "acme:acme", serve(tenants, req))
+}
+
+func TestTenantsExtractorError(t *testing.T) {
+	tenants, err := New(http.NotFoundHandler(), utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		return "", 0, errors.New("no tenant")
+	}), ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusBadRequest)
+	})))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	tenants.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	_, err = New(http.NotFoundHandler(), nil)
+	assert.Error(t, err)
+}
+
+func TestTenantsConcurrentUpdates(t *testing.T) {
+	tenants, err := New(http.NotFoundHandler(), Host())
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			tenants.Upsert("acme.example.com", chain("acme"))
+			tenants.Remove("acme.example.com")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			serve(tenants, httptest.NewRequest(http.MethodGet, "http://acme.example.com/", nil))
+		}
+	}()
+	wg.Wait()
+}
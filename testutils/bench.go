@@ -0,0 +1,55 @@
+package testutils
+
+import (
+	"net/http"
+)
+
+// DiscardWriter is a response writer discarding the responses, reused across the iterations of a benchmark
+// so that the allocations of the handlers are measured alone
+type DiscardWriter struct {
+	header http.Header
+	Code   int
+}
+
+// NewDiscardWriter creates a new DiscardWriter
+func NewDiscardWriter() *DiscardWriter {
+	return &DiscardWriter{header: make(http.Header)}
+}
+
+// Header returns the response headers
+func (d *DiscardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *DiscardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// WriteHeader records the status code
+func (d *DiscardWriter) WriteHeader(code int) {
+	d.Code = code
+}
+
+// Reset clears the response, keeping the header map
+func (d *DiscardWriter) Reset() {
+	for k := range d.header {
+		delete(d.header, k)
+	}
+	d.Code = 0
+}
+
+// StaticTransport is a round tripper replying 200 without a network round trip
+type StaticTransport struct{}
+
+// RoundTrip returns an empty 200 response
+func (StaticTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,243 @@
+package testutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// CertOpts describes a certificate to generate
+type CertOpts struct {
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+	// DNSNames and IPAddresses are the subject alternative names of the certificate
+	DNSNames    []string
+	IPAddresses []net.IP
+	// NotBefore and NotAfter default to a validity period of one day starting one hour ago
+	NotBefore time.Time
+	NotAfter  time.Time
+	// ExtKeyUsage defaults to server and client authentication
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+// CertOption certificate option type
+type CertOption func(o *CertOpts) error
+
+// CommonName sets the subject common name of the certificate
+func CommonName(cn string) CertOption {
+	return func(o *CertOpts) error {
+		o.CommonName = cn
+		return nil
+	}
+}
+
+// Organization sets the subject organization of the certificate
+func Organization(org ...string) CertOption {
+	return func(o *CertOpts) error {
+		o.Organization = org
+		return nil
+	}
+}
+
+// OrganizationalUnit sets the subject organizational units of the certificate
+func OrganizationalUnit(ou ...string) CertOption {
+	return func(o *CertOpts) error {
+		o.OrganizationalUnit = ou
+		return nil
+	}
+}
+
+// SAN adds subject alternative names to the certificate, IP addresses are detected and added as IP SANs
+func SAN(names ...string) CertOption {
+	return func(o *CertOpts) error {
+		for _, name := range names {
+			if ip := net.ParseIP(name); ip != nil {
+				o.IPAddresses = append(o.IPAddresses, ip)
+			} else {
+				o.DNSNames = append(o.DNSNames, name)
+			}
+		}
+		return nil
+	}
+}
+
+// Validity sets the validity period of the certificate, use a period in the past to get an expired certificate
+func Validity(notBefore, notAfter time.Time) CertOption {
+	return func(o *CertOpts) error {
+		o.NotBefore = notBefore
+		o.NotAfter = notAfter
+		return nil
+	}
+}
+
+// ExtKeyUsage sets the extended key usages of the certificate
+func ExtKeyUsage(usages ...x509.ExtKeyUsage) CertOption {
+	return func(o *CertOpts) error {
+		o.ExtKeyUsage = usages
+		return nil
+	}
+}
+
+// CA is a certificate authority generated at runtime, used to issue server and client certificates in tests
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// NewCA generates a self-signed certificate authority
+func NewCA(opts ...CertOption) (*CA, error) {
+	o := &CertOpts{CommonName: "oxy test CA"}
+	template, err := newTemplate(o, opts)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Certificate: cert, Key: key}, nil
+}
+
+// Issue generates a certificate signed by the CA, by default it is valid for localhost and the loopback addresses
+func (ca *CA) Issue(opts ...CertOption) (tls.Certificate, error) {
+	o := &CertOpts{CommonName: "localhost"}
+	template, err := newTemplate(o, opts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if len(template.DNSNames) == 0 && len(template.IPAddresses) == 0 {
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, key.Public(), ca.Key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// CertPool returns a pool containing the CA certificate, to be used as RootCAs or ClientCAs
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// CertPEM returns the PEM encoded CA certificate
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+// ClientTLSConfig returns a client configuration trusting the CA and presenting the given certificates
+func (ca *CA) ClientTLSConfig(certs ...tls.Certificate) *tls.Config {
+	return &tls.Config{
+		RootCAs:      ca.CertPool(),
+		Certificates: certs,
+	}
+}
+
+// NewTLSServer starts a TLS server using a certificate issued by the CA.
+// When clientAuth is not tls.NoClientCert, client certificates are verified against the CA.
+func (ca *CA) NewTLSServer(handler http.Handler, clientAuth tls.ClientAuthType, opts ...CertOption) (*httptest.Server, error) {
+	cert, err := ca.Issue(opts...)
+	if err != nil {
+		return nil, err
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		ClientCAs:    ca.CertPool(),
+	}
+	srv.StartTLS()
+	return srv, nil
+}
+
+// CertKeyPEM returns the PEM encoded certificate chain and private key of a certificate issued by a CA
+func CertKeyPEM(cert tls.Certificate) ([]byte, []byte, error) {
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return certPEM, nil, nil
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func newTemplate(o *CertOpts, opts []CertOption) (*x509.Certificate, error) {
+	for _, s := range opts {
+		if err := s(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.NotBefore.IsZero() {
+		o.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if o.NotAfter.IsZero() {
+		o.NotAfter = o.NotBefore.Add(25 * time.Hour)
+	}
+	if o.ExtKeyUsage == nil {
+		o.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         o.CommonName,
+			Organization:       o.Organization,
+			OrganizationalUnit: o.OrganizationalUnit,
+		},
+		DNSNames:    o.DNSNames,
+		IPAddresses: o.IPAddresses,
+		NotBefore:   o.NotBefore,
+		NotAfter:    o.NotAfter,
+		ExtKeyUsage: o.ExtKeyUsage,
+	}, nil
+}
@@ -0,0 +1,267 @@
+/*
+Package chain assembles the oxy middlewares in a proxy with test defaults, for integration tests of their interactions.
+
+The default chain is trace -> ratelimit -> cbreaker -> buffer -> forward -> backend,
+every hop is served by its own test server so requests can enter the chain at any hop:
+
+	backend := testutils.NewRecorder()
+	defer backend.Close()
+
+	c, err := chain.New(backend.URL, chain.Skip(chain.HopRateLimit))
+	if err != nil {
+	  return err
+	}
+	defer c.Close()
+
+	// goes through the whole chain
+	testutils.Get(c.URL())
+	// goes through buffer and forward only
+	testutils.Get(c.Hop(chain.HopBuffer).Server.URL)
+*/
+package chain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/buffer"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/trace"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Names of the hops of the chain, from the front to the back
+const (
+	HopTrace          = "trace"
+	HopRateLimit      = "ratelimit"
+	HopCircuitBreaker = "cbreaker"
+	HopBuffer         = "buffer"
+	HopForward        = "forward"
+)
+
+var hopOrder = []string{HopTrace, HopRateLimit, HopCircuitBreaker, HopBuffer, HopForward}
+
+// Middleware builds the handler of a hop around the next one
+type Middleware func(next http.Handler) (http.Handler, error)
+
+// Hop is a running hop of the chain
+type Hop struct {
+	Name string
+	// Handler is the middleware of the hop, e.g. a *cbreaker.CircuitBreaker
+	Handler http.Handler
+	// Server serves the chain starting at this hop
+	Server *httptest.Server
+}
+
+// Chain is a running chain of middlewares
+type Chain struct {
+	// Hops are ordered from the front to the back of the chain
+	Hops []*Hop
+
+	traceOutput *syncBuffer
+}
+
+type config struct {
+	middlewares map[string]Middleware
+	skip        map[string]bool
+	forwarder   *forward.Forwarder
+	clock       utils.Clock
+}
+
+// Option configures the chain
+type Option func(c *config) error
+
+// Skip removes hops from the chain, the forward hop cannot be skipped
+func Skip(hops ...string) Option {
+	return func(c *config) error {
+		for _, hop := range hops {
+			if hop == HopForward {
+				return fmt.Errorf("the %s hop cannot be skipped", HopForward)
+			}
+			if !isHop(hop) {
+				return fmt.Errorf("unknown hop %q", hop)
+			}
+			c.skip[hop] = true
+		}
+		return nil
+	}
+}
+
+// Replace replaces the default middleware of a hop
+func Replace(hop string, m Middleware) Option {
+	return func(c *config) error {
+		if hop == HopForward {
+			return fmt.Errorf("use the Forwarder option to replace the %s hop", HopForward)
+		}
+		if !isHop(hop) {
+			return fmt.Errorf("unknown hop %q", hop)
+		}
+		c.middlewares[hop] = m
+		return nil
+	}
+}
+
+// Forwarder sets the forwarder used by the forward hop
+func Forwarder(f *forward.Forwarder) Option {
+	return func(c *config) error {
+		c.forwarder = f
+		return nil
+	}
+}
+
+// Clock sets the clock of the default rate limiter and circuit breaker
+func Clock(clock utils.Clock) Option {
+	return func(c *config) error {
+		c.clock = clock
+		return nil
+	}
+}
+
+// New builds and starts a chain forwarding to the backend URL
+func New(backendURL string, opts ...Option) (*Chain, error) {
+	cfg := &config{
+		middlewares: map[string]Middleware{},
+		skip:        map[string]bool{},
+		clock:       utils.DefaultClock,
+	}
+	for _, o := range opts {
+		if err := o(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Chain{traceOutput: &syncBuffer{}}
+	defaults := c.defaultMiddlewares(cfg)
+
+	fwd := cfg.forwarder
+	if fwd == nil {
+		var err error
+		if fwd, err = forward.New(); err != nil {
+			return nil, err
+		}
+	}
+	backend := testutils.ParseURI(backendURL)
+	var next http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = utils.CopyURL(backend)
+		fwd.ServeHTTP(w, req)
+	})
+	hops := []*Hop{{Name: HopForward, Handler: fwd, Server: httptest.NewServer(next)}}
+
+	for i := len(hopOrder) - 2; i >= 0; i-- {
+		name := hopOrder[i]
+		if cfg.skip[name] {
+			continue
+		}
+		m, ok := cfg.middlewares[name]
+		if !ok {
+			m = defaults[name]
+		}
+		h, err := m(next)
+		if err != nil {
+			c.Hops = hops
+			c.Close()
+			return nil, fmt.Errorf("failed to create the %s hop: %v", name, err)
+		}
+		next = h
+		hops = append([]*Hop{{Name: name, Handler: h, Server: httptest.NewServer(h)}}, hops...)
+	}
+	c.Hops = hops
+	return c, nil
+}
+
+// URL returns the URL of the front of the chain
+func (c *Chain) URL() string {
+	return c.Hops[0].Server.URL
+}
+
+// Hop returns the hop with the given name, nil if it is not part of the chain
+func (c *Chain) Hop(name string) *Hop {
+	for _, h := range c.Hops {
+		if h.Name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// TraceRecords returns the records emitted by the default trace hop so far
+func (c *Chain) TraceRecords() ([]trace.Record, error) {
+	var records []trace.Record
+	scanner := bufio.NewScanner(bytes.NewReader(c.traceOutput.Bytes()))
+	for scanner.Scan() {
+		var r trace.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// Close stops the servers of all the hops
+func (c *Chain) Close() {
+	for _, h := range c.Hops {
+		h.Server.Close()
+	}
+}
+
+func (c *Chain) defaultMiddlewares(cfg *config) map[string]Middleware {
+	return map[string]Middleware{
+		HopTrace: func(next http.Handler) (http.Handler, error) {
+			return trace.New(next, c.traceOutput)
+		},
+		HopRateLimit: func(next http.Handler) (http.Handler, error) {
+			extractor, err := utils.NewExtractor("client.ip")
+			if err != nil {
+				return nil, err
+			}
+			rates := ratelimit.NewRateSet()
+			if err := rates.Add(time.Second, 1000, 1000); err != nil {
+				return nil, err
+			}
+			return ratelimit.New(next, extractor, rates, ratelimit.Clock(cfg.clock))
+		},
+		HopCircuitBreaker: func(next http.Handler) (http.Handler, error) {
+			return cbreaker.New(next, "NetworkErrorRatio() > 0.5", cbreaker.Clock(cfg.clock))
+		},
+		HopBuffer: func(next http.Handler) (http.Handler, error) {
+			return buffer.New(next)
+		},
+	}
+}
+
+func isHop(name string) bool {
+	for _, h := range hopOrder {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, the trace hop writes to it from the server goroutines
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
@@ -0,0 +1,121 @@
+package chain
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/buffer"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestChain(t *testing.T) {
+	backend := testutils.NewRecorder()
+	defer backend.Close()
+
+	c, err := New(backend.URL)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Len(t, c.Hops, 5)
+	for i, name := range hopOrder {
+		assert.Equal(t, name, c.Hops[i].Name)
+	}
+
+	re, body, err := testutils.Get(c.URL())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	backend.AssertCount(t, 1)
+
+	// entering the chain after the trace hop does not emit a record
+	re, _, err = testutils.Get(c.Hop(HopBuffer).Server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	backend.AssertCount(t, 2)
+
+	records, err := c.TraceRecords()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, http.StatusOK, records[0].Response.Code)
+}
+
+func TestChainSkip(t *testing.T) {
+	backend := testutils.NewRecorder()
+	defer backend.Close()
+
+	c, err := New(backend.URL, Skip(HopTrace, HopCircuitBreaker))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Len(t, c.Hops, 3)
+	assert.Nil(t, c.Hop(HopTrace))
+	assert.Equal(t, HopRateLimit, c.Hops[0].Name)
+
+	_, err = New(backend.URL, Skip(HopForward))
+	assert.Error(t, err)
+
+	_, err = New(backend.URL, Skip("unknown"))
+	assert.Error(t, err)
+}
+
+func TestChainRateLimitedRequestsAreTraced(t *testing.T) {
+	backend := testutils.NewRecorder()
+	defer backend.Close()
+
+	clock := testutils.GetClock()
+	c, err := New(backend.URL, Clock(clock), Replace(HopRateLimit, func(next http.Handler) (http.Handler, error) {
+		extractor, err := utils.NewExtractor("client.ip")
+		if err != nil {
+			return nil, err
+		}
+		rates := ratelimit.NewRateSet()
+		if err := rates.Add(time.Second, 1, 1); err != nil {
+			return nil, err
+		}
+		return ratelimit.New(next, extractor, rates, ratelimit.Clock(clock))
+	}))
+	require.NoError(t, err)
+	defer c.Close()
+
+	re, _, err := testutils.Get(c.URL())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(c.URL())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	backend.AssertCount(t, 1)
+
+	clock.Advance(time.Second)
+	re, _, err = testutils.Get(c.URL())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	records, err := c.TraceRecords()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, http.StatusTooManyRequests, records[1].Response.Code)
+}
+
+func TestChainBufferRetriesFlakyBackend(t *testing.T) {
+	backend, err := testutils.NewChaosBackend(testutils.FailFirst(1, testutils.ResetFault()))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	c, err := New(backend.URL, Replace(HopBuffer, func(next http.Handler) (http.Handler, error) {
+		return buffer.New(next, buffer.Retry(`IsNetworkError() && Attempts() <= 2`))
+	}))
+	require.NoError(t, err)
+	defer c.Close()
+
+	re, body, err := testutils.Get(c.URL())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 2, backend.Requests())
+}
@@ -0,0 +1,265 @@
+package testutils
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Fault is a failure injected by a ChaosBackend instead of the regular response
+type Fault func(w http.ResponseWriter, req *http.Request)
+
+// StatusFault answers with the given status code
+func StatusFault(code int) Fault {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(code)
+		fmt.Fprint(w, http.StatusText(code))
+	}
+}
+
+// ResetFault resets the connection before sending anything, the client sees a network error
+func ResetFault() Fault {
+	return func(w http.ResponseWriter, req *http.Request) {
+		conn := hijack(w)
+		if conn == nil {
+			return
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			// a zero linger turns the close into a RST
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+// PartialWriteFault announces the full body length but only writes half of it before closing the connection
+func PartialWriteFault(body string) Fault {
+	return func(w http.ResponseWriter, req *http.Request) {
+		conn := hijack(w)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body[:len(body)/2])
+	}
+}
+
+// MalformedFault writes a response that is not valid HTTP and closes the connection
+func MalformedFault() Fault {
+	return func(w http.ResponseWriter, req *http.Request) {
+		conn := hijack(w)
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "HTTP/1.1 ??? broken\r\nnot a header\r\n\r\n")
+	}
+}
+
+// HangFault never answers, it returns once the client gives up
+func HangFault() Fault {
+	return func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}
+}
+
+func hijack(w http.ResponseWriter) net.Conn {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return nil
+	}
+	return conn
+}
+
+// LatencyDistribution returns the latency to add to a request
+type LatencyDistribution func() time.Duration
+
+// FixedLatency always returns the same latency
+func FixedLatency(d time.Duration) LatencyDistribution {
+	return func() time.Duration {
+		return d
+	}
+}
+
+// UniformLatency returns latencies uniformly distributed in [min, max), the seed makes the sequence reproducible
+func UniformLatency(min, max time.Duration, seed int64) LatencyDistribution {
+	mutex := &sync.Mutex{}
+	r := rand.New(rand.NewSource(seed))
+	return func() time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// NormalLatency returns normally distributed latencies, negative values are clamped to 0, the seed makes the sequence reproducible
+func NormalLatency(mean, stddev time.Duration, seed int64) LatencyDistribution {
+	mutex := &sync.Mutex{}
+	r := rand.New(rand.NewSource(seed))
+	return func() time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+		d := mean + time.Duration(r.NormFloat64()*float64(stddev))
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
+
+// ChaosOpts chaos backend options
+type ChaosOpts struct {
+	Latency LatencyDistribution
+	Body    string
+	// Script lists the fault of each request in order, a nil fault means a regular response.
+	// Requests past the end of the script get a regular response.
+	Script []Fault
+	// Rate is the probability of Fault for requests past the script
+	Rate      float64
+	RateFault Fault
+	Seed      int64
+}
+
+// ChaosOption chaos backend option type
+type ChaosOption func(o *ChaosOpts) error
+
+// Latency adds a latency drawn from the distribution to every request
+func Latency(dist LatencyDistribution) ChaosOption {
+	return func(o *ChaosOpts) error {
+		o.Latency = dist
+		return nil
+	}
+}
+
+// ResponseBody sets the body of the regular responses
+func ResponseBody(body string) ChaosOption {
+	return func(o *ChaosOpts) error {
+		o.Body = body
+		return nil
+	}
+}
+
+// FailFirst makes the first n requests fail with the fault, the following ones succeed
+func FailFirst(n int, fault Fault) ChaosOption {
+	return func(o *ChaosOpts) error {
+		if n < 0 {
+			return fmt.Errorf("n should be >= 0, got %d", n)
+		}
+		for i := 0; i < n; i++ {
+			o.Script = append(o.Script, fault)
+		}
+		return nil
+	}
+}
+
+// Script sets the fault of each request in order, nil faults are regular responses
+func Script(faults ...Fault) ChaosOption {
+	return func(o *ChaosOpts) error {
+		o.Script = append(o.Script, faults...)
+		return nil
+	}
+}
+
+// FaultRate makes a fraction of the requests fail with the fault once the script is over.
+// The seed makes the sequence of failures reproducible.
+func FaultRate(rate float64, fault Fault, seed int64) ChaosOption {
+	return func(o *ChaosOpts) error {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("rate should be in [0, 1], got %f", rate)
+		}
+		o.Rate = rate
+		o.RateFault = fault
+		o.Seed = seed
+		return nil
+	}
+}
+
+// ChaosBackend is a test server injecting latency and faults in its responses
+type ChaosBackend struct {
+	*httptest.Server
+
+	mutex    *sync.Mutex
+	opts     ChaosOpts
+	rand     *rand.Rand
+	requests int
+	faults   int
+}
+
+// NewChaosBackend creates and starts a new ChaosBackend
+func NewChaosBackend(opts ...ChaosOption) (*ChaosBackend, error) {
+	o := ChaosOpts{Body: "hello"}
+	for _, s := range opts {
+		if err := s(&o); err != nil {
+			return nil, err
+		}
+	}
+	c := &ChaosBackend{
+		mutex: &sync.Mutex{},
+		opts:  o,
+		rand:  rand.New(rand.NewSource(o.Seed)),
+	}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serveHTTP))
+	return c, nil
+}
+
+// Requests returns the number of requests received so far
+func (c *ChaosBackend) Requests() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.requests
+}
+
+// Faults returns the number of faults injected so far
+func (c *ChaosBackend) Faults() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.faults
+}
+
+func (c *ChaosBackend) nextFault() Fault {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := c.requests
+	c.requests++
+
+	var fault Fault
+	if n < len(c.opts.Script) {
+		fault = c.opts.Script[n]
+	} else if c.opts.RateFault != nil && c.rand.Float64() < c.opts.Rate {
+		fault = c.opts.RateFault
+	}
+	if fault != nil {
+		c.faults++
+	}
+	return fault
+}
+
+func (c *ChaosBackend) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	fault := c.nextFault()
+
+	if c.opts.Latency != nil {
+		select {
+		case <-time.After(c.opts.Latency()):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if fault != nil {
+		fault(w, req)
+		return
+	}
+	w.Write([]byte(c.opts.Body))
+}
@@ -0,0 +1,101 @@
+/*
+Package clocktest creates the time dependent middlewares wired to a fake clock, so that the tests of their expiration,
+recovery and backoff logic move the time forward instead of sleeping.
+
+Example of a circuit breaker test:
+
+	clock := clocktest.New()
+	cb, err := clock.CircuitBreaker(handler, "NetworkErrorRatio() > 0.5", cbreaker.FallbackDuration(10*time.Second))
+	if err != nil {
+	  return err
+	}
+
+	// ... trip the circuit breaker
+
+	// the circuit breaker is recovering 10 seconds later, without a sleep
+	clock.Advance(10*time.Second + time.Millisecond)
+*/
+package clocktest
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Clock is a fake clock creating middlewares that read the time from it
+type Clock struct {
+	*utils.FakeClock
+}
+
+// New returns a fake clock frozen at the date of testutils.GetClock
+func New() *Clock {
+	return &Clock{FakeClock: testutils.GetClock()}
+}
+
+// At returns a fake clock frozen at the given time
+func At(t time.Time) *Clock {
+	return &Clock{FakeClock: utils.NewFakeClock(t)}
+}
+
+// CircuitBreaker creates a circuit breaker, and its metrics, reading the time from the clock. The options are applied
+// after the clock one.
+func (c *Clock) CircuitBreaker(next http.Handler, expression string, options ...cbreaker.CircuitBreakerOption) (*cbreaker.CircuitBreaker, error) {
+	return cbreaker.New(next, expression, append([]cbreaker.CircuitBreakerOption{cbreaker.Clock(c)}, options...)...)
+}
+
+// TokenLimiter creates a rate limiter whose buckets refill as the clock moves forward. The options are applied after
+// the clock one.
+func (c *Clock) TokenLimiter(next http.Handler, extract utils.SourceExtractor, rates *ratelimit.RateSet, options ...ratelimit.TokenLimiterOption) (*ratelimit.TokenLimiter, error) {
+	return ratelimit.New(next, extract, rates, append([]ratelimit.TokenLimiterOption{ratelimit.Clock(c)}, options...)...)
+}
+
+// Rebalancer creates a rebalancer of the round robin load balancer whose metrics and backoff read the time from the
+// clock. The options are applied after the clock one.
+func (c *Clock) Rebalancer(lb *roundrobin.RoundRobin, options ...roundrobin.RebalancerOption) (*roundrobin.Rebalancer, error) {
+	return roundrobin.NewRebalancer(lb, append([]roundrobin.RebalancerOption{roundrobin.RebalancerClock(c)}, options...)...)
+}
+
+// RTMetrics creates round trip metrics whose windows roll as the clock moves forward
+func (c *Clock) RTMetrics() (*memmetrics.RTMetrics, error) {
+	return memmetrics.NewRTMetrics(memmetrics.RTClock(c))
+}
+
+// Tick moves the clock forward by step n times, yielding to the other goroutines between the steps so that the
+// loops waiting on After with a period shorter than n*step get every tick
+func (c *Clock) Tick(step time.Duration, n int) {
+	for i := 0; i < n; i++ {
+		c.Advance(step)
+		runtime.Gosched()
+	}
+}
+
+// AwaitWaiters waits, in real time and up to timeout, for n goroutines to wait on After, e.g. a retry backoff, so
+// that the clock is moved forward once they are waiting. It returns false on timeout.
+func (c *Clock) AwaitWaiters(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for c.Waiters() < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// AdvanceWhenWaiting waits for n goroutines to wait on After, like AwaitWaiters, then moves the clock forward by d.
+// It returns false, without moving the clock, on timeout.
+func (c *Clock) AdvanceWhenWaiting(n int, d, timeout time.Duration) bool {
+	if !c.AwaitWaiters(n, timeout) {
+		return false
+	}
+	c.Advance(d)
+	return true
+}
@@ -0,0 +1,106 @@
+package clocktest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestCircuitBreakerRecovers(t *testing.T) {
+	status := http.StatusInternalServerError
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	})
+
+	clock := New()
+	cb, err := clock.CircuitBreaker(handler, "ResponseCodeRatio(500, 600, 0, 600) > 0.5",
+		cbreaker.FallbackDuration(10*time.Second), cbreaker.RecoveryDuration(10*time.Second))
+	require.NoError(t, err)
+
+	serve := func() int {
+		rw := httptest.NewRecorder()
+		cb.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		return rw.Code
+	}
+
+	for i := 0; i < 10; i++ {
+		serve()
+	}
+	clock.Advance(time.Second)
+	serve()
+	require.True(t, cb.Tripped())
+
+	status = http.StatusOK
+	clock.Advance(9 * time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, serve())
+
+	clock.Advance(time.Second + time.Millisecond)
+	serve()
+	assert.Equal(t, "recovering", cb.State())
+
+	clock.Advance(10*time.Second + time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, "standby", cb.State())
+}
+
+func TestTokenLimiterRefills(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := ratelimit.NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	extract, err := utils.NewExtractor("client.ip")
+	require.NoError(t, err)
+
+	clock := New()
+	l, err := clock.TokenLimiter(handler, extract, rates)
+	require.NoError(t, err)
+
+	serve := func() int {
+		rw := httptest.NewRecorder()
+		l.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, http.StatusOK, serve())
+}
+
+func TestAwaitWaiters(t *testing.T) {
+	clock := New()
+	assert.False(t, clock.AwaitWaiters(1, 10*time.Millisecond))
+
+	done := make(chan struct{})
+	go func() {
+		<-clock.After(time.Minute)
+		close(done)
+	}()
+
+	require.True(t, clock.AdvanceWhenWaiting(1, time.Minute, time.Second))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the waiter was not released")
+	}
+	assert.Equal(t, 0, clock.Waiters())
+}
+
+func TestTick(t *testing.T) {
+	clock := At(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := clock.UtcNow()
+
+	clock.Tick(time.Second, 5)
+	assert.Equal(t, 5*time.Second, clock.UtcNow().Sub(start))
+}
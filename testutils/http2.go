@@ -0,0 +1,45 @@
+package testutils
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// NewHTTP2Server creates a new TLS Server speaking HTTP/2, clients not negotiating h2 fall back to HTTP/1.1
+func NewHTTP2Server(handler http.Handler) (*httptest.Server, error) {
+	srv := httptest.NewUnstartedServer(handler)
+	if err := http2.ConfigureServer(srv.Config, &http2.Server{}); err != nil {
+		return nil, err
+	}
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	return srv, nil
+}
+
+// NewH2CServer creates a new Server speaking HTTP/2 over cleartext (h2c),
+// with prior knowledge as well as through the HTTP/1.1 upgrade mechanism
+func NewH2CServer(handler http.Handler) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+// NewHTTP2Transport creates a HTTP/2 only transport, TLS certificates are not verified
+func NewHTTP2Transport() *http2.Transport {
+	return &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+}
+
+// NewH2CTransport creates a transport speaking HTTP/2 over cleartext with prior knowledge
+func NewH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+}
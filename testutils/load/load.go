@@ -0,0 +1,332 @@
+/*
+Package load generates load on a handler or a URL and reports the throughput and the latency quantiles of the
+responses, for the performance regression tests of the middleware stacks run by go test.
+
+Example of a regression test of a middleware stack:
+
+	g, err := load.Handler(stack, load.Concurrency(8), load.Duration(2*time.Second),
+	  load.Templates(load.Request(http.MethodGet, "/api", nil)))
+	if err != nil {
+	  return err
+	}
+
+	report, err := g.Run()
+	if err != nil {
+	  return err
+	}
+	if report.P99 > 5*time.Millisecond {
+	  t.Errorf("p99 regression: %v", report)
+	}
+*/
+package load
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// Template builds the i-th request of the load, from 0, a new request for every call
+type Template func(i int) (*http.Request, error)
+
+// Request returns a template of requests with the method, the target, a path and a query for a URL load, and a copy
+// of the body
+func Request(method, target string, body []byte) Template {
+	return func(i int) (*http.Request, error) {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		return http.NewRequest(method, target, r)
+	}
+}
+
+// Option is a functional option setter for Generator
+type Option func(*Generator) error
+
+// Concurrency sets the number of workers sending the requests, each one waiting for its response before sending the
+// next request, 1 by default
+func Concurrency(n int) Option {
+	return func(g *Generator) error {
+		if n <= 0 {
+			return fmt.Errorf("concurrency should be > 0, got %d", n)
+		}
+		g.concurrency = n
+		return nil
+	}
+}
+
+// Duration sets the duration of the load, 1 second by default
+func Duration(d time.Duration) Option {
+	return func(g *Generator) error {
+		if d <= 0 {
+			return fmt.Errorf("duration should be > 0, got %v", d)
+		}
+		g.duration = d
+		return nil
+	}
+}
+
+// MaxRequests stops the load once n requests are sent, before the end of the duration
+func MaxRequests(n int) Option {
+	return func(g *Generator) error {
+		if n <= 0 {
+			return fmt.Errorf("max requests should be > 0, got %d", n)
+		}
+		g.maxRequests = n
+		return nil
+	}
+}
+
+// Templates adds templates of the requests, built from the templates in turn, a GET of "/" by default
+func Templates(templates ...Template) Option {
+	return func(g *Generator) error {
+		for _, t := range templates {
+			if t == nil {
+				return fmt.Errorf("template can not be nil")
+			}
+		}
+		g.templates = append(g.templates, templates...)
+		return nil
+	}
+}
+
+// Client sets the client of a URL load, a client keeping a connection per worker by default
+func Client(c *http.Client) Option {
+	return func(g *Generator) error {
+		g.client = c
+		return nil
+	}
+}
+
+// Generator sends the requests of a load and measures their responses
+type Generator struct {
+	handler http.Handler
+	target  *url.URL
+	client  *http.Client
+
+	concurrency int
+	duration    time.Duration
+	maxRequests int
+	templates   []Template
+}
+
+// Handler returns a generator serving the requests with the handler, in process
+func Handler(h http.Handler, opts ...Option) (*Generator, error) {
+	if h == nil {
+		return nil, fmt.Errorf("handler can not be nil")
+	}
+	return newGenerator(&Generator{handler: h}, opts)
+}
+
+// URL returns a generator sending the requests to the URL, the URLs of the templates are resolved against it
+func URL(target string, opts ...Option) (*Generator, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("target %q should be an absolute URL", target)
+	}
+	return newGenerator(&Generator{target: u}, opts)
+}
+
+func newGenerator(g *Generator, opts []Option) (*Generator, error) {
+	g.concurrency = 1
+	g.duration = time.Second
+	for _, o := range opts {
+		if err := o(g); err != nil {
+			return nil, err
+		}
+	}
+	if len(g.templates) == 0 {
+		g.templates = []Template{Request(http.MethodGet, "/", nil)}
+	}
+	if g.target != nil && g.client == nil {
+		g.client = &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: g.concurrency}}
+	}
+	return g, nil
+}
+
+// Report is the result of a load
+type Report struct {
+	// Requests is the number of requests sent, Errors the number of requests without a response, e.g. a refused
+	// connection, and StatusCodes the number of responses by status code
+	Requests    int64
+	Errors      int64
+	StatusCodes map[int]int64
+	// Duration is the duration of the load and Throughput the number of responses per second
+	Duration   time.Duration
+	Throughput float64
+	// P50, P90, P99 and Max are the quantiles of the latencies of the responses, with a microsecond precision
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+
+	histogram *memmetrics.HDRHistogram
+}
+
+// LatencyAtQuantile returns the latency of the responses at the quantile, in percents, e.g. 99.9
+func (r *Report) LatencyAtQuantile(q float64) time.Duration {
+	return r.histogram.LatencyAtQuantile(q)
+}
+
+func (r *Report) String() string {
+	codes := make([]int, 0, len(r.StatusCodes))
+	for code := range r.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	counts := make([]string, len(codes))
+	for i, code := range codes {
+		counts[i] = fmt.Sprintf("%d: %d", code, r.StatusCodes[code])
+	}
+	return fmt.Sprintf("%d requests in %v, %.1f req/s, %d errors, codes {%s}, p50 %v, p90 %v, p99 %v, max %v",
+		r.Requests, r.Duration, r.Throughput, r.Errors, strings.Join(counts, ", "), r.P50, r.P90, r.P99, r.Max)
+}
+
+// latency bounds of the histograms, in microseconds
+const (
+	minLatency = 1
+	maxLatency = int64(time.Hour / time.Microsecond)
+)
+
+// Run sends the requests of the load and reports their latencies, it returns the first error of the templates
+func (g *Generator) Run() (*Report, error) {
+	var sent int64
+
+	workers := make([]*worker, g.concurrency)
+	for i := range workers {
+		h, err := memmetrics.NewHDRHistogram(minLatency, maxLatency, 2)
+		if err != nil {
+			return nil, err
+		}
+		workers[i] = &worker{generator: g, histogram: h, statusCodes: make(map[int]int64)}
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(g.duration)
+	for _, w := range workers {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				i := int(atomic.AddInt64(&sent, 1) - 1)
+				if g.maxRequests > 0 && i >= g.maxRequests {
+					return
+				}
+				if !w.send(i) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Duration: time.Since(start), StatusCodes: make(map[int]int64)}
+	h, err := memmetrics.NewHDRHistogram(minLatency, maxLatency, 2)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range workers {
+		if w.err != nil {
+			return nil, w.err
+		}
+		if err := h.Merge(w.histogram); err != nil {
+			return nil, err
+		}
+		report.Requests += w.requests
+		report.Errors += w.errors
+		for code, count := range w.statusCodes {
+			report.StatusCodes[code] += count
+		}
+	}
+	if g.target != nil && g.client.Transport != nil {
+		if t, ok := g.client.Transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+
+	report.Throughput = float64(report.Requests-report.Errors) / report.Duration.Seconds()
+	report.histogram = h
+	report.P50 = h.LatencyAtQuantile(50)
+	report.P90 = h.LatencyAtQuantile(90)
+	report.P99 = h.LatencyAtQuantile(99)
+	report.Max = h.LatencyAtQuantile(100)
+	return report, nil
+}
+
+// worker sends requests one at a time, recording their latencies
+type worker struct {
+	generator *Generator
+	histogram *memmetrics.HDRHistogram
+
+	requests    int64
+	errors      int64
+	statusCodes map[int]int64
+	err         error
+}
+
+// send sends the i-th request, it returns false if the template failed
+func (w *worker) send(i int) bool {
+	g := w.generator
+	req, err := g.templates[i%len(g.templates)](i)
+	if err != nil {
+		w.err = err
+		return false
+	}
+
+	w.requests++
+	start := time.Now()
+	code, err := w.roundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		w.errors++
+		return true
+	}
+	w.statusCodes[code]++
+	// the latencies over the bounds of the histogram are not recorded
+	w.histogram.RecordLatencies(latency, 1)
+	return true
+}
+
+func (w *worker) roundTrip(req *http.Request) (int, error) {
+	g := w.generator
+	if g.handler != nil {
+		if req.RemoteAddr == "" {
+			req.RemoteAddr = "192.0.2.1:1234"
+		}
+		if req.RequestURI == "" {
+			req.RequestURI = req.URL.RequestURI()
+		}
+		rec := httptest.NewRecorder()
+		g.handler.ServeHTTP(rec, req)
+		return rec.Code, nil
+	}
+
+	req.URL = g.target.ResolveReference(req.URL)
+	req.Host = ""
+	re, err := g.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer re.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, re.Body); err != nil {
+		return 0, err
+	}
+	return re.StatusCode, nil
+}
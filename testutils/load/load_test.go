@@ -0,0 +1,106 @@
+package load
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond)
+		if req.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	g, err := Handler(handler, Concurrency(4), Duration(10*time.Second), MaxRequests(100),
+		Templates(Request(http.MethodGet, "/", nil), Request(http.MethodGet, "/missing", nil)))
+	require.NoError(t, err)
+
+	report, err := g.Run()
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, report.Requests)
+	assert.EqualValues(t, 0, report.Errors)
+	assert.Equal(t, map[int]int64{http.StatusOK: 50, http.StatusNotFound: 50}, report.StatusCodes)
+	assert.True(t, report.Duration < 10*time.Second, report.String())
+	assert.True(t, report.Throughput > 0, report.String())
+	assert.True(t, report.P50 >= time.Millisecond, report.String())
+	assert.True(t, report.P50 <= report.P99 && report.P99 <= report.Max, report.String())
+	assert.Equal(t, report.P99, report.LatencyAtQuantile(99))
+}
+
+func TestURL(t *testing.T) {
+	var mutex sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf := make([]byte, 16)
+		n, _ := req.Body.Read(buf)
+		mutex.Lock()
+		bodies = append(bodies, req.Method+" "+req.URL.RequestURI()+" "+string(buf[:n]))
+		mutex.Unlock()
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	g, err := URL(srv.URL, MaxRequests(2), Templates(Request(http.MethodPost, "/upload?a=1", []byte("data"))))
+	require.NoError(t, err)
+
+	report, err := g.Run()
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, report.Requests)
+	assert.Equal(t, map[int]int64{http.StatusOK: 2}, report.StatusCodes)
+	assert.Equal(t, []string{"POST /upload?a=1 data", "POST /upload?a=1 data"}, bodies)
+}
+
+func TestURLErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	g, err := URL(srv.URL, Duration(50*time.Millisecond), MaxRequests(3))
+	require.NoError(t, err)
+
+	report, err := g.Run()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, report.Requests)
+	assert.EqualValues(t, 3, report.Errors)
+	assert.Empty(t, report.StatusCodes)
+	assert.Equal(t, float64(0), report.Throughput)
+}
+
+func TestTemplateError(t *testing.T) {
+	errTemplate := errors.New("template error")
+	g, err := Handler(http.NotFoundHandler(), Templates(func(i int) (*http.Request, error) {
+		return nil, errTemplate
+	}))
+	require.NoError(t, err)
+
+	_, err = g.Run()
+	assert.Equal(t, errTemplate, err)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := Handler(nil)
+	assert.Error(t, err)
+
+	_, err = URL("/relative")
+	assert.Error(t, err)
+
+	_, err = Handler(http.NotFoundHandler(), Concurrency(0))
+	assert.Error(t, err)
+
+	_, err = Handler(http.NotFoundHandler(), Duration(0))
+	assert.Error(t, err)
+
+	_, err = Handler(http.NotFoundHandler(), MaxRequests(-1))
+	assert.Error(t, err)
+
+	_, err = Handler(http.NotFoundHandler(), Templates(nil))
+	assert.Error(t, err)
+}
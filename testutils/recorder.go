@@ -0,0 +1,199 @@
+package testutils
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vulcand/oxy/utils"
+)
+
+// RecordedRequest is a request as received by a Recorder
+type RecordedRequest struct {
+	Method           string
+	URL              *url.URL
+	RequestURI       string
+	Proto            string
+	Host             string
+	RemoteAddr       string
+	Header           http.Header
+	ContentLength    int64
+	TransferEncoding []string
+	Body             []byte
+	// Trailer holds the trailers sent after the body
+	Trailer http.Header
+	// TLS is nil for plain text connections
+	TLS *tls.ConnectionState
+	// BodyErr is the error that occurred while reading the body, if any
+	BodyErr error
+}
+
+// AssertHeader asserts that the request had the header with the given value
+func (r *RecordedRequest) AssertHeader(t assert.TestingT, name, expected string) bool {
+	return assert.Equal(t, expected, r.Header.Get(name), "header %s", name)
+}
+
+// AssertNoHeader asserts that none of the headers reached the server
+func (r *RecordedRequest) AssertNoHeader(t assert.TestingT, names ...string) bool {
+	ok := true
+	for _, name := range names {
+		ok = assert.Empty(t, r.Header[http.CanonicalHeaderKey(name)], "header %s", name) && ok
+	}
+	return ok
+}
+
+// AssertBody asserts the body of the request
+func (r *RecordedRequest) AssertBody(t assert.TestingT, expected string) bool {
+	return assert.Equal(t, expected, string(r.Body))
+}
+
+// AssertTrailer asserts that the request had the trailer with the given value
+func (r *RecordedRequest) AssertTrailer(t assert.TestingT, name, expected string) bool {
+	return assert.Equal(t, expected, r.Trailer.Get(name), "trailer %s", name)
+}
+
+// ScriptedResponse is a response served by a Recorder
+type ScriptedResponse struct {
+	// StatusCode defaults to 200
+	StatusCode int
+	Header     http.Header
+	Body       string
+	// Trailer is sent after the body, trailer names are announced in the header
+	Trailer http.Header
+	// Delay is waited before sending the response
+	Delay time.Duration
+}
+
+func (s ScriptedResponse) write(w http.ResponseWriter, req *http.Request) {
+	if s.Delay > 0 {
+		select {
+		case <-time.After(s.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	utils.CopyHeaders(w.Header(), s.Header)
+	for name := range s.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	code := s.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.WriteHeader(code)
+	w.Write([]byte(s.Body))
+	for name, values := range s.Trailer {
+		w.Header()[name] = values
+	}
+}
+
+// Recorder is a test server recording the requests it receives and answering with scripted responses.
+// It stands for the upstream servers of the forward tests, the middleware tests check the request passed to their
+// next handler instead.
+type Recorder struct {
+	*httptest.Server
+
+	mutex     *sync.Mutex
+	requests  []*RecordedRequest
+	responses []ScriptedResponse
+	fallback  ScriptedResponse
+}
+
+// NewRecorder creates and starts a new Recorder.
+// The responses are served in order, the last one is repeated once the script is over.
+// Without responses, the recorder answers 200 with "hello".
+func NewRecorder(responses ...ScriptedResponse) *Recorder {
+	r := newRecorder(responses)
+	r.Server = httptest.NewServer(r)
+	return r
+}
+
+// NewTLSRecorder creates and starts a new Recorder serving over TLS
+func NewTLSRecorder(responses ...ScriptedResponse) *Recorder {
+	r := newRecorder(responses)
+	r.Server = httptest.NewTLSServer(r)
+	return r
+}
+
+func newRecorder(responses []ScriptedResponse) *Recorder {
+	r := &Recorder{
+		mutex:     &sync.Mutex{},
+		responses: responses,
+		fallback:  ScriptedResponse{Body: "hello"},
+	}
+	if len(responses) > 0 {
+		r.fallback = responses[len(responses)-1]
+	}
+	return r
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	rec := &RecordedRequest{
+		Method:           req.Method,
+		URL:              utils.CopyURL(req.URL),
+		RequestURI:       req.RequestURI,
+		Proto:            req.Proto,
+		Host:             req.Host,
+		RemoteAddr:       req.RemoteAddr,
+		Header:           utils.CloneHeaders(req.Header),
+		ContentLength:    req.ContentLength,
+		TransferEncoding: req.TransferEncoding,
+		Body:             body,
+		Trailer:          utils.CloneHeaders(req.Trailer),
+		TLS:              req.TLS,
+		BodyErr:          err,
+	}
+
+	r.mutex.Lock()
+	n := len(r.requests)
+	r.requests = append(r.requests, rec)
+	response := r.fallback
+	if n < len(r.responses) {
+		response = r.responses[n]
+	}
+	r.mutex.Unlock()
+
+	response.write(w, req)
+}
+
+// Requests returns the requests recorded so far
+func (r *Recorder) Requests() []*RecordedRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*RecordedRequest(nil), r.requests...)
+}
+
+// Count returns the number of requests recorded so far
+func (r *Recorder) Count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.requests)
+}
+
+// Last returns the last recorded request, nil if there is none
+func (r *Recorder) Last() *RecordedRequest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.requests) == 0 {
+		return nil
+	}
+	return r.requests[len(r.requests)-1]
+}
+
+// Reset forgets the recorded requests and restarts the script
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests = nil
+}
+
+// AssertCount asserts the number of recorded requests
+func (r *Recorder) AssertCount(t assert.TestingT, expected int) bool {
+	return assert.Equal(t, expected, r.Count(), "recorded requests")
+}
@@ -0,0 +1,153 @@
+package testutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// SSEEvent is a server-sent event
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry is the reconnection time in milliseconds, 0 when not set
+	Retry int
+}
+
+// WriteTo writes the event in the text/event-stream format
+func (e SSEEvent) WriteTo(w io.Writer) (int64, error) {
+	var out []string
+	if e.ID != "" {
+		out = append(out, "id: "+e.ID)
+	}
+	if e.Event != "" {
+		out = append(out, "event: "+e.Event)
+	}
+	if e.Retry > 0 {
+		out = append(out, "retry: "+strconv.Itoa(e.Retry))
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		out = append(out, "data: "+line)
+	}
+	n, err := io.WriteString(w, strings.Join(out, "\n")+"\n\n")
+	return int64(n), err
+}
+
+// NewSSEServer creates a new Server emitting the events on every request, waiting for interval before each event.
+// Every event is flushed as soon as it is written, the response ends after the last event.
+func NewSSEServer(interval time.Duration, events ...SSEEvent) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for _, event := range events {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(interval):
+			}
+			if _, err := event.WriteTo(w); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}))
+}
+
+// SSEReader reads server-sent events from a text/event-stream body
+type SSEReader struct {
+	scanner *bufio.Scanner
+}
+
+// NewSSEReader creates a new SSEReader
+func NewSSEReader(r io.Reader) *SSEReader {
+	return &SSEReader{scanner: bufio.NewScanner(r)}
+}
+
+// Next returns the next event of the stream, io.EOF is returned once the stream is over
+func (r *SSEReader) Next() (*SSEEvent, error) {
+	event := &SSEEvent{}
+	var data []string
+	started := false
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if line == "" {
+			if !started {
+				continue
+			}
+			event.Data = strings.Join(data, "\n")
+			return event, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			// comment
+			continue
+		}
+		started = true
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			event.ID = value
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			retry, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retry field %q: %v", value, err)
+			}
+			event.Retry = retry
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// GetSSE opens an event stream and returns the response along with a reader of its events, the caller has to close the response body
+func GetSSE(url string, opts ...ReqOption) (*http.Response, *SSEReader, error) {
+	o := &ReqOpts{}
+	for _, s := range opts {
+		if err := s(o); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.Headers != nil {
+		utils.CopyHeaders(request.Header, o.Headers)
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if len(o.Host) != 0 {
+		request.Host = o.Host
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return response, NewSSEReader(response.Body), nil
+}
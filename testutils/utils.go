@@ -10,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -175,9 +174,7 @@ func Post(url string, opts ...ReqOption) (*http.Response, []byte, error) {
 	return MakeRequest(url, opts...)
 }
 
-// GetClock gets a FreezedTime
-func GetClock() *timetools.FreezedTime {
-	return &timetools.FreezedTime{
-		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
-	}
+// GetClock gets a FakeClock frozen at a fixed date
+func GetClock() *utils.FakeClock {
+	return utils.NewFakeClock(time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC))
 }
@@ -0,0 +1,76 @@
+package testutils
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewWebSocketEchoServer creates a new Server sending back every WebSocket message it receives.
+// The headers of the upgrade request are echoed in the handshake response with the "Echo-" prefix,
+// so tests can check what reached the backend.
+func NewWebSocketEchoServer() *httptest.Server {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		responseHeader := http.Header{}
+		for k, vv := range req.Header {
+			switch k {
+			case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol":
+				continue
+			}
+			responseHeader["Echo-"+k] = vv
+		}
+		conn, err := upgrader.Upgrade(w, req, responseHeader)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// WebSocketURL converts a http(s) server URL to its ws(s) counterpart, appending the path
+func WebSocketURL(serverURL, path string) string {
+	if strings.HasPrefix(serverURL, "https://") {
+		return "wss://" + strings.TrimPrefix(serverURL, "https://") + path
+	}
+	return "ws://" + strings.TrimPrefix(serverURL, "http://") + path
+}
+
+// DialWebSocket opens a WebSocket connection to a http(s) server URL, typically a proxy in front of a WebSocket server.
+// TLS certificates are not verified.
+func DialWebSocket(serverURL, path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: 5 * time.Second,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
+	}
+	return dialer.Dial(WebSocketURL(serverURL, path), header)
+}
+
+// WebSocketRoundTrip sends a message on the connection and returns the next message received
+func WebSocketRoundTrip(conn *websocket.Conn, messageType int, data []byte, timeout time.Duration) (int, []byte, error) {
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, nil, err
+	}
+	if err := conn.WriteMessage(messageType, data); err != nil {
+		return 0, nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, nil, err
+	}
+	return conn.ReadMessage()
+}
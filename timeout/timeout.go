@@ -0,0 +1,249 @@
+/*
+Package timeout provides a middleware bounding the time spent serving a request.
+
+The next handler is served with a context canceled at the deadline. When the deadline is reached before the response
+is started, a 504 response is written, exactly once: the writes of the next handler are discarded from then on.
+When the response is already streaming, it is aborted so that the client does not take a truncated response for
+a complete one. Hijacked connections, e.g. websockets, are owned by the next handler and are not bounded.
+
+Examples of a timeout:
+
+	// at most 30 seconds for the whole chain
+	t, err := timeout.New(chain, 30*time.Second)
+*/
+package timeout
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Timeout is a middleware replying 504 to the requests not served before the deadline
+type Timeout struct {
+	next       http.Handler
+	timeout    time.Duration
+	errHandler utils.ErrorHandler
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Timeout
+type Option func(t *Timeout) error
+
+// New creates a new Timeout middleware, serving the requests for at most the given duration
+func New(next http.Handler, timeout time.Duration, opts ...Option) (*Timeout, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("timeout should be > 0, got %v", timeout)
+	}
+	t := &Timeout{
+		next:       next,
+		timeout:    timeout,
+		errHandler: utils.ErrorHandlerFunc(gatewayTimeout),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// ErrorHandler sets the handler replying to the requests reaching the deadline, with context.DeadlineExceeded.
+// It defaults to a 504 Gateway Timeout response.
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(t *Timeout) error {
+		if h == nil {
+			return errors.New("error handler can not be nil")
+		}
+		t.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the timeout will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(t *Timeout) error {
+		t.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by timeout handler.
+func (t *Timeout) Wrap(next http.Handler) error {
+	t.next = next
+	return nil
+}
+
+func (t *Timeout) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if t.log.Level >= log.DebugLevel {
+		logEntry := t.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/timeout: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/timeout: completed ServeHttp on request")
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	tw := &timeoutWriter{w: w, header: make(http.Header)}
+	done := make(chan struct{})
+	panics := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panics <- p
+			}
+			close(done)
+		}()
+		t.next.ServeHTTP(tw, req.WithContext(ctx))
+	}()
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		t.finish(tw, panics)
+		return
+	case <-timer.C:
+	}
+
+	tw.mutex.Lock()
+	if tw.hijacked {
+		// the connection belongs to the next handler
+		tw.mutex.Unlock()
+		<-done
+		t.finish(tw, panics)
+		return
+	}
+	tw.timedOut = true
+	started := tw.started
+	if !started {
+		t.errHandler.ServeHTTP(w, req, context.DeadlineExceeded)
+	}
+	tw.mutex.Unlock()
+	cancel()
+
+	if started {
+		t.log.Debugf("vulcand/oxy/timeout: aborting the response to %v after %v", req.RemoteAddr, t.timeout)
+		panic(http.ErrAbortHandler)
+	}
+	t.log.Debugf("vulcand/oxy/timeout: %v timed out after %v", req.RemoteAddr, t.timeout)
+}
+
+// finish completes the response of a next handler returning before the deadline
+func (t *Timeout) finish(tw *timeoutWriter, panics chan interface{}) {
+	select {
+	case p := <-panics:
+		panic(p)
+	default:
+	}
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if !tw.started && !tw.hijacked {
+		tw.writeHeader(http.StatusOK)
+	}
+}
+
+func gatewayTimeout(w http.ResponseWriter, req *http.Request, err error) {
+	http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+}
+
+// timeoutWriter serializes the writes of the next handler with the timeout, and rejects them once it is reached
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mutex    sync.Mutex
+	started  bool
+	hijacked bool
+	timedOut bool
+}
+
+// Header returns the headers of the response, they are sent once the response is started and before the deadline
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut || tw.started || tw.hijacked {
+		return
+	}
+	tw.writeHeader(code)
+}
+
+func (tw *timeoutWriter) writeHeader(code int) {
+	tw.started = true
+	utils.CopyHeaders(tw.w.Header(), tw.header)
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !tw.started {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.w.Write(p)
+}
+
+// Flush sends any buffered data to the client
+func (tw *timeoutWriter) Flush() {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut || tw.hijacked {
+		return
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		if !tw.started {
+			tw.writeHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, the deadline does not apply to it anymore
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	hi, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer that was wrapped in this timeout middleware does not implement http.Hijacker(type: %T)", tw.w)
+	}
+	conn, rw, err := hi.Hijack()
+	if err == nil {
+		tw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// CloseNotify returns a channel that receives a single value when the client connection has gone away
+func (tw *timeoutWriter) CloseNotify() <-chan bool {
+	if cn, ok := tw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
@@ -0,0 +1,126 @@
+package timeout
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestTimeoutNotReached(t *testing.T) {
+	to, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Served", "true")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}), time.Second)
+	require.NoError(t, err)
+	srv := httptest.NewServer(to)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, re.StatusCode)
+	assert.Equal(t, "true", re.Header.Get("X-Served"))
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestTimeoutReached(t *testing.T) {
+	writeErr := make(chan error, 1)
+	to, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		w.Header().Set("X-Served", "true")
+		_, err := w.Write([]byte("too late"))
+		writeErr <- err
+	}), 50*time.Millisecond)
+	require.NoError(t, err)
+	srv := httptest.NewServer(to)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+	assert.Empty(t, re.Header.Get("X-Served"))
+	assert.Equal(t, http.StatusText(http.StatusGatewayTimeout)+"\n", string(body))
+	assert.Equal(t, http.ErrHandlerTimeout, <-writeErr)
+}
+
+func TestTimeoutStreaming(t *testing.T) {
+	to, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}), 50*time.Millisecond)
+	require.NoError(t, err)
+	srv := httptest.NewServer(to)
+	defer srv.Close()
+
+	re, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer re.Body.Close()
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	_, err = ioutil.ReadAll(re.Body)
+	assert.Error(t, err, "the truncated response is aborted")
+}
+
+func TestTimeoutHijacked(t *testing.T) {
+	to, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		time.Sleep(100 * time.Millisecond)
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		rw.Flush()
+	}), 10*time.Millisecond)
+	require.NoError(t, err)
+	srv := httptest.NewServer(to)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	re, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(re.Body)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hijacked", string(body))
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	to, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	}), time.Second)
+	require.NoError(t, err)
+
+	assert.PanicsWithValue(t, "boom", func() {
+		to.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestTimeoutErrorHandler(t *testing.T) {
+	to, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}), 10*time.Millisecond, ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	to.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestTimeoutInvalidOptions(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), 0)
+	assert.Error(t, err)
+	_, err = New(http.NotFoundHandler(), time.Second, ErrorHandler(nil))
+	assert.Error(t, err)
+}
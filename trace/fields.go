@@ -0,0 +1,61 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// FieldProvider returns the value of a field of the trace records pulled out of a request, e.g. from its context,
+// the value is encoded in JSON, false omits the field from the record
+type FieldProvider func(req *http.Request) (interface{}, bool)
+
+// Field appends the field of the provider to every trace record, in the fields of the record by name, e.g. the
+// tenant, the authenticated subject or the route name set in the request context. The provider is called once the
+// next handler returns, with the request received by the tracer: the values set in the context by the next handlers
+// are not visible, the middlewares setting them should be in front of the tracer.
+func Field(name string, provider FieldProvider) Option {
+	return func(t *Tracer) error {
+		if name == "" {
+			return fmt.Errorf("field name can not be empty")
+		}
+		if provider == nil {
+			return fmt.Errorf("field provider of %q can not be nil", name)
+		}
+		for _, f := range t.fields {
+			if f.name == name {
+				return fmt.Errorf("field %q is already provided", name)
+			}
+		}
+		t.fields = append(t.fields, field{name: name, provider: provider})
+		return nil
+	}
+}
+
+// ContextField appends the value of the request context for key to every trace record, see Field
+func ContextField(name string, key interface{}) Option {
+	return Field(name, func(req *http.Request) (interface{}, bool) {
+		value := req.Context().Value(key)
+		return value, value != nil
+	})
+}
+
+type field struct {
+	name     string
+	provider FieldProvider
+}
+
+// provideFields returns the fields of the record of the request, nil if none is provided
+func (t *Tracer) provideFields(req *http.Request) map[string]interface{} {
+	var fields map[string]interface{}
+	for _, f := range t.fields {
+		value, ok := f.provider(req)
+		if !ok {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]interface{}, len(t.fields))
+		}
+		fields[f.name] = value
+	}
+	return fields
+}
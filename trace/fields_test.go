@@ -0,0 +1,78 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+type contextKey string
+
+func TestTraceFields(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace,
+		ContextField("tenant", contextKey("tenant")),
+		ContextField("subject", contextKey("subject")),
+		Field("route", func(req *http.Request) (interface{}, bool) {
+			return map[string]string{"name": "hello", "path": req.URL.Path}, true
+		}),
+	)
+	require.NoError(t, err)
+
+	// sets the tenant in front of the tracer, the subject is not set
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tr.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey("tenant"), "acme")))
+	}))
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL + "/hello")
+	require.NoError(t, err)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, map[string]interface{}{
+		"tenant": "acme",
+		"route":  map[string]interface{}{"name": "hello", "path": "/hello"},
+	}, r.Fields)
+}
+
+func TestTraceNoFields(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, ContextField("tenant", contextKey("tenant")))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.NotContains(t, trace.String(), `"fields"`)
+}
+
+func TestFieldInvalid(t *testing.T) {
+	provider := func(req *http.Request) (interface{}, bool) { return nil, false }
+
+	_, err := New(nil, nil, Field("", provider))
+	assert.Error(t, err)
+
+	_, err = New(nil, nil, Field("tenant", nil))
+	assert.Error(t, err)
+
+	_, err = New(nil, nil, Field("tenant", provider), ContextField("tenant", contextKey("tenant")))
+	assert.Error(t, err)
+}
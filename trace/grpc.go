@@ -0,0 +1,100 @@
+package trace
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// GRPC contains information about a gRPC call, the HTTP code of a gRPC response is 200 whether the call failed or not
+type GRPC struct {
+	Service string `json:"service"`           // Service - full name of the service, from the request path
+	Method  string `json:"method"`            // Method - name of the method, from the request path
+	Code    int    `json:"code"`              // Code - status code of the call, from the grpc-status trailer
+	Status  string `json:"status"`            // Status - name of the status code, e.g. UNAVAILABLE
+	Message string `json:"message,omitempty"` // Message - optional error message, from the grpc-message trailer
+}
+
+// gRPC status codes, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+var grpcStatusNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+	"PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// newGRPC returns the gRPC record of the call, nil if the request is not a gRPC request
+func newGRPC(req *http.Request, code int, h http.Header) *GRPC {
+	if !isGRPC(req) {
+		return nil
+	}
+	g := &GRPC{}
+	// the path of a call is /package.Service/Method
+	if parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/"); len(parts) == 2 {
+		g.Service, g.Method = parts[0], parts[1]
+	}
+
+	status, message := grpcTrailer(h, "Grpc-Status"), grpcTrailer(h, "Grpc-Message")
+	if c, err := strconv.Atoi(status); err == nil && c >= 0 {
+		g.Code = c
+	} else {
+		g.Code = grpcCodeFromHTTP(code)
+	}
+	g.Status = grpcStatusName(g.Code)
+	if m, err := url.PathUnescape(message); err == nil {
+		g.Message = m
+	} else {
+		g.Message = message
+	}
+	return g
+}
+
+// grpcTrailer returns the value of the trailer, or of the header for the trailers-only responses
+func grpcTrailer(h http.Header, name string) string {
+	if v := h.Get(name); v != "" {
+		return v
+	}
+	// the trailers not announced by the upstream server are written with the prefix
+	return h.Get(http.TrailerPrefix + name)
+}
+
+// grpcCodeFromHTTP maps the HTTP code of a response without a grpc-status, e.g. from an intermediary, to a gRPC
+// status code as the gRPC clients do
+func grpcCodeFromHTTP(code int) int {
+	switch code {
+	case http.StatusOK:
+		// a call that succeeded has a grpc-status, the stream ended without one
+		return grpcUnknown
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+func grpcStatusName(code int) string {
+	if code >= 0 && code < len(grpcStatusNames) {
+		return grpcStatusNames[code]
+	}
+	return "CODE(" + strconv.Itoa(code) + ")"
+}
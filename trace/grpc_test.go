@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceGRPC(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		contentType string
+		handler     http.HandlerFunc
+		expected    *GRPC
+	}{
+		{
+			desc:        "trailers",
+			contentType: "application/grpc",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.Write([]byte("message"))
+				w.Header().Set("Grpc-Status", "5")
+				w.Header().Set("Grpc-Message", "user%20not%20found")
+			},
+			expected: &GRPC{Service: "users.v1.Users", Method: "Get", Code: 5, Status: "NOT_FOUND", Message: "user not found"},
+		},
+		{
+			desc:        "trailers-only response",
+			contentType: "application/grpc+proto",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Grpc-Status", "14")
+			},
+			expected: &GRPC{Service: "users.v1.Users", Method: "Get", Code: 14, Status: "UNAVAILABLE"},
+		},
+		{
+			desc:        "unannounced trailer",
+			contentType: "application/grpc",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("message"))
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+			},
+			expected: &GRPC{Service: "users.v1.Users", Method: "Get", Code: 0, Status: "OK"},
+		},
+		{
+			desc:        "http error",
+			contentType: "application/grpc",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			expected: &GRPC{Service: "users.v1.Users", Method: "Get", Code: 14, Status: "UNAVAILABLE"},
+		},
+		{
+			desc:        "not grpc",
+			contentType: "application/json",
+			handler: func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Grpc-Status", "14")
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			trace := &bytes.Buffer{}
+			tr, err := New(test.handler, trace)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/users.v1.Users/Get", nil)
+			req.Header.Set("Content-Type", test.contentType)
+			tr.ServeHTTP(httptest.NewRecorder(), req)
+
+			var r *Record
+			require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+			assert.Equal(t, test.expected, r.GRPC)
+		})
+	}
+}
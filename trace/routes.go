@@ -0,0 +1,127 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/utils"
+)
+
+// DefaultMaxRoutes is the default number of routes aggregated by RouteMetrics
+const DefaultMaxRoutes = 1000
+
+// OtherRoute is the route of the requests once the max number of routes is reached
+const OtherRoute = "other"
+
+// RouteStats are the rolling RED metrics of a route, over the last CounterWindowSize of memmetrics.RTMetrics
+type RouteStats struct {
+	// Requests is the number of requests of the window
+	Requests int64 `json:"requests"`
+	// Rate is the number of requests per second of the window
+	Rate float64 `json:"rate"`
+	// Errors is the number of 5xx responses of the window
+	Errors int64 `json:"errors"`
+	// ErrorRatio is the ratio of 5xx responses
+	ErrorRatio float64 `json:"error_ratio"`
+	// P50, P90 and P99 are the quantiles of the round trip time
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+}
+
+// RouteMetrics aggregates the rolling RED metrics, the rate, the errors and the duration of the requests, per route,
+// the key extracted from the requests, e.g. utils.NewExtractor("request.host"), see Tracer.Routes. The requests of
+// more than max routes are aggregated in OtherRoute, 0 for DefaultMaxRoutes.
+func RouteMetrics(key utils.SourceExtractor, max int) Option {
+	return func(t *Tracer) error {
+		if key == nil {
+			return fmt.Errorf("route key extractor can not be nil")
+		}
+		if max < 0 {
+			return fmt.Errorf("max routes should be >= 0, got %d", max)
+		}
+		if max == 0 {
+			max = DefaultMaxRoutes
+		}
+		t.routes = &routes{key: key, max: max, metrics: make(map[string]*memmetrics.RTMetrics)}
+		return nil
+	}
+}
+
+// routes are the metrics of the routes
+type routes struct {
+	key utils.SourceExtractor
+	max int
+
+	mutex   sync.Mutex
+	metrics map[string]*memmetrics.RTMetrics
+}
+
+func (r *routes) record(req *http.Request, code int, duration time.Duration) error {
+	route, _, err := r.key.Extract(req)
+	if err != nil {
+		route = OtherRoute
+	}
+
+	r.mutex.Lock()
+	m, ok := r.metrics[route]
+	if !ok && len(r.metrics) >= r.max {
+		route = OtherRoute
+		m, ok = r.metrics[route]
+	}
+	if !ok {
+		m, err = memmetrics.NewRTMetrics()
+		if err != nil {
+			r.mutex.Unlock()
+			return err
+		}
+		r.metrics[route] = m
+	}
+	r.mutex.Unlock()
+
+	m.Record(code, duration)
+	return nil
+}
+
+func (r *routes) stats() (map[string]RouteStats, error) {
+	r.mutex.Lock()
+	metrics := make(map[string]*memmetrics.RTMetrics, len(r.metrics))
+	for route, m := range r.metrics {
+		metrics[route] = m
+	}
+	r.mutex.Unlock()
+
+	stats := make(map[string]RouteStats, len(metrics))
+	for route, m := range metrics {
+		s := RouteStats{Requests: m.TotalCount()}
+		if window := m.CounterWindowSize(); window > 0 {
+			s.Rate = float64(s.Requests) / window.Seconds()
+		}
+		for code, count := range m.StatusCodesCounts() {
+			if code >= http.StatusInternalServerError {
+				s.Errors += count
+			}
+		}
+		if s.Requests > 0 {
+			s.ErrorRatio = float64(s.Errors) / float64(s.Requests)
+		}
+		latencies, err := m.LatencyAtQuantiles(50, 90, 99)
+		if err != nil {
+			return nil, err
+		}
+		s.P50, s.P90, s.P99 = latencies[0], latencies[1], latencies[2]
+		stats[route] = s
+	}
+	return stats, nil
+}
+
+// Routes returns the rolling metrics of the routes, nil if RouteMetrics is not set
+func (t *Tracer) Routes() (map[string]RouteStats, error) {
+	if t.routes == nil {
+		return nil, nil
+	}
+	return t.routes.stats()
+}
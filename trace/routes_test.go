@@ -0,0 +1,68 @@
+package trace
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestRouteMetrics(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	route := utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		return req.URL.Path, 1, nil
+	})
+	tr, err := New(handler, ioutil.Discard, RouteMetrics(route, 2))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	for _, path := range []string{"/hello", "/hello", "/fail", "/hello", "/other", "/another"} {
+		_, _, err := testutils.Get(srv.URL + path)
+		require.NoError(t, err)
+	}
+
+	routes, err := tr.Routes()
+	require.NoError(t, err)
+	require.Len(t, routes, 3)
+
+	hello := routes["/hello"]
+	assert.Equal(t, int64(3), hello.Requests)
+	assert.Equal(t, int64(0), hello.Errors)
+	assert.InDelta(t, 3/(10*time.Second).Seconds(), hello.Rate, 0.001)
+	assert.True(t, hello.P50 <= hello.P99)
+
+	fail := routes["/fail"]
+	assert.Equal(t, int64(1), fail.Requests)
+	assert.Equal(t, int64(1), fail.Errors)
+	assert.Equal(t, 1.0, fail.ErrorRatio)
+
+	// the routes over the max are aggregated
+	assert.Equal(t, int64(2), routes[OtherRoute].Requests)
+}
+
+func TestRouteMetricsDisabled(t *testing.T) {
+	tr, err := New(http.NotFoundHandler(), ioutil.Discard)
+	require.NoError(t, err)
+
+	routes, err := tr.Routes()
+	require.NoError(t, err)
+	assert.Nil(t, routes)
+
+	_, err = New(http.NotFoundHandler(), ioutil.Discard, RouteMetrics(nil, 0))
+	assert.Error(t, err)
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/requestid"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -41,6 +42,19 @@ func ResponseHeaders(headers ...string) Option {
 	}
 }
 
+// Identities records the identities of the requests, e.g. the client or the tenant the rate limits key on, all the
+// identities of the registry when no names are given
+func Identities(ids *utils.Identities, names ...string) Option {
+	return func(t *Tracer) error {
+		if ids == nil {
+			return fmt.Errorf("identities can not be nil")
+		}
+		t.identities = ids
+		t.identityNames = names
+		return nil
+	}
+}
+
 // Tracer records request and response emitting JSON structured data to the output
 type Tracer struct {
 	errHandler  utils.ErrorHandler
@@ -49,6 +63,13 @@ type Tracer struct {
 	respHeaders []string
 	writer      io.Writer
 
+	identities    *utils.Identities
+	identityNames []string
+
+	routes *routes
+
+	fields []field
+
 	log *log.Logger
 }
 
@@ -60,7 +81,7 @@ func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 		writer: writer,
 		next:   next,
 
-		log: log.StandardLogger(),
+		log: utils.InheritedLogger(),
 	}
 	for _, o := range opts {
 		if err := o(t); err != nil {
@@ -68,7 +89,7 @@ func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 		}
 	}
 	if t.errHandler == nil {
-		t.errHandler = utils.DefaultHandler
+		t.errHandler = utils.InheritedErrorHandler(utils.DefaultHandler)
 	}
 	return t, nil
 }
@@ -85,18 +106,26 @@ func Logger(l *log.Logger) Option {
 
 func (t *Tracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
-	pw := utils.NewProxyWriterWithLogger(w, t.log)
+	pw := utils.AcquireProxyWriter(w, t.log)
+	defer utils.ReleaseProxyWriter(pw)
 	t.next.ServeHTTP(pw, req)
 
-	l := t.newRecord(req, pw, time.Since(start))
+	diff := time.Since(start)
+	l := t.newRecord(req, pw, diff)
+	if t.routes != nil {
+		if err := t.routes.record(req, pw.StatusCode(), diff); err != nil {
+			t.log.Errorf("Failed to record route metrics: %v", err)
+		}
+	}
 	if err := json.NewEncoder(t.writer).Encode(l); err != nil {
 		t.log.Errorf("Failed to marshal request: %v", err)
 	}
 }
 
 func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, diff time.Duration) *Record {
-	return &Record{
+	r := &Record{
 		Request: Request{
+			ID:        requestID(req),
 			Method:    req.Method,
 			URL:       req.URL.String(),
 			TLS:       newTLS(req),
@@ -109,7 +138,20 @@ func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, diff time.D
 			Roundtrip: float64(diff) / float64(time.Millisecond),
 			Headers:   captureHeaders(pw.Header(), t.respHeaders),
 		},
+		GRPC:   newGRPC(req, pw.StatusCode(), pw.Header()),
+		Fields: t.provideFields(req),
 	}
+	if t.identities != nil {
+		if identities := t.identities.Extract(req, t.identityNames...); len(identities) > 0 {
+			r.Request.Identities = identities
+		}
+	}
+	return r
+}
+
+func requestID(req *http.Request) string {
+	id, _ := requestid.FromContext(req.Context())
+	return id
 }
 
 func newTLS(req *http.Request) *TLS {
@@ -145,15 +187,22 @@ func captureHeaders(in http.Header, headers []string) http.Header {
 type Record struct {
 	Request  Request  `json:"request"`
 	Response Response `json:"response"`
+	// GRPC - optional gRPC call record, will be recorded if it's a gRPC request
+	GRPC *GRPC `json:"grpc,omitempty"`
+	// Fields - optional fields by name, will be recorded if provided, see Field
+	Fields map[string]interface{} `json:"fields,omitempty"`
 }
 
 // Request contains information about an HTTP request
 type Request struct {
+	ID        string      `json:"id,omitempty"`      // ID - optional request ID, will be recorded if set by the requestid middleware
 	Method    string      `json:"method"`            // Method - request method
 	BodyBytes int64       `json:"body_bytes"`        // BodyBytes - size of request body in bytes
 	URL       string      `json:"url"`               // URL - Request URL
 	Headers   http.Header `json:"headers,omitempty"` // Headers - optional request headers, will be recorded if configured
 	TLS       *TLS        `json:"tls,omitempty"`     // TLS - optional TLS record, will be recorded if it's a TLS connection
+	// Identities - optional identities of the request by name, will be recorded if configured
+	Identities map[string]string `json:"identities,omitempty"`
 }
 
 // Response contains information about HTTP response
@@ -13,6 +13,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/requestid"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
 )
@@ -45,6 +46,53 @@ func TestTraceSimple(t *testing.T) {
 	assert.EqualValues(t, 5, r.Response.BodyBytes)
 }
 
+func TestTraceRequestID(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace)
+	require.NoError(t, err)
+
+	rid, err := requestid.New(tr, requestid.TrustHeader(true))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL, testutils.Header(requestid.DefaultHeader, "id-1"))
+	require.NoError(t, err)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, "id-1", r.Request.ID)
+}
+
+func TestTraceIdentities(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	ids := utils.NewIdentities()
+	require.NoError(t, ids.RegisterVariable("tenant", "request.header.X-Tenant"))
+	require.NoError(t, ids.Register("client", utils.NewClientIPExtractor(nil)))
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, Identities(ids))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL, testutils.Header("X-Tenant", "acme"))
+	require.NoError(t, err)
+
+	var r *Record
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+	assert.Equal(t, map[string]string{"tenant": "acme", "client": "127.0.0.1"}, r.Request.Identities)
+}
+
 func TestTraceCaptureHeaders(t *testing.T) {
 	respHeaders := http.Header{
 		"X-Re-1": []string{"6", "7"},
@@ -0,0 +1,438 @@
+/*
+Package udpproxy implements a UDP proxy forwarding the datagrams to upstream servers, for DNS, syslog or game servers.
+
+The proxy maintains NAT-like sessions: the first datagram of a client opens a session to an upstream server picked
+by the balancer, e.g. a *roundrobin.RoundRobin, the following datagrams of the client go to the same upstream
+server, and the replies of the upstream server are sent back to the client. The sessions without traffic are closed
+after the idle timeout.
+
+Examples of a UDP proxy:
+
+	// the upstream servers are balanced by a round robin, e.g. udp://10.0.0.1:53
+	lb, err := roundrobin.New(nil)
+	lb.UpsertServer(&url.URL{Scheme: "udp", Host: "10.0.0.1:53"})
+	lb.UpsertServer(&url.URL{Scheme: "udp", Host: "10.0.0.2:53"})
+
+	p, err := udpproxy.New(lb, udpproxy.IdleTimeout(10*time.Second))
+	err = p.ListenAndServe(":53")
+*/
+package udpproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+const (
+	// DefaultIdleTimeout is the time after which the sessions without traffic are closed
+	DefaultIdleTimeout = time.Minute
+	// DefaultBufferSize is the size of the buffers reading the datagrams, larger datagrams are truncated
+	DefaultBufferSize = 64 * 1024
+)
+
+var (
+	// ErrTooManySessions is reported when a datagram is dropped because of MaxSessions
+	ErrTooManySessions = errors.New("udpproxy: too many sessions")
+	// ErrProxyClosed is returned by Serve after the proxy is closed
+	ErrProxyClosed = errors.New("udpproxy: proxy closed")
+)
+
+// Balancer picks the upstream server of the new sessions, the host of the URL is the address of the server
+type Balancer interface {
+	NextServer() (*url.URL, error)
+}
+
+// SessionStats are the statistics of a session
+type SessionStats struct {
+	// Client is the address of the client
+	Client net.Addr
+	// Upstream is the address of the upstream server
+	Upstream string
+	// Started is the time the session was opened at
+	Started time.Time
+	// LastActive is the time of the last datagram, either way
+	LastActive time.Time
+	// PacketsReceived and BytesReceived count the datagrams received from the client
+	PacketsReceived, BytesReceived int64
+	// PacketsSent and BytesSent count the datagrams sent to the client
+	PacketsSent, BytesSent int64
+}
+
+// Proxy forwards the UDP datagrams to upstream servers
+type Proxy struct {
+	balancer       Balancer
+	idleTimeout    time.Duration
+	maxSessions    int
+	bufferSize     int
+	dial           func(network, address string) (net.Conn, error)
+	errHandler     func(client net.Addr, err error)
+	sessionClosedH func(stats SessionStats)
+	sessionOpenedH func(stats SessionStats)
+
+	mutex           sync.Mutex
+	closed          bool
+	sessions        map[sessionKey]*session
+	packetListeners map[net.PacketConn]struct{}
+
+	log *log.Logger
+}
+
+// Option is a functional option setter for Proxy
+type Option func(p *Proxy) error
+
+// New creates a new Proxy picking the upstream servers with balancer
+func New(balancer Balancer, opts ...Option) (*Proxy, error) {
+	if balancer == nil {
+		return nil, errors.New("balancer can not be nil")
+	}
+	p := &Proxy{
+		balancer:        balancer,
+		idleTimeout:     DefaultIdleTimeout,
+		bufferSize:      DefaultBufferSize,
+		dial:            net.Dial,
+		sessions:        make(map[sessionKey]*session),
+		packetListeners: make(map[net.PacketConn]struct{}),
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// IdleTimeout sets the time after which the sessions without traffic are closed, it defaults to DefaultIdleTimeout
+func IdleTimeout(d time.Duration) Option {
+	return func(p *Proxy) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout should be > 0, got %v", d)
+		}
+		p.idleTimeout = d
+		return nil
+	}
+}
+
+// MaxSessions limits the number of concurrent sessions, the datagrams of the new clients are dropped beyond
+func MaxSessions(max int) Option {
+	return func(p *Proxy) error {
+		if max <= 0 {
+			return fmt.Errorf("max sessions should be > 0, got %d", max)
+		}
+		p.maxSessions = max
+		return nil
+	}
+}
+
+// BufferSize sets the size of the buffers reading the datagrams, it defaults to DefaultBufferSize
+func BufferSize(size int) Option {
+	return func(p *Proxy) error {
+		if size <= 0 {
+			return fmt.Errorf("buffer size should be > 0, got %d", size)
+		}
+		p.bufferSize = size
+		return nil
+	}
+}
+
+// Dial sets the function connecting to the upstream servers, it defaults to net.Dial
+func Dial(dial func(network, address string) (net.Conn, error)) Option {
+	return func(p *Proxy) error {
+		if dial == nil {
+			return errors.New("dial function can not be nil")
+		}
+		p.dial = dial
+		return nil
+	}
+}
+
+// ErrorHandler sets the function called when a datagram of a client can not be forwarded
+func ErrorHandler(h func(client net.Addr, err error)) Option {
+	return func(p *Proxy) error {
+		p.errHandler = h
+		return nil
+	}
+}
+
+// SessionOpenedHook sets the function called when a session is opened
+func SessionOpenedHook(hook func(stats SessionStats)) Option {
+	return func(p *Proxy) error {
+		p.sessionOpenedH = hook
+		return nil
+	}
+}
+
+// SessionClosedHook sets the function called with the statistics of each session once closed
+func SessionClosedHook(hook func(stats SessionStats)) Option {
+	return func(p *Proxy) error {
+		p.sessionClosedH = hook
+		return nil
+	}
+}
+
+// Logger defines the logger the proxy will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(p *Proxy) error {
+		p.log = l
+		return nil
+	}
+}
+
+// ListenAndServe listens on the UDP address and proxies the received datagrams
+func (p *Proxy) ListenAndServe(address string) error {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	return p.Serve(pc)
+}
+
+// Serve proxies the datagrams received on pc until it fails or the proxy is closed, it closes pc
+func (p *Proxy) Serve(pc net.PacketConn) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		pc.Close()
+		return ErrProxyClosed
+	}
+	p.packetListeners[pc] = struct{}{}
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		delete(p.packetListeners, pc)
+		p.mutex.Unlock()
+		pc.Close()
+	}()
+
+	buf := make([]byte, p.bufferSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				p.log.Warnf("vulcand/oxy/udpproxy: read error: %v", err)
+				continue
+			}
+			return err
+		}
+		s, opened, err := p.session(pc, client)
+		if err != nil {
+			p.fail(client, err)
+			continue
+		}
+		if opened && p.sessionOpenedH != nil {
+			p.sessionOpenedH(s.stats())
+		}
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			p.fail(client, fmt.Errorf("udpproxy: failed to forward to %v: %v", s.address, err))
+			continue
+		}
+		s.received(n)
+	}
+}
+
+// Sessions returns the statistics of the open sessions
+func (p *Proxy) Sessions() []SessionStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats := make([]SessionStats, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		stats = append(stats, s.stats())
+	}
+	return stats
+}
+
+// Close stops the listeners and closes the sessions
+func (p *Proxy) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	for pc := range p.packetListeners {
+		pc.Close()
+	}
+	sessions := make([]*session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.upstream.Close()
+	}
+	return nil
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
+
+func (p *Proxy) fail(client net.Addr, err error) {
+	p.log.Debugf("vulcand/oxy/udpproxy: dropping datagram from %v: %v", client, err)
+	if p.errHandler != nil {
+		p.errHandler(client, err)
+	}
+}
+
+type sessionKey struct {
+	pc     net.PacketConn
+	client string
+}
+
+// session returns the session of the client, opened to the next server of the balancer when missing
+func (p *Proxy) session(pc net.PacketConn, client net.Addr) (*session, bool, error) {
+	key := sessionKey{pc: pc, client: client.String()}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if s, ok := p.sessions[key]; ok {
+		// touched under the lock, so that the session is not closed as idle before the datagram is forwarded
+		s.touch()
+		return s, false, nil
+	}
+	if p.closed {
+		return nil, false, ErrProxyClosed
+	}
+	if p.maxSessions > 0 && len(p.sessions) >= p.maxSessions {
+		return nil, false, ErrTooManySessions
+	}
+
+	u, err := p.balancer.NextServer()
+	if err != nil {
+		return nil, false, err
+	}
+	upstream, err := p.dial("udp", u.Host)
+	if err != nil {
+		return nil, false, fmt.Errorf("udpproxy: failed to dial %v: %v", u.Host, err)
+	}
+	now := time.Now()
+	s := &session{
+		pc:         pc,
+		client:     client,
+		address:    u.Host,
+		upstream:   upstream,
+		started:    now,
+		lastActive: now.UnixNano(),
+	}
+	p.sessions[key] = s
+	p.log.Debugf("vulcand/oxy/udpproxy: session opened %v -> %v", client, u.Host)
+	go p.reply(key, s)
+	return s, true, nil
+}
+
+// reply sends the datagrams of the upstream server back to the client, until the session is idle
+func (p *Proxy) reply(key sessionKey, s *session) {
+	defer func() {
+		p.mutex.Lock()
+		if p.sessions[key] == s {
+			delete(p.sessions, key)
+		}
+		p.mutex.Unlock()
+		s.upstream.Close()
+		p.log.Debugf("vulcand/oxy/udpproxy: session closed %v -> %v", s.client, s.address)
+		if p.sessionClosedH != nil {
+			p.sessionClosedH(s.stats())
+		}
+	}()
+
+	buf := make([]byte, p.bufferSize)
+	for {
+		s.upstream.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&s.lastActive)).Add(p.idleTimeout))
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if p.closeIdle(key, s) {
+					return
+				}
+				// the client sent datagrams since the deadline was set
+				continue
+			}
+			if p.isClosed() || isClosedErr(err) {
+				return
+			}
+			// e.g. ICMP port unreachable, the session is kept until it is idle
+			p.log.Debugf("vulcand/oxy/udpproxy: read error from %v: %v", s.address, err)
+			continue
+		}
+		if _, err := s.pc.WriteTo(buf[:n], s.client); err != nil {
+			p.log.Debugf("vulcand/oxy/udpproxy: failed to reply to %v: %v", s.client, err)
+			continue
+		}
+		s.sent(n)
+	}
+}
+
+// closeIdle removes the session when it is idle
+func (p *Proxy) closeIdle(key sessionKey, s *session) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive))) < p.idleTimeout {
+		return false
+	}
+	if p.sessions[key] == s {
+		delete(p.sessions, key)
+	}
+	return true
+}
+
+// isClosedErr tells whether err is the error of an operation on a closed connection
+func isClosedErr(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Err != nil && opErr.Err.Error() == "use of closed network connection"
+}
+
+type session struct {
+	// accessed atomically, first for the 64-bit alignment on 32-bit platforms
+	lastActive      int64
+	packetsReceived int64
+	bytesReceived   int64
+	packetsSent     int64
+	bytesSent       int64
+
+	pc       net.PacketConn
+	client   net.Addr
+	address  string
+	upstream net.Conn
+	started  time.Time
+}
+
+func (s *session) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *session) received(n int) {
+	s.touch()
+	atomic.AddInt64(&s.packetsReceived, 1)
+	atomic.AddInt64(&s.bytesReceived, int64(n))
+}
+
+func (s *session) sent(n int) {
+	s.touch()
+	atomic.AddInt64(&s.packetsSent, 1)
+	atomic.AddInt64(&s.bytesSent, int64(n))
+}
+
+func (s *session) stats() SessionStats {
+	return SessionStats{
+		Client:          s.client,
+		Upstream:        s.address,
+		Started:         s.started,
+		LastActive:      time.Unix(0, atomic.LoadInt64(&s.lastActive)),
+		PacketsReceived: atomic.LoadInt64(&s.packetsReceived),
+		BytesReceived:   atomic.LoadInt64(&s.bytesReceived),
+		PacketsSent:     atomic.LoadInt64(&s.packetsSent),
+		BytesSent:       atomic.LoadInt64(&s.bytesSent),
+	}
+}
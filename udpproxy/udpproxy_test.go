@@ -0,0 +1,195 @@
+package udpproxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// echoServer replies to the datagrams with its name followed by the datagram
+func echoServer(t *testing.T, name string) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte(name+":"), buf[:n]...), addr)
+		}
+	}()
+	return pc
+}
+
+func startProxy(t *testing.T, lb Balancer, opts ...Option) (*Proxy, string) {
+	p, err := New(lb, opts...)
+	require.NoError(t, err)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.Serve(pc)
+	return p, pc.LocalAddr().String()
+}
+
+func exchange(t *testing.T, conn net.Conn, msg string) string {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+// waitFor waits for the proxy goroutines to meet the condition
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newBalancer(t *testing.T, backends ...net.PacketConn) *roundrobin.RoundRobin {
+	lb, err := roundrobin.New(http.NotFoundHandler())
+	require.NoError(t, err)
+	for _, b := range backends {
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("udp://"+b.LocalAddr().String())))
+	}
+	return lb
+}
+
+func TestProxySessions(t *testing.T) {
+	a := echoServer(t, "a")
+	defer a.Close()
+	b := echoServer(t, "b")
+	defer b.Close()
+
+	var mutex sync.Mutex
+	var closed []SessionStats
+	p, addr := startProxy(t, newBalancer(t, a, b), IdleTimeout(100*time.Millisecond),
+		SessionClosedHook(func(stats SessionStats) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			closed = append(closed, stats)
+		}))
+	defer p.Close()
+
+	first, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+
+	assert.Equal(t, "a:ping", exchange(t, first, "ping"))
+	assert.Equal(t, "b:ping", exchange(t, second, "ping"))
+	assert.Equal(t, "a:hello", exchange(t, first, "hello"), "the session sticks to its upstream server")
+	assert.Len(t, p.Sessions(), 2)
+
+	waitFor(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(closed) == 2
+	})
+	assert.Empty(t, p.Sessions(), "the idle sessions are closed")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, stats := range closed {
+		if stats.Client.String() != first.LocalAddr().String() {
+			continue
+		}
+		assert.Equal(t, a.LocalAddr().String(), stats.Upstream)
+		assert.Equal(t, int64(2), stats.PacketsReceived)
+		assert.Equal(t, int64(9), stats.BytesReceived)
+		assert.Equal(t, int64(2), stats.PacketsSent)
+		assert.Equal(t, int64(13), stats.BytesSent)
+	}
+}
+
+func TestProxyKeepAlive(t *testing.T) {
+	a := echoServer(t, "a")
+	defer a.Close()
+	opened := make(chan SessionStats, 10)
+	p, addr := startProxy(t, newBalancer(t, a), IdleTimeout(100*time.Millisecond),
+		SessionOpenedHook(func(stats SessionStats) { opened <- stats }))
+	defer p.Close()
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "a:ping", exchange(t, conn, "ping"))
+		time.Sleep(40 * time.Millisecond)
+	}
+	assert.Len(t, opened, 1, "the traffic keeps the session open")
+}
+
+func TestProxyMaxSessions(t *testing.T) {
+	a := echoServer(t, "a")
+	defer a.Close()
+	errs := make(chan error, 10)
+	p, addr := startProxy(t, newBalancer(t, a), MaxSessions(1),
+		ErrorHandler(func(client net.Addr, err error) { errs <- err }))
+	defer p.Close()
+
+	first, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer first.Close()
+	assert.Equal(t, "a:ping", exchange(t, first, "ping"))
+
+	second, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+	_, err = second.Write([]byte("ping"))
+	require.NoError(t, err)
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrTooManySessions, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the datagram should be dropped")
+	}
+}
+
+func TestProxyClose(t *testing.T) {
+	a := echoServer(t, "a")
+	defer a.Close()
+	p, err := New(newBalancer(t, a))
+	require.NoError(t, err)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(pc) }()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a:ping", exchange(t, conn, "ping"))
+
+	require.NoError(t, p.Close())
+	assert.Equal(t, ErrProxyClosed, <-served)
+	waitFor(t, func() bool { return len(p.Sessions()) == 0 })
+}
+
+func TestProxyInvalidOptions(t *testing.T) {
+	_, err := New(nil)
+	assert.Error(t, err)
+
+	lb, err := roundrobin.New(http.NotFoundHandler())
+	require.NoError(t, err)
+	for _, opt := range []Option{IdleTimeout(0), MaxSessions(0), BufferSize(-1), Dial(nil)} {
+		_, err := New(lb, opt)
+		assert.Error(t, err)
+	}
+}
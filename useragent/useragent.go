@@ -0,0 +1,255 @@
+/*
+Package useragent provides a middleware classifying the requests by their User-Agent header, to block or throttle
+the crawlers and the bots.
+
+The rules are evaluated in order against the User-Agent: the first matching Allow rule passes the request to the
+next handler, the first matching Deny rule rejects it, and matching Tag rules classify the request while the
+evaluation goes on. The class of the request, the class of the matching Allow rule or else of the first matching
+Tag rule, is stored in the request context, see ClassFromContext, and can be passed to the backends in a header.
+
+The classification is a key dimension of the rate limiter with Extractor: the identified crawlers are limited
+per class, e.g. all the instances of a crawler share the same bucket, the other clients keep their own buckets.
+
+Examples of a User-Agent filter:
+
+	// Googlebot is allowed, the other bots are blocked
+	f, err := useragent.New(handler,
+		useragent.Rule("googlebot", useragent.Allow, `(?i)googlebot`),
+		useragent.Rule("bot", useragent.Deny, `(?i)bot|crawler|spider`))
+
+	// the curl clients are tagged, unless they are denied
+	f, err := useragent.New(handler,
+		useragent.Rule("curl", useragent.Tag, `^curl/`),
+		useragent.Rule("legacy", useragent.Deny, `^curl/7\.[0-2]?[0-9]\.`))
+
+	// the crawlers are throttled together, 10 requests per second per crawler
+	f, err := useragent.New(nil, useragent.Rule("crawler", useragent.Tag, `(?i)bot|crawler|spider`))
+	limiter, err := ratelimit.New(handler, f.Extractor(ipExtractor), rates)
+	f.Wrap(limiter)
+*/
+package useragent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Action is the action taken on the requests matching a rule
+type Action int
+
+const (
+	// Allow classifies the request and passes it to the next handler, the following rules are not evaluated
+	Allow Action = iota
+	// Deny rejects the request, the following rules are not evaluated
+	Deny
+	// Tag classifies the request, unless a previous Tag rule matched, and evaluates the following rules
+	Tag
+)
+
+// String returns the name of the action
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	case Tag:
+		return "tag"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+type rule struct {
+	class    string
+	action   Action
+	patterns []*regexp.Regexp
+}
+
+func (r *rule) matches(userAgent string) bool {
+	for _, p := range r.patterns {
+		if p.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// ClassFromContext returns the class of the request stored in ctx, it is not set when no rule matched
+func ClassFromContext(ctx context.Context) (string, bool) {
+	class, ok := ctx.Value(contextKey{}).(string)
+	return class, ok
+}
+
+// Filter is a middleware classifying the requests by their User-Agent header
+type Filter struct {
+	next   http.Handler
+	rules  []rule
+	header string
+
+	rejectHandler http.Handler
+	log           *log.Logger
+}
+
+// Option is a functional option setter for Filter
+type Option func(f *Filter) error
+
+// New creates a new Filter middleware
+func New(next http.Handler, opts ...Option) (*Filter, error) {
+	f := &Filter{
+		next: next,
+
+		log: utils.InheritedLogger(),
+	}
+	for _, o := range opts {
+		if err := o(f); err != nil {
+			return nil, err
+		}
+	}
+	if f.rejectHandler == nil {
+		f.rejectHandler = http.HandlerFunc(forbidden)
+	}
+	return f, nil
+}
+
+// Rule adds a rule classifying the requests whose User-Agent matches one of the regular expressions,
+// the rules are evaluated in the order they are added
+func Rule(class string, action Action, patterns ...string) Option {
+	return func(f *Filter) error {
+		if class == "" {
+			return errors.New("class can not be empty")
+		}
+		if action < Allow || action > Tag {
+			return fmt.Errorf("unsupported action %v", action)
+		}
+		if len(patterns) == 0 {
+			return fmt.Errorf("rule %q has no pattern", class)
+		}
+		r := rule{class: class, action: action}
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("rule %q: %v", class, err)
+			}
+			r.patterns = append(r.patterns, re)
+		}
+		f.rules = append(f.rules, r)
+		return nil
+	}
+}
+
+// ClassHeader sets the request header passing the class to the next handler.
+// The header sent by the client is always removed, the header is missing when no rule matched.
+func ClassHeader(name string) Option {
+	return func(f *Filter) error {
+		if name == "" {
+			return errors.New("class header can not be empty")
+		}
+		f.header = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// RejectHandler sets the handler serving the denied requests, it defaults to a 403 Forbidden response
+func RejectHandler(h http.Handler) Option {
+	return func(f *Filter) error {
+		f.rejectHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the User-Agent filter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(f *Filter) error {
+		f.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by User-Agent filter handler.
+func (f *Filter) Wrap(next http.Handler) error {
+	f.next = next
+	return nil
+}
+
+// Classify evaluates the rules against the User-Agent of the request, it returns the class of the request and
+// the action of the rule ending the evaluation, Tag when only Tag rules matched. ok is false when no rule matched.
+func (f *Filter) Classify(req *http.Request) (class string, action Action, ok bool) {
+	userAgent := req.UserAgent()
+	for i := range f.rules {
+		r := &f.rules[i]
+		if !r.matches(userAgent) {
+			continue
+		}
+		if r.action != Tag {
+			return r.class, r.action, true
+		}
+		if !ok {
+			class, action, ok = r.class, Tag, true
+		}
+	}
+	return class, action, ok
+}
+
+func (f *Filter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.log.Level >= log.DebugLevel {
+		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/useragent: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/useragent: completed ServeHttp on request")
+	}
+
+	class, action, ok := f.Classify(req)
+	if ok && action == Deny {
+		if utils.Sampled(f.log, log.DebugLevel, "vulcand/oxy/useragent: rejecting request from %v, class %q") {
+			f.log.Debugf("vulcand/oxy/useragent: rejecting request from %v, class %q", req.RemoteAddr, class)
+		}
+		f.rejectHandler.ServeHTTP(w, req)
+		return
+	}
+
+	outReq := req
+	if ok {
+		outReq = req.WithContext(context.WithValue(req.Context(), contextKey{}, class))
+	}
+	if f.header != "" {
+		if outReq == req {
+			outReq = req.WithContext(req.Context())
+		}
+		outReq.Header = utils.CloneHeaders(req.Header)
+		outReq.Header.Del(f.header)
+		if ok {
+			outReq.Header.Set(f.header, class)
+		}
+	}
+	f.next.ServeHTTP(w, outReq)
+}
+
+// Extractor returns a source extractor keying the classified requests by their class,
+// and the other requests with the base extractor, e.g. for the rate limiter or the connection limiter.
+// The keys of the classes are prefixed with "useragent:".
+func (f *Filter) Extractor(base utils.SourceExtractor) utils.SourceExtractor {
+	return utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		class, ok := ClassFromContext(req.Context())
+		if !ok {
+			class, _, ok = f.Classify(req)
+		}
+		if ok {
+			return "useragent:" + class, 1, nil
+		}
+		return base.Extract(req)
+	})
+}
+
+func forbidden(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(http.StatusText(http.StatusForbidden)))
+}
@@ -0,0 +1,94 @@
+package useragent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestFilter(t *testing.T) {
+	rules := []Option{
+		Rule("googlebot", Allow, `(?i)googlebot`),
+		Rule("curl", Tag, `^curl/`),
+		Rule("bot", Deny, `(?i)bot|crawler`, `(?i)spider`),
+	}
+
+	testCases := []struct {
+		desc          string
+		userAgent     string
+		expected      int
+		expectedClass string
+	}{
+		{desc: "browser", userAgent: "Mozilla/5.0 (X11; Linux x86_64)", expected: http.StatusOK},
+		{desc: "allowed bot", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", expected: http.StatusOK, expectedClass: "googlebot"},
+		{desc: "tagged", userAgent: "curl/8.5.0", expected: http.StatusOK, expectedClass: "curl"},
+		{desc: "tagged and denied", userAgent: "curl/8.5.0 crawler", expected: http.StatusForbidden},
+		{desc: "denied", userAgent: "SomeCrawler/1.0", expected: http.StatusForbidden},
+		{desc: "second pattern", userAgent: "spider", expected: http.StatusForbidden},
+		{desc: "no user agent", expected: http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			var class, header string
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				class, _ = ClassFromContext(req.Context())
+				header = req.Header.Get("X-Client-Class")
+			})
+			f, err := New(next, append(rules, ClassHeader("X-Client-Class"))...)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("User-Agent", test.userAgent)
+			req.Header.Set("X-Client-Class", "spoofed")
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, req)
+			assert.Equal(t, test.expected, rec.Code)
+			assert.Equal(t, test.expectedClass, class)
+			assert.Equal(t, test.expectedClass, header)
+		})
+	}
+}
+
+func TestFilterRateLimit(t *testing.T) {
+	f, err := New(nil, Rule("crawler", Tag, `(?i)crawler`))
+	require.NoError(t, err)
+
+	rates := ratelimit.NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+	clientIP, err := utils.NewExtractor("client.ip")
+	require.NoError(t, err)
+	limiter, err := ratelimit.New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		f.Extractor(clientIP), rates, ratelimit.Clock(testutils.GetClock()))
+	require.NoError(t, err)
+	require.NoError(t, f.Wrap(limiter))
+
+	serve := func(remoteAddr, userAgent string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", userAgent)
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", "crawler/1.0"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("192.0.2.2:1234", "crawler/1.0"), "the crawler instances share a bucket")
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:1234", "Mozilla/5.0"))
+	assert.Equal(t, http.StatusOK, serve("192.0.2.2:1234", "Mozilla/5.0"), "the other clients are limited per IP")
+}
+
+func TestFilterInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{Rule("", Deny, "bot"), Rule("bot", Action(42), "bot"), Rule("bot", Deny), Rule("bot", Deny, "("), ClassHeader("")} {
+		_, err := New(http.NotFoundHandler(), opt)
+		assert.Error(t, err)
+	}
+}
@@ -1,8 +1,15 @@
 package utils
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 )
 
@@ -41,3 +48,295 @@ func ParseAuthHeader(header string) (*BasicAuth, error) {
 	}
 	return &BasicAuth{Username: values[0], Password: values[1]}, nil
 }
+
+// ParseAuthHeaderStrict creates a new BasicAuth from header values like ParseAuthHeader, but rejects the malformed
+// headers the latter lets through: control characters, e.g. the CR and LF the base64 decoder skips, a non canonical
+// base64 encoding, an empty username, and control characters in the credentials
+func ParseAuthHeaderStrict(header string) (*BasicAuth, error) {
+	if err := ValidateHeaderValue(header); err != nil {
+		return nil, &MalformedError{What: "Authorization header", Reason: err.(*MalformedError).Reason}
+	}
+	values := strings.Split(strings.TrimSpace(header), " ")
+	if len(values) != 2 {
+		return nil, &MalformedError{What: "Authorization header", Reason: "expected a scheme and credentials separated by a space"}
+	}
+	if strings.ToLower(values[0]) != AuthSchemeBasic {
+		return nil, fmt.Errorf("Expected basic auth type, got '%s'", values[0])
+	}
+
+	decoded, err := base64.StdEncoding.Strict().DecodeString(values[1])
+	if err != nil {
+		return nil, &MalformedError{What: "Authorization header", Reason: fmt.Sprintf("invalid base64: %v", err)}
+	}
+	credentials := string(decoded)
+	if err := ValidateHeaderValue(credentials); err != nil {
+		return nil, &MalformedError{What: "basic auth credentials", Reason: err.(*MalformedError).Reason}
+	}
+	sep := strings.IndexByte(credentials, ':')
+	if sep < 0 {
+		return nil, &MalformedError{What: "basic auth credentials", Reason: "expected separator ':'"}
+	}
+	if sep == 0 {
+		return nil, &MalformedError{What: "basic auth credentials", Reason: "empty username"}
+	}
+	return &BasicAuth{Username: credentials[:sep], Password: credentials[sep+1:]}, nil
+}
+
+// Authentication schemes
+const (
+	AuthSchemeBasic  = "basic"
+	AuthSchemeBearer = "bearer"
+	AuthSchemeDigest = "digest"
+	AuthSchemeAPIKey = "apikey"
+)
+
+// ErrNoCredentials is returned when the request does not carry the expected credentials
+var ErrNoCredentials = errors.New("no credentials found in request")
+
+// ParseBearerHeader returns the token of a "Bearer" Authorization header, validating its syntax as per RFC 6750
+func ParseBearerHeader(header string) (string, error) {
+	values := strings.Fields(header)
+	if len(values) != 2 {
+		return "", fmt.Errorf("Failed to parse header '%s'", header)
+	}
+
+	authType := strings.ToLower(values[0])
+	if authType != AuthSchemeBearer {
+		return "", fmt.Errorf("Expected bearer auth type, got '%s'", authType)
+	}
+
+	if err := ValidateBearerToken(values[1]); err != nil {
+		return "", err
+	}
+	return values[1], nil
+}
+
+// ValidateBearerToken checks that the token matches the b64token syntax defined by RFC 6750
+func ValidateBearerToken(token string) error {
+	body := strings.TrimRight(token, "=")
+	if len(body) == 0 {
+		return fmt.Errorf("empty bearer token")
+	}
+	for _, c := range body {
+		if !isB64TokenChar(c) {
+			return fmt.Errorf("invalid character %q in bearer token", c)
+		}
+	}
+	return nil
+}
+
+func isB64TokenChar(c rune) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~' || c == '+' || c == '/'
+}
+
+// ExtractAPIKey returns the API key found in the request header or, if the header is missing, in the query parameter.
+// Either header or param can be empty to disable the corresponding lookup.
+func ExtractAPIKey(req *http.Request, header, param string) (string, error) {
+	key := ""
+	if header != "" {
+		key = strings.TrimSpace(req.Header.Get(header))
+	}
+	if key == "" && param != "" && req.URL != nil {
+		key = strings.TrimSpace(req.URL.Query().Get(param))
+	}
+	if key == "" {
+		return "", ErrNoCredentials
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return "", fmt.Errorf("invalid character %q in API key", c)
+		}
+	}
+	return key, nil
+}
+
+// DigestAuth holds the parameters of a Digest Authorization header (RFC 7616)
+type DigestAuth struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm string
+	Cnonce    string
+	Opaque    string
+	QOP       string
+	NC        string
+}
+
+// ParseDigestAuthHeader creates a new DigestAuth from header values
+func ParseDigestAuthHeader(header string) (*DigestAuth, error) {
+	values := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(values) != 2 {
+		return nil, fmt.Errorf("Failed to parse header '%s'", header)
+	}
+
+	authType := strings.ToLower(values[0])
+	if authType != AuthSchemeDigest {
+		return nil, fmt.Errorf("Expected digest auth type, got '%s'", authType)
+	}
+
+	params, err := parseAuthParams(values[1])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse header '%s': %v", header, err)
+	}
+
+	d := &DigestAuth{
+		Username:  params["username"],
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		URI:       params["uri"],
+		Response:  params["response"],
+		Algorithm: params["algorithm"],
+		Cnonce:    params["cnonce"],
+		Opaque:    params["opaque"],
+		QOP:       params["qop"],
+		NC:        params["nc"],
+	}
+	if d.Username == "" || d.Nonce == "" || d.URI == "" || d.Response == "" {
+		return nil, fmt.Errorf("Failed to parse header '%s', missing mandatory parameters", header)
+	}
+	return d, nil
+}
+
+// Validate checks that the digest response was computed with the given password,
+// the MD5 and SHA-256 algorithms are supported
+func (d *DigestAuth) Validate(method, password string) bool {
+	var hash func(string) string
+	switch strings.ToUpper(d.Algorithm) {
+	case "", "MD5":
+		hash = func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	case "SHA-256":
+		hash = func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+	default:
+		return false
+	}
+
+	ha1 := hash(d.Username + ":" + d.Realm + ":" + password)
+	ha2 := hash(method + ":" + d.URI)
+
+	var expected string
+	switch d.QOP {
+	case "":
+		expected = hash(ha1 + ":" + d.Nonce + ":" + ha2)
+	case "auth":
+		expected = hash(ha1 + ":" + d.Nonce + ":" + d.NC + ":" + d.Cnonce + ":" + d.QOP + ":" + ha2)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(d.Response))) == 1
+}
+
+// parseAuthParams parses comma separated auth-params, e.g. username="Mufasa", nc=00000001
+func parseAuthParams(in string) (map[string]string, error) {
+	params := make(map[string]string)
+	for len(in) > 0 {
+		in = strings.TrimLeft(in, " ,\t")
+		if in == "" {
+			break
+		}
+		eq := strings.Index(in, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected key=value, got '%s'", in)
+		}
+		key := strings.ToLower(strings.TrimSpace(in[:eq]))
+		in = strings.TrimLeft(in[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(in, `"`) {
+			end := 1
+			var buf []byte
+			for ; end < len(in) && in[end] != '"'; end++ {
+				if in[end] == '\\' && end+1 < len(in) {
+					end++
+				}
+				buf = append(buf, in[end])
+			}
+			if end >= len(in) {
+				return nil, fmt.Errorf("unterminated quoted value for '%s'", key)
+			}
+			value = string(buf)
+			in = in[end+1:]
+		} else {
+			end := strings.Index(in, ",")
+			if end == -1 {
+				end = len(in)
+			}
+			value = strings.TrimSpace(in[:end])
+			in = in[end:]
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+// Identity is a normalized representation of the caller credentials,
+// that can be used as a key by the rate and connection limiters.
+type Identity struct {
+	// Scheme is the authentication scheme the identity was extracted from, e.g. "basic"
+	Scheme string
+	// Name identifies the caller within the scheme. Secrets like bearer tokens and API keys are never used
+	// as is but are replaced by a hash of their value.
+	Name string
+}
+
+func (i *Identity) String() string {
+	return i.Scheme + ":" + i.Name
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity of the caller, as verified by an authentication middleware
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the verified identity of the caller stored in ctx
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// ExtractIdentity returns the identity of the caller, as verified by an authentication middleware if any,
+// otherwise based on the Authorization header.
+// Basic, Bearer and Digest schemes are supported, ErrNoCredentials is returned if the header is missing.
+func ExtractIdentity(req *http.Request) (*Identity, error) {
+	if identity, ok := IdentityFromContext(req.Context()); ok {
+		return identity, nil
+	}
+
+	header := req.Header.Get("Authorization")
+	values := strings.Fields(header)
+	if len(values) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	switch strings.ToLower(values[0]) {
+	case AuthSchemeBasic:
+		auth, err := ParseAuthHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Scheme: AuthSchemeBasic, Name: auth.Username}, nil
+	case AuthSchemeBearer:
+		token, err := ParseBearerHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Scheme: AuthSchemeBearer, Name: hashSecret(token)}, nil
+	case AuthSchemeDigest:
+		auth, err := ParseDigestAuthHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Scheme: AuthSchemeDigest, Name: auth.Username}, nil
+	}
+	return nil, fmt.Errorf("unsupported auth type '%s'", values[0])
+}
+
+// hashSecret returns a short, stable representation of a secret that is safe to use as a key or to log
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:16])
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -58,3 +60,147 @@ func TestParseSuccess(t *testing.T) {
 
 	}
 }
+
+func TestParseBearerHeader(t *testing.T) {
+	token, err := ParseBearerHeader("Bearer mF_9.B5f-4.1JqM")
+	require.NoError(t, err)
+	assert.Equal(t, "mF_9.B5f-4.1JqM", token)
+
+	token, err = ParseBearerHeader("bearer YWJj==")
+	require.NoError(t, err)
+	assert.Equal(t, "YWJj==", token)
+
+	headers := []string{
+		"",
+		"Bearer",
+		"Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==",
+		"Bearer a b",
+		"Bearer ===",
+		"Bearer tok\"en",
+	}
+	for _, h := range headers {
+		_, err := ParseBearerHeader(h)
+		require.Error(t, err, h)
+	}
+}
+
+func TestExtractAPIKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/?api_key=query-key", nil)
+
+	key, err := ExtractAPIKey(req, "X-Api-Key", "api_key")
+	require.NoError(t, err)
+	assert.Equal(t, "query-key", key)
+
+	req.Header.Set("X-Api-Key", "header-key")
+	key, err = ExtractAPIKey(req, "X-Api-Key", "api_key")
+	require.NoError(t, err)
+	assert.Equal(t, "header-key", key)
+
+	_, err = ExtractAPIKey(req, "X-Other", "")
+	assert.Equal(t, ErrNoCredentials, err)
+
+	req.Header.Set("X-Api-Key", "bad key")
+	_, err = ExtractAPIKey(req, "X-Api-Key", "")
+	require.Error(t, err)
+}
+
+func TestParseDigestAuthHeader(t *testing.T) {
+	// example from RFC 2617
+	header := `Digest username="Mufasa", realm="testrealm@host.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", ` +
+		`uri="/dir/index.html", qop=auth, nc=00000001, cnonce="0a4f113b", ` +
+		`response="6629fae49393a05397450978507c4ef1", opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+
+	auth, err := ParseDigestAuthHeader(header)
+	require.NoError(t, err)
+	assert.Equal(t, "Mufasa", auth.Username)
+	assert.Equal(t, "testrealm@host.com", auth.Realm)
+	assert.Equal(t, "/dir/index.html", auth.URI)
+	assert.Equal(t, "auth", auth.QOP)
+	assert.Equal(t, "00000001", auth.NC)
+
+	assert.True(t, auth.Validate(http.MethodGet, "Circle Of Life"))
+	assert.False(t, auth.Validate(http.MethodGet, "wrong"))
+	assert.False(t, auth.Validate(http.MethodPost, "Circle Of Life"))
+
+	headers := []string{
+		"",
+		"Digest",
+		"Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==",
+		`Digest username="Mufasa`,
+		`Digest username="Mufasa"`,
+	}
+	for _, h := range headers {
+		_, err := ParseDigestAuthHeader(h)
+		require.Error(t, err, h)
+	}
+}
+
+func TestExtractIdentity(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	_, err := ExtractIdentity(req)
+	assert.Equal(t, ErrNoCredentials, err)
+
+	req.Header.Set("Authorization", (&BasicAuth{Username: "Alice", Password: "secret"}).String())
+	identity, err := ExtractIdentity(req)
+	require.NoError(t, err)
+	assert.Equal(t, "basic:Alice", identity.String())
+
+	req.Header.Set("Authorization", "Bearer token")
+	identity, err = ExtractIdentity(req)
+	require.NoError(t, err)
+	assert.Equal(t, AuthSchemeBearer, identity.Scheme)
+	assert.NotContains(t, identity.Name, "token")
+
+	req.Header.Set("Authorization", "Negotiate abc")
+	_, err = ExtractIdentity(req)
+	require.Error(t, err)
+
+	req.Header.Set("Authorization", " ")
+	_, err = ExtractIdentity(req)
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestExtractVerifiedIdentity(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+
+	_, ok := IdentityFromContext(req.Context())
+	assert.False(t, ok)
+
+	verified := &Identity{Scheme: AuthSchemeBasic, Name: "Alice"}
+	req = req.WithContext(WithIdentity(req.Context(), verified))
+	identity, err := ExtractIdentity(req)
+	require.NoError(t, err)
+	assert.Equal(t, verified, identity)
+}
+
+func TestParseAuthHeaderStrict(t *testing.T) {
+	auth, err := ParseAuthHeaderStrict("Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==")
+	require.NoError(t, err)
+	assert.Equal(t, &BasicAuth{Username: "Aladdin", Password: "open sesame"}, auth)
+
+	headers := []string{
+		// CR and LF skipped by the base64 decoder
+		"Basic QWxhZGRp\r\nbjpvcGVuIHNlc2FtZQ==",
+		// non canonical padding bits
+		"Basic QWxhZGRpbjpvcGVuIHNlc2FtZR==",
+		// two spaces
+		"Basic  QWxhZGRpbjpvcGVuIHNlc2FtZQ==",
+		// empty username, ":pass"
+		"Basic OnBhc3M=",
+		// missing separator, "user"
+		"Basic dXNlcg==",
+		// LF in the credentials, "user:pa\nss"
+		"Basic dXNlcjpwYQpzcw==",
+	}
+	for _, h := range headers {
+		_, err := ParseAuthHeaderStrict(h)
+		require.Error(t, err, h)
+		assert.True(t, IsError(err, ErrMalformedRequest), h)
+	}
+
+	// the lenient parser lets them through
+	_, err = ParseAuthHeader(headers[1])
+	require.NoError(t, err)
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock gives the middlewares their view of the current time, so time dependent behavior can be controlled in tests.
+// Its method set matches github.com/mailgun/timetools.TimeProvider, existing providers can be used as a Clock.
+type Clock interface {
+	// UtcNow returns the current time in UTC
+	UtcNow() time.Time
+	// Sleep pauses the current goroutine for at least the duration d
+	Sleep(d time.Duration)
+	// After waits for the duration to elapse and then sends the current time on the returned channel
+	After(d time.Duration) <-chan time.Time
+}
+
+// DefaultClock is the clock used by the middlewares unless configured otherwise
+var DefaultClock Clock = &RealClock{}
+
+// RealClock is a Clock backed by the time package
+type RealClock struct{}
+
+// UtcNow returns the current time in UTC
+func (*RealClock) UtcNow() time.Time {
+	return time.Now().UTC()
+}
+
+// Sleep pauses the current goroutine for at least the duration d
+func (*RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// After waits for the duration to elapse and then sends the current time on the returned channel
+func (*RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock is a Clock that only moves forward when told to, intended for tests.
+// It is safe for concurrent use.
+type FakeClock struct {
+	mutex   *sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+// NewFakeClock creates a FakeClock frozen at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		mutex: &sync.Mutex{},
+		now:   now.UTC(),
+	}
+}
+
+// UtcNow returns the current fake time
+func (c *FakeClock) UtcNow() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Sleep does not block, it moves the clock forward by d instead
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// After returns a channel that receives the fake time once the clock has been advanced by at least d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{until: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the channels returned by After whose deadline has passed
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to the given time
+func (c *FakeClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(t.UTC())
+}
+
+// Waiters returns the number of pending After channels, it helps tests to synchronize with goroutines waiting on the clock
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+func (c *FakeClock) set(t time.Time) {
+	c.now = t
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.until.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = pending
+}
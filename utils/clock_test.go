@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	assert.Equal(t, start, clock.UtcNow())
+
+	clock.Sleep(time.Second)
+	assert.Equal(t, start.Add(time.Second), clock.UtcNow())
+
+	clock.Set(start)
+	assert.Equal(t, start, clock.UtcNow())
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	start := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	immediate := clock.After(0)
+	assert.Equal(t, start, <-immediate)
+
+	c := clock.After(2 * time.Second)
+	assert.Equal(t, 1, clock.Waiters())
+
+	clock.Advance(time.Second)
+	select {
+	case <-c:
+		t.Fatal("fired before the deadline")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case now := <-c:
+		assert.Equal(t, start.Add(2*time.Second), now)
+	default:
+		t.Fatal("did not fire after the deadline")
+	}
+	assert.Equal(t, 0, clock.Waiters())
+}
+
+func TestRealClock(t *testing.T) {
+	now := DefaultClock.UtcNow()
+	assert.Equal(t, time.UTC, now.Location())
+	assert.WithinDuration(t, time.Now(), now, time.Second)
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults are the error handler, the logger and the clock of the middlewares created without the matching options,
+// so that a large configuration does not repeat the same options on every constructor
+type Defaults struct {
+	// ErrorHandler replaces DefaultHandler, the middlewares with an error handler of their own, answering with the
+	// status code of their errors like buffer.SizeErrHandler, keep it
+	ErrorHandler ErrorHandler
+	// Logger replaces logrus.StandardLogger()
+	Logger *log.Logger
+	// Clock replaces DefaultClock
+	Clock Clock
+}
+
+var (
+	defaultsMutex sync.RWMutex
+	defaults      Defaults
+)
+
+// SetDefaults sets the defaults inherited by the middlewares created afterwards, the middlewares already created
+// keep theirs. The nil fields restore the built-in defaults, SetDefaults(Defaults{}) restores all of them.
+func SetDefaults(d Defaults) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+	defaults = d
+}
+
+// GetDefaults returns the defaults inherited by the middlewares, with the built-in defaults for the ones not set
+func GetDefaults() Defaults {
+	return Defaults{
+		ErrorHandler: InheritedErrorHandler(DefaultHandler),
+		Logger:       InheritedLogger(),
+		Clock:        InheritedClock(),
+	}
+}
+
+// InheritedErrorHandler returns the error handler set with SetDefaults, fallback if none is set
+func InheritedErrorHandler(fallback ErrorHandler) ErrorHandler {
+	defaultsMutex.RLock()
+	defer defaultsMutex.RUnlock()
+	if defaults.ErrorHandler != nil {
+		return defaults.ErrorHandler
+	}
+	return fallback
+}
+
+// InheritedLogger returns the logger set with SetDefaults, logrus.StandardLogger() if none is set
+func InheritedLogger() *log.Logger {
+	defaultsMutex.RLock()
+	defer defaultsMutex.RUnlock()
+	if defaults.Logger != nil {
+		return defaults.Logger
+	}
+	return log.StandardLogger()
+}
+
+// InheritedClock returns the clock set with SetDefaults, DefaultClock if none is set
+func InheritedClock() Clock {
+	defaultsMutex.RLock()
+	defer defaultsMutex.RUnlock()
+	if defaults.Clock != nil {
+		return defaults.Clock
+	}
+	return DefaultClock
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaults(t *testing.T) {
+	defer SetDefaults(Defaults{})
+
+	d := GetDefaults()
+	assert.Equal(t, DefaultHandler, d.ErrorHandler)
+	assert.Equal(t, log.StandardLogger(), d.Logger)
+	assert.Equal(t, DefaultClock, d.Clock)
+
+	h := ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {})
+	logger := log.New()
+	clock := &FakeClock{}
+	SetDefaults(Defaults{ErrorHandler: h, Logger: logger, Clock: clock})
+
+	assert.Equal(t, logger, InheritedLogger())
+	assert.Equal(t, clock, InheritedClock())
+	_, ok := InheritedErrorHandler(DefaultHandler).(ErrorHandlerFunc)
+	assert.True(t, ok)
+
+	// the fields not set keep the built-in defaults
+	SetDefaults(Defaults{Logger: logger})
+	assert.Equal(t, logger, InheritedLogger())
+	assert.Equal(t, DefaultClock, InheritedClock())
+	assert.Equal(t, DefaultHandler, InheritedErrorHandler(DefaultHandler))
+
+	SetDefaults(Defaults{})
+	assert.Equal(t, log.StandardLogger(), InheritedLogger())
+}
@@ -0,0 +1,53 @@
+package utils
+
+import "errors"
+
+// Errors shared by the middlewares, whatever the middleware failing. The errors passed to the error handlers
+// wrap their cause and match these errors with errors.Is, or IsError:
+//
+//	func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+//		if utils.IsError(err, utils.ErrRateLimited) {
+//			...
+//		}
+//	}
+var (
+	// ErrUpstreamTimeout is a timeout of the upstream server, forward
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+	// ErrBodyTooLarge is a request or a response body over the limit, buffer
+	ErrBodyTooLarge = errors.New("body too large")
+	// ErrRateLimited is a request over the rate limit, ratelimit
+	ErrRateLimited = errors.New("rate limited")
+	// ErrCircuitOpen is a request rejected by a tripped circuit breaker, cbreaker
+	ErrCircuitOpen = errors.New("circuit breaker open")
+	// ErrHeaderTooLarge is a request with headers over the limits set for the upstream servers, forward
+	ErrHeaderTooLarge = errors.New("header too large")
+	// ErrMalformedRequest is a request rejected by the strict parsing, e.g. a header value with a CR or LF, forward, or
+	// a request body not matching its checksum, buffer
+	ErrMalformedRequest = errors.New("malformed request")
+	// ErrMisdirectedRequest is a request the upstream server answered with a 421 Misdirected Request, forward
+	ErrMisdirectedRequest = errors.New("misdirected request")
+	// ErrNoServer is a request the load balancer has no server for, e.g. all the servers are removed or have a 0
+	// weight, roundrobin
+	ErrNoServer = errors.New("no server available")
+	// ErrAffinityBroken is a request whose sticky session server is gone from the load balancer, when a sticky
+	// session fallback code is set, roundrobin
+	ErrAffinityBroken = errors.New("affinity broken")
+)
+
+// IsError reports whether an error in the chain of err matches target, like errors.Is in Go 1.13
+func IsError(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+		if e, ok := err.(interface{ Is(error) bool }); ok && e.Is(target) {
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type wrappedError struct {
+	kind, cause error
+}
+
+func (e *wrappedError) Error() string        { return e.cause.Error() }
+func (e *wrappedError) Is(target error) bool { return target == e.kind }
+func (e *wrappedError) Unwrap() error        { return e.cause }
+
+func TestIsError(t *testing.T) {
+	cause := errors.New("cause")
+	err := &wrappedError{kind: ErrRateLimited, cause: &wrappedError{kind: ErrCircuitOpen, cause: cause}}
+
+	assert.True(t, IsError(err, ErrRateLimited))
+	assert.True(t, IsError(err, ErrCircuitOpen))
+	assert.True(t, IsError(err, cause))
+	assert.True(t, IsError(ErrBodyTooLarge, ErrBodyTooLarge))
+	assert.False(t, IsError(err, ErrBodyTooLarge))
+	assert.False(t, IsError(nil, ErrBodyTooLarge))
+}
+
+// statusCodeError is an error carrying its status code
+type statusCodeError int
+
+func (e statusCodeError) Error() string {
+	return http.StatusText(int(e))
+}
+
+func (e statusCodeError) StatusCode() int {
+	return int(e)
+}
+
+func TestErrorStatusCode(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected int
+	}{
+		{err: ErrBodyTooLarge, expected: http.StatusRequestEntityTooLarge},
+		{err: &wrappedError{kind: ErrRateLimited, cause: errors.New("max rate reached")}, expected: http.StatusTooManyRequests},
+		{err: ErrCircuitOpen, expected: http.StatusServiceUnavailable},
+		{err: ErrHeaderTooLarge, expected: http.StatusRequestHeaderFieldsTooLarge},
+		{err: ErrMalformedRequest, expected: http.StatusBadRequest},
+		{err: ErrMisdirectedRequest, expected: http.StatusBadGateway},
+		{err: ErrNoServer, expected: http.StatusInternalServerError},
+		{err: statusCodeError(http.StatusGone), expected: http.StatusGone},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			DefaultHandler.ServeHTTP(w, nil, test.err)
+			assert.Equal(t, test.expected, w.Code)
+		})
+	}
+}
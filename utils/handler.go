@@ -1,10 +1,17 @@
 package utils
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -27,23 +34,46 @@ var DefaultHandler ErrorHandler = &StdHandler{}
 type StdHandler struct{}
 
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
-	statusCode := http.StatusInternalServerError
+	statusCode := errorStatusCode(err)
 
+	w.WriteHeader(statusCode)
+	w.Write([]byte(statusText(statusCode)))
+	if log.GetLevel() >= log.DebugLevel {
+		log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+	}
+}
+
+// errorStatusCode maps an error to the HTTP status code reported to the client
+func errorStatusCode(err error) int {
+	// the errors carrying their status code, e.g. the sticky session fallback code of roundrobin
+	if e, ok := err.(interface{ StatusCode() int }); ok {
+		return e.StatusCode()
+	}
+	switch {
+	case IsError(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case IsError(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case IsError(err, ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	case IsError(err, ErrHeaderTooLarge):
+		return http.StatusRequestHeaderFieldsTooLarge
+	case IsError(err, ErrMalformedRequest):
+		return http.StatusBadRequest
+	case IsError(err, ErrMisdirectedRequest):
+		return http.StatusBadGateway
+	}
 	if e, ok := err.(net.Error); ok {
 		if e.Timeout() {
-			statusCode = http.StatusGatewayTimeout
-		} else {
-			statusCode = http.StatusBadGateway
+			return http.StatusGatewayTimeout
 		}
+		return http.StatusBadGateway
 	} else if err == io.EOF {
-		statusCode = http.StatusBadGateway
+		return http.StatusBadGateway
 	} else if err == context.Canceled {
-		statusCode = StatusClientClosedRequest
+		return StatusClientClosedRequest
 	}
-
-	w.WriteHeader(statusCode)
-	w.Write([]byte(statusText(statusCode)))
-	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+	return http.StatusInternalServerError
 }
 
 func statusText(statusCode int) string {
@@ -60,3 +90,149 @@ type ErrorHandlerFunc func(http.ResponseWriter, *http.Request, error)
 func (f ErrorHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request, err error) {
 	f(w, r, err)
 }
+
+// JSONHandler renders errors as a JSON object, e.g. {"status":502,"message":"Bad Gateway"}
+type JSONHandler struct {
+	// Detailed adds the error message to the response body, keep it off for public facing endpoints
+	Detailed bool
+}
+
+type jsonError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (h *JSONHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := errorStatusCode(err)
+
+	body := jsonError{Status: statusCode, Message: statusText(statusCode)}
+	if h.Detailed && err != nil {
+		body.Error = err.Error()
+	}
+	writeJSON(w, "application/json", statusCode, body)
+	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+}
+
+// ProblemHandler renders errors as RFC 7807 problem details using the application/problem+json media type
+type ProblemHandler struct {
+	// Type is a URI reference that identifies the problem type, "about:blank" is used when empty
+	Type string
+	// Detailed adds the error message as the problem "detail" member
+	Detailed bool
+}
+
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func (h *ProblemHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := errorStatusCode(err)
+
+	body := problem{Type: h.Type, Title: statusText(statusCode), Status: statusCode}
+	if body.Type == "" {
+		body.Type = "about:blank"
+	}
+	if h.Detailed && err != nil {
+		body.Detail = err.Error()
+	}
+	if req != nil && req.URL != nil {
+		body.Instance = req.URL.RequestURI()
+	}
+	writeJSON(w, "application/problem+json", statusCode, body)
+	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+}
+
+func writeJSON(w http.ResponseWriter, contentType string, statusCode int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("vulcand/oxy/utils: failed to marshal error response: %v", err)
+		w.WriteHeader(statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+// ErrorPage is the data passed to the template of a TemplateHandler
+type ErrorPage struct {
+	StatusCode int
+	StatusText string
+	Request    *http.Request
+	// Error is only set when the TemplateHandler is Detailed
+	Error string
+}
+
+// TemplateHandler renders errors as HTML pages using a html/template
+type TemplateHandler struct {
+	template *template.Template
+	detailed bool
+}
+
+// NewTemplateHandler creates a new TemplateHandler, the template is executed with an ErrorPage.
+// If detailed is set, the page gets the error message.
+func NewTemplateHandler(tmpl *template.Template, detailed bool) (*TemplateHandler, error) {
+	if tmpl == nil {
+		return nil, fmt.Errorf("template can not be nil")
+	}
+	return &TemplateHandler{template: tmpl, detailed: detailed}, nil
+}
+
+func (h *TemplateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := errorStatusCode(err)
+
+	page := ErrorPage{StatusCode: statusCode, StatusText: statusText(statusCode), Request: req}
+	if h.detailed && err != nil {
+		page.Error = err.Error()
+	}
+
+	buf := &bytes.Buffer{}
+	if errExec := h.template.Execute(buf, page); errExec != nil {
+		log.Errorf("vulcand/oxy/utils: failed to render error page: %v", errExec)
+		w.WriteHeader(statusCode)
+		w.Write([]byte(statusText(statusCode)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(statusCode)
+	w.Write(buf.Bytes())
+	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+}
+
+// RedirectHandler redirects the client to an error page.
+// The "{status}" placeholder of the location is replaced by the status code of the error, e.g. /errors/{status}.html
+type RedirectHandler struct {
+	location string
+	code     int
+}
+
+// NewRedirectHandler creates a new RedirectHandler, code is the redirect status code and defaults to 302
+func NewRedirectHandler(location string, code int) (*RedirectHandler, error) {
+	if _, err := url.Parse(strings.Replace(location, "{status}", "500", -1)); err != nil {
+		return nil, err
+	}
+	if code == 0 {
+		code = http.StatusFound
+	}
+	if code < 300 || code > 399 {
+		return nil, fmt.Errorf("redirect code should be 3xx, got %d", code)
+	}
+	return &RedirectHandler{location: location, code: code}, nil
+}
+
+func (h *RedirectHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	statusCode := errorStatusCode(err)
+
+	w.Header().Set("Location", strings.Replace(h.location, "{status}", strconv.Itoa(statusCode), -1))
+	w.WriteHeader(h.code)
+	w.Write([]byte(http.StatusText(h.code)))
+	log.Debugf("'%d %s' caused by: %v, redirected to %s", statusCode, statusText(statusCode), err, h.location)
+}
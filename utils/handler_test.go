@@ -2,6 +2,10 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -30,3 +34,71 @@ func TestDefaultHandlerErrors(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadGateway, w.Code)
 }
+
+func TestJSONHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/path", nil)
+
+	handler := &JSONHandler{}
+	handler.ServeHTTP(w, req, io.EOF)
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":502,"message":"Bad Gateway"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler = &JSONHandler{Detailed: true}
+	handler.ServeHTTP(w, req, errors.New("boom"))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"status":500,"message":"Internal Server Error","error":"boom"}`, w.Body.String())
+}
+
+func TestProblemHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/path?a=b", nil)
+
+	handler := &ProblemHandler{}
+	handler.ServeHTTP(w, req, context.Canceled)
+
+	assert.Equal(t, StatusClientClosedRequest, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"about:blank","title":"Client Closed Request","status":499,"instance":"/path?a=b"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler = &ProblemHandler{Type: "https://example.com/problems/upstream", Detailed: true}
+	handler.ServeHTTP(w, nil, errors.New("boom"))
+
+	assert.JSONEq(t, `{"type":"https://example.com/problems/upstream","title":"Internal Server Error","status":500,"detail":"boom"}`, w.Body.String())
+}
+
+func TestTemplateHandler(t *testing.T) {
+	tmpl := template.Must(template.New("error").Parse(`<h1>{{.StatusCode}} {{.StatusText}}</h1>{{.Error}}`))
+
+	handler, err := NewTemplateHandler(tmpl, true)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), errors.New("<script>"))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "<h1>500 Internal Server Error</h1>&lt;script&gt;", w.Body.String())
+
+	_, err = NewTemplateHandler(nil, false)
+	require.Error(t, err)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	handler, err := NewRedirectHandler("https://example.com/errors/{status}.html", 0)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), io.EOF)
+
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://example.com/errors/502.html", w.Header().Get("Location"))
+
+	_, err = NewRedirectHandler("/errors", http.StatusOK)
+	require.Error(t, err)
+}
@@ -0,0 +1,18 @@
+package utils
+
+// StateHandoff is implemented by the middlewares with a state that can be handed to the instance replacing them
+// during a reload, e.g. the process started with SO_REUSEPORT before the former one drains: the former instance
+// saves its state, passes it to the new process, e.g. through a file or a socket inherited from the former process,
+// and the new instance restores it before it serves its first request.
+//
+// Implemented by ratelimit.TokenLimiter, the token buckets of the sources, cbreaker.CircuitBreaker, the tripped or
+// recovering state, and roundrobin.Rebalancer, the weights of the servers. The sticky sessions are kept by the
+// clients cookies and need no handoff, neither do the connection limits: the connections counted by a
+// connlimit.ConnLimiter stay with the former process until they are closed.
+type StateHandoff interface {
+	// SaveState serializes the state of the middleware
+	SaveState() ([]byte, error)
+	// RestoreState restores the state saved by the same kind of middleware, the state of a former version is
+	// restored as far as possible and an unknown version is an error
+	RestoreState(data []byte) error
+}
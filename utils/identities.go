@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Identities is a registry of the identities of the requests shared by the middlewares, so that the rate limits, the
+// connection limits, the traces and the logs key on the same definition of a client, a user or a tenant. The
+// identities are defined once by name and the middlewares take their extractors:
+//
+//	ids := utils.NewIdentities()
+//	ids.Register("client", utils.NewClientIPExtractor(trustedProxies))
+//	ids.RegisterVariable("tenant", "request.header.X-Tenant")
+//
+//	tenant, _ := ids.Extractor("tenant")
+//	limiter, _ := ratelimit.New(next, tenant, rates)
+//	tracer, _ := trace.New(limiter, os.Stdout, trace.Identities(ids, "client", "tenant"))
+type Identities struct {
+	mutex      sync.RWMutex
+	extractors map[string]SourceExtractor
+	// names keeps the registration order
+	names []string
+}
+
+// NewIdentities creates an empty registry of identities
+func NewIdentities() *Identities {
+	return &Identities{extractors: make(map[string]SourceExtractor)}
+}
+
+// Register defines the identity name, or redefines it for all the middlewares using it
+func (i *Identities) Register(name string, extractor SourceExtractor) error {
+	if name == "" {
+		return fmt.Errorf("identity name can not be empty")
+	}
+	if extractor == nil {
+		return fmt.Errorf("extractor of identity %q can not be nil", name)
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if _, ok := i.extractors[name]; !ok {
+		i.names = append(i.names, name)
+	}
+	i.extractors[name] = extractor
+	return nil
+}
+
+// RegisterVariable defines the identity name with a variable of NewExtractor, e.g. "request.header.X-Tenant"
+func (i *Identities) RegisterVariable(name, variable string) error {
+	extractor, err := NewExtractor(variable)
+	if err != nil {
+		return err
+	}
+	return i.Register(name, extractor)
+}
+
+// Names returns the names of the identities, in registration order
+func (i *Identities) Names() []string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return append([]string(nil), i.names...)
+}
+
+// Extractor returns the extractor of the identity name, it follows the later registrations of the name
+func (i *Identities) Extractor(name string) (SourceExtractor, error) {
+	if _, ok := i.get(name); !ok {
+		return nil, fmt.Errorf("unknown identity: %q", name)
+	}
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		extractor, _ := i.get(name)
+		return extractor.Extract(req)
+	}), nil
+}
+
+func (i *Identities) get(name string) (SourceExtractor, bool) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	extractor, ok := i.extractors[name]
+	return extractor, ok
+}
+
+// Extract returns the identities of the request by name, all the identities when no names are given. The unknown
+// identities and the identities failing to be extracted are left out.
+func (i *Identities) Extract(req *http.Request, names ...string) map[string]string {
+	if len(names) == 0 {
+		names = i.Names()
+	}
+	identities := make(map[string]string, len(names))
+	for _, name := range names {
+		extractor, ok := i.get(name)
+		if !ok {
+			continue
+		}
+		if token, _, err := extractor.Extract(req); err == nil {
+			identities[name] = token
+		}
+	}
+	return identities
+}
+
+// Fields returns the identities of the request as log fields, see Extract:
+//
+//	logger.WithFields(ids.Fields(req)).Info("request served")
+func (i *Identities) Fields(req *http.Request, names ...string) log.Fields {
+	identities := i.Extract(req, names...)
+	fields := make(log.Fields, len(identities))
+	for name, token := range identities {
+		fields[name] = token
+	}
+	return fields
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentities(t *testing.T) {
+	ids := NewIdentities()
+	require.NoError(t, ids.RegisterVariable("tenant", "request.header.X-Tenant"))
+	require.NoError(t, ids.Register("failing", ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		return "", 0, fmt.Errorf("failed")
+	})))
+
+	tenant, err := ids.Extractor("tenant")
+	require.NoError(t, err)
+	_, err = ids.Extractor("unknown")
+	require.Error(t, err)
+
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"X-Tenant": {"acme"}}}
+	token, amount, err := tenant.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "acme", token)
+	assert.Equal(t, int64(1), amount)
+
+	// the extractors follow the redefinitions of the identities
+	require.NoError(t, ids.Register("tenant", ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		return "tenant-" + req.Header.Get("X-Tenant"), 1, nil
+	})))
+	token, _, err = tenant.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "tenant-acme", token)
+
+	assert.Equal(t, []string{"tenant", "failing"}, ids.Names())
+	assert.Equal(t, map[string]string{"tenant": "tenant-acme"}, ids.Extract(req))
+	assert.Equal(t, map[string]string{}, ids.Extract(req, "unknown"))
+	assert.Equal(t, log.Fields{"tenant": "tenant-acme"}, ids.Fields(req, "tenant"))
+
+	assert.Error(t, ids.Register("", tenant))
+	assert.Error(t, ids.Register("nil", nil))
+	assert.Error(t, ids.RegisterVariable("invalid", "request.unknown"))
+}
+
+func TestClientIPExtractor(t *testing.T) {
+	trusted, err := NewIPSet("10.0.0.0/8")
+	require.NoError(t, err)
+
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"X-Forwarded-For": {"1.2.3.4"}}}
+	token, _, err := NewClientIPExtractor(trusted).Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", token)
+
+	token, _, err = NewClientIPExtractor(nil).Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", token)
+
+	_, _, err = NewClientIPExtractor(nil).Extract(&http.Request{RemoteAddr: "invalid"})
+	require.Error(t, err)
+}
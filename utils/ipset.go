@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// IPSet is a set of IP addresses and CIDR ranges.
+// It is backed by a binary radix tree per address family, so the cost of a lookup is bound by the
+// length of the address and does not depend on the amount of ranges in the set.
+type IPSet struct {
+	mutex *sync.RWMutex
+	v4    *ipNode
+	v6    *ipNode
+	size  int
+}
+
+type ipNode struct {
+	children [2]*ipNode
+	// terminal is set when the path leading to this node is a prefix present in the set
+	terminal bool
+}
+
+// NewIPSet creates a new IPSet from a list of IP addresses or CIDR ranges, e.g. "10.0.0.0/8", "::1"
+func NewIPSet(ranges ...string) (*IPSet, error) {
+	s := &IPSet{
+		mutex: &sync.RWMutex{},
+		v4:    &ipNode{},
+		v6:    &ipNode{},
+	}
+	for _, r := range ranges {
+		if err := s.Add(r); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ParseIPNet parses either a CIDR range or a single IP address, the latter is turned into a /32 (or /128) network
+func ParseIPNet(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address or CIDR range: %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Add adds an IP address or a CIDR range to the set
+func (s *IPSet) Add(value string) error {
+	ipNet, err := ParseIPNet(value)
+	if err != nil {
+		return err
+	}
+	s.AddNet(ipNet)
+	return nil
+}
+
+// AddNet adds a network to the set
+func (s *IPSet) AddNet(ipNet *net.IPNet) {
+	ones, _ := ipNet.Mask.Size()
+	root, ip := s.root(ipNet.IP)
+	if root == nil {
+		return
+	}
+	if len(ip) == net.IPv4len && len(ipNet.Mask) == net.IPv6len {
+		// IPv4 network expressed with a 16 bytes mask
+		ones -= 96
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	node := root
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			// a wider range already covers this network
+			return
+		}
+		b := bit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &ipNode{}
+		}
+		node = node.children[b]
+	}
+	if node.terminal {
+		return
+	}
+	// narrower ranges are covered by this one now
+	s.size -= node.count()
+	s.size++
+	node.terminal = true
+	node.children = [2]*ipNode{}
+}
+
+// Contains tells whether the IP address belongs to any range of the set
+func (s *IPSet) Contains(ip net.IP) bool {
+	root, ip := s.root(ip)
+	if root == nil {
+		return false
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	node := root
+	for i := 0; i < len(ip)*8; i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[bit(ip, i)]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
+
+// ContainsString tells whether the address belongs to any range of the set,
+// the address can be an IP or a host:port pair such as http.Request.RemoteAddr
+func (s *IPSet) ContainsString(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return s.Contains(net.ParseIP(ipv6fix(addr)))
+}
+
+// Len returns the number of distinct ranges in the set, ranges covered by wider ones are not counted
+func (s *IPSet) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.size
+}
+
+func (s *IPSet) root(ip net.IP) (*ipNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return s.v4, ip4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return s.v6, ip16
+	}
+	return nil, nil
+}
+
+// count returns the number of terminal nodes in the subtree
+func (n *ipNode) count() int {
+	if n == nil {
+		return 0
+	}
+	if n.terminal {
+		return 1
+	}
+	return n.children[0].count() + n.children[1].count()
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// ClientIP resolves the IP address of the client that sent the request.
+// When the request comes from a trusted proxy, the X-Forwarded-For header is walked from the right,
+// skipping the trusted proxies, and the first untrusted address is returned. A nil set trusts no proxy.
+// It returns nil when the address can not be parsed.
+func ClientIP(req *http.Request, trustedProxies *IPSet) net.IP {
+	addr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(ipv6fix(addr))
+	if ip == nil || trustedProxies == nil || !trustedProxies.Contains(ip) {
+		return ip
+	}
+
+	values := req.Header["X-Forwarded-For"]
+	for i := len(values) - 1; i >= 0; i-- {
+		hops := strings.Split(values[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop := net.ParseIP(ipv6fix(strings.TrimSpace(hops[j])))
+			if hop == nil {
+				// the chain is broken, the last trusted proxy is the closest known client
+				return ip
+			}
+			ip = hop
+			if !trustedProxies.Contains(ip) {
+				return ip
+			}
+		}
+	}
+	return ip
+}
+
+// AnonymizeIP zeroes the host part of an IP address: the last octet of an IPv4 address, the last 64 bits of an IPv6
+// address
+func AnonymizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(64, 128))
+}
+
+// clean up IP in case if it is ipv6 address and it has {zone} information in it
+func ipv6fix(ip string) string {
+	return strings.Split(ip, "%")[0]
+}
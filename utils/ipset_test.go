@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPSetContains(t *testing.T) {
+	set, err := NewIPSet("10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "::1")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		ip       string
+		expected bool
+	}{
+		{ip: "10.0.0.1", expected: true},
+		{ip: "10.255.255.255", expected: true},
+		{ip: "11.0.0.1", expected: false},
+		{ip: "192.168.1.1", expected: true},
+		{ip: "192.168.1.2", expected: false},
+		{ip: "::ffff:10.1.2.3", expected: true},
+		{ip: "2001:db8:1::1", expected: true},
+		{ip: "2001:db9::1", expected: false},
+		{ip: "::1", expected: true},
+		{ip: "::2", expected: false},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.ip, func(t *testing.T) {
+			assert.Equal(t, test.expected, set.Contains(net.ParseIP(test.ip)))
+		})
+	}
+}
+
+func TestIPSetContainsString(t *testing.T) {
+	set, err := NewIPSet("127.0.0.0/8", "fe80::/10")
+	require.NoError(t, err)
+
+	assert.True(t, set.ContainsString("127.0.0.1"))
+	assert.True(t, set.ContainsString("127.0.0.1:5432"))
+	assert.True(t, set.ContainsString("[fe80::1%eth0]:80"))
+	assert.False(t, set.ContainsString("10.0.0.1:80"))
+	assert.False(t, set.ContainsString("not an ip"))
+}
+
+func TestIPSetOverlappingRanges(t *testing.T) {
+	set, err := NewIPSet("10.1.0.0/16", "10.2.0.0/16")
+	require.NoError(t, err)
+	assert.Equal(t, 2, set.Len())
+
+	// already covered
+	require.NoError(t, set.Add("10.1.2.0/24"))
+	assert.Equal(t, 2, set.Len())
+
+	// covers both existing ranges
+	require.NoError(t, set.Add("10.0.0.0/8"))
+	assert.Equal(t, 1, set.Len())
+	assert.True(t, set.ContainsString("10.3.0.1"))
+}
+
+func TestIPSetInvalid(t *testing.T) {
+	_, err := NewIPSet("10.0.0.0/33")
+	require.Error(t, err)
+
+	_, err = NewIPSet("localhost")
+	require.Error(t, err)
+
+	set, err := NewIPSet()
+	require.NoError(t, err)
+	assert.False(t, set.Contains(nil))
+	assert.Equal(t, 0, set.Len())
+}
+
+func BenchmarkIPSetContains(b *testing.B) {
+	set, err := NewIPSet()
+	require.NoError(b, err)
+	for i := 0; i < 256; i++ {
+		set.AddNet(&net.IPNet{IP: net.IPv4(10, byte(i), 0, 0), Mask: net.CIDRMask(16, 32)})
+	}
+	ip := net.ParseIP("10.200.1.1")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		set.Contains(ip)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := NewIPSet("10.0.0.0/8")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		remoteAddr   string
+		forwardedFor []string
+		trusted      *IPSet
+		expected     string
+	}{
+		{desc: "direct", remoteAddr: "1.2.3.4:1234", forwardedFor: []string{"5.6.7.8"}, trusted: trusted, expected: "1.2.3.4"},
+		{desc: "no trusted proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"5.6.7.8"}, expected: "10.0.0.1"},
+		{desc: "trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"5.6.7.8"}, trusted: trusted, expected: "5.6.7.8"},
+		{desc: "spoofed chain", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"}, trusted: trusted, expected: "5.6.7.8"},
+		{desc: "several headers", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"5.6.7.8", "10.0.0.3"}, trusted: trusted, expected: "5.6.7.8"},
+		{desc: "only proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"10.0.0.2"}, trusted: trusted, expected: "10.0.0.2"},
+		{desc: "invalid hop", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"5.6.7.8, unknown"}, trusted: trusted, expected: "10.0.0.1"},
+		{desc: "ipv6", remoteAddr: "[::1]:1234", expected: "::1"},
+		{desc: "invalid remote address", remoteAddr: "invalid", expected: "<nil>"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+			for _, value := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, test.expected, ClientIP(req, test.trusted).String())
+		})
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	testCases := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "192.168.1.42", expected: "192.168.1.0"},
+		{ip: "::ffff:192.168.1.42", expected: "192.168.1.0"},
+		{ip: "2001:db8:1:2:3:4:5:6", expected: "2001:db8:1:2::"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.ip, func(t *testing.T) {
+			assert.Equal(t, test.expected, AnonymizeIP(net.ParseIP(test.ip)).String())
+		})
+	}
+}
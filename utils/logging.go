@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSampledMessages bounds the number of distinct messages counted by a sampled logger
+const maxSampledMessages = 1024
+
+// LevelLogger returns a logger writing to the output of l with its formatter and hooks, at its own level.
+// It overrides the level of a single middleware, e.g. debug logs for the rate limiter only:
+//
+//	tl, err := ratelimit.New(next, extractor, rates, ratelimit.Logger(utils.LevelLogger(logger, logrus.DebugLevel)))
+func LevelLogger(l *log.Logger, level log.Level) *log.Logger {
+	return &log.Logger{
+		Out:       l.Out,
+		Hooks:     l.Hooks,
+		Formatter: l.Formatter,
+		Level:     level,
+	}
+}
+
+// SampledLogger returns a logger writing to the output of l, at its level, that writes the first of the identical
+// messages checked with Sampled and then 1 every n. Two messages are identical when they have the same level and the
+// same format, their arguments and fields are ignored. The other messages are all written.
+//
+// It keeps the messages repeated on each request, e.g. "limiting request", from flooding the output.
+func SampledLogger(l *log.Logger, n int) *log.Logger {
+	if n <= 1 {
+		return LevelLogger(l, l.Level)
+	}
+	sampled := LevelLogger(l, l.Level)
+	// the sampler wraps the formatter to ride along with the logger, see Sampled
+	sampled.Formatter = &sampler{
+		Formatter: l.Formatter,
+		n:         uint64(n),
+		counts:    make(map[sampleKey]uint64),
+	}
+	return sampled
+}
+
+// Sampled tells whether l writes a message of the level and the format, it is checked before formatting the messages
+// repeated on each request so that the dropped ones cost neither their formatting nor their fields:
+//
+//	if utils.Sampled(l.log, logrus.DebugLevel, "limiting request %v") {
+//		l.log.Debugf("limiting request %v", req.URL)
+//	}
+//
+// It is false when the level is disabled, or when the message is dropped by a logger created with SampledLogger.
+func Sampled(l *log.Logger, level log.Level, format string) bool {
+	if l.Level < level {
+		return false
+	}
+	s, ok := l.Formatter.(*sampler)
+	if !ok {
+		return true
+	}
+	return s.sample(sampleKey{level: level, format: format})
+}
+
+type sampleKey struct {
+	level  log.Level
+	format string
+}
+
+// sampler counts the messages checked with Sampled, it formats the entries with the formatter of the sampled logger
+type sampler struct {
+	log.Formatter
+	n uint64
+
+	mutex  sync.Mutex
+	counts map[sampleKey]uint64
+}
+
+func (s *sampler) sample(key sampleKey) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count, ok := s.counts[key]
+	if !ok && len(s.counts) >= maxSampledMessages {
+		// the formats differ too much to be sampled, e.g. they are built from the requests: start over
+		s.counts = make(map[sampleKey]uint64)
+	}
+	s.counts[key] = count + 1
+	return count%s.n == 0
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogger(out *bytes.Buffer) *log.Logger {
+	return &log.Logger{
+		Out:       out,
+		Hooks:     make(log.LevelHooks),
+		Formatter: &log.TextFormatter{DisableTimestamp: true},
+		Level:     log.WarnLevel,
+	}
+}
+
+func TestLevelLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := newTestLogger(out)
+
+	debug := LevelLogger(logger, log.DebugLevel)
+	debug.Debug("on")
+	logger.Debug("off")
+
+	assert.Equal(t, "level=debug msg=on\n", out.String())
+	assert.Equal(t, log.WarnLevel, logger.Level)
+}
+
+func TestSampledLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := SampledLogger(newTestLogger(out), 3)
+
+	for i := 0; i < 7; i++ {
+		if Sampled(logger, log.WarnLevel, "limiting request %d") {
+			logger.Warnf("limiting request %d", i)
+		}
+		if Sampled(logger, log.ErrorLevel, "retry") {
+			logger.WithField("attempt", i).Error("retry")
+		}
+		// the messages not checked are all written
+		if i < 2 {
+			logger.Warn("not sampled")
+		}
+	}
+	assert.False(t, Sampled(logger, log.InfoLevel, "dropped by the level"))
+
+	assert.Equal(t, []string{
+		"level=warning msg=\"limiting request 0\"",
+		"level=error msg=retry attempt=0",
+		"level=warning msg=\"not sampled\"",
+		"level=warning msg=\"not sampled\"",
+		"level=warning msg=\"limiting request 3\"",
+		"level=error msg=retry attempt=3",
+		"level=warning msg=\"limiting request 6\"",
+		"level=error msg=retry attempt=6",
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+}
+
+func TestSampledLoggerDistinctMessages(t *testing.T) {
+	logger := SampledLogger(newTestLogger(&bytes.Buffer{}), 2)
+
+	written := 0
+	for i := 0; i < maxSampledMessages+1; i++ {
+		if Sampled(logger, log.WarnLevel, fmt.Sprintf("message %d", i)) {
+			written++
+		}
+	}
+	if Sampled(logger, log.WarnLevel, "message 0") {
+		written++
+	}
+
+	assert.Equal(t, maxSampledMessages+2, written)
+}
+
+func TestSampledNotSampledLogger(t *testing.T) {
+	logger := newTestLogger(&bytes.Buffer{})
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, Sampled(logger, log.WarnLevel, "limiting request"))
+	}
+	assert.False(t, Sampled(logger, log.DebugLevel, "limiting request"))
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// MultipartPolicy is the policy of the parts of the multipart/form-data bodies, see InspectMultipart
+type MultipartPolicy struct {
+	// MaxParts is the max number of parts, 0 for no limit
+	MaxParts int
+	// MaxPartBytes is the max size of the body of a part, 0 for no limit
+	MaxPartBytes int64
+	// ContentTypes are the media types allowed for the parts, e.g. "image/png" or "image/*", all if empty. The parts
+	// without a Content-Type header are "text/plain", e.g. the form fields.
+	ContentTypes []string
+	// Check is called with the headers of each part, e.g. to check the name or the file name, the part must not be
+	// read and an error rejects the body, optional
+	Check func(part *multipart.Part) error
+}
+
+// MultipartError is a part of a multipart body rejected by the policy, it matches ErrBodyTooLarge for a part over
+// the size limit and ErrMalformedRequest otherwise
+type MultipartError struct {
+	// Part is the form name of the part, empty for the errors of the body
+	Part   string
+	Reason string
+
+	tooLarge bool
+}
+
+func (e *MultipartError) Error() string {
+	if e.Part == "" {
+		return fmt.Sprintf("multipart body rejected: %s", e.Reason)
+	}
+	return fmt.Sprintf("multipart part %q rejected: %s", e.Part, e.Reason)
+}
+
+// Is matches ErrBodyTooLarge or ErrMalformedRequest
+func (e *MultipartError) Is(target error) bool {
+	if e.tooLarge {
+		return target == ErrBodyTooLarge
+	}
+	return target == ErrMalformedRequest
+}
+
+// WalkMultipart reads the parts of a multipart body with the boundary, checking them against the policy, and calls
+// fn with each part and its body limited to MaxPartBytes, if fn is not nil, in a streaming fashion: the parts are not
+// buffered, fn may read the body it is given and the rest is discarded. It returns the first error of the policy, of
+// fn or of the body.
+func WalkMultipart(body io.Reader, boundary string, policy MultipartPolicy, fn func(part *multipart.Part, body io.Reader) error) error {
+	r := multipart.NewReader(body, boundary)
+	for parts := 1; ; parts++ {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &MultipartError{Reason: err.Error()}
+		}
+		if policy.MaxParts > 0 && parts > policy.MaxParts {
+			return &MultipartError{Reason: fmt.Sprintf("more than %d parts", policy.MaxParts)}
+		}
+		if err := policy.checkPart(part); err != nil {
+			return err
+		}
+
+		limited := &partReader{Part: part, max: policy.MaxPartBytes}
+		if fn != nil {
+			if err := fn(part, limited); err != nil {
+				return err
+			}
+		}
+		// the rest of the part not read by fn
+		if _, err := io.Copy(ioutil.Discard, limited); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return &MultipartError{Part: part.FormName(), Reason: "truncated part"}
+			}
+			return err
+		}
+	}
+}
+
+func (p MultipartPolicy) checkPart(part *multipart.Part) error {
+	if len(p.ContentTypes) != 0 {
+		contentType := part.Header.Get("Content-Type")
+		mediaType := "text/plain"
+		if contentType != "" {
+			var err error
+			if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+				return &MultipartError{Part: part.FormName(), Reason: fmt.Sprintf("invalid content type %q", contentType)}
+			}
+		}
+		if !matchMediaType(p.ContentTypes, mediaType) {
+			return &MultipartError{Part: part.FormName(), Reason: fmt.Sprintf("content type %q not allowed", mediaType)}
+		}
+	}
+	if p.Check != nil {
+		return p.Check(part)
+	}
+	return nil
+}
+
+func matchMediaType(allowed []string, mediaType string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mediaType || (strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, a[:len(a)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// partReader reads the body of a part up to the size limit
+type partReader struct {
+	*multipart.Part
+	max  int64
+	read int64
+}
+
+func (r *partReader) Read(p []byte) (int, error) {
+	n, err := r.Part.Read(p)
+	r.read += int64(n)
+	if r.max > 0 && r.read > r.max {
+		return n, &MultipartError{Part: r.FormName(), Reason: fmt.Sprintf("part larger than %d bytes", r.max), tooLarge: true}
+	}
+	return n, err
+}
+
+// InspectMultipart checks the multipart/form-data body of the request against the policy while it is read, e.g. by
+// a forward.Forwarder or a buffer.Buffer, without buffering it: the body of the request is replaced by a reader
+// returning the bytes of the original body and the first error of the policy, a MultipartError, once it is detected,
+// and at the latest instead of the end of the body. It returns false, and leaves the request untouched, if the body
+// is not a multipart/form-data one, and an error if its boundary is missing.
+//
+//	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+//		if _, err := utils.InspectMultipart(req, policy); err != nil {
+//			errHandler.ServeHTTP(w, req, err)
+//			return
+//		}
+//		buffered.ServeHTTP(w, req)
+//	})
+func InspectMultipart(req *http.Request, policy MultipartPolicy) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return false, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return false, nil
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return true, &MultipartError{Reason: "missing boundary"}
+	}
+
+	pr, pw := io.Pipe()
+	b := &multipartBody{body: req.Body, pw: pw, done: make(chan struct{})}
+	go func() {
+		err := WalkMultipart(pr, boundary, policy, nil)
+		b.err = err
+		// unblocks the writes of the body once the walk is over, e.g. the epilogue after the last part
+		pr.CloseWithError(err)
+		close(b.done)
+	}()
+	go func() {
+		select {
+		case <-req.Context().Done():
+			pw.CloseWithError(req.Context().Err())
+		case <-b.done:
+		}
+	}()
+	req.Body = b
+	return true, nil
+}
+
+// multipartBody passes the bytes of the body to the walk of its parts
+type multipartBody struct {
+	body io.ReadCloser
+	pw   *io.PipeWriter
+	done chan struct{}
+	// err is the error of the walk, set before done is closed
+	err error
+}
+
+func (b *multipartBody) failure() error {
+	select {
+	case <-b.done:
+		return b.err
+	default:
+		return nil
+	}
+}
+
+func (b *multipartBody) Read(p []byte) (int, error) {
+	if err := b.failure(); err != nil {
+		return 0, err
+	}
+	n, err := b.body.Read(p)
+	if n > 0 {
+		if _, errWrite := b.pw.Write(p[:n]); errWrite != nil {
+			<-b.done
+			if b.err != nil {
+				return 0, b.err
+			}
+		}
+	}
+	if err == io.EOF {
+		// the walk reads the end of the parts before the body ends
+		b.pw.Close()
+		<-b.done
+		if b.err != nil {
+			return n, b.err
+		}
+	}
+	return n, err
+}
+
+func (b *multipartBody) Close() error {
+	b.pw.Close()
+	return b.body.Close()
+}
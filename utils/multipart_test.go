@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testPart struct {
+	name        string
+	contentType string
+	body        string
+}
+
+func newMultipartRequest(t *testing.T, parts ...testPart) (*http.Request, []byte) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, p := range parts {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="`+p.name+`"`)
+		if p.contentType != "" {
+			h.Set("Content-Type", p.contentType)
+		}
+		pw, err := w.CreatePart(h)
+		require.NoError(t, err)
+		_, err = pw.Write([]byte(p.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	raw := body.Bytes()
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(raw))
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, raw
+}
+
+func TestInspectMultipart(t *testing.T) {
+	policy := MultipartPolicy{
+		MaxParts:     3,
+		MaxPartBytes: 10,
+		ContentTypes: []string{"text/plain", "image/*"},
+	}
+
+	testCases := []struct {
+		desc     string
+		parts    []testPart
+		expected error
+	}{
+		{
+			desc: "allowed",
+			parts: []testPart{
+				{name: "title", body: "holidays"},
+				{name: "photo", contentType: "image/png", body: "0123456789"},
+				{name: "thumbnail", contentType: "Image/JPEG", body: "01234"},
+			},
+		},
+		{
+			desc:     "part too large",
+			parts:    []testPart{{name: "title", body: "holidays"}, {name: "photo", contentType: "image/png", body: "0123456789a"}},
+			expected: ErrBodyTooLarge,
+		},
+		{
+			desc:     "content type not allowed",
+			parts:    []testPart{{name: "script", contentType: "application/javascript", body: "alert()"}},
+			expected: ErrMalformedRequest,
+		},
+		{
+			desc:     "invalid content type",
+			parts:    []testPart{{name: "photo", contentType: "image/", body: "0123"}},
+			expected: ErrMalformedRequest,
+		},
+		{
+			desc: "too many parts",
+			parts: []testPart{
+				{name: "a", body: "1"}, {name: "b", body: "2"}, {name: "c", body: "3"}, {name: "d", body: "4"},
+			},
+			expected: ErrMalformedRequest,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req, raw := newMultipartRequest(t, test.parts...)
+
+			ok, err := InspectMultipart(req, policy)
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			body, err := ioutil.ReadAll(req.Body)
+			if test.expected == nil {
+				require.NoError(t, err)
+				assert.Equal(t, raw, body)
+				return
+			}
+			require.Error(t, err)
+			assert.True(t, IsError(err, test.expected), err.Error())
+			assert.IsType(t, &MultipartError{}, err)
+		})
+	}
+}
+
+func TestInspectMultipartTruncated(t *testing.T) {
+	req, raw := newMultipartRequest(t, testPart{name: "title", body: "holidays"})
+	req.Body = ioutil.NopCloser(bytes.NewReader(raw[:len(raw)-10]))
+
+	ok, err := InspectMultipart(req, MultipartPolicy{})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = ioutil.ReadAll(req.Body)
+	assert.True(t, IsError(err, ErrMalformedRequest))
+}
+
+func TestInspectMultipartCheck(t *testing.T) {
+	req, _ := newMultipartRequest(t, testPart{name: "title", body: "holidays"}, testPart{name: "admin", body: "true"})
+
+	errForbidden := errors.New("forbidden field")
+	ok, err := InspectMultipart(req, MultipartPolicy{Check: func(part *multipart.Part) error {
+		if part.FormName() == "admin" {
+			return errForbidden
+		}
+		return nil
+	}})
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = ioutil.ReadAll(req.Body)
+	assert.Equal(t, errForbidden, err)
+	assert.NoError(t, req.Body.Close())
+}
+
+func TestInspectMultipartNotMultipart(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("a=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body := req.Body
+
+	ok, err := InspectMultipart(req, MultipartPolicy{})
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, body, req.Body)
+
+	req.Header.Set("Content-Type", "multipart/form-data")
+	ok, err = InspectMultipart(req, MultipartPolicy{})
+	assert.True(t, ok)
+	assert.True(t, IsError(err, ErrMalformedRequest))
+}
+
+func TestWalkMultipart(t *testing.T) {
+	req, _ := newMultipartRequest(t,
+		testPart{name: "title", body: "holidays"},
+		testPart{name: "photo", contentType: "image/png", body: "0123456789"},
+	)
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	require.NoError(t, err)
+
+	read := map[string]string{}
+	err = WalkMultipart(req.Body, params["boundary"], MultipartPolicy{MaxPartBytes: 10}, func(part *multipart.Part, body io.Reader) error {
+		// reads the first bytes only, the rest is discarded
+		buf := make([]byte, 4)
+		n, errRead := io.ReadFull(body, buf)
+		read[part.FormName()] = string(buf[:n])
+		return errRead
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"title": "holi", "photo": "0123"}, read)
+}
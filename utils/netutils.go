@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -34,6 +35,26 @@ func NewProxyWriterWithLogger(w http.ResponseWriter, l *log.Logger) *ProxyWriter
 	}
 }
 
+var proxyWriterPool = sync.Pool{
+	New: func() interface{} { return &ProxyWriter{} },
+}
+
+// AcquireProxyWriter returns a ProxyWriter from a pool, to save an allocation per request on the hot paths.
+// It is released with ReleaseProxyWriter once the handler it was passed to returned.
+func AcquireProxyWriter(w http.ResponseWriter, l *log.Logger) *ProxyWriter {
+	p := proxyWriterPool.Get().(*ProxyWriter)
+	p.w = w
+	p.log = l
+	return p
+}
+
+// ReleaseProxyWriter puts a ProxyWriter acquired with AcquireProxyWriter back in the pool,
+// it must not be used afterwards
+func ReleaseProxyWriter(p *ProxyWriter) {
+	*p = ProxyWriter{}
+	proxyWriterPool.Put(p)
+}
+
 // StatusCode gets status code
 func (p *ProxyWriter) StatusCode() int {
 	if p.code == 0 {
@@ -59,6 +80,25 @@ func (p *ProxyWriter) Write(buf []byte) (int, error) {
 	return p.w.Write(buf)
 }
 
+// ReadFrom copies r to the response with the io.ReaderFrom of the underlying writer if it has one, so that the
+// net/http response writer can still send the body with sendfile(2) or splice(2) through the wrappers.
+func (p *ProxyWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := p.w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{p.w}, r)
+	}
+	p.length = p.length + n
+	return n, err
+}
+
+// writerOnly hides the io.ReaderFrom of a writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
+
 // WriteHeader writes status code
 func (p *ProxyWriter) WriteHeader(code int) {
 	p.code = code
@@ -156,21 +196,50 @@ func NopWriteCloser(w io.Writer) io.WriteCloser {
 	return &nopWriteCloser{Writer: w}
 }
 
-// CopyURL provides update safe copy by avoiding shallow copying User field
+// CopyURL provides update safe copy of the URL.
+// The User field is shared with the original: url.Userinfo is immutable, copying it would only cost an allocation.
 func CopyURL(i *url.URL) *url.URL {
 	out := *i
-	if i.User != nil {
-		out.User = &(*i.User)
-	}
 	return &out
 }
 
 // CopyHeaders copies http headers from source to destination, it
 // does not overide, but adds multiple headers
 func CopyHeaders(dst http.Header, src http.Header) {
+	// Values of the headers missing from dst share a single backing array,
+	// so copying a header map costs one slice allocation instead of one per header.
+	var values []string
 	for k, vv := range src {
-		dst[k] = append(dst[k], vv...)
+		if len(vv) == 0 {
+			continue
+		}
+		if prior := dst[k]; len(prior) > 0 {
+			dst[k] = append(prior, vv...)
+			continue
+		}
+		if values == nil {
+			values = make([]string, headerValuesCount(src))
+		}
+		n := copy(values, vv)
+		// the capacity is capped so that appending to this header never overwrites the next one
+		dst[k] = values[:n:n]
+		values = values[n:]
+	}
+}
+
+// CloneHeaders returns a copy of the headers, the returned map is pre-sized to avoid growing it while copying
+func CloneHeaders(src http.Header) http.Header {
+	dst := make(http.Header, len(src))
+	CopyHeaders(dst, src)
+	return dst
+}
+
+func headerValuesCount(h http.Header) int {
+	count := 0
+	for _, vv := range h {
+		count += len(vv)
 	}
+	return count
 }
 
 // HasHeaders determines whether any of the header names is present in the http headers
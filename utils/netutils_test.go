@@ -1,8 +1,12 @@
 package utils
 
 import (
+	"bytes"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -28,6 +32,38 @@ func TestCopyUrl(t *testing.T) {
 	assert.NotEqual(t, urlA, urlB)
 }
 
+// readFromRecorder is a ResponseWriter implementing io.ReaderFrom
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.calls++
+	return io.Copy(r.ResponseRecorder.Body, src)
+}
+
+func TestProxyWriterReadFrom(t *testing.T) {
+	rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	pw := NewProxyWriter(rec)
+
+	n, err := io.Copy(pw, io.LimitReader(strings.NewReader("hello"), 10))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, n)
+	assert.Equal(t, 1, rec.calls)
+	assert.EqualValues(t, 5, pw.GetLength())
+	assert.Equal(t, "hello", rec.Body.String())
+
+	// without io.ReaderFrom the body is written
+	plain := httptest.NewRecorder()
+	pw = NewProxyWriter(plain)
+	n, err = pw.ReadFrom(bytes.NewReader([]byte("world")))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, n)
+	assert.EqualValues(t, 5, pw.GetLength())
+	assert.Equal(t, "world", plain.Body.String())
+}
+
 // Make sure copy headers is not shallow and copies all headers
 func TestCopyHeaders(t *testing.T) {
 	source, destination := make(http.Header), make(http.Header)
@@ -46,6 +82,41 @@ func TestCopyHeaders(t *testing.T) {
 	assert.Equal(t, "b", destination.Get("a"))
 }
 
+// Make sure headers sharing a backing array do not overwrite each other when appended to
+func TestCopyHeadersAppend(t *testing.T) {
+	source := make(http.Header)
+	source.Add("a", "b")
+	source.Add("c", "d")
+	source.Add("c", "e")
+
+	destination := make(http.Header)
+	destination.Add("c", "f")
+	CopyHeaders(destination, source)
+
+	assert.Equal(t, []string{"f", "d", "e"}, destination["C"])
+
+	destination.Add("a", "g")
+	destination.Add("x", "y")
+	assert.Equal(t, []string{"b", "g"}, destination["A"])
+	assert.Equal(t, []string{"f", "d", "e"}, destination["C"])
+	assert.Equal(t, []string{"b"}, source["A"])
+}
+
+func TestCloneHeaders(t *testing.T) {
+	source := make(http.Header)
+	source.Add("a", "b")
+	source.Add("a", "c")
+	source.Add("d", "e")
+
+	clone := CloneHeaders(source)
+	assert.Equal(t, source, clone)
+
+	clone.Set("a", "f")
+	assert.Equal(t, []string{"b", "c"}, source["A"])
+
+	assert.Empty(t, CloneHeaders(http.Header{}))
+}
+
 func TestHasHeaders(t *testing.T) {
 	source := make(http.Header)
 	source.Add("a", "b")
@@ -86,9 +157,44 @@ func BenchmarkCopyHeaders(b *testing.B) {
 		s.Add("Accept-Ranges", "bytes")
 		sourceHeaders = append(sourceHeaders, s)
 	}
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
 		CopyHeaders(dstHeaders[n], sourceHeaders[n])
 	}
 }
+
+func BenchmarkCloneHeaders(b *testing.B) {
+	s := http.Header{}
+	s.Add("Accept", "text/html")
+	s.Add("Accept-Encoding", "gzip, deflate")
+	s.Add("Cookie", "a=1")
+	s.Add("Cookie", "b=2")
+	s.Add("User-Agent", "Mozilla/5.0")
+	s.Add("X-Forwarded-For", "10.0.0.1")
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		CloneHeaders(s)
+	}
+}
+
+var urlSink *url.URL
+
+func BenchmarkCopyURL(b *testing.B) {
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     "localhost:5000",
+		Path:     "/upstream",
+		RawQuery: "a=1&b=2",
+		User:     url.UserPassword("user", "pass"),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		urlSink = CopyURL(u)
+	}
+}
@@ -24,7 +24,14 @@ func (f ExtractorFunc) Extract(req *http.Request) (string, int64, error) {
 // ExtractSource extract source function type
 type ExtractSource func(req *http.Request)
 
-// NewExtractor creates a new SourceExtractor
+// NewExtractor creates a new SourceExtractor. Supported variables are:
+//
+// client.ip - client IP address
+// request.host - request host
+// request.header.<Name> - value of the request header
+// request.identity - caller identity derived from Basic, Bearer or Digest Authorization header
+// request.apikey.header.<Name> - API key passed in the request header
+// request.apikey.query.<name> - API key passed in the query string
 func NewExtractor(variable string) (SourceExtractor, error) {
 	if variable == "client.ip" {
 		return ExtractorFunc(extractClientIP), nil
@@ -32,6 +39,23 @@ func NewExtractor(variable string) (SourceExtractor, error) {
 	if variable == "request.host" {
 		return ExtractorFunc(extractHost), nil
 	}
+	if variable == "request.identity" {
+		return ExtractorFunc(extractIdentity), nil
+	}
+	if strings.HasPrefix(variable, "request.apikey.header.") {
+		header := strings.TrimPrefix(variable, "request.apikey.header.")
+		if len(header) == 0 {
+			return nil, fmt.Errorf("wrong header: %s", header)
+		}
+		return makeAPIKeyExtractor(header, ""), nil
+	}
+	if strings.HasPrefix(variable, "request.apikey.query.") {
+		param := strings.TrimPrefix(variable, "request.apikey.query.")
+		if len(param) == 0 {
+			return nil, fmt.Errorf("wrong query parameter: %s", param)
+		}
+		return makeAPIKeyExtractor("", param), nil
+	}
 	if strings.HasPrefix(variable, "request.header.") {
 		header := strings.TrimPrefix(variable, "request.header.")
 		if len(header) == 0 {
@@ -43,11 +67,14 @@ func NewExtractor(variable string) (SourceExtractor, error) {
 }
 
 func extractClientIP(req *http.Request) (string, int64, error) {
-	vals := strings.SplitN(req.RemoteAddr, ":", 2)
-	if len(vals[0]) == 0 {
+	ip := req.RemoteAddr
+	if i := strings.IndexByte(ip, ':'); i >= 0 {
+		ip = ip[:i]
+	}
+	if len(ip) == 0 {
 		return "", 0, fmt.Errorf("failed to parse client IP: %v", req.RemoteAddr)
 	}
-	return vals[0], 1, nil
+	return ip, 1, nil
 }
 
 func extractHost(req *http.Request) (string, int64, error) {
@@ -59,3 +86,41 @@ func makeHeaderExtractor(header string) SourceExtractor {
 		return req.Header.Get(header), 1, nil
 	})
 }
+
+// extractIdentity keys on the caller identity, anonymous requests share the empty token
+func extractIdentity(req *http.Request) (string, int64, error) {
+	identity, err := ExtractIdentity(req)
+	if err == ErrNoCredentials {
+		return "", 1, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return identity.String(), 1, nil
+}
+
+func makeAPIKeyExtractor(header, param string) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		key, err := ExtractAPIKey(req, header, param)
+		if err == ErrNoCredentials {
+			return "", 1, nil
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		identity := &Identity{Scheme: AuthSchemeAPIKey, Name: hashSecret(key)}
+		return identity.String(), 1, nil
+	})
+}
+
+// NewClientIPExtractor creates a SourceExtractor keying on the client IP address, resolved through the trusted
+// proxies, see ClientIP. A nil set trusts no proxy.
+func NewClientIPExtractor(trustedProxies *IPSet) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		ip := ClientIP(req, trustedProxies)
+		if ip == nil {
+			return "", 0, fmt.Errorf("failed to parse client IP: %v", req.RemoteAddr)
+		}
+		return ip.String(), 1, nil
+	})
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewExtractor(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		variable string
+		setup    func(req *http.Request)
+		expected string
+	}{
+		{
+			desc:     "client ip",
+			variable: "client.ip",
+			expected: "192.0.2.1",
+		},
+		{
+			desc:     "host",
+			variable: "request.host",
+			expected: "example.com",
+		},
+		{
+			desc:     "header",
+			variable: "request.header.X-Tenant",
+			setup:    func(req *http.Request) { req.Header.Set("X-Tenant", "acme") },
+			expected: "acme",
+		},
+		{
+			desc:     "identity",
+			variable: "request.identity",
+			setup: func(req *http.Request) {
+				req.Header.Set("Authorization", (&BasicAuth{Username: "Alice", Password: "secret"}).String())
+			},
+			expected: "basic:Alice",
+		},
+		{
+			desc:     "anonymous identity",
+			variable: "request.identity",
+			expected: "",
+		},
+		{
+			desc:     "api key in header",
+			variable: "request.apikey.header.X-Api-Key",
+			setup:    func(req *http.Request) { req.Header.Set("X-Api-Key", "secret") },
+			expected: "apikey:" + hashSecret("secret"),
+		},
+		{
+			desc:     "api key in query",
+			variable: "request.apikey.query.key",
+			setup:    func(req *http.Request) { req.URL.RawQuery = "key=secret" },
+			expected: "apikey:" + hashSecret("secret"),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			extractor, err := NewExtractor(test.variable)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if test.setup != nil {
+				test.setup(req)
+			}
+
+			token, amount, err := extractor.Extract(req)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, token)
+			assert.EqualValues(t, 1, amount)
+		})
+	}
+}
+
+func TestNewExtractorErrors(t *testing.T) {
+	for _, variable := range []string{"", "request.header.", "request.apikey.header.", "request.apikey.query.", "unknown"} {
+		_, err := NewExtractor(variable)
+		require.Error(t, err, variable)
+	}
+}
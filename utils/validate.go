@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// MalformedError is an input rejected by the strict parsing and validation functions, it matches ErrMalformedRequest
+type MalformedError struct {
+	// What is the malformed part of the input, e.g. "header X-Forwarded-For"
+	What   string
+	Reason string
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("malformed %s: %s", e.What, e.Reason)
+}
+
+// Is matches ErrMalformedRequest
+func (e *MalformedError) Is(target error) bool {
+	return target == ErrMalformedRequest
+}
+
+// ValidateHeaderName checks that the name is a token as defined by RFC 7230
+func ValidateHeaderName(name string) error {
+	if name == "" {
+		return &MalformedError{What: "header name", Reason: "empty name"}
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return &MalformedError{What: "header name", Reason: fmt.Sprintf("invalid character %q in %q", name[i], name)}
+		}
+	}
+	return nil
+}
+
+// ValidateHeaderValue checks that the value has no control characters but horizontal tabs, in particular no CR or LF
+// that would let the value be read as another header, or another request, by the upstream servers
+func ValidateHeaderValue(value string) error {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return &MalformedError{What: "header value", Reason: fmt.Sprintf("invalid character %q", c)}
+		}
+	}
+	return nil
+}
+
+// ValidateHeaders checks the names and the values of the headers
+func ValidateHeaders(h http.Header) error {
+	for name, values := range h {
+		if err := ValidateHeaderName(name); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if err := ValidateHeaderValue(v); err != nil {
+				return &MalformedError{What: "header " + name, Reason: err.(*MalformedError).Reason}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidatePercentEncoding checks that every '%' of s starts a percent-encoded octet, i.e. is followed by two
+// hexadecimal digits, and that no octet decodes to a NUL, CR or LF
+func ValidatePercentEncoding(s string) error {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			continue
+		}
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			return &MalformedError{What: "percent-encoding", Reason: fmt.Sprintf("invalid escape %q", s[i:min(i+3, len(s))])}
+		}
+		if c := unhex(s[i+1])<<4 | unhex(s[i+2]); c == 0 || c == '\r' || c == '\n' {
+			return &MalformedError{What: "percent-encoding", Reason: fmt.Sprintf("escaped control character %q", s[i:i+3])}
+		}
+		i += 2
+	}
+	return nil
+}
+
+// ValidateForwardedFor checks that every entry of the X-Forwarded-For header values is an IP address
+func ValidateForwardedFor(values []string) error {
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			hop = strings.TrimSpace(hop)
+			if net.ParseIP(ipv6fix(hop)) == nil {
+				return &MalformedError{What: "header X-Forwarded-For", Reason: fmt.Sprintf("invalid entry %q", hop)}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateRequest checks the request URI, the headers and the X-Forwarded-For entries of the request, the checks
+// of the strict parsing of the middlewares
+func ValidateRequest(req *http.Request) error {
+	uri := req.RequestURI
+	if uri == "" && req.URL != nil {
+		uri = req.URL.RequestURI()
+	}
+	if err := ValidatePercentEncoding(uri); err != nil {
+		return &MalformedError{What: "request URI", Reason: err.(*MalformedError).Reason}
+	}
+	if err := ValidateHeaderValue(req.Host); err != nil {
+		return &MalformedError{What: "host", Reason: err.(*MalformedError).Reason}
+	}
+	if err := ValidateHeaders(req.Header); err != nil {
+		return err
+	}
+	return ValidateForwardedFor(req.Header["X-Forwarded-For"])
+}
+
+// ClientIPStrict resolves the IP address of the client like ClientIP, but returns an error when the remote address
+// or an X-Forwarded-For entry set by a trusted proxy is not an IP address instead of falling back to the last
+// trusted proxy
+func ClientIPStrict(req *http.Request, trustedProxies *IPSet) (net.IP, error) {
+	addr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(ipv6fix(addr))
+	if ip == nil {
+		return nil, &MalformedError{What: "remote address", Reason: fmt.Sprintf("invalid address %q", req.RemoteAddr)}
+	}
+	if trustedProxies == nil || !trustedProxies.Contains(ip) {
+		return ip, nil
+	}
+	if err := ValidateForwardedFor(req.Header["X-Forwarded-For"]); err != nil {
+		return nil, err
+	}
+	return ClientIP(req, trustedProxies), nil
+}
+
+// isTokenChar reports whether c is a tchar as defined by RFC 7230
+func isTokenChar(c byte) bool {
+	if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateHeaderValue(t *testing.T) {
+	require.NoError(t, ValidateHeaderValue("text/html;\tq=0.9"))
+	require.NoError(t, ValidateHeaderValue(""))
+
+	for _, v := range []string{"a\r\nX-Injected: 1", "a\nb", "a\x00b", "a\x7fb"} {
+		err := ValidateHeaderValue(v)
+		require.Error(t, err, v)
+		assert.True(t, IsError(err, ErrMalformedRequest))
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	require.NoError(t, ValidateHeaders(http.Header{"X-Test": {"a", "b"}}))
+	require.Error(t, ValidateHeaders(http.Header{"X Test": {"a"}}))
+	require.Error(t, ValidateHeaders(http.Header{"": {"a"}}))
+
+	err := ValidateHeaders(http.Header{"X-Test": {"a", "b\rc"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "X-Test")
+}
+
+func TestValidatePercentEncoding(t *testing.T) {
+	testCases := []struct {
+		in    string
+		valid bool
+	}{
+		{in: "/a/b?c=d", valid: true},
+		{in: "/a%20b?c=%2F", valid: true},
+		{in: "/a%2", valid: false},
+		{in: "/a%", valid: false},
+		{in: "/a%zzb", valid: false},
+		{in: "/a%0d%0aSet-Cookie:x", valid: false},
+		{in: "/a%00", valid: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.in, func(t *testing.T) {
+			err := ValidatePercentEncoding(test.in)
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateForwardedFor(t *testing.T) {
+	require.NoError(t, ValidateForwardedFor([]string{"10.0.0.1, 2001:db8::1", "192.168.0.1"}))
+	require.NoError(t, ValidateForwardedFor(nil))
+	require.Error(t, ValidateForwardedFor([]string{"10.0.0.1, unknown"}))
+	require.Error(t, ValidateForwardedFor([]string{"10.0.0.1,"}))
+}
+
+func TestValidateRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/a%20b?c=d", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	require.NoError(t, ValidateRequest(req))
+
+	req.RequestURI = "/a%zz"
+	require.Error(t, ValidateRequest(req))
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header["X-Test"] = []string{"a\r\nb"}
+	require.Error(t, ValidateRequest(req))
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.Header.Set("X-Forwarded-For", "evil")
+	require.Error(t, ValidateRequest(req))
+}
+
+func TestClientIPStrict(t *testing.T) {
+	trusted, err := NewIPSet("10.0.0.0/8")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.168.0.1, 10.0.0.2")
+
+	ip, err := ClientIPStrict(req, trusted)
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.0.1", ip.String())
+
+	// ClientIP falls back to the last trusted proxy
+	req.Header.Set("X-Forwarded-For", "192.168.0.1, bogus")
+	assert.Equal(t, "10.0.0.1", ClientIP(req, trusted).String())
+	_, err = ClientIPStrict(req, trusted)
+	require.Error(t, err)
+
+	// the header of an untrusted client is not looked at
+	req.RemoteAddr = "192.168.0.2:1234"
+	ip, err = ClientIPStrict(req, trusted)
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.0.2", ip.String())
+
+	req.RemoteAddr = "bogus"
+	_, err = ClientIPStrict(req, trusted)
+	require.Error(t, err)
+}